@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+// fault fails requests of one operation.
+type fault struct {
+	op string
+	// status is the HTTP status of the failed response. GraphQL operations
+	// fail with an error message instead and ignore it.
+	status int
+	// probability is the chance that a request fails, in (0, 1].
+	probability float64
+}
+
+// err returns the error a request fails with, or nil if it is let through.
+func (f fault) err() error {
+	if rand.Float64() >= f.probability {
+		return nil
+	}
+	return &fakefly.StatusError{Code: f.status, Message: fmt.Sprintf("injected %s fault", f.op)}
+}
+
+// faultOps install a fault into the server hook of each operation.
+var faultOps = map[string]func(*fakefly.Server, fault){
+	"create-app": func(s *fakefly.Server, f fault) {
+		s.OnCreateApp = func(string, string) error { return f.err() }
+	},
+	"delete-app": func(s *fakefly.Server, f fault) {
+		s.OnDeleteApp = func(string) error { return f.err() }
+	},
+	"create-machine": func(s *fakefly.Server, f fault) {
+		s.OnCreateMachine = func(string, flyio.CreateMachineInput) error { return f.err() }
+	},
+	"update-machine": func(s *fakefly.Server, f fault) {
+		s.OnUpdateMachine = func(string, string, flyio.CreateMachineInput) error { return f.err() }
+	},
+	"delete-machine": func(s *fakefly.Server, f fault) {
+		s.OnDeleteMachine = func(string, string) error { return f.err() }
+	},
+	"wait-machine": func(s *fakefly.Server, f fault) {
+		s.OnWaitMachine = func(string, string, string) error { return f.err() }
+	},
+	"set-secrets": func(s *fakefly.Server, f fault) {
+		s.OnSetSecrets = func(string, map[string]string) error { return f.err() }
+	},
+	"allocate-ip": func(s *fakefly.Server, f fault) {
+		s.OnAllocateIP = func(string) error { return f.err() }
+	},
+	"allocate-ipv6": func(s *fakefly.Server, f fault) {
+		s.OnAllocateIPv6 = func(string) error { return f.err() }
+	},
+	"release-ip": func(s *fakefly.Server, f fault) {
+		s.OnReleaseIP = func(string, string) error { return f.err() }
+	},
+}
+
+// faultOpNames returns the operations faults can be injected into.
+func faultOpNames() string {
+	names := make([]string, 0, len(faultOps))
+	for name := range faultOps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// faultFlags is a repeatable --fault flag.
+type faultFlags []fault
+
+func (f *faultFlags) String() string {
+	parts := make([]string, len(*f))
+	for i, fault := range *f {
+		parts[i] = fmt.Sprintf("%s=%d:%g", fault.op, fault.status, fault.probability)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses <op>=<status>[:<probability>].
+func (f *faultFlags) Set(value string) error {
+	op, spec, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("%q: expected <op>=<status>[:<probability>]", value)
+	}
+	if _, known := faultOps[op]; !known {
+		return fmt.Errorf("unknown operation %q, expected one of %s", op, faultOpNames())
+	}
+	statusText, probabilityText, hasProbability := strings.Cut(spec, ":")
+	status, err := strconv.Atoi(statusText)
+	if err != nil || http.StatusText(status) == "" || status < 400 {
+		return fmt.Errorf("%q: invalid error status %q", value, statusText)
+	}
+	probability := 1.0
+	if hasProbability {
+		probability, err = strconv.ParseFloat(probabilityText, 64)
+		if err != nil || probability <= 0 || probability > 1 {
+			return fmt.Errorf("%q: invalid probability %q, must be in (0, 1]", value, probabilityText)
+		}
+	}
+	*f = append(*f, fault{op: op, status: status, probability: probability})
+	return nil
+}
+
+// install sets the hooks of server to inject the faults. A later fault for
+// the same operation replaces an earlier one.
+func (f faultFlags) install(server *fakefly.Server) {
+	for _, fault := range f {
+		faultOps[fault.op](server, fault)
+	}
+}
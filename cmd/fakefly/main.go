@@ -0,0 +1,136 @@
+// Command fakefly serves the fake Fly.io API of internal/fakefly, for running
+// the operator locally without a Fly.io account. Point the operator at it
+// with --fly-api-base-url and --fly-graphql-url.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ready := func(url string) {
+		log.Printf("fakefly listening on %s", url)
+		log.Printf("run the operator with --fly-api-base-url=%s --fly-graphql-url=%s/graphql", url, url)
+	}
+	if err := run(ctx, os.Args[1:], ready); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves the fake API until ctx is done, calling ready with its URL
+// once it accepts requests.
+func run(ctx context.Context, args []string, ready func(url string)) error {
+	fs := flag.NewFlagSet("fakefly", flag.ContinueOnError)
+	var (
+		addr         string
+		stateFile    string
+		saveInterval time.Duration
+		faults       faultFlags
+		deletionLag  int
+	)
+	fs.StringVar(&addr, "addr", ":4280", "The address the fake API listens on.")
+	fs.StringVar(&stateFile, "state-file", "", "If set, load Apps, Machines, IPs and secrets from this JSON file at startup and save them to it while running and on exit.")
+	fs.DurationVar(&saveInterval, "save-interval", 5*time.Second, "How often changes are saved to --state-file.")
+	fs.Var(&faults, "fault", "Fail requests of an operation, as <op>=<status>[:<probability>], e.g. create-machine=503:0.5. Repeatable. Operations: "+faultOpNames()+".")
+	fs.IntVar(&deletionLag, "app-deletion-drain", 0, "Keep the name of a deleted App pending deletion for this many further create attempts.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	server, err := fakefly.Listen(addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	defer server.Close()
+	server.AppDeletionDrain = deletionLag
+	faults.install(server)
+
+	var saved []byte
+	if stateFile != "" {
+		saved, err = loadState(server, stateFile)
+		if err != nil {
+			return err
+		}
+	}
+	ready(server.URL)
+
+	if stateFile == "" {
+		<-ctx.Done()
+		return nil
+	}
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			_, err := saveState(server, stateFile, saved)
+			return err
+		case <-ticker.C:
+			if saved, err = saveState(server, stateFile, saved); err != nil {
+				log.Printf("saving state: %v", err)
+			}
+		}
+	}
+}
+
+// loadState restores server from path, if it exists, and returns the state
+// as read.
+func loadState(server *fakefly.Server, path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state: %w", err)
+	}
+	var state fakefly.State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("decoding state %s: %w", path, err)
+	}
+	server.Restore(state)
+	return data, nil
+}
+
+// saveState writes the state of server to path unless it equals saved, and
+// returns the state written.
+func saveState(server *fakefly.Server, path string, saved []byte) ([]byte, error) {
+	data, err := json.MarshalIndent(server.State(), "", "  ")
+	if err != nil {
+		return saved, fmt.Errorf("encoding state: %w", err)
+	}
+	if string(data) == string(saved) {
+		return saved, nil
+	}
+	// Write and rename so a crash never leaves a truncated file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return saved, fmt.Errorf("saving state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return saved, fmt.Errorf("saving state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return saved, fmt.Errorf("saving state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return saved, fmt.Errorf("saving state: %w", err)
+	}
+	return data, nil
+}
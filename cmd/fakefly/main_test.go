@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+// start runs fakefly with args until the test ends and returns a client for
+// it and a func that stops it.
+func start(t *testing.T, args ...string) (*flyio.Client, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	urls := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, append([]string{"--addr", "127.0.0.1:0"}, args...), func(url string) { urls <- url })
+	}()
+
+	var url string
+	select {
+	case url = <-urls:
+	case err := <-done:
+		cancel()
+		t.Fatalf("fakefly exited at startup: %v", err)
+	case <-time.After(5 * time.Second):
+		cancel()
+		t.Fatal("fakefly did not start")
+	}
+
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("fakefly exited with %v", err)
+		}
+	}
+	t.Cleanup(stop)
+	client := flyio.NewClient("test-token").WithBaseURL(url).WithGraphQLURL(url+"/graphql").WithRetry(1, time.Millisecond)
+	return client, stop
+}
+
+func TestRun_PersistsState(t *testing.T) {
+	ctx := context.Background()
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	client, stop := start(t, "--state-file", stateFile, "--save-interval", time.Hour.String())
+	if err := client.EnsureApp(ctx, "demo", "personal"); err != nil {
+		t.Fatalf("EnsureApp failed: %v", err)
+	}
+	machine, err := client.CreateMachine(ctx, "demo", flyio.CreateMachineInput{Region: "syd", Config: flyio.MachineConfig{Image: "frps"}})
+	if err != nil {
+		t.Fatalf("CreateMachine failed: %v", err)
+	}
+	ip, err := client.AllocateDedicatedIPv4(ctx, "demo")
+	if err != nil {
+		t.Fatalf("AllocateDedicatedIPv4 failed: %v", err)
+	}
+	// The state is saved on exit even if the save interval has not passed.
+	stop()
+
+	client, _ = start(t, "--state-file", stateFile)
+	if _, err := client.GetMachine(ctx, "demo", machine.ID); err != nil {
+		t.Errorf("expected the Machine to survive a restart: %v", err)
+	}
+	ips, err := client.ListIPAddresses(ctx, "demo")
+	if err != nil {
+		t.Fatalf("ListIPAddresses failed: %v", err)
+	}
+	if len(ips) != 1 || ips[0].ID != ip.ID || ips[0].Address != ip.Address {
+		t.Errorf("expected IP %s %s to survive a restart, got %+v", ip.ID, ip.Address, ips)
+	}
+
+	// New resources do not reuse the IDs of restored ones.
+	next, err := client.AllocateDedicatedIPv4(ctx, "demo")
+	if err != nil {
+		t.Fatalf("AllocateDedicatedIPv4 failed: %v", err)
+	}
+	if next.ID == ip.ID || next.Address == ip.Address {
+		t.Errorf("expected a new IP, got %s %s again", next.ID, next.Address)
+	}
+}
+
+func TestRun_InjectsFaults(t *testing.T) {
+	ctx := context.Background()
+	client, _ := start(t, "--fault", "create-machine=503")
+
+	if err := client.EnsureApp(ctx, "demo", "personal"); err != nil {
+		t.Fatalf("EnsureApp failed: %v", err)
+	}
+	_, err := client.CreateMachine(ctx, "demo", flyio.CreateMachineInput{Region: "syd"})
+	var apiErr *flyio.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected an injected 503, got %v", err)
+	}
+}
+
+func TestRun_RejectsInvalidFaults(t *testing.T) {
+	for _, fault := range []string{"create-machine", "launch-rocket=500", "create-machine=200", "create-machine=500:2"} {
+		err := run(context.Background(), []string{"--addr", "127.0.0.1:0", "--fault", fault}, func(string) {
+			t.Errorf("%s: expected fakefly not to start", fault)
+		})
+		if err == nil {
+			t.Errorf("%s: expected an error", fault)
+		}
+	}
+}
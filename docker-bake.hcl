@@ -17,6 +17,9 @@ target "dev" {
 
 target "production" {
   dockerfile = "Dockerfile"
+  args = {
+    VERSION = VERSION
+  }
   tags = [
     "${IMAGE}:${VERSION}",
     "${IMAGE}:latest"
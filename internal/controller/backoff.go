@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// DefaultMaxProvisionBackoff caps the wait between provisioning
+	// attempts of a Service that keeps failing.
+	DefaultMaxProvisionBackoff = 5 * time.Minute
+
+	// provisionBackoffBase is the wait after a Service's first failed
+	// provisioning attempt. It doubles with each further failure.
+	provisionBackoffBase = 5 * time.Second
+)
+
+// provisionBackoff spaces out the provisioning retries of each Service, so a
+// failure that persists (e.g. the Fly.io org is out of IPs) does not have
+// the operator hammer the Fly.io API.
+type provisionBackoff struct {
+	// max caps the wait; zero disables the backoff, leaving retries to the
+	// controller's rate limiter.
+	max time.Duration
+
+	mu sync.Mutex
+	// failures counts the consecutive failed attempts of each Service.
+	failures map[types.NamespacedName]int
+}
+
+// WithProvisionBackoff retries a Service whose provisioning failed after a
+// wait that doubles with each consecutive failure, up to max, and resets
+// once it is provisioned. Zero leaves retries to the controller's rate
+// limiter.
+func (r *ServiceReconciler) WithProvisionBackoff(max time.Duration) *ServiceReconciler {
+	r.backoff.mu.Lock()
+	defer r.backoff.mu.Unlock()
+	r.backoff.max = max
+	return r
+}
+
+// failed records a failed attempt of key and returns how long to wait before
+// the next one, or zero if the backoff is disabled.
+func (b *provisionBackoff) failed(key types.NamespacedName) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.max <= 0 {
+		return 0
+	}
+	if b.failures == nil {
+		b.failures = make(map[types.NamespacedName]int)
+	}
+	n := b.failures[key]
+	b.failures[key] = n + 1
+
+	wait := provisionBackoffBase
+	for ; n > 0 && wait < b.max; n-- {
+		wait *= 2
+	}
+	return min(wait, b.max)
+}
+
+// reset forgets the failures of key, once it is provisioned or deleted.
+func (b *provisionBackoff) reset(key types.NamespacedName) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, key)
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestReconcile_ProvisionBackoff(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	env := newGroupTestEnv(t, svc)
+	env.r.WithProvisionBackoff(12 * time.Second)
+	env.server.OnAllocateIP = func(string) error { return errors.New("no IPs left") }
+
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+	for _, want := range []time.Duration{5 * time.Second, 10 * time.Second, 12 * time.Second, 12 * time.Second} {
+		res, err := env.r.Reconcile(context.Background(), req)
+		if err != nil {
+			t.Fatalf("expected a failed attempt to be requeued rather than returned, got %v", err)
+		}
+		if res.RequeueAfter != want {
+			t.Errorf("expected a retry after %s, got %+v", want, res)
+		}
+	}
+
+	env.server.OnAllocateIP = nil
+	env.reconcile(svc)
+	if !tunnel.Provisioned(svc) {
+		t.Fatal("expected the Service to be provisioned once allocation succeeds")
+	}
+	if n := len(env.r.backoff.failures); n != 0 {
+		t.Errorf("expected the backoff to reset once provisioned, got %d Services", n)
+	}
+}
+
+func TestProvisionBackoff_Disabled(t *testing.T) {
+	var b provisionBackoff
+	key := client.ObjectKey{Namespace: "default", Name: "web"}
+	if wait := b.failed(key); wait != 0 {
+		t.Errorf("expected no wait with the backoff disabled, got %s", wait)
+	}
+}
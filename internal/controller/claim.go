@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// claim records the operator identity on svc, provisioned before identities
+// were recorded, so operators with another identity leave it alone.
+func (r *ServiceReconciler) claim(ctx context.Context, svc *corev1.Service) error {
+	if svc.Annotations[tunnel.AnnotationOperatorIdentity] != "" {
+		return nil
+	}
+	patch := client.MergeFrom(svc.DeepCopy())
+	if svc.Annotations == nil {
+		svc.Annotations = make(map[string]string)
+	}
+	svc.Annotations[tunnel.AnnotationOperatorIdentity] = r.tunnelManager.Identity(svc)
+	if err := r.client.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("recording operator identity: %w", err)
+	}
+	return nil
+}
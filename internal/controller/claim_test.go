@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestReconcile_ClaimsAndRespectsOperatorIdentity(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	env := newGroupTestEnv(t, svc)
+
+	env.reconcile(svc)
+	identity := svc.Annotations[tunnel.AnnotationOperatorIdentity]
+	if !strings.HasPrefix(identity, "org=") {
+		t.Fatalf("expected the Service to be claimed on provision, got %q", identity)
+	}
+
+	// A tunnel from before identities were recorded is claimed on update.
+	delete(svc.Annotations, tunnel.AnnotationOperatorIdentity)
+	if err := env.kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	env.reconcile(svc)
+	if got := svc.Annotations[tunnel.AnnotationOperatorIdentity]; got != identity {
+		t.Fatalf("expected the legacy tunnel to be claimed as %q, got %q", identity, got)
+	}
+
+	// Claimed by someone else, the Service is left alone, deletion included.
+	svc.Annotations[tunnel.AnnotationOperatorIdentity] = "org=other,cluster=,class=" + *svc.Spec.LoadBalancerClass
+	if err := env.kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	if err := env.kubeClient.Delete(context.Background(), svc); err != nil {
+		t.Fatalf("deleting service: %v", err)
+	}
+	env.reconcile(svc)
+	if env.server.AppCount() != 1 {
+		t.Errorf("expected the tunnel to be left to its owner, got %d apps", env.server.AppCount())
+	}
+	if len(svc.Finalizers) == 0 {
+		t.Error("expected the finalizer to be left for the owner to remove")
+	}
+	if !hasEvent(env.events(), "ClaimedByOtherOperator") {
+		t.Error("expected a ClaimedByOtherOperator event")
+	}
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestReconciler_MultipleLoadBalancerClasses(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, "example.com/cheap", "", "example.com/premium", "example.com/cheap")
+	if want := []string{"example.com/cheap", "example.com/premium"}; !slices.Equal(r.loadBalancerClasses, want) {
+		t.Fatalf("expected classes %v, got %v", want, r.loadBalancerClasses)
+	}
+
+	svc := func(class *string) *corev1.Service {
+		return &corev1.Service{Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, LoadBalancerClass: class}}
+	}
+	filter := r.serviceFilter()
+	for _, tt := range []struct {
+		name   string
+		class  *string
+		reason string
+	}{
+		{name: "first class", class: ptr.To("example.com/cheap")},
+		{name: "second class", class: ptr.To("example.com/premium")},
+		{name: "no class", reason: IgnoredNoClass},
+		{name: "other class", class: ptr.To(DefaultLoadBalancerClass), reason: IgnoredOtherClass},
+	} {
+		s := svc(tt.class)
+		if got := r.ignoredReason(s); got != tt.reason {
+			t.Errorf("%s: expected reason %q, got %q", tt.name, tt.reason, got)
+		}
+		if got := filter.Create(event.CreateEvent{Object: s}); got != (tt.reason == "") {
+			t.Errorf("%s: expected the create predicate to return %v", tt.name, tt.reason == "")
+		}
+	}
+
+	if got := r.describeClasses("or"); got != `"example.com/cheap" or "example.com/premium"` {
+		t.Errorf("unexpected class description %s", got)
+	}
+}
+
+func TestNewServiceReconciler_DefaultClass(t *testing.T) {
+	r := NewServiceReconciler(nil, nil)
+	if len(r.loadBalancerClasses) != 1 || r.loadBalancerClasses[0] != DefaultLoadBalancerClass {
+		t.Errorf("expected only %q, got %v", DefaultLoadBalancerClass, r.loadBalancerClasses)
+	}
+	if got := r.describeClasses("and"); got != `"`+DefaultLoadBalancerClass+`"` {
+		t.Errorf("unexpected class description %s", got)
+	}
+}
@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionControlChannelConnected is set on the Service status by the drift
+// check: True while frpc holds a control connection to frps, False with the
+// error frpc reports otherwise.
+const ConditionControlChannelConnected = "fly-tunnel-operator.dev/ControlChannelConnected"
+
+// reconcileControlChannel refreshes the ControlChannelConnected condition and
+// emits a Warning event when the channel goes down.
+func (r *ServiceReconciler) reconcileControlChannel(ctx context.Context, svc *corev1.Service) error {
+	connected, message, err := r.tunnelManager.ControlChannelStatus(ctx, svc)
+	if err != nil {
+		return err
+	}
+
+	wasDisconnected := meta.IsStatusConditionFalse(svc.Status.Conditions, ConditionControlChannelConnected)
+	status, reason := metav1.ConditionTrue, "Connected"
+	if connected {
+		message = "frpc is connected to frps"
+	} else {
+		status, reason = metav1.ConditionFalse, "Disconnected"
+	}
+	if _, err := r.setCondition(ctx, svc, ConditionControlChannelConnected, status, reason, message); err != nil {
+		return err
+	}
+
+	if !connected && !wasDisconnected {
+		r.event(svc, corev1.EventTypeWarning, "ControlChannelDisconnected", "frpc is not connected to frps: %s", message)
+	}
+	return nil
+}
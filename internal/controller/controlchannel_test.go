@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// stubAdminReader reads proxy status from a stub frpc admin API server
+// instead of the frpc pods.
+type stubAdminReader struct {
+	addr string
+}
+
+func (s stubAdminReader) ProxyStatuses(ctx context.Context, _, _ string) ([]frp.ProxyStatus, error) {
+	return frp.FetchProxyStatus(ctx, http.DefaultClient, s.addr, "")
+}
+
+func TestReconcile_ControlChannelConnected(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	var body atomic.Value
+	body.Store(`{"tcp":[{"name":"default-web-http","type":"tcp","status":"running","remote_addr":":31000"}]}`)
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer admin.Close()
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fly-tunnel-operator-system"}}
+	lbClass := DefaultLoadBalancerClass
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{frp.AnnotationRandomRemotePorts: "true"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: &lbClass,
+			Ports:             []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(ns, svc).
+		WithStatusSubresource(&corev1.Service{}).
+		Build()
+
+	flyClient := flyio.NewClient("test-token").
+		WithBaseURL(server.URL).
+		WithGraphQLURL(server.URL + "/graphql")
+	tunnelMgr := tunnel.NewManager(flyClient, kubeClient, tunnel.Config{
+		FlyOrg:            "personal",
+		FlyRegion:         "syd",
+		OperatorNamespace: ns.Name,
+	}).WithProxyStatusReader(stubAdminReader{addr: strings.TrimPrefix(admin.URL, "http://")})
+	recorder := record.NewFakeRecorder(100)
+	r := NewServiceReconciler(kubeClient, tunnelMgr, lbClass).WithEventRecorder(recorder)
+
+	key := client.ObjectKeyFromObject(svc)
+	reconcileAndCheck := func(want metav1.ConditionStatus) *metav1.Condition {
+		t.Helper()
+		if _, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key}); err != nil {
+			t.Fatalf("Reconcile failed: %v", err)
+		}
+		if err := kubeClient.Get(context.Background(), key, svc); err != nil {
+			t.Fatalf("getting service: %v", err)
+		}
+		cond := meta.FindStatusCondition(svc.Status.Conditions, ConditionControlChannelConnected)
+		if cond == nil || cond.Status != want {
+			t.Fatalf("expected ControlChannelConnected=%s, got %+v", want, cond)
+		}
+		return cond
+	}
+
+	// The first reconcile provisions; the drift check runs on the next.
+	if _, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	reconcileAndCheck(metav1.ConditionTrue)
+
+	body.Store(`{"tcp":[{"name":"default-web-http","type":"tcp","status":"wait start","err":"login to server failed: i/o timeout"}]}`)
+	cond := reconcileAndCheck(metav1.ConditionFalse)
+	if !strings.Contains(cond.Message, "login to server failed: i/o timeout") {
+		t.Errorf("expected the frpc error in the condition message, got %q", cond.Message)
+	}
+	reconcileAndCheck(metav1.ConditionFalse)
+
+	var warnings []string
+	for len(recorder.Events) > 0 {
+		if e := <-recorder.Events; strings.Contains(e, "ControlChannelDisconnected") {
+			warnings = append(warnings, e)
+		}
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected one ControlChannelDisconnected event, got %q", warnings)
+	}
+	if !strings.HasPrefix(warnings[0], corev1.EventTypeWarning) || !strings.Contains(warnings[0], "login to server failed") {
+		t.Errorf("unexpected event: %q", warnings[0])
+	}
+
+	body.Store(`{"tcp":[{"name":"default-web-http","type":"tcp","status":"running","remote_addr":":31000"}]}`)
+	reconcileAndCheck(metav1.ConditionTrue)
+}
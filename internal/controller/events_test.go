@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestReconcile_TunnelUpdatedOnlyOnChange(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	env := newGroupTestEnv(t, svc)
+
+	env.reconcile(svc)
+	env.reconcile(svc)
+	env.events()
+
+	env.reconcile(svc)
+	if events := env.events(); countEvents(events, "TunnelUpdated") != 0 {
+		t.Errorf("expected no TunnelUpdated event from a resync, got %v", events)
+	}
+
+	svc.Spec.Ports[0].Port = 8080
+	if err := env.kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	env.reconcile(svc)
+	if events := env.events(); countEvents(events, "TunnelUpdated") != 1 {
+		t.Errorf("expected one TunnelUpdated event after a port change, got %v", events)
+	}
+}
+
+// countEvents returns how many of events have reason.
+func countEvents(events []string, reason string) int {
+	n := 0
+	for _, e := range events {
+		if strings.Contains(e, " "+reason+" ") {
+			n++
+		}
+	}
+	return n
+}
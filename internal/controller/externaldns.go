@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+const (
+	// AnnotationExternalDNSTarget is the external-dns annotation setting the
+	// values of the records it creates for a Service. With external-dns
+	// hints, the operator sets it to the published tunnel IPs, unless the
+	// user set it.
+	AnnotationExternalDNSTarget = "external-dns.alpha.kubernetes.io/target"
+
+	// AnnotationFlyHostname is set with external-dns hints to the fly.dev
+	// hostname of the tunnel's App, for wildcard or manually managed records
+	// to CNAME to.
+	AnnotationFlyHostname = "fly-tunnel-operator.dev/fly-hostname"
+
+	// annotationExternalDNSTargetManaged records that the operator set
+	// AnnotationExternalDNSTarget, so a target set by the user is never
+	// changed or removed.
+	annotationExternalDNSTargetManaged = "fly-tunnel-operator.dev/external-dns-target-managed"
+)
+
+// WithExternalDNSHints makes the reconciler publish the tunnel IPs and the
+// fly.dev hostname of each tunnel in the annotations external-dns and
+// manual DNS setups read, once its IP is published in the Service status.
+// They follow the status as the IP changes, and are removed when the IP is
+// withdrawn or the tunnel torn down.
+func (r *ServiceReconciler) WithExternalDNSHints() *ServiceReconciler {
+	r.externalDNSHints = true
+	return r
+}
+
+// externalDNSHints returns the hint annotations of svc, "" for those it
+// should not have.
+func externalDNSHints(svc *corev1.Service) map[string]string {
+	hints := map[string]string{
+		AnnotationExternalDNSTarget:        "",
+		AnnotationFlyHostname:              "",
+		annotationExternalDNSTargetManaged: "",
+	}
+	ips := ingressIPs(svc)
+	if len(ips) == 0 || !svc.DeletionTimestamp.IsZero() {
+		return hints
+	}
+	if app := svc.Annotations[tunnel.AnnotationFlyApp]; app != "" {
+		hints[AnnotationFlyHostname] = app + ".fly.dev"
+	}
+	hints[AnnotationExternalDNSTarget] = strings.Join(ips, ",")
+	hints[annotationExternalDNSTargetManaged] = "true"
+	return hints
+}
+
+// reconcileExternalDNSHints brings the hint annotations of svc in line with
+// its published IPs, if hints are enabled. A target set by the user is left
+// alone.
+func (r *ServiceReconciler) reconcileExternalDNSHints(ctx context.Context, svc *corev1.Service) error {
+	if !r.externalDNSHints {
+		return nil
+	}
+	hints := externalDNSHints(svc)
+	if _, set := svc.Annotations[AnnotationExternalDNSTarget]; set && svc.Annotations[annotationExternalDNSTargetManaged] != "true" {
+		delete(hints, AnnotationExternalDNSTarget)
+		delete(hints, annotationExternalDNSTargetManaged)
+	}
+
+	changed := false
+	for key, value := range hints {
+		if current, ok := svc.Annotations[key]; current != value || ok != (value != "") {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	patch := client.MergeFrom(svc.DeepCopy())
+	if svc.Annotations == nil {
+		svc.Annotations = make(map[string]string)
+	}
+	for key, value := range hints {
+		if value != "" {
+			svc.Annotations[key] = value
+		} else {
+			delete(svc.Annotations, key)
+		}
+	}
+	if err := r.client.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("updating external-dns hints: %w", err)
+	}
+	log.FromContext(ctx).Info("Updated external-dns hints", "target", svc.Annotations[AnnotationExternalDNSTarget])
+	return nil
+}
@@ -0,0 +1,95 @@
+package controller_test
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/controller"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// waitForAnnotations waits until the annotations of the Service key satisfy
+// done, and returns them.
+func waitForAnnotations(t *testing.T, key types.NamespacedName, done func(map[string]string) bool) map[string]string {
+	t.Helper()
+	var svc corev1.Service
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		if err := k8sClient.Get(testCtx, key, &svc); err == nil && done(svc.Annotations) {
+			return svc.Annotations
+		}
+		time.Sleep(testInterval)
+	}
+	t.Fatalf("timed out waiting for the annotations of Service %s, last saw %v", key, svc.Annotations)
+	return nil
+}
+
+func TestReconcile_ExternalDNSHints(t *testing.T) {
+	ensureNamespace(t, "test-dns-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	// Holds the Service after the operator's finalizer is gone, so the
+	// annotations can be checked after teardown.
+	const holdFinalizer = "test.fly-tunnel-operator.dev/hold"
+	lbClass := controller.DefaultLoadBalancerClass
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test-svc-dns",
+			Namespace:  "test-dns-ns",
+			Finalizers: []string{holdFinalizer},
+			Annotations: map[string]string{
+				"external-dns.alpha.kubernetes.io/hostname": "app.example.com",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: &lbClass,
+			Ports:             []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+			Selector:          map[string]string{"app": "test"},
+		},
+	}
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	key := types.NamespacedName{Name: "test-svc-dns", Namespace: "test-dns-ns"}
+
+	ip := waitForServiceIP(t, key, testTimeout)
+	annotations := waitForAnnotations(t, key, func(a map[string]string) bool {
+		return a[controller.AnnotationExternalDNSTarget] != ""
+	})
+	if got := annotations[controller.AnnotationExternalDNSTarget]; got != ip {
+		t.Errorf("expected the target %q, got %q", ip, got)
+	}
+	if got, want := annotations[controller.AnnotationFlyHostname], annotations[tunnel.AnnotationFlyApp]+".fly.dev"; got != want {
+		t.Errorf("expected the fly hostname %q, got %q", want, got)
+	}
+	if got := annotations["external-dns.alpha.kubernetes.io/hostname"]; got != "app.example.com" {
+		t.Errorf("expected the user's hostname to be kept, got %q", got)
+	}
+
+	if err := k8sClient.Delete(testCtx, svc); err != nil {
+		t.Fatalf("failed to delete service: %v", err)
+	}
+	annotations = waitForAnnotations(t, key, func(a map[string]string) bool {
+		_, target := a[controller.AnnotationExternalDNSTarget]
+		_, hostname := a[controller.AnnotationFlyHostname]
+		return !target && !hostname
+	})
+	if got := annotations["external-dns.alpha.kubernetes.io/hostname"]; got != "app.example.com" {
+		t.Errorf("expected the user's hostname to be kept, got %q", got)
+	}
+
+	if err := k8sClient.Get(testCtx, key, svc); err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	controllerutil.RemoveFinalizer(svc, holdFinalizer)
+	if err := k8sClient.Update(testCtx, svc); err != nil {
+		t.Fatalf("failed to release service: %v", err)
+	}
+	waitForServiceDeletion(t, key, testTimeout)
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// WithoutFinalizer stops the reconciler from adding its finalizer, so
+// Services can be deleted without waiting for their tunnel to be torn down.
+// Tunnels are then torn down best-effort from the delete events the
+// reconciler observes; a delete missed while the operator is down leaks the
+// tunnel until OrphanCollector (or an external process) removes it.
+func (r *ServiceReconciler) WithoutFinalizer() *ServiceReconciler {
+	r.noFinalizer = true
+	return r
+}
+
+// rememberDeleted keeps the last state of a Service deleted without a
+// finalizer, whose tunnel annotations are otherwise gone by the time its
+// delete is reconciled.
+func (r *ServiceReconciler) rememberDeleted(svc *corev1.Service) {
+	if !r.noFinalizer || !svc.DeletionTimestamp.IsZero() {
+		// Services deleted through a finalizer were torn down already.
+		return
+	}
+	r.deletedMu.Lock()
+	defer r.deletedMu.Unlock()
+	if r.deleted == nil {
+		r.deleted = make(map[types.NamespacedName]*corev1.Service)
+	}
+	r.deleted[types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}] = svc.DeepCopy()
+}
+
+// teardownDeleted tears down the tunnel of a Service observed being deleted
+// without a finalizer. A failed teardown is retried.
+func (r *ServiceReconciler) teardownDeleted(ctx context.Context, key types.NamespacedName) (reconcile.Result, error) {
+	r.forgetPending(key)
+	r.backoff.reset(key)
+	r.forgetUnknownAnnotations(key)
+	r.deletedMu.Lock()
+	svc := r.deleted[key]
+	delete(r.deleted, key)
+	r.deletedMu.Unlock()
+	if svc == nil {
+		return reconcile.Result{}, nil
+	}
+
+	log.FromContext(ctx).Info("Tearing down tunnel for deleted Service")
+	if err := r.tunnelManager.Teardown(ctx, svc); err != nil {
+		r.rememberDeleted(svc)
+		return reconcile.Result{}, fmt.Errorf("tearing down tunnel: %w", err)
+	}
+	return reconcile.Result{}, nil
+}
+
+// OrphanCollector returns a Runnable that tears down, every interval, the
+// tunnels whose Service no longer exists.
+func (r *ServiceReconciler) OrphanCollector(interval time.Duration) manager.Runnable {
+	return manager.RunnableFunc(func(ctx context.Context) error {
+		logger := log.FromContext(ctx).WithName("orphan-gc")
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			collected, err := r.tunnelManager.CollectOrphans(log.IntoContext(ctx, logger))
+			if err != nil {
+				logger.Error(err, "Failed to collect orphaned tunnels")
+			}
+			if collected > 0 {
+				logger.Info("Tore down orphaned tunnels", "count", collected)
+			}
+		}
+	})
+}
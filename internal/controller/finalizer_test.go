@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// newFinalizerTestReconciler returns a reconciler backed by a fake cluster
+// and server, with a managed Service created and reconciled once.
+func newFinalizerTestReconciler(t *testing.T, server *fakefly.Server, withoutFinalizer bool) (*ServiceReconciler, client.Client, *corev1.Service) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fly-tunnel-operator-system"}}
+	lbClass := DefaultLoadBalancerClass
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: &lbClass,
+			Ports:             []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(ns, svc).
+		WithStatusSubresource(&corev1.Service{}).
+		Build()
+
+	flyClient := flyio.NewClient("test-token").
+		WithBaseURL(server.URL).
+		WithGraphQLURL(server.URL + "/graphql")
+	tunnelMgr := tunnel.NewManager(flyClient, kubeClient, tunnel.Config{
+		FlyOrg:            "personal",
+		FlyRegion:         "syd",
+		OperatorNamespace: ns.Name,
+	})
+	r := NewServiceReconciler(kubeClient, tunnelMgr, lbClass)
+	if withoutFinalizer {
+		r.WithoutFinalizer()
+	}
+
+	key := client.ObjectKeyFromObject(svc)
+	if _, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), key, svc); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	if svc.Annotations[tunnel.AnnotationFlyApp] == "" {
+		t.Fatal("expected the tunnel to be provisioned")
+	}
+	return r, kubeClient, svc
+}
+
+func TestReconcile_Finalizer(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	_, _, svc := newFinalizerTestReconciler(t, server, false)
+	if !controllerutil.ContainsFinalizer(svc, FinalizerName) {
+		t.Error("expected the finalizer to be added by default")
+	}
+}
+
+func TestReconcile_WithoutFinalizer(t *testing.T) {
+	tests := []struct {
+		name string
+		// observed reports whether the operator sees the delete event.
+		observed bool
+	}{
+		{name: "delete observed", observed: true},
+		{name: "delete missed, collected as orphan", observed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			r, kubeClient, svc := newFinalizerTestReconciler(t, server, true)
+			if controllerutil.ContainsFinalizer(svc, FinalizerName) {
+				t.Fatal("expected no finalizer")
+			}
+			app := svc.Annotations[tunnel.AnnotationFlyApp]
+
+			// Without a finalizer the Service goes at once.
+			if err := kubeClient.Delete(context.Background(), svc); err != nil {
+				t.Fatalf("deleting service: %v", err)
+			}
+			if tt.observed && !r.serviceFilter().Delete(event.DeleteEvent{Object: svc}) {
+				t.Fatal("expected the delete event to be reconciled")
+			}
+			key := client.ObjectKeyFromObject(svc)
+			if _, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key}); err != nil {
+				t.Fatalf("Reconcile failed: %v", err)
+			}
+
+			if !tt.observed {
+				if !server.HasApp(app) {
+					t.Fatal("expected a missed delete to leave the tunnel until collected")
+				}
+				if n, err := r.tunnelManager.CollectOrphans(context.Background()); err != nil || n != 1 {
+					t.Fatalf("expected the orphan GC to collect the tunnel, got %d, %v", n, err)
+				}
+			}
+			if server.HasApp(app) {
+				t.Errorf("expected app %s to be torn down", app)
+			}
+		})
+	}
+}
+
+func TestReconcile_DeleteWhileProvisioningFails(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	env := newGroupTestEnv(t, svc)
+	env.server.OnCreateApp = func(string, string) error {
+		return &fakefly.StatusError{Code: http.StatusInternalServerError, Message: "fly.io is having a bad day"}
+	}
+	key := client.ObjectKeyFromObject(svc)
+	if _, err := env.r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key}); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if err := env.kubeClient.Get(context.Background(), key, svc); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	if !controllerutil.ContainsFinalizer(svc, FinalizerName) || tunnel.HasTunnelState(svc) {
+		t.Fatalf("expected a finalized Service without tunnel state, got finalizers %v and annotations %v", svc.Finalizers, svc.Annotations)
+	}
+	env.events()
+
+	if err := env.kubeClient.Delete(context.Background(), svc); err != nil {
+		t.Fatalf("deleting service: %v", err)
+	}
+	if _, err := env.r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if err := env.kubeClient.Get(context.Background(), key, svc); err == nil {
+		t.Fatalf("expected the Service to be gone after one reconcile, still has finalizers %v", svc.Finalizers)
+	}
+	if events := env.events(); len(events) != 0 {
+		t.Errorf("expected a quiet removal, got events %v", events)
+	}
+	if env.server.AppCount() != 0 {
+		t.Errorf("expected no apps, got %d", env.server.AppCount())
+	}
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// reconcileGroupChange moves a provisioned Service whose tunnel group
+// annotation no longer matches the group its tunnel is in. A move the
+// target group cannot take is refused and retried on the next resync,
+// leaving the Service on its current tunnel.
+func (r *ServiceReconciler) reconcileGroupChange(ctx context.Context, svc *corev1.Service, from, to string) (reconcile.Result, error) {
+	logger := log.FromContext(ctx).WithValues("fromGroup", from, "toGroup", to)
+	logger.Info("Moving Service between tunnel groups")
+	r.event(svc, corev1.EventTypeNormal, "TunnelGroupChanging", "Moving from %s to %s", describeGroup(from), describeGroup(to))
+
+	result, err := r.tunnelManager.ChangeTunnelGroup(ctx, svc)
+	if result == nil {
+		switch {
+		case errors.Is(err, tunnel.ErrGroupPortConflict):
+			r.event(svc, corev1.EventTypeWarning, "TunnelGroupConflict", "Not moving to %s: %v", describeGroup(to), err)
+			return r.resync(), nil
+		case errors.Is(err, tunnel.ErrPermanent):
+			r.event(svc, corev1.EventTypeWarning, "TunnelGroupChangeFailed", "Cannot move to %s: %v", describeGroup(to), err)
+			return reconcile.Result{}, nil
+		}
+		r.event(svc, corev1.EventTypeWarning, "TunnelGroupChangeFailed", "Moving to %s failed, will retry: %v", describeGroup(to), err)
+		return reconcile.Result{}, fmt.Errorf("changing tunnel group: %w", err)
+	}
+	if err != nil {
+		logger.Error(err, "Failed to drain previous tunnel")
+		r.event(svc, corev1.EventTypeWarning, "TunnelGroupDrainFailed", "Moved to %s, but draining %s failed: %v", describeGroup(to), describeGroup(from), err)
+	}
+
+	// Re-fetch the Service to get the latest version before patching.
+	if err := r.client.Get(ctx, client.ObjectKeyFromObject(svc), svc); err != nil {
+		return reconcile.Result{}, fmt.Errorf("re-fetching service: %w", err)
+	}
+	// Drop the state of the previous tunnel that the new one does not
+	// replace.
+	for _, key := range []string{
+		tunnel.AnnotationControlPort,
+		tunnel.AnnotationFrpsDashboardSecret,
+		tunnel.AnnotationAssignedRemotePorts,
+	} {
+		delete(svc.Annotations, key)
+	}
+	recordTunnel(svc, result)
+	if err := r.client.Update(ctx, svc); err != nil {
+		return reconcile.Result{}, fmt.Errorf("updating service annotations: %w", err)
+	}
+
+	logger.Info("Moved Service between tunnel groups", "publicIP", result.PublicIP)
+	r.event(svc, corev1.EventTypeNormal, "TunnelGroupChanged", "Moved to %s with public IP %s", describeGroup(to), result.PublicIP)
+
+	res, err := r.publishStatus(ctx, svc)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	return soonest(res, r.resync()), nil
+}
+
+// describeGroup names a tunnel group in events, "" being a tunnel of the
+// Service's own.
+func describeGroup(group string) string {
+	if group == "" {
+		return "its own tunnel"
+	}
+	return "tunnel group " + strconv.Quote(group)
+}
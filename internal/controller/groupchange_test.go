@@ -0,0 +1,201 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// groupTestEnv reconciles Services against a fake Fly.io API and a fake
+// cluster.
+type groupTestEnv struct {
+	t          *testing.T
+	server     *fakefly.Server
+	kubeClient client.Client
+	recorder   *record.FakeRecorder
+	r          *ServiceReconciler
+}
+
+func newGroupTestEnv(t *testing.T, services ...*corev1.Service) *groupTestEnv {
+	server := fakefly.NewServer()
+	t.Cleanup(server.Close)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fly-tunnel-operator-system"}}
+	objects := []client.Object{ns}
+	for _, svc := range services {
+		objects = append(objects, svc)
+	}
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&corev1.Service{}).
+		Build()
+
+	flyClient := flyio.NewClient("test-token").
+		WithBaseURL(server.URL).
+		WithGraphQLURL(server.URL + "/graphql")
+	recorder := record.NewFakeRecorder(100)
+	tunnelMgr := tunnel.NewManager(flyClient, kubeClient, tunnel.Config{
+		FlyOrg:            "personal",
+		FlyRegion:         "syd",
+		OperatorNamespace: ns.Name,
+	}).WithEventRecorder(recorder)
+	return &groupTestEnv{
+		t:          t,
+		server:     server,
+		kubeClient: kubeClient,
+		recorder:   recorder,
+		r:          NewServiceReconciler(kubeClient, tunnelMgr, DefaultLoadBalancerClass).WithEventRecorder(recorder),
+	}
+}
+
+// reconcile reconciles svc and refreshes it from the cluster.
+func (e *groupTestEnv) reconcile(svc *corev1.Service) {
+	e.t.Helper()
+	key := client.ObjectKeyFromObject(svc)
+	if _, err := e.r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key}); err != nil {
+		e.t.Fatalf("Reconcile failed: %v", err)
+	}
+	if err := e.kubeClient.Get(context.Background(), key, svc); err != nil {
+		e.t.Fatalf("getting service: %v", err)
+	}
+}
+
+// setGroup sets the tunnel group annotation of svc, "" removing it.
+func (e *groupTestEnv) setGroup(svc *corev1.Service, group string) {
+	e.t.Helper()
+	if group == "" {
+		delete(svc.Annotations, tunnel.AnnotationTunnelGroup)
+	} else {
+		svc.Annotations[tunnel.AnnotationTunnelGroup] = group
+	}
+	if err := e.kubeClient.Update(context.Background(), svc); err != nil {
+		e.t.Fatalf("updating service: %v", err)
+	}
+}
+
+// events drains the recorded events.
+func (e *groupTestEnv) events() []string {
+	var events []string
+	for len(e.recorder.Events) > 0 {
+		events = append(events, <-e.recorder.Events)
+	}
+	return events
+}
+
+func groupTestService(name, namespace, group string) *corev1.Service {
+	lbClass := DefaultLoadBalancerClass
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: map[string]string{}},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: &lbClass,
+			Ports:             []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	if group != "" {
+		svc.Annotations[tunnel.AnnotationTunnelGroup] = group
+	}
+	return svc
+}
+
+func hasEvent(events []string, reason string) bool {
+	for _, e := range events {
+		if strings.Contains(e, " "+reason+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReconcile_TunnelGroupChange(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	env := newGroupTestEnv(t, svc)
+
+	env.reconcile(svc)
+	standaloneIP := svc.Annotations[tunnel.AnnotationPublicIP]
+	if standaloneIP == "" || strings.HasPrefix(svc.Annotations[tunnel.AnnotationFrpcDeployment], "tunnel-group-") {
+		t.Fatalf("expected a tunnel of its own, got %v", svc.Annotations)
+	}
+	env.events()
+
+	// Standalone to group: the group tunnel replaces the Service's own.
+	env.setGroup(svc, "a")
+	env.reconcile(svc)
+	if got := svc.Annotations[tunnel.AnnotationFrpcDeployment]; got != "tunnel-group-a" {
+		t.Fatalf("expected the Service to be served by group a, got frpc %q", got)
+	}
+	if env.server.AppCount() != 1 || env.server.MachineCount() != 1 {
+		t.Errorf("expected only the group tunnel to remain, got %d apps and %d machines", env.server.AppCount(), env.server.MachineCount())
+	}
+	groupIP := svc.Annotations[tunnel.AnnotationPublicIP]
+	if groupIP == standaloneIP || len(svc.Status.LoadBalancer.Ingress) != 1 || svc.Status.LoadBalancer.Ingress[0].IP != groupIP {
+		t.Errorf("expected the group IP %s to be published, got %+v", groupIP, svc.Status.LoadBalancer.Ingress)
+	}
+	if got := svc.Annotations[tunnel.AnnotationAssignedRemotePorts]; got != "80/tcp=80" {
+		t.Errorf("expected the Service to keep its public port, got %q", got)
+	}
+	events := env.events()
+	if !hasEvent(events, "TunnelGroupChanging") || !hasEvent(events, "TunnelGroupChanged") {
+		t.Errorf("expected the move in the event trail, got %q", events)
+	}
+
+	// Group to group: the last member leaving deletes group a.
+	env.setGroup(svc, "b")
+	env.reconcile(svc)
+	if got := svc.Annotations[tunnel.AnnotationFrpcDeployment]; got != "tunnel-group-b" {
+		t.Fatalf("expected the Service to be served by group b, got frpc %q", got)
+	}
+	if env.server.AppCount() != 1 || env.server.MachineCount() != 1 {
+		t.Errorf("expected only group b to remain, got %d apps and %d machines", env.server.AppCount(), env.server.MachineCount())
+	}
+	if svc.Status.LoadBalancer.Ingress[0].IP == groupIP {
+		t.Errorf("expected group b's IP to be published, got %+v", svc.Status.LoadBalancer.Ingress)
+	}
+
+	// A later reconcile is a plain update.
+	env.events()
+	env.reconcile(svc)
+	if events := env.events(); hasEvent(events, "TunnelGroupChanging") {
+		t.Errorf("expected no further move, got %q", events)
+	}
+}
+
+func TestReconcile_TunnelGroupChangeConflict(t *testing.T) {
+	api := groupTestService("api", "default", "shared")
+	web := groupTestService("web", "default", "")
+	env := newGroupTestEnv(t, api, web)
+
+	env.reconcile(api)
+	env.reconcile(web)
+	standalone := web.Annotations[tunnel.AnnotationFrpcDeployment]
+	env.events()
+
+	// The group already serves port 80, which web is published on.
+	env.setGroup(web, "shared")
+	env.reconcile(web)
+	if got := web.Annotations[tunnel.AnnotationFrpcDeployment]; got != standalone {
+		t.Errorf("expected the Service to stay on its own tunnel, got frpc %q", got)
+	}
+	if env.server.AppCount() != 2 {
+		t.Errorf("expected both tunnels to remain, got %d apps", env.server.AppCount())
+	}
+	events := env.events()
+	if !hasEvent(events, "TunnelGroupConflict") || hasEvent(events, "TunnelGroupChanged") {
+		t.Errorf("expected the move to be refused, got %q", events)
+	}
+}
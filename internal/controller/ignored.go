@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/metrics"
+)
+
+// Reasons a LoadBalancer Service is observed but not managed.
+const (
+	IgnoredNoClass    = "no-load-balancer-class"
+	IgnoredOtherClass = "other-load-balancer-class"
+)
+
+// ignoredReasons lists every reason, so each is reported even at zero.
+var ignoredReasons = []string{IgnoredNoClass, IgnoredOtherClass}
+
+// notLoadBalancer marks Services that are not LoadBalancers. They are never
+// the operator's concern, so they are not reported as ignored.
+const notLoadBalancer = "not-load-balancer"
+
+// DefaultIgnoredSummaryInterval is how often ignored Services are counted.
+const DefaultIgnoredSummaryInterval = 5 * time.Minute
+
+// ignoredReason returns why svc is not managed by this operator, or "" if it
+// is. isManaged is defined by it, so the reported reasons cannot drift from
+// what the controller does.
+func (r *ServiceReconciler) ignoredReason(svc *corev1.Service) string {
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return notLoadBalancer
+	}
+	if svc.Spec.LoadBalancerClass == nil {
+		return IgnoredNoClass
+	}
+	if !slices.Contains(r.loadBalancerClasses, *svc.Spec.LoadBalancerClass) {
+		return IgnoredOtherClass
+	}
+	return ""
+}
+
+// describeClasses lists the managed loadBalancerClasses quoted, the last
+// joined with conjunction, e.g. `"a", "b" or "c"`.
+func (r *ServiceReconciler) describeClasses(conjunction string) string {
+	quoted := make([]string, len(r.loadBalancerClasses))
+	for i, class := range r.loadBalancerClasses {
+		quoted[i] = fmt.Sprintf("%q", class)
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " " + conjunction + " " + quoted[len(quoted)-1]
+}
+
+// WithExplainIgnored makes the ignored Services summary record a one-time
+// Normal event on each ignored LoadBalancer Service saying why it is not
+// managed.
+func (r *ServiceReconciler) WithExplainIgnored() *ServiceReconciler {
+	r.explainIgnored = true
+	return r
+}
+
+// IgnoredServicesSummary returns a Runnable that counts the LoadBalancer
+// Services the operator observes but does not manage every interval, by
+// reason, as a metric and a debug-level log line.
+func (r *ServiceReconciler) IgnoredServicesSummary(interval time.Duration) manager.Runnable {
+	return &ignoredSummary{reconciler: r, interval: interval}
+}
+
+type ignoredSummary struct {
+	reconciler *ServiceReconciler
+	interval   time.Duration
+
+	// explained holds the Services already given an explanation event.
+	explained map[types.UID]bool
+}
+
+// Start summarizes ignored Services every interval until ctx is cancelled.
+func (s *ignoredSummary) Start(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.summarize(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *ignoredSummary) summarize(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("ignored-services")
+	r := s.reconciler
+
+	var services corev1.ServiceList
+	if err := r.client.List(ctx, &services); err != nil {
+		logger.Error(err, "Failed to list Services")
+		return
+	}
+
+	counts := make(map[string]int, len(ignoredReasons))
+	for _, reason := range ignoredReasons {
+		counts[reason] = 0
+	}
+	explained := make(map[types.UID]bool)
+	for i := range services.Items {
+		svc := &services.Items[i]
+		reason := r.ignoredReason(svc)
+		if reason == "" || reason == notLoadBalancer {
+			continue
+		}
+		counts[reason]++
+
+		if !r.explainIgnored {
+			continue
+		}
+		explained[svc.UID] = true
+		if s.explained[svc.UID] {
+			continue
+		}
+		switch reason {
+		case IgnoredNoClass:
+			r.event(svc, corev1.EventTypeNormal, "NotManaged",
+				"Service has no loadBalancerClass; set spec.loadBalancerClass to %s for fly-tunnel-operator to manage it", r.describeClasses("or"))
+		case IgnoredOtherClass:
+			r.event(svc, corev1.EventTypeNormal, "NotManaged",
+				"Service has loadBalancerClass %q; fly-tunnel-operator only manages %s", *svc.Spec.LoadBalancerClass, r.describeClasses("and"))
+		}
+	}
+	// Services that went away or became managed drop out.
+	s.explained = explained
+
+	metrics.SetIgnoredServices(counts)
+	kv := make([]any, 0, 2*len(ignoredReasons))
+	for _, reason := range ignoredReasons {
+		kv = append(kv, reason, counts[reason])
+	}
+	logger.V(1).Info("LoadBalancer Services not managed by this operator", kv...)
+}
@@ -0,0 +1,97 @@
+package controller_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/controller"
+)
+
+// objectRecorder records events by the name of the object they are about.
+type objectRecorder struct {
+	mu     sync.Mutex
+	events map[string][]string
+}
+
+func (r *objectRecorder) Event(obj runtime.Object, eventType, reason, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := obj.(client.Object).GetName()
+	r.events[name] = append(r.events[name], reason+": "+message)
+}
+
+func (r *objectRecorder) Eventf(obj runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	r.Event(obj, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *objectRecorder) AnnotatedEventf(obj runtime.Object, _ map[string]string, eventType, reason, messageFmt string, args ...interface{}) {
+	r.Eventf(obj, eventType, reason, messageFmt, args...)
+}
+
+func (r *objectRecorder) get(name string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events[name]
+}
+
+func TestIgnoredServicesSummary_ExplainsOnce(t *testing.T) {
+	lbService := func(name string, class *string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+			Spec: corev1.ServiceSpec{
+				Type:              corev1.ServiceTypeLoadBalancer,
+				LoadBalancerClass: class,
+				Ports:             []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		}
+	}
+	clusterIP := lbService("internal", nil)
+	clusterIP.Spec.Type = corev1.ServiceTypeClusterIP
+
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		lbService("no-class", nil),
+		lbService("other-class", ptr.To("example.com/lb")),
+		lbService("managed", ptr.To(controller.DefaultLoadBalancerClass)),
+		clusterIP,
+	).Build()
+	recorder := &objectRecorder{events: make(map[string][]string)}
+	reconciler := controller.NewServiceReconciler(kubeClient, nil, controller.DefaultLoadBalancerClass).
+		WithEventRecorder(recorder).
+		WithExplainIgnored()
+
+	// Several summaries run before the context expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := reconciler.IgnoredServicesSummary(10 * time.Millisecond).Start(ctx); err != nil {
+		t.Fatalf("summary failed: %v", err)
+	}
+
+	for _, name := range []string{"no-class", "other-class"} {
+		if got := recorder.get(name); len(got) != 1 {
+			t.Errorf("expected exactly one explanation on %s, got %v", name, got)
+		}
+	}
+	if got := recorder.get("no-class"); len(got) == 1 && !containsSubstring(got[0], "no loadBalancerClass") {
+		t.Errorf("expected the missing class to be explained, got %q", got[0])
+	}
+	if got := recorder.get("other-class"); len(got) == 1 && !containsSubstring(got[0], `"example.com/lb"`) {
+		t.Errorf("expected the other class to be named, got %q", got[0])
+	}
+	for _, name := range []string{"managed", "internal"} {
+		if got := recorder.get(name); len(got) != 0 {
+			t.Errorf("expected no events on %s, got %v", name, got)
+		}
+	}
+}
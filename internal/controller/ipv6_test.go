@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestReconcile_IPv6AllocationRetried(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	svc.Annotations[tunnel.AnnotationIPv6] = "true"
+	env := newGroupTestEnv(t, svc)
+	env.server.OnAllocateIPv6 = func(string) error { return errors.New("no IPv6 capacity") }
+
+	// The IPv4 is published on its own.
+	env.reconcile(svc)
+	publicIP := svc.Annotations[tunnel.AnnotationPublicIP]
+	if publicIP == "" || svc.Annotations[tunnel.AnnotationPublicIPv6] != "" {
+		t.Fatalf("expected an IPv4 only, got %v", svc.Annotations)
+	}
+	if got := ingressIPs(svc); !slices.Equal(got, []string{publicIP}) {
+		t.Errorf("expected ingress [%s], got %v", publicIP, got)
+	}
+	if events := env.events(); !hasEvent(events, "IPAllocationPartial") {
+		t.Errorf("expected the failed IPv6 in the event trail, got %q", events)
+	}
+	appName := svc.Annotations[tunnel.AnnotationFlyApp]
+	machineID := svc.Annotations[tunnel.AnnotationMachineID]
+
+	// The next reconcile allocates only the IPv6.
+	env.server.OnAllocateIPv6 = nil
+	env.reconcile(svc)
+	publicIPv6 := svc.Annotations[tunnel.AnnotationPublicIPv6]
+	if publicIPv6 == "" {
+		t.Fatalf("expected the IPv6 to be allocated, got %v", svc.Annotations)
+	}
+	if svc.Annotations[tunnel.AnnotationPublicIP] != publicIP || svc.Annotations[tunnel.AnnotationFlyApp] != appName ||
+		svc.Annotations[tunnel.AnnotationMachineID] != machineID {
+		t.Errorf("expected the tunnel to be kept, got %v", svc.Annotations)
+	}
+	if env.server.AppCount() != 1 || env.server.MachineCount() != 1 {
+		t.Errorf("expected no re-provisioning, got %d apps and %d machines", env.server.AppCount(), env.server.MachineCount())
+	}
+	if got := ingressIPs(svc); !slices.Equal(got, []string{publicIP, publicIPv6}) {
+		t.Errorf("expected ingress [%s %s], got %v", publicIP, publicIPv6, got)
+	}
+	if events := env.events(); !hasEvent(events, "IPv6Allocated") {
+		t.Errorf("expected the IPv6 allocation in the event trail, got %q", events)
+	}
+}
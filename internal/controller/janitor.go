@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// DefaultJanitorInterval is how often ArtifactJanitor looks for expired
+// artifacts.
+const DefaultJanitorInterval = time.Hour
+
+// ArtifactJanitor returns a Runnable that deletes, every interval, the
+// auxiliary objects whose TTL has expired (see tunnel.ArtifactTTLs).
+func (r *ServiceReconciler) ArtifactJanitor(interval time.Duration) manager.Runnable {
+	return manager.RunnableFunc(func(ctx context.Context) error {
+		logger := log.FromContext(ctx).WithName("janitor")
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			collected, err := r.tunnelManager.CollectExpired(log.IntoContext(ctx, logger))
+			if err != nil {
+				logger.Error(err, "Failed to collect expired artifacts")
+			}
+			if collected > 0 {
+				logger.Info("Deleted expired artifacts", "count", collected)
+			}
+		}
+	})
+}
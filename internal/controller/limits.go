@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/metrics"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// pendingRequeueInterval is how often a Service held back by the tunnel cap
+// checks whether it may be provisioned.
+const pendingRequeueInterval = time.Minute
+
+// provisionLimits caps the provisioning of new tunnels, so a burst of
+// LoadBalancer Services cannot create Fly.io Apps without bound.
+type provisionLimits struct {
+	// maxTunnels caps the provisioned tunnels; perHour caps provisioning
+	// attempts in any hour. Zero disables a cap.
+	maxTunnels int
+	perHour    int
+
+	mu sync.Mutex
+	// attempts holds the start of each provisioning attempt in the last hour.
+	attempts []time.Time
+	// inFlight holds the Services being provisioned, which are not yet
+	// counted as provisioned.
+	inFlight map[types.NamespacedName]bool
+	// pending holds the Services held back by a cap.
+	pending map[types.NamespacedName]bool
+}
+
+// WithProvisionLimits caps the number of provisioned tunnels at maxTunnels
+// and provisioning attempts at perHour in any hour; zero disables a cap. A
+// Service over a cap is left pending, with an event and a Ready=False
+// condition saying why, and provisioned on a later reconcile once under it.
+func (r *ServiceReconciler) WithProvisionLimits(maxTunnels, perHour int) *ServiceReconciler {
+	r.limits.mu.Lock()
+	defer r.limits.mu.Unlock()
+	r.limits.maxTunnels = maxTunnels
+	r.limits.perHour = perHour
+	return r
+}
+
+// admitProvision decides whether svc may be provisioned now. If not, it
+// returns why and when to check again. An admitted Service must be passed
+// to provisionDone once its attempt is over.
+func (r *ServiceReconciler) admitProvision(ctx context.Context, svc *corev1.Service) (string, time.Duration, error) {
+	l := &r.limits
+	l.mu.Lock()
+	maxTunnels, perHour := l.maxTunnels, l.perHour
+	l.mu.Unlock()
+	if maxTunnels <= 0 && perHour <= 0 {
+		return "", 0, nil
+	}
+
+	var tunnels int
+	if maxTunnels > 0 {
+		var list corev1.ServiceList
+		if err := r.client.List(ctx, &list); err != nil {
+			return "", 0, fmt.Errorf("counting tunnels: %w", err)
+		}
+		for i := range list.Items {
+			if r.isManaged(&list.Items[i]) && tunnel.Provisioned(&list.Items[i]) {
+				tunnels++
+			}
+		}
+	}
+
+	key := client.ObjectKeyFromObject(svc)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for len(l.attempts) > 0 && now.Sub(l.attempts[0]) >= time.Hour {
+		l.attempts = l.attempts[1:]
+	}
+	if n := tunnels + len(l.inFlight); maxTunnels > 0 && n >= maxTunnels {
+		return fmt.Sprintf("%d tunnels exist or are being provisioned, the limit is %d", n, maxTunnels), pendingRequeueInterval, nil
+	}
+	if perHour > 0 && len(l.attempts) >= perHour {
+		return fmt.Sprintf("%d tunnels were provisioned in the last hour, the limit is %d", len(l.attempts), perHour), l.attempts[0].Add(time.Hour).Sub(now), nil
+	}
+
+	l.attempts = append(l.attempts, now)
+	if l.inFlight == nil {
+		l.inFlight = make(map[types.NamespacedName]bool)
+	}
+	l.inFlight[key] = true
+	l.setPending(key, false)
+	return "", 0, nil
+}
+
+// provisionDone ends a provisioning attempt admitted by admitProvision.
+func (r *ServiceReconciler) provisionDone(svc *corev1.Service) {
+	r.limits.mu.Lock()
+	defer r.limits.mu.Unlock()
+	delete(r.limits.inFlight, client.ObjectKeyFromObject(svc))
+}
+
+// forgetPending stops counting a deleted Service as pending.
+func (r *ServiceReconciler) forgetPending(key types.NamespacedName) {
+	r.limits.mu.Lock()
+	defer r.limits.mu.Unlock()
+	r.limits.setPending(key, false)
+}
+
+// setPending records whether key is pending and reports whether that
+// changed. l.mu must be held.
+func (l *provisionLimits) setPending(key types.NamespacedName, pending bool) bool {
+	if l.pending[key] == pending {
+		return false
+	}
+	if pending {
+		if l.pending == nil {
+			l.pending = make(map[types.NamespacedName]bool)
+		}
+		l.pending[key] = true
+	} else {
+		delete(l.pending, key)
+	}
+	metrics.SetPendingTunnels(len(l.pending))
+	return true
+}
+
+// holdPending leaves svc pending because of reason, checking again after
+// wait.
+func (r *ServiceReconciler) holdPending(ctx context.Context, svc *corev1.Service, reason string, wait time.Duration) (reconcile.Result, error) {
+	r.limits.mu.Lock()
+	newly := r.limits.setPending(client.ObjectKeyFromObject(svc), true)
+	r.limits.mu.Unlock()
+
+	if newly {
+		log.FromContext(ctx).Info("Provisioning limit reached; Service is pending", "reason", reason)
+		r.event(svc, corev1.EventTypeWarning, "ProvisioningPending", "Not provisioning a tunnel yet: %s", reason)
+	}
+	if err := r.withholdIngress(ctx, svc, WithheldPending, "Waiting for a provisioning limit: "+reason); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{RequeueAfter: wait}, nil
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestReconcile_MaxTunnels(t *testing.T) {
+	first := groupTestService("first", "default", "")
+	second := groupTestService("second", "default", "")
+	env := newGroupTestEnv(t, first, second)
+	env.r.WithProvisionLimits(1, 0)
+
+	env.reconcile(first)
+	if !tunnel.Provisioned(first) {
+		t.Fatal("expected the first Service to be provisioned")
+	}
+
+	res, err := env.r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(second)})
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if res.RequeueAfter != pendingRequeueInterval {
+		t.Errorf("expected a pending Service to be checked again after %s, got %+v", pendingRequeueInterval, res)
+	}
+	env.reconcile(second)
+	if tunnel.Provisioned(second) || env.server.AppCount() != 1 {
+		t.Fatalf("expected the second Service to be pending, got %d apps", env.server.AppCount())
+	}
+	if cond := meta.FindStatusCondition(second.Status.Conditions, ConditionReady); cond == nil || cond.Reason != "Pending" {
+		t.Errorf("expected Ready reason Pending, got %+v", cond)
+	}
+	var pendingEvents int
+	for _, e := range env.events() {
+		if strings.Contains(e, "ProvisioningPending") {
+			pendingEvents++
+		}
+	}
+	if pendingEvents != 1 {
+		t.Errorf("expected one ProvisioningPending event, got %d", pendingEvents)
+	}
+
+	// Raising the limit lets it proceed.
+	env.r.WithProvisionLimits(2, 0)
+	env.reconcile(second)
+	if !tunnel.Provisioned(second) {
+		t.Error("expected the second Service to be provisioned after raising the limit")
+	}
+	if len(env.r.limits.pending) != 0 {
+		t.Errorf("expected no pending Services, got %v", env.r.limits.pending)
+	}
+}
+
+func TestReconcile_MaxProvisionsPerHour(t *testing.T) {
+	first := groupTestService("first", "default", "")
+	second := groupTestService("second", "default", "")
+	env := newGroupTestEnv(t, first, second)
+	env.r.WithProvisionLimits(0, 1)
+
+	env.reconcile(first)
+	res, err := env.r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(second)})
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if res.RequeueAfter <= 59*time.Minute || res.RequeueAfter > time.Hour {
+		t.Errorf("expected the Service to wait for the hour to pass, got %+v", res)
+	}
+	if env.server.AppCount() != 1 {
+		t.Errorf("expected one app, got %d", env.server.AppCount())
+	}
+}
@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestPublishStatus_RemappedPorts(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+		{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP},
+	}
+	svc.Annotations[frp.PortAnnotation("http", frp.AnnotationRemotePort)] = "80"
+	env := newGroupTestEnv(t, svc)
+
+	env.reconcile(svc)
+	env.reconcile(svc)
+
+	if len(svc.Status.LoadBalancer.Ingress) != 1 {
+		t.Fatalf("expected one ingress, got %+v", svc.Status.LoadBalancer.Ingress)
+	}
+	want := []corev1.PortStatus{{Port: 80, Protocol: corev1.ProtocolTCP}}
+	if got := svc.Status.LoadBalancer.Ingress[0].Ports; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the remapped port %+v in the ingress, got %+v", want, got)
+	}
+}
+
+// restartingFrps reports the remote ports an frps that forgets its
+// assignments on restart hands out: the port frpc asks for if its config
+// pins one, otherwise a new one per restart.
+type restartingFrps struct {
+	kubeClient client.Client
+	restarts   int
+}
+
+func (f *restartingFrps) RemotePorts(ctx context.Context, namespace, deploymentName string) (map[string]int, error) {
+	var secret corev1.Secret
+	if err := f.kubeClient.Get(ctx, types.NamespacedName{Name: deploymentName + "-config", Namespace: namespace}, &secret); err != nil {
+		return nil, err
+	}
+	config, err := frp.ParseClientConfig(string(secret.Data["frpc.toml"]))
+	if err != nil {
+		return nil, err
+	}
+	ports := make(map[string]int)
+	for _, proxy := range config.Proxies {
+		ports[proxy.Name] = proxy.RemotePort
+		if proxy.RemotePort == 0 {
+			ports[proxy.Name] = 31000 + f.restarts
+		}
+	}
+	return ports, nil
+}
+
+func TestReconcile_RandomRemotePortsStableAcrossMachineUpdates(t *testing.T) {
+	svc := groupTestService("game", "default", "")
+	svc.Annotations[frp.AnnotationRandomRemotePorts] = "true"
+	env := newGroupTestEnv(t, svc)
+	frps := &restartingFrps{kubeClient: env.kubeClient}
+	env.r.tunnelManager.WithRemotePortReader(frps)
+	env.server.OnUpdateMachine = func(string, string, flyio.CreateMachineInput) error {
+		frps.restarts++
+		return nil
+	}
+
+	// Provision, then record the port frps picked.
+	env.reconcile(svc)
+	env.reconcile(svc)
+	want := "80/tcp=31000"
+	if got := svc.Annotations[tunnel.AnnotationAssignedRemotePorts]; got != want {
+		t.Fatalf("expected assigned ports %q, got %q", want, got)
+	}
+
+	// Exposing the port updates, and so restarts, the Machine.
+	env.reconcile(svc)
+	if frps.restarts != 1 {
+		t.Fatalf("expected the Machine to be updated once to expose the port, got %d updates", frps.restarts)
+	}
+	if config := frpcConfigOf(t, env, svc); config.Proxies[0].RemotePort != 31000 {
+		t.Errorf("expected frpc to pin the assigned port, got %+v", config.Proxies[0])
+	}
+
+	env.reconcile(svc)
+	env.reconcile(svc)
+	if got := svc.Annotations[tunnel.AnnotationAssignedRemotePorts]; got != want {
+		t.Errorf("expected the assigned ports to survive the Machine restart, got %q", got)
+	}
+	if frps.restarts != 1 {
+		t.Errorf("expected no further Machine updates, got %d", frps.restarts)
+	}
+}
+
+// frpcConfigOf returns the frpc config deployed for svc.
+func frpcConfigOf(t *testing.T, env *groupTestEnv, svc *corev1.Service) *frp.ClientConfig {
+	t.Helper()
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: svc.Annotations[tunnel.AnnotationFrpcDeployment] + "-config", Namespace: "fly-tunnel-operator-system"}
+	if err := env.kubeClient.Get(context.Background(), key, &secret); err != nil {
+		t.Fatalf("getting frpc config Secret: %v", err)
+	}
+	config, err := frp.ParseClientConfig(string(secret.Data["frpc.toml"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
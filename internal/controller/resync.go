@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// DefaultResyncJitter spreads periodic resyncs by ±20% of the interval.
+const DefaultResyncJitter = 0.2
+
+// WithResync makes every reconcile of a provisioned Service requeue after
+// interval, so drift in its tunnel is periodically corrected. Each requeue is
+// randomized by ±jitter (a fraction of interval) so that many Services do
+// not hit the Fly.io API in synchronized bursts.
+func (r *ServiceReconciler) WithResync(interval time.Duration, jitter float64) *ServiceReconciler {
+	r.resyncInterval = interval
+	r.resyncJitter = min(max(jitter, 0), 1)
+	return r
+}
+
+// resync returns the periodic requeue for a provisioned Service, or an
+// empty result when periodic resync is disabled.
+func (r *ServiceReconciler) resync() reconcile.Result {
+	if r.resyncInterval <= 0 {
+		return reconcile.Result{}
+	}
+	spread := (2*rand.Float64() - 1) * r.resyncJitter
+	return reconcile.Result{RequeueAfter: r.resyncInterval + time.Duration(spread*float64(r.resyncInterval))}
+}
@@ -0,0 +1,82 @@
+package controller_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/controller"
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestResync_SpreadsRequeues(t *testing.T) {
+	const (
+		services = 40
+		interval = 10 * time.Minute
+		jitter   = 0.2
+	)
+
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+		WithStatusSubresource(&corev1.Service{}).
+		WithObjects(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: operatorNamespace}}).
+		Build()
+	flyClient := flyio.NewClient("test-token").WithBaseURL(server.URL).WithGraphQLURL(server.URL + "/graphql")
+	tunnelMgr := tunnel.NewManager(flyClient, kubeClient, tunnel.Config{
+		FlyOrg:            "personal",
+		FlyRegion:         "syd",
+		OperatorNamespace: operatorNamespace,
+	})
+	reconciler := controller.NewServiceReconciler(kubeClient, tunnelMgr, controller.DefaultLoadBalancerClass).
+		WithResync(interval, jitter)
+
+	seen := make(map[time.Duration]bool)
+	for i := range services {
+		svc := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("svc-%d", i), Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Type:              corev1.ServiceTypeLoadBalancer,
+				LoadBalancerClass: ptr.To(controller.DefaultLoadBalancerClass),
+				Ports:             []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+			},
+		}
+		if err := kubeClient.Create(context.Background(), svc); err != nil {
+			t.Fatalf("creating service: %v", err)
+		}
+		req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+
+		// The first reconcile provisions; the next finds the tunnel in place.
+		if _, err := reconciler.Reconcile(context.Background(), req); err != nil {
+			t.Fatalf("provisioning reconcile failed: %v", err)
+		}
+		result, err := reconciler.Reconcile(context.Background(), req)
+		if err != nil {
+			t.Fatalf("resync reconcile failed: %v", err)
+		}
+
+		low := time.Duration(float64(interval) * (1 - jitter))
+		high := time.Duration(float64(interval) * (1 + jitter))
+		if result.RequeueAfter < low || result.RequeueAfter > high {
+			t.Errorf("requeue %s outside %s..%s", result.RequeueAfter, low, high)
+		}
+		seen[result.RequeueAfter] = true
+	}
+
+	// With a continuous spread, near-all requeues differ.
+	if len(seen) < services*9/10 {
+		t.Errorf("expected requeues spread across the jitter window, got %d distinct of %d", len(seen), services)
+	}
+}
@@ -3,20 +3,33 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/health"
+	"github.com/zhming0/fly-tunnel-operator/internal/metrics"
 	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
 )
 
@@ -26,67 +39,245 @@ const (
 
 	// FinalizerName is the finalizer added to managed Services for cleanup.
 	FinalizerName = "fly-tunnel-operator.dev/finalizer"
+
+	// namespaceRequeueInterval is how long to wait before retrying a Service
+	// whose provisioning is blocked on the operator namespace being created.
+	namespaceRequeueInterval = 5 * time.Second
+
+	// frpcReadyPollInterval is how often a Service waiting on the frpc
+	// readiness gate is re-checked.
+	frpcReadyPollInterval = 2 * time.Second
+
+	// remotePortsResyncInterval is how often frps-assigned remote ports are
+	// read back, since they can change whenever frpc reconnects.
+	remotePortsResyncInterval = 30 * time.Second
+
+	// provisionInProgressRequeueInterval is how long to wait before
+	// updating a tunnel whose provisioning is still running.
+	provisionInProgressRequeueInterval = 5 * time.Second
+
+	// ipv6RetryInterval is how long to wait before retrying the IPv6
+	// allocation of a dual-stack tunnel published with its IPv4 only.
+	ipv6RetryInterval = time.Minute
+
+	// ConditionDegraded is set on the Service status when the tunnel IP was
+	// published before the frpc Deployment became available.
+	ConditionDegraded = "fly-tunnel-operator.dev/Degraded"
+
+	// ConditionReady is set on the Service status: False with reason
+	// Provisioning while the tunnel comes up, True once its IP is published,
+	// and False with reason Error when provisioning or updating it fails.
+	ConditionReady = "fly-tunnel-operator.dev/Ready"
+
+	// AnnotationError puts a Service in the terminal Error state: provisioning
+	// failed in a way retrying cannot fix (invalid annotations, Fly.io quota),
+	// so it is not retried automatically. The value is the failure message.
+	AnnotationError = "fly-tunnel-operator.dev/error"
+
+	// AnnotationRetry is set by users to leave the Error state: changing it to
+	// any new value clears the error and forces a fresh provisioning attempt.
+	AnnotationRetry = "fly-tunnel-operator.dev/retry"
+
+	// annotationRetryObserved records the AnnotationRetry value already acted
+	// upon, so only a new value triggers a retry.
+	annotationRetryObserved = "fly-tunnel-operator.dev/retry-observed"
 )
 
 // ServiceReconciler reconciles Service objects with type LoadBalancer
-// and the matching loadBalancerClass.
+// and one of the matching loadBalancerClasses.
 type ServiceReconciler struct {
-	client            client.Client
-	tunnelManager     *tunnel.Manager
-	loadBalancerClass string
+	client        client.Client
+	tunnelManager *tunnel.Manager
+	// loadBalancerClasses are the classes managed, in the order given.
+	loadBalancerClasses []string
+
+	// frpcReadyTimeout bounds how long the status IP is withheld waiting for
+	// the frpc Deployment to become available. Zero disables the gate.
+	frpcReadyTimeout time.Duration
+
+	// recorder emits Events on Services; nil disables them.
+	recorder record.EventRecorder
+
+	// heartbeat tracks in-flight reconciles for the liveness probe; nil
+	// disables tracking.
+	heartbeat *health.Heartbeat
+
+	// explainIgnored records an event on each ignored LoadBalancer Service
+	// saying why it is not managed.
+	explainIgnored bool
+
+	// resyncInterval, when set, requeues provisioned Services periodically,
+	// randomized by ±resyncJitter of the interval.
+	resyncInterval time.Duration
+	resyncJitter   float64
+
+	// noFinalizer leaves the finalizer off Services; deleted holds the last
+	// state of those observed being deleted, until their tunnel is torn down.
+	noFinalizer bool
+	deletedMu   sync.Mutex
+	deleted     map[types.NamespacedName]*corev1.Service
+
+	// limits caps the provisioning of new tunnels.
+	limits provisionLimits
+
+	// backoff spaces out the retries of failed provisioning attempts.
+	backoff provisionBackoff
+
+	// unknownAnnotations dedups the warnings about unknown annotations.
+	unknownAnnotations unknownAnnotationWarnings
+
+	// externalDNSHints publishes the tunnel IPs and hostname in annotations
+	// for external-dns.
+	externalDNSHints bool
 }
 
-// NewServiceReconciler creates a new ServiceReconciler.
+// NewServiceReconciler creates a new ServiceReconciler managing Services of
+// the given loadBalancerClasses, DefaultLoadBalancerClass if none.
 func NewServiceReconciler(
 	client client.Client,
 	tunnelManager *tunnel.Manager,
-	loadBalancerClass string,
+	loadBalancerClasses ...string,
 ) *ServiceReconciler {
-	if loadBalancerClass == "" {
-		loadBalancerClass = DefaultLoadBalancerClass
+	var classes []string
+	for _, class := range loadBalancerClasses {
+		if class != "" && !slices.Contains(classes, class) {
+			classes = append(classes, class)
+		}
+	}
+	if len(classes) == 0 {
+		classes = []string{DefaultLoadBalancerClass}
 	}
 	return &ServiceReconciler{
-		client:            client,
-		tunnelManager:     tunnelManager,
-		loadBalancerClass: loadBalancerClass,
+		client:              client,
+		tunnelManager:       tunnelManager,
+		loadBalancerClasses: classes,
+	}
+}
+
+// WithFrpcReadyGate defers publishing the tunnel IP until the frpc Deployment
+// reports an available replica, for at most timeout. After the timeout the IP
+// is published anyway and the Service is marked Degraded.
+func (r *ServiceReconciler) WithFrpcReadyGate(timeout time.Duration) *ServiceReconciler {
+	r.frpcReadyTimeout = timeout
+	return r
+}
+
+// WithEventRecorder makes the reconciler emit Kubernetes Events on Services.
+func (r *ServiceReconciler) WithEventRecorder(recorder record.EventRecorder) *ServiceReconciler {
+	r.recorder = recorder
+	return r
+}
+
+// WithHeartbeat makes every reconcile report to hb, so a wedged reconcile
+// fails the liveness probe.
+func (r *ServiceReconciler) WithHeartbeat(hb *health.Heartbeat) *ServiceReconciler {
+	r.heartbeat = hb
+	return r
+}
+
+// event records an Event on svc if a recorder is configured.
+func (r *ServiceReconciler) event(svc *corev1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.recorder == nil {
+		return
 	}
+	r.recorder.Eventf(svc, eventType, reason, messageFmt, args...)
 }
 
-// SetupWithManager sets up the controller with the Manager.
+// frpOptionsIndex indexes Services by the frp options ConfigMap they
+// reference.
+const frpOptionsIndex = "metadata.annotations.frp-options-from"
+
+// SetupWithManager sets up the controller with the Manager. Without a
+// recorder from WithEventRecorder, Events are recorded through the Manager's.
 func (r *ServiceReconciler) SetupWithManager(mgr manager.Manager) error {
+	if r.recorder == nil {
+		r.recorder = mgr.GetEventRecorderFor("fly-tunnel-operator")
+	}
+
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Service{}, frpOptionsIndex, func(obj client.Object) []string {
+		if name := obj.GetAnnotations()[tunnel.AnnotationFrpOptionsFrom]; name != "" {
+			return []string{name}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("indexing services by frp options configmap: %w", err)
+	}
+
 	return builder.ControllerManagedBy(mgr).
 		For(&corev1.Service{}, builder.WithPredicates(r.serviceFilter())).
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.servicesForFrpOptions)).
 		Complete(r)
 }
 
+// servicesForFrpOptions maps a ConfigMap to the Services in its namespace
+// that read frp options from it, so editing it updates their tunnels. The
+// operator's cache only holds ConfigMaps labelled tunnel.LabelFrpOptions.
+func (r *ServiceReconciler) servicesForFrpOptions(ctx context.Context, obj client.Object) []reconcile.Request {
+	var services corev1.ServiceList
+	if err := r.client.List(ctx, &services,
+		client.InNamespace(obj.GetNamespace()),
+		client.MatchingFields{frpOptionsIndex: obj.GetName()},
+	); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list Services using frp options", "configMap", client.ObjectKeyFromObject(obj))
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for i := range services.Items {
+		if r.isManaged(&services.Items[i]) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&services.Items[i])})
+		}
+	}
+	return requests
+}
+
 // Reconcile handles creating, updating, and deleting tunnel infrastructure
 // for matching LoadBalancer services.
 func (r *ServiceReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	defer r.heartbeat.Begin()()
+
 	logger := log.FromContext(ctx).WithValues("service", req.NamespacedName)
 	ctx = log.IntoContext(ctx, logger)
 
 	// Fetch the Service.
 	var svc corev1.Service
 	if err := r.client.Get(ctx, req.NamespacedName, &svc); err != nil {
-		if errors.IsNotFound(err) {
-			// Service was deleted; nothing to do (finalizer handles cleanup).
-			return reconcile.Result{}, nil
+		if apierrors.IsNotFound(err) {
+			// Service was deleted; the finalizer handled cleanup, unless
+			// there is none.
+			metrics.SetTunnelActive(req.NamespacedName.String(), false)
+			return r.teardownDeleted(ctx, req.NamespacedName)
 		}
 		return reconcile.Result{}, fmt.Errorf("getting service: %w", err)
 	}
-
-	// Check if this Service matches our loadBalancerClass.
+	defer func() {
+		// A tunnel counts as active while its Service has one and is not
+		// going away.
+		metrics.SetTunnelActive(req.NamespacedName.String(),
+			r.isManaged(&svc) && svc.DeletionTimestamp.IsZero() && tunnel.Provisioned(&svc))
+	}()
+
+	// Check if this Service matches one of our loadBalancerClasses.
 	if !r.isManaged(&svc) {
 		return reconcile.Result{}, nil
 	}
 
+	// A Service claimed by an operator with another identity, e.g. one
+	// for a different Fly.io org watching the same class, is left to it,
+	// deletion included.
+	if err := r.tunnelManager.CheckClaim(&svc); err != nil {
+		logger.Info("Leaving Service claimed by another operator", "reason", err.Error())
+		return reconcile.Result{}, nil
+	}
+
 	// Handle deletion via finalizer.
 	if !svc.DeletionTimestamp.IsZero() {
 		return r.reconcileDelete(ctx, &svc)
 	}
 
 	// Ensure finalizer is present.
-	if !controllerutil.ContainsFinalizer(&svc, FinalizerName) {
+	if !r.noFinalizer && !controllerutil.ContainsFinalizer(&svc, FinalizerName) {
 		controllerutil.AddFinalizer(&svc, FinalizerName)
 		if err := r.client.Update(ctx, &svc); err != nil {
 			return reconcile.Result{}, fmt.Errorf("adding finalizer: %w", err)
@@ -97,24 +288,155 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req reconcile.Request
 		}
 	}
 
-	// Check if tunnel is already provisioned.
-	if flyApp, ok := svc.Annotations[tunnel.AnnotationFlyApp]; ok && flyApp != "" {
+	r.warnUnknownAnnotations(ctx, &svc)
+
+	// Check if tunnel is already provisioned. Partial state left by an
+	// interrupted Provision is resumed by provisioning again.
+	if tunnel.Provisioned(&svc) {
 		return r.reconcileUpdate(ctx, &svc)
 	}
 
+	// A permanently failed Service is left alone until the user asks for a
+	// retry.
+	if svc.Annotations[AnnotationError] != "" {
+		if svc.Annotations[AnnotationRetry] == svc.Annotations[annotationRetryObserved] {
+			return reconcile.Result{}, nil
+		}
+		return r.retryProvision(ctx, &svc)
+	}
+
 	// No tunnel yet — provision one.
 	return r.reconcileCreate(ctx, &svc)
 }
 
+// retryProvision clears the Error state in response to a new retry
+// annotation value and provisions again.
+func (r *ServiceReconciler) retryProvision(ctx context.Context, svc *corev1.Service) (reconcile.Result, error) {
+	logger := log.FromContext(ctx)
+	logger.Info("Retry requested for failed Service", "retry", svc.Annotations[AnnotationRetry])
+
+	delete(svc.Annotations, AnnotationError)
+	delete(svc.Annotations, AnnotationIngressWithheldReason)
+	svc.Annotations[annotationRetryObserved] = svc.Annotations[AnnotationRetry]
+	if err := r.client.Update(ctx, svc); err != nil {
+		return reconcile.Result{}, fmt.Errorf("clearing error state: %w", err)
+	}
+	r.event(svc, corev1.EventTypeNormal, "RetryRequested", "Retrying provisioning after a permanent failure")
+
+	return r.reconcileCreate(ctx, svc)
+}
+
+// markFailed puts the Service in the terminal Error state.
+func (r *ServiceReconciler) markFailed(ctx context.Context, svc *corev1.Service, cause error) (reconcile.Result, error) {
+	logger := log.FromContext(ctx)
+	logger.Error(cause, "Provisioning failed permanently; not retrying until requested")
+
+	if err := r.client.Get(ctx, client.ObjectKeyFromObject(svc), svc); err != nil {
+		return reconcile.Result{}, fmt.Errorf("re-fetching service: %w", err)
+	}
+	if svc.Annotations == nil {
+		svc.Annotations = make(map[string]string)
+	}
+	svc.Annotations[AnnotationError] = cause.Error()
+	svc.Annotations[AnnotationIngressWithheldReason] = WithheldError
+	// A retry value set before this failure must not count as a new request.
+	svc.Annotations[annotationRetryObserved] = svc.Annotations[AnnotationRetry]
+	if err := r.client.Update(ctx, svc); err != nil {
+		return reconcile.Result{}, fmt.Errorf("recording error state: %w", err)
+	}
+	r.event(svc, corev1.EventTypeWarning, "ProvisioningFailed",
+		"%v; set the %s annotation to a new value to retry", cause, AnnotationRetry)
+	if err := r.setReady(ctx, svc, metav1.ConditionFalse, WithheldError, cause.Error()); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, nil
+}
+
+// setReady records the Ready condition on the Service status, patching only
+// when it changes.
+func (r *ServiceReconciler) setReady(ctx context.Context, svc *corev1.Service, status metav1.ConditionStatus, reason, message string) error {
+	_, err := r.setCondition(ctx, svc, ConditionReady, status, reason, message)
+	return err
+}
+
+// setCondition records a condition on the Service status, patching only when
+// it changes, and reports whether it did.
+func (r *ServiceReconciler) setCondition(ctx context.Context, svc *corev1.Service, conditionType string, status metav1.ConditionStatus, reason, message string) (bool, error) {
+	patch := client.MergeFrom(svc.DeepCopy())
+	changed := meta.SetStatusCondition(&svc.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: svc.Generation,
+	})
+	if !changed {
+		return false, nil
+	}
+	if err := r.client.Status().Patch(ctx, svc, patch); err != nil {
+		return false, fmt.Errorf("updating %s condition: %w", conditionType, err)
+	}
+	return true, nil
+}
+
+// readyCondition is the Ready condition of a tunnel whose IP is published.
+func readyCondition(svc *corev1.Service) metav1.Condition {
+	return metav1.Condition{
+		Type:               ConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "TunnelReady",
+		Message:            fmt.Sprintf("Tunnel IP %s is live", svc.Annotations[tunnel.AnnotationPublicIP]),
+		ObservedGeneration: svc.Generation,
+	}
+}
+
 // reconcileCreate provisions a new tunnel for the Service.
 func (r *ServiceReconciler) reconcileCreate(ctx context.Context, svc *corev1.Service) (reconcile.Result, error) {
 	logger := log.FromContext(ctx)
+	// Problems Fly.io would only report halfway through provisioning are
+	// caught before anything is created.
+	if failed, err := r.validate(ctx, svc); failed {
+		return reconcile.Result{}, err
+	}
+	reason, wait, err := r.admitProvision(ctx, svc)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if reason != "" {
+		return r.holdPending(ctx, svc, reason, wait)
+	}
+	defer r.provisionDone(svc)
+
 	logger.Info("Provisioning tunnel for Service")
+	r.event(svc, corev1.EventTypeNormal, "Provisioning", "Provisioning a fly.io tunnel")
+	if err := r.setWithheldReason(ctx, svc, ""); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.setReady(ctx, svc, metav1.ConditionFalse, "Provisioning", "Provisioning the fly.io tunnel"); err != nil {
+		return reconcile.Result{}, err
+	}
 
 	result, err := r.tunnelManager.Provision(ctx, svc)
 	if err != nil {
+		if errors.Is(err, tunnel.ErrOperatorNamespaceNotReady) {
+			logger.Info("Waiting for operator namespace before provisioning", "reason", err.Error(), "requeueAfter", namespaceRequeueInterval)
+			return reconcile.Result{RequeueAfter: namespaceRequeueInterval}, nil
+		}
+		if errors.Is(err, tunnel.ErrPermanent) {
+			r.backoff.reset(client.ObjectKeyFromObject(svc))
+			return r.markFailed(ctx, svc, err)
+		}
+		r.event(svc, corev1.EventTypeWarning, "ProvisionFailed", "Provisioning failed, will retry: %v", err)
+		if err := r.setReady(ctx, svc, metav1.ConditionFalse, "Error", err.Error()); err != nil {
+			logger.Error(err, "Failed to record provisioning failure")
+		}
+		if wait := r.backoff.failed(client.ObjectKeyFromObject(svc)); wait > 0 {
+			logger.Error(err, "Provisioning failed; retrying", "requeueAfter", wait)
+			return reconcile.Result{RequeueAfter: wait}, nil
+		}
 		return reconcile.Result{}, fmt.Errorf("provisioning tunnel: %w", err)
 	}
+	r.backoff.reset(client.ObjectKeyFromObject(svc))
 
 	// Re-fetch the Service to get the latest version before patching.
 	key := client.ObjectKeyFromObject(svc)
@@ -123,77 +445,353 @@ func (r *ServiceReconciler) reconcileCreate(ctx context.Context, svc *corev1.Ser
 	}
 
 	// Store tunnel state in annotations.
+	recordTunnel(svc, result)
+
+	if err := r.client.Update(ctx, svc); err != nil {
+		return reconcile.Result{}, fmt.Errorf("updating service annotations: %w", err)
+	}
+
+	logger.Info("Tunnel provisioned successfully", "publicIP", result.PublicIP, "machineID", result.MachineID)
+	r.event(svc, corev1.EventTypeNormal, "Provisioned", "Provisioned fly.io tunnel %s with public IP %s", result.FlyApp, result.PublicIP)
+
+	// Patch the Service status with the public IP (subject to the frpc gate).
+	res, err := r.publishStatus(ctx, svc)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.reconcileExternalDNSHints(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.recordVhostDomains(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.recordUnsupportedPorts(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	}
+	if frp.RandomRemotePorts(svc) {
+		// Come back to read the assigned ports once frpc has connected.
+		res = soonest(res, reconcile.Result{RequeueAfter: remotePortsResyncInterval})
+	}
+	if tunnel.MissingIPv6(svc) {
+		res = soonest(res, reconcile.Result{RequeueAfter: ipv6RetryInterval})
+	}
+	return res, nil
+}
+
+// recordTunnel stores the state of a provisioned tunnel in the Service
+// annotations.
+func recordTunnel(svc *corev1.Service, result *tunnel.TunnelResult) {
 	if svc.Annotations == nil {
 		svc.Annotations = make(map[string]string)
 	}
 	svc.Annotations[tunnel.AnnotationFlyApp] = result.FlyApp
 	svc.Annotations[tunnel.AnnotationMachineID] = result.MachineID
 	svc.Annotations[tunnel.AnnotationFrpcDeployment] = result.FrpcDeployment
+	svc.Annotations[tunnel.AnnotationFrpcNamespace] = result.FrpcNamespace
 	svc.Annotations[tunnel.AnnotationIPID] = result.IPID
 	svc.Annotations[tunnel.AnnotationPublicIP] = result.PublicIP
-
-	if err := r.client.Update(ctx, svc); err != nil {
-		return reconcile.Result{}, fmt.Errorf("updating service annotations: %w", err)
+	svc.Annotations[tunnel.AnnotationIPOwnership] = result.IPOwnership
+	if result.AppOwnership != "" {
+		svc.Annotations[tunnel.AnnotationAppOwnership] = result.AppOwnership
 	}
-
-	// Patch the Service status with the public IP.
-	// Use MergeFrom patch to avoid conflicts with concurrent reconciliations.
-	statusPatch := client.MergeFrom(svc.DeepCopy())
-	svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{
-		{IP: result.PublicIP},
+	if result.OperatorIdentity != "" {
+		svc.Annotations[tunnel.AnnotationOperatorIdentity] = result.OperatorIdentity
 	}
-	if err := r.client.Status().Patch(ctx, svc, statusPatch); err != nil {
-		return reconcile.Result{}, fmt.Errorf("updating service status: %w", err)
+	if result.IPv6ID != "" {
+		svc.Annotations[tunnel.AnnotationIPv6ID] = result.IPv6ID
+		svc.Annotations[tunnel.AnnotationPublicIPv6] = result.PublicIPv6
+	}
+	if result.ControlPort != 0 {
+		svc.Annotations[tunnel.AnnotationControlPort] = strconv.Itoa(result.ControlPort)
+	}
+	for key, value := range result.Versions {
+		svc.Annotations[key] = value
+	}
+	if result.DashboardSecret != "" {
+		svc.Annotations[tunnel.AnnotationFrpsDashboardSecret] = result.DashboardSecret
+	}
+	if result.AssignedRemotePorts != "" {
+		svc.Annotations[tunnel.AnnotationAssignedRemotePorts] = result.AssignedRemotePorts
 	}
-
-	logger.Info("Tunnel provisioned successfully", "publicIP", result.PublicIP, "machineID", result.MachineID)
-	return reconcile.Result{}, nil
 }
 
 // reconcileUpdate ensures an existing tunnel's configuration and status are up to date.
 func (r *ServiceReconciler) reconcileUpdate(ctx context.Context, svc *corev1.Service) (reconcile.Result, error) {
 	logger := log.FromContext(ctx)
 
-	// Check if the Service status already has the correct IP.
-	publicIP := svc.Annotations[tunnel.AnnotationPublicIP]
-	needsStatusUpdate := len(svc.Status.LoadBalancer.Ingress) == 0 ||
-		svc.Status.LoadBalancer.Ingress[0].IP != publicIP
+	from, to, err := r.tunnelManager.TunnelGroupChange(ctx, svc)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if from != to {
+		return r.reconcileGroupChange(ctx, svc, from, to)
+	}
+	if err := r.claim(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	}
+	if tunnel.Suspended(svc) {
+		return r.reconcileSuspended(ctx, svc)
+	}
 
-	if needsStatusUpdate {
-		statusPatch := client.MergeFrom(svc.DeepCopy())
-		svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{
-			{IP: publicIP},
-		}
-		if err := r.client.Status().Patch(ctx, svc, statusPatch); err != nil {
-			return reconcile.Result{}, fmt.Errorf("updating service status: %w", err)
+	// Make sure the Service status has the correct IP. A resuming tunnel
+	// is published again once Update below has started its Machine.
+	var result reconcile.Result
+	if !tunnel.MachineStopped(svc) {
+		result, err = r.publishStatus(ctx, svc)
+		if err != nil {
+			return reconcile.Result{}, err
 		}
-		logger.Info("Updated Service status with public IP", "publicIP", publicIP)
 	}
 
 	// Detect if ports have changed and update the tunnel.
 	// The tunnel manager will regenerate frpc config and update the Machine.
-	if err := r.tunnelManager.Update(ctx, svc); err != nil {
+	publicIPs := tunnel.PublicIPs(svc)
+	if changed, err := r.tunnelManager.Update(ctx, svc); errors.Is(err, tunnel.ErrProvisionInProgress) {
+		logger.Info("Tunnel is still being provisioned; updating it later", "requeueAfter", provisionInProgressRequeueInterval)
+		return reconcile.Result{RequeueAfter: provisionInProgressRequeueInterval}, nil
+	} else if err != nil {
 		logger.Error(err, "Failed to update tunnel")
+		r.event(svc, corev1.EventTypeWarning, "TunnelUpdateFailed", "Updating the tunnel failed, will retry: %v", err)
+		if err := r.setReady(ctx, svc, metav1.ConditionFalse, "Error", err.Error()); err != nil {
+			return reconcile.Result{}, err
+		}
 		// Don't return error — the tunnel may still be functional with old config.
 		// The next reconciliation will retry.
+	} else {
+		// Resyncs that find nothing to change stay quiet.
+		if changed {
+			r.event(svc, corev1.EventTypeNormal, "TunnelUpdated", "Updated the tunnel to the current configuration")
+		}
+		if !slices.Equal(publicIPs, tunnel.PublicIPs(svc)) && !tunnel.MachineStopped(svc) {
+			// Update allocated or released the IPv6 of a dual-stack tunnel.
+			statusResult, err := r.publishStatus(ctx, svc)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			result = soonest(result, statusResult)
+		}
+		if len(svc.Status.LoadBalancer.Ingress) > 0 {
+			cond := readyCondition(svc)
+			if err := r.setReady(ctx, svc, cond.Status, cond.Reason, cond.Message); err != nil {
+				return reconcile.Result{}, err
+			}
+		}
 	}
 
-	return reconcile.Result{}, nil
+	if err := r.reconcileExternalDNSHints(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.recordVhostDomains(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.recordUnsupportedPorts(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := r.recordFrpcCrash(ctx, svc); err != nil {
+		logger.Error(err, "Failed to record frpc crash details")
+	}
+
+	if err := r.reconcileControlChannel(ctx, svc); err != nil {
+		logger.Error(err, "Failed to check the frpc control channel")
+	}
+
+	if frp.RandomRemotePorts(svc) {
+		portsResult, err := r.reconcileRemotePorts(ctx, svc)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		result = soonest(result, portsResult)
+	}
+	if tunnel.MissingIPv6(svc) {
+		result = soonest(result, reconcile.Result{RequeueAfter: ipv6RetryInterval})
+	}
+
+	return soonest(result, r.resync()), nil
+}
+
+// reconcileRemotePorts records the remote ports frps assigned to a Service's
+// proxies. Changing the annotation triggers another reconcile, whose Update
+// exposes the ports on the fly.io Machine and pins them in the frpc config,
+// so the Machine restart does not move them.
+func (r *ServiceReconciler) reconcileRemotePorts(ctx context.Context, svc *corev1.Service) (reconcile.Result, error) {
+	logger := log.FromContext(ctx)
+
+	assigned, err := r.tunnelManager.ReadRemotePorts(ctx, svc)
+	if err != nil {
+		logger.Info("Assigned remote ports not available yet", "reason", err.Error())
+		return reconcile.Result{RequeueAfter: remotePortsResyncInterval}, nil
+	}
+
+	if svc.Annotations[tunnel.AnnotationAssignedRemotePorts] != assigned {
+		svc.Annotations[tunnel.AnnotationAssignedRemotePorts] = assigned
+		if err := r.client.Update(ctx, svc); err != nil {
+			return reconcile.Result{}, fmt.Errorf("recording assigned remote ports: %w", err)
+		}
+		logger.Info("Recorded assigned remote ports", "ports", assigned)
+	}
+
+	return reconcile.Result{RequeueAfter: remotePortsResyncInterval}, nil
+}
+
+// recordFrpcCrash copies a log excerpt from a crash-looping frpc container
+// into the Service's last-frpc-error annotation and emits a Warning event,
+// once per crash.
+func (r *ServiceReconciler) recordFrpcCrash(ctx context.Context, svc *corev1.Service) error {
+	current := svc.Annotations[tunnel.AnnotationLastFrpcError]
+	excerpt, err := r.tunnelManager.FrpcCrashExcerpt(ctx, svc, current)
+	if err != nil {
+		return err
+	}
+	if excerpt == "" || excerpt == current {
+		return nil
+	}
+
+	svc.Annotations[tunnel.AnnotationLastFrpcError] = excerpt
+	if err := r.client.Update(ctx, svc); err != nil {
+		return fmt.Errorf("recording frpc error: %w", err)
+	}
+	log.FromContext(ctx).Info("frpc is crash-looping", "excerpt", excerpt)
+	r.event(svc, corev1.EventTypeWarning, "FrpcCrashLooping", "frpc is crash-looping; see the %s annotation. %s",
+		tunnel.AnnotationLastFrpcError, excerpt)
+	return nil
+}
+
+// soonest merges two reconcile results, keeping the earliest requeue.
+func soonest(a, b reconcile.Result) reconcile.Result {
+	switch {
+	case a.RequeueAfter == 0:
+		return b
+	case b.RequeueAfter == 0:
+		return a
+	case b.RequeueAfter < a.RequeueAfter:
+		return b
+	default:
+		return a
+	}
+}
+
+// publishStatus patches the Service status with the tunnel's public IP. When
+// the frpc readiness gate is enabled, the IP is withheld (and the Service
+// requeued) until the frpc Deployment has an available replica or the gate
+// times out, in which case the IP is published with a Degraded condition.
+func (r *ServiceReconciler) publishStatus(ctx context.Context, svc *corev1.Service) (reconcile.Result, error) {
+	logger := log.FromContext(ctx)
+
+	publicIPs := tunnel.PublicIPs(svc)
+	needsStatusUpdate := !slices.Equal(ingressIPs(svc), publicIPs)
+	degraded := meta.IsStatusConditionTrue(svc.Status.Conditions, ConditionDegraded)
+
+	if !needsStatusUpdate && (!degraded || r.frpcReadyTimeout == 0) {
+		return reconcile.Result{}, nil
+	}
+
+	var result reconcile.Result
+	frpcReady := true
+	if r.frpcReadyTimeout > 0 {
+		ready, createdAt, err := r.tunnelManager.FrpcReady(ctx, svc)
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("checking frpc readiness: %w", err)
+		}
+		if ready && needsStatusUpdate && tunnel.NeedsWarmUp(svc) {
+			// Pooled tunnels are only published once a real connection
+			// through them succeeds.
+			if err := r.tunnelManager.WarmUp(ctx, svc); err != nil {
+				logger.Info("Tunnel warm-up failed", "reason", err.Error())
+				ready = false
+			}
+		}
+		frpcReady = ready
+		if !ready {
+			if !needsStatusUpdate {
+				// Already published and marked Degraded; keep checking.
+				return reconcile.Result{RequeueAfter: frpcReadyPollInterval}, nil
+			}
+			if remaining := r.frpcReadyTimeout - time.Since(createdAt); remaining > 0 {
+				logger.Info("Waiting for frpc Deployment before publishing IP", "remaining", remaining)
+				message := fmt.Sprintf("Waiting up to %s for frpc to become available before publishing the tunnel IP", r.frpcReadyTimeout)
+				if err := r.withholdIngress(ctx, svc, WithheldWaitingForFrpc, message); err != nil {
+					return reconcile.Result{}, err
+				}
+				return reconcile.Result{RequeueAfter: min(frpcReadyPollInterval, remaining)}, nil
+			}
+			logger.Info("frpc Deployment not ready before timeout; publishing IP as Degraded", "timeout", r.frpcReadyTimeout)
+			result = reconcile.Result{RequeueAfter: frpcReadyPollInterval}
+		}
+	}
+
+	// Use MergeFrom patch to avoid conflicts with concurrent reconciliations.
+	statusPatch := client.MergeFrom(svc.DeepCopy())
+	svc.Status.LoadBalancer.Ingress = nil
+	ports := tunnel.RemappedPorts(svc)
+	for _, ip := range publicIPs {
+		svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip, Ports: ports})
+	}
+	meta.SetStatusCondition(&svc.Status.Conditions, readyCondition(svc))
+	if r.frpcReadyTimeout > 0 {
+		cond := metav1.Condition{
+			Type:               ConditionDegraded,
+			Status:             metav1.ConditionFalse,
+			Reason:             "FrpcAvailable",
+			Message:            "frpc Deployment has an available replica",
+			ObservedGeneration: svc.Generation,
+		}
+		if !frpcReady {
+			cond.Status = metav1.ConditionTrue
+			cond.Reason = "FrpcNotReady"
+			cond.Message = fmt.Sprintf("frpc Deployment not available after %s; tunnel IP published anyway", r.frpcReadyTimeout)
+			if tunnel.NeedsWarmUp(svc) {
+				cond.Message = fmt.Sprintf("frpc not available or tunnel warm-up failing after %s; tunnel IP published anyway", r.frpcReadyTimeout)
+			}
+		}
+		meta.SetStatusCondition(&svc.Status.Conditions, cond)
+	}
+	if err := r.client.Status().Patch(ctx, svc, statusPatch); err != nil {
+		return reconcile.Result{}, fmt.Errorf("updating service status: %w", err)
+	}
+	logger.Info("Updated Service status with public IP", "publicIPs", publicIPs)
+	if err := r.setWithheldReason(ctx, svc, ""); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	return result, nil
+}
+
+// ingressIPs returns the IPs published in the status of svc.
+func ingressIPs(svc *corev1.Service) []string {
+	var ips []string
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		ips = append(ips, ingress.IP)
+	}
+	return ips
 }
 
 // reconcileDelete tears down the tunnel and removes the finalizer.
 func (r *ServiceReconciler) reconcileDelete(ctx context.Context, svc *corev1.Service) (reconcile.Result, error) {
 	logger := log.FromContext(ctx)
 	logger.Info("Tearing down tunnel for deleted Service")
+	// A Service whose provisioning never got anywhere has nothing to
+	// announce; Teardown only tidies up in-cluster leftovers.
+	if tunnel.HasTunnelState(svc) {
+		r.event(svc, corev1.EventTypeNormal, "TunnelTeardown", "Tearing down the fly.io tunnel")
+	}
+	r.forgetPending(client.ObjectKeyFromObject(svc))
+	r.backoff.reset(client.ObjectKeyFromObject(svc))
 
 	if err := r.tunnelManager.Teardown(ctx, svc); err != nil {
+		r.event(svc, corev1.EventTypeWarning, "TunnelTeardownFailed", "Tearing down the tunnel failed, will retry: %v", err)
 		return reconcile.Result{}, fmt.Errorf("tearing down tunnel: %w", err)
 	}
+	if err := r.reconcileExternalDNSHints(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	}
 
-	// Remove the finalizer.
-	controllerutil.RemoveFinalizer(svc, FinalizerName)
-	if err := r.client.Update(ctx, svc); err != nil {
-		return reconcile.Result{}, fmt.Errorf("removing finalizer: %w", err)
+	// Remove the finalizer. Without one, the Service was only waiting on
+	// someone else's.
+	if controllerutil.RemoveFinalizer(svc, FinalizerName) {
+		if err := r.client.Update(ctx, svc); err != nil {
+			return reconcile.Result{}, fmt.Errorf("removing finalizer: %w", err)
+		}
 	}
 
 	logger.Info("Tunnel teardown complete")
@@ -202,19 +800,13 @@ func (r *ServiceReconciler) reconcileDelete(ctx context.Context, svc *corev1.Ser
 
 // isManaged returns true if the Service should be managed by this operator.
 func (r *ServiceReconciler) isManaged(svc *corev1.Service) bool {
-	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
-		return false
-	}
-	if svc.Spec.LoadBalancerClass == nil {
-		return false
-	}
-	return *svc.Spec.LoadBalancerClass == r.loadBalancerClass
+	return r.ignoredReason(svc) == ""
 }
 
 // serviceFilter returns a predicate that filters for matching LoadBalancer services.
 func (r *ServiceReconciler) serviceFilter() predicate.Predicate {
 	return predicate.Funcs{
-		// Create: only if the Service is a LoadBalancer with matching loadBalancerClass.
+		// Create: only if the Service is a LoadBalancer with a matching loadBalancerClass.
 		CreateFunc: func(e event.CreateEvent) bool {
 			svc, ok := e.Object.(*corev1.Service)
 			if !ok {
@@ -222,8 +814,8 @@ func (r *ServiceReconciler) serviceFilter() predicate.Predicate {
 			}
 			return r.isManaged(svc)
 		},
-		// Update: only if managed AND ports changed, annotations changed, deletion
-		// started, or status is stale/missing.
+		// Update: only if managed AND ports or selector changed, labels or
+		// annotations changed, deletion started, or status is stale/missing.
 		UpdateFunc: func(e event.UpdateEvent) bool {
 			oldSvc, ok1 := e.ObjectOld.(*corev1.Service)
 			newSvc, ok2 := e.ObjectNew.(*corev1.Service)
@@ -236,9 +828,17 @@ func (r *ServiceReconciler) serviceFilter() predicate.Predicate {
 			if !reflect.DeepEqual(oldSvc.Spec.Ports, newSvc.Spec.Ports) {
 				return true
 			}
+			// The endpoints Service of endpoints mode copies the selector.
+			if !reflect.DeepEqual(oldSvc.Spec.Selector, newSvc.Spec.Selector) {
+				return true
+			}
 			if !reflect.DeepEqual(oldSvc.Annotations, newSvc.Annotations) {
 				return true
 			}
+			// Labels may be propagated to the frpc resources.
+			if !reflect.DeepEqual(oldSvc.Labels, newSvc.Labels) {
+				return true
+			}
 			if !newSvc.DeletionTimestamp.IsZero() {
 				return true
 			}
@@ -246,8 +846,7 @@ func (r *ServiceReconciler) serviceFilter() predicate.Predicate {
 			if len(newSvc.Status.LoadBalancer.Ingress) == 0 {
 				return true
 			}
-			expectedIP := newSvc.Annotations[tunnel.AnnotationPublicIP]
-			if expectedIP != "" && newSvc.Status.LoadBalancer.Ingress[0].IP != expectedIP {
+			if expected := tunnel.PublicIPs(newSvc); len(expected) > 0 && !slices.Equal(ingressIPs(newSvc), expected) {
 				return true
 			}
 			return false
@@ -255,10 +854,11 @@ func (r *ServiceReconciler) serviceFilter() predicate.Predicate {
 		// Delete: only if managed.
 		DeleteFunc: func(e event.DeleteEvent) bool {
 			svc, ok := e.Object.(*corev1.Service)
-			if !ok {
+			if !ok || !r.isManaged(svc) {
 				return false
 			}
-			return r.isManaged(svc)
+			r.rememberDeleted(svc)
+			return true
 		},
 		// Generic: always ignored.
 		GenericFunc: func(e event.GenericEvent) bool {
@@ -1,15 +1,24 @@
 package controller_test
 
 import (
+	"errors"
+	"net/http"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/zhming0/fly-tunnel-operator/internal/controller"
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
 	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
 )
 
@@ -366,17 +375,17 @@ func TestReconcile_UpdateServicePorts_RegeneratesConfig(t *testing.T) {
 		t.Fatalf("failed to update service: %v", err)
 	}
 
-	// Wait for ConfigMap to be updated with port 443.
+	// Wait for the config Secret to be updated with port 443.
 	deadline := time.Now().Add(testTimeout)
 	configUpdated := false
 	for time.Now().Before(deadline) {
-		var cm corev1.ConfigMap
+		var secret corev1.Secret
 		if err := k8sClient.Get(testCtx, types.NamespacedName{
 			Name:      frpcDeployName + "-config",
 			Namespace: operatorNamespace,
-		}, &cm); err == nil {
-			if config, ok := cm.Data["frpc.toml"]; ok {
-				if containsSubstring(config, "remotePort = 443") {
+		}, &secret); err == nil {
+			if config, ok := secret.Data["frpc.toml"]; ok {
+				if containsSubstring(string(config), "remotePort = 443") {
 					configUpdated = true
 					break
 				}
@@ -390,6 +399,290 @@ func TestReconcile_UpdateServicePorts_RegeneratesConfig(t *testing.T) {
 	}
 }
 
+func TestReconcile_FrpOptionsConfigMapChange_UpdatesTunnel(t *testing.T) {
+	ensureNamespace(t, "test-frp-options-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	options := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "frp-options",
+			Namespace: "test-frp-options-ns",
+			Labels:    map[string]string{tunnel.LabelFrpOptions: "true"},
+		},
+		Data: map[string]string{"pool-count": "2"},
+	}
+	if err := k8sClient.Create(testCtx, options); err != nil {
+		t.Fatalf("failed to create options configmap: %v", err)
+	}
+
+	svc := unannotatedService("test-svc-frp-options", "test-frp-options-ns")
+	svc.Annotations = map[string]string{tunnel.AnnotationFrpOptionsFrom: "frp-options"}
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	key := client.ObjectKeyFromObject(svc)
+	waitForServiceIP(t, key, testTimeout)
+
+	var current corev1.Service
+	if err := k8sClient.Get(testCtx, key, &current); err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	secretKey := types.NamespacedName{
+		Name:      current.Annotations[tunnel.AnnotationFrpcDeployment] + "-config",
+		Namespace: operatorNamespace,
+	}
+
+	// Editing only the ConfigMap must reach the frpc config.
+	options.Data["pool-count"] = "4"
+	if err := k8sClient.Update(testCtx, options); err != nil {
+		t.Fatalf("failed to update options configmap: %v", err)
+	}
+
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		var secret corev1.Secret
+		if err := k8sClient.Get(testCtx, secretKey, &secret); err == nil {
+			config, err := frp.ParseClientConfig(string(secret.Data["frpc.toml"]))
+			if err == nil && config.Transport != nil && config.Transport.PoolCount == 4 {
+				return
+			}
+		}
+		time.Sleep(testInterval)
+	}
+	t.Error("expected the frpc config to pick up the changed options ConfigMap")
+}
+
+func waitForDeployment(t *testing.T, key types.NamespacedName, timeout time.Duration) *appsv1.Deployment {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var deploy appsv1.Deployment
+		if err := k8sClient.Get(testCtx, key, &deploy); err == nil {
+			return &deploy
+		}
+		time.Sleep(testInterval)
+	}
+	t.Fatalf("timed out waiting for Deployment %s", key)
+	return nil
+}
+
+func TestReconcile_FrpcReadyGate_PublishesWhenAvailable(t *testing.T) {
+	ensureNamespace(t, "test-gate-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	lbClass := controller.DefaultLoadBalancerClass
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-svc-gate",
+			Namespace: "test-gate-ns",
+		},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: &lbClass,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			},
+			Selector: map[string]string{"app": "test"},
+		},
+	}
+	key := types.NamespacedName{Name: "test-svc-gate", Namespace: "test-gate-ns"}
+
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	// Wait for the frpc Deployment; the IP must still be withheld.
+	var fetched corev1.Service
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		if err := k8sClient.Get(testCtx, key, &fetched); err == nil && fetched.Annotations[tunnel.AnnotationFrpcDeployment] != "" {
+			break
+		}
+		time.Sleep(testInterval)
+	}
+	deploy := waitForDeployment(t, types.NamespacedName{
+		Name:      fetched.Annotations[tunnel.AnnotationFrpcDeployment],
+		Namespace: operatorNamespace,
+	}, testTimeout)
+
+	if err := k8sClient.Get(testCtx, key, &fetched); err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if len(fetched.Status.LoadBalancer.Ingress) != 0 {
+		t.Fatalf("expected IP to be withheld until frpc is available, got %v", fetched.Status.LoadBalancer.Ingress)
+	}
+
+	// Simulate the Deployment controller reporting an available replica.
+	deploy.Status.Replicas = 1
+	deploy.Status.ReadyReplicas = 1
+	deploy.Status.AvailableReplicas = 1
+	if err := k8sClient.Status().Update(testCtx, deploy); err != nil {
+		t.Fatalf("failed to update deployment status: %v", err)
+	}
+
+	waitForServiceIP(t, key, testTimeout)
+
+	if err := k8sClient.Get(testCtx, key, &fetched); err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if meta.IsStatusConditionTrue(fetched.Status.Conditions, controller.ConditionDegraded) {
+		t.Errorf("expected Service not to be Degraded once frpc is available")
+	}
+}
+
+func TestReconcile_FrpcReadyGate_TimeoutPublishesDegraded(t *testing.T) {
+	ensureNamespace(t, "test-gate-timeout-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	lbClass := controller.DefaultLoadBalancerClass
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-svc-gate-timeout",
+			Namespace: "test-gate-timeout-ns",
+		},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: &lbClass,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			},
+			Selector: map[string]string{"app": "test"},
+		},
+	}
+	key := types.NamespacedName{Name: "test-svc-gate-timeout", Namespace: "test-gate-timeout-ns"}
+
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	// frpc never becomes available in envtest, so the IP is published after the timeout.
+	start := time.Now()
+	waitForServiceIP(t, key, testTimeout)
+	if elapsed := time.Since(start); elapsed < frpcReadyTimeout/2 {
+		t.Errorf("expected IP to be withheld for roughly %s, published after %s", frpcReadyTimeout, elapsed)
+	}
+
+	var fetched corev1.Service
+	if err := k8sClient.Get(testCtx, key, &fetched); err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	cond := meta.FindStatusCondition(fetched.Status.Conditions, controller.ConditionDegraded)
+	if cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Fatalf("expected Degraded condition to be True, got %+v", cond)
+	}
+	if cond.Reason != "FrpcNotReady" {
+		t.Errorf("expected reason FrpcNotReady, got %q", cond.Reason)
+	}
+}
+
+// failAppCreation makes the fake Fly.io API reject creating appName, so the
+// Service keeps its finalizer without ever getting tunnel annotations.
+func failAppCreation(t *testing.T, appName string) {
+	t.Helper()
+	flyServer.OnCreateApp = func(name, _ string) error {
+		if name == appName {
+			return errors.New("simulated provisioning failure")
+		}
+		return nil
+	}
+	t.Cleanup(func() { flyServer.OnCreateApp = nil })
+}
+
+func unannotatedService(name, namespace string) *corev1.Service {
+	lbClass := controller.DefaultLoadBalancerClass
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Namespace:  namespace,
+			Finalizers: []string{controller.FinalizerName},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: &lbClass,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			},
+			Selector: map[string]string{"app": "test"},
+		},
+	}
+}
+
+func TestReconcile_DeleteWithoutAnnotations_RemovesFinalizer(t *testing.T) {
+	ensureNamespace(t, "test-noannot-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	// An app with the conventional name that this cluster has no record of.
+	appName := "fly-tunnel-test-noannot-ns-test-svc-noannot-personal"
+	flyClient := flyio.NewClient("test-token").WithBaseURL(flyServer.URL)
+	if err := flyClient.EnsureApp(testCtx, appName, "personal"); err != nil {
+		t.Fatalf("EnsureApp failed: %v", err)
+	}
+	failAppCreation(t, appName)
+
+	svc := unannotatedService("test-svc-noannot", "test-noannot-ns")
+	key := client.ObjectKeyFromObject(svc)
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	if err := k8sClient.Delete(testCtx, svc); err != nil {
+		t.Fatalf("failed to delete service: %v", err)
+	}
+	waitForServiceDeletion(t, key, testTimeout)
+
+	if !flyServer.HasApp(appName) {
+		t.Error("expected the unowned app to be left alone")
+	}
+}
+
+func TestReconcile_DeleteWithoutAnnotations_CleansUpOwnedTunnel(t *testing.T) {
+	ensureNamespace(t, "test-orphan-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	appName := "fly-tunnel-test-orphan-ns-test-svc-orphan-personal"
+	flyClient := flyio.NewClient("test-token").WithBaseURL(flyServer.URL)
+	if err := flyClient.EnsureApp(testCtx, appName, "personal"); err != nil {
+		t.Fatalf("EnsureApp failed: %v", err)
+	}
+	failAppCreation(t, appName)
+
+	// The frpc config Secret labelled with the Service is the ownership
+	// marker left behind by a Provision whose annotations were never written.
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "frpc-test-orphan-ns-test-svc-orphan-config",
+			Namespace: operatorNamespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by":    "fly-tunnel-operator",
+				"fly-tunnel-operator.dev/service": "test-orphan-ns-test-svc-orphan",
+			},
+		},
+		Data: map[string][]byte{"frpc.toml": nil},
+	}
+	if err := k8sClient.Create(testCtx, secret); err != nil {
+		t.Fatalf("failed to create secret: %v", err)
+	}
+
+	svc := unannotatedService("test-svc-orphan", "test-orphan-ns")
+	key := client.ObjectKeyFromObject(svc)
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	if err := k8sClient.Delete(testCtx, svc); err != nil {
+		t.Fatalf("failed to delete service: %v", err)
+	}
+	waitForServiceDeletion(t, key, testTimeout)
+
+	if flyServer.HasApp(appName) {
+		t.Error("expected the owned app to be deleted")
+	}
+	err := k8sClient.Get(testCtx, client.ObjectKeyFromObject(secret), &corev1.Secret{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected frpc config Secret to be deleted, got %v", err)
+	}
+}
+
 func containsSubstring(s, substr string) bool {
 	for i := 0; i <= len(s)-len(substr); i++ {
 		if s[i:i+len(substr)] == substr {
@@ -398,3 +691,204 @@ func containsSubstring(s, substr string) bool {
 	}
 	return false
 }
+
+// waitForAnnotation polls until the Service annotation satisfies cond.
+func waitForAnnotation(t *testing.T, key types.NamespacedName, annotation string, cond func(string) bool, timeout time.Duration) *corev1.Service {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var svc corev1.Service
+		if err := k8sClient.Get(testCtx, key, &svc); err == nil && cond(svc.Annotations[annotation]) {
+			return &svc
+		}
+		time.Sleep(testInterval)
+	}
+	t.Fatalf("timed out waiting for annotation %s on %s", annotation, key)
+	return nil
+}
+
+func TestReconcile_PermanentFailure_RetryAnnotation(t *testing.T) {
+	ensureNamespace(t, "test-retry-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	appName := "fly-tunnel-test-retry-ns-test-svc-retry-personal"
+	var attempts atomic.Int32
+	flyServer.OnCreateApp = func(name, _ string) error {
+		if name != appName {
+			return nil
+		}
+		if attempts.Add(1) == 1 {
+			return &fakefly.StatusError{Code: http.StatusPaymentRequired, Message: "app quota exceeded"}
+		}
+		return nil
+	}
+	t.Cleanup(func() { flyServer.OnCreateApp = nil })
+
+	svc := unannotatedService("test-svc-retry", "test-retry-ns")
+	svc.Finalizers = nil
+	key := client.ObjectKeyFromObject(svc)
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	// The quota error puts the Service in the Error state...
+	failed := waitForAnnotation(t, key, controller.AnnotationError, func(v string) bool { return v != "" }, testTimeout)
+	if !containsSubstring(failed.Annotations[controller.AnnotationError], "quota") {
+		t.Errorf("expected the error annotation to describe the quota failure, got %q", failed.Annotations[controller.AnnotationError])
+	}
+
+	// ...and it is not retried on its own.
+	time.Sleep(2 * time.Second)
+	if n := attempts.Load(); n != 1 {
+		t.Fatalf("expected no automatic retries, got %d attempts", n)
+	}
+
+	// Setting the retry annotation clears the error and provisions.
+	failed.Annotations[controller.AnnotationRetry] = "1"
+	if err := k8sClient.Update(testCtx, failed); err != nil {
+		t.Fatalf("failed to set retry annotation: %v", err)
+	}
+
+	ip := waitForServiceIP(t, key, testTimeout)
+	if ip == "" {
+		t.Fatal("expected the retried Service to get an external IP")
+	}
+	var fetched corev1.Service
+	if err := k8sClient.Get(testCtx, key, &fetched); err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if fetched.Annotations[controller.AnnotationError] != "" {
+		t.Errorf("expected the error annotation to be cleared, got %q", fetched.Annotations[controller.AnnotationError])
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("expected exactly one retry, got %d attempts", n)
+	}
+}
+
+// waitForEvent waits for an Event with reason to be recorded on the Service
+// key and returns it.
+func waitForEvent(t *testing.T, key types.NamespacedName, reason string, timeout time.Duration) *corev1.Event {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var events corev1.EventList
+		if err := k8sClient.List(testCtx, &events, client.InNamespace(key.Namespace)); err == nil {
+			for i := range events.Items {
+				event := &events.Items[i]
+				if event.InvolvedObject.Kind == "Service" && event.InvolvedObject.Name == key.Name && event.Reason == reason {
+					return event
+				}
+			}
+		}
+		time.Sleep(testInterval)
+	}
+	t.Fatalf("timed out waiting for a %s event on Service %s", reason, key)
+	return nil
+}
+
+func TestReconcile_RecordsLifecycleEvents(t *testing.T) {
+	ensureNamespace(t, "test-events-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	svc := unannotatedService("test-svc-events", "test-events-ns")
+	svc.Finalizers = nil
+	key := client.ObjectKeyFromObject(svc)
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	waitForEvent(t, key, "Provisioning", testTimeout)
+	provisioned := waitForEvent(t, key, "Provisioned", testTimeout)
+	if provisioned.Type != corev1.EventTypeNormal {
+		t.Errorf("expected a Normal Provisioned event, got %s", provisioned.Type)
+	}
+
+	var fetched corev1.Service
+	if err := k8sClient.Get(testCtx, key, &fetched); err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if ip := fetched.Annotations[tunnel.AnnotationPublicIP]; ip == "" || !containsSubstring(provisioned.Message, ip) {
+		t.Errorf("expected the Provisioned event to name the public IP %q, got %q", ip, provisioned.Message)
+	}
+
+	if err := k8sClient.Delete(testCtx, &fetched); err != nil {
+		t.Fatalf("failed to delete service: %v", err)
+	}
+	waitForEvent(t, key, "TunnelTeardown", testTimeout)
+	waitForServiceDeletion(t, key, testTimeout)
+}
+
+func TestReconcile_ReadyConditionAfterProvisioning(t *testing.T) {
+	ensureNamespace(t, "test-ready-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	svc := unannotatedService("test-svc-ready", "test-ready-ns")
+	svc.Finalizers = nil
+	key := client.ObjectKeyFromObject(svc)
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	ip := waitForServiceIP(t, key, testTimeout)
+	var fetched corev1.Service
+	if err := k8sClient.Get(testCtx, key, &fetched); err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	cond := meta.FindStatusCondition(fetched.Status.Conditions, controller.ConditionReady)
+	if cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Fatalf("expected the Ready condition to be True once the IP is live, got %+v", cond)
+	}
+	if !containsSubstring(cond.Message, ip) {
+		t.Errorf("expected the Ready message to name the IP %s, got %q", ip, cond.Message)
+	}
+}
+
+func TestReconcile_ProvisionFailure_RetriedWithBackoff(t *testing.T) {
+	ensureNamespace(t, "test-backoff-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	// Fail the first few IP allocations of this Service's tunnel only.
+	const failures = 3
+	appName := "fly-tunnel-test-backoff-ns-test-svc-backoff-personal"
+	var attempts atomic.Int32
+	flyServer.OnAllocateIP = func(name string) error {
+		if name != appName {
+			return nil
+		}
+		if attempts.Add(1) <= failures {
+			return errors.New("simulated IP quota exhaustion")
+		}
+		return nil
+	}
+	t.Cleanup(func() { flyServer.OnAllocateIP = nil })
+
+	lbClass := controller.DefaultLoadBalancerClass
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-svc-backoff", Namespace: "test-backoff-ns"},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: &lbClass,
+			Ports:             []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+			Selector:          map[string]string{"app": "test"},
+		},
+	}
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	// The Service is retried past the failures rather than abandoned.
+	ip := waitForServiceIP(t, client.ObjectKeyFromObject(svc), testTimeout)
+	if ip == "" {
+		t.Fatal("expected a non-empty external IP")
+	}
+	if n := attempts.Load(); n <= failures {
+		t.Errorf("expected an allocation attempt after the %d failures, got %d attempts", failures, n)
+	}
+	var fetched corev1.Service
+	if err := k8sClient.Get(testCtx, client.ObjectKeyFromObject(svc), &fetched); err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if fetched.Annotations[controller.AnnotationError] != "" {
+		t.Errorf("expected a transient failure not to mark the Service failed, got %q", fetched.Annotations[controller.AnnotationError])
+	}
+}
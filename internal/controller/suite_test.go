@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
@@ -31,7 +32,17 @@ var (
 	flyServer *fakefly.Server
 )
 
-const operatorNamespace = "fly-tunnel-operator-system"
+const (
+	operatorNamespace = "fly-tunnel-operator-system"
+
+	// frpcReadyTimeout is kept short because envtest has no Deployment
+	// controller, so frpc never becomes available on its own.
+	frpcReadyTimeout = 5 * time.Second
+
+	// maxProvisionBackoff is kept short so that Services whose provisioning
+	// a test fails come up soon after it stops failing.
+	maxProvisionBackoff = time.Second
+)
 
 func TestMain(m *testing.M) {
 	log.SetLogger(zap.New(zap.WriteTo(os.Stderr), zap.UseDevMode(true)))
@@ -85,7 +96,7 @@ func TestMain(m *testing.M) {
 		mgr.GetClient(),
 		tunnelMgr,
 		controller.DefaultLoadBalancerClass,
-	)
+	).WithFrpcReadyGate(frpcReadyTimeout).WithExternalDNSHints().WithProvisionBackoff(maxProvisionBackoff)
 	if err := reconciler.SetupWithManager(mgr); err != nil {
 		panic("failed to setup reconciler: " + err.Error())
 	}
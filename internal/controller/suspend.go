@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// reconcileSuspended stops the Machine of a suspended tunnel and withdraws
+// its IP from the Service status until it is resumed.
+func (r *ServiceReconciler) reconcileSuspended(ctx context.Context, svc *corev1.Service) (reconcile.Result, error) {
+	logger := log.FromContext(ctx)
+
+	if _, err := r.tunnelManager.Update(ctx, svc); errors.Is(err, tunnel.ErrProvisionInProgress) {
+		return reconcile.Result{RequeueAfter: provisionInProgressRequeueInterval}, nil
+	} else if err != nil {
+		logger.Error(err, "Failed to suspend tunnel")
+		r.event(svc, corev1.EventTypeWarning, "TunnelUpdateFailed", "Suspending the tunnel failed, will retry: %v", err)
+		return reconcile.Result{}, fmt.Errorf("suspending tunnel: %w", err)
+	}
+
+	if len(svc.Status.LoadBalancer.Ingress) > 0 {
+		patch := client.MergeFrom(svc.DeepCopy())
+		svc.Status.LoadBalancer.Ingress = nil
+		if err := r.client.Status().Patch(ctx, svc, patch); err != nil {
+			return reconcile.Result{}, fmt.Errorf("clearing service status: %w", err)
+		}
+		logger.Info("Cleared Service status for suspended tunnel")
+	}
+	if err := r.reconcileExternalDNSHints(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.recordVhostDomains(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.withholdIngress(ctx, svc, WithheldSuspended, "The tunnel is suspended; its fly.io Machine is stopped"); err != nil {
+		return reconcile.Result{}, err
+	}
+	return r.resync(), nil
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// AnnotationUnsupportedPorts records the ports of a Service left out of its
+// tunnel because frp cannot tunnel their protocol, e.g. "sip (5060/SCTP)".
+// It is absent while every port is supported.
+const AnnotationUnsupportedPorts = "fly-tunnel-operator.dev/unsupported-ports"
+
+// unsupportedPorts returns the AnnotationUnsupportedPorts value of svc, ""
+// for none.
+func unsupportedPorts(svc *corev1.Service) string {
+	var ports []string
+	for _, port := range frp.UnsupportedPorts(svc) {
+		if port.Name != "" {
+			ports = append(ports, fmt.Sprintf("%s (%d/%s)", port.Name, port.Port, port.Protocol))
+		} else {
+			ports = append(ports, fmt.Sprintf("%d/%s", port.Port, port.Protocol))
+		}
+	}
+	return strings.Join(ports, ", ")
+}
+
+// recordUnsupportedPorts brings AnnotationUnsupportedPorts of svc in line
+// with its ports, with a Warning event when ports are newly left out.
+func (r *ServiceReconciler) recordUnsupportedPorts(ctx context.Context, svc *corev1.Service) error {
+	ports := unsupportedPorts(svc)
+	if current, ok := svc.Annotations[AnnotationUnsupportedPorts]; current == ports && ok == (ports != "") {
+		return nil
+	}
+	patch := client.MergeFrom(svc.DeepCopy())
+	if ports != "" {
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+		svc.Annotations[AnnotationUnsupportedPorts] = ports
+	} else {
+		delete(svc.Annotations, AnnotationUnsupportedPorts)
+	}
+	if err := r.client.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("recording unsupported ports: %w", err)
+	}
+	log.FromContext(ctx).Info("Recorded unsupported ports", "ports", ports)
+	if ports != "" {
+		r.event(svc, corev1.EventTypeWarning, "UnsupportedPorts",
+			"Ports %s are not tunneled: frp only tunnels TCP and UDP", ports)
+	}
+	return nil
+}
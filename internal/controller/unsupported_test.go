@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestReconcile_UnsupportedPorts(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	svc.Spec.Ports = append(svc.Spec.Ports,
+		corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+		corev1.ServicePort{Name: "sip", Port: 5060, Protocol: corev1.ProtocolSCTP},
+	)
+	env := newGroupTestEnv(t, svc)
+
+	env.reconcile(svc)
+	if svc.Annotations[AnnotationError] != "" {
+		t.Fatalf("expected the supported ports to be provisioned, got %q", svc.Annotations[AnnotationError])
+	}
+	if env.server.AppCount() != 1 {
+		t.Fatalf("expected a tunnel, got %d apps", env.server.AppCount())
+	}
+	if got := svc.Annotations[AnnotationUnsupportedPorts]; got != "sip (5060/SCTP)" {
+		t.Errorf("expected sip recorded as unsupported, got %q", got)
+	}
+	var warnings []string
+	for _, e := range env.events() {
+		if strings.Contains(e, " UnsupportedPorts ") {
+			warnings = append(warnings, e)
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "sip (5060/SCTP)") {
+		t.Fatalf("expected one warning naming the SCTP port, got %v", warnings)
+	}
+
+	env.reconcile(svc)
+	if hasEvent(env.events(), "UnsupportedPorts") {
+		t.Error("expected no second warning for the same ports")
+	}
+
+	// Dropping the port clears the record.
+	svc.Spec.Ports = svc.Spec.Ports[:2]
+	if err := env.kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	env.reconcile(svc)
+	if _, ok := svc.Annotations[AnnotationUnsupportedPorts]; ok {
+		t.Errorf("expected the annotation to be removed, got %q", svc.Annotations[AnnotationUnsupportedPorts])
+	}
+}
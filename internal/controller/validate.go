@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// controllerAnnotations are the annotations in the operator's prefix that
+// the controller, rather than the tunnel package, reads or writes.
+var controllerAnnotations = []string{
+	AnnotationError,
+	AnnotationRetry,
+	annotationRetryObserved,
+	AnnotationIngressWithheldReason,
+	AnnotationFlyHostname,
+	annotationExternalDNSTargetManaged,
+	AnnotationVhostDomains,
+	AnnotationUnsupportedPorts,
+}
+
+// unknownAnnotationWarnings remembers the unknown annotations each Service
+// was last warned about, so a Service is warned again only when they change.
+type unknownAnnotationWarnings struct {
+	mu     sync.Mutex
+	warned map[types.NamespacedName]string
+}
+
+// warnUnknownAnnotations records a Warning event on svc naming the
+// annotations in the operator's prefix it does not know, typically typos.
+func (r *ServiceReconciler) warnUnknownAnnotations(ctx context.Context, svc *corev1.Service) {
+	unknown := strings.Join(tunnel.UnknownAnnotations(svc, controllerAnnotations...), ", ")
+	key := client.ObjectKeyFromObject(svc)
+
+	w := &r.unknownAnnotations
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.warned[key] == unknown {
+		return
+	}
+	if w.warned == nil {
+		w.warned = make(map[types.NamespacedName]string)
+	}
+	w.warned[key] = unknown
+	if unknown == "" {
+		return
+	}
+	log.FromContext(ctx).Info("Service has unknown annotations", "annotations", unknown)
+	r.event(svc, corev1.EventTypeWarning, "UnknownAnnotations",
+		"Ignoring unknown annotations %s; check them for typos", unknown)
+}
+
+// forgetUnknownAnnotations drops what was remembered about the deleted
+// Service key.
+func (r *ServiceReconciler) forgetUnknownAnnotations(key types.NamespacedName) {
+	w := &r.unknownAnnotations
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.warned, key)
+}
+
+// validate puts svc in the Error state, returning true, if it cannot be
+// provisioned as it stands.
+func (r *ServiceReconciler) validate(ctx context.Context, svc *corev1.Service) (bool, error) {
+	err := tunnel.ValidateService(svc, r.tunnelManager.Config())
+	if err == nil {
+		return false, nil
+	}
+	r.backoff.reset(client.ObjectKeyFromObject(svc))
+	_, err = r.markFailed(ctx, svc, fmt.Errorf("invalid Service: %w", err))
+	return true, err
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestReconcile_InvalidServiceFailsBeforeFly(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	svc.Spec.Ports = nil
+	svc.Annotations[tunnel.AnnotationFlyRegion] = "Sydney"
+	env := newGroupTestEnv(t, svc)
+
+	env.reconcile(svc)
+	if env.server.AppCount() != 0 {
+		t.Fatalf("expected nothing created on Fly.io, got %d apps", env.server.AppCount())
+	}
+	msg := svc.Annotations[AnnotationError]
+	for _, want := range []string{"no ports", tunnel.AnnotationFlyRegion} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected the error annotation to mention %q, got %q", want, msg)
+		}
+	}
+	if !hasEvent(env.events(), "ProvisioningFailed") {
+		t.Error("expected a ProvisioningFailed event")
+	}
+
+	// The Error state holds: no retry loop against Fly.io.
+	env.reconcile(svc)
+	if env.server.AppCount() != 0 || svc.Annotations[AnnotationError] != msg {
+		t.Errorf("expected the Service to stay failed, got %d apps and error %q", env.server.AppCount(), svc.Annotations[AnnotationError])
+	}
+}
+
+func TestReconcile_UnknownAnnotationsWarnedOnce(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	svc.Annotations["fly-tunnel-operator.dev/bandwith-limit"] = "1MB"
+	svc.Annotations[AnnotationRetry] = "1"
+	env := newGroupTestEnv(t, svc)
+
+	env.reconcile(svc)
+	var warnings []string
+	for _, e := range env.events() {
+		if strings.Contains(e, " UnknownAnnotations ") {
+			warnings = append(warnings, e)
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "fly-tunnel-operator.dev/bandwith-limit") ||
+		strings.Contains(warnings[0], AnnotationRetry) {
+		t.Fatalf("expected one warning naming only the typo, got %v", warnings)
+	}
+
+	env.reconcile(svc)
+	if hasEvent(env.events(), "UnknownAnnotations") {
+		t.Error("expected no second warning for the same annotations")
+	}
+
+	svc.Annotations["fly-tunnel-operator.dev/pool-cont"] = "2"
+	if err := env.kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	env.reconcile(svc)
+	if !hasEvent(env.events(), "UnknownAnnotations") {
+		t.Error("expected a new warning once another unknown annotation appears")
+	}
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// AnnotationVhostDomains records the domains the vhost proxies of a tunnel
+// answer for on its published IP, for DNS to point at the IP in the Service
+// status. It is absent while the tunnel has no vhost proxies or no IP.
+const AnnotationVhostDomains = "fly-tunnel-operator.dev/vhost-domains"
+
+// vhostDomains returns the AnnotationVhostDomains value of svc, "" for none.
+func vhostDomains(svc *corev1.Service) string {
+	if len(ingressIPs(svc)) == 0 {
+		return ""
+	}
+	if httpPort, httpsPort := frp.VhostPorts(svc); httpPort == 0 && httpsPort == 0 {
+		return ""
+	}
+	return strings.Join(frp.CustomDomains(svc), ",")
+}
+
+// recordVhostDomains brings AnnotationVhostDomains of svc in line with its
+// vhost proxies and published IPs.
+func (r *ServiceReconciler) recordVhostDomains(ctx context.Context, svc *corev1.Service) error {
+	domains := vhostDomains(svc)
+	if current, ok := svc.Annotations[AnnotationVhostDomains]; current == domains && ok == (domains != "") {
+		return nil
+	}
+	patch := client.MergeFrom(svc.DeepCopy())
+	if domains != "" {
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+		svc.Annotations[AnnotationVhostDomains] = domains
+	} else {
+		delete(svc.Annotations, AnnotationVhostDomains)
+	}
+	if err := r.client.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("recording vhost domains: %w", err)
+	}
+	log.FromContext(ctx).Info("Recorded vhost domains", "domains", domains)
+	return nil
+}
@@ -0,0 +1,64 @@
+package controller_test
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/controller"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+func TestReconcile_VhostDomains(t *testing.T) {
+	ensureNamespace(t, "test-vhost-ns")
+	ensureNamespace(t, operatorNamespace)
+
+	lbClass := controller.DefaultLoadBalancerClass
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-svc-vhost",
+			Namespace: "test-vhost-ns",
+			Annotations: map[string]string{
+				frp.PortAnnotation("http", frp.AnnotationProxyType): "http",
+				frp.AnnotationCustomDomains:                         "a.example.com,b.example.com",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:              corev1.ServiceTypeLoadBalancer,
+			LoadBalancerClass: &lbClass,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+				{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP},
+			},
+			Selector: map[string]string{"app": "test"},
+		},
+	}
+	if err := k8sClient.Create(testCtx, svc); err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	key := types.NamespacedName{Name: "test-svc-vhost", Namespace: "test-vhost-ns"}
+
+	waitForServiceIP(t, key, testTimeout)
+	waitForAnnotations(t, key, func(a map[string]string) bool {
+		return a[controller.AnnotationVhostDomains] == "a.example.com,b.example.com"
+	})
+
+	// The recorded domains follow the annotation.
+	if err := k8sClient.Get(testCtx, key, svc); err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	svc.Annotations[frp.AnnotationCustomDomains] = "c.example.com"
+	if err := k8sClient.Update(testCtx, svc); err != nil {
+		t.Fatalf("failed to update service: %v", err)
+	}
+	waitForAnnotations(t, key, func(a map[string]string) bool {
+		return a[controller.AnnotationVhostDomains] == "c.example.com"
+	})
+
+	if err := k8sClient.Delete(testCtx, svc); err != nil {
+		t.Fatalf("failed to delete service: %v", err)
+	}
+	waitForServiceDeletion(t, key, testTimeout)
+}
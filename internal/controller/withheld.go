@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AnnotationIngressWithheldReason records why the controller keeps the
+// tunnel IP out of the status of a managed Service. It holds the reason of
+// the Ready condition, whose message explains it, and is removed once the IP
+// is published.
+const AnnotationIngressWithheldReason = "fly-tunnel-operator.dev/ingress-withheld-reason"
+
+// Reasons the tunnel IP is withheld from the Service status.
+const (
+	// WithheldWaitingForFrpc: the frpc gate waits for frpc to become
+	// available before publishing the IP.
+	WithheldWaitingForFrpc = "WaitingForFrpc"
+	// WithheldSuspended: the tunnel is suspended.
+	WithheldSuspended = "Suspended"
+	// WithheldError: provisioning failed permanently.
+	WithheldError = "Error"
+	// WithheldPending: provisioning waits for a provisioning limit.
+	WithheldPending = "Pending"
+)
+
+// withholdIngress records reason as why svc has no IP in its status, and
+// marks it not Ready with reason and message.
+func (r *ServiceReconciler) withholdIngress(ctx context.Context, svc *corev1.Service, reason, message string) error {
+	if err := r.setWithheldReason(ctx, svc, reason); err != nil {
+		return err
+	}
+	return r.setReady(ctx, svc, metav1.ConditionFalse, reason, message)
+}
+
+// setWithheldReason sets AnnotationIngressWithheldReason of svc to reason,
+// "" removing it, if it differs.
+func (r *ServiceReconciler) setWithheldReason(ctx context.Context, svc *corev1.Service, reason string) error {
+	if current, ok := svc.Annotations[AnnotationIngressWithheldReason]; current == reason && ok == (reason != "") {
+		return nil
+	}
+	patch := client.MergeFrom(svc.DeepCopy())
+	if reason != "" {
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+		svc.Annotations[AnnotationIngressWithheldReason] = reason
+	} else {
+		delete(svc.Annotations, AnnotationIngressWithheldReason)
+	}
+	if err := r.client.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("recording why the ingress IP is withheld: %w", err)
+	}
+	return nil
+}
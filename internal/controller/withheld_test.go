@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// assertWithheld checks that svc has no ingress IP, for reason.
+func assertWithheld(t *testing.T, svc *corev1.Service, reason string) {
+	t.Helper()
+	if len(svc.Status.LoadBalancer.Ingress) != 0 {
+		t.Errorf("expected no ingress IP, got %+v", svc.Status.LoadBalancer.Ingress)
+	}
+	if got := svc.Annotations[AnnotationIngressWithheldReason]; got != reason {
+		t.Errorf("expected the withheld reason %q, got %q", reason, got)
+	}
+	if cond := meta.FindStatusCondition(svc.Status.Conditions, ConditionReady); cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != reason {
+		t.Errorf("expected Ready=False with reason %q, got %+v", reason, cond)
+	}
+}
+
+// assertPublished checks that svc has its ingress IP and no withheld reason.
+func assertPublished(t *testing.T, svc *corev1.Service) {
+	t.Helper()
+	if len(svc.Status.LoadBalancer.Ingress) == 0 {
+		t.Error("expected the ingress IP to be published")
+	}
+	if reason, ok := svc.Annotations[AnnotationIngressWithheldReason]; ok {
+		t.Errorf("expected no withheld reason, got %q", reason)
+	}
+}
+
+func TestIngressWithheld_WaitingForFrpc(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	env := newGroupTestEnv(t, svc)
+	env.r.WithFrpcReadyGate(time.Hour)
+
+	// The fake client leaves the creation time of the frpc Deployment
+	// unset, so the first reconcile publishes the IP as if the gate had
+	// timed out. Start over with a fresh Deployment.
+	env.reconcile(svc)
+	svc.Status.LoadBalancer.Ingress = nil
+	if err := env.kubeClient.Status().Update(context.Background(), svc); err != nil {
+		t.Fatalf("clearing service status: %v", err)
+	}
+	var deploy appsv1.Deployment
+	key := types.NamespacedName{Name: svc.Annotations[tunnel.AnnotationFrpcDeployment], Namespace: svc.Annotations[tunnel.AnnotationFrpcNamespace]}
+	if err := env.kubeClient.Get(context.Background(), key, &deploy); err != nil {
+		t.Fatalf("getting frpc deployment: %v", err)
+	}
+	deploy.CreationTimestamp = metav1.Now()
+	if err := env.kubeClient.Update(context.Background(), &deploy); err != nil {
+		t.Fatalf("updating frpc deployment: %v", err)
+	}
+
+	env.reconcile(svc)
+	assertWithheld(t, svc, WithheldWaitingForFrpc)
+
+	if err := env.kubeClient.Get(context.Background(), key, &deploy); err != nil {
+		t.Fatalf("getting frpc deployment: %v", err)
+	}
+	deploy.Status.AvailableReplicas = 1
+	if err := env.kubeClient.Status().Update(context.Background(), &deploy); err != nil {
+		t.Fatalf("updating frpc deployment status: %v", err)
+	}
+	env.reconcile(svc)
+	assertPublished(t, svc)
+}
+
+func TestIngressWithheld_Suspended(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	env := newGroupTestEnv(t, svc)
+
+	env.reconcile(svc)
+	assertPublished(t, svc)
+
+	svc.Annotations[tunnel.AnnotationSuspend] = "true"
+	if err := env.kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	env.reconcile(svc)
+	assertWithheld(t, svc, WithheldSuspended)
+
+	// Resuming publishes the IP again once the Machine has started.
+	delete(svc.Annotations, tunnel.AnnotationSuspend)
+	if err := env.kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	env.reconcile(svc)
+	env.reconcile(svc)
+	assertPublished(t, svc)
+}
+
+func TestIngressWithheld_Error(t *testing.T) {
+	svc := groupTestService("web", "default", "")
+	svc.Annotations[frp.AnnotationPoolCount] = "many"
+	env := newGroupTestEnv(t, svc)
+
+	env.reconcile(svc)
+	assertWithheld(t, svc, WithheldError)
+
+	// A retry starts over without the stale reason.
+	svc.Annotations[frp.AnnotationPoolCount] = "1"
+	svc.Annotations[AnnotationRetry] = "1"
+	if err := env.kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	env.reconcile(svc)
+	assertPublished(t, svc)
+}
+
+func TestIngressWithheld_Pending(t *testing.T) {
+	first := groupTestService("first", "default", "")
+	second := groupTestService("second", "default", "")
+	env := newGroupTestEnv(t, first, second)
+	env.r.WithProvisionLimits(1, 0)
+
+	env.reconcile(first)
+	env.reconcile(second)
+	assertWithheld(t, second, WithheldPending)
+
+	env.r.WithProvisionLimits(2, 0)
+	env.reconcile(second)
+	assertPublished(t, second)
+}
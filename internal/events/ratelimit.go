@@ -0,0 +1,131 @@
+// Package events provides EventRecorder wrappers used by the operator.
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// DefaultWindow is how long identical Warning events are suppressed after one
+// is emitted.
+const DefaultWindow = 5 * time.Minute
+
+type eventKey struct {
+	object string
+	reason string
+}
+
+type eventState struct {
+	emitted    time.Time
+	suppressed int
+}
+
+// RateLimitedRecorder wraps an EventRecorder so that a persistently failing
+// object emits at most one Warning event per reason per window. The next
+// event after a window in which events were suppressed carries a count of
+// the suppressed repeats. Normal events are passed through unchanged.
+type RateLimitedRecorder struct {
+	inner  record.EventRecorder
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	state     map[eventKey]*eventState
+	lastSweep time.Time
+}
+
+var _ record.EventRecorder = &RateLimitedRecorder{}
+
+// NewRateLimitedRecorder wraps inner, suppressing repeated Warning events
+// within window. A zero window disables rate limiting.
+func NewRateLimitedRecorder(inner record.EventRecorder, window time.Duration) *RateLimitedRecorder {
+	return &RateLimitedRecorder{
+		inner:  inner,
+		window: window,
+		now:    time.Now,
+		state:  make(map[eventKey]*eventState),
+	}
+}
+
+// Event implements record.EventRecorder.
+func (r *RateLimitedRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if msg, ok := r.admit(object, eventtype, reason, message); ok {
+		r.inner.Event(object, eventtype, reason, msg)
+	}
+}
+
+// Eventf implements record.EventRecorder.
+func (r *RateLimitedRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// AnnotatedEventf implements record.EventRecorder.
+func (r *RateLimitedRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	if msg, ok := r.admit(object, eventtype, reason, fmt.Sprintf(messageFmt, args...)); ok {
+		r.inner.AnnotatedEventf(object, annotations, eventtype, reason, "%s", msg)
+	}
+}
+
+// admit decides whether an event is emitted, returning the message to use.
+func (r *RateLimitedRecorder) admit(object runtime.Object, eventtype, reason, message string) (string, bool) {
+	if r.window <= 0 || eventtype != corev1.EventTypeWarning {
+		return message, true
+	}
+
+	now := r.now()
+	key := eventKey{object: objectKey(object), reason: reason}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sweep(now)
+
+	st, ok := r.state[key]
+	if !ok {
+		r.state[key] = &eventState{emitted: now}
+		return message, true
+	}
+	if now.Sub(st.emitted) < r.window {
+		st.suppressed++
+		return "", false
+	}
+
+	if st.suppressed > 0 {
+		message = fmt.Sprintf("%s (repeated %d times in the last %s)", message, st.suppressed+1, r.window)
+	}
+	st.emitted = now
+	st.suppressed = 0
+	return message, true
+}
+
+// sweep forgets objects that have been quiet for a full window so the state
+// map doesn't grow with every Service ever seen. It runs at most once per
+// window. Callers must hold r.mu.
+func (r *RateLimitedRecorder) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.window {
+		return
+	}
+	r.lastSweep = now
+	for key, st := range r.state {
+		if st.suppressed == 0 && now.Sub(st.emitted) >= r.window {
+			delete(r.state, key)
+		}
+	}
+}
+
+func objectKey(object runtime.Object) string {
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		return fmt.Sprintf("%T/%p", object, object)
+	}
+	if uid := accessor.GetUID(); uid != "" {
+		return string(uid)
+	}
+	return accessor.GetNamespace() + "/" + accessor.GetName()
+}
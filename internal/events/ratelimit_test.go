@@ -0,0 +1,94 @@
+package events
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func drain(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func testService(name string) *corev1.Service {
+	return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+}
+
+func TestRateLimitedRecorder_BoundsRepeatedWarnings(t *testing.T) {
+	fake := record.NewFakeRecorder(1000)
+	r := NewRateLimitedRecorder(fake, 5*time.Minute)
+	now := time.Unix(0, 0)
+	r.now = func() time.Time { return now }
+
+	svc := testService("web")
+
+	// A failure every 5 seconds for 20 minutes.
+	for i := 0; i < 240; i++ {
+		r.Eventf(svc, corev1.EventTypeWarning, "ProvisionFailed", "provisioning failed: %d", i)
+		now = now.Add(5 * time.Second)
+	}
+
+	events := drain(fake)
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events (one per 5m window), got %d: %v", len(events), events)
+	}
+	if strings.Contains(events[0], "repeated") {
+		t.Errorf("expected the first event to be unannotated, got %q", events[0])
+	}
+	if !strings.Contains(events[1], "(repeated 60 times in the last 5m0s)") {
+		t.Errorf("expected the repeat count in the message, got %q", events[1])
+	}
+}
+
+func TestRateLimitedRecorder_KeysByObjectAndReason(t *testing.T) {
+	fake := record.NewFakeRecorder(100)
+	r := NewRateLimitedRecorder(fake, 5*time.Minute)
+
+	for i := 0; i < 10; i++ {
+		r.Event(testService("a"), corev1.EventTypeWarning, "ProvisionFailed", "failed")
+		r.Event(testService("a"), corev1.EventTypeWarning, "UpdateFailed", "failed")
+		r.Event(testService("b"), corev1.EventTypeWarning, "ProvisionFailed", "failed")
+	}
+
+	if events := drain(fake); len(events) != 3 {
+		t.Errorf("expected one event per object and reason, got %d: %v", len(events), events)
+	}
+}
+
+func TestRateLimitedRecorder_PassesThroughNormalEvents(t *testing.T) {
+	fake := record.NewFakeRecorder(100)
+	r := NewRateLimitedRecorder(fake, 5*time.Minute)
+
+	for i := 0; i < 5; i++ {
+		r.Event(testService("a"), corev1.EventTypeNormal, "Provisioned", "ok")
+	}
+
+	if events := drain(fake); len(events) != 5 {
+		t.Errorf("expected Normal events to pass through, got %d", len(events))
+	}
+}
+
+func TestRateLimitedRecorder_ZeroWindowDisables(t *testing.T) {
+	fake := record.NewFakeRecorder(100)
+	r := NewRateLimitedRecorder(fake, 0)
+
+	for i := 0; i < 5; i++ {
+		r.Event(testService("a"), corev1.EventTypeWarning, "ProvisionFailed", "failed")
+	}
+
+	if events := drain(fake); len(events) != 5 {
+		t.Errorf("expected no rate limiting with a zero window, got %d events", len(events))
+	}
+}
@@ -3,9 +3,13 @@ package fakefly
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 
@@ -17,32 +21,95 @@ type Server struct {
 	*httptest.Server
 
 	mu       sync.Mutex
-	apps     map[string]bool             // appName -> exists
-	machines map[string]*flyio.Machine   // machineID -> Machine
-	ips      map[string]*flyio.IPAddress // ipID -> IPAddress
+	apps     map[string]string            // appName -> org slug
+	machines map[string]*flyio.Machine    // machineID -> Machine
+	owners   map[string]string            // machineID -> appName
+	ips      map[string]*flyio.IPAddress  // ipID -> IPAddress
+	ipOwners map[string]string            // ipID -> appName
+	secrets  map[string]map[string]string // appName -> secret name -> value
+	draining map[string]int               // appName -> create attempts until deletion completes
 
 	nextMachineID int
 	nextIPID      int
 	nextIPAddr    int
 
-	// Hooks for custom behaviour in tests.
+	// Hooks for custom behaviour in tests. OnAllocateIP is called for IPv4
+	// allocations and OnAllocateIPv6 for IPv6 ones.
 	OnCreateApp     func(appName, orgSlug string) error
 	OnDeleteApp     func(appName string) error
 	OnCreateMachine func(appName string, input flyio.CreateMachineInput) error
+	OnUpdateMachine func(appName, machineID string, input flyio.CreateMachineInput) error
 	OnDeleteMachine func(appName, machineID string) error
 	OnAllocateIP    func(appName string) error
+	OnAllocateIPv6  func(appName string) error
 	OnReleaseIP     func(appName, ipID string) error
+	OnSetSecrets    func(appName string, secrets map[string]string) error
+	OnWaitMachine   func(appName, machineID, state string) error
+
+	// Regions are the regions the platform lists; nil lists DefaultRegions.
+	Regions []flyio.Region
+
+	// AppDeletionDrain simulates Fly.io deleting Apps asynchronously: a
+	// deleted App's name stays taken, as pending deletion, for this many
+	// further attempts to create an App with it.
+	AppDeletionDrain int
+}
+
+// StatusError can be returned from a REST hook to control the HTTP status code
+// of the error response. Other errors are reported as 500.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string { return e.Message }
+
+// writeHookError writes the error response for a failed REST hook.
+func writeHookError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		code = statusErr.Code
+	}
+	http.Error(w, err.Error(), code)
 }
 
 // NewServer creates and starts a new fake Fly.io API server.
 func NewServer() *Server {
-	s := &Server{
-		apps:       make(map[string]bool),
+	s := newServer()
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+// Listen creates a new fake Fly.io API server and starts it on addr, e.g.
+// ":4280", for use outside of tests.
+func Listen(addr string) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := newServer()
+	s.Server = httptest.NewUnstartedServer(s.handler())
+	s.Listener.Close()
+	s.Listener = l
+	s.Start()
+	return s, nil
+}
+
+func newServer() *Server {
+	return &Server{
+		apps:       make(map[string]string),
 		machines:   make(map[string]*flyio.Machine),
+		owners:     make(map[string]string),
 		ips:        make(map[string]*flyio.IPAddress),
+		ipOwners:   make(map[string]string),
+		secrets:    make(map[string]map[string]string),
+		draining:   make(map[string]int),
 		nextIPAddr: 1,
 	}
+}
 
+func (s *Server) handler() http.Handler {
 	mux := http.NewServeMux()
 
 	// Apps REST API routes (exact match for create/list).
@@ -54,8 +121,7 @@ func NewServer() *Server {
 	// GraphQL endpoint for IP allocation.
 	mux.HandleFunc("/graphql", s.handleGraphQL)
 
-	s.Server = httptest.NewServer(mux)
-	return s
+	return mux
 }
 
 // AppCount returns the number of apps.
@@ -69,7 +135,8 @@ func (s *Server) AppCount() int {
 func (s *Server) HasApp(name string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.apps[name]
+	_, ok := s.apps[name]
+	return ok
 }
 
 // GetMachines returns a copy of all machines.
@@ -98,6 +165,18 @@ func (s *Server) GetIPs() map[string]*flyio.IPAddress {
 	return result
 }
 
+// AppSecrets returns a copy of the secrets set on an app.
+func (s *Server) AppSecrets(appName string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]string, len(s.secrets[appName]))
+	for k, v := range s.secrets[appName] {
+		result[k] = v
+	}
+	return result
+}
+
 // MachineCount returns the number of machines.
 func (s *Server) MachineCount() int {
 	s.mu.Lock()
@@ -121,7 +200,7 @@ func (s *Server) handleApps(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleAppsAndMachines(w http.ResponseWriter, r *http.Request) {
-	// Parse path: /v1/apps/{appName}[/machines[/{machineID}[/wait]]]
+	// Parse path: /v1/apps/{appName}[/secrets|/machines[/{machineID}[/wait|/stop|/start]]]
 	path := strings.TrimPrefix(r.URL.Path, "/v1/apps/")
 	parts := strings.Split(path, "/")
 
@@ -132,28 +211,46 @@ func (s *Server) handleAppsAndMachines(w http.ResponseWriter, r *http.Request) {
 
 	appName := parts[0]
 
+	// GET /v1/apps/{appName} — get app
+	if len(parts) == 1 && r.Method == http.MethodGet {
+		s.getApp(w, appName)
+		return
+	}
+
 	// DELETE /v1/apps/{appName} — delete app
 	if len(parts) == 1 && r.Method == http.MethodDelete {
 		s.deleteApp(w, r, appName)
 		return
 	}
 
+	// POST /v1/apps/{appName}/secrets — set secrets
+	if len(parts) == 2 && parts[1] == "secrets" && r.Method == http.MethodPost {
+		s.setSecrets(w, r, appName)
+		return
+	}
+
 	if len(parts) < 2 || parts[1] != "machines" {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 
 	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.listMachines(w, appName)
 	case len(parts) == 2 && r.Method == http.MethodPost:
 		s.createMachine(w, r, appName)
 	case len(parts) == 3 && r.Method == http.MethodGet:
 		s.getMachine(w, r, parts[2])
 	case len(parts) == 3 && r.Method == http.MethodPost:
-		s.updateMachine(w, r, parts[2])
+		s.updateMachine(w, r, appName, parts[2])
 	case len(parts) == 3 && r.Method == http.MethodDelete:
 		s.deleteMachine(w, r, appName, parts[2])
+	case len(parts) == 4 && parts[3] == "stop" && r.Method == http.MethodPost:
+		s.setMachineState(w, parts[2], "stopped")
+	case len(parts) == 4 && parts[3] == "start" && r.Method == http.MethodPost:
+		s.setMachineState(w, parts[2], "started")
 	case len(parts) == 4 && parts[3] == "wait" && r.Method == http.MethodGet:
-		s.waitMachine(w, r, parts[2])
+		s.waitMachine(w, r, appName, parts[2])
 	default:
 		http.Error(w, "not found", http.StatusNotFound)
 	}
@@ -168,38 +265,107 @@ func (s *Server) createApp(w http.ResponseWriter, r *http.Request) {
 
 	if s.OnCreateApp != nil {
 		if err := s.OnCreateApp(input.AppName, input.OrgSlug); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeHookError(w, err)
 			return
 		}
 	}
 
 	s.mu.Lock()
-	if s.apps[input.AppName] {
+	if s.draining[input.AppName] > 0 {
+		s.draining[input.AppName]--
+		s.mu.Unlock()
+		http.Error(w, `{"error":"Validation failed: Name is taken by an app pending deletion"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	if _, ok := s.apps[input.AppName]; ok {
 		s.mu.Unlock()
 		http.Error(w, `{"error":"Validation failed: Name has already been taken"}`, http.StatusUnprocessableEntity)
 		return
 	}
-	s.apps[input.AppName] = true
+	s.apps[input.AppName] = input.OrgSlug
 	s.mu.Unlock()
 
 	w.WriteHeader(http.StatusCreated)
 }
 
+func (s *Server) getApp(w http.ResponseWriter, appName string) {
+	s.mu.Lock()
+	org, ok := s.apps[appName]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(flyio.App{
+		Name:         appName,
+		Status:       "deployed",
+		Organization: flyio.Organization{Name: org, Slug: org},
+	})
+}
+
 func (s *Server) deleteApp(w http.ResponseWriter, _ *http.Request, appName string) {
 	if s.OnDeleteApp != nil {
 		if err := s.OnDeleteApp(appName); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeHookError(w, err)
 			return
 		}
 	}
 
 	s.mu.Lock()
+	if _, ok := s.apps[appName]; ok && s.AppDeletionDrain > 0 {
+		s.draining[appName] = s.AppDeletionDrain
+	}
 	delete(s.apps, appName)
+	delete(s.secrets, appName)
+	// Like a forced deletion on Fly.io, the App's Machines and IPs go too.
+	for id, owner := range s.owners {
+		if owner == appName {
+			delete(s.machines, id)
+			delete(s.owners, id)
+		}
+	}
+	for id, owner := range s.ipOwners {
+		if owner == appName {
+			delete(s.ips, id)
+			delete(s.ipOwners, id)
+		}
+	}
 	s.mu.Unlock()
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
+func (s *Server) setSecrets(w http.ResponseWriter, r *http.Request, appName string) {
+	var input flyio.SetAppSecretsInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.OnSetSecrets != nil {
+		if err := s.OnSetSecrets(appName, input.Values); err != nil {
+			writeHookError(w, err)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	if _, ok := s.apps[appName]; !ok {
+		s.mu.Unlock()
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	if s.secrets[appName] == nil {
+		s.secrets[appName] = make(map[string]string)
+	}
+	for k, v := range input.Values {
+		s.secrets[appName][k] = v
+	}
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
 func (s *Server) createMachine(w http.ResponseWriter, r *http.Request, appName string) {
 	var input flyio.CreateMachineInput
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -209,7 +375,7 @@ func (s *Server) createMachine(w http.ResponseWriter, r *http.Request, appName s
 
 	if s.OnCreateMachine != nil {
 		if err := s.OnCreateMachine(appName, input); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeHookError(w, err)
 			return
 		}
 	}
@@ -229,12 +395,27 @@ func (s *Server) createMachine(w http.ResponseWriter, r *http.Request, appName s
 		Config:     input.Config,
 	}
 	s.machines[id] = machine
+	s.owners[id] = appName
 	s.mu.Unlock()
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(machine)
 }
 
+func (s *Server) listMachines(w http.ResponseWriter, appName string) {
+	s.mu.Lock()
+	machines := []*flyio.Machine{}
+	for id, machine := range s.machines {
+		if s.owners[id] == appName {
+			machines = append(machines, machine)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(machines, func(i, j int) bool { return machines[i].ID < machines[j].ID })
+	json.NewEncoder(w).Encode(machines)
+}
+
 func (s *Server) getMachine(w http.ResponseWriter, _ *http.Request, machineID string) {
 	s.mu.Lock()
 	machine, ok := s.machines[machineID]
@@ -248,7 +429,7 @@ func (s *Server) getMachine(w http.ResponseWriter, _ *http.Request, machineID st
 	json.NewEncoder(w).Encode(machine)
 }
 
-func (s *Server) updateMachine(w http.ResponseWriter, r *http.Request, machineID string) {
+func (s *Server) updateMachine(w http.ResponseWriter, r *http.Request, appName, machineID string) {
 	s.mu.Lock()
 	machine, ok := s.machines[machineID]
 	s.mu.Unlock()
@@ -264,6 +445,13 @@ func (s *Server) updateMachine(w http.ResponseWriter, r *http.Request, machineID
 		return
 	}
 
+	if s.OnUpdateMachine != nil {
+		if err := s.OnUpdateMachine(appName, machineID, input); err != nil {
+			writeHookError(w, err)
+			return
+		}
+	}
+
 	s.mu.Lock()
 	machine.Config = input.Config
 	if input.Name != "" {
@@ -277,19 +465,36 @@ func (s *Server) updateMachine(w http.ResponseWriter, r *http.Request, machineID
 func (s *Server) deleteMachine(w http.ResponseWriter, _ *http.Request, appName, machineID string) {
 	if s.OnDeleteMachine != nil {
 		if err := s.OnDeleteMachine(appName, machineID); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeHookError(w, err)
 			return
 		}
 	}
 
 	s.mu.Lock()
 	delete(s.machines, machineID)
+	delete(s.owners, machineID)
 	s.mu.Unlock()
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *Server) waitMachine(w http.ResponseWriter, _ *http.Request, machineID string) {
+// setMachineState completes a stop or start of a Machine at once.
+func (s *Server) setMachineState(w http.ResponseWriter, machineID, state string) {
+	s.mu.Lock()
+	machine, ok := s.machines[machineID]
+	if ok {
+		machine.State = state
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) waitMachine(w http.ResponseWriter, r *http.Request, appName, machineID string) {
 	s.mu.Lock()
 	_, ok := s.machines[machineID]
 	s.mu.Unlock()
@@ -299,6 +504,13 @@ func (s *Server) waitMachine(w http.ResponseWriter, _ *http.Request, machineID s
 		return
 	}
 
+	if s.OnWaitMachine != nil {
+		if err := s.OnWaitMachine(appName, machineID, r.URL.Query().Get("state")); err != nil {
+			writeHookError(w, err)
+			return
+		}
+	}
+
 	// Fake: always return immediately as if the machine reached the target state.
 	w.WriteHeader(http.StatusOK)
 }
@@ -314,36 +526,120 @@ func (s *Server) handleGraphQL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	switch {
+	case aliasedAllocation.MatchString(gqlReq.Query):
+		s.allocateIPs(w, gqlReq.Query, gqlReq.Variables)
 	case strings.Contains(gqlReq.Query, "allocateIpAddress"):
 		s.allocateIP(w, gqlReq.Variables)
 	case strings.Contains(gqlReq.Query, "releaseIpAddress"):
 		s.releaseIP(w, gqlReq.Variables)
 	case strings.Contains(gqlReq.Query, "ipAddresses"):
-		s.listIPs(w)
+		s.listIPs(w, gqlReq.Variables)
+	case strings.Contains(gqlReq.Query, "platform"):
+		s.listRegions(w)
 	default:
 		http.Error(w, "unknown query", http.StatusBadRequest)
 	}
 }
 
+// DefaultRegions are the regions a Server lists unless Regions is set.
+var DefaultRegions = []flyio.Region{
+	{Code: "ams", Name: "Amsterdam, Netherlands", Latitude: 52.374342, Longitude: 4.895439},
+	{Code: "fra", Name: "Frankfurt, Germany", Latitude: 50.1167, Longitude: 8.6833},
+	{Code: "iad", Name: "Ashburn, Virginia (US)", Latitude: 39.02214, Longitude: -77.462555},
+	{Code: "nrt", Name: "Tokyo, Japan", Latitude: 35.621171, Longitude: 139.741941},
+	{Code: "ord", Name: "Chicago, Illinois (US)", Latitude: 41.891047, Longitude: -87.631873},
+	{Code: "sin", Name: "Singapore, Singapore", Latitude: 1.3, Longitude: 103.8},
+	{Code: "sjc", Name: "San Jose, California (US)", Latitude: 37.351601, Longitude: -121.896744},
+	{Code: "syd", Name: "Sydney, Australia", Latitude: -33.866667, Longitude: 151.2},
+}
+
+func (s *Server) listRegions(w http.ResponseWriter) {
+	regions := s.Regions
+	if regions == nil {
+		regions = DefaultRegions
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": map[string]interface{}{
+			"platform": map[string]interface{}{"regions": regions},
+		},
+	})
+}
+
+// aliasedAllocation matches the aliased allocateIpAddress fields of a
+// batched document, capturing the alias and the name of its input variable.
+var aliasedAllocation = regexp.MustCompile(`(\w+)\s*:\s*allocateIpAddress\(\s*input\s*:\s*\$(\w+)\s*\)`)
+
+// allocationInput is the input of an allocateIpAddress mutation.
+type allocationInput struct {
+	AppID string `json:"appId"`
+	Type  string `json:"type"`
+}
+
 func (s *Server) allocateIP(w http.ResponseWriter, variables json.RawMessage) {
 	var vars struct {
-		Input struct {
-			AppID string `json:"appId"`
-			Type  string `json:"type"`
-		} `json:"input"`
+		Input allocationInput `json:"input"`
 	}
 	json.Unmarshal(variables, &vars)
 
-	if s.OnAllocateIP != nil {
-		if err := s.OnAllocateIP(vars.Input.AppID); err != nil {
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"errors": []map[string]string{{"message": err.Error()}},
-			})
-			return
+	ip, err := s.allocate(vars.Input)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"errors": []map[string]string{{"message": err.Error()}},
+		})
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data": map[string]interface{}{
+			"allocateIpAddress": map[string]interface{}{
+				"ipAddress": ip,
+			},
+		},
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// allocateIPs serves a document of aliased allocateIpAddress mutations.
+// Each alias succeeds or fails on its own, a failure leaving its field null
+// with an error whose path names the alias.
+func (s *Server) allocateIPs(w http.ResponseWriter, query string, variables json.RawMessage) {
+	var vars map[string]allocationInput
+	json.Unmarshal(variables, &vars)
+
+	data := make(map[string]interface{})
+	var errs []map[string]interface{}
+	for _, match := range aliasedAllocation.FindAllStringSubmatch(query, -1) {
+		alias, input := match[1], vars[match[2]]
+		ip, err := s.allocate(input)
+		if err != nil {
+			data[alias] = nil
+			errs = append(errs, map[string]interface{}{"message": err.Error(), "path": []string{alias}})
+			continue
+		}
+		data[alias] = map[string]interface{}{"ipAddress": ip}
+	}
+
+	resp := map[string]interface{}{"data": data}
+	if len(errs) > 0 {
+		resp["errors"] = errs
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// allocate allocates an IP for input, unless its hook fails.
+func (s *Server) allocate(input allocationInput) (*flyio.IPAddress, error) {
+	hook := s.OnAllocateIP
+	if input.Type == "v6" {
+		hook = s.OnAllocateIPv6
+	}
+	if hook != nil {
+		if err := hook(input.AppID); err != nil {
+			return nil, err
 		}
 	}
 
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.nextIPID++
 	s.nextIPAddr++
 	ipID := fmt.Sprintf("ip-%d", s.nextIPID)
@@ -353,17 +649,14 @@ func (s *Server) allocateIP(w http.ResponseWriter, variables json.RawMessage) {
 		Type:    "v4",
 		Region:  "global",
 	}
-	s.ips[ipID] = ip
-	s.mu.Unlock()
-
-	resp := map[string]interface{}{
-		"data": map[string]interface{}{
-			"allocateIpAddress": map[string]interface{}{
-				"ipAddress": ip,
-			},
-		},
+	if input.Type == "v6" {
+		ip.Address = fmt.Sprintf("2a09:8280:1::%x", s.nextIPAddr)
+		ip.Type = "v6"
 	}
-	json.NewEncoder(w).Encode(resp)
+	s.ips[ipID] = ip
+	s.ipOwners[ipID] = input.AppID
+	cp := *ip
+	return &cp, nil
 }
 
 func (s *Server) releaseIP(w http.ResponseWriter, variables json.RawMessage) {
@@ -385,8 +678,16 @@ func (s *Server) releaseIP(w http.ResponseWriter, variables json.RawMessage) {
 	}
 
 	s.mu.Lock()
+	_, found := s.ips[vars.Input.IPAddressID]
 	delete(s.ips, vars.Input.IPAddressID)
+	delete(s.ipOwners, vars.Input.IPAddressID)
 	s.mu.Unlock()
+	if !found {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"errors": []map[string]string{{"message": "Could not find IPAddress with id " + vars.Input.IPAddressID}},
+		})
+		return
+	}
 
 	resp := map[string]interface{}{
 		"data": map[string]interface{}{
@@ -398,13 +699,21 @@ func (s *Server) releaseIP(w http.ResponseWriter, variables json.RawMessage) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *Server) listIPs(w http.ResponseWriter) {
+func (s *Server) listIPs(w http.ResponseWriter, variables json.RawMessage) {
+	var vars struct {
+		AppName string `json:"appName"`
+	}
+	json.Unmarshal(variables, &vars)
+
 	s.mu.Lock()
 	nodes := make([]*flyio.IPAddress, 0, len(s.ips))
-	for _, ip := range s.ips {
-		nodes = append(nodes, ip)
+	for id, ip := range s.ips {
+		if s.ipOwners[id] == vars.AppName {
+			nodes = append(nodes, ip)
+		}
 	}
 	s.mu.Unlock()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
 
 	resp := map[string]interface{}{
 		"data": map[string]interface{}{
@@ -0,0 +1,90 @@
+package fakefly
+
+import (
+	"maps"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+// State is a snapshot of the resources held by a Server, for persisting it
+// across restarts.
+type State struct {
+	Apps          map[string]string            `json:"apps"`
+	Machines      map[string]*flyio.Machine    `json:"machines"`
+	MachineOwners map[string]string            `json:"machineOwners"`
+	IPs           map[string]*flyio.IPAddress  `json:"ips"`
+	IPOwners      map[string]string            `json:"ipOwners"`
+	Secrets       map[string]map[string]string `json:"secrets"`
+	Draining      map[string]int               `json:"draining,omitempty"`
+
+	NextMachineID int `json:"nextMachineID"`
+	NextIPID      int `json:"nextIPID"`
+	NextIPAddr    int `json:"nextIPAddr"`
+}
+
+// State returns a copy of the resources held by the server.
+func (s *Server) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := State{
+		Apps:          maps.Clone(s.apps),
+		Machines:      make(map[string]*flyio.Machine, len(s.machines)),
+		MachineOwners: maps.Clone(s.owners),
+		IPs:           make(map[string]*flyio.IPAddress, len(s.ips)),
+		IPOwners:      maps.Clone(s.ipOwners),
+		Secrets:       make(map[string]map[string]string, len(s.secrets)),
+		Draining:      maps.Clone(s.draining),
+		NextMachineID: s.nextMachineID,
+		NextIPID:      s.nextIPID,
+		NextIPAddr:    s.nextIPAddr,
+	}
+	for id, m := range s.machines {
+		cp := *m
+		state.Machines[id] = &cp
+	}
+	for id, ip := range s.ips {
+		cp := *ip
+		state.IPs[id] = &cp
+	}
+	for app, secrets := range s.secrets {
+		state.Secrets[app] = maps.Clone(secrets)
+	}
+	return state
+}
+
+// Restore replaces the resources held by the server with state.
+func (s *Server) Restore(state State) {
+	restored := newServer()
+	restored.apps = orEmpty(maps.Clone(state.Apps))
+	restored.owners = orEmpty(maps.Clone(state.MachineOwners))
+	restored.ipOwners = orEmpty(maps.Clone(state.IPOwners))
+	restored.draining = orEmpty(maps.Clone(state.Draining))
+	for id, m := range state.Machines {
+		cp := *m
+		restored.machines[id] = &cp
+	}
+	for id, ip := range state.IPs {
+		cp := *ip
+		restored.ips[id] = &cp
+	}
+	for app, secrets := range state.Secrets {
+		restored.secrets[app] = maps.Clone(secrets)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apps, s.machines, s.owners = restored.apps, restored.machines, restored.owners
+	s.ips, s.ipOwners = restored.ips, restored.ipOwners
+	s.secrets, s.draining = restored.secrets, restored.draining
+	s.nextMachineID, s.nextIPID = state.NextMachineID, state.NextIPID
+	s.nextIPAddr = max(state.NextIPAddr, 1)
+}
+
+// orEmpty returns m, or an empty map if it is nil.
+func orEmpty[V any](m map[string]V) map[string]V {
+	if m == nil {
+		return make(map[string]V)
+	}
+	return m
+}
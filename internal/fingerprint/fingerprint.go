@@ -0,0 +1,176 @@
+// Package fingerprint captures how the operator is configured, for support:
+// its version and every flag, with credentials redacted.
+package fingerprint
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DefaultConfigMapName is the ConfigMap in the operator namespace the
+	// fingerprint is written to.
+	DefaultConfigMapName = "fly-tunnel-operator-fingerprint"
+
+	// configMapKey holds the fingerprint as JSON.
+	configMapKey = "fingerprint.json"
+
+	// Redacted replaces the value of a set credential flag.
+	Redacted = "<redacted>"
+)
+
+// sensitiveWords mark flags holding credentials.
+var sensitiveWords = []string{"token", "password", "auth", "credential"}
+
+// Fingerprint describes the version and configuration of the operator.
+type Fingerprint struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	// Flags holds the value of every flag, as resolved from the command
+	// line, the environment and defaults. Credentials read Redacted.
+	Flags map[string]string `json:"flags"`
+	// ConfigHash is the SHA-256 of Version and Flags, so two replicas or
+	// restarts can be compared at a glance.
+	ConfigHash string    `json:"configHash"`
+	StartedAt  time.Time `json:"startedAt"`
+}
+
+// New returns the fingerprint of an operator at version configured with fs.
+// Call it once environment fallbacks have been stored in the flag variables.
+func New(version string, fs *flag.FlagSet) *Fingerprint {
+	f := &Fingerprint{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Flags:     make(map[string]string),
+		StartedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	fs.VisitAll(func(fl *flag.Flag) {
+		value := fl.Value.String()
+		if value != "" && sensitive(fl.Name) {
+			value = Redacted
+		}
+		f.Flags[fl.Name] = value
+	})
+
+	names := make([]string, 0, len(f.Flags))
+	for name := range f.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	fmt.Fprintf(h, "version=%s\n", version)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\n", name, f.Flags[name])
+	}
+	f.ConfigHash = hex.EncodeToString(h.Sum(nil))
+	return f
+}
+
+// sensitive reports whether the flag name holds a credential.
+func sensitive(name string) bool {
+	for _, word := range sensitiveWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// JSON renders f.
+func (f *Fingerprint) JSON() []byte {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		// Strings, a map of strings and a time always encode.
+		panic(fmt.Sprintf("fingerprint: encoding: %v", err))
+	}
+	return data
+}
+
+// Handler serves f as JSON.
+func (f *Fingerprint) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(f.JSON())
+	})
+}
+
+// Publisher writes a Fingerprint to a ConfigMap. It is a manager.Runnable;
+// see Publisher.NeedLeaderElection.
+type Publisher struct {
+	kubeClient  client.Client
+	fingerprint *Fingerprint
+	namespace   string
+	name        string
+	leader      bool
+}
+
+// NewPublisher returns a Publisher writing f to the named ConfigMap. With
+// leader set it runs once leadership is acquired, otherwise at startup.
+func NewPublisher(kubeClient client.Client, f *Fingerprint, namespace, name string, leader bool) *Publisher {
+	return &Publisher{kubeClient: kubeClient, fingerprint: f, namespace: namespace, name: name, leader: leader}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+func (p *Publisher) NeedLeaderElection() bool {
+	return p.leader
+}
+
+// Start writes the fingerprint once. Failures are logged rather than
+// returned: the fingerprint is for humans and must not stop the operator.
+func (p *Publisher) Start(ctx context.Context) error {
+	if err := p.publish(ctx); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to write operator fingerprint", "configMap", p.namespace+"/"+p.name)
+	}
+	return nil
+}
+
+func (p *Publisher) publish(ctx context.Context) error {
+	data := map[string]string{
+		configMapKey: string(p.fingerprint.JSON()),
+		"version":    p.fingerprint.Version,
+		"configHash": p.fingerprint.ConfigHash,
+		// The pod that wrote it, and whether it was leading at the time.
+		"writer": os.Getenv("HOSTNAME"),
+		"leader": fmt.Sprint(p.leader),
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var cm corev1.ConfigMap
+		err := p.kubeClient.Get(ctx, types.NamespacedName{Name: p.name, Namespace: p.namespace}, &cm)
+		if apierrors.IsNotFound(err) {
+			cm = corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      p.name,
+					Namespace: p.namespace,
+					Labels: map[string]string{
+						"app.kubernetes.io/managed-by": "fly-tunnel-operator",
+					},
+				},
+				Data: data,
+			}
+			return p.kubeClient.Create(ctx, &cm)
+		}
+		if err != nil {
+			return err
+		}
+		cm.Data = data
+		return p.kubeClient.Update(ctx, &cm)
+	})
+}
@@ -0,0 +1,101 @@
+package fingerprint
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const (
+	testToken    = "fo1_do-not-leak"
+	testPassword = "hunter2-do-not-leak"
+)
+
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("operator", flag.ContinueOnError)
+	fs.String("fly-api-token", testToken, "")
+	fs.String("fly-registry-auth", "bot:"+testPassword+"@ghcr.io", "")
+	fs.String("fly-region", "syd", "")
+	fs.String("load-balancer-class", "fly-tunnel-operator.dev/lb", "")
+	fs.Bool("wait-for-frpc", true, "")
+	return fs
+}
+
+func TestFingerprint_RedactsCredentials(t *testing.T) {
+	f := New("v1.2.3", testFlagSet())
+
+	recorder := httptest.NewRecorder()
+	f.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/config", nil))
+	for name, payload := range map[string]string{"JSON": string(f.JSON()), "handler": recorder.Body.String()} {
+		for _, secret := range []string{testToken, testPassword} {
+			if strings.Contains(payload, secret) {
+				t.Errorf("%s payload contains a credential:\n%s", name, payload)
+			}
+		}
+	}
+
+	var got Fingerprint
+	if err := json.Unmarshal(recorder.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding handler response: %v", err)
+	}
+	if got.Flags["fly-api-token"] != Redacted || got.Flags["fly-registry-auth"] != Redacted {
+		t.Errorf("expected credentials to read %q, got %v", Redacted, got.Flags)
+	}
+	if got.Flags["fly-region"] != "syd" || got.Flags["wait-for-frpc"] != "true" || got.Version != "v1.2.3" {
+		t.Errorf("expected the other settings as configured, got %+v", got)
+	}
+}
+
+func TestFingerprint_ConfigHash(t *testing.T) {
+	a := New("v1", testFlagSet())
+	if b := New("v1", testFlagSet()); a.ConfigHash != b.ConfigHash {
+		t.Errorf("expected the same config to hash the same, got %s and %s", a.ConfigHash, b.ConfigHash)
+	}
+
+	fs := testFlagSet()
+	_ = fs.Set("fly-region", "ord")
+	if c := New("v1", fs); c.ConfigHash == a.ConfigHash {
+		t.Error("expected a config change to change the hash")
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	f := New("v1.2.3", testFlagSet())
+
+	// Written at startup, then again by the leader.
+	for _, leader := range []bool{false, true} {
+		p := NewPublisher(kubeClient, f, "fly-tunnel-operator-system", DefaultConfigMapName, leader)
+		if p.NeedLeaderElection() != leader {
+			t.Errorf("expected NeedLeaderElection %v", leader)
+		}
+		if err := p.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+	}
+
+	var cm corev1.ConfigMap
+	key := types.NamespacedName{Name: DefaultConfigMapName, Namespace: "fly-tunnel-operator-system"}
+	if err := kubeClient.Get(context.Background(), key, &cm); err != nil {
+		t.Fatalf("getting fingerprint ConfigMap: %v", err)
+	}
+	if cm.Data["configHash"] != f.ConfigHash || cm.Data["leader"] != "true" {
+		t.Errorf("expected the leader's fingerprint, got %v", cm.Data)
+	}
+	for _, value := range cm.Data {
+		if strings.Contains(value, testToken) || strings.Contains(value, testPassword) {
+			t.Errorf("ConfigMap contains a credential: %v", cm.Data)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package flyio
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// AuditRecord describes a single mutating call made against the Fly.io API.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	App      string    `json:"app"`
+	Resource string    `json:"resource,omitempty"`
+	Subject  string    `json:"subject,omitempty"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+}
+
+const (
+	AuditResultSuccess = "success"
+	AuditResultError   = "error"
+)
+
+// AuditSink receives an AuditRecord for every mutating Fly.io API call.
+// Sinks must not block for long; they run inline with the API call.
+type AuditSink interface {
+	Record(ctx context.Context, record AuditRecord)
+}
+
+type auditSubjectKey struct{}
+
+// ContextWithAuditSubject attaches the object that triggered subsequent API
+// calls (e.g. "namespace/service") so it is included in audit records.
+func ContextWithAuditSubject(ctx context.Context, subject string) context.Context {
+	return context.WithValue(ctx, auditSubjectKey{}, subject)
+}
+
+// WithAuditSink adds a sink that receives every audit record in addition to
+// the info-level log line the Client always writes.
+func (c *Client) WithAuditSink(sink AuditSink) *Client {
+	c.auditSinks = append(c.auditSinks, sink)
+	return c
+}
+
+// audit records the outcome of a mutating call. resource is the ID of the
+// machine or IP acted on, if any.
+func (c *Client) audit(ctx context.Context, op, app, resource string, err error) {
+	record := AuditRecord{
+		Time:     time.Now().UTC(),
+		Op:       op,
+		App:      app,
+		Resource: resource,
+		Result:   AuditResultSuccess,
+	}
+	if subject, ok := ctx.Value(auditSubjectKey{}).(string); ok {
+		record.Subject = subject
+	}
+	if err != nil {
+		record.Result = AuditResultError
+		record.Error = err.Error()
+	}
+
+	log.FromContext(ctx).WithName("audit").Info("fly.io API mutation",
+		"time", record.Time.Format(time.RFC3339Nano),
+		"op", record.Op,
+		"app", record.App,
+		"resource", record.Resource,
+		"subject", record.Subject,
+		"result", record.Result,
+		"error", record.Error,
+	)
+
+	for _, sink := range c.auditSinks {
+		sink.Record(ctx, record)
+	}
+}
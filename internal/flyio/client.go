@@ -5,11 +5,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -24,6 +27,11 @@ type Client struct {
 	baseURL    string
 	graphQLURL string
 	token      string
+	auditSinks []AuditSink
+	observers  []Observer
+	limiter    *rate.Limiter
+	retry      retryPolicy
+	inFlight   chan struct{}
 }
 
 // NewClient creates a new Fly.io Machines API client.
@@ -66,6 +74,18 @@ type MachineConfig struct {
 	Services []MachineService  `json:"services,omitempty"`
 	Guest    *GuestConfig      `json:"guest,omitempty"`
 	Init     *InitConfig       `json:"init,omitempty"`
+	// ImageRegistryAuth holds the credentials Fly.io pulls Image with; nil
+	// for public images.
+	ImageRegistryAuth *RegistryAuth `json:"image_registry_auth,omitempty"`
+	// Metadata are key-value pairs Fly.io stores with the Machine.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// RegistryAuth holds the credentials of a private container registry.
+type RegistryAuth struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 // InitConfig overrides the container's entrypoint/cmd.
@@ -110,6 +130,19 @@ type IPAddress struct {
 	CreatedAt string `json:"created_at"`
 }
 
+// App is a Fly App.
+type App struct {
+	Name         string       `json:"name"`
+	Status       string       `json:"status"`
+	Organization Organization `json:"organization"`
+}
+
+// Organization is the Fly.io organization an App belongs to.
+type Organization struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
 // CreateAppInput is the request body for creating a Fly App.
 type CreateAppInput struct {
 	AppName string `json:"app_name"`
@@ -134,6 +167,9 @@ type graphQLResponse struct {
 	Data   json.RawMessage `json:"data"`
 	Errors []struct {
 		Message string `json:"message"`
+		// Path leads to the field that failed, starting with its alias
+		// in a batched document.
+		Path []interface{} `json:"path,omitempty"`
 	} `json:"errors,omitempty"`
 }
 
@@ -152,7 +188,15 @@ type releaseIPData struct {
 }
 
 // CreateMachine creates a new Machine in the specified app.
-func (c *Client) CreateMachine(ctx context.Context, appName string, input CreateMachineInput) (*Machine, error) {
+func (c *Client) CreateMachine(ctx context.Context, appName string, input CreateMachineInput) (machine *Machine, err error) {
+	defer func() {
+		var id string
+		if machine != nil {
+			id = machine.ID
+		}
+		c.audit(ctx, opCreateMachine, appName, id, err)
+	}()
+
 	url := fmt.Sprintf("%s/%s/apps/%s/machines", c.baseURL, apiVersion, appName)
 
 	body, err := json.Marshal(input)
@@ -166,7 +210,7 @@ func (c *Client) CreateMachine(ctx context.Context, appName string, input Create
 	}
 	c.setHeaders(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(opCreateMachine, req)
 	if err != nil {
 		return nil, fmt.Errorf("creating machine: %w", err)
 	}
@@ -174,15 +218,18 @@ func (c *Client) CreateMachine(ctx context.Context, appName string, input Create
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("creating machine: status %d, body: %s", resp.StatusCode, string(respBody))
+		if isQuotaRefusal(resp.StatusCode, string(respBody)) {
+			return nil, &QuotaExceededError{Op: "creating machine", StatusCode: resp.StatusCode, Message: string(respBody)}
+		}
+		return nil, &APIError{Op: "creating machine", StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
-	var machine Machine
-	if err := json.NewDecoder(resp.Body).Decode(&machine); err != nil {
+	var created Machine
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
 		return nil, fmt.Errorf("decoding machine response: %w", err)
 	}
 
-	return &machine, nil
+	return &created, nil
 }
 
 // GetMachine retrieves a Machine by ID.
@@ -195,19 +242,15 @@ func (c *Client) GetMachine(ctx context.Context, appName, machineID string) (*Ma
 	}
 	c.setHeaders(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(opGetMachine, req)
 	if err != nil {
 		return nil, fmt.Errorf("getting machine: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("machine %s not found", machineID)
-	}
-
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("getting machine: status %d, body: %s", resp.StatusCode, string(respBody))
+		return nil, &APIError{Op: "getting machine", StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	var machine Machine
@@ -218,8 +261,40 @@ func (c *Client) GetMachine(ctx context.Context, appName, machineID string) (*Ma
 	return &machine, nil
 }
 
+// ListMachines lists all Machines in an app. The Machines API returns them
+// in a single response; there is no pagination to follow.
+func (c *Client) ListMachines(ctx context.Context, appName string) ([]Machine, error) {
+	url := fmt.Sprintf("%s/%s/apps/%s/machines", c.baseURL, apiVersion, appName)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	c.setHeaders(req)
+
+	resp, err := c.do(opListMachines, req)
+	if err != nil {
+		return nil, fmt.Errorf("listing machines: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, &APIError{Op: "listing machines", StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	var machines []Machine
+	if err := json.NewDecoder(resp.Body).Decode(&machines); err != nil {
+		return nil, fmt.Errorf("decoding machine list response: %w", err)
+	}
+
+	return machines, nil
+}
+
 // DeleteMachine destroys a Machine by ID.
-func (c *Client) DeleteMachine(ctx context.Context, appName, machineID string) error {
+func (c *Client) DeleteMachine(ctx context.Context, appName, machineID string) (err error) {
+	defer func() { c.audit(ctx, opDeleteMachine, appName, machineID, err) }()
+
 	url := fmt.Sprintf("%s/%s/apps/%s/machines/%s?force=true", c.baseURL, apiVersion, appName, machineID)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
@@ -228,7 +303,7 @@ func (c *Client) DeleteMachine(ctx context.Context, appName, machineID string) e
 	}
 	c.setHeaders(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(opDeleteMachine, req)
 	if err != nil {
 		return fmt.Errorf("deleting machine: %w", err)
 	}
@@ -236,14 +311,53 @@ func (c *Client) DeleteMachine(ctx context.Context, appName, machineID string) e
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
 		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("deleting machine: status %d, body: %s", resp.StatusCode, string(respBody))
+		return &APIError{Op: "deleting machine", StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	return nil
+}
+
+// StopMachine stops a Machine. A stopped Machine is not billed for compute;
+// its App, IP addresses and configuration are kept for StartMachine.
+func (c *Client) StopMachine(ctx context.Context, appName, machineID string) (err error) {
+	defer func() { c.audit(ctx, opStopMachine, appName, machineID, err) }()
+	return c.machineAction(ctx, opStopMachine, appName, machineID, "stop")
+}
+
+// StartMachine starts a stopped Machine.
+func (c *Client) StartMachine(ctx context.Context, appName, machineID string) (err error) {
+	defer func() { c.audit(ctx, opStartMachine, appName, machineID, err) }()
+	return c.machineAction(ctx, opStartMachine, appName, machineID, "start")
+}
+
+// machineAction posts to the action endpoint of a Machine, e.g. "stop".
+func (c *Client) machineAction(ctx context.Context, op, appName, machineID, action string) error {
+	url := fmt.Sprintf("%s/%s/apps/%s/machines/%s/%s", c.baseURL, apiVersion, appName, machineID, action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	c.setHeaders(req)
+
+	resp, err := c.do(op, req)
+	if err != nil {
+		return fmt.Errorf("%s machine: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return &APIError{Op: action + " machine", StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	return nil
 }
 
 // UpdateMachine updates a Machine's configuration.
-func (c *Client) UpdateMachine(ctx context.Context, appName, machineID string, input CreateMachineInput) (*Machine, error) {
+func (c *Client) UpdateMachine(ctx context.Context, appName, machineID string, input CreateMachineInput) (_ *Machine, err error) {
+	defer func() { c.audit(ctx, opUpdateMachine, appName, machineID, err) }()
+
 	url := fmt.Sprintf("%s/%s/apps/%s/machines/%s", c.baseURL, apiVersion, appName, machineID)
 
 	body, err := json.Marshal(input)
@@ -257,7 +371,7 @@ func (c *Client) UpdateMachine(ctx context.Context, appName, machineID string, i
 	}
 	c.setHeaders(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(opUpdateMachine, req)
 	if err != nil {
 		return nil, fmt.Errorf("updating machine: %w", err)
 	}
@@ -265,7 +379,10 @@ func (c *Client) UpdateMachine(ctx context.Context, appName, machineID string, i
 
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("updating machine: status %d, body: %s", resp.StatusCode, string(respBody))
+		if isUpdateRejection(resp.StatusCode, string(respBody)) {
+			return nil, &UpdateRejectedError{MachineID: machineID, StatusCode: resp.StatusCode, Body: string(respBody)}
+		}
+		return nil, &APIError{Op: "updating machine", StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	var machine Machine
@@ -276,8 +393,36 @@ func (c *Client) UpdateMachine(ctx context.Context, appName, machineID string, i
 	return &machine, nil
 }
 
-// WaitForMachine waits for a Machine to reach the specified state.
+// maxWaitTimeout is the longest wait the Machines API accepts per request.
+const maxWaitTimeout = 60 * time.Second
+
+// WaitForMachine waits for a Machine to reach the specified state. Timeouts
+// longer than the API allows per request are waited out over several
+// requests.
 func (c *Client) WaitForMachine(ctx context.Context, appName, machineID, instanceID, targetState string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		wait := min(time.Until(deadline), maxWaitTimeout)
+		err := c.waitForMachine(ctx, appName, machineID, instanceID, targetState, max(wait, time.Second))
+		var timedOut *waitTimeoutError
+		if !errors.As(err, &timedOut) || time.Until(deadline) <= 0 {
+			return err
+		}
+	}
+}
+
+// waitTimeoutError is returned by waitForMachine when the API gave up
+// waiting before the Machine reached the state.
+type waitTimeoutError struct {
+	body string
+}
+
+func (e *waitTimeoutError) Error() string {
+	return fmt.Sprintf("waiting for machine: status %d, body: %s", http.StatusRequestTimeout, e.body)
+}
+
+// waitForMachine makes a single wait request of at most maxWaitTimeout.
+func (c *Client) waitForMachine(ctx context.Context, appName, machineID, instanceID, targetState string, timeout time.Duration) error {
 	url := fmt.Sprintf("%s/%s/apps/%s/machines/%s/wait?instance_id=%s&state=%s&timeout=%d",
 		c.baseURL, apiVersion, appName, machineID, instanceID, targetState, int(timeout.Seconds()))
 
@@ -287,15 +432,19 @@ func (c *Client) WaitForMachine(ctx context.Context, appName, machineID, instanc
 	}
 	c.setHeaders(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(opWaitForMachine, req)
 	if err != nil {
 		return fmt.Errorf("waiting for machine: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusRequestTimeout {
+		respBody, _ := io.ReadAll(resp.Body)
+		return &waitTimeoutError{body: string(respBody)}
+	}
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("waiting for machine: status %d, body: %s", resp.StatusCode, string(respBody))
+		return &APIError{Op: "waiting for machine", StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	return nil
@@ -303,6 +452,25 @@ func (c *Client) WaitForMachine(ctx context.Context, appName, machineID, instanc
 
 // AllocateDedicatedIPv4 allocates a dedicated IPv4 address for the app using the Fly.io GraphQL API.
 func (c *Client) AllocateDedicatedIPv4(ctx context.Context, appName string) (*IPAddress, error) {
+	return c.allocateIP(ctx, opAllocateDedicatedIPv4, appName, "v4")
+}
+
+// AllocateIPv6 allocates a dedicated IPv6 address for the app using the
+// Fly.io GraphQL API.
+func (c *Client) AllocateIPv6(ctx context.Context, appName string) (*IPAddress, error) {
+	return c.allocateIP(ctx, opAllocateIPv6, appName, "v6")
+}
+
+// allocateIP allocates an IP address of ipType ("v4" or "v6") for the app.
+func (c *Client) allocateIP(ctx context.Context, op, appName, ipType string) (ip *IPAddress, err error) {
+	defer func() {
+		var id string
+		if ip != nil {
+			id = ip.ID
+		}
+		c.audit(ctx, op, appName, id, err)
+	}()
+
 	query := `
 		mutation($input: AllocateIPAddressInput!) {
 			allocateIpAddress(input: $input) {
@@ -320,7 +488,7 @@ func (c *Client) AllocateDedicatedIPv4(ctx context.Context, appName string) (*IP
 	variables := map[string]interface{}{
 		"input": map[string]interface{}{
 			"appId": appName,
-			"type":  "v4",
+			"type":  ipType,
 		},
 	}
 
@@ -340,7 +508,7 @@ func (c *Client) AllocateDedicatedIPv4(ctx context.Context, appName string) (*IP
 	}
 	c.setHeaders(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(op, req)
 	if err != nil {
 		return nil, fmt.Errorf("allocating IP: %w", err)
 	}
@@ -352,6 +520,9 @@ func (c *Client) AllocateDedicatedIPv4(ctx context.Context, appName string) (*IP
 	}
 
 	if len(gqlResp.Errors) > 0 {
+		if isQuotaRefusal(0, gqlResp.Errors[0].Message) {
+			return nil, &QuotaExceededError{Op: "allocating IP", Message: gqlResp.Errors[0].Message}
+		}
 		return nil, fmt.Errorf("graphql error: %s", gqlResp.Errors[0].Message)
 	}
 
@@ -363,8 +534,11 @@ func (c *Client) AllocateDedicatedIPv4(ctx context.Context, appName string) (*IP
 	return &data.AllocateIPAddress.IPAddress, nil
 }
 
-// ReleaseIPAddress releases an allocated IP address.
-func (c *Client) ReleaseIPAddress(ctx context.Context, appName, ipID string) error {
+// ReleaseIPAddress releases an allocated IP address. Releasing one that is
+// no longer allocated fails with an error matching ErrNotFound.
+func (c *Client) ReleaseIPAddress(ctx context.Context, appName, ipID string) (err error) {
+	defer func() { c.audit(ctx, opReleaseIPAddress, appName, ipID, err) }()
+
 	query := `
 		mutation($input: ReleaseIPAddressInput!) {
 			releaseIpAddress(input: $input) {
@@ -398,7 +572,7 @@ func (c *Client) ReleaseIPAddress(ctx context.Context, appName, ipID string) err
 	}
 	c.setHeaders(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(opReleaseIPAddress, req)
 	if err != nil {
 		return fmt.Errorf("releasing IP: %w", err)
 	}
@@ -410,6 +584,9 @@ func (c *Client) ReleaseIPAddress(ctx context.Context, appName, ipID string) err
 	}
 
 	if len(gqlResp.Errors) > 0 {
+		if isNotFoundMessage(gqlResp.Errors[0].Message) {
+			return fmt.Errorf("releasing IP: %w: %s", ErrNotFound, gqlResp.Errors[0].Message)
+		}
 		return fmt.Errorf("graphql error: %s", gqlResp.Errors[0].Message)
 	}
 
@@ -454,7 +631,7 @@ func (c *Client) ListIPAddresses(ctx context.Context, appName string) ([]IPAddre
 	}
 	c.setHeaders(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(opListIPAddresses, req)
 	if err != nil {
 		return nil, fmt.Errorf("listing IPs: %w", err)
 	}
@@ -483,9 +660,41 @@ func (c *Client) ListIPAddresses(ctx context.Context, appName string) ([]IPAddre
 	return data.App.IPAddresses.Nodes, nil
 }
 
+// GetApp returns the Fly App appName, or an error matching ErrNotFound if
+// there is none.
+func (c *Client) GetApp(ctx context.Context, appName string) (*App, error) {
+	url := fmt.Sprintf("%s/%s/apps/%s", c.baseURL, apiVersion, appName)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	c.setHeaders(req)
+
+	resp, err := c.do(opGetApp, req)
+	if err != nil {
+		return nil, fmt.Errorf("getting app: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, &APIError{Op: "getting app", StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	var app App
+	if err := json.NewDecoder(resp.Body).Decode(&app); err != nil {
+		return nil, fmt.Errorf("decoding app response: %w", err)
+	}
+
+	return &app, nil
+}
+
 // EnsureApp creates a Fly App if it doesn't already exist.
 // Returns nil if the app was created or already exists.
-func (c *Client) EnsureApp(ctx context.Context, appName, orgSlug string) error {
+func (c *Client) EnsureApp(ctx context.Context, appName, orgSlug string) (err error) {
+	defer func() { c.audit(ctx, opEnsureApp, appName, "", err) }()
+
 	url := fmt.Sprintf("%s/%s/apps", c.baseURL, apiVersion)
 
 	body, err := json.Marshal(CreateAppInput{
@@ -502,24 +711,37 @@ func (c *Client) EnsureApp(ctx context.Context, appName, orgSlug string) error {
 	}
 	c.setHeaders(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(opEnsureApp, req)
 	if err != nil {
 		return fmt.Errorf("creating app: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// Fly returns 422 with "Name has already been taken" when the app exists.
+	// Fly returns 422 with "Name has already been taken" when the app
+	// exists, or 409 from some API versions.
+	if resp.StatusCode == http.StatusConflict {
+		return nil
+	}
 	if resp.StatusCode == http.StatusUnprocessableEntity {
 		respBody, _ := io.ReadAll(resp.Body)
+		if isPendingDeletion(string(respBody)) {
+			return fmt.Errorf("creating app: %w: %s", ErrAppPendingDeletion, string(respBody))
+		}
 		if strings.Contains(string(respBody), "already been taken") {
 			return nil
 		}
-		return fmt.Errorf("creating app: status %d, body: %s", resp.StatusCode, string(respBody))
+		if isQuotaRefusal(resp.StatusCode, string(respBody)) {
+			return &QuotaExceededError{Op: "creating app", StatusCode: resp.StatusCode, Message: string(respBody)}
+		}
+		return &APIError{Op: "creating app", StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("creating app: status %d, body: %s", resp.StatusCode, string(respBody))
+		if isQuotaRefusal(resp.StatusCode, string(respBody)) {
+			return &QuotaExceededError{Op: "creating app", StatusCode: resp.StatusCode, Message: string(respBody)}
+		}
+		return &APIError{Op: "creating app", StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	return nil
@@ -527,7 +749,9 @@ func (c *Client) EnsureApp(ctx context.Context, appName, orgSlug string) error {
 
 // DeleteApp deletes a Fly App by name.
 // Uses force=true to stop any running Machines and delete immediately.
-func (c *Client) DeleteApp(ctx context.Context, appName string) error {
+func (c *Client) DeleteApp(ctx context.Context, appName string) (err error) {
+	defer func() { c.audit(ctx, opDeleteApp, appName, "", err) }()
+
 	url := fmt.Sprintf("%s/%s/apps/%s?force=true", c.baseURL, apiVersion, appName)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
@@ -536,7 +760,7 @@ func (c *Client) DeleteApp(ctx context.Context, appName string) error {
 	}
 	c.setHeaders(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(opDeleteApp, req)
 	if err != nil {
 		return fmt.Errorf("deleting app: %w", err)
 	}
@@ -544,12 +768,87 @@ func (c *Client) DeleteApp(ctx context.Context, appName string) error {
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
 		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("deleting app: status %d, body: %s", resp.StatusCode, string(respBody))
+		return &APIError{Op: "deleting app", StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	return nil
 }
 
+// SetAppSecretsInput is the request body for setting app secrets.
+type SetAppSecretsInput struct {
+	Values map[string]string `json:"values"`
+}
+
+// SetAppSecrets creates or replaces secrets on a Fly App. Secrets are
+// injected into the environment of the App's Machines when they boot, so
+// running Machines must be restarted (e.g. by UpdateMachine) to see new
+// values. Unlike Machine env, secret values cannot be read back.
+func (c *Client) SetAppSecrets(ctx context.Context, appName string, secrets map[string]string) (err error) {
+	defer func() { c.audit(ctx, opSetAppSecrets, appName, "", err) }()
+
+	url := fmt.Sprintf("%s/%s/apps/%s/secrets", c.baseURL, apiVersion, appName)
+
+	body, err := json.Marshal(SetAppSecretsInput{Values: secrets})
+	if err != nil {
+		return fmt.Errorf("marshaling set secrets input: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	c.setHeaders(req)
+
+	resp, err := c.do(opSetAppSecrets, req)
+	if err != nil {
+		return fmt.Errorf("setting app secrets: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		respBody, _ := io.ReadAll(resp.Body)
+		return &APIError{Op: "setting app secrets", StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	return nil
+}
+
+// send makes one attempt at req on behalf of op, waiting on the client-side
+// rate limiter first (if configured) and reporting the call to every Observer.
+func (c *Client) send(op string, req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	if c.inFlight != nil && op != opWaitForMachine {
+		select {
+		case c.inFlight <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, fmt.Errorf("waiting for a request slot: %w", req.Context().Err())
+		}
+		defer func() { <-c.inFlight }()
+	}
+	if c.limiter != nil {
+		if err := c.limiter.Wait(req.Context()); err != nil {
+			return nil, fmt.Errorf("waiting for rate limiter: %w", err)
+		}
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		for _, o := range c.observers {
+			o.ObserveQueued(op, waited)
+		}
+	}
+
+	start = time.Now()
+
+	resp, err := c.httpClient.Do(req)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	for _, o := range c.observers {
+		o.ObserveRequest(op, statusCode, time.Since(start))
+	}
+	return resp, err
+}
+
 func (c *Client) setHeaders(req *http.Request) {
 	req.Header.Set("Authorization", "Bearer "+c.token)
 	req.Header.Set("Content-Type", "application/json")
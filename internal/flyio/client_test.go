@@ -2,6 +2,15 @@ package flyio_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -89,8 +98,15 @@ func TestGetMachine_NotFound(t *testing.T) {
 	client := newTestClient(server)
 
 	_, err := client.GetMachine(context.Background(), "test-app", "nonexistent")
-	if err == nil {
-		t.Error("expected error for nonexistent machine")
+	if !flyio.IsNotFound(err) {
+		t.Fatalf("expected IsNotFound for a nonexistent machine, got %v", err)
+	}
+	var apiErr *flyio.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an APIError with status 404, got %#v", err)
+	}
+	if flyio.IsConflict(err) || flyio.IsRateLimited(err) {
+		t.Errorf("expected a 404 to be neither a conflict nor rate limited, got %v", err)
 	}
 }
 
@@ -122,6 +138,39 @@ func TestDeleteMachine(t *testing.T) {
 	}
 }
 
+func TestStopAndStartMachine(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	client := newTestClient(server)
+
+	m, err := client.CreateMachine(context.Background(), "test-app", flyio.CreateMachineInput{
+		Name:   "stop-test",
+		Region: "syd",
+		Config: flyio.MachineConfig{Image: "test:latest"},
+	})
+	if err != nil {
+		t.Fatalf("CreateMachine failed: %v", err)
+	}
+
+	if err := client.StopMachine(context.Background(), "test-app", m.ID); err != nil {
+		t.Fatalf("StopMachine failed: %v", err)
+	}
+	if state := server.GetMachines()[m.ID].State; state != "stopped" {
+		t.Errorf("expected state 'stopped', got %q", state)
+	}
+
+	if err := client.StartMachine(context.Background(), "test-app", m.ID); err != nil {
+		t.Fatalf("StartMachine failed: %v", err)
+	}
+	if state := server.GetMachines()[m.ID].State; state != "started" {
+		t.Errorf("expected state 'started', got %q", state)
+	}
+
+	if err := client.StopMachine(context.Background(), "test-app", "nonexistent"); !errors.Is(err, flyio.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing machine, got %v", err)
+	}
+}
+
 func TestUpdateMachine(t *testing.T) {
 	server := fakefly.NewServer()
 	defer server.Close()
@@ -209,6 +258,73 @@ func TestAllocateDedicatedIPv4(t *testing.T) {
 	}
 }
 
+func TestAllocateIPs(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	observer := &recordingObserver{}
+	client := newTestClient(server).WithObserver(observer)
+
+	results, err := client.AllocateIPs(context.Background(), "test-app", []string{"v4", "v6"})
+	if err != nil {
+		t.Fatalf("AllocateIPs failed: %v", err)
+	}
+	if !slices.Equal(observer.requests, []string{"AllocateIPs 200"}) {
+		t.Errorf("expected a single request, got %v", observer.requests)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	for i, want := range []string{"v4", "v6"} {
+		if results[i].Err != nil {
+			t.Fatalf("allocating %s failed: %v", want, results[i].Err)
+		}
+		if results[i].Type != want || results[i].IP.Type != want {
+			t.Errorf("result %d: expected type %q, got %q with IP type %q", i, want, results[i].Type, results[i].IP.Type)
+		}
+	}
+	if server.IPCount() != 2 {
+		t.Errorf("expected 2 IPs on server, got %d", server.IPCount())
+	}
+}
+
+func TestAllocateIPs_PartialFailure(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	client := newTestClient(server)
+
+	server.OnAllocateIPv6 = func(string) error { return errors.New("no IPv6 capacity") }
+	results, err := client.AllocateIPs(context.Background(), "test-app", []string{"v4", "v6"})
+	if err != nil {
+		t.Fatalf("AllocateIPs failed: %v", err)
+	}
+	if results[0].Err != nil || results[0].IP == nil {
+		t.Errorf("expected the IPv4 to be allocated, got %+v", results[0])
+	}
+	if results[1].Err == nil || results[1].IP != nil {
+		t.Errorf("expected the IPv6 to fail, got %+v", results[1])
+	} else if !strings.Contains(results[1].Err.Error(), "no IPv6 capacity") {
+		t.Errorf("expected the IPv6 error to carry the API message, got %v", results[1].Err)
+	}
+	if server.IPCount() != 1 {
+		t.Errorf("expected 1 IP on server, got %d", server.IPCount())
+	}
+
+	server.OnAllocateIPv6 = nil
+	server.OnAllocateIP = func(string) error {
+		return &fakeError{msg: "You have exceeded the number of dedicated IPv4 addresses for this organization"}
+	}
+	results, err = client.AllocateIPs(context.Background(), "test-app", []string{"v4", "v6"})
+	if err != nil {
+		t.Fatalf("AllocateIPs failed: %v", err)
+	}
+	if !flyio.IsQuotaExceeded(results[0].Err) {
+		t.Errorf("expected the IPv4 to fail with a quota refusal, got %v", results[0].Err)
+	}
+	if results[1].Err != nil || results[1].IP == nil {
+		t.Errorf("expected the IPv6 to be allocated, got %+v", results[1])
+	}
+}
+
 func TestReleaseIPAddress(t *testing.T) {
 	server := fakefly.NewServer()
 	defer server.Close()
@@ -233,6 +349,17 @@ func TestReleaseIPAddress(t *testing.T) {
 	}
 }
 
+func TestReleaseIPAddress_NotFound(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	client := newTestClient(server)
+
+	err := client.ReleaseIPAddress(context.Background(), "test-app", "nonexistent")
+	if !flyio.IsNotFound(err) {
+		t.Fatalf("expected IsNotFound for an IP that is not allocated, got %v", err)
+	}
+}
+
 func TestListIPAddresses(t *testing.T) {
 	server := fakefly.NewServer()
 	defer server.Close()
@@ -256,6 +383,21 @@ func TestListIPAddresses(t *testing.T) {
 	}
 }
 
+func TestListRegions(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	server.Regions = []flyio.Region{{Code: "syd", Name: "Sydney, Australia"}, {Code: "ord", Name: "Chicago, Illinois (US)"}}
+	client := newTestClient(server)
+
+	regions, err := client.ListRegions(context.Background())
+	if err != nil {
+		t.Fatalf("ListRegions failed: %v", err)
+	}
+	if !slices.Equal(regions, server.Regions) {
+		t.Errorf("ListRegions = %v, want %v", regions, server.Regions)
+	}
+}
+
 func TestCreateMachine_MultipleMachines(t *testing.T) {
 	server := fakefly.NewServer()
 	defer server.Close()
@@ -283,6 +425,43 @@ func TestCreateMachine_MultipleMachines(t *testing.T) {
 	}
 }
 
+func TestListMachines(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	client := newTestClient(server)
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.CreateMachine(context.Background(), "test-app", flyio.CreateMachineInput{
+			Name:   "list-test",
+			Region: "syd",
+			Config: flyio.MachineConfig{Image: "test:latest"},
+		}); err != nil {
+			t.Fatalf("CreateMachine[%d] failed: %v", i, err)
+		}
+	}
+	// Machines of other apps are not listed.
+	if _, err := client.CreateMachine(context.Background(), "other-app", flyio.CreateMachineInput{
+		Name:   "other",
+		Region: "syd",
+		Config: flyio.MachineConfig{Image: "test:latest"},
+	}); err != nil {
+		t.Fatalf("CreateMachine failed: %v", err)
+	}
+
+	machines, err := client.ListMachines(context.Background(), "test-app")
+	if err != nil {
+		t.Fatalf("ListMachines failed: %v", err)
+	}
+	if len(machines) != 3 {
+		t.Fatalf("expected 3 machines, got %d", len(machines))
+	}
+	for _, m := range machines {
+		if m.Name != "list-test" {
+			t.Errorf("unexpected machine %q in list", m.Name)
+		}
+	}
+}
+
 func TestCreateMachine_HookError(t *testing.T) {
 	server := fakefly.NewServer()
 	defer server.Close()
@@ -356,6 +535,40 @@ func TestEnsureApp_AlreadyExists(t *testing.T) {
 	}
 }
 
+func TestEnsureApp_Conflict(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	server.OnCreateApp = func(appName, orgSlug string) error {
+		return &fakefly.StatusError{Code: http.StatusConflict, Message: "app already exists"}
+	}
+	client := newTestClient(server)
+
+	if err := client.EnsureApp(context.Background(), "dup-app", "personal"); err != nil {
+		t.Errorf("expected a 409 to mean the app exists, got: %v", err)
+	}
+}
+
+func TestGetApp(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	client := newTestClient(server)
+
+	if _, err := client.GetApp(context.Background(), "my-app"); !errors.Is(err, flyio.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound before the app exists, got %v", err)
+	}
+
+	if err := client.EnsureApp(context.Background(), "my-app", "personal"); err != nil {
+		t.Fatalf("EnsureApp failed: %v", err)
+	}
+	app, err := client.GetApp(context.Background(), "my-app")
+	if err != nil {
+		t.Fatalf("GetApp failed: %v", err)
+	}
+	if app.Name != "my-app" || app.Organization.Slug != "personal" || app.Status == "" {
+		t.Errorf("unexpected app %+v", app)
+	}
+}
+
 func TestDeleteApp(t *testing.T) {
 	server := fakefly.NewServer()
 	defer server.Close()
@@ -380,8 +593,532 @@ func TestDeleteApp(t *testing.T) {
 	}
 }
 
+func TestEnsureApp_PendingDeletion(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	server.AppDeletionDrain = 1
+	client := newTestClient(server)
+
+	if err := client.EnsureApp(context.Background(), "drain-app", "personal"); err != nil {
+		t.Fatalf("EnsureApp failed: %v", err)
+	}
+	if err := client.DeleteApp(context.Background(), "drain-app"); err != nil {
+		t.Fatalf("DeleteApp failed: %v", err)
+	}
+
+	err := client.EnsureApp(context.Background(), "drain-app", "personal")
+	if !errors.Is(err, flyio.ErrAppPendingDeletion) {
+		t.Fatalf("expected ErrAppPendingDeletion while the old app drains, got %v", err)
+	}
+	if err := client.EnsureApp(context.Background(), "drain-app", "personal"); err != nil {
+		t.Fatalf("expected EnsureApp to succeed once deletion completed, got %v", err)
+	}
+	if !server.HasApp("drain-app") {
+		t.Error("expected the app to be recreated")
+	}
+}
+
+type recordingAuditSink struct {
+	records []flyio.AuditRecord
+}
+
+func (s *recordingAuditSink) Record(_ context.Context, record flyio.AuditRecord) {
+	s.records = append(s.records, record)
+}
+
+func TestAudit_CreateAndDeleteMachine(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	sink := &recordingAuditSink{}
+	client := newTestClient(server).WithAuditSink(sink)
+
+	ctx := flyio.ContextWithAuditSubject(context.Background(), "default/web")
+
+	machine, err := client.CreateMachine(ctx, "audit-app", flyio.CreateMachineInput{
+		Name:   "audit-machine",
+		Region: "syd",
+		Config: flyio.MachineConfig{Image: "test:latest"},
+	})
+	if err != nil {
+		t.Fatalf("CreateMachine failed: %v", err)
+	}
+	if _, err := client.GetMachine(ctx, "audit-app", machine.ID); err != nil {
+		t.Fatalf("GetMachine failed: %v", err)
+	}
+	if err := client.DeleteMachine(ctx, "audit-app", machine.ID); err != nil {
+		t.Fatalf("DeleteMachine failed: %v", err)
+	}
+
+	// Reads are not audited.
+	if len(sink.records) != 2 {
+		t.Fatalf("expected 2 audit records, got %d: %+v", len(sink.records), sink.records)
+	}
+
+	for i, want := range []string{"CreateMachine", "DeleteMachine"} {
+		rec := sink.records[i]
+		if rec.Op != want {
+			t.Errorf("record %d: expected op %q, got %q", i, want, rec.Op)
+		}
+		if rec.App != "audit-app" {
+			t.Errorf("record %d: expected app 'audit-app', got %q", i, rec.App)
+		}
+		if rec.Resource != machine.ID {
+			t.Errorf("record %d: expected resource %q, got %q", i, machine.ID, rec.Resource)
+		}
+		if rec.Subject != "default/web" {
+			t.Errorf("record %d: expected subject 'default/web', got %q", i, rec.Subject)
+		}
+		if rec.Result != flyio.AuditResultSuccess || rec.Error != "" {
+			t.Errorf("record %d: expected success, got %q (%q)", i, rec.Result, rec.Error)
+		}
+		if rec.Time.IsZero() {
+			t.Errorf("record %d: expected time to be set", i)
+		}
+	}
+}
+
+func TestAudit_RecordsFailures(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	server.OnCreateMachine = func(appName string, input flyio.CreateMachineInput) error {
+		return errFakeFailure
+	}
+	sink := &recordingAuditSink{}
+	client := newTestClient(server).WithAuditSink(sink)
+
+	_, err := client.CreateMachine(context.Background(), "audit-app", flyio.CreateMachineInput{Name: "fail"})
+	if err == nil {
+		t.Fatal("expected CreateMachine to fail")
+	}
+
+	if len(sink.records) != 1 {
+		t.Fatalf("expected 1 audit record, got %d", len(sink.records))
+	}
+	if sink.records[0].Result != flyio.AuditResultError || sink.records[0].Error == "" {
+		t.Errorf("expected error record, got %+v", sink.records[0])
+	}
+}
+
+type recordingObserver struct {
+	mu       sync.Mutex
+	requests []string
+	queued   []time.Duration
+}
+
+func (o *recordingObserver) ObserveRequest(op string, statusCode int, _ time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = append(o.requests, fmt.Sprintf("%s %d", op, statusCode))
+}
+
+func (o *recordingObserver) ObserveQueued(_ string, wait time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queued = append(o.queued, wait)
+}
+
+func TestObserver_CountsRequestsPerOperation(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	obs := &recordingObserver{}
+	client := newTestClient(server).WithObserver(obs)
+
+	ctx := context.Background()
+	if err := client.EnsureApp(ctx, "obs-app", "personal"); err != nil {
+		t.Fatalf("EnsureApp failed: %v", err)
+	}
+	if _, err := client.GetMachine(ctx, "obs-app", "missing"); err == nil {
+		t.Fatal("expected GetMachine to fail for a missing machine")
+	}
+
+	want := []string{"EnsureApp 201", "GetMachine 404"}
+	if len(obs.requests) != len(want) {
+		t.Fatalf("expected %v, got %v", want, obs.requests)
+	}
+	for i := range want {
+		if obs.requests[i] != want[i] {
+			t.Errorf("request %d: expected %q, got %q", i, want[i], obs.requests[i])
+		}
+	}
+	if len(obs.queued) != 0 {
+		t.Errorf("expected no queueing without a rate limit, got %v", obs.queued)
+	}
+}
+
+func TestObserver_RecordsRateLimitQueueTime(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	obs := &recordingObserver{}
+	client := newTestClient(server).WithObserver(obs).WithRateLimit(20, 1)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := client.ListIPAddresses(ctx, "obs-app"); err != nil {
+			t.Fatalf("ListIPAddresses failed: %v", err)
+		}
+	}
+
+	// The first request uses the burst; the others wait ~50ms each.
+	if len(obs.queued) != 2 {
+		t.Fatalf("expected 2 queued requests, got %v", obs.queued)
+	}
+	for _, wait := range obs.queued {
+		if wait < 10*time.Millisecond {
+			t.Errorf("expected queue wait to reflect the rate limit, got %v", wait)
+		}
+	}
+}
+
+func TestUpdateMachine_Rejected(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	client := newTestClient(server)
+
+	created, err := client.CreateMachine(context.Background(), "test-app", flyio.CreateMachineInput{
+		Name:   "reject-test",
+		Region: "syd",
+		Config: flyio.MachineConfig{Image: "test:latest"},
+	})
+	if err != nil {
+		t.Fatalf("CreateMachine failed: %v", err)
+	}
+
+	server.OnUpdateMachine = func(appName, machineID string, input flyio.CreateMachineInput) error {
+		return &fakefly.StatusError{Code: http.StatusUnprocessableEntity, Message: "cannot update in place"}
+	}
+	_, err = client.UpdateMachine(context.Background(), "test-app", created.ID, flyio.CreateMachineInput{})
+	if !flyio.IsUpdateRejected(err) {
+		t.Fatalf("expected an update rejection, got %v", err)
+	}
+
+	server.OnUpdateMachine = func(appName, machineID string, input flyio.CreateMachineInput) error {
+		return &fakefly.StatusError{Code: http.StatusUnprocessableEntity, Message: "invalid guest: memory_mb must be a multiple of 256"}
+	}
+	_, err = client.UpdateMachine(context.Background(), "test-app", created.ID, flyio.CreateMachineInput{})
+	if err == nil || flyio.IsUpdateRejected(err) {
+		t.Fatalf("expected a validation error not classed as a rejection, got %v", err)
+	}
+
+	server.OnUpdateMachine = func(appName, machineID string, input flyio.CreateMachineInput) error {
+		return errFakeFailure
+	}
+	_, err = client.UpdateMachine(context.Background(), "test-app", created.ID, flyio.CreateMachineInput{})
+	if err == nil || flyio.IsUpdateRejected(err) {
+		t.Fatalf("expected a server error not classed as a rejection, got %v", err)
+	}
+}
+
 var errFakeFailure = &fakeError{msg: "fake failure"}
 
 type fakeError struct{ msg string }
 
 func (e *fakeError) Error() string { return e.msg }
+
+func TestCreateMachine_QuotaExceeded(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	client := newTestClient(server)
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"payment required", &fakefly.StatusError{Code: http.StatusPaymentRequired, Message: "billing required"}, true},
+		{"quota message", &fakefly.StatusError{Code: http.StatusUnprocessableEntity, Message: "machine quota exceeded"}, true},
+		{"limit reached", &fakefly.StatusError{Code: http.StatusForbidden, Message: "Organization machine limit reached"}, true},
+		{"invalid input", &fakefly.StatusError{Code: http.StatusUnprocessableEntity, Message: "invalid guest"}, false},
+		{"server error", errFakeFailure, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.OnCreateMachine = func(appName string, input flyio.CreateMachineInput) error {
+				return tt.err
+			}
+			_, err := client.CreateMachine(context.Background(), "test-app", flyio.CreateMachineInput{
+				Config: flyio.MachineConfig{Image: "test:latest"},
+			})
+			if err == nil {
+				t.Fatal("expected CreateMachine to fail")
+			}
+			if got := flyio.IsQuotaExceeded(err); got != tt.want {
+				t.Errorf("IsQuotaExceeded(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateDedicatedIPv4_QuotaExceeded(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	client := newTestClient(server)
+
+	server.OnAllocateIP = func(appName string) error {
+		return &fakeError{msg: "You have exceeded the number of dedicated IPv4 addresses for this organization"}
+	}
+	if _, err := client.AllocateDedicatedIPv4(context.Background(), "test-app"); !flyio.IsQuotaExceeded(err) {
+		t.Fatalf("expected a quota refusal, got %v", err)
+	}
+}
+
+func TestSetAppSecrets(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	client := newTestClient(server)
+
+	if err := client.EnsureApp(context.Background(), "test-app", "personal"); err != nil {
+		t.Fatalf("EnsureApp failed: %v", err)
+	}
+	if err := client.SetAppSecrets(context.Background(), "test-app", map[string]string{"A": "1", "B": "2"}); err != nil {
+		t.Fatalf("SetAppSecrets failed: %v", err)
+	}
+	if err := client.SetAppSecrets(context.Background(), "test-app", map[string]string{"B": "3"}); err != nil {
+		t.Fatalf("SetAppSecrets failed: %v", err)
+	}
+
+	secrets := server.AppSecrets("test-app")
+	if secrets["A"] != "1" || secrets["B"] != "3" {
+		t.Errorf("expected A=1 and B=3 after overwriting B, got %v", secrets)
+	}
+
+	if err := client.SetAppSecrets(context.Background(), "missing-app", map[string]string{"A": "1"}); err == nil {
+		t.Error("expected an error setting secrets on a missing app")
+	}
+}
+
+func TestRetry_TransientFailures(t *testing.T) {
+	var calls atomic.Int32
+	var bodies []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		if calls.Add(1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"id":"m1","instance_id":"i1"}`)
+	}))
+	defer server.Close()
+
+	client := flyio.NewClient("test-token").WithBaseURL(server.URL).WithRetry(3, time.Millisecond)
+	machine, err := client.CreateMachine(context.Background(), "test-app", flyio.CreateMachineInput{Name: "retried"})
+	if err != nil {
+		t.Fatalf("expected the call to succeed after two 503s, got %v", err)
+	}
+	if machine.ID != "m1" || calls.Load() != 3 {
+		t.Errorf("expected machine m1 after 3 attempts, got %q after %d", machine.ID, calls.Load())
+	}
+	for i, body := range bodies {
+		if !strings.Contains(body, `"name":"retried"`) {
+			t.Errorf("attempt %d sent body %q; expected the request body on every attempt", i+1, body)
+		}
+	}
+}
+
+func TestRetry_NotOnClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "conflict", http.StatusConflict)
+	}))
+	defer server.Close()
+
+	client := flyio.NewClient("test-token").WithBaseURL(server.URL).WithRetry(3, time.Millisecond)
+	if err := client.DeleteMachine(context.Background(), "test-app", "m1"); !flyio.IsConflict(err) {
+		t.Fatalf("expected a 409 to fail with IsConflict, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected a 409 not to be retried, got %d attempts", calls.Load())
+	}
+}
+
+func TestRetry_MutationsNotOnGatewayErrors(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout} {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			http.Error(w, "gateway", status)
+		}))
+
+		client := flyio.NewClient("test-token").WithBaseURL(server.URL).WithRetry(3, time.Millisecond)
+		if _, err := client.CreateMachine(context.Background(), "test-app", flyio.CreateMachineInput{Name: "once"}); err == nil {
+			t.Errorf("%d: expected CreateMachine to fail", status)
+		}
+		if calls.Load() != 1 {
+			t.Errorf("%d: expected CreateMachine not to be retried, it may have created the Machine; got %d attempts", status, calls.Load())
+		}
+
+		calls.Store(0)
+		if _, err := client.GetMachine(context.Background(), "test-app", "m1"); err == nil {
+			t.Errorf("%d: expected GetMachine to fail", status)
+		}
+		if calls.Load() != 3 {
+			t.Errorf("%d: expected GetMachine to be retried, got %d attempts", status, calls.Load())
+		}
+		server.Close()
+	}
+}
+
+func TestRetry_GivesUpAfterMaxAttempts(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := flyio.NewClient("test-token").WithBaseURL(server.URL).WithRetry(3, time.Millisecond)
+	if _, err := client.GetMachine(context.Background(), "test-app", "m1"); !flyio.IsRateLimited(err) {
+		t.Fatalf("expected persistent 429s to fail with IsRateLimited, got %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls.Load())
+	}
+}
+
+func TestRetry_HonorsContextCancellation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := flyio.NewClient("test-token").WithBaseURL(server.URL).WithRetry(10, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.GetMachine(ctx, "test-app", "m1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the backoff to stop at the deadline, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the retry to stop promptly, took %s", elapsed)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	const limit = 3
+	var inFlight, peak atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, `{"id":"m1"}`)
+	}))
+	defer server.Close()
+
+	client := flyio.NewClient("test-token").WithBaseURL(server.URL).WithMaxConcurrentRequests(limit)
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetMachine(context.Background(), "test-app", "m1"); err != nil {
+				t.Errorf("GetMachine failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > limit {
+		t.Errorf("expected at most %d requests in flight, saw %d", limit, got)
+	}
+	if got := peak.Load(); got < 2 {
+		t.Errorf("expected requests to run concurrently up to the cap, peak was %d", got)
+	}
+}
+
+func TestRetry_HonorsRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter func() string
+		minWait    time.Duration
+	}{
+		{name: "seconds", retryAfter: func() string { return "2" }, minWait: 1900 * time.Millisecond},
+		// HTTP dates have second precision, so the wait may be up to a
+		// second shorter.
+		{name: "http-date", retryAfter: func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) }, minWait: 900 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					w.Header().Set("Retry-After", tt.retryAfter())
+					http.Error(w, "rate limited", http.StatusTooManyRequests)
+					return
+				}
+				fmt.Fprint(w, `{"id":"m1","instance_id":"i1"}`)
+			}))
+			defer server.Close()
+
+			// The base delay alone would retry almost immediately.
+			client := flyio.NewClient("test-token").WithBaseURL(server.URL).WithRetry(2, time.Millisecond)
+			start := time.Now()
+			if _, err := client.GetMachine(context.Background(), "test-app", "m1"); err != nil {
+				t.Fatalf("expected the call to succeed after a 429, got %v", err)
+			}
+			if waited := time.Since(start); waited < tt.minWait || waited > 3*time.Second {
+				t.Errorf("expected to wait about as long as Retry-After asked, waited %v", waited)
+			}
+			if calls.Load() != 2 {
+				t.Errorf("expected 2 attempts, got %d", calls.Load())
+			}
+		})
+	}
+}
+
+func TestWaitForMachine_SpansLongTimeouts(t *testing.T) {
+	var timeouts []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		timeouts = append(timeouts, r.URL.Query().Get("timeout"))
+		n := len(timeouts)
+		mu.Unlock()
+		if n == 1 {
+			http.Error(w, "deadline exceeded", http.StatusRequestTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := flyio.NewClient("test-token").WithBaseURL(server.URL)
+	if err := client.WaitForMachine(context.Background(), "test-app", "m1", "i1", "started", 2*time.Minute); err != nil {
+		t.Fatalf("expected the wait to continue past a 408, got %v", err)
+	}
+	if len(timeouts) != 2 || timeouts[0] != "60" {
+		t.Errorf("expected two waits of at most 60s, got timeouts %v", timeouts)
+	}
+}
+
+func TestParseRegistryAuth(t *testing.T) {
+	auth, err := flyio.ParseRegistryAuth("bot:p@ss:word@registry.example.com:5000")
+	if err != nil {
+		t.Fatalf("ParseRegistryAuth failed: %v", err)
+	}
+	want := flyio.RegistryAuth{Server: "registry.example.com:5000", Username: "bot", Password: "p@ss:word"}
+	if *auth != want {
+		t.Errorf("expected %+v, got %+v", want, *auth)
+	}
+	if got := fmt.Sprint(auth); strings.Contains(got, "p@ss") {
+		t.Errorf("expected the password to be left out of %q", got)
+	}
+
+	for _, value := range []string{"", "bot:secret", "bot@ghcr.io", ":secret@ghcr.io", "bot:@ghcr.io", "bot:secret@", "bot:secret@ghcr.io/org"} {
+		if _, err := flyio.ParseRegistryAuth(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
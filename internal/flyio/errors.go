@@ -0,0 +1,149 @@
+package flyio
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNotFound is matched by the errors of requests for a resource that does
+// not exist.
+var ErrNotFound = errors.New("not found")
+
+// APIError is returned when the Fly.io API answers a request with an
+// unexpected status. A 404 also matches ErrNotFound.
+type APIError struct {
+	// Op describes the request, e.g. "getting machine".
+	Op         string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: status %d, body: %s", e.Op, e.StatusCode, e.Body)
+}
+
+// Is makes a 404 match ErrNotFound.
+func (e *APIError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// IsNotFound reports whether err means the requested resource does not
+// exist.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// isNotFoundMessage reports whether a GraphQL error message means the
+// resource does not exist. GraphQL errors carry no status code.
+func isNotFoundMessage(message string) bool {
+	message = strings.ToLower(message)
+	return strings.Contains(message, "could not find") || strings.Contains(message, "not found")
+}
+
+// IsConflict reports whether err is a 409 from the Fly.io API, e.g. for a
+// resource that already exists.
+func IsConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+// IsRateLimited reports whether err is a 429 from the Fly.io API that
+// outlasted the client's retries.
+func IsRateLimited(err error) bool {
+	return hasStatus(err, http.StatusTooManyRequests)
+}
+
+// hasStatus reports whether err is an APIError with statusCode.
+func hasStatus(err error, statusCode int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == statusCode
+}
+
+// ErrAppPendingDeletion is returned by EnsureApp when the name still belongs
+// to a deleted App that Fly.io has not finished removing. The name becomes
+// available again once the deletion completes.
+var ErrAppPendingDeletion = errors.New("app name is pending deletion")
+
+// isPendingDeletion reports whether a 422 from app creation means the name is
+// held by an App being deleted.
+func isPendingDeletion(message string) bool {
+	return strings.Contains(strings.ToLower(message), "pending deletion")
+}
+
+// UpdateRejectedError is returned by UpdateMachine when the Machines API
+// refuses to apply a config change in place (e.g. a guest resize across CPU
+// kinds). The Machine must be replaced to apply the change.
+type UpdateRejectedError struct {
+	MachineID  string
+	StatusCode int
+	Body       string
+}
+
+func (e *UpdateRejectedError) Error() string {
+	return fmt.Sprintf("updating machine: status %d, body: %s", e.StatusCode, e.Body)
+}
+
+// IsUpdateRejected reports whether err is an in-place update rejection.
+func IsUpdateRejected(err error) bool {
+	var rejected *UpdateRejectedError
+	return errors.As(err, &rejected)
+}
+
+// updateRejectionMarkers are fragments of the errors the Machines API
+// returns for a config the Machine cannot take in place, such as a guest
+// size its host has no capacity left for. A new Machine can be placed
+// elsewhere; other 400s and 422s are validation errors it would get too.
+var updateRejectionMarkers = []string{"in place", "in-place", "insufficient"}
+
+// isUpdateRejection reports whether an UpdateMachine response means the new
+// config can only be applied by replacing the Machine.
+func isUpdateRejection(statusCode int, body string) bool {
+	if statusCode != http.StatusBadRequest && statusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+	body = strings.ToLower(body)
+	for _, marker := range updateRejectionMarkers {
+		if strings.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaExceededError is returned when Fly.io refuses to create a resource
+// because an organization limit (apps, machines, dedicated IPs) or billing
+// requirement was hit. Retrying will not help until the limit is raised.
+type QuotaExceededError struct {
+	Op         string
+	StatusCode int
+	Message    string
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s: quota exceeded: %s", e.Op, e.Message)
+	}
+	return fmt.Sprintf("%s: quota exceeded: status %d, body: %s", e.Op, e.StatusCode, e.Message)
+}
+
+// IsQuotaExceeded reports whether err is a Fly.io quota or billing refusal.
+func IsQuotaExceeded(err error) bool {
+	var quota *QuotaExceededError
+	return errors.As(err, &quota)
+}
+
+// isQuotaRefusal reports whether a failed response means an organization
+// limit was hit. statusCode is 0 for GraphQL errors, which carry only a
+// message.
+func isQuotaRefusal(statusCode int, message string) bool {
+	if statusCode == http.StatusPaymentRequired {
+		return true
+	}
+	if statusCode != 0 && statusCode != http.StatusForbidden && statusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+	message = strings.ToLower(message)
+	return strings.Contains(message, "quota") || strings.Contains(message, "limit reached") ||
+		strings.Contains(message, "limit exceeded") || strings.Contains(message, "exceeded the")
+}
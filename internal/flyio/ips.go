@@ -0,0 +1,164 @@
+package flyio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// IPAllocation is the outcome of one allocation of AllocateIPs.
+type IPAllocation struct {
+	// Type is the requested type, "v4" or "v6".
+	Type string
+	// IP is the allocated address, nil if Err is set.
+	IP  *IPAddress
+	Err error
+}
+
+// AllocateIPs allocates one IP address of each of types ("v4" for a
+// dedicated IPv4, "v6") for the app in a single GraphQL request, as aliased
+// mutations. Each allocation succeeds or fails on its own: the results hold
+// the IP or error of each type, in order. The returned error is set only if
+// the request as a whole failed, leaving the outcome of every allocation
+// unknown.
+func (c *Client) AllocateIPs(ctx context.Context, appName string, types []string) (results []IPAllocation, err error) {
+	defer func() {
+		for i, ipType := range types {
+			var id string
+			resultErr := err
+			if err == nil {
+				if results[i].IP != nil {
+					id = results[i].IP.ID
+				}
+				resultErr = results[i].Err
+			}
+			c.audit(ctx, allocateIPOp(ipType), appName, id, resultErr)
+		}
+	}()
+	results = make([]IPAllocation, len(types))
+	if len(types) == 0 {
+		return results, nil
+	}
+
+	params := make([]string, len(types))
+	var fields strings.Builder
+	variables := make(map[string]interface{}, len(types))
+	for i, ipType := range types {
+		results[i].Type = ipType
+		params[i] = fmt.Sprintf("$input%d: AllocateIPAddressInput!", i)
+		fmt.Fprintf(&fields, `
+			%s: allocateIpAddress(input: $input%d) {
+				ipAddress {
+					id
+					address
+					type
+					region
+					createdAt
+				}
+			}`, ipAlias(i), i)
+		variables[fmt.Sprintf("input%d", i)] = map[string]interface{}{
+			"appId": appName,
+			"type":  ipType,
+		}
+	}
+
+	gqlReq := graphQLRequest{
+		Query:     fmt.Sprintf("mutation(%s) {%s\n}", strings.Join(params, ", "), fields.String()),
+		Variables: variables,
+	}
+
+	body, err := json.Marshal(gqlReq)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling graphql request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.graphQLURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	c.setHeaders(req)
+
+	resp, err := c.do(opAllocateIPs, req)
+	if err != nil {
+		return nil, fmt.Errorf("allocating IPs: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var gqlResp graphQLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&gqlResp); err != nil {
+		return nil, fmt.Errorf("decoding graphql response: %w", err)
+	}
+
+	var data map[string]*struct {
+		IPAddress IPAddress `json:"ipAddress"`
+	}
+	if len(gqlResp.Data) > 0 {
+		if err := json.Unmarshal(gqlResp.Data, &data); err != nil {
+			return nil, fmt.Errorf("decoding allocate IPs data: %w", err)
+		}
+	}
+
+	// Errors name the alias they belong to; one without a path fails every
+	// allocation left without a result.
+	failures := make(map[string]string)
+	var unattributed string
+	for _, gqlErr := range gqlResp.Errors {
+		alias, _ := firstPathElement(gqlErr.Path).(string)
+		if alias == "" {
+			if unattributed == "" {
+				unattributed = gqlErr.Message
+			}
+			continue
+		}
+		if _, ok := failures[alias]; !ok {
+			failures[alias] = gqlErr.Message
+		}
+	}
+
+	for i := range results {
+		alias := ipAlias(i)
+		message, failed := failures[alias]
+		if !failed && data[alias] != nil {
+			ip := data[alias].IPAddress
+			results[i].IP = &ip
+			continue
+		}
+		if !failed {
+			message = unattributed
+		}
+		if message == "" {
+			message = "no address returned"
+		}
+		if isQuotaRefusal(0, message) {
+			results[i].Err = &QuotaExceededError{Op: "allocating IP", Message: message}
+		} else {
+			results[i].Err = fmt.Errorf("graphql error: %s", message)
+		}
+	}
+	return results, nil
+}
+
+// ipAlias returns the alias of the i-th allocation of AllocateIPs.
+func ipAlias(i int) string {
+	return fmt.Sprintf("ip%d", i)
+}
+
+// allocateIPOp returns the operation an allocation of ipType is audited as.
+func allocateIPOp(ipType string) string {
+	if ipType == "v6" {
+		return opAllocateIPv6
+	}
+	return opAllocateDedicatedIPv4
+}
+
+// firstPathElement returns the first element of a GraphQL error path, nil if
+// it is empty.
+func firstPathElement(path []interface{}) interface{} {
+	if len(path) == 0 {
+		return nil
+	}
+	return path[0]
+}
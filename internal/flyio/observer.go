@@ -0,0 +1,67 @@
+package flyio
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Operation names reported to Observers. They form a small fixed set so they
+// are safe to use as metric labels.
+const (
+	opCreateMachine         = "CreateMachine"
+	opGetMachine            = "GetMachine"
+	opListMachines          = "ListMachines"
+	opDeleteMachine         = "DeleteMachine"
+	opUpdateMachine         = "UpdateMachine"
+	opStopMachine           = "StopMachine"
+	opStartMachine          = "StartMachine"
+	opWaitForMachine        = "WaitForMachine"
+	opAllocateDedicatedIPv4 = "AllocateDedicatedIPv4"
+	opAllocateIPv6          = "AllocateIPv6"
+	opAllocateIPs           = "AllocateIPs"
+	opReleaseIPAddress      = "ReleaseIPAddress"
+	opListIPAddresses       = "ListIPAddresses"
+	opListRegions           = "ListRegions"
+	opGetApp                = "GetApp"
+	opEnsureApp             = "EnsureApp"
+	opDeleteApp             = "DeleteApp"
+	opSetAppSecrets         = "SetAppSecrets"
+)
+
+// Observer is notified about every outgoing Fly.io API request. Implementations
+// must be safe for concurrent use and should not block.
+type Observer interface {
+	// ObserveRequest is called once per HTTP request. statusCode is 0 when
+	// the request failed before a response was received.
+	ObserveRequest(op string, statusCode int, duration time.Duration)
+
+	// ObserveQueued is called when a request was held back by client-side
+	// rate limiting, the concurrency cap or rate-limit (429) handling before
+	// being sent.
+	ObserveQueued(op string, wait time.Duration)
+}
+
+// WithObserver registers an Observer for outgoing API requests.
+func (c *Client) WithObserver(o Observer) *Client {
+	c.observers = append(c.observers, o)
+	return c
+}
+
+// WithRateLimit limits outgoing requests to qps with the given burst. Time
+// spent waiting is reported to Observers via ObserveQueued.
+func (c *Client) WithRateLimit(qps float64, burst int) *Client {
+	c.limiter = rate.NewLimiter(rate.Limit(qps), burst)
+	return c
+}
+
+// WithMaxConcurrentRequests caps the requests in flight at once, shared by
+// every caller of the Client, so periodic drift checks of many tunnels
+// cannot crowd out Machine mutations. WaitForMachine long-polls are not
+// counted. Time spent waiting for a slot is reported via ObserveQueued.
+func (c *Client) WithMaxConcurrentRequests(n int) *Client {
+	if n > 0 {
+		c.inFlight = make(chan struct{}, n)
+	}
+	return c
+}
@@ -0,0 +1,75 @@
+package flyio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Region is a Fly.io region Machines can run in.
+type Region struct {
+	// Code identifies the region, e.g. "syd".
+	Code string `json:"code"`
+	// Name describes it, e.g. "Sydney, Australia".
+	Name string `json:"name"`
+	// Latitude and Longitude locate it, in degrees.
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// ListRegions lists the regions of the Fly.io platform.
+func (c *Client) ListRegions(ctx context.Context) ([]Region, error) {
+	gqlReq := graphQLRequest{
+		Query: `
+			query {
+				platform {
+					regions {
+						code
+						name
+						latitude
+						longitude
+					}
+				}
+			}
+		`,
+	}
+
+	body, err := json.Marshal(gqlReq)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling graphql request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.graphQLURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	c.setHeaders(req)
+
+	resp, err := c.do(opListRegions, req)
+	if err != nil {
+		return nil, fmt.Errorf("listing regions: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var gqlResp graphQLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&gqlResp); err != nil {
+		return nil, fmt.Errorf("decoding graphql response: %w", err)
+	}
+
+	if len(gqlResp.Errors) > 0 {
+		return nil, fmt.Errorf("graphql error: %s", gqlResp.Errors[0].Message)
+	}
+
+	var data struct {
+		Platform struct {
+			Regions []Region `json:"regions"`
+		} `json:"platform"`
+	}
+	if err := json.Unmarshal(gqlResp.Data, &data); err != nil {
+		return nil, fmt.Errorf("decoding region list data: %w", err)
+	}
+
+	return data.Platform.Regions, nil
+}
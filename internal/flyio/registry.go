@@ -0,0 +1,27 @@
+package flyio
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseRegistryAuth parses registry credentials written as
+// <username>:<password>@<server>, e.g. "bot:s3cret@ghcr.io".
+func ParseRegistryAuth(value string) (*RegistryAuth, error) {
+	i := strings.LastIndex(value, "@")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid registry auth: must be <username>:<password>@<server>")
+	}
+	username, password, ok := strings.Cut(value[:i], ":")
+	server := value[i+1:]
+	if !ok || username == "" || password == "" || server == "" || strings.Contains(server, "/") {
+		return nil, fmt.Errorf("invalid registry auth: must be <username>:<password>@<server>")
+	}
+	return &RegistryAuth{Server: server, Username: username, Password: password}, nil
+}
+
+// String returns the username and server of a, leaving out the password so
+// that a can be logged.
+func (a *RegistryAuth) String() string {
+	return a.Username + "@" + a.Server
+}
@@ -0,0 +1,130 @@
+package flyio
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter caps how long a Retry-After header can hold up a retry, so a
+// misbehaving response cannot stall a reconcile indefinitely.
+const maxRetryAfter = 30 * time.Second
+
+// retryPolicy controls how failed requests are retried.
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+}
+
+// idempotentOps are read-only operations, safe to retry even when the request
+// may have reached the API before failing.
+var idempotentOps = map[string]bool{
+	opGetMachine:      true,
+	opListMachines:    true,
+	opWaitForMachine:  true,
+	opListIPAddresses: true,
+	opListRegions:     true,
+}
+
+// WithRetry retries failed requests up to maxAttempts times in total, with
+// jittered exponential backoff starting at baseDelay. Read-only operations
+// are retried on network errors, 429 and 5xx. Mutations are only retried on
+// 429 and 503, which turn the request away before it is acted on: a 502 or
+// 504 from Fly.io's edge may arrive after the API created the Machine or
+// allocated the IP, and retrying would create a second one. Other 4xx
+// responses (e.g. 409) are never retried. maxAttempts of 1 or less disables
+// retries.
+func (c *Client) WithRetry(maxAttempts int, baseDelay time.Duration) *Client {
+	c.retry = retryPolicy{maxAttempts: maxAttempts, baseDelay: baseDelay}
+	return c
+}
+
+// shouldRetry reports whether the outcome of one attempt at op is transient.
+func shouldRetry(op string, resp *http.Response, err error) bool {
+	if err != nil {
+		return idempotentOps[op]
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+		return true
+	case resp.StatusCode >= 500:
+		return idempotentOps[op]
+	default:
+		return false
+	}
+}
+
+// backoff returns the delay before retry number attempt (starting at 1):
+// baseDelay doubled per attempt, randomized to between half and all of it so
+// concurrent callers spread out.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.baseDelay << (attempt - 1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryAfter returns the delay requested by the Retry-After header of a 429
+// response, in either its seconds or HTTP-date form, capped at maxRetryAfter.
+// It reports false when the response carries no usable header.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		d = at.Sub(now)
+	} else {
+		return 0, false
+	}
+	return min(max(d, 0), maxRetryAfter), true
+}
+
+// do sends req on behalf of op, retrying transient failures according to the
+// retry policy. A Retry-After header on a 429 takes precedence over the
+// computed backoff. The request body must be rewindable (GetBody set), which
+// http.NewRequest arranges for the bytes.Reader bodies used here.
+func (c *Client) do(op string, req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(op, req)
+		if attempt >= c.retry.maxAttempts || !shouldRetry(op, resp, err) {
+			return resp, err
+		}
+		delay := c.retry.backoff(attempt)
+		if d, ok := retryAfter(resp, time.Now()); ok {
+			delay = d
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			if err == nil {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+			return nil, fmt.Errorf("retrying after %w: %w", err, req.Context().Err())
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("rewinding request body: %w", err)
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
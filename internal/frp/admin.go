@@ -0,0 +1,78 @@
+package frp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// ProxyStatus is a single proxy entry reported by the frpc admin API.
+type ProxyStatus struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	Err        string `json:"err"`
+	LocalAddr  string `json:"local_addr"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// FetchProxyStatus queries the frpc admin API at adminAddr (host:port) as
+// AdminUser with password and returns the status of every proxy, regardless
+// of type.
+func FetchProxyStatus(ctx context.Context, httpClient *http.Client, adminAddr, password string) ([]ProxyStatus, error) {
+	url := fmt.Sprintf("http://%s/api/status", adminAddr)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.SetBasicAuth(AdminUser, password)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("querying frpc admin API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("querying frpc admin API: status %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	// The response is keyed by proxy type: {"tcp": [...], "udp": [...]}.
+	var byType map[string][]ProxyStatus
+	if err := json.NewDecoder(resp.Body).Decode(&byType); err != nil {
+		return nil, fmt.Errorf("decoding frpc status: %w", err)
+	}
+
+	var statuses []ProxyStatus
+	for _, list := range byType {
+		statuses = append(statuses, list...)
+	}
+	return statuses, nil
+}
+
+// AssignedRemotePorts extracts the remote port frps assigned to each running
+// proxy, keyed by proxy name. Proxies that haven't registered yet are omitted.
+func AssignedRemotePorts(statuses []ProxyStatus) map[string]int {
+	ports := make(map[string]int)
+	for _, st := range statuses {
+		if st.Status != "running" || st.RemoteAddr == "" {
+			continue
+		}
+		_, portStr, err := net.SplitHostPort(st.RemoteAddr)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port == 0 {
+			continue
+		}
+		ports[st.Name] = port
+	}
+	return ports
+}
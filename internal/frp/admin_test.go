@@ -0,0 +1,55 @@
+package frp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchProxyStatus_AssignedRemotePorts(t *testing.T) {
+	// Stub of frpc's admin API as served by /api/status.
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/status" {
+			http.NotFound(w, r)
+			return
+		}
+		if user, password, ok := r.BasicAuth(); !ok || user != AdminUser || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{
+			"tcp": [
+				{"name": "game-game", "type": "tcp", "status": "running", "remote_addr": "137.66.0.2:31234"},
+				{"name": "game-rcon", "type": "tcp", "status": "start error", "err": "port unavailable", "remote_addr": ""}
+			],
+			"udp": [
+				{"name": "game-voice", "type": "udp", "status": "running", "remote_addr": "137.66.0.2:31235"}
+			]
+		}`))
+	}))
+	defer admin.Close()
+
+	statuses, err := FetchProxyStatus(context.Background(), admin.Client(), strings.TrimPrefix(admin.URL, "http://"), "s3cret")
+	if err != nil {
+		t.Fatalf("FetchProxyStatus failed: %v", err)
+	}
+	if len(statuses) != 3 {
+		t.Fatalf("expected 3 proxy statuses, got %d", len(statuses))
+	}
+
+	ports := AssignedRemotePorts(statuses)
+	if len(ports) != 2 {
+		t.Errorf("expected 2 assigned ports, got %v", ports)
+	}
+	if ports["game-game"] != 31234 {
+		t.Errorf("expected game-game on 31234, got %d", ports["game-game"])
+	}
+	if ports["game-voice"] != 31235 {
+		t.Errorf("expected game-voice on 31235, got %d", ports["game-voice"])
+	}
+	if _, ok := ports["game-rcon"]; ok {
+		t.Error("expected proxy that failed to start to be omitted")
+	}
+}
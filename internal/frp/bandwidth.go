@@ -0,0 +1,75 @@
+package frp
+
+import (
+	"fmt"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationBandwidthLimit caps the throughput of every proxy of the
+	// Service, in frp's notation (e.g. "512KB", "10MB"), per direction.
+	AnnotationBandwidthLimit = "fly-tunnel-operator.dev/bandwidth-limit"
+
+	// AnnotationBandwidthLimitMode selects where the limit is enforced:
+	// "client" (frpc, the default) or "server" (frps).
+	AnnotationBandwidthLimitMode = "fly-tunnel-operator.dev/bandwidth-limit-mode"
+
+	BandwidthLimitModeClient = "client"
+	BandwidthLimitModeServer = "server"
+)
+
+var bandwidthLimitPattern = regexp.MustCompile(`^[1-9][0-9]*(KB|MB)$`)
+
+// BandwidthLimit is the per-proxy bandwidth limit requested by a Service.
+type BandwidthLimit struct {
+	// Limit in frp's notation; empty means unlimited.
+	Limit string
+	// Mode is BandwidthLimitModeClient or BandwidthLimitModeServer.
+	Mode string
+}
+
+// BandwidthLimitFor returns the bandwidth limit requested by the Service's
+// annotations. Invalid annotations result in no limit; see
+// ValidateBandwidthLimit.
+func BandwidthLimitFor(svc *corev1.Service) BandwidthLimit {
+	limit, err := parseBandwidthLimit(svc)
+	if err != nil {
+		return BandwidthLimit{}
+	}
+	return limit
+}
+
+// ValidateBandwidthLimit returns an error if the bandwidth annotations are
+// malformed.
+func ValidateBandwidthLimit(svc *corev1.Service) error {
+	_, err := parseBandwidthLimit(svc)
+	return err
+}
+
+func parseBandwidthLimit(svc *corev1.Service) (BandwidthLimit, error) {
+	limit := svc.Annotations[AnnotationBandwidthLimit]
+	mode := svc.Annotations[AnnotationBandwidthLimitMode]
+
+	switch mode {
+	case "":
+		mode = BandwidthLimitModeClient
+	case BandwidthLimitModeClient, BandwidthLimitModeServer:
+	default:
+		return BandwidthLimit{}, fmt.Errorf("invalid %s %q: must be %q or %q",
+			AnnotationBandwidthLimitMode, mode, BandwidthLimitModeClient, BandwidthLimitModeServer)
+	}
+
+	if limit == "" {
+		if svc.Annotations[AnnotationBandwidthLimitMode] != "" {
+			return BandwidthLimit{}, fmt.Errorf("%s requires %s", AnnotationBandwidthLimitMode, AnnotationBandwidthLimit)
+		}
+		return BandwidthLimit{}, nil
+	}
+	if !bandwidthLimitPattern.MatchString(limit) {
+		return BandwidthLimit{}, fmt.Errorf("invalid %s %q: must be a positive integer followed by KB or MB", AnnotationBandwidthLimit, limit)
+	}
+
+	return BandwidthLimit{Limit: limit, Mode: mode}, nil
+}
@@ -0,0 +1,80 @@
+package frp
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGenerateClientConfigBandwidthLimit(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        *ProxyTransportConfig
+	}{
+		{
+			name:        "no limit",
+			annotations: nil,
+		},
+		{
+			name:        "client mode by default",
+			annotations: map[string]string{AnnotationBandwidthLimit: "1MB"},
+			want:        &ProxyTransportConfig{BandwidthLimit: "1MB", BandwidthLimitMode: "client"},
+		},
+		{
+			name: "server mode",
+			annotations: map[string]string{
+				AnnotationBandwidthLimit:     "512KB",
+				AnnotationBandwidthLimitMode: "server",
+			},
+			want: &ProxyTransportConfig{BandwidthLimit: "512KB", BandwidthLimitMode: "server"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := mustParseClientConfig(t, GenerateClientConfig(testService(tt.annotations, ports...), "10.0.0.1", 7000))
+
+			// Every proxy carries the limit.
+			for _, proxy := range config.Proxies {
+				if !reflect.DeepEqual(proxy.Transport, tt.want) {
+					t.Errorf("proxy %s: expected transport %+v, got %+v", proxy.Name, tt.want, proxy.Transport)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateBandwidthLimit(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErr     bool
+	}{
+		{name: "unset", annotations: nil},
+		{name: "megabytes", annotations: map[string]string{AnnotationBandwidthLimit: "10MB"}},
+		{name: "server mode", annotations: map[string]string{AnnotationBandwidthLimit: "10MB", AnnotationBandwidthLimitMode: "server"}},
+		{name: "bad unit", annotations: map[string]string{AnnotationBandwidthLimit: "10Mbps"}, wantErr: true},
+		{name: "zero", annotations: map[string]string{AnnotationBandwidthLimit: "0MB"}, wantErr: true},
+		{name: "bad mode", annotations: map[string]string{AnnotationBandwidthLimit: "10MB", AnnotationBandwidthLimitMode: "both"}, wantErr: true},
+		{name: "mode without limit", annotations: map[string]string{AnnotationBandwidthLimitMode: "server"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateBandwidthLimit(testService(tt.annotations, ports...))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateBandwidthLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
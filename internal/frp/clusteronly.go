@@ -0,0 +1,38 @@
+package frp
+
+import (
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AnnotationClusterOnlyPorts lists Service ports (comma-separated names or
+// numbers) that stay on the Service but are not tunneled, e.g. metrics or
+// health endpoints only needed inside the cluster.
+const AnnotationClusterOnlyPorts = "fly-tunnel-operator.dev/cluster-only-ports"
+
+// ClusterOnly reports whether port is excluded from the tunnel by
+// AnnotationClusterOnlyPorts.
+func ClusterOnly(svc *corev1.Service, port corev1.ServicePort) bool {
+	return matchesPortList(svc.Annotations[AnnotationClusterOnlyPorts], port)
+}
+
+// matchesPortList reports whether port's name or number appears in the
+// comma-separated list.
+func matchesPortList(list string, port corev1.ServicePort) bool {
+	if list == "" {
+		return false
+	}
+	number := strconv.Itoa(int(port.Port))
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == number || (port.Name != "" && entry == port.Name) {
+			return true
+		}
+	}
+	return false
+}
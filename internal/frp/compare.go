@@ -0,0 +1,43 @@
+package frp
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ConfigEqual reports whether the frpc or frps TOML configs a and b
+// configure frp the same way: it ignores whitespace, comments, the order of
+// keys and tables, and the order of [[proxies]], which frp looks up by name.
+// Configs that fail to parse are only equal if they are identical.
+func ConfigEqual(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ca, err := canonicalConfig(a)
+	if err != nil {
+		return false
+	}
+	cb, err := canonicalConfig(b)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(ca, cb)
+}
+
+// canonicalConfig decodes a TOML config into generic tables with its
+// proxies sorted by name.
+func canonicalConfig(data string) (map[string]any, error) {
+	var c map[string]any
+	if _, err := toml.Decode(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing frp config: %w", err)
+	}
+	if proxies, ok := c["proxies"].([]map[string]any); ok {
+		sort.SliceStable(proxies, func(i, j int) bool {
+			return fmt.Sprint(proxies[i]["name"]) < fmt.Sprint(proxies[j]["name"])
+		})
+	}
+	return c, nil
+}
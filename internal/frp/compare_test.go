@@ -0,0 +1,89 @@
+package frp
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConfigEqualReorderedProxies(t *testing.T) {
+	config := GenerateClientConfig(testService(nil,
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+	), "10.0.0.1", 7000)
+
+	parsed, err := ParseClientConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed.Proxies[0], parsed.Proxies[1] = parsed.Proxies[1], parsed.Proxies[0]
+	reordered := parsed.TOML()
+	if reordered == config {
+		t.Fatal("expected reordering the proxies to change the rendered config")
+	}
+
+	if !ConfigEqual(config, reordered) {
+		t.Errorf("expected configs differing only in proxy order to be equal:\n%s\n---\n%s", config, reordered)
+	}
+}
+
+func TestConfigEqualWhitespace(t *testing.T) {
+	a := `serverAddr = "10.0.0.1"
+serverPort = 7000
+
+[[proxies]]
+name = "web-http"
+type = "tcp"
+localIP = "web.default.svc.cluster.local"
+localPort = 80
+remotePort = 80
+`
+	b := `# rendered by an older version
+serverPort=7000
+serverAddr   =   "10.0.0.1"
+[[proxies]]
+  remotePort = 80
+  name = "web-http"
+  type = "tcp"
+  localPort = 80
+  localIP = "web.default.svc.cluster.local"
+`
+	if !ConfigEqual(a, b) {
+		t.Error("expected configs differing only in whitespace, comments and key order to be equal")
+	}
+}
+
+func TestConfigEqualPortChange(t *testing.T) {
+	before := GenerateClientConfig(testService(nil,
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	), "10.0.0.1", 7000)
+	after := GenerateClientConfig(testService(nil,
+		corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+	), "10.0.0.1", 7000)
+	added := GenerateClientConfig(testService(nil,
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+	), "10.0.0.1", 7000)
+
+	if ConfigEqual(before, after) {
+		t.Error("expected a changed port to make the configs differ")
+	}
+	if ConfigEqual(before, added) {
+		t.Error("expected an added proxy to make the configs differ")
+	}
+}
+
+func TestConfigEqualUnparsable(t *testing.T) {
+	config := GenerateClientConfig(testService(nil,
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	), "10.0.0.1", 7000)
+	broken := strings.Replace(config, "serverPort = ", "serverPort = = ", 1)
+
+	if ConfigEqual(config, broken) {
+		t.Error("expected an unparsable config to differ from a valid one")
+	}
+	if !ConfigEqual(broken, broken) {
+		t.Error("expected identical configs to be equal even if unparsable")
+	}
+}
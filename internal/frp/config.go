@@ -2,8 +2,7 @@
 package frp
 
 import (
-	"fmt"
-	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 )
@@ -11,44 +10,273 @@ import (
 const (
 	// DefaultServerPort is the default frps control port.
 	DefaultServerPort = 7000
+
+	// DefaultAdminPort is the frpc admin API (webServer) port. It is only
+	// enabled when the operator needs to read proxy state back from frpc.
+	DefaultAdminPort = 7400
+
+	// AdminUser is the user the frpc admin API requires, with
+	// ClientOptions.AdminPassword.
+	AdminUser = "admin"
+
+	// AnnotationRandomRemotePorts asks frps to pick the public port of every
+	// proxy (remotePort = 0) instead of reusing the Service port.
+	AnnotationRandomRemotePorts = "fly-tunnel-operator.dev/random-remote-ports"
 )
 
+// RandomRemotePorts reports whether the Service asked for frps-assigned
+// remote ports.
+func RandomRemotePorts(svc *corev1.Service) bool {
+	return svc.Annotations[AnnotationRandomRemotePorts] == "true"
+}
+
+// ClientOptions controls how GenerateClientConfigWithOptions renders the
+// frpc configuration of a Service.
+type ClientOptions struct {
+	// ServerAddr is the fly.io Machine's dedicated IPv4 address.
+	ServerAddr string
+	// ServerPort is the frps control port.
+	ServerPort int
+	// ClusterDomain is the cluster DNS domain the Service's DNS name is
+	// under; empty means DefaultClusterDomain. See LocalAddress.
+	ClusterDomain string
+	// LocalIPOverride, when set, replaces the Service's cluster DNS name as
+	// the address every proxy forwards to.
+	LocalIPOverride string
+	// LocalPortOverrides maps proxy names to the local port they forward to
+	// instead of the Service port.
+	LocalPortOverrides map[string]int
+	// AuthToken enables token authentication. Empty disables it.
+	AuthToken string
+	// User is the frpc user. frps prefixes it to proxy names. Empty means
+	// ClientUser of the Service.
+	User string
+	// LoadBalancerGroupKey, when set, puts every TCP proxy in a load
+	// balancing group named after it, so that several frpc replicas can
+	// serve the same remote port. Each replica then needs a distinct User.
+	// frp cannot balance UDP proxies; the first replica to register one
+	// serves it.
+	LoadBalancerGroupKey string
+	// Heartbeat is how frpc detects a dead connection to frps.
+	Heartbeat Heartbeat
+	// LogLevel is the level frpc logs to stdout at; empty means
+	// DefaultLogLevel.
+	LogLevel string
+	// AssignedRemotePorts pins the remote port of proxies frps picked the
+	// port of (see AnnotationRandomRemotePorts), keyed by ProxyPort.Key, so
+	// frpc asks for the same port once frps or frpc restarts.
+	AssignedRemotePorts map[string]int
+	// AdminPassword guards the frpc admin API, which hands out the auth
+	// token and can reconfigure frpc. Without one, the admin API only
+	// listens on localhost.
+	AdminPassword string
+}
+
 // GenerateClientConfig generates a TOML frpc configuration from a Service spec.
 // serverAddr is the fly.io Machine's dedicated IPv4 address.
 func GenerateClientConfig(svc *corev1.Service, serverAddr string, serverPort int) string {
-	var b strings.Builder
+	return GenerateClientConfigWithOptions(svc, ClientOptions{ServerAddr: serverAddr, ServerPort: serverPort})
+}
 
-	b.WriteString(fmt.Sprintf("serverAddr = \"%s\"\n", serverAddr))
-	b.WriteString(fmt.Sprintf("serverPort = %d\n", serverPort))
-	b.WriteString("\n")
+// GenerateClientConfigWithOptions generates a TOML frpc configuration from a
+// Service spec.
+func GenerateClientConfigWithOptions(svc *corev1.Service, opts ClientOptions) string {
+	return marshalTOML(ClientConfigFor(svc, opts))
+}
 
-	// Build the ClusterIP DNS name for this service.
-	localIP := fmt.Sprintf("%s.%s.svc.cluster.local", svc.Name, svc.Namespace)
+// ClientConfigFor returns the frpc configuration of
+// GenerateClientConfigWithOptions.
+func ClientConfigFor(svc *corev1.Service, opts ClientOptions) *ClientConfig {
+	c := &ClientConfig{ServerAddr: opts.ServerAddr, ServerPort: opts.ServerPort, User: opts.User, Log: consoleLog(opts.LogLevel)}
+	if c.User == "" {
+		c.User = ClientUser(svc)
+	}
+	if opts.AuthToken != "" {
+		c.Auth = &AuthSettings{Method: "token", Token: opts.AuthToken}
+	}
+	if protocol := TransportProtocol(svc); protocol != "tcp" {
+		c.Transport = &ClientTransport{Protocol: protocol}
+	}
+	if n := PoolCount(svc); n > 0 {
+		if c.Transport == nil {
+			c.Transport = &ClientTransport{}
+		}
+		c.Transport.PoolCount = n
+	}
+	c.keepReconnecting(opts.Heartbeat)
 
-	for _, port := range svc.Spec.Ports {
-		proxyName := fmt.Sprintf("%s-%s", svc.Name, port.Name)
-		if port.Name == "" {
-			proxyName = fmt.Sprintf("%s-%d", svc.Name, port.Port)
+	if RandomRemotePorts(svc) {
+		// The admin API is how the operator learns which ports frps assigned.
+		c.WebServer = &WebServer{Addr: "127.0.0.1", Port: DefaultAdminPort}
+		if opts.AdminPassword != "" {
+			c.WebServer.Addr = "0.0.0.0"
+			c.WebServer.User, c.WebServer.Password = AdminUser, opts.AdminPassword
 		}
+	}
 
-		protocol := strings.ToLower(string(port.Protocol))
-		if protocol == "" {
-			protocol = "tcp"
+	for _, port := range PublishedPorts(svc) {
+		if assigned, ok := opts.AssignedRemotePorts[port.Key()]; ok && port.RemotePort == 0 {
+			port.RemotePort = assigned
 		}
+		p := proxyConfig(svc, port.ProxyPort, port.Name, port.RemotePort, opts.ClusterDomain)
+		if opts.LocalIPOverride != "" {
+			p.LocalIP = opts.LocalIPOverride
+		}
+		if port, ok := opts.LocalPortOverrides[p.Name]; ok {
+			p.LocalPort = port
+		}
+		c.Proxies = append(c.Proxies, p)
+	}
+	if opts.LoadBalancerGroupKey != "" {
+		c.EnableLoadBalancing(opts.LoadBalancerGroupKey)
+	}
+	return c
+}
 
-		b.WriteString("[[proxies]]\n")
-		b.WriteString(fmt.Sprintf("name = \"%s\"\n", proxyName))
-		b.WriteString(fmt.Sprintf("type = \"%s\"\n", protocol))
-		b.WriteString(fmt.Sprintf("localIP = \"%s\"\n", localIP))
-		b.WriteString(fmt.Sprintf("localPort = %d\n", port.Port))
-		b.WriteString(fmt.Sprintf("remotePort = %d\n", port.Port))
-		b.WriteString("\n")
+// ClientUser returns the frpc user of the tunnel of svc: its namespace and
+// name, sanitized as for a Kubernetes label value. frps prefixes proxy names
+// with the user, so tunnels sharing an frps can each register an "http"
+// proxy.
+func ClientUser(svc *corev1.Service) string {
+	return sanitizeProxyName(svc.Namespace + "-" + svc.Name)
+}
+
+// GroupMember is a Service sharing a tunnel group's frpc with others.
+type GroupMember struct {
+	Service *corev1.Service
+	// RemotePorts maps ProxyPort.Key to the public port frps serves the
+	// proxy on. Proxies without an entry are left out.
+	RemotePorts map[string]int
+}
+
+// GenerateGroupClientConfig generates a TOML frpc configuration aggregating
+// the proxies of every member of a tunnel group. Proxy names are prefixed
+// with the member's namespace, since members may share a name. token,
+// clusterDomain, heartbeat and logLevel are as AuthToken and the like in
+// ClientOptions.
+func GenerateGroupClientConfig(members []GroupMember, serverAddr string, serverPort int, token, clusterDomain string, heartbeat Heartbeat, logLevel string) string {
+	c := &ClientConfig{ServerAddr: serverAddr, ServerPort: serverPort, Log: consoleLog(logLevel)}
+	if token != "" {
+		c.Auth = &AuthSettings{Method: "token", Token: token}
+	}
+	c.keepReconnecting(heartbeat)
+	namer := newProxyNamer()
+	for _, member := range members {
+		for _, proxy := range ProxyPorts(member.Service) {
+			remotePort, ok := member.RemotePorts[proxy.Key()]
+			if !ok {
+				continue
+			}
+			name := namer.name(member.Service.Namespace + "-" + proxy.Name)
+			c.Proxies = append(c.Proxies, proxyConfig(member.Service, proxy, name, remotePort, clusterDomain))
+		}
+	}
+	return marshalTOML(c)
+}
+
+// proxyConfig returns the [[proxies]] entry for a proxy of svc.
+func proxyConfig(svc *corev1.Service, proxy ProxyPort, name string, remotePort int, clusterDomain string) Proxy {
+	p := Proxy{
+		Name: name,
+		Type: proxy.Protocol,
+		// The ClusterIP DNS name of the Service.
+		LocalIP:    LocalAddress(svc, clusterDomain),
+		LocalPort:  int(proxy.Port.Port),
+		RemotePort: remotePort,
+	}
+
+	var transport ProxyTransportConfig
+	if bandwidth := BandwidthLimitFor(svc); bandwidth.Limit != "" {
+		transport.BandwidthLimit = bandwidth.Limit
+		transport.BandwidthLimitMode = bandwidth.Mode
+	}
+	options := ProxyTransportFor(svc, proxy.Port)
+	transport.UseEncryption = options.UseEncryption
+	transport.UseCompression = options.UseCompression
+	if proxy.Protocol == "tcp" {
+		transport.ProxyProtocolVersion = ProxyProtocolFor(svc, proxy.Port)
+	}
+	if transport != (ProxyTransportConfig{}) {
+		p.Transport = &transport
+	}
+	if VhostPort(svc, proxy) != 0 {
+		// frps routes by domain on its vhost port instead.
+		p.Type = ProxyTypeFor(svc, proxy)
+		p.RemotePort = 0
+		p.CustomDomains = CustomDomains(svc)
 	}
+	if proxy.Protocol == "tcp" {
+		// frp's checks dial TCP or speak HTTP, which a UDP backend would fail.
+		p.HealthCheck = HealthCheckFor(svc, proxy.Port)
+	}
+	return p
+}
 
-	return b.String()
+// ServerOptions controls how GenerateServerConfigWithOptions renders an
+// frps configuration.
+type ServerOptions struct {
+	// BindPort is the frps control port.
+	BindPort int
+	// Protocol is the transport protocol clients connect with (see
+	// TransportProtocol); empty means tcp. quic and kcp listen on UDP with
+	// the same port number as BindPort.
+	Protocol string
+	// Dashboard, when set, enables the frps dashboard on
+	// DefaultDashboardPort, protected by its credentials.
+	Dashboard *Dashboard
+	// Limits bound what clients may ask of frps.
+	Limits ServerLimits
+	// VhostHTTPPort and VhostHTTPSPort, when set, make frps serve http and
+	// https proxies on them; see AnnotationProxyType.
+	VhostHTTPPort  int
+	VhostHTTPSPort int
+	// LogLevel is the level frps logs to stdout at, where `fly logs` shows
+	// it; empty means DefaultLogLevel.
+	LogLevel string
+	// AuthToken makes frps require token authentication. Empty disables it.
+	AuthToken string
 }
 
 // GenerateServerConfig generates a minimal TOML frps configuration.
 func GenerateServerConfig(bindPort int) string {
-	return fmt.Sprintf("bindPort = %d\n", bindPort)
+	return GenerateServerConfigWithOptions(ServerOptions{BindPort: bindPort})
+}
+
+// GenerateServerConfigWithOptions generates a TOML frps configuration.
+//
+// Bandwidth limits need no server-side settings in either mode: frpc sends
+// each proxy's limit and mode when registering it, and in server mode frps
+// throttles the proxy's public listener itself.
+func GenerateServerConfigWithOptions(opts ServerOptions) string {
+	c := &ServerConfig{
+		BindPort:          opts.BindPort,
+		MaxPortsPerClient: opts.Limits.MaxPortsPerClient,
+		VhostHTTPPort:     opts.VhostHTTPPort,
+		VhostHTTPSPort:    opts.VhostHTTPSPort,
+		Log:               consoleLog(opts.LogLevel),
+	}
+	if opts.AuthToken != "" {
+		c.Auth = &AuthSettings{Method: "token", Token: opts.AuthToken}
+	}
+	switch opts.Protocol {
+	case "quic":
+		c.QUICBindPort = opts.BindPort
+	case "kcp":
+		c.KCPBindPort = opts.BindPort
+	}
+	if opts.Limits.MaxPoolCount > 0 || opts.Limits.HeartbeatTimeout > 0 {
+		c.Transport = &ServerTransport{
+			MaxPoolCount:     opts.Limits.MaxPoolCount,
+			HeartbeatTimeout: int(opts.Limits.HeartbeatTimeout / time.Second),
+		}
+	}
+	if opts.Dashboard != nil {
+		c.WebServer = &WebServer{
+			Addr:     "0.0.0.0",
+			Port:     DefaultDashboardPort,
+			User:     opts.Dashboard.User,
+			Password: opts.Dashboard.Password,
+		}
+	}
+	return marshalTOML(c)
 }
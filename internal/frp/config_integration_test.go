@@ -4,6 +4,7 @@ package frp_test
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -18,6 +19,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
 )
 
 // findFrpBinary searches for frps/frpc in common locations.
@@ -169,14 +171,12 @@ func TestIntegration_SinglePortTunnel(t *testing.T) {
 
 	// Generate frpc config. Override localIP to 127.0.0.1 and localPort to backendPort
 	// since we're running locally (not in a K8s cluster).
-	frpcConfig := frp.GenerateClientConfig(svc, "127.0.0.1", controlPort)
-	// Patch localIP and localPort to point to our local echo server.
-	frpcConfig = strings.ReplaceAll(frpcConfig,
-		"localIP = \"echo-service.default.svc.cluster.local\"",
-		"localIP = \"127.0.0.1\"")
-	frpcConfig = strings.ReplaceAll(frpcConfig,
-		fmt.Sprintf("localPort = %d", servicePort),
-		fmt.Sprintf("localPort = %d", backendPort))
+	frpcConfig := frp.GenerateClientConfigWithOptions(svc, frp.ClientOptions{
+		ServerAddr:         "127.0.0.1",
+		ServerPort:         controlPort,
+		LocalIPOverride:    "127.0.0.1",
+		LocalPortOverrides: map[string]int{"echo-service-echo": backendPort},
+	})
 
 	frpcConfigPath := filepath.Join(tmpDir, "frpc.toml")
 	os.WriteFile(frpcConfigPath, []byte(frpcConfig), 0644)
@@ -286,14 +286,15 @@ func TestIntegration_MultiPortTunnel(t *testing.T) {
 	}
 
 	// Generate frpc config and patch for local testing.
-	frpcConfig := frp.GenerateClientConfig(svc, "127.0.0.1", controlPort)
-	frpcConfig = strings.ReplaceAll(frpcConfig,
-		"localIP = \"envoy-gateway.envoy-gateway-system.svc.cluster.local\"",
-		"localIP = \"127.0.0.1\"")
-	// Patch localPort for HTTP.
-	frpcConfig = patchLocalPort(frpcConfig, "envoy-gateway-http", httpBackendPort)
-	// Patch localPort for HTTPS.
-	frpcConfig = patchLocalPort(frpcConfig, "envoy-gateway-https", httpsBackendPort)
+	frpcConfig := frp.GenerateClientConfigWithOptions(svc, frp.ClientOptions{
+		ServerAddr:      "127.0.0.1",
+		ServerPort:      controlPort,
+		LocalIPOverride: "127.0.0.1",
+		LocalPortOverrides: map[string]int{
+			"envoy-gateway-http":  httpBackendPort,
+			"envoy-gateway-https": httpsBackendPort,
+		},
+	})
 
 	frpcConfigPath := filepath.Join(tmpDir, "frpc.toml")
 	os.WriteFile(frpcConfigPath, []byte(frpcConfig), 0644)
@@ -389,7 +390,105 @@ func TestIntegration_ServerConfigParseValid(t *testing.T) {
 	t.Logf("frps verify output: %s", strings.TrimSpace(string(output)))
 }
 
+// TestIntegration_ServerConfigLimitsParseValid verifies that frps accepts a
+// generated config with connection limits and a heartbeat timeout.
+func TestIntegration_ServerConfigLimitsParseValid(t *testing.T) {
+	frpsBin := findFrpBinary("frps")
+	if frpsBin == "" {
+		t.Skip("frps binary not found; set FRP_BIN_DIR or install frp")
+	}
+
+	config := frp.GenerateServerConfigWithOptions(frp.ServerOptions{
+		BindPort:  7000,
+		Limits:    frp.ServerLimits{MaxPoolCount: 2, MaxPortsPerClient: 10, HeartbeatTimeout: time.Minute},
+		AuthToken: "sample-token",
+	})
+
+	configPath := filepath.Join(t.TempDir(), "frps.toml")
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(frpsBin, "verify", "-c", configPath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("frps verify failed: %v\noutput: %s\nconfig:\n%s", err, string(output), config)
+	}
+}
+
+// TestIntegration_LogConfigParseValid verifies that frps and frpc accept the
+// log table of generated configs.
+func TestIntegration_LogConfigParseValid(t *testing.T) {
+	frpcBin := findFrpBinary("frpc")
+	frpsBin := findFrpBinary("frps")
+	if frpcBin == "" || frpsBin == "" {
+		t.Skip("frps/frpc binaries not found; set FRP_BIN_DIR or install frp")
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "logs", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	configs := map[string]string{
+		frpsBin: frp.GenerateServerConfigWithOptions(frp.ServerOptions{BindPort: 7000, LogLevel: "debug"}),
+		frpcBin: frp.GenerateClientConfigWithOptions(svc, frp.ClientOptions{ServerAddr: "10.0.0.1", ServerPort: 7000, LogLevel: "trace"}),
+	}
+	for bin, config := range configs {
+		configPath := filepath.Join(t.TempDir(), "frp.toml")
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		output, err := exec.Command(bin, "verify", "-c", configPath).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s verify failed: %v\noutput: %s\nconfig:\n%s", filepath.Base(bin), err, output, config)
+		}
+	}
+}
+
 // TestIntegration_LargePortRange verifies config generation and parsing with many ports.
+func TestIntegration_VhostConfigParseValid(t *testing.T) {
+	frpcBin := findFrpBinary("frpc")
+	frpsBin := findFrpBinary("frps")
+	if frpcBin == "" || frpsBin == "" {
+		t.Skip("frps/frpc binaries not found; set FRP_BIN_DIR or install frp")
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "test-namespace",
+			Annotations: map[string]string{
+				frp.AnnotationProxyType:                              "http",
+				frp.PortAnnotation("https", frp.AnnotationProxyType): "https",
+				frp.PortAnnotation("ssh", frp.AnnotationProxyType):   "tcp",
+				frp.AnnotationCustomDomains:                          "a.example.com,*.b.example.com",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+				{Name: "https", Port: 8443, Protocol: corev1.ProtocolTCP},
+				{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	httpPort, httpsPort := frp.VhostPorts(svc)
+	configs := map[string]string{
+		frpcBin: frp.GenerateClientConfig(svc, "10.0.0.1", 7000),
+		frpsBin: frp.GenerateServerConfigWithOptions(frp.ServerOptions{BindPort: 7000, VhostHTTPPort: httpPort, VhostHTTPSPort: httpsPort}),
+	}
+	for bin, config := range configs {
+		configPath := filepath.Join(t.TempDir(), "frp.toml")
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		output, err := exec.Command(bin, "verify", "-c", configPath).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s verify failed: %v\noutput: %s\nconfig:\n%s", filepath.Base(bin), err, string(output), config)
+		}
+	}
+}
+
 func TestIntegration_LargePortRange(t *testing.T) {
 	frpcBin := findFrpBinary("frpc")
 	if frpcBin == "" {
@@ -531,18 +630,729 @@ func verifyTunnel(t *testing.T, port int, message string) {
 	t.Logf("port %d verified: sent %q, received %q", port, message, response)
 }
 
-// patchLocalPort replaces the localPort for a specific proxy name in the config.
-func patchLocalPort(config, proxyName string, newPort int) string {
-	lines := strings.Split(config, "\n")
-	inProxy := false
-	for i, line := range lines {
-		if strings.Contains(line, fmt.Sprintf(`name = "%s"`, proxyName)) {
-			inProxy = true
+// TestIntegration_BandwidthLimitConfigParseValid verifies that frpc accepts
+// the generated bandwidth settings in both modes.
+func TestIntegration_BandwidthLimitConfigParseValid(t *testing.T) {
+	frpcBin := findFrpBinary("frpc")
+	if frpcBin == "" {
+		t.Skip("frpc binary not found; set FRP_BIN_DIR or install frp")
+	}
+
+	for _, mode := range []string{frp.BandwidthLimitModeClient, frp.BandwidthLimitModeServer} {
+		t.Run(mode, func(t *testing.T) {
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-service",
+					Namespace: "test-namespace",
+					Annotations: map[string]string{
+						frp.AnnotationBandwidthLimit:     "1MB",
+						frp.AnnotationBandwidthLimitMode: mode,
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+						{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+					},
+				},
+			}
+
+			config := frp.GenerateClientConfig(svc, "10.0.0.1", 7000)
+
+			configPath := filepath.Join(t.TempDir(), "frpc.toml")
+			os.WriteFile(configPath, []byte(config), 0644)
+
+			cmd := exec.Command(frpcBin, "verify", "-c", configPath)
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("frpc verify failed: %v\noutput: %s\nconfig:\n%s", err, string(output), config)
+			}
+		})
+	}
+}
+
+// TestIntegration_ProxyTransportConfigParseValid verifies that frpc accepts
+// the generated encryption and compression settings.
+func TestIntegration_ProxyTransportConfigParseValid(t *testing.T) {
+	frpcBin := findFrpBinary("frpc")
+	if frpcBin == "" {
+		t.Skip("frpc binary not found; set FRP_BIN_DIR or install frp")
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "test-namespace",
+			Annotations: map[string]string{
+				frp.AnnotationEncryption:                              "true",
+				frp.PortAnnotation("http", frp.AnnotationCompression): "true",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	config := frp.GenerateClientConfig(svc, "10.0.0.1", 7000)
+
+	configPath := filepath.Join(t.TempDir(), "frpc.toml")
+	os.WriteFile(configPath, []byte(config), 0644)
+
+	cmd := exec.Command(frpcBin, "verify", "-c", configPath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("frpc verify failed: %v\noutput: %s\nconfig:\n%s", err, string(output), config)
+	}
+}
+
+// TestIntegration_TransportProtocolConfigParseValid verifies that frpc and
+// frps accept the generated configs for every transport protocol.
+func TestIntegration_TransportProtocolConfigParseValid(t *testing.T) {
+	frpsBin := findFrpBinary("frps")
+	frpcBin := findFrpBinary("frpc")
+	if frpsBin == "" || frpcBin == "" {
+		t.Skip("frps/frpc binaries not found; set FRP_BIN_DIR or install frp")
+	}
+
+	for _, protocol := range []string{"tcp", "websocket", "quic", "kcp"} {
+		t.Run(protocol, func(t *testing.T) {
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-service",
+					Namespace:   "test-namespace",
+					Annotations: map[string]string{frp.AnnotationTransport: protocol},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			}
+
+			tmpDir := t.TempDir()
+			for _, c := range []struct {
+				bin, file, config string
+			}{
+				{frpcBin, "frpc.toml", frp.GenerateClientConfig(svc, "10.0.0.1", 7000)},
+				{frpsBin, "frps.toml", frp.GenerateServerConfigWithOptions(frp.ServerOptions{BindPort: 7000, Protocol: protocol})},
+			} {
+				path := filepath.Join(tmpDir, c.file)
+				os.WriteFile(path, []byte(c.config), 0644)
+
+				output, err := exec.Command(c.bin, "verify", "-c", path).CombinedOutput()
+				if err != nil {
+					t.Fatalf("%s verify failed: %v\noutput: %s\nconfig:\n%s", filepath.Base(c.bin), err, string(output), c.config)
+				}
+			}
+		})
+	}
+}
+
+// TestIntegration_ServerBandwidthLimit verifies that frps caps the throughput
+// of a proxy registered with server-side bandwidth limiting.
+func TestIntegration_ServerBandwidthLimit(t *testing.T) {
+	frpsBin := findFrpBinary("frps")
+	frpcBin := findFrpBinary("frpc")
+	if frpsBin == "" || frpcBin == "" {
+		t.Skip("frps/frpc binaries not found; set FRP_BIN_DIR or install frp")
+	}
+
+	controlPort := getFreePort(t)
+	servicePort := getFreePort(t)
+	backendPort := getFreePort(t)
+
+	echoListener := startEchoServer(t, backendPort)
+	defer echoListener.Close()
+
+	tmpDir := t.TempDir()
+
+	frpsConfigPath := filepath.Join(tmpDir, "frps.toml")
+	os.WriteFile(frpsConfigPath, []byte(frp.GenerateServerConfig(controlPort)), 0644)
+
+	frpsCmd := exec.Command(frpsBin, "-c", frpsConfigPath)
+	frpsCmd.Env = noProxyEnv()
+	frpsCmd.Stdout = os.Stdout
+	frpsCmd.Stderr = os.Stderr
+	if err := frpsCmd.Start(); err != nil {
+		t.Fatalf("failed to start frps: %v", err)
+	}
+	defer func() {
+		frpsCmd.Process.Kill()
+		frpsCmd.Wait()
+	}()
+
+	waitForPort(t, controlPort, 10*time.Second)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "limited",
+			Namespace: "default",
+			Annotations: map[string]string{
+				frp.AnnotationBandwidthLimit:     "64KB",
+				frp.AnnotationBandwidthLimitMode: frp.BandwidthLimitModeServer,
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "echo", Port: int32(servicePort), Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+
+	frpcConfig := frp.GenerateClientConfigWithOptions(svc, frp.ClientOptions{
+		ServerAddr:         "127.0.0.1",
+		ServerPort:         controlPort,
+		LocalIPOverride:    "127.0.0.1",
+		LocalPortOverrides: map[string]int{"limited-echo": backendPort},
+	})
+
+	frpcConfigPath := filepath.Join(tmpDir, "frpc.toml")
+	os.WriteFile(frpcConfigPath, []byte(frpcConfig), 0644)
+
+	frpcCmd := exec.Command(frpcBin, "-c", frpcConfigPath)
+	frpcCmd.Env = noProxyEnv()
+	frpcCmd.Stdout = os.Stdout
+	frpcCmd.Stderr = os.Stderr
+	if err := frpcCmd.Start(); err != nil {
+		t.Fatalf("failed to start frpc: %v", err)
+	}
+	defer func() {
+		frpcCmd.Process.Kill()
+		frpcCmd.Wait()
+	}()
+
+	waitForPort(t, servicePort, 10*time.Second)
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", servicePort), 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to tunnel port %d: %v", servicePort, err)
+	}
+	defer conn.Close()
+
+	// Push 256KB through a 64KB/s limit; it cannot complete in under ~3s.
+	const lines = 256
+	line := strings.Repeat("x", 1023)
+	start := time.Now()
+	go func() {
+		for i := 0; i < lines; i++ {
+			fmt.Fprintf(conn, "%s\n", line)
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	for i := 0; i < lines; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("read %d of %d lines: %v", i, lines, scanner.Err())
+		}
+	}
+	elapsed := time.Since(start)
+
+	if elapsed < 2*time.Second {
+		t.Errorf("expected throughput to be capped at 64KB/s, transferred 256KB in %v", elapsed)
+	}
+	t.Logf("transferred 256KB in %v", elapsed)
+}
+
+// TestIntegration_PoolCountWarmUp verifies that a pooled frpc config is
+// accepted and that the operator's warm-up probe reaches the backend through
+// the tunnel.
+func TestIntegration_PoolCountWarmUp(t *testing.T) {
+	frpsBin := findFrpBinary("frps")
+	frpcBin := findFrpBinary("frpc")
+	if frpsBin == "" || frpcBin == "" {
+		t.Skip("frps/frpc binaries not found; set FRP_BIN_DIR or install frp")
+	}
+
+	controlPort := getFreePort(t)
+	servicePort := getFreePort(t)
+	backendPort := getFreePort(t)
+
+	// Backend that counts connections.
+	backend, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", backendPort))
+	if err != nil {
+		t.Fatalf("failed to start backend: %v", err)
+	}
+	defer backend.Close()
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- struct{}{}
 		}
-		if inProxy && strings.HasPrefix(line, "localPort = ") {
-			lines[i] = fmt.Sprintf("localPort = %d", newPort)
+	}()
+
+	tmpDir := t.TempDir()
+	frpsConfigPath := filepath.Join(tmpDir, "frps.toml")
+	os.WriteFile(frpsConfigPath, []byte(frp.GenerateServerConfig(controlPort)), 0644)
+
+	frpsCmd := exec.Command(frpsBin, "-c", frpsConfigPath)
+	frpsCmd.Env = noProxyEnv()
+	frpsCmd.Stdout = os.Stdout
+	frpsCmd.Stderr = os.Stderr
+	if err := frpsCmd.Start(); err != nil {
+		t.Fatalf("failed to start frps: %v", err)
+	}
+	defer func() {
+		frpsCmd.Process.Kill()
+		frpsCmd.Wait()
+	}()
+
+	waitForPort(t, controlPort, 10*time.Second)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pooled",
+			Namespace: "default",
+			Annotations: map[string]string{
+				frp.AnnotationPoolCount:   "2",
+				tunnel.AnnotationPublicIP: "127.0.0.1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "api", Port: int32(servicePort), Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+
+	frpcConfig := frp.GenerateClientConfigWithOptions(svc, frp.ClientOptions{
+		ServerAddr:         "127.0.0.1",
+		ServerPort:         controlPort,
+		LocalIPOverride:    "127.0.0.1",
+		LocalPortOverrides: map[string]int{"pooled-api": backendPort},
+	})
+
+	frpcConfigPath := filepath.Join(tmpDir, "frpc.toml")
+	os.WriteFile(frpcConfigPath, []byte(frpcConfig), 0644)
+
+	frpcCmd := exec.Command(frpcBin, "-c", frpcConfigPath)
+	frpcCmd.Env = noProxyEnv()
+	frpcCmd.Stdout = os.Stdout
+	frpcCmd.Stderr = os.Stderr
+	if err := frpcCmd.Start(); err != nil {
+		t.Fatalf("failed to start frpc: %v", err)
+	}
+	defer func() {
+		frpcCmd.Process.Kill()
+		frpcCmd.Wait()
+	}()
+
+	waitForPort(t, servicePort, 10*time.Second)
+	// waitForPort's own probe also reaches the backend; drain it.
+	drain := time.After(time.Second)
+	for draining := true; draining; {
+		select {
+		case <-accepted:
+		case <-drain:
+			draining = false
+		}
+	}
+
+	mgr := tunnel.NewManager(nil, nil, tunnel.Config{})
+	if err := mgr.WarmUp(context.Background(), svc); err != nil {
+		t.Fatalf("WarmUp failed: %v", err)
+	}
+
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the warm-up probe to reach the backend through the tunnel")
+	}
+}
+
+// TestIntegration_TCPHealthCheck verifies that frps stops serving a proxy
+// whose backend fails its tcp health check, and serves it again once the
+// backend is back.
+func TestIntegration_TCPHealthCheck(t *testing.T) {
+	frpsBin := findFrpBinary("frps")
+	frpcBin := findFrpBinary("frpc")
+	if frpsBin == "" || frpcBin == "" {
+		t.Skip("frps/frpc binaries not found; set FRP_BIN_DIR or install frp")
+	}
+
+	controlPort := getFreePort(t)
+	servicePort := getFreePort(t)
+	backendPort := getFreePort(t)
+
+	echoListener := startEchoServer(t, backendPort)
+	defer func() { echoListener.Close() }()
+
+	tmpDir := t.TempDir()
+	frpsConfigPath := filepath.Join(tmpDir, "frps.toml")
+	os.WriteFile(frpsConfigPath, []byte(frp.GenerateServerConfig(controlPort)), 0644)
+
+	frpsCmd := exec.Command(frpsBin, "-c", frpsConfigPath)
+	frpsCmd.Env = noProxyEnv()
+	frpsCmd.Stdout = os.Stdout
+	frpsCmd.Stderr = os.Stderr
+	if err := frpsCmd.Start(); err != nil {
+		t.Fatalf("failed to start frps: %v", err)
+	}
+	defer func() {
+		frpsCmd.Process.Kill()
+		frpsCmd.Wait()
+	}()
+
+	waitForPort(t, controlPort, 10*time.Second)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "checked",
+			Namespace: "default",
+			Annotations: map[string]string{
+				frp.AnnotationHealthCheck:         frp.HealthCheckTCP,
+				frp.AnnotationHealthCheckInterval: "1s",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "echo", Port: int32(servicePort), Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+
+	frpcConfig := frp.GenerateClientConfigWithOptions(svc, frp.ClientOptions{
+		ServerAddr:         "127.0.0.1",
+		ServerPort:         controlPort,
+		LocalIPOverride:    "127.0.0.1",
+		LocalPortOverrides: map[string]int{"checked-echo": backendPort},
+	})
+	t.Logf("frpc config:\n%s", frpcConfig)
+
+	frpcConfigPath := filepath.Join(tmpDir, "frpc.toml")
+	os.WriteFile(frpcConfigPath, []byte(frpcConfig), 0644)
+
+	frpcCmd := exec.Command(frpcBin, "-c", frpcConfigPath)
+	frpcCmd.Env = noProxyEnv()
+	frpcCmd.Stdout = os.Stdout
+	frpcCmd.Stderr = os.Stderr
+	if err := frpcCmd.Start(); err != nil {
+		t.Fatalf("failed to start frpc: %v", err)
+	}
+	defer func() {
+		frpcCmd.Process.Kill()
+		frpcCmd.Wait()
+	}()
+
+	// The proxy is only registered once the first check passes.
+	waitForPort(t, servicePort, 10*time.Second)
+	verifyTunnel(t, servicePort, "healthy")
+
+	// With the backend down, frpc removes the proxy and frps closes its port.
+	echoListener.Close()
+	waitForPortClosed(t, servicePort, 10*time.Second)
+
+	echoListener = startEchoServer(t, backendPort)
+	waitForPort(t, servicePort, 10*time.Second)
+	verifyTunnel(t, servicePort, "recovered")
+}
+
+// waitForPortClosed waits until a TCP port refuses connections.
+func waitForPortClosed(t *testing.T, port int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 500*time.Millisecond)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("port %d still accepting connections after %v", port, timeout)
+}
+
+// TestIntegration_ProxyProtocol verifies that a backend behind a proxy with
+// the PROXY protocol enabled receives exactly one header ahead of the data.
+func TestIntegration_ProxyProtocol(t *testing.T) {
+	frpsBin := findFrpBinary("frps")
+	frpcBin := findFrpBinary("frpc")
+	if frpsBin == "" || frpcBin == "" {
+		t.Skip("frps/frpc binaries not found; set FRP_BIN_DIR or install frp")
+	}
+
+	controlPort := getFreePort(t)
+	servicePort := getFreePort(t)
+	backendPort := getFreePort(t)
+
+	// The echo server echoes the v1 header line like any other.
+	echoListener := startEchoServer(t, backendPort)
+	defer echoListener.Close()
+
+	tmpDir := t.TempDir()
+	frpsConfigPath := filepath.Join(tmpDir, "frps.toml")
+	os.WriteFile(frpsConfigPath, []byte(frp.GenerateServerConfig(controlPort)), 0644)
+
+	frpsCmd := exec.Command(frpsBin, "-c", frpsConfigPath)
+	frpsCmd.Env = noProxyEnv()
+	frpsCmd.Stdout = os.Stdout
+	frpsCmd.Stderr = os.Stderr
+	if err := frpsCmd.Start(); err != nil {
+		t.Fatalf("failed to start frps: %v", err)
+	}
+	defer func() {
+		frpsCmd.Process.Kill()
+		frpsCmd.Wait()
+	}()
+
+	waitForPort(t, controlPort, 10*time.Second)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "proxied",
+			Namespace:   "default",
+			Annotations: map[string]string{frp.AnnotationProxyProtocol: frp.ProxyProtocolV1},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "echo", Port: int32(servicePort), Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+
+	frpcConfig := frp.GenerateClientConfigWithOptions(svc, frp.ClientOptions{
+		ServerAddr:         "127.0.0.1",
+		ServerPort:         controlPort,
+		LocalIPOverride:    "127.0.0.1",
+		LocalPortOverrides: map[string]int{"proxied-echo": backendPort},
+	})
+	t.Logf("frpc config:\n%s", frpcConfig)
+
+	frpcConfigPath := filepath.Join(tmpDir, "frpc.toml")
+	os.WriteFile(frpcConfigPath, []byte(frpcConfig), 0644)
+
+	frpcCmd := exec.Command(frpcBin, "-c", frpcConfigPath)
+	frpcCmd.Env = noProxyEnv()
+	frpcCmd.Stdout = os.Stdout
+	frpcCmd.Stderr = os.Stderr
+	if err := frpcCmd.Start(); err != nil {
+		t.Fatalf("failed to start frpc: %v", err)
+	}
+	defer func() {
+		frpcCmd.Process.Kill()
+		frpcCmd.Wait()
+	}()
+
+	waitForPort(t, servicePort, 10*time.Second)
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", servicePort), 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to tunneled port %d: %v", servicePort, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "hello\n")
+
+	var headers []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(strings.TrimPrefix(scanner.Text(), "echo:"), "\r")
+		if line == "hello" {
 			break
 		}
+		if strings.HasPrefix(line, "PROXY ") {
+			headers = append(headers, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("reading from tunnel: %v", err)
+	}
+	if len(headers) != 1 || !strings.HasPrefix(headers[0], "PROXY TCP4 127.0.0.1 ") {
+		t.Errorf("expected exactly one PROXY header from 127.0.0.1, got %q", headers)
+	}
+}
+
+// TestIntegration_VerifyBinaries runs the startup verification against the
+// real frp binaries.
+func TestIntegration_VerifyBinaries(t *testing.T) {
+	frpcBin, frpsBin := findFrpBinary("frpc"), findFrpBinary("frps")
+	if frpcBin == "" || frpsBin == "" {
+		t.Skip("frps/frpc binaries not found; set FRP_BIN_DIR or install frp")
+	}
+
+	if err := frp.VerifyBinaries(context.Background(), frpcBin, frpsBin); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTaggedServer starts a TCP server that answers each line with tag and
+// the line, so a test can tell which backend served a connection.
+func startTaggedServer(t *testing.T, port int, tag string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("failed to start server on port %d: %v", port, err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				scanner := bufio.NewScanner(c)
+				for scanner.Scan() {
+					fmt.Fprintf(c, "%s:%s\n", tag, scanner.Text())
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+// tunnelResponder sends message through the tunnel port and returns the tag
+// of the backend that answered.
+func tunnelResponder(t *testing.T, port int, message string) string {
+	t.Helper()
+	tag, err := tryTunnelResponder(port, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tag
+}
+
+// tryTunnelResponder is tunnelResponder returning its failure.
+func tryTunnelResponder(port int, message string) (string, error) {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 5*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to tunnel port %d: %w", port, err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "%s\n", message)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		return "", fmt.Errorf("failed to read response from port %d: %v", port, scanner.Err())
+	}
+	tag, echoed, _ := strings.Cut(scanner.Text(), ":")
+	if echoed != message {
+		return "", fmt.Errorf("port %d: got %q, want a reply to %q", port, scanner.Text(), message)
+	}
+	return tag, nil
+}
+
+// TestIntegration_LoadBalancedReplicas verifies that two frpc processes
+// running the config of a multi-replica tunnel, told apart only by their pod
+// name, both stay registered with frps and share the Service's traffic, and
+// that the survivor keeps serving when one goes away.
+func TestIntegration_LoadBalancedReplicas(t *testing.T) {
+	frpsBin := findFrpBinary("frps")
+	frpcBin := findFrpBinary("frpc")
+	if frpsBin == "" || frpcBin == "" {
+		t.Skip("frps/frpc binaries not found; set FRP_BIN_DIR or install frp")
+	}
+
+	controlPort := getFreePort(t)
+	servicePort := getFreePort(t)
+	const token = "replicas-test-token"
+
+	tmpDir := t.TempDir()
+	frpsConfigPath := filepath.Join(tmpDir, "frps.toml")
+	os.WriteFile(frpsConfigPath, []byte(frp.GenerateServerConfigWithOptions(frp.ServerOptions{BindPort: controlPort, AuthToken: token})), 0644)
+
+	frpsCmd := exec.Command(frpsBin, "-c", frpsConfigPath)
+	frpsCmd.Env = noProxyEnv()
+	frpsCmd.Stdout = os.Stdout
+	frpsCmd.Stderr = os.Stderr
+	if err := frpsCmd.Start(); err != nil {
+		t.Fatalf("failed to start frps: %v", err)
+	}
+	defer func() {
+		frpsCmd.Process.Kill()
+		frpsCmd.Wait()
+	}()
+	waitForPort(t, controlPort, 10*time.Second)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "echo", Port: int32(servicePort), Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+
+	// Each replica gets its own backend here, so the test can tell which
+	// one served a connection; in a cluster they share the Service.
+	startReplica := func(pod string) *exec.Cmd {
+		backendPort := getFreePort(t)
+		l := startTaggedServer(t, backendPort, pod)
+		t.Cleanup(func() { l.Close() })
+
+		config := frp.GenerateClientConfigWithOptions(svc, frp.ClientOptions{
+			ServerAddr:           "127.0.0.1",
+			ServerPort:           controlPort,
+			AuthToken:            token,
+			User:                 "{{ .Envs.FRPC_POD_NAME }}",
+			LoadBalancerGroupKey: "replicas-test-group-key",
+			LocalIPOverride:      "127.0.0.1",
+			LocalPortOverrides:   map[string]int{"web-echo": backendPort},
+		})
+		path := filepath.Join(tmpDir, pod+".toml")
+		os.WriteFile(path, []byte(config), 0644)
+
+		cmd := exec.Command(frpcBin, "-c", path)
+		cmd.Env = append(noProxyEnv(), "FRPC_POD_NAME="+pod)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("failed to start frpc %s: %v", pod, err)
+		}
+		t.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+		return cmd
+	}
+	startReplica("frpc-a")
+	waitForPort(t, servicePort, 10*time.Second)
+	b := startReplica("frpc-b")
+
+	// frps picks a group member per connection; within a few dozen
+	// connections both must have answered, and keep doing so.
+	served := map[string]int{}
+	deadline := time.Now().Add(15 * time.Second)
+	for (served["frpc-a"] == 0 || served["frpc-b"] == 0) && time.Now().Before(deadline) {
+		served[tunnelResponder(t, servicePort, "hello")]++
+		time.Sleep(50 * time.Millisecond)
+	}
+	if served["frpc-a"] == 0 || served["frpc-b"] == 0 {
+		t.Fatalf("expected both replicas to serve the tunnel, got %v", served)
+	}
+	time.Sleep(3 * time.Second)
+	served = map[string]int{}
+	for i := 0; i < 40; i++ {
+		served[tunnelResponder(t, servicePort, fmt.Sprintf("still-%d", i))]++
+	}
+	if served["frpc-a"] == 0 || served["frpc-b"] == 0 {
+		t.Fatalf("expected both replicas to stay connected, got %v", served)
+	}
+	t.Logf("traffic shared between replicas: %v", served)
+
+	// frps drops a replica that goes away from the group once its control
+	// connection closes; from then on the survivor serves every connection.
+	b.Process.Kill()
+	b.Wait()
+	deadline = time.Now().Add(10 * time.Second)
+	consecutive := 0
+	for consecutive < 10 && time.Now().Before(deadline) {
+		if tag, err := tryTunnelResponder(servicePort, "after"); err == nil && tag == "frpc-a" {
+			consecutive++
+			continue
+		}
+		consecutive = 0
+		time.Sleep(100 * time.Millisecond)
+	}
+	if consecutive < 10 {
+		t.Fatal("expected the surviving replica to serve every connection")
 	}
-	return strings.Join(lines, "\n")
 }
@@ -1,10 +1,17 @@
 package frp
 
 import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 func TestGenerateClientConfig(t *testing.T) {
@@ -29,29 +36,110 @@ func TestGenerateClientConfig(t *testing.T) {
 		},
 	}
 
-	config := GenerateClientConfig(svc, "137.66.1.1", 7000)
+	config := mustParseClientConfig(t, GenerateClientConfig(svc, "137.66.1.1", 7000))
 
-	expected := `serverAddr = "137.66.1.1"
-serverPort = 7000
+	localIP := "envoy-gateway.envoy-gateway-system.svc.cluster.local"
+	expected := &ClientConfig{
+		ServerAddr:    "137.66.1.1",
+		ServerPort:    7000,
+		User:          "envoy-gateway-system-envoy-gateway",
+		LoginFailExit: new(bool),
+		Log:           defaultLog(),
+		Transport:     defaultTransport(),
+		Proxies: []Proxy{
+			{Name: "envoy-gateway-http", Type: "tcp", LocalIP: localIP, LocalPort: 80, RemotePort: 80},
+			{Name: "envoy-gateway-https", Type: "tcp", LocalIP: localIP, LocalPort: 443, RemotePort: 443},
+		},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("unexpected config:\ngot:  %+v\nwant: %+v", config, expected)
+	}
+}
 
-[[proxies]]
-name = "envoy-gateway-http"
-type = "tcp"
-localIP = "envoy-gateway.envoy-gateway-system.svc.cluster.local"
-localPort = 80
-remotePort = 80
+func TestGenerateClientConfigWithOptions(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
 
-[[proxies]]
-name = "envoy-gateway-https"
-type = "tcp"
-localIP = "envoy-gateway.envoy-gateway-system.svc.cluster.local"
-localPort = 443
-remotePort = 443
+	config := mustParseClientConfig(t, GenerateClientConfigWithOptions(svc, ClientOptions{
+		ServerAddr:         "127.0.0.1",
+		ServerPort:         7001,
+		LocalIPOverride:    "127.0.0.1",
+		LocalPortOverrides: map[string]int{"web-https": 8443},
+		AuthToken:          "secret",
+		User:               "tenant",
+	}))
 
-`
+	expected := &ClientConfig{
+		ServerAddr:    "127.0.0.1",
+		ServerPort:    7001,
+		User:          "tenant",
+		LoginFailExit: new(bool),
+		Log:           defaultLog(),
+		Auth:          &AuthSettings{Method: "token", Token: "secret"},
+		Transport:     defaultTransport(),
+		Proxies: []Proxy{
+			{Name: "web-http", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: 80, RemotePort: 80},
+			{Name: "web-https", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: 8443, RemotePort: 443},
+		},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("unexpected config:\ngot:  %+v\nwant: %+v", config, expected)
+	}
+}
 
-	if config != expected {
-		t.Errorf("unexpected config:\ngot:\n%s\nwant:\n%s", config, expected)
+// mustParseClientConfig parses a generated frpc config.
+func mustParseClientConfig(t *testing.T, data string) *ClientConfig {
+	t.Helper()
+	c, err := ParseClientConfig(data)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, data)
+	}
+	return c
+}
+
+// mustParseServerConfig parses a generated frps config.
+func mustParseServerConfig(t *testing.T, data string) *ServerConfig {
+	t.Helper()
+	c, err := ParseServerConfig(data)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, data)
+	}
+	return c
+}
+
+func TestGenerateClientConfigUser(t *testing.T) {
+	svc := func(namespace, name string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}}},
+		}
+	}
+
+	a := mustParseClientConfig(t, GenerateClientConfig(svc("team-a", "web"), "10.0.0.1", 7000))
+	b := mustParseClientConfig(t, GenerateClientConfig(svc("team-b", "web"), "10.0.0.1", 7000))
+	if a.User != "team-a-web" || b.User != "team-b-web" {
+		t.Errorf("expected users team-a-web and team-b-web, got %q and %q", a.User, b.User)
+	}
+	// The same proxy name is safe on a shared frps, which prefixes the user.
+	if a.Proxies[0].Name != b.Proxies[0].Name {
+		t.Errorf("expected the same proxy name, got %q and %q", a.Proxies[0].Name, b.Proxies[0].Name)
+	}
+
+	long := ClientUser(svc(strings.Repeat("n", 63), strings.Repeat("s", 63)))
+	if len(long) > maxProxyNameLen {
+		t.Errorf("user %q exceeds %d characters", long, maxProxyNameLen)
+	}
+
+	c := mustParseClientConfig(t, GenerateClientConfigWithOptions(svc("team-a", "web"), ClientOptions{ServerAddr: "10.0.0.1", ServerPort: 7000, User: "replica"}))
+	if c.User != "replica" {
+		t.Errorf("expected ClientOptions.User to win, got %q", c.User)
 	}
 }
 
@@ -73,19 +161,322 @@ func TestGenerateClientConfigUnnamedPort(t *testing.T) {
 
 	config := GenerateClientConfig(svc, "10.0.0.1", 7000)
 
-	if !contains(config, `name = "minecraft-25565"`) {
-		t.Errorf("expected proxy name 'minecraft-25565' in config:\n%s", config)
+	if !contains(config, `name = "minecraft-tcp-25565"`) {
+		t.Errorf("expected proxy name 'minecraft-tcp-25565' in config:\n%s", config)
+	}
+}
+
+func TestGenerateClientConfigLongProxyNames(t *testing.T) {
+	// 63-char Service name (the Kubernetes maximum) plus a long port name.
+	svcName := strings.Repeat("a", 63)
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      svcName,
+			Namespace: "default",
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: strings.Repeat("p", 15), Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: strings.Repeat("p", 14) + "q", Port: 81, Protocol: corev1.ProtocolTCP},
+				{Port: 82, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+
+	config := GenerateClientConfig(svc, "10.0.0.1", 7000)
+
+	names := proxyNames(config)
+	if len(names) != 3 {
+		t.Fatalf("expected 3 proxies, got %d:\n%s", len(names), config)
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if len(name) > maxProxyNameLen {
+			t.Errorf("proxy name %q length = %d, exceeds max %d", name, len(name), maxProxyNameLen)
+		}
+		if seen[name] {
+			t.Errorf("duplicate proxy name %q", name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestProxyNamerUniqueness(t *testing.T) {
+	namer := newProxyNamer()
+
+	// Distinct inputs that sanitize to the same string must still be unique.
+	got := []string{
+		namer.name("svc-HTTP"),
+		namer.name("svc-http"),
+		namer.name("svc.http"),
+		namer.name(strings.Repeat("x", 100)),
+		namer.name(strings.Repeat("x", 100)),
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range got {
+		if seen[name] {
+			t.Errorf("duplicate proxy name %q in %v", name, got)
+		}
+		seen[name] = true
+		if len(name) > maxProxyNameLen {
+			t.Errorf("proxy name %q exceeds max length %d", name, maxProxyNameLen)
+		}
+	}
+
+	if got[0] != "svc-http" {
+		t.Errorf("expected first name to be unchanged, got %q", got[0])
+	}
+}
+
+func TestSanitizeProxyName(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"envoy-gateway-http", "envoy-gateway-http"},
+		{"Envoy_Gateway.HTTP", "envoy-gateway-http"},
+		{"-svc--http-", "svc-http"},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeProxyName(tt.input); got != tt.want {
+			t.Errorf("sanitizeProxyName(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+
+	long := sanitizeProxyName(strings.Repeat("a", 63) + "-" + strings.Repeat("b", 63))
+	if len(long) > maxProxyNameLen {
+		t.Errorf("truncated name length = %d, exceeds max %d", len(long), maxProxyNameLen)
+	}
+	if long == sanitizeProxyName(strings.Repeat("a", 63)+"-"+strings.Repeat("c", 63)) {
+		t.Error("truncation lost uniqueness")
+	}
+}
+
+func FuzzGenerateClientConfig(f *testing.F) {
+	f.Add("envoy-gateway", "envoy-gateway-system", "http", uint16(80), false, "https", uint16(443), false, "", "", "", "")
+	f.Add("minecraft", "default", "", uint16(25565), false, "", uint16(25565), true, "", "", "", "")
+	f.Add("dns", "default", "dns", uint16(53), true, "", uint16(0), false, "53", "", "", "")
+	f.Add("game", "default", "game", uint16(25565), false, "metrics", uint16(9100), false, "25565", "metrics", "", "")
+	f.Add(strings.Repeat("a", 63), "default", strings.Repeat("p", 15), uint16(80), false, strings.Repeat("p", 14)+"q", uint16(81), false, "", "", "", "")
+	f.Add("svc", "default", "HTTP", uint16(80), false, "http", uint16(81), false, "80,81", "", "", "")
+	f.Add("web", "default", "http", uint16(8080), false, "", uint16(0), false, "", "", "http", "a.example.com,*.b.example.com")
+	f.Fuzz(func(t *testing.T, name, namespace, name1 string, port1 uint16, udp1 bool, name2 string, port2 uint16, udp2 bool, dualStack, clusterOnly, proxyType, domains string) {
+		svc := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Annotations: map[string]string{
+					AnnotationDualStackPorts:   dualStack,
+					AnnotationClusterOnlyPorts: clusterOnly,
+					AnnotationProxyType:        proxyType,
+					AnnotationCustomDomains:    domains,
+				},
+			},
+		}
+		protocol := func(udp bool) corev1.Protocol {
+			if udp {
+				return corev1.ProtocolUDP
+			}
+			return corev1.ProtocolTCP
+		}
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: name1, Port: int32(port1), Protocol: protocol(udp1)})
+		if port2 != 0 {
+			svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: name2, Port: int32(port2), Protocol: protocol(udp2)})
+		}
+		// Stay within what the API server accepts.
+		if !validService(svc) {
+			t.Skip()
+		}
+
+		config, err := ParseClientConfig(GenerateClientConfig(svc, "10.0.0.1", 7000))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := make(map[string]int) // "<type>/<port>" of every included port
+		for _, port := range svc.Spec.Ports {
+			if !ClusterOnly(svc, port) {
+				want[strings.ToLower(string(port.Protocol))+"/"+strconv.Itoa(int(port.Port))]++
+			}
+		}
+		if len(config.Proxies) != len(PublishedPorts(svc)) {
+			t.Fatalf("expected %d proxies, got %d", len(PublishedPorts(svc)), len(config.Proxies))
+		}
+		got := make(map[string]int)
+		names := make(map[string]bool)
+		for _, p := range config.Proxies {
+			protocol := p.Type
+			if protocol == ProxyTypeHTTP || protocol == ProxyTypeHTTPS {
+				protocol = "tcp"
+			}
+			got[protocol+"/"+strconv.Itoa(p.LocalPort)]++
+			if p.Name == "" || len(p.Name) > maxProxyNameLen || sanitizeProxyName(p.Name) != p.Name {
+				t.Errorf("invalid proxy name %q", p.Name)
+			}
+			if names[p.Name] {
+				t.Errorf("duplicate proxy name %q", p.Name)
+			}
+			names[p.Name] = true
+		}
+		for key, n := range want {
+			if got[key] != n {
+				t.Errorf("expected %d proxies for %s, got %d", n, key, got[key])
+			}
+		}
+	})
+}
+
+// testService returns the Service default/web with annotations and ports.
+func testService(annotations map[string]string, ports ...corev1.ServicePort) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: annotations},
+		Spec:       corev1.ServiceSpec{Ports: ports},
+	}
+}
+
+// validService reports whether the API server would accept the names and
+// ports of svc, and its annotations as UTF-8.
+func validService(svc *corev1.Service) bool {
+	if len(validation.IsDNS1035Label(svc.Name)) > 0 || len(validation.IsDNS1123Label(svc.Namespace)) > 0 {
+		return false
+	}
+	for _, value := range svc.Annotations {
+		if !utf8.ValidString(value) {
+			return false
+		}
+	}
+	names := make(map[string]bool)
+	ports := make(map[string]bool)
+	for _, port := range svc.Spec.Ports {
+		key := fmt.Sprintf("%s/%d", port.Protocol, port.Port)
+		if port.Port < 1 || ports[key] || names[port.Name] {
+			return false
+		}
+		if port.Name != "" && len(validation.IsValidPortName(port.Name)) > 0 {
+			return false
+		}
+		if port.Name == "" && len(svc.Spec.Ports) > 1 {
+			return false
+		}
+		ports[key], names[port.Name] = true, true
+	}
+	return true
+}
+
+func TestGenerateClientConfigRandomRemotePorts(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "game",
+			Namespace:   "default",
+			Annotations: map[string]string{AnnotationRandomRemotePorts: "true"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+				{Name: "voice", Port: 9987, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	config := mustParseClientConfig(t, GenerateClientConfig(svc, "10.0.0.1", 7000))
+
+	if len(config.Proxies) != 2 {
+		t.Fatalf("expected 2 proxies, got %+v", config.Proxies)
+	}
+	for i, want := range []int{25565, 9987} {
+		proxy := config.Proxies[i]
+		if proxy.RemotePort != 0 {
+			t.Errorf("expected proxy %s to use remotePort = 0, got %d", proxy.Name, proxy.RemotePort)
+		}
+		if proxy.LocalPort != want {
+			t.Errorf("expected proxy %s to keep Service port %d, got %d", proxy.Name, want, proxy.LocalPort)
+		}
+	}
+	if config.WebServer == nil || config.WebServer.Port != DefaultAdminPort {
+		t.Fatalf("expected frpc admin API to be enabled, got %+v", config.WebServer)
+	}
+	if config.WebServer.Addr != "127.0.0.1" {
+		t.Errorf("expected an admin API without password to only listen on localhost, got %q", config.WebServer.Addr)
+	}
+
+	config = mustParseClientConfig(t, GenerateClientConfigWithOptions(svc, ClientOptions{
+		ServerAddr: "10.0.0.1", ServerPort: 7000, AdminPassword: "s3cret",
+	}))
+	if ws := config.WebServer; ws == nil || ws.Addr != "0.0.0.0" || ws.User != AdminUser || ws.Password != "s3cret" {
+		t.Errorf("expected the admin API to require the admin password, got %+v", config.WebServer)
+	}
+
+	// Assigned ports are pinned; the others are still left to frps.
+	config = mustParseClientConfig(t, GenerateClientConfigWithOptions(svc, ClientOptions{
+		ServerAddr: "10.0.0.1", ServerPort: 7000, AssignedRemotePorts: map[string]int{"25565/tcp": 31234},
+	}))
+	if got := config.Proxies[0].RemotePort; got != 31234 {
+		t.Errorf("expected the assigned port to be pinned, got %d", got)
+	}
+	if got := config.Proxies[1].RemotePort; got != 0 {
+		t.Errorf("expected an unassigned port to be left to frps, got %d", got)
 	}
 }
 
 func TestGenerateServerConfig(t *testing.T) {
 	config := GenerateServerConfig(7000)
-	expected := "bindPort = 7000\n"
+	expected := "bindPort = 7000\n\n[log]\nto = \"console\"\nlevel = \"info\"\nmaxDays = 3\n"
 	if config != expected {
 		t.Errorf("unexpected server config: got %q, want %q", config, expected)
 	}
 }
 
+func TestGenerateServerConfig_Dashboard(t *testing.T) {
+	config := mustParseServerConfig(t, GenerateServerConfigWithOptions(ServerOptions{
+		BindPort:  7000,
+		Dashboard: &Dashboard{User: "admin", Password: "pa\"ss"},
+	}))
+	expected := &ServerConfig{
+		BindPort:  7000,
+		Log:       defaultLog(),
+		WebServer: &WebServer{Addr: "0.0.0.0", Port: 7500, User: "admin", Password: "pa\"ss"},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("unexpected server config:\ngot:  %+v\nwant: %+v", config, expected)
+	}
+}
+
+func TestGenerateConfigs_Auth(t *testing.T) {
+	want := &AuthSettings{Method: "token", Token: "s3cret"}
+
+	server := mustParseServerConfig(t, GenerateServerConfigWithOptions(ServerOptions{BindPort: 7000, AuthToken: "s3cret"}))
+	if !reflect.DeepEqual(server.Auth, want) {
+		t.Errorf("expected frps to require %+v, got %+v", want, server.Auth)
+	}
+	client := mustParseClientConfig(t, GenerateClientConfigWithOptions(sampleService(), ClientOptions{ServerAddr: "10.0.0.1", ServerPort: 7000, AuthToken: "s3cret"}))
+	if !reflect.DeepEqual(client.Auth, want) {
+		t.Errorf("expected frpc to present %+v, got %+v", want, client.Auth)
+	}
+	group := mustParseClientConfig(t, GenerateGroupClientConfig([]GroupMember{{Service: sampleService(), RemotePorts: map[string]int{"80/tcp": 80}}},
+		"10.0.0.1", 7000, "s3cret", "", Heartbeat{}, ""))
+	if !reflect.DeepEqual(group.Auth, want) {
+		t.Errorf("expected the group frpc to present %+v, got %+v", want, group.Auth)
+	}
+
+	if server := mustParseServerConfig(t, GenerateServerConfig(7000)); server.Auth != nil {
+		t.Errorf("expected no auth settings without a token, got %+v", server.Auth)
+	}
+}
+
+var proxyNamePattern = regexp.MustCompile(`(?m)^name = "([^"]*)"$`)
+
+// proxyNames extracts all proxy names from a generated client config.
+func proxyNames(config string) []string {
+	var names []string
+	for _, m := range proxyNamePattern.FindAllStringSubmatch(config, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && searchString(s, substr)
 }
@@ -98,3 +489,35 @@ func searchString(s, substr string) bool {
 	}
 	return false
 }
+
+func TestGenerateClientConfigPoolCount(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "api",
+			Namespace:   "default",
+			Annotations: map[string]string{AnnotationPoolCount: "3"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+
+	config := mustParseClientConfig(t, GenerateClientConfig(svc, "10.0.0.1", 7000))
+	if config.Transport == nil || config.Transport.PoolCount != 3 {
+		t.Errorf("expected poolCount 3 in the common section, got %+v", config.Transport)
+	}
+
+	svc.Annotations[AnnotationPoolCount] = "0"
+	if config := mustParseClientConfig(t, GenerateClientConfig(svc, "10.0.0.1", 7000)); config.Transport.PoolCount != 0 {
+		t.Errorf("expected no poolCount for 0, got %+v", config.Transport)
+	}
+}
+
+func TestValidatePoolCount(t *testing.T) {
+	for value, wantErr := range map[string]bool{"": false, "0": false, "5": false, "6": true, "-1": true, "many": true} {
+		svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationPoolCount: value}}}
+		if err := ValidatePoolCount(svc); (err != nil) != wantErr {
+			t.Errorf("ValidatePoolCount(%q) error = %v, wantErr %v", value, err, wantErr)
+		}
+	}
+}
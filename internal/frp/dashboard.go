@@ -0,0 +1,23 @@
+package frp
+
+import corev1 "k8s.io/api/core/v1"
+
+const (
+	// AnnotationFrpsDashboard enables the frps dashboard (webServer) on the
+	// tunnel's public IP, behind generated basic auth credentials.
+	AnnotationFrpsDashboard = "fly-tunnel-operator.dev/frps-dashboard"
+
+	// DefaultDashboardPort is the frps dashboard port.
+	DefaultDashboardPort = 7500
+)
+
+// Dashboard holds the basic auth credentials of the frps dashboard.
+type Dashboard struct {
+	User     string
+	Password string
+}
+
+// DashboardEnabled reports whether the Service asked for the frps dashboard.
+func DashboardEnabled(svc *corev1.Service) bool {
+	return svc.Annotations[AnnotationFrpsDashboard] == "true"
+}
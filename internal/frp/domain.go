@@ -0,0 +1,59 @@
+package frp
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// DefaultClusterDomain is the cluster DNS domain of most clusters.
+	DefaultClusterDomain = "cluster.local"
+
+	// AnnotationClusterDomain overrides the cluster DNS domain frpc
+	// resolves the Service under, for a Service reached through another
+	// domain than the rest of the cluster.
+	AnnotationClusterDomain = "fly-tunnel-operator.dev/cluster-domain"
+)
+
+// LocalAddress returns the DNS name frpc forwards the proxies of svc to:
+// <service>.<namespace>.svc.<domain>, where domain is AnnotationClusterDomain
+// if set and valid, else clusterDomain, else DefaultClusterDomain.
+func LocalAddress(svc *corev1.Service, clusterDomain string) string {
+	if domain, err := parseClusterDomain(svc); err == nil && domain != "" {
+		clusterDomain = domain
+	}
+	if clusterDomain == "" {
+		clusterDomain = DefaultClusterDomain
+	}
+	return fmt.Sprintf("%s.%s.svc.%s", svc.Name, svc.Namespace, strings.TrimSuffix(clusterDomain, "."))
+}
+
+// ValidateClusterDomain returns an error if domain is not a DNS name.
+func ValidateClusterDomain(domain string) error {
+	domain = strings.TrimSuffix(domain, ".")
+	if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+		return fmt.Errorf("invalid cluster domain %q: %s", domain, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ValidateClusterDomainAnnotation returns an error if AnnotationClusterDomain
+// is set to something other than a DNS name.
+func ValidateClusterDomainAnnotation(svc *corev1.Service) error {
+	_, err := parseClusterDomain(svc)
+	return err
+}
+
+func parseClusterDomain(svc *corev1.Service) (string, error) {
+	value, ok := svc.Annotations[AnnotationClusterDomain]
+	if !ok {
+		return "", nil
+	}
+	if err := ValidateClusterDomain(value); err != nil {
+		return "", fmt.Errorf("invalid %s: %w", AnnotationClusterDomain, err)
+	}
+	return value, nil
+}
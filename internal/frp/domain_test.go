@@ -0,0 +1,62 @@
+package frp
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGenerateClientConfigClusterDomain(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "apps", Annotations: map[string]string{}},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		domain     string
+		annotation string
+		want       string
+	}{
+		{name: "default", want: "web.apps.svc.cluster.local"},
+		{name: "configured", domain: "corp.example", want: "web.apps.svc.corp.example"},
+		{name: "trailing dot", domain: "corp.example.", want: "web.apps.svc.corp.example"},
+		{name: "annotation", domain: "corp.example", annotation: "edge.example", want: "web.apps.svc.edge.example"},
+		{name: "invalid annotation", domain: "corp.example", annotation: "not a domain", want: "web.apps.svc.corp.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := svc.DeepCopy()
+			if tt.annotation != "" {
+				svc.Annotations[AnnotationClusterDomain] = tt.annotation
+			}
+			config := GenerateClientConfigWithOptions(svc, ClientOptions{ServerAddr: "10.0.0.1", ServerPort: 7000, ClusterDomain: tt.domain})
+			if got := mustParseClientConfig(t, config).Proxies[0].LocalIP; got != tt.want {
+				t.Errorf("expected localIP %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateClusterDomain(t *testing.T) {
+	for domain, wantErr := range map[string]bool{
+		"cluster.local":  false,
+		"cluster.local.": false,
+		"corp":           false,
+		"":               true,
+		"Cluster.Local":  true,
+		"bad_domain":     true,
+	} {
+		if err := ValidateClusterDomain(domain); (err != nil) != wantErr {
+			t.Errorf("ValidateClusterDomain(%q) = %v, wantErr %v", domain, err, wantErr)
+		}
+	}
+
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationClusterDomain: ""}}}
+	if err := ValidateClusterDomainAnnotation(svc); err == nil {
+		t.Error("expected an empty annotation to be rejected")
+	}
+}
@@ -0,0 +1,120 @@
+package frp
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationHealthCheck makes frpc health check the backend of every TCP
+	// proxy of the Service, so frps stops routing to it while it is down:
+	// "tcp" dials the backend, "http" expects a 2xx response. Unset (the
+	// default) or "none" disables health checks. UDP proxies are never
+	// checked.
+	AnnotationHealthCheck = "fly-tunnel-operator.dev/health-check"
+
+	// AnnotationHealthCheckPath is the path of an "http" health check,
+	// "/" by default.
+	AnnotationHealthCheckPath = "fly-tunnel-operator.dev/health-check-path"
+
+	// AnnotationHealthCheckInterval is how often the backend is checked, as
+	// a duration of whole seconds such as "5s"; frp checks every 10s by
+	// default.
+	AnnotationHealthCheckInterval = "fly-tunnel-operator.dev/health-check-interval"
+
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+	HealthCheckNone = "none"
+)
+
+// healthCheckAnnotations are the health check options, all of which can be
+// overridden per port.
+var healthCheckAnnotations = []string{AnnotationHealthCheck, AnnotationHealthCheckPath, AnnotationHealthCheckInterval}
+
+// HealthCheckFor returns the health check of the proxies of port, or nil if
+// they are not checked. A per-port annotation takes precedence over the
+// Service-wide one. Invalid values are treated as unset; see
+// ValidateHealthCheck.
+func HealthCheckFor(svc *corev1.Service, port corev1.ServicePort) *HealthCheckConfig {
+	check, err := parseHealthCheck(svc, port)
+	if err != nil {
+		return nil
+	}
+	return check
+}
+
+// ValidateHealthCheck returns an error naming the offending annotation if a
+// health check annotation is malformed, or a per-port one names no port of
+// the Service or a UDP port.
+func ValidateHealthCheck(svc *corev1.Service) error {
+	for _, key := range portAnnotationKeys(svc) {
+		portName, option, _ := splitPortAnnotation(key)
+		if !slices.Contains(healthCheckAnnotations, "fly-tunnel-operator.dev/"+option) {
+			continue
+		}
+		i := slices.IndexFunc(svc.Spec.Ports, func(p corev1.ServicePort) bool { return p.Name == portName })
+		if i < 0 {
+			return fmt.Errorf("invalid %s: the Service has no port named %q", key, portName)
+		}
+		if svc.Spec.Ports[i].Protocol == corev1.ProtocolUDP {
+			return fmt.Errorf("invalid %s: frp cannot health check the UDP port %q", key, portName)
+		}
+	}
+	if _, err := parseHealthCheck(svc, corev1.ServicePort{}); err != nil {
+		return err
+	}
+	for _, port := range svc.Spec.Ports {
+		if _, err := parseHealthCheck(svc, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseHealthCheck returns the health check of the proxies of port.
+func parseHealthCheck(svc *corev1.Service, port corev1.ServicePort) (*HealthCheckConfig, error) {
+	checkType, key := healthCheckOption(svc, port, AnnotationHealthCheck)
+	switch checkType {
+	case "", HealthCheckNone:
+		return nil, nil
+	case HealthCheckTCP, HealthCheckHTTP:
+	default:
+		return nil, fmt.Errorf("invalid %s %q: must be %q, %q or %q", key, checkType, HealthCheckTCP, HealthCheckHTTP, HealthCheckNone)
+	}
+	check := &HealthCheckConfig{Type: checkType}
+
+	if checkType == HealthCheckHTTP {
+		check.Path = "/"
+		if path, key := healthCheckOption(svc, port, AnnotationHealthCheckPath); path != "" {
+			if !strings.HasPrefix(path, "/") {
+				return nil, fmt.Errorf("invalid %s %q: must start with \"/\"", key, path)
+			}
+			check.Path = path
+		}
+	}
+
+	if interval, key := healthCheckOption(svc, port, AnnotationHealthCheckInterval); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < time.Second || d%time.Second != 0 {
+			return nil, fmt.Errorf("invalid %s %q: must be a whole number of seconds such as \"5s\" or \"1m\"", key, interval)
+		}
+		check.IntervalSeconds = int(d / time.Second)
+	}
+	return check, nil
+}
+
+// healthCheckOption returns the value of a health check option for port and
+// the annotation it comes from.
+func healthCheckOption(svc *corev1.Service, port corev1.ServicePort, annotation string) (string, string) {
+	if port.Name != "" {
+		key := PortAnnotation(port.Name, annotation)
+		if value, ok := svc.Annotations[key]; ok {
+			return value, key
+		}
+	}
+	return svc.Annotations[annotation], annotation
+}
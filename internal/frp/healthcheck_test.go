@@ -0,0 +1,160 @@
+package frp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGenerateClientConfigHealthCheck(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "admin", Port: 9000, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	tcp := &HealthCheckConfig{Type: HealthCheckTCP}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]*HealthCheckConfig // proxy name -> expected health check
+	}{
+		{
+			name: "off by default",
+			want: map[string]*HealthCheckConfig{"web-http": nil, "web-admin": nil, "web-dns": nil},
+		},
+		{
+			name:        "service-wide tcp",
+			annotations: map[string]string{AnnotationHealthCheck: "tcp"},
+			want:        map[string]*HealthCheckConfig{"web-http": tcp, "web-admin": tcp, "web-dns": nil},
+		},
+		{
+			name: "service-wide http with interval",
+			annotations: map[string]string{
+				AnnotationHealthCheck:         "http",
+				AnnotationHealthCheckInterval: "30s",
+			},
+			want: map[string]*HealthCheckConfig{
+				"web-http":  {Type: HealthCheckHTTP, Path: "/", IntervalSeconds: 30},
+				"web-admin": {Type: HealthCheckHTTP, Path: "/", IntervalSeconds: 30},
+			},
+		},
+		{
+			name: "per-port overrides win",
+			annotations: map[string]string{
+				AnnotationHealthCheck:                                 "tcp",
+				AnnotationHealthCheckInterval:                         "5s",
+				PortAnnotation("http", AnnotationHealthCheck):         "http",
+				PortAnnotation("http", AnnotationHealthCheckPath):     "/healthz",
+				PortAnnotation("http", AnnotationHealthCheckInterval): "1m",
+				PortAnnotation("admin", AnnotationHealthCheck):        "none",
+			},
+			want: map[string]*HealthCheckConfig{
+				"web-http":  {Type: HealthCheckHTTP, Path: "/healthz", IntervalSeconds: 60},
+				"web-admin": nil,
+				"web-dns":   nil,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := mustParseClientConfig(t, GenerateClientConfig(testService(tt.annotations, ports...), "1.2.3.4", 7000))
+			for name, want := range tt.want {
+				proxy := config.ProxyByName(name)
+				if proxy == nil {
+					t.Fatalf("no proxy %s in %+v", name, config.Proxies)
+				}
+				if !reflect.DeepEqual(proxy.HealthCheck, want) {
+					t.Errorf("proxy %s: expected health check %+v, got %+v", name, want, proxy.HealthCheck)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateClientConfigHealthCheckTOML(t *testing.T) {
+	svc := testService(map[string]string{
+		AnnotationHealthCheck:         "http",
+		AnnotationHealthCheckPath:     "/ready",
+		AnnotationHealthCheckInterval: "15s",
+	}, corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+
+	config := GenerateClientConfig(svc, "1.2.3.4", 7000)
+	want := "[proxies.healthCheck]\ntype = \"http\"\nintervalSeconds = 15\npath = \"/ready\"\n"
+	if !strings.Contains(config, want) {
+		t.Errorf("expected config to contain\n%s\ngot:\n%s", want, config)
+	}
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "admin", Port: 9000, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErr     string
+	}{
+		{name: "unset"},
+		{name: "valid", annotations: map[string]string{
+			AnnotationHealthCheck:                             "tcp",
+			AnnotationHealthCheckInterval:                     "2m",
+			PortAnnotation("http", AnnotationHealthCheck):     "http",
+			PortAnnotation("http", AnnotationHealthCheckPath): "/healthz",
+		}},
+		{
+			name:        "unknown type",
+			annotations: map[string]string{AnnotationHealthCheck: "grpc"},
+			wantErr:     `invalid ` + AnnotationHealthCheck + ` "grpc"`,
+		},
+		{
+			name:        "invalid per-port type",
+			annotations: map[string]string{PortAnnotation("admin", AnnotationHealthCheck): "udp"},
+			wantErr:     PortAnnotation("admin", AnnotationHealthCheck),
+		},
+		{
+			name:        "relative path",
+			annotations: map[string]string{AnnotationHealthCheck: "http", AnnotationHealthCheckPath: "healthz"},
+			wantErr:     `must start with "/"`,
+		},
+		{
+			name:        "sub-second interval",
+			annotations: map[string]string{AnnotationHealthCheck: "tcp", AnnotationHealthCheckInterval: "500ms"},
+			wantErr:     "whole number of seconds",
+		},
+		{
+			name:        "interval not a duration",
+			annotations: map[string]string{AnnotationHealthCheck: "tcp", AnnotationHealthCheckInterval: "10"},
+			wantErr:     AnnotationHealthCheckInterval,
+		},
+		{
+			name:        "unknown port",
+			annotations: map[string]string{PortAnnotation("https", AnnotationHealthCheck): "tcp"},
+			wantErr:     `no port named "https"`,
+		},
+		{
+			name:        "udp port",
+			annotations: map[string]string{PortAnnotation("dns", AnnotationHealthCheck): "tcp"},
+			wantErr:     `UDP port "dns"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateHealthCheck(testService(tt.annotations, ports...))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error mentioning %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
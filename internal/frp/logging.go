@@ -0,0 +1,87 @@
+package frp
+
+import (
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationFrpsLogLevel and AnnotationFrpcLogLevel override the log
+	// level of the frps and frpc of a Service's tunnel, e.g. "debug" while
+	// diagnosing it.
+	AnnotationFrpsLogLevel = "fly-tunnel-operator.dev/frps-log-level"
+	AnnotationFrpcLogLevel = "fly-tunnel-operator.dev/frpc-log-level"
+
+	// DefaultLogLevel is the log level of frps and frpc unless configured.
+	DefaultLogLevel = "info"
+
+	// DefaultLogMaxDays is how many days of logs frp keeps. It only matters
+	// for logs written to a file, so it is set for completeness: the
+	// operator always logs to the console.
+	DefaultLogMaxDays = 3
+)
+
+// logLevels are the levels frp accepts, most verbose first.
+var logLevels = []string{"trace", "debug", "info", "warn", "error"}
+
+// LogConfig is the log table shared by frpc and frps.
+type LogConfig struct {
+	// To is "console" to log to stdout, which `fly logs` and `kubectl
+	// logs` show.
+	To      string `toml:"to"`
+	Level   string `toml:"level"`
+	MaxDays int    `toml:"maxDays,omitzero"`
+}
+
+// consoleLog returns the log table logging at level to stdout; an empty
+// level means DefaultLogLevel.
+func consoleLog(level string) *LogConfig {
+	if level == "" {
+		level = DefaultLogLevel
+	}
+	return &LogConfig{To: "console", Level: level, MaxDays: DefaultLogMaxDays}
+}
+
+// ValidateLogLevel returns an error if level is not a level frp accepts.
+// An empty level means DefaultLogLevel.
+func ValidateLogLevel(level string) error {
+	if level != "" && !slices.Contains(logLevels, level) {
+		return fmt.Errorf("invalid log level %q: must be one of %v", level, logLevels)
+	}
+	return nil
+}
+
+// FrpsLogLevelFor returns the frps log level of the tunnel of svc:
+// AnnotationFrpsLogLevel if set and valid, fallback otherwise.
+func FrpsLogLevelFor(svc *corev1.Service, fallback string) string {
+	return logLevelFor(svc, AnnotationFrpsLogLevel, fallback)
+}
+
+// FrpcLogLevelFor returns the frpc log level of the tunnel of svc:
+// AnnotationFrpcLogLevel if set and valid, fallback otherwise.
+func FrpcLogLevelFor(svc *corev1.Service, fallback string) string {
+	return logLevelFor(svc, AnnotationFrpcLogLevel, fallback)
+}
+
+func logLevelFor(svc *corev1.Service, annotation, fallback string) string {
+	level, ok := svc.Annotations[annotation]
+	if !ok || level == "" || ValidateLogLevel(level) != nil {
+		return fallback
+	}
+	return level
+}
+
+// ValidateLogLevels returns an error if AnnotationFrpsLogLevel or
+// AnnotationFrpcLogLevel is not a level frp accepts.
+func ValidateLogLevels(svc *corev1.Service) error {
+	for _, annotation := range []string{AnnotationFrpsLogLevel, AnnotationFrpcLogLevel} {
+		if level, ok := svc.Annotations[annotation]; ok {
+			if level == "" || !slices.Contains(logLevels, level) {
+				return fmt.Errorf("invalid %s %q: must be one of %v", annotation, level, logLevels)
+			}
+		}
+	}
+	return nil
+}
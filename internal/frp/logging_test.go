@@ -0,0 +1,81 @@
+package frp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// defaultLog is the log table of a config generated without a log level.
+func defaultLog() *LogConfig {
+	return &LogConfig{To: "console", Level: "info", MaxDays: 3}
+}
+
+func TestGenerateConfig_LogLevel(t *testing.T) {
+	svc := testService(nil, corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+
+	server := mustParseServerConfig(t, GenerateServerConfigWithOptions(ServerOptions{BindPort: 7000, LogLevel: "debug"}))
+	want := &LogConfig{To: "console", Level: "debug", MaxDays: DefaultLogMaxDays}
+	if !reflect.DeepEqual(server.Log, want) {
+		t.Errorf("expected frps log %+v, got %+v", want, server.Log)
+	}
+
+	client := mustParseClientConfig(t, GenerateClientConfigWithOptions(svc, ClientOptions{ServerAddr: "1.2.3.4", ServerPort: 7000, LogLevel: "warn"}))
+	want = &LogConfig{To: "console", Level: "warn", MaxDays: DefaultLogMaxDays}
+	if !reflect.DeepEqual(client.Log, want) {
+		t.Errorf("expected frpc log %+v, got %+v", want, client.Log)
+	}
+
+	group := mustParseClientConfig(t, GenerateGroupClientConfig([]GroupMember{{Service: svc, RemotePorts: map[string]int{"80/tcp": 80}}},
+		"1.2.3.4", 7000, "", "", Heartbeat{}, "trace"))
+	if group.Log == nil || group.Log.Level != "trace" || group.Log.To != "console" {
+		t.Errorf("expected the group frpc to log to the console at trace, got %+v", group.Log)
+	}
+}
+
+func TestLogLevelFor(t *testing.T) {
+	svc := testService(map[string]string{AnnotationFrpsLogLevel: "debug", AnnotationFrpcLogLevel: "loud"})
+	if got := FrpsLogLevelFor(svc, "info"); got != "debug" {
+		t.Errorf("expected the annotation to override the frps level, got %q", got)
+	}
+	if got := FrpcLogLevelFor(svc, "warn"); got != "warn" {
+		t.Errorf("expected an invalid annotation to fall back, got %q", got)
+	}
+	if got := FrpsLogLevelFor(testService(nil), "error"); got != "error" {
+		t.Errorf("expected the fallback without an annotation, got %q", got)
+	}
+}
+
+func TestValidateLogLevels(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		wantErr     string
+	}{
+		{annotations: nil},
+		{annotations: map[string]string{AnnotationFrpsLogLevel: "trace", AnnotationFrpcLogLevel: "error"}},
+		{annotations: map[string]string{AnnotationFrpsLogLevel: "verbose"}, wantErr: AnnotationFrpsLogLevel},
+		{annotations: map[string]string{AnnotationFrpcLogLevel: ""}, wantErr: AnnotationFrpcLogLevel},
+		{annotations: map[string]string{AnnotationFrpcLogLevel: "INFO"}, wantErr: AnnotationFrpcLogLevel},
+	}
+	for _, tt := range tests {
+		err := ValidateLogLevels(testService(tt.annotations))
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("ValidateLogLevels(%v) = %v, want nil", tt.annotations, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ValidateLogLevels(%v) = %v, want an error naming %s", tt.annotations, err, tt.wantErr)
+		}
+	}
+
+	if err := ValidateLogLevel("debug"); err != nil {
+		t.Errorf("ValidateLogLevel(debug) = %v", err)
+	}
+	if err := ValidateLogLevel("noisy"); err == nil {
+		t.Error("expected ValidateLogLevel to reject an unknown level")
+	}
+}
@@ -0,0 +1,68 @@
+package frp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// maxProxyNameLen bounds generated proxy names. Some frps versions truncate
+// or reject long names, so we stay within the same 63-character limit used
+// for Kubernetes label values.
+const maxProxyNameLen = 63
+
+// proxyNamer hands out sanitized, length-bounded proxy names that are unique
+// within a single generated config.
+type proxyNamer struct {
+	used map[string]bool
+}
+
+func newProxyNamer() *proxyNamer {
+	return &proxyNamer{used: make(map[string]bool)}
+}
+
+// name returns a unique proxy name derived from base. When the sanitized name
+// was already handed out, a counter is mixed in before sanitizing again so the
+// hash suffix (or plain suffix for short names) differs.
+func (n *proxyNamer) name(base string) string {
+	name := sanitizeProxyName(base)
+	for i := 2; n.used[name]; i++ {
+		name = sanitizeProxyName(fmt.Sprintf("%s-%d", base, i))
+	}
+	n.used[name] = true
+	return name
+}
+
+// sanitizeProxyName lowercases name, replaces anything other than
+// alphanumerics and dashes, and truncates it to maxProxyNameLen with a short
+// hash suffix to preserve uniqueness. It mirrors tunnel.sanitizeName.
+func sanitizeProxyName(name string) string {
+	name = strings.ToLower(name)
+
+	var b strings.Builder
+	for _, c := range name {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	sanitized := b.String()
+
+	// Collapse consecutive dashes and trim leading/trailing dashes.
+	for strings.Contains(sanitized, "--") {
+		sanitized = strings.ReplaceAll(sanitized, "--", "-")
+	}
+	sanitized = strings.Trim(sanitized, "-")
+
+	if len(sanitized) <= maxProxyNameLen {
+		return sanitized
+	}
+
+	hash := sha256.Sum256([]byte(name))
+	suffix := hex.EncodeToString(hash[:6]) // 12 hex chars
+	truncated := sanitized[:maxProxyNameLen-len(suffix)-1]
+	truncated = strings.TrimRight(truncated, "-")
+	return truncated + "-" + suffix
+}
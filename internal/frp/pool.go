@@ -0,0 +1,47 @@
+package frp
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationPoolCount sets how many work connections frpc opens to frps
+	// ahead of time, so first connections skip the frps-to-frpc dial.
+	AnnotationPoolCount = "fly-tunnel-operator.dev/pool-count"
+
+	// MaxPoolCount is frps' default transport.maxPoolCount; frps silently
+	// caps larger client pool counts to it.
+	MaxPoolCount = 5
+)
+
+// PoolCount returns the connection pool size requested by the Service, or 0
+// if none (or an invalid one) was requested; see ValidatePoolCount.
+func PoolCount(svc *corev1.Service) int {
+	n, err := parsePoolCount(svc)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// ValidatePoolCount returns an error if AnnotationPoolCount is not an
+// integer between 0 and MaxPoolCount.
+func ValidatePoolCount(svc *corev1.Service) error {
+	_, err := parsePoolCount(svc)
+	return err
+}
+
+func parsePoolCount(svc *corev1.Service) (int, error) {
+	value := svc.Annotations[AnnotationPoolCount]
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > MaxPoolCount {
+		return 0, fmt.Errorf("invalid %s %q: must be an integer between 0 and %d", AnnotationPoolCount, value, MaxPoolCount)
+	}
+	return n, nil
+}
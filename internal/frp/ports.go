@@ -0,0 +1,159 @@
+package frp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AnnotationDualStackPorts lists Service port numbers (comma-separated) that
+// are tunneled over both TCP and UDP from a single ServicePort declaration.
+const AnnotationDualStackPorts = "fly-tunnel-operator.dev/dual-stack-ports"
+
+// ProxyPort is a single frp proxy derived from a Service port.
+type ProxyPort struct {
+	// Name is the unique proxy name in the generated frpc config.
+	Name string
+	// Protocol is the frp proxy type: "tcp" or "udp".
+	Protocol string
+	// Port is the Service port the proxy forwards to.
+	Port corev1.ServicePort
+}
+
+// Key identifies the proxy by port number and protocol, e.g. "53/udp".
+func (p ProxyPort) Key() string {
+	return fmt.Sprintf("%d/%s", p.Port.Port, p.Protocol)
+}
+
+// ProxyPorts returns every proxy generated for the Service: one per
+// ServicePort, followed by the extra-protocol proxy for each port listed in
+// AnnotationDualStackPorts. Dual-stack entries that are invalid or already
+// declared on the Service are skipped; see ValidateDualStackPorts. Ports
+// listed in AnnotationClusterOnlyPorts or returned by UnsupportedPorts get
+// no proxy at all.
+//
+// Proxy names are unique and depend only on the Service: a named port gives
+// <service>-<port name>, an unnamed one <service>-<protocol>-<number>, and a
+// port number declared over both TCP and UDP has the protocol appended to
+// its names. Names still colliding after that get a numeric suffix.
+func ProxyPorts(svc *corev1.Service) []ProxyPort {
+	namer := newProxyNamer()
+	var proxies []ProxyPort
+	declared := make(map[string]bool)
+	protocols := make(map[int32]map[string]bool)
+	for _, port := range svc.Spec.Ports {
+		if protocols[port.Port] == nil {
+			protocols[port.Port] = make(map[string]bool)
+		}
+		protocols[port.Port][protocolOf(port)] = true
+	}
+	for _, port := range svc.Spec.Ports {
+		if ClusterOnly(svc, port) || !Supported(port) {
+			continue
+		}
+		protocol := protocolOf(port)
+		base := fmt.Sprintf("%s-%s-%d", svc.Name, protocol, port.Port)
+		if port.Name != "" {
+			base = fmt.Sprintf("%s-%s", svc.Name, port.Name)
+			if len(protocols[port.Port]) > 1 && !strings.HasSuffix(base, "-"+protocol) {
+				base += "-" + protocol
+			}
+		}
+		p := ProxyPort{Name: namer.name(base), Protocol: protocol, Port: port}
+		declared[p.Key()] = true
+		proxies = append(proxies, p)
+	}
+
+	dualStack, _ := parseDualStackPorts(svc)
+	for _, port := range svc.Spec.Ports {
+		if !dualStack[port.Port] || ClusterOnly(svc, port) || !Supported(port) {
+			continue
+		}
+		other := "udp"
+		if protocolOf(port) == "udp" {
+			other = "tcp"
+		}
+		p := ProxyPort{Protocol: other, Port: port}
+		if declared[p.Key()] {
+			continue
+		}
+		declared[p.Key()] = true
+
+		base := fmt.Sprintf("%s-%s-%s", svc.Name, port.Name, other)
+		if port.Name == "" {
+			base = fmt.Sprintf("%s-%s-%d", svc.Name, other, port.Port)
+		}
+		p.Name = namer.name(base)
+		proxies = append(proxies, p)
+	}
+	return proxies
+}
+
+// ValidateDualStackPorts checks that every port listed in
+// AnnotationDualStackPorts is a number declared on the Service.
+func ValidateDualStackPorts(svc *corev1.Service) error {
+	_, err := parseDualStackPorts(svc)
+	return err
+}
+
+// parseDualStackPorts returns the valid dual-stack port numbers along with an
+// error describing any entries that were rejected.
+func parseDualStackPorts(svc *corev1.Service) (map[int32]bool, error) {
+	value := strings.TrimSpace(svc.Annotations[AnnotationDualStackPorts])
+	if value == "" {
+		return nil, nil
+	}
+
+	declared := make(map[int32]bool, len(svc.Spec.Ports))
+	for _, port := range svc.Spec.Ports {
+		declared[port.Port] = true
+	}
+
+	ports := make(map[int32]bool)
+	var invalid []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(entry, 10, 32)
+		if err != nil || !declared[int32(n)] {
+			invalid = append(invalid, entry)
+			continue
+		}
+		ports[int32(n)] = true
+	}
+	if len(invalid) > 0 {
+		return ports, fmt.Errorf("%s lists ports not declared on the Service: %s",
+			AnnotationDualStackPorts, strings.Join(invalid, ", "))
+	}
+	return ports, nil
+}
+
+// Supported reports whether frp can tunnel the protocol of port: TCP or UDP.
+func Supported(port corev1.ServicePort) bool {
+	protocol := protocolOf(port)
+	return protocol == "tcp" || protocol == "udp"
+}
+
+// UnsupportedPorts returns the ports of svc frp cannot tunnel, such as SCTP
+// ports, which are left out of the tunnel.
+func UnsupportedPorts(svc *corev1.Service) []corev1.ServicePort {
+	var unsupported []corev1.ServicePort
+	for _, port := range svc.Spec.Ports {
+		if !Supported(port) {
+			unsupported = append(unsupported, port)
+		}
+	}
+	return unsupported
+}
+
+func protocolOf(port corev1.ServicePort) string {
+	protocol := strings.ToLower(string(port.Protocol))
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	return protocol
+}
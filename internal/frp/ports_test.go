@@ -0,0 +1,209 @@
+package frp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGenerateClientConfigDualStackPorts(t *testing.T) {
+	svc := testService(map[string]string{AnnotationDualStackPorts: "25565"},
+		corev1.ServicePort{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "rcon", Port: 25575, Protocol: corev1.ProtocolTCP},
+	)
+
+	config := GenerateClientConfig(svc, "10.0.0.1", 7000)
+
+	names := proxyNames(config)
+	want := []string{"web-game", "web-rcon", "web-game-udp"}
+	if len(names) != len(want) {
+		t.Fatalf("expected proxies %v, got %v:\n%s", want, names, config)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("proxy %d: expected %q, got %q", i, want[i], names[i])
+		}
+	}
+	wantUDP := Proxy{Name: "web-game-udp", Type: "udp", LocalIP: "web.default.svc.cluster.local", LocalPort: 25565, RemotePort: 25565}
+	if proxy := mustParseClientConfig(t, config).ProxyByName(wantUDP.Name); proxy == nil || !reflect.DeepEqual(*proxy, wantUDP) {
+		t.Errorf("expected a udp proxy for 25565, got %+v", proxy)
+	}
+}
+
+func TestProxyPortsDualStackAlreadyDeclared(t *testing.T) {
+	// Both protocols already declared: no synthetic proxy is added.
+	svc := testService(map[string]string{AnnotationDualStackPorts: "53"},
+		corev1.ServicePort{Name: "dns-tcp", Port: 53, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "dns-udp", Port: 53, Protocol: corev1.ProtocolUDP},
+	)
+
+	proxies := ProxyPorts(svc)
+	if len(proxies) != 2 {
+		t.Fatalf("expected 2 proxies, got %+v", proxies)
+	}
+}
+
+func TestProxyPortsDualStackFromUDP(t *testing.T) {
+	svc := testService(map[string]string{AnnotationDualStackPorts: "9987"},
+		corev1.ServicePort{Port: 9987, Protocol: corev1.ProtocolUDP},
+	)
+
+	proxies := ProxyPorts(svc)
+	if len(proxies) != 2 {
+		t.Fatalf("expected 2 proxies, got %+v", proxies)
+	}
+	if proxies[1].Protocol != "tcp" || proxies[1].Key() != "9987/tcp" || proxies[1].Name != "web-tcp-9987" {
+		t.Errorf("unexpected synthetic proxy: %+v", proxies[1])
+	}
+}
+
+func TestProxyPortsNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []corev1.ServicePort
+		want  []string
+	}{
+		{
+			name: "unnamed ports",
+			ports: []corev1.ServicePort{
+				{Port: 25565, Protocol: corev1.ProtocolTCP},
+				{Port: 25565, Protocol: corev1.ProtocolUDP},
+				{Port: 25575},
+			},
+			want: []string{"web-tcp-25565", "web-udp-25565", "web-tcp-25575"},
+		},
+		{
+			name: "duplicate names",
+			ports: []corev1.ServicePort{
+				{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+				{Name: "GAME", Port: 25566, Protocol: corev1.ProtocolTCP},
+				{Name: "game.", Port: 25567, Protocol: corev1.ProtocolTCP},
+			},
+			want: []string{"web-game", "web-game-2", "web-game-3"},
+		},
+		{
+			name: "mixed protocols on one port number",
+			ports: []corev1.ServicePort{
+				{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+				{Name: "game-udp", Port: 25565, Protocol: corev1.ProtocolUDP},
+				{Name: "rcon", Port: 25575, Protocol: corev1.ProtocolTCP},
+			},
+			want: []string{"web-game-tcp", "web-game-udp", "web-rcon"},
+		},
+		{
+			name: "mixed protocols colliding with a port name",
+			ports: []corev1.ServicePort{
+				{Name: "game-tcp", Port: 25566, Protocol: corev1.ProtocolTCP},
+				{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+				{Name: "query", Port: 25565, Protocol: corev1.ProtocolUDP},
+			},
+			want: []string{"web-game-tcp", "web-game-tcp-2", "web-query-udp"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := testService(nil, tt.ports...)
+			config := GenerateClientConfig(svc, "10.0.0.1", 7000)
+
+			names := proxyNames(config)
+			if len(names) != len(tt.want) {
+				t.Fatalf("expected proxies %v, got %v:\n%s", tt.want, names, config)
+			}
+			for i := range tt.want {
+				if names[i] != tt.want[i] {
+					t.Errorf("proxy %d: expected %q, got %q", i, tt.want[i], names[i])
+				}
+			}
+			seen := make(map[string]bool)
+			for _, proxy := range mustParseClientConfig(t, config).Proxies {
+				if seen[proxy.Name] {
+					t.Errorf("duplicate proxy name %q:\n%s", proxy.Name, config)
+				}
+				seen[proxy.Name] = true
+			}
+			// Regenerating gives the same names.
+			if again := proxyNames(GenerateClientConfig(svc, "10.0.0.1", 7000)); strings.Join(again, ",") != strings.Join(names, ",") {
+				t.Errorf("expected stable names %v, got %v", names, again)
+			}
+		})
+	}
+}
+
+func TestValidateDualStackPorts(t *testing.T) {
+	tests := []struct {
+		annotation string
+		wantErr    bool
+	}{
+		{"", false},
+		{"25565", false},
+		{" 25565 , ", false},
+		{"25566", true},
+		{"25565,http", true},
+	}
+	for _, tt := range tests {
+		svc := testService(map[string]string{AnnotationDualStackPorts: tt.annotation},
+			corev1.ServicePort{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+		)
+		err := ValidateDualStackPorts(svc)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateDualStackPorts(%q) error = %v, wantErr %v", tt.annotation, err, tt.wantErr)
+		}
+	}
+}
+
+func TestProxyPortsClusterOnly(t *testing.T) {
+	svc := testService(map[string]string{AnnotationDualStackPorts: "25565"},
+		corev1.ServicePort{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "metrics", Port: 9090, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "health", Port: 8081, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[AnnotationClusterOnlyPorts] = "metrics, 8081"
+
+	var keys []string
+	for _, p := range ProxyPorts(svc) {
+		keys = append(keys, p.Key())
+	}
+	want := []string{"25565/tcp", "25565/udp"}
+	if len(keys) != len(want) || keys[0] != want[0] || keys[1] != want[1] {
+		t.Errorf("expected proxies %v, got %v", want, keys)
+	}
+
+	// Excluding a dual-stack port drops both protocols.
+	svc.Annotations[AnnotationClusterOnlyPorts] = "game"
+	for _, p := range ProxyPorts(svc) {
+		if p.Port.Port == 25565 {
+			t.Errorf("expected cluster-only port 25565 to get no proxy, got %s", p.Key())
+		}
+	}
+}
+
+func TestProxyPortsSkipsUnsupportedProtocols(t *testing.T) {
+	svc := testService(map[string]string{AnnotationDualStackPorts: "5060"},
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+		corev1.ServicePort{Name: "sip", Port: 5060, Protocol: corev1.ProtocolSCTP},
+	)
+
+	var keys []string
+	for _, p := range ProxyPorts(svc) {
+		keys = append(keys, p.Key())
+	}
+	if want := []string{"80/tcp", "53/udp"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("expected proxies %v, got %v", want, keys)
+	}
+	if unsupported := UnsupportedPorts(svc); len(unsupported) != 1 || unsupported[0].Name != "sip" {
+		t.Errorf("expected only sip to be unsupported, got %+v", unsupported)
+	}
+
+	config := mustParseClientConfig(t, GenerateClientConfig(svc, "10.0.0.1", 7000))
+	for _, p := range config.Proxies {
+		if p.Type != "tcp" && p.Type != "udp" {
+			t.Errorf("expected only tcp and udp proxies, got %s %q", p.Type, p.Name)
+		}
+	}
+	if len(config.Proxies) != 2 {
+		t.Errorf("expected 2 proxies, got %d", len(config.Proxies))
+	}
+}
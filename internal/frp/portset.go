@@ -0,0 +1,52 @@
+package frp
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PublishedPort is a proxy of a Service with where it is published. It is
+// the one description of a port that both the frpc config and the frps
+// Machine's services are built from, so that no annotation can open a port
+// on one side only.
+type PublishedPort struct {
+	ProxyPort
+	// Type is the frp proxy type: "tcp" or "udp", or "http" or "https" for
+	// a vhost proxy (see AnnotationProxyType).
+	Type string
+	// LocalPort is the Service port frpc forwards to.
+	LocalPort int
+	// RemotePort is the public port frps serves the proxy on: the frps
+	// vhost port of a vhost proxy, otherwise the Service port or its
+	// AnnotationRemotePort override. It is 0 when frps picks the port (see
+	// AnnotationRandomRemotePorts).
+	RemotePort int
+}
+
+// Vhost reports whether p is a vhost proxy, sharing its RemotePort with the
+// other vhost proxies of its Type.
+func (p PublishedPort) Vhost() bool {
+	return p.Type == ProxyTypeHTTP || p.Type == ProxyTypeHTTPS
+}
+
+// PublishedPorts returns every port svc publishes, one per proxy of
+// ProxyPorts, so after AnnotationDualStackPorts and
+// AnnotationClusterOnlyPorts have been applied.
+func PublishedPorts(svc *corev1.Service) []PublishedPort {
+	randomPorts := RandomRemotePorts(svc)
+	var ports []PublishedPort
+	for _, proxy := range ProxyPorts(svc) {
+		p := PublishedPort{
+			ProxyPort: proxy,
+			Type:      ProxyTypeFor(svc, proxy),
+			LocalPort: int(proxy.Port.Port),
+		}
+		switch {
+		case p.Vhost():
+			p.RemotePort = VhostPort(svc, proxy)
+		case !randomPorts:
+			p.RemotePort = RemotePortFor(svc, proxy)
+		}
+		ports = append(ports, p)
+	}
+	return ports
+}
@@ -0,0 +1,59 @@
+package frp
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPublishedPorts(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{
+			AnnotationDualStackPorts:                     "53",
+			AnnotationClusterOnlyPorts:                   "metrics",
+			AnnotationCustomDomains:                      "example.com",
+			PortAnnotation("http", AnnotationProxyType):  ProxyTypeHTTP,
+			PortAnnotation("game", AnnotationRemotePort): "25565",
+		}},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+			{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+			{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			{Name: "game", Port: 3000, Protocol: corev1.ProtocolTCP},
+			{Name: "metrics", Port: 9090, Protocol: corev1.ProtocolTCP},
+		}},
+	}
+
+	type published struct {
+		Key        string
+		Type       string
+		LocalPort  int
+		RemotePort int
+	}
+	var got []published
+	for _, p := range PublishedPorts(svc) {
+		got = append(got, published{p.Key(), p.Type, p.LocalPort, p.RemotePort})
+	}
+	want := []published{
+		{"8080/tcp", ProxyTypeHTTP, 8080, VhostHTTPPort},
+		{"53/udp", "udp", 53, 53},
+		{"3000/tcp", "tcp", 3000, 25565},
+		{"53/tcp", "tcp", 53, 53},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected published ports:\ngot:  %+v\nwant: %+v", got, want)
+	}
+
+	svc.Annotations[AnnotationRandomRemotePorts] = "true"
+	delete(svc.Annotations, PortAnnotation("game", AnnotationRemotePort))
+	for _, p := range PublishedPorts(svc) {
+		want := 0
+		if p.Vhost() {
+			want = VhostHTTPPort
+		}
+		if p.RemotePort != want {
+			t.Errorf("%s: expected remote port %d with random remote ports, got %d", p.Key(), want, p.RemotePort)
+		}
+	}
+}
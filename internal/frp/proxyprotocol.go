@@ -0,0 +1,84 @@
+package frp
+
+import (
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationProxyProtocol makes frpc prepend a PROXY protocol header to
+	// every TCP connection it opens to the backends of the Service, so they
+	// see the client address instead of the frpc pod's: "v1" or "v2". Unset
+	// (the default) or "none" sends no header. UDP proxies never get one.
+	//
+	// frps, not the Fly.io proxy, is the single source of the header. Fly's
+	// proxy_proto handler could prepend one too, but frp forwards it as
+	// payload, and the backend would receive two; the Machine services of a
+	// tunnel therefore never use handlers (see Manager.buildMachineInput).
+	AnnotationProxyProtocol = "fly-tunnel-operator.dev/proxy-protocol"
+
+	ProxyProtocolV1   = "v1"
+	ProxyProtocolV2   = "v2"
+	ProxyProtocolNone = "none"
+)
+
+// ProxyProtocolFor returns the PROXY protocol version frpc sends to the
+// backends of port, or "" for none. A per-port annotation takes precedence
+// over the Service-wide one. Invalid values are treated as unset; see
+// ValidateProxyProtocol.
+func ProxyProtocolFor(svc *corev1.Service, port corev1.ServicePort) string {
+	version, err := parseProxyProtocol(svc, port)
+	if err != nil {
+		return ""
+	}
+	return version
+}
+
+// ValidateProxyProtocol returns an error naming the offending annotation if
+// a PROXY protocol annotation is not a supported version, or a per-port one
+// names no port of the Service or a UDP port.
+func ValidateProxyProtocol(svc *corev1.Service) error {
+	for _, key := range portAnnotationKeys(svc) {
+		portName, option, _ := splitPortAnnotation(key)
+		if "fly-tunnel-operator.dev/"+option != AnnotationProxyProtocol {
+			continue
+		}
+		i := slices.IndexFunc(svc.Spec.Ports, func(p corev1.ServicePort) bool { return p.Name == portName })
+		if i < 0 {
+			return fmt.Errorf("invalid %s: the Service has no port named %q", key, portName)
+		}
+		if svc.Spec.Ports[i].Protocol == corev1.ProtocolUDP {
+			return fmt.Errorf("invalid %s: frp sends no PROXY protocol header on the UDP port %q", key, portName)
+		}
+	}
+	if _, err := parseProxyProtocol(svc, corev1.ServicePort{}); err != nil {
+		return err
+	}
+	for _, port := range svc.Spec.Ports {
+		if _, err := parseProxyProtocol(svc, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseProxyProtocol returns the PROXY protocol version of the proxies of
+// port.
+func parseProxyProtocol(svc *corev1.Service, port corev1.ServicePort) (string, error) {
+	key := AnnotationProxyProtocol
+	if port.Name != "" {
+		if _, ok := svc.Annotations[PortAnnotation(port.Name, key)]; ok {
+			key = PortAnnotation(port.Name, key)
+		}
+	}
+	switch version := svc.Annotations[key]; version {
+	case "", ProxyProtocolNone:
+		return "", nil
+	case ProxyProtocolV1, ProxyProtocolV2:
+		return version, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q: must be %q, %q or %q", key, version, ProxyProtocolV1, ProxyProtocolV2, ProxyProtocolNone)
+	}
+}
@@ -0,0 +1,123 @@
+package frp
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGenerateClientConfigProxyProtocol(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "admin", Port: 9000, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string // proxy name -> expected version
+	}{
+		{
+			name: "off by default",
+			want: map[string]string{"web-http": "", "web-admin": "", "web-dns": ""},
+		},
+		{
+			name:        "service-wide",
+			annotations: map[string]string{AnnotationProxyProtocol: "v2"},
+			want:        map[string]string{"web-http": "v2", "web-admin": "v2", "web-dns": ""},
+		},
+		{
+			name: "per-port overrides win",
+			annotations: map[string]string{
+				AnnotationProxyProtocol:                          "v2",
+				PortAnnotation("http", AnnotationProxyProtocol):  "v1",
+				PortAnnotation("admin", AnnotationProxyProtocol): "none",
+			},
+			want: map[string]string{"web-http": "v1", "web-admin": "", "web-dns": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := mustParseClientConfig(t, GenerateClientConfig(testService(tt.annotations, ports...), "1.2.3.4", 7000))
+			for name, want := range tt.want {
+				proxy := config.ProxyByName(name)
+				if proxy == nil {
+					t.Fatalf("no proxy %s in %+v", name, config.Proxies)
+				}
+				var got string
+				if proxy.Transport != nil {
+					got = proxy.Transport.ProxyProtocolVersion
+				}
+				if got != want {
+					t.Errorf("proxy %s: expected PROXY protocol %q, got %q", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateClientConfigProxyProtocolTOML(t *testing.T) {
+	svc := testService(map[string]string{AnnotationProxyProtocol: "v2"}, corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+
+	config := GenerateClientConfig(svc, "1.2.3.4", 7000)
+	want := "[proxies.transport]\nproxyProtocolVersion = \"v2\"\n"
+	if !strings.Contains(config, want) {
+		t.Errorf("expected config to contain\n%s\ngot:\n%s", want, config)
+	}
+}
+
+func TestValidateProxyProtocol(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "admin", Port: 9000, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErr     string
+	}{
+		{name: "unset"},
+		{name: "valid", annotations: map[string]string{
+			AnnotationProxyProtocol:                         "v1",
+			PortAnnotation("http", AnnotationProxyProtocol): "v2",
+		}},
+		{
+			name:        "unknown version",
+			annotations: map[string]string{AnnotationProxyProtocol: "2"},
+			wantErr:     `invalid ` + AnnotationProxyProtocol + ` "2"`,
+		},
+		{
+			name:        "invalid per-port version",
+			annotations: map[string]string{PortAnnotation("admin", AnnotationProxyProtocol): "v3"},
+			wantErr:     PortAnnotation("admin", AnnotationProxyProtocol),
+		},
+		{
+			name:        "unknown port",
+			annotations: map[string]string{PortAnnotation("https", AnnotationProxyProtocol): "v2"},
+			wantErr:     `no port named "https"`,
+		},
+		{
+			name:        "udp port",
+			annotations: map[string]string{PortAnnotation("dns", AnnotationProxyProtocol): "v2"},
+			wantErr:     `UDP port "dns"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateProxyProtocol(testService(tt.annotations, ports...))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error mentioning %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package frp
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultDialServerTimeout is how long frpc waits for a connection to
+	// frps before retrying.
+	DefaultDialServerTimeout = 10 * time.Second
+
+	// DefaultHeartbeatInterval and DefaultHeartbeatTimeout are how often
+	// frpc sends frps a heartbeat, and how long it goes without an answer
+	// before dropping the connection and reconnecting.
+	DefaultHeartbeatInterval = 10 * time.Second
+	DefaultHeartbeatTimeout  = 30 * time.Second
+)
+
+// Heartbeat is how frpc detects a dead connection to frps. Zero fields
+// mean the defaults above.
+type Heartbeat struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// withDefaults returns h with its zero fields set to the defaults.
+func (h Heartbeat) withDefaults() Heartbeat {
+	if h.Interval == 0 {
+		h.Interval = DefaultHeartbeatInterval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = DefaultHeartbeatTimeout
+	}
+	return h
+}
+
+// ValidateHeartbeat returns an error if h is not whole seconds, or its
+// timeout does not leave room for at least one missed heartbeat.
+func ValidateHeartbeat(h Heartbeat) error {
+	h = h.withDefaults()
+	for _, d := range []time.Duration{h.Interval, h.Timeout} {
+		if d < time.Second || d%time.Second != 0 {
+			return fmt.Errorf("invalid heartbeat duration %s: must be a whole number of seconds", d)
+		}
+	}
+	if h.Timeout < 2*h.Interval {
+		return fmt.Errorf("heartbeat timeout %s must be at least twice the interval %s", h.Timeout, h.Interval)
+	}
+	return nil
+}
+
+// keepReconnecting makes frpc retry frps forever and notice dead
+// connections within the heartbeat timeout. By default frpc exits when its
+// first login fails, which is what it sees while the Machine restarts; the
+// frpc pod would then crash-loop and its restart backoff would outlast the
+// restart.
+func (c *ClientConfig) keepReconnecting(h Heartbeat) {
+	h = h.withDefaults()
+	loginFailExit := false
+	c.LoginFailExit = &loginFailExit
+	if c.Transport == nil {
+		c.Transport = &ClientTransport{}
+	}
+	c.Transport.DialServerTimeout = int(DefaultDialServerTimeout / time.Second)
+	c.Transport.HeartbeatInterval = int(h.Interval / time.Second)
+	c.Transport.HeartbeatTimeout = int(h.Timeout / time.Second)
+}
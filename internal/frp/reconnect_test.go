@@ -0,0 +1,76 @@
+package frp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultTransport is the transport table of a config with the default
+// reconnect settings and nothing else.
+func defaultTransport() *ClientTransport {
+	return &ClientTransport{DialServerTimeout: 10, HeartbeatInterval: 10, HeartbeatTimeout: 30}
+}
+
+func TestGenerateClientConfigReconnect(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+
+	config := GenerateClientConfig(svc, "10.0.0.1", 7000)
+	for _, want := range []string{"loginFailExit = false\n", "dialServerTimeout = 10\n", "heartbeatInterval = 10\n", "heartbeatTimeout = 30\n"} {
+		if !strings.Contains(config, want) {
+			t.Errorf("expected config to contain %q, got:\n%s", want, config)
+		}
+	}
+
+	parsed := mustParseClientConfig(t, GenerateClientConfigWithOptions(svc, ClientOptions{
+		ServerAddr: "10.0.0.1",
+		ServerPort: 7000,
+		Heartbeat:  Heartbeat{Interval: 5 * time.Second, Timeout: 20 * time.Second},
+	}))
+	want := &ClientTransport{DialServerTimeout: 10, HeartbeatInterval: 5, HeartbeatTimeout: 20}
+	if parsed.LoginFailExit == nil || *parsed.LoginFailExit || !reflect.DeepEqual(parsed.Transport, want) {
+		t.Errorf("expected loginFailExit false and transport %+v, got %v and %+v", want, parsed.LoginFailExit, parsed.Transport)
+	}
+
+	group := mustParseClientConfig(t, GenerateGroupClientConfig([]GroupMember{{Service: svc, RemotePorts: map[string]int{"80/tcp": 80}}},
+		"10.0.0.1", 7000, "", "", Heartbeat{Interval: 15 * time.Second}, ""))
+	want = &ClientTransport{DialServerTimeout: 10, HeartbeatInterval: 15, HeartbeatTimeout: 30}
+	if group.LoginFailExit == nil || *group.LoginFailExit || !reflect.DeepEqual(group.Transport, want) {
+		t.Errorf("expected the group config to reconnect with %+v, got %v and %+v", want, group.LoginFailExit, group.Transport)
+	}
+}
+
+func TestValidateHeartbeat(t *testing.T) {
+	tests := []struct {
+		heartbeat Heartbeat
+		wantErr   string
+	}{
+		{heartbeat: Heartbeat{}},
+		{heartbeat: Heartbeat{Interval: 20 * time.Second, Timeout: time.Minute}},
+		{heartbeat: Heartbeat{Interval: 1500 * time.Millisecond}, wantErr: "whole number of seconds"},
+		{heartbeat: Heartbeat{Interval: -time.Second}, wantErr: "whole number of seconds"},
+		{heartbeat: Heartbeat{Interval: 20 * time.Second}, wantErr: "at least twice the interval"},
+		{heartbeat: Heartbeat{Timeout: 15 * time.Second}, wantErr: "at least twice the interval"},
+	}
+	for _, tt := range tests {
+		err := ValidateHeartbeat(tt.heartbeat)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%+v: unexpected error: %v", tt.heartbeat, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%+v: expected error mentioning %q, got %v", tt.heartbeat, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package frp
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AnnotationRemotePort, in its per-port form only (see PortAnnotation),
+// serves the proxies of a named Service port on a different public port,
+// e.g. "fly-tunnel-operator.dev/port.http.remote-port": "80" publishes
+// Service port 8080 on port 80. frpc still forwards to the Service port.
+const AnnotationRemotePort = "fly-tunnel-operator.dev/remote-port"
+
+// RemotePortFor returns the public port frps serves proxy on, when neither
+// frps assigns it (see RandomRemotePorts) nor it is a vhost proxy: the
+// per-port AnnotationRemotePort override, or else the Service port. Invalid
+// overrides are ignored; see ValidateRemotePorts.
+func RemotePortFor(svc *corev1.Service, proxy ProxyPort) int {
+	if proxy.Port.Name != "" {
+		if port, err := parseRemotePort(svc, PortAnnotation(proxy.Port.Name, AnnotationRemotePort)); err == nil && port != 0 {
+			return port
+		}
+	}
+	return int(proxy.Port.Port)
+}
+
+// HasRemotePortOverrides reports whether svc sets AnnotationRemotePort for
+// any of its ports.
+func HasRemotePortOverrides(svc *corev1.Service) bool {
+	return slices.ContainsFunc(portAnnotationKeys(svc), isRemotePortKey)
+}
+
+// ValidateRemotePorts returns an error if an AnnotationRemotePort override
+// is not a port number, names no port of the Service, applies to a proxy
+// whose public port is not fixed, or makes two proxies of a protocol share
+// a public port.
+func ValidateRemotePorts(svc *corev1.Service) error {
+	if _, ok := svc.Annotations[AnnotationRemotePort]; ok {
+		return fmt.Errorf("%s only has a per-port form, e.g. %s", AnnotationRemotePort, PortAnnotation("http", AnnotationRemotePort))
+	}
+	for _, key := range portAnnotationKeys(svc) {
+		if !isRemotePortKey(key) {
+			continue
+		}
+		portName, _, _ := splitPortAnnotation(key)
+		if !slices.ContainsFunc(svc.Spec.Ports, func(p corev1.ServicePort) bool { return p.Name == portName }) {
+			return fmt.Errorf("invalid %s: the Service has no port named %q", key, portName)
+		}
+		if _, err := parseRemotePort(svc, key); err != nil {
+			return err
+		}
+		if RandomRemotePorts(svc) {
+			return fmt.Errorf("%s cannot be combined with %s", key, AnnotationRandomRemotePorts)
+		}
+	}
+
+	served := make(map[string]string)
+	for _, proxy := range ProxyPorts(svc) {
+		if VhostPort(svc, proxy) != 0 {
+			key := PortAnnotation(proxy.Port.Name, AnnotationRemotePort)
+			if _, ok := svc.Annotations[key]; ok && proxy.Port.Name != "" {
+				return fmt.Errorf("%s cannot be set for the %s proxy %s, which is served on the vhost port", key, ProxyTypeFor(svc, proxy), proxy.Name)
+			}
+			continue
+		}
+		if RandomRemotePorts(svc) {
+			continue
+		}
+		key := fmt.Sprintf("%d/%s", RemotePortFor(svc, proxy), proxy.Protocol)
+		if other, ok := served[key]; ok {
+			return fmt.Errorf("proxies %s and %s would both be served on public port %s; change %s", other, proxy.Name, key, AnnotationRemotePort)
+		}
+		served[key] = proxy.Name
+	}
+	return nil
+}
+
+// isRemotePortKey reports whether key is a per-port AnnotationRemotePort.
+func isRemotePortKey(key string) bool {
+	_, option, ok := splitPortAnnotation(key)
+	return ok && "fly-tunnel-operator.dev/"+option == AnnotationRemotePort
+}
+
+// parseRemotePort returns the port number of the annotation key, 0 if it is
+// unset.
+func parseRemotePort(svc *corev1.Service, key string) (int, error) {
+	value, ok := svc.Annotations[key]
+	if !ok {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid %s %q: must be a port number between 1 and 65535", key, value)
+	}
+	return port, nil
+}
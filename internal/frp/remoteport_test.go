@@ -0,0 +1,68 @@
+package frp
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGenerateClientConfig_RemotePortOverride(t *testing.T) {
+	svc := testService(map[string]string{
+		PortAnnotation("http", AnnotationRemotePort): "80",
+	},
+		corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP},
+	)
+
+	config := mustParseClientConfig(t, GenerateClientConfig(svc, "10.0.0.1", 7000))
+
+	localIP := "web.default.svc.cluster.local"
+	want := []Proxy{
+		{Name: "web-http", Type: "tcp", LocalIP: localIP, LocalPort: 8080, RemotePort: 80},
+		{Name: "web-ssh", Type: "tcp", LocalIP: localIP, LocalPort: 22, RemotePort: 22},
+	}
+	if !reflect.DeepEqual(config.Proxies, want) {
+		t.Errorf("unexpected proxies:\ngot:  %+v\nwant: %+v", config.Proxies, want)
+	}
+}
+
+func TestValidateRemotePorts(t *testing.T) {
+	http := corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP}
+	web := corev1.ServicePort{Name: "web", Port: 80, Protocol: corev1.ProtocolTCP}
+	dns := corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP}
+	override := PortAnnotation("http", AnnotationRemotePort)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ports       []corev1.ServicePort
+		wantErr     bool
+	}{
+		{name: "unset", ports: []corev1.ServicePort{http, web}},
+		{name: "override", annotations: map[string]string{override: "80"}, ports: []corev1.ServicePort{http}},
+		{name: "swapped ports", annotations: map[string]string{override: "80", PortAnnotation("web", AnnotationRemotePort): "8080"}, ports: []corev1.ServicePort{http, web}},
+		{name: "same number, other protocol", annotations: map[string]string{PortAnnotation("dns", AnnotationRemotePort): "8080"}, ports: []corev1.ServicePort{http, dns}},
+		{name: "clashes with a Service port", annotations: map[string]string{override: "80"}, ports: []corev1.ServicePort{http, web}, wantErr: true},
+		{name: "two overrides clash", annotations: map[string]string{override: "9000", PortAnnotation("web", AnnotationRemotePort): "9000"}, ports: []corev1.ServicePort{http, web}, wantErr: true},
+		{name: "not a number", annotations: map[string]string{override: "http"}, ports: []corev1.ServicePort{http}, wantErr: true},
+		{name: "out of range", annotations: map[string]string{override: "70000"}, ports: []corev1.ServicePort{http}, wantErr: true},
+		{name: "unknown port", annotations: map[string]string{PortAnnotation("missing", AnnotationRemotePort): "80"}, ports: []corev1.ServicePort{http}, wantErr: true},
+		{name: "service-wide form", annotations: map[string]string{AnnotationRemotePort: "80"}, ports: []corev1.ServicePort{http}, wantErr: true},
+		{name: "random remote ports", annotations: map[string]string{override: "80", AnnotationRandomRemotePorts: "true"}, ports: []corev1.ServicePort{http}, wantErr: true},
+		{
+			name:        "vhost proxy",
+			annotations: map[string]string{override: "8000", AnnotationProxyType: "http", AnnotationCustomDomains: "app.example.com"},
+			ports:       []corev1.ServicePort{http},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRemotePorts(testService(tt.annotations, tt.ports...))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRemotePorts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
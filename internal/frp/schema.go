@@ -0,0 +1,177 @@
+package frp
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ClientConfig mirrors the parts of the frp v1 frpc TOML schema the operator
+// generates.
+type ClientConfig struct {
+	ServerAddr string `toml:"serverAddr"`
+	ServerPort int    `toml:"serverPort"`
+	User       string `toml:"user,omitempty"`
+	// LoginFailExit is nil for frp's default, exiting when the first login
+	// fails.
+	LoginFailExit *bool            `toml:"loginFailExit,omitempty"`
+	Log           *LogConfig       `toml:"log,omitempty"`
+	Auth          *AuthSettings    `toml:"auth,omitempty"`
+	Transport     *ClientTransport `toml:"transport,omitempty"`
+	WebServer     *WebServer       `toml:"webServer,omitempty"`
+	Proxies       []Proxy          `toml:"proxies,omitempty"`
+}
+
+// ServerConfig mirrors the parts of the frp v1 frps TOML schema the operator
+// generates.
+type ServerConfig struct {
+	BindPort          int              `toml:"bindPort"`
+	QUICBindPort      int              `toml:"quicBindPort,omitzero"`
+	KCPBindPort       int              `toml:"kcpBindPort,omitzero"`
+	MaxPortsPerClient int              `toml:"maxPortsPerClient,omitzero"`
+	VhostHTTPPort     int              `toml:"vhostHTTPPort,omitzero"`
+	VhostHTTPSPort    int              `toml:"vhostHTTPSPort,omitzero"`
+	Log               *LogConfig       `toml:"log,omitempty"`
+	Auth              *AuthSettings    `toml:"auth,omitempty"`
+	Transport         *ServerTransport `toml:"transport,omitempty"`
+	WebServer         *WebServer       `toml:"webServer,omitempty"`
+}
+
+// ServerTransport is the transport table of frps.
+type ServerTransport struct {
+	MaxPoolCount int `toml:"maxPoolCount,omitzero"`
+	// HeartbeatTimeout is in seconds.
+	HeartbeatTimeout int `toml:"heartbeatTimeout,omitzero"`
+}
+
+// AuthSettings is the auth table shared by frpc and frps.
+type AuthSettings struct {
+	Method string `toml:"method"`
+	Token  string `toml:"token"`
+}
+
+// ClientTransport is the transport table of frpc.
+type ClientTransport struct {
+	Protocol  string `toml:"protocol,omitempty"`
+	PoolCount int    `toml:"poolCount,omitzero"`
+	// DialServerTimeout, HeartbeatInterval and HeartbeatTimeout are in
+	// seconds.
+	DialServerTimeout int `toml:"dialServerTimeout,omitzero"`
+	HeartbeatInterval int `toml:"heartbeatInterval,omitzero"`
+	HeartbeatTimeout  int `toml:"heartbeatTimeout,omitzero"`
+}
+
+// WebServer is the webServer table: the frpc admin API or the frps
+// dashboard.
+type WebServer struct {
+	Addr     string `toml:"addr"`
+	Port     int    `toml:"port"`
+	User     string `toml:"user,omitempty"`
+	Password string `toml:"password,omitempty"`
+}
+
+// Proxy is a single [[proxies]] entry of frpc.
+type Proxy struct {
+	Name      string `toml:"name"`
+	Type      string `toml:"type"`
+	LocalIP   string `toml:"localIP"`
+	LocalPort int    `toml:"localPort"`
+	// RemotePort is left out for vhost proxies, which have none; for a TCP
+	// or UDP proxy, leaving it out is the same as 0, letting frps pick.
+	RemotePort int `toml:"remotePort,omitzero"`
+	// CustomDomains are the domains an http or https proxy answers for.
+	CustomDomains []string `toml:"customDomains,omitempty"`
+	// Transport is nil when the proxy uses frp's defaults.
+	Transport *ProxyTransportConfig `toml:"transport,omitempty"`
+	// LoadBalancer is nil unless the proxy joins a load balancing group.
+	LoadBalancer *LoadBalancerConfig `toml:"loadBalancer,omitempty"`
+	// HealthCheck is nil unless frpc checks the backend of the proxy.
+	HealthCheck *HealthCheckConfig `toml:"healthCheck,omitempty"`
+}
+
+// HealthCheckConfig is the healthCheck table of a proxy. frpc removes the
+// proxy from frps while its backend fails the check, and registers it again
+// once it passes.
+type HealthCheckConfig struct {
+	Type            string `toml:"type"`
+	IntervalSeconds int    `toml:"intervalSeconds,omitzero"`
+	Path            string `toml:"path,omitempty"`
+}
+
+// LoadBalancerConfig is the loadBalancer table of a proxy. frps spreads the
+// connections of a remote port across the proxies of every client in the
+// same group, provided they present the same key.
+type LoadBalancerConfig struct {
+	Group    string `toml:"group"`
+	GroupKey string `toml:"groupKey"`
+}
+
+// ProxyTransportConfig is the transport table of a proxy.
+type ProxyTransportConfig struct {
+	BandwidthLimit     string `toml:"bandwidthLimit,omitempty"`
+	BandwidthLimitMode string `toml:"bandwidthLimitMode,omitempty"`
+	UseEncryption      bool   `toml:"useEncryption,omitempty"`
+	UseCompression     bool   `toml:"useCompression,omitempty"`
+	// ProxyProtocolVersion is "v1" or "v2" when frpc prepends a PROXY
+	// protocol header to backend connections.
+	ProxyProtocolVersion string `toml:"proxyProtocolVersion,omitempty"`
+}
+
+// EnableLoadBalancing puts every TCP and http proxy of c in a load
+// balancing group named after it, joined with groupKey; see
+// ClientOptions.LoadBalancerGroupKey.
+func (c *ClientConfig) EnableLoadBalancing(groupKey string) {
+	for i := range c.Proxies {
+		if c.Proxies[i].Type == "tcp" || c.Proxies[i].Type == ProxyTypeHTTP {
+			c.Proxies[i].LoadBalancer = &LoadBalancerConfig{Group: c.Proxies[i].Name, GroupKey: groupKey}
+		}
+	}
+}
+
+// TOML renders c as frpc.toml.
+func (c *ClientConfig) TOML() string {
+	return marshalTOML(c)
+}
+
+// ProxyByName returns the proxy named name, or nil.
+func (c *ClientConfig) ProxyByName(name string) *Proxy {
+	for i := range c.Proxies {
+		if c.Proxies[i].Name == name {
+			return &c.Proxies[i]
+		}
+	}
+	return nil
+}
+
+// ParseClientConfig parses an frpc TOML config.
+func ParseClientConfig(data string) (*ClientConfig, error) {
+	var c ClientConfig
+	if _, err := toml.Decode(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing frpc config: %w", err)
+	}
+	return &c, nil
+}
+
+// ParseServerConfig parses an frps TOML config.
+func ParseServerConfig(data string) (*ServerConfig, error) {
+	var c ServerConfig
+	if _, err := toml.Decode(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing frps config: %w", err)
+	}
+	return &c, nil
+}
+
+// marshalTOML encodes a config struct without indenting tables, so each
+// key starts its line.
+func marshalTOML(v any) string {
+	var b bytes.Buffer
+	enc := toml.NewEncoder(&b)
+	enc.Indent = ""
+	if err := enc.Encode(v); err != nil {
+		// The config types only hold strings, ints, bools and tables
+		// of them, which always encode.
+		panic(fmt.Sprintf("frp: encoding config: %v", err))
+	}
+	return b.String()
+}
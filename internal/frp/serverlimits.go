@@ -0,0 +1,77 @@
+package frp
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AnnotationMaxPortsPerClient overrides ServerLimits.MaxPortsPerClient for
+// the tunnel of a Service.
+const AnnotationMaxPortsPerClient = "fly-tunnel-operator.dev/frps-max-ports-per-client"
+
+// ServerLimits bound what frpc clients may ask of frps, to protect a small
+// Machine from connection storms. Zero fields leave the frps defaults.
+type ServerLimits struct {
+	// MaxPoolCount caps the work connections each proxy keeps open ahead
+	// of time (see AnnotationPoolCount); frps caps larger pool counts to
+	// it. At most MaxPoolCount, the frps default.
+	MaxPoolCount int
+	// MaxPortsPerClient caps the remote ports one frpc may listen on.
+	MaxPortsPerClient int
+	// HeartbeatTimeout is how long frps keeps a client that stopped sending
+	// heartbeats, in whole seconds.
+	HeartbeatTimeout time.Duration
+}
+
+// ValidateServerLimits returns an error if l is out of range, or would make
+// frps drop clients sending heartbeats as configured by heartbeat.
+func ValidateServerLimits(l ServerLimits, heartbeat Heartbeat) error {
+	if l.MaxPoolCount < 0 || l.MaxPoolCount > MaxPoolCount {
+		return fmt.Errorf("invalid frps max pool count %d: must be between 0 and %d", l.MaxPoolCount, MaxPoolCount)
+	}
+	if l.MaxPortsPerClient < 0 {
+		return fmt.Errorf("invalid frps max ports per client %d: must not be negative", l.MaxPortsPerClient)
+	}
+	if l.HeartbeatTimeout == 0 {
+		return nil
+	}
+	if l.HeartbeatTimeout < time.Second || l.HeartbeatTimeout%time.Second != 0 {
+		return fmt.Errorf("invalid frps heartbeat timeout %s: must be a whole number of seconds", l.HeartbeatTimeout)
+	}
+	if interval := heartbeat.withDefaults().Interval; l.HeartbeatTimeout < 2*interval {
+		return fmt.Errorf("frps heartbeat timeout %s must be at least twice the frpc heartbeat interval %s", l.HeartbeatTimeout, interval)
+	}
+	return nil
+}
+
+// MaxPortsPerClientFor returns the remote port limit of the frps of svc:
+// AnnotationMaxPortsPerClient if set and valid, fallback otherwise.
+func MaxPortsPerClientFor(svc *corev1.Service, fallback int) int {
+	n, ok, err := parseMaxPortsPerClient(svc)
+	if !ok || err != nil {
+		return fallback
+	}
+	return n
+}
+
+// ValidateMaxPortsPerClient returns an error if AnnotationMaxPortsPerClient
+// is not a positive integer.
+func ValidateMaxPortsPerClient(svc *corev1.Service) error {
+	_, _, err := parseMaxPortsPerClient(svc)
+	return err
+}
+
+func parseMaxPortsPerClient(svc *corev1.Service) (int, bool, error) {
+	value, ok := svc.Annotations[AnnotationMaxPortsPerClient]
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, true, fmt.Errorf("invalid %s %q: must be a positive integer", AnnotationMaxPortsPerClient, value)
+	}
+	return n, true, nil
+}
@@ -0,0 +1,81 @@
+package frp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGenerateServerConfigWithOptions_Limits(t *testing.T) {
+	config := GenerateServerConfigWithOptions(ServerOptions{
+		BindPort: 7000,
+		Limits:   ServerLimits{MaxPoolCount: 2, MaxPortsPerClient: 10, HeartbeatTimeout: 60 * time.Second},
+	})
+	expected := "bindPort = 7000\nmaxPortsPerClient = 10\n\n[log]\nto = \"console\"\nlevel = \"info\"\nmaxDays = 3\n\n[transport]\nmaxPoolCount = 2\nheartbeatTimeout = 60\n"
+	if config != expected {
+		t.Errorf("unexpected server config: got %q, want %q", config, expected)
+	}
+
+	parsed := mustParseServerConfig(t, config)
+	want := &ServerConfig{
+		BindPort:          7000,
+		MaxPortsPerClient: 10,
+		Log:               defaultLog(),
+		Transport:         &ServerTransport{MaxPoolCount: 2, HeartbeatTimeout: 60},
+	}
+	if !reflect.DeepEqual(parsed, want) {
+		t.Errorf("unexpected server config:\ngot:  %+v\nwant: %+v", parsed, want)
+	}
+}
+
+func TestValidateServerLimits(t *testing.T) {
+	tests := []struct {
+		limits  ServerLimits
+		wantErr string
+	}{
+		{limits: ServerLimits{}},
+		{limits: ServerLimits{MaxPoolCount: MaxPoolCount, MaxPortsPerClient: 20, HeartbeatTimeout: 20 * time.Second}},
+		{limits: ServerLimits{MaxPoolCount: MaxPoolCount + 1}, wantErr: "max pool count"},
+		{limits: ServerLimits{MaxPortsPerClient: -1}, wantErr: "max ports per client"},
+		{limits: ServerLimits{HeartbeatTimeout: 1500 * time.Millisecond}, wantErr: "whole number of seconds"},
+		{limits: ServerLimits{HeartbeatTimeout: 15 * time.Second}, wantErr: "at least twice"},
+	}
+	for _, tt := range tests {
+		err := ValidateServerLimits(tt.limits, Heartbeat{})
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%+v: unexpected error: %v", tt.limits, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%+v: expected error mentioning %q, got %v", tt.limits, tt.wantErr, err)
+		}
+	}
+}
+
+func TestMaxPortsPerClientFor(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		want        int
+		wantErr     bool
+	}{
+		{annotations: map[string]string{}, want: 8},
+		{annotations: map[string]string{AnnotationMaxPortsPerClient: "3"}, want: 3},
+		{annotations: map[string]string{AnnotationMaxPortsPerClient: "0"}, want: 8, wantErr: true},
+		{annotations: map[string]string{AnnotationMaxPortsPerClient: "many"}, want: 8, wantErr: true},
+	}
+	for _, tt := range tests {
+		svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+		if got := MaxPortsPerClientFor(svc, 8); got != tt.want {
+			t.Errorf("%v: expected %d, got %d", tt.annotations, tt.want, got)
+		}
+		if err := ValidateMaxPortsPerClient(svc); (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error %v, got %v", tt.annotations, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package frp
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationEncryption encrypts the traffic of every proxy of the Service
+	// between frpc and frps ("true" or "false").
+	AnnotationEncryption = "fly-tunnel-operator.dev/frp-encryption"
+
+	// AnnotationCompression compresses the traffic of every proxy of the
+	// Service between frpc and frps ("true" or "false").
+	AnnotationCompression = "fly-tunnel-operator.dev/frp-compression"
+
+	// AnnotationTransport selects the protocol frpc reaches frps with:
+	// "tcp" (the default), "websocket", "quic" or "kcp". The latter two run
+	// over UDP on the control port number, for networks that mangle
+	// long-lived TCP connections.
+	AnnotationTransport = "fly-tunnel-operator.dev/frp-transport"
+
+	// portAnnotationPrefix starts the per-port form of a proxy annotation,
+	// e.g. fly-tunnel-operator.dev/port.http.frp-compression.
+	portAnnotationPrefix = "fly-tunnel-operator.dev/port."
+)
+
+// transportProtocols are the accepted AnnotationTransport values.
+var transportProtocols = []string{"tcp", "websocket", "quic", "kcp"}
+
+// TransportProtocol returns the protocol frpc connects to frps with.
+func TransportProtocol(svc *corev1.Service) string {
+	if protocol := svc.Annotations[AnnotationTransport]; protocol != "" {
+		return protocol
+	}
+	return "tcp"
+}
+
+// TransportUsesUDP reports whether protocol needs frps to listen on UDP.
+func TransportUsesUDP(protocol string) bool {
+	return protocol == "quic" || protocol == "kcp"
+}
+
+// ValidateTransportProtocol returns an error naming AnnotationTransport if
+// its value is not a supported protocol.
+func ValidateTransportProtocol(svc *corev1.Service) error {
+	if !slices.Contains(transportProtocols, TransportProtocol(svc)) {
+		return fmt.Errorf("invalid %s %q: must be one of %s", AnnotationTransport, svc.Annotations[AnnotationTransport], strings.Join(transportProtocols, ", "))
+	}
+	return nil
+}
+
+// proxyTransportAnnotations are the proxy options that can be overridden per
+// port.
+var proxyTransportAnnotations = []string{AnnotationEncryption, AnnotationCompression}
+
+// PortAnnotation returns the per-port form of a proxy annotation for the
+// Service port named portName.
+func PortAnnotation(portName, annotation string) string {
+	return portAnnotationPrefix + portName + "." + strings.TrimPrefix(annotation, "fly-tunnel-operator.dev/")
+}
+
+// IsPortAnnotation reports whether key is the per-port form of an annotation
+// that can be overridden per port, for any port name.
+func IsPortAnnotation(key string) bool {
+	if !strings.HasPrefix(key, portAnnotationPrefix) {
+		return false
+	}
+	_, option, ok := splitPortAnnotation(key)
+	if !ok {
+		return false
+	}
+	annotation := "fly-tunnel-operator.dev/" + option
+	return slices.Contains(proxyTransportAnnotations, annotation) ||
+		slices.Contains(healthCheckAnnotations, annotation) ||
+		annotation == AnnotationProxyProtocol ||
+		annotation == AnnotationRemotePort ||
+		annotation == AnnotationProxyType
+}
+
+// ProxyTransport holds the frp transport options of one proxy.
+type ProxyTransport struct {
+	UseEncryption  bool
+	UseCompression bool
+}
+
+// ProxyTransportFor returns the transport options for the proxies of port.
+// A per-port annotation takes precedence over the Service-wide one. Invalid
+// values are treated as unset; see ValidateProxyTransport.
+func ProxyTransportFor(svc *corev1.Service, port corev1.ServicePort) ProxyTransport {
+	return ProxyTransport{
+		UseEncryption:  proxyOption(svc, port, AnnotationEncryption),
+		UseCompression: proxyOption(svc, port, AnnotationCompression),
+	}
+}
+
+func proxyOption(svc *corev1.Service, port corev1.ServicePort, annotation string) bool {
+	if port.Name != "" {
+		if value, ok := svc.Annotations[PortAnnotation(port.Name, annotation)]; ok {
+			return value == "true"
+		}
+	}
+	return svc.Annotations[annotation] == "true"
+}
+
+// ValidateProxyTransport returns an error naming the offending annotation if
+// an encryption or compression annotation is not "true" or "false", or a
+// per-port annotation names no port of the Service.
+func ValidateProxyTransport(svc *corev1.Service) error {
+	for _, annotation := range proxyTransportAnnotations {
+		if err := validateBool(svc, annotation); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range portAnnotationKeys(svc) {
+		portName, option, ok := splitPortAnnotation(key)
+		if !ok || !slices.Contains(proxyTransportAnnotations, "fly-tunnel-operator.dev/"+option) {
+			continue
+		}
+		if !slices.ContainsFunc(svc.Spec.Ports, func(p corev1.ServicePort) bool { return p.Name == portName }) {
+			return fmt.Errorf("invalid %s: the Service has no port named %q", key, portName)
+		}
+		if err := validateBool(svc, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// portAnnotationKeys returns the per-port annotation keys of svc, sorted.
+func portAnnotationKeys(svc *corev1.Service) []string {
+	var keys []string
+	for key := range svc.Annotations {
+		if strings.HasPrefix(key, portAnnotationPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// splitPortAnnotation splits a per-port annotation key into the port name
+// and the option it overrides.
+func splitPortAnnotation(key string) (portName, option string, ok bool) {
+	rest := strings.TrimPrefix(key, portAnnotationPrefix)
+	i := strings.LastIndex(rest, ".")
+	if i <= 0 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+func validateBool(svc *corev1.Service, annotation string) error {
+	switch value, ok := svc.Annotations[annotation]; {
+	case !ok, value == "true", value == "false":
+		return nil
+	default:
+		return fmt.Errorf("invalid %s %q: must be \"true\" or \"false\"", annotation, value)
+	}
+}
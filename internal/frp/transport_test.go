@@ -0,0 +1,179 @@
+package frp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGenerateClientConfigProxyTransport(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	both := &ProxyTransportConfig{UseEncryption: true, UseCompression: true}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]*ProxyTransportConfig // proxy name -> expected transport
+	}{
+		{
+			name: "off by default",
+			want: map[string]*ProxyTransportConfig{"web-http": nil, "web-dns": nil},
+		},
+		{
+			name: "service-wide",
+			annotations: map[string]string{
+				AnnotationEncryption:  "true",
+				AnnotationCompression: "true",
+			},
+			want: map[string]*ProxyTransportConfig{"web-http": both, "web-dns": both},
+		},
+		{
+			name: "per-port override wins",
+			annotations: map[string]string{
+				AnnotationCompression:                        "true",
+				PortAnnotation("dns", AnnotationCompression): "false",
+				PortAnnotation("http", AnnotationEncryption): "true",
+			},
+			want: map[string]*ProxyTransportConfig{"web-http": both, "web-dns": nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := mustParseClientConfig(t, GenerateClientConfig(testService(tt.annotations, ports...), "1.2.3.4", 7000))
+			for name, want := range tt.want {
+				proxy := config.ProxyByName(name)
+				if proxy == nil {
+					t.Fatalf("no proxy %s in %+v", name, config.Proxies)
+				}
+				if !reflect.DeepEqual(proxy.Transport, want) {
+					t.Errorf("proxy %s: expected transport %+v, got %+v", name, want, proxy.Transport)
+				}
+			}
+		})
+	}
+}
+
+func TestPortAnnotation(t *testing.T) {
+	if got := PortAnnotation("http", AnnotationCompression); got != "fly-tunnel-operator.dev/port.http.frp-compression" {
+		t.Errorf("PortAnnotation = %q", got)
+	}
+}
+
+func TestIsPortAnnotation(t *testing.T) {
+	for key, want := range map[string]bool{
+		PortAnnotation("http", AnnotationCompression):     true,
+		PortAnnotation("my.port", AnnotationRemotePort):   true,
+		PortAnnotation("http", AnnotationHealthCheckPath): true,
+		PortAnnotation("http", AnnotationPoolCount):       false,
+		"fly-tunnel-operator.dev/port.frp-compression":    false,
+		AnnotationCompression:                             false,
+	} {
+		if got := IsPortAnnotation(key); got != want {
+			t.Errorf("IsPortAnnotation(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestValidateProxyTransport(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErr     string
+	}{
+		{name: "unset"},
+		{name: "valid", annotations: map[string]string{
+			AnnotationEncryption:                          "false",
+			PortAnnotation("http", AnnotationCompression): "true",
+		}},
+		{
+			name:        "invalid service-wide value",
+			annotations: map[string]string{AnnotationEncryption: "yes"},
+			wantErr:     AnnotationEncryption,
+		},
+		{
+			name:        "invalid per-port value",
+			annotations: map[string]string{PortAnnotation("dns", AnnotationCompression): "1"},
+			wantErr:     PortAnnotation("dns", AnnotationCompression),
+		},
+		{
+			name:        "unknown port",
+			annotations: map[string]string{PortAnnotation("https", AnnotationEncryption): "true"},
+			wantErr:     `no port named "https"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateProxyTransport(testService(tt.annotations, ports...))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error mentioning %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTransportProtocol(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantClient string // expected transport.protocol; "" for none
+		wantServer *ServerConfig
+		wantErr    bool
+	}{
+		{value: ""},
+		{value: "tcp"},
+		{value: "websocket", wantClient: "websocket"},
+		{value: "quic", wantClient: "quic", wantServer: &ServerConfig{BindPort: 7000, QUICBindPort: 7000, Log: defaultLog()}},
+		{value: "kcp", wantClient: "kcp", wantServer: &ServerConfig{BindPort: 7000, KCPBindPort: 7000, Log: defaultLog()}},
+		{value: "udp", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			svc := testService(map[string]string{}, corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+			if tt.value != "" {
+				svc.Annotations[AnnotationTransport] = tt.value
+			}
+			if err := ValidateTransportProtocol(svc); (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateTransportProtocol() = %v, wantErr %v", err, tt.wantErr)
+			} else if err != nil {
+				if !strings.Contains(err.Error(), AnnotationTransport) {
+					t.Errorf("expected the error to name %s, got %v", AnnotationTransport, err)
+				}
+				return
+			}
+
+			client := mustParseClientConfig(t, GenerateClientConfig(svc, "1.2.3.4", 7000))
+			var protocol string
+			if client.Transport != nil {
+				protocol = client.Transport.Protocol
+			}
+			if protocol != tt.wantClient {
+				t.Errorf("expected transport.protocol %q, got %q", tt.wantClient, protocol)
+			}
+
+			wantServer := tt.wantServer
+			if wantServer == nil {
+				wantServer = &ServerConfig{BindPort: 7000, Log: defaultLog()}
+			}
+			server := mustParseServerConfig(t, GenerateServerConfigWithOptions(ServerOptions{BindPort: 7000, Protocol: TransportProtocol(svc)}))
+			if !reflect.DeepEqual(server, wantServer) {
+				t.Errorf("expected server config %+v, got %+v", wantServer, server)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package frp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// sampleService exercises every option that changes the generated configs.
+func sampleService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sample",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationRandomRemotePorts:  "true",
+				AnnotationBandwidthLimit:     "1MB",
+				AnnotationBandwidthLimitMode: BandwidthLimitModeServer,
+				AnnotationPoolCount:          "1",
+				AnnotationEncryption:         "true",
+				AnnotationCompression:        "true",
+				AnnotationDualStackPorts:     "53",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+}
+
+// VerifyBinaries runs "frpc verify" and "frps verify" from the given
+// binaries against sample generated configs, to catch an frp release that no
+// longer (or does not yet) understand them.
+func VerifyBinaries(ctx context.Context, frpcPath, frpsPath string) error {
+	dir, err := os.MkdirTemp("", "frp-verify-")
+	if err != nil {
+		return fmt.Errorf("creating temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	configs := []struct {
+		bin, file, config string
+	}{
+		{frpcPath, "frpc.toml", GenerateClientConfigWithOptions(sampleService(), ClientOptions{ServerAddr: "10.0.0.1", ServerPort: DefaultServerPort, AuthToken: "sample-token"})},
+		{frpsPath, "frps.toml", GenerateServerConfigWithOptions(ServerOptions{
+			BindPort:  DefaultServerPort,
+			Dashboard: &Dashboard{User: "admin", Password: "sample-password"},
+			AuthToken: "sample-token",
+		})},
+	}
+	for _, c := range configs {
+		path := filepath.Join(dir, c.file)
+		if err := os.WriteFile(path, []byte(c.config), 0o600); err != nil {
+			return fmt.Errorf("writing %s: %w", c.file, err)
+		}
+		output, err := exec.CommandContext(ctx, c.bin, "verify", "-c", path).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s verify rejected the generated %s: %w\noutput: %s", filepath.Base(c.bin), c.file, err, output)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package frp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeBinary writes a script standing in for frpc or frps that checks it was
+// asked to verify a config file and exits with code.
+func fakeBinary(t *testing.T, name string, code int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	script := "#!/bin/sh\n" +
+		"[ \"$1\" = verify ] && [ \"$2\" = -c ] && [ -s \"$3\" ] || exit 2\n" +
+		"echo \"" + name + " checked $3\"\n" +
+		"exit " + strconv.Itoa(code) + "\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyBinaries(t *testing.T) {
+	if err := VerifyBinaries(context.Background(), fakeBinary(t, "frpc", 0), fakeBinary(t, "frps", 0)); err != nil {
+		t.Fatalf("expected accepted configs to verify, got %v", err)
+	}
+}
+
+func TestVerifyBinaries_Rejected(t *testing.T) {
+	err := VerifyBinaries(context.Background(), fakeBinary(t, "frpc", 0), fakeBinary(t, "frps", 1))
+	if err == nil {
+		t.Fatal("expected an error when frps rejects its config")
+	}
+	if !strings.Contains(err.Error(), "frps verify rejected the generated frps.toml") {
+		t.Errorf("expected the error to name the rejecting binary, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "frps checked") {
+		t.Errorf("expected the error to include the binary's output, got %v", err)
+	}
+}
+
+func TestVerifyBinaries_MissingBinary(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "frpc")
+	if err := VerifyBinaries(context.Background(), missing, fakeBinary(t, "frps", 0)); err == nil {
+		t.Fatal("expected an error when frpc does not exist")
+	}
+}
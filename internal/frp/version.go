@@ -0,0 +1,81 @@
+package frp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is an frp release version.
+type Version struct {
+	Major, Minor, Patch int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Less reports whether v is an earlier release than o.
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+// MinSupportedVersion is the oldest frp release that understands the
+// generated configs: frp 0.52.0 introduced TOML configs with the
+// transport.*, webServer.* and [[proxies]] keys used here.
+var MinSupportedVersion = Version{0, 52, 0}
+
+// ImageVersion extracts the frp version from an image reference such as
+// "snowdreamtech/frpc:0.61.1@sha256:...". It reports false when the tag is
+// missing or not a version (e.g. "latest").
+func ImageVersion(image string) (Version, bool) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return Version{}, false
+	}
+	tag := strings.TrimPrefix(image[i+1:], "v")
+	if j := strings.IndexAny(tag, "-+"); j >= 0 {
+		tag = tag[:j]
+	}
+
+	parts := strings.Split(tag, ".")
+	if len(parts) != 3 {
+		return Version{}, false
+	}
+	var nums [3]int
+	for k, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, false
+		}
+		nums[k] = n
+	}
+	return Version{nums[0], nums[1], nums[2]}, true
+}
+
+// CheckImageVersion returns an error if image is tagged with an frp version
+// known not to understand the generated configs: anything before
+// MinSupportedVersion, or a new major release, whose config format may have
+// changed. Images without a version tag cannot be checked and pass.
+func CheckImageVersion(image string) error {
+	v, ok := ImageVersion(image)
+	if !ok {
+		return nil
+	}
+	if v.Less(MinSupportedVersion) {
+		return fmt.Errorf("image %s is frp %s; generated configs need frp %s or later", image, v, MinSupportedVersion)
+	}
+	if v.Major > MinSupportedVersion.Major {
+		return fmt.Errorf("image %s is frp %s; configs are generated for frp 0.x and may not be understood", image, v)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package frp
+
+import "testing"
+
+func TestImageVersion(t *testing.T) {
+	tests := []struct {
+		image  string
+		want   Version
+		wantOK bool
+	}{
+		{"snowdreamtech/frpc:0.61.1@sha256:55de10291630ca31e98a07120ad73e25977354a2307731cb28b0dc42f6987c59", Version{0, 61, 1}, true},
+		{"snowdreamtech/frps:0.52.0", Version{0, 52, 0}, true},
+		{"ghcr.io/fatedier/frpc:v0.60.0", Version{0, 60, 0}, true},
+		{"registry.local:5000/frpc:0.58.1-alpine", Version{0, 58, 1}, true},
+		{"registry.local:5000/frpc", Version{}, false},
+		{"snowdreamtech/frpc:latest", Version{}, false},
+		{"snowdreamtech/frpc", Version{}, false},
+		{"snowdreamtech/frpc@sha256:55de10291630ca31e98a07120ad73e25977354a2307731cb28b0dc42f6987c59", Version{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ImageVersion(tt.image)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("ImageVersion(%q) = %v, %v; want %v, %v", tt.image, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestCheckImageVersion(t *testing.T) {
+	tests := []struct {
+		image   string
+		wantErr bool
+	}{
+		{"snowdreamtech/frpc:0.61.1", false},
+		{"snowdreamtech/frpc:0.52.0", false},
+		{"snowdreamtech/frpc:0.51.3", true},
+		{"snowdreamtech/frpc:0.9.0", true},
+		{"snowdreamtech/frpc:1.0.0", true},
+		{"snowdreamtech/frpc:latest", false},
+	}
+	for _, tt := range tests {
+		if err := CheckImageVersion(tt.image); (err != nil) != tt.wantErr {
+			t.Errorf("CheckImageVersion(%q) = %v, want error: %v", tt.image, err, tt.wantErr)
+		}
+	}
+}
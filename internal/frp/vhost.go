@@ -0,0 +1,166 @@
+package frp
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// AnnotationProxyType switches the proxies of a Service from plain TCP
+	// to frp's virtual host proxies: "http" or "https". frps then serves
+	// them on VhostHTTPPort or VhostHTTPSPort, routing requests by the Host
+	// header or TLS SNI to the domains in AnnotationCustomDomains, rather
+	// than on the Service port. Unset or "tcp" keeps plain TCP. A per-port
+	// annotation takes precedence, so a Service can mix vhost and TCP ports;
+	// UDP ports are always plain.
+	AnnotationProxyType = "fly-tunnel-operator.dev/frp-proxy-type"
+
+	// AnnotationCustomDomains lists the domains (comma-separated) the vhost
+	// proxies of a Service answer for. A leading "*." matches subdomains.
+	AnnotationCustomDomains = "fly-tunnel-operator.dev/custom-domains"
+
+	// VhostHTTPPort and VhostHTTPSPort are the ports frps serves http and
+	// https proxies on.
+	VhostHTTPPort  = 80
+	VhostHTTPSPort = 443
+
+	ProxyTypeTCP   = "tcp"
+	ProxyTypeHTTP  = "http"
+	ProxyTypeHTTPS = "https"
+)
+
+// ProxyTypeFor returns the frp proxy type of proxy: its protocol, or "http"
+// or "https" for a vhost proxy. Invalid values are treated as unset; see
+// ValidateVhost.
+func ProxyTypeFor(svc *corev1.Service, proxy ProxyPort) string {
+	if proxy.Protocol != "tcp" {
+		return proxy.Protocol
+	}
+	proxyType, err := parseProxyType(svc, proxy.Port)
+	if err != nil || proxyType == "" {
+		return proxy.Protocol
+	}
+	return proxyType
+}
+
+// VhostPort returns the frps port the vhost proxy proxy is served on, or 0
+// if it is not a vhost proxy.
+func VhostPort(svc *corev1.Service, proxy ProxyPort) int {
+	switch ProxyTypeFor(svc, proxy) {
+	case ProxyTypeHTTP:
+		return VhostHTTPPort
+	case ProxyTypeHTTPS:
+		return VhostHTTPSPort
+	}
+	return 0
+}
+
+// VhostPorts returns the vhost ports frps listens on for svc, 0 for those
+// none of its proxies use.
+func VhostPorts(svc *corev1.Service) (httpPort, httpsPort int) {
+	for _, proxy := range ProxyPorts(svc) {
+		switch VhostPort(svc, proxy) {
+		case VhostHTTPPort:
+			httpPort = VhostHTTPPort
+		case VhostHTTPSPort:
+			httpsPort = VhostHTTPSPort
+		}
+	}
+	return httpPort, httpsPort
+}
+
+// CustomDomains returns the domains listed in AnnotationCustomDomains.
+func CustomDomains(svc *corev1.Service) []string {
+	var domains []string
+	for _, domain := range strings.Split(svc.Annotations[AnnotationCustomDomains], ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// ValidateVhost returns an error if a proxy type annotation is not a
+// supported type or names no TCP port of the Service, or the vhost proxies
+// of the Service cannot be served: they need custom domains, share them so
+// at most one http and one https proxy is allowed, and take their vhost
+// port from the plain TCP proxies.
+func ValidateVhost(svc *corev1.Service) error {
+	for _, key := range portAnnotationKeys(svc) {
+		portName, option, _ := splitPortAnnotation(key)
+		if "fly-tunnel-operator.dev/"+option != AnnotationProxyType {
+			continue
+		}
+		i := slices.IndexFunc(svc.Spec.Ports, func(p corev1.ServicePort) bool { return p.Name == portName })
+		if i < 0 {
+			return fmt.Errorf("invalid %s: the Service has no port named %q", key, portName)
+		}
+		if svc.Spec.Ports[i].Protocol == corev1.ProtocolUDP {
+			return fmt.Errorf("invalid %s: the UDP port %q cannot be a vhost proxy", key, portName)
+		}
+	}
+	if _, err := parseProxyType(svc, corev1.ServicePort{}); err != nil {
+		return err
+	}
+	for _, port := range svc.Spec.Ports {
+		if _, err := parseProxyType(svc, port); err != nil {
+			return err
+		}
+	}
+
+	vhosts := make(map[string]string)
+	tcpPorts := make(map[int]string)
+	for _, proxy := range ProxyPorts(svc) {
+		proxyType := ProxyTypeFor(svc, proxy)
+		switch {
+		case proxyType == ProxyTypeTCP:
+			tcpPorts[RemotePortFor(svc, proxy)] = proxy.Name
+		case proxyType != proxy.Protocol:
+			if other, ok := vhosts[proxyType]; ok {
+				return fmt.Errorf("proxies %s and %s are both %s proxies for the same %s", other, proxy.Name, proxyType, AnnotationCustomDomains)
+			}
+			vhosts[proxyType] = proxy.Name
+		}
+	}
+	if len(vhosts) == 0 {
+		return nil
+	}
+	domains := CustomDomains(svc)
+	if len(domains) == 0 {
+		return fmt.Errorf("%s proxies need %s", AnnotationProxyType, AnnotationCustomDomains)
+	}
+	for _, domain := range domains {
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(domain, "*.")); len(errs) > 0 {
+			return fmt.Errorf("invalid %s entry %q: %s", AnnotationCustomDomains, domain, strings.Join(errs, "; "))
+		}
+	}
+	if !RandomRemotePorts(svc) {
+		for proxyType, port := range map[string]int{ProxyTypeHTTP: VhostHTTPPort, ProxyTypeHTTPS: VhostHTTPSPort} {
+			if name, ok := tcpPorts[port]; ok && vhosts[proxyType] != "" {
+				return fmt.Errorf("the TCP proxy %s and the %s proxy %s would both be served on port %d", name, proxyType, vhosts[proxyType], port)
+			}
+		}
+	}
+	return nil
+}
+
+// parseProxyType returns the proxy type annotation of the proxies of port,
+// "" if unset.
+func parseProxyType(svc *corev1.Service, port corev1.ServicePort) (string, error) {
+	key := AnnotationProxyType
+	if port.Name != "" {
+		if _, ok := svc.Annotations[PortAnnotation(port.Name, key)]; ok {
+			key = PortAnnotation(port.Name, key)
+		}
+	}
+	switch proxyType := svc.Annotations[key]; proxyType {
+	case "", ProxyTypeTCP, ProxyTypeHTTP, ProxyTypeHTTPS:
+		return proxyType, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q: must be %q, %q or %q", key, proxyType, ProxyTypeTCP, ProxyTypeHTTP, ProxyTypeHTTPS)
+	}
+}
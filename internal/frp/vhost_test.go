@@ -0,0 +1,97 @@
+package frp
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGenerateClientConfigVhost(t *testing.T) {
+	svc := testService(map[string]string{
+		AnnotationProxyType:                          "http",
+		PortAnnotation("https", AnnotationProxyType): "https",
+		PortAnnotation("ssh", AnnotationProxyType):   "tcp",
+		AnnotationCustomDomains:                      "a.example.com, *.b.example.com",
+	},
+		corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "https", Port: 8443, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	)
+
+	config := mustParseClientConfig(t, GenerateClientConfig(svc, "10.0.0.1", 7000))
+
+	localIP := "web.default.svc.cluster.local"
+	domains := []string{"a.example.com", "*.b.example.com"}
+	want := []Proxy{
+		{Name: "web-http", Type: "http", LocalIP: localIP, LocalPort: 8080, CustomDomains: domains},
+		{Name: "web-https", Type: "https", LocalIP: localIP, LocalPort: 8443, CustomDomains: domains},
+		{Name: "web-ssh", Type: "tcp", LocalIP: localIP, LocalPort: 22, RemotePort: 22},
+		{Name: "web-dns", Type: "udp", LocalIP: localIP, LocalPort: 53, RemotePort: 53},
+	}
+	if !reflect.DeepEqual(config.Proxies, want) {
+		t.Errorf("unexpected proxies:\ngot:  %+v\nwant: %+v", config.Proxies, want)
+	}
+	if http, https := VhostPorts(svc); http != VhostHTTPPort || https != VhostHTTPSPort {
+		t.Errorf("expected vhost ports %d and %d, got %d and %d", VhostHTTPPort, VhostHTTPSPort, http, https)
+	}
+}
+
+func TestGenerateServerConfig_Vhost(t *testing.T) {
+	config := mustParseServerConfig(t, GenerateServerConfigWithOptions(ServerOptions{BindPort: 7000, VhostHTTPPort: 80, VhostHTTPSPort: 443}))
+	if config.VhostHTTPPort != 80 || config.VhostHTTPSPort != 443 {
+		t.Errorf("expected vhost ports 80 and 443, got %+v", config)
+	}
+}
+
+func TestValidateVhost(t *testing.T) {
+	http := corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP}
+	admin := corev1.ServicePort{Name: "admin", Port: 9000, Protocol: corev1.ProtocolTCP}
+	plain80 := corev1.ServicePort{Name: "plain", Port: 80, Protocol: corev1.ProtocolTCP}
+	dns := corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP}
+	domains := "app.example.com"
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ports       []corev1.ServicePort
+		wantErr     bool
+	}{
+		{name: "unset", ports: []corev1.ServicePort{http}},
+		{name: "http", annotations: map[string]string{AnnotationProxyType: "http", AnnotationCustomDomains: domains}, ports: []corev1.ServicePort{http}},
+		{name: "wildcard domain", annotations: map[string]string{AnnotationProxyType: "http", AnnotationCustomDomains: "*.example.com"}, ports: []corev1.ServicePort{http}},
+		{name: "tcp without domains", annotations: map[string]string{AnnotationProxyType: "tcp"}, ports: []corev1.ServicePort{http}},
+		{name: "udp ports stay plain", annotations: map[string]string{AnnotationProxyType: "http", AnnotationCustomDomains: domains}, ports: []corev1.ServicePort{http, dns}},
+		{name: "unknown type", annotations: map[string]string{AnnotationProxyType: "tcpmux", AnnotationCustomDomains: domains}, ports: []corev1.ServicePort{http}, wantErr: true},
+		{name: "no domains", annotations: map[string]string{AnnotationProxyType: "http"}, ports: []corev1.ServicePort{http}, wantErr: true},
+		{name: "invalid domain", annotations: map[string]string{AnnotationProxyType: "http", AnnotationCustomDomains: "app_example"}, ports: []corev1.ServicePort{http}, wantErr: true},
+		{name: "two http proxies", annotations: map[string]string{AnnotationProxyType: "http", AnnotationCustomDomains: domains}, ports: []corev1.ServicePort{http, admin}, wantErr: true},
+		{
+			name:        "tcp port on the vhost port",
+			annotations: map[string]string{PortAnnotation("http", AnnotationProxyType): "http", AnnotationCustomDomains: domains},
+			ports:       []corev1.ServicePort{http, plain80},
+			wantErr:     true,
+		},
+		{
+			name:        "per-port annotation on unknown port",
+			annotations: map[string]string{PortAnnotation("missing", AnnotationProxyType): "http", AnnotationCustomDomains: domains},
+			ports:       []corev1.ServicePort{http},
+			wantErr:     true,
+		},
+		{
+			name:        "per-port annotation on udp port",
+			annotations: map[string]string{PortAnnotation("dns", AnnotationProxyType): "http", AnnotationCustomDomains: domains},
+			ports:       []corev1.ServicePort{dns},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateVhost(testService(tt.annotations, tt.ports...))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateVhost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
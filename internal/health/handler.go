@@ -0,0 +1,26 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// DetailedHandler serves the state of every component as JSON, for humans.
+// It responds 503 if any component is unhealthy.
+func (r *Registry) DetailedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		statuses := r.Statuses()
+		code := http.StatusOK
+		for _, s := range statuses {
+			if !s.Healthy {
+				code = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(map[string]any{"components": statuses})
+	})
+}
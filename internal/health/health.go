@@ -0,0 +1,228 @@
+// Package health tracks the liveness of individual operator components and
+// exposes them as healthz checks.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// component reports its current state and whether it is healthy.
+type component interface {
+	status(now time.Time) (state string, err error)
+}
+
+// Registry holds the operator's tracked components.
+type Registry struct {
+	mu         sync.Mutex
+	components map[string]component
+	now        func() time.Time
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		components: make(map[string]component),
+		now:        time.Now,
+	}
+}
+
+func (r *Registry) add(name string, c component) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.components[name] = c
+}
+
+func (r *Registry) get(name string) component {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.components[name]
+}
+
+// Checker returns a healthz check that fails while the named component is
+// unhealthy.
+func (r *Registry) Checker(name string) healthz.Checker {
+	return func(_ *http.Request) error {
+		c := r.get(name)
+		if c == nil {
+			return fmt.Errorf("unknown component %q", name)
+		}
+		_, err := c.status(r.now())
+		return err
+	}
+}
+
+// ComponentStatus is one line of the detailed health report.
+type ComponentStatus struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Statuses returns the state of every component, sorted by name.
+func (r *Registry) Statuses() []ComponentStatus {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.components))
+	for name := range r.components {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	now := r.now()
+	statuses := make([]ComponentStatus, 0, len(names))
+	for _, name := range names {
+		state, err := r.get(name).status(now)
+		s := ComponentStatus{Name: name, Healthy: err == nil, State: state}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// Heartbeat tracks in-flight units of work, such as reconciles, and reports
+// the component unhealthy when one has been running for longer than maxAge.
+// An idle component is always healthy.
+type Heartbeat struct {
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu       sync.Mutex
+	nextID   uint64
+	inFlight map[uint64]time.Time
+	lastDone time.Time
+}
+
+// Heartbeat registers and returns a Heartbeat for the named component.
+func (r *Registry) Heartbeat(name string, maxAge time.Duration) *Heartbeat {
+	h := &Heartbeat{
+		maxAge:   maxAge,
+		now:      r.now,
+		inFlight: make(map[uint64]time.Time),
+	}
+	r.add(name, h)
+	return h
+}
+
+// Begin marks the start of a unit of work and returns the function that
+// marks its end. It is safe to call on a nil Heartbeat.
+func (h *Heartbeat) Begin() (done func()) {
+	if h == nil {
+		return func() {}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextID++
+	id := h.nextID
+	h.inFlight[id] = h.now()
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.inFlight, id)
+		h.lastDone = h.now()
+	}
+}
+
+func (h *Heartbeat) status(now time.Time) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var oldest time.Time
+	for _, started := range h.inFlight {
+		if oldest.IsZero() || started.Before(oldest) {
+			oldest = started
+		}
+	}
+
+	last := "never"
+	if !h.lastDone.IsZero() {
+		last = now.Sub(h.lastDone).Truncate(time.Second).String() + " ago"
+	}
+	if oldest.IsZero() {
+		return fmt.Sprintf("idle, last completed %s", last), nil
+	}
+	if age := now.Sub(oldest); age > h.maxAge {
+		return fmt.Sprintf("%d in flight, last completed %s", len(h.inFlight), last),
+			fmt.Errorf("work in progress for %s, exceeds %s", age.Truncate(time.Second), h.maxAge)
+	}
+	return fmt.Sprintf("%d in flight, last completed %s", len(h.inFlight), last), nil
+}
+
+// Runner states.
+const (
+	runnerPending = "pending"
+	runnerRunning = "running"
+	runnerStopped = "stopped"
+	runnerExited  = "exited"
+)
+
+// runner wraps a manager.Runnable and records whether it is still running.
+type runner struct {
+	inner manager.Runnable
+
+	mu    sync.Mutex
+	state string
+	err   error
+}
+
+// Runnable registers the named background runner and returns a wrapper to add
+// to the manager in its place. The runner is unhealthy once its Start returns
+// before the manager is shutting down. Runners that have not started yet, for
+// example while waiting for leader election, are healthy.
+func (r *Registry) Runnable(name string, inner manager.Runnable) manager.Runnable {
+	w := &runner{inner: inner, state: runnerPending}
+	r.add(name, w)
+	if _, ok := inner.(manager.LeaderElectionRunnable); ok {
+		return &leaderElectionRunner{w}
+	}
+	return w
+}
+
+func (w *runner) Start(ctx context.Context) error {
+	w.setState(runnerRunning, nil)
+	err := w.inner.Start(ctx)
+	if ctx.Err() != nil {
+		w.setState(runnerStopped, err)
+	} else {
+		w.setState(runnerExited, err)
+	}
+	return err
+}
+
+func (w *runner) setState(state string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.state, w.err = state, err
+}
+
+func (w *runner) status(time.Time) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state != runnerExited {
+		return w.state, nil
+	}
+	if w.err != nil {
+		return w.state, fmt.Errorf("runner exited: %w", w.err)
+	}
+	return w.state, fmt.Errorf("runner exited")
+}
+
+// leaderElectionRunner preserves the wrapped Runnable's leader election
+// preference.
+type leaderElectionRunner struct {
+	*runner
+}
+
+func (l *leaderElectionRunner) NeedLeaderElection() bool {
+	return l.inner.(manager.LeaderElectionRunnable).NeedLeaderElection()
+}
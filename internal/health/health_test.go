@@ -0,0 +1,147 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newTestRegistry() (*Registry, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	r := NewRegistry()
+	r.now = clock.now
+	return r, clock
+}
+
+func TestHeartbeat_Staleness(t *testing.T) {
+	r, clock := newTestRegistry()
+	hb := r.Heartbeat("controller", time.Minute)
+	check := r.Checker("controller")
+
+	if err := check(nil); err != nil {
+		t.Fatalf("expected idle controller to be healthy, got %v", err)
+	}
+
+	done := hb.Begin()
+	clock.t = clock.t.Add(30 * time.Second)
+	if err := check(nil); err != nil {
+		t.Errorf("expected reconcile within maxAge to be healthy, got %v", err)
+	}
+
+	clock.t = clock.t.Add(time.Minute)
+	if err := check(nil); err == nil {
+		t.Error("expected reconcile running past maxAge to be unhealthy")
+	}
+
+	done()
+	if err := check(nil); err != nil {
+		t.Errorf("expected controller to recover once the reconcile finished, got %v", err)
+	}
+}
+
+func TestHeartbeat_OldestInFlightCounts(t *testing.T) {
+	r, clock := newTestRegistry()
+	hb := r.Heartbeat("controller", time.Minute)
+
+	_ = hb.Begin() // wedged
+	clock.t = clock.t.Add(50 * time.Second)
+	for i := 0; i < 3; i++ {
+		// Quick reconciles completing alongside must not mask the wedged one.
+		hb.Begin()()
+	}
+	clock.t = clock.t.Add(20 * time.Second)
+
+	if err := r.Checker("controller")(nil); err == nil {
+		t.Error("expected the wedged reconcile to make the controller unhealthy")
+	}
+}
+
+func TestHeartbeat_NilIsNoop(t *testing.T) {
+	var hb *Heartbeat
+	hb.Begin()()
+}
+
+type fakeRunnable struct {
+	run func(ctx context.Context) error
+}
+
+func (f fakeRunnable) Start(ctx context.Context) error { return f.run(ctx) }
+
+func TestRunnable_Liveness(t *testing.T) {
+	r, _ := newTestRegistry()
+	crashed := r.Runnable("janitor", fakeRunnable{run: func(context.Context) error {
+		return errors.New("boom")
+	}})
+	stopped := r.Runnable("prober", fakeRunnable{run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}})
+
+	if err := r.Checker("janitor")(nil); err != nil {
+		t.Errorf("expected pending runner to be healthy, got %v", err)
+	}
+
+	_ = crashed.Start(context.Background())
+	if err := r.Checker("janitor")(nil); err == nil {
+		t.Error("expected exited runner to be unhealthy")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = stopped.Start(ctx)
+	if err := r.Checker("prober")(nil); err != nil {
+		t.Errorf("expected runner stopped by shutdown to be healthy, got %v", err)
+	}
+}
+
+type leaderRunnable struct{ fakeRunnable }
+
+func (leaderRunnable) NeedLeaderElection() bool { return false }
+
+func TestRunnable_PreservesLeaderElection(t *testing.T) {
+	r, _ := newTestRegistry()
+
+	wrapped := r.Runnable("summary", leaderRunnable{})
+	le, ok := wrapped.(manager.LeaderElectionRunnable)
+	if !ok || le.NeedLeaderElection() {
+		t.Error("expected wrapper to keep NeedLeaderElection() = false")
+	}
+
+	if _, ok := r.Runnable("other", fakeRunnable{}).(manager.LeaderElectionRunnable); ok {
+		t.Error("expected wrapper without leader election preference to use the manager default")
+	}
+}
+
+func TestDetailedHandler(t *testing.T) {
+	r, clock := newTestRegistry()
+	hb := r.Heartbeat("controller", time.Minute)
+	r.Runnable("janitor", fakeRunnable{})
+
+	rec := httptest.NewRecorder()
+	r.DetailedHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz/detailed", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	_ = hb.Begin()
+	clock.t = clock.t.Add(2 * time.Minute)
+	rec = httptest.NewRecorder()
+	r.DetailedHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz/detailed", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d: %s", rec.Code, rec.Body)
+	}
+
+	statuses := r.Statuses()
+	if len(statuses) != 2 || statuses[0].Name != "controller" || statuses[0].Healthy || statuses[1].Name != "janitor" {
+		t.Errorf("unexpected statuses: %+v", statuses)
+	}
+}
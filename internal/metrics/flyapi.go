@@ -0,0 +1,134 @@
+// Package metrics exposes operator metrics on the controller-runtime registry.
+package metrics
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	flyAPIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fly_tunnel_operator_fly_api_requests_total",
+		Help: "Fly.io API requests sent by the operator, by operation and status code class.",
+	}, []string{"operation", "code"})
+
+	flyAPIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fly_tunnel_operator_fly_api_request_duration_seconds",
+		Help:    "Latency of Fly.io API requests, by operation.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"operation"})
+
+	flyAPIQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fly_tunnel_operator_fly_api_queue_wait_seconds",
+		Help:    "Time Fly.io API requests spent held back by rate limiting before being sent, by operation.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"operation"})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(flyAPIRequests, flyAPIRequestDuration, flyAPIQueueWait)
+}
+
+// codeClass collapses a status code into a low-cardinality label. 429 is kept
+// separate because it is the signal for shared rate-limit exhaustion.
+func codeClass(statusCode int) string {
+	switch {
+	case statusCode == 0:
+		return "error"
+	case statusCode == 429:
+		return "429"
+	default:
+		return strconv.Itoa(statusCode/100) + "xx"
+	}
+}
+
+// FlyAPIRecorder implements flyio.Observer. It records Prometheus metrics and,
+// when run by the manager, logs an hourly per-operation summary of API usage,
+// along with the tunnel teardowns and failed teardown steps in that hour.
+type FlyAPIRecorder struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	counts  map[string]int
+	limited int
+	queued  time.Duration
+}
+
+// NewFlyAPIRecorder creates a recorder that logs a summary every hour.
+func NewFlyAPIRecorder() *FlyAPIRecorder {
+	return &FlyAPIRecorder{
+		interval: time.Hour,
+		counts:   make(map[string]int),
+	}
+}
+
+// ObserveRequest implements flyio.Observer.
+func (r *FlyAPIRecorder) ObserveRequest(op string, statusCode int, duration time.Duration) {
+	flyAPIRequests.WithLabelValues(op, codeClass(statusCode)).Inc()
+	flyAPIRequestDuration.WithLabelValues(op).Observe(duration.Seconds())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[op]++
+	if statusCode == 429 {
+		r.limited++
+	}
+}
+
+// ObserveQueued implements flyio.Observer.
+func (r *FlyAPIRecorder) ObserveQueued(op string, wait time.Duration) {
+	flyAPIQueueWait.WithLabelValues(op).Observe(wait.Seconds())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queued += wait
+}
+
+// Start logs the usage summary every interval until ctx is cancelled. It
+// implements manager.Runnable.
+func (r *FlyAPIRecorder) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("fly-api-usage")
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			r.logSummary(logger.Info)
+		}
+	}
+}
+
+// logSummary emits the counts gathered since the previous summary and resets
+// them.
+func (r *FlyAPIRecorder) logSummary(info func(msg string, keysAndValues ...any)) {
+	r.mu.Lock()
+	counts, limited, queued := r.counts, r.limited, r.queued
+	r.counts, r.limited, r.queued = make(map[string]int), 0, 0
+	r.mu.Unlock()
+
+	ops := make([]string, 0, len(counts))
+	total := 0
+	for op, n := range counts {
+		ops = append(ops, op)
+		total += n
+	}
+	sort.Strings(ops)
+
+	kv := []any{"interval", r.interval.String(), "total", total, "rateLimited", limited, "queued", queued.String()}
+	for _, op := range ops {
+		kv = append(kv, op, counts[op])
+	}
+	teardowns, failed, steps := takeTeardownCounts()
+	kv = append(kv, "teardowns", teardowns, "teardownsFailed", failed, "teardownStepsFailed", steps)
+	info("Fly.io API usage summary", kv...)
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCodeClass(t *testing.T) {
+	tests := map[int]string{
+		0:   "error",
+		200: "2xx",
+		201: "2xx",
+		404: "4xx",
+		429: "429",
+		503: "5xx",
+	}
+	for code, want := range tests {
+		if got := codeClass(code); got != want {
+			t.Errorf("codeClass(%d) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestFlyAPIRecorder(t *testing.T) {
+	r := NewFlyAPIRecorder()
+
+	before := testutil.ToFloat64(flyAPIRequests.WithLabelValues("CreateMachine", "2xx"))
+	r.ObserveRequest("CreateMachine", 200, 10*time.Millisecond)
+	r.ObserveRequest("CreateMachine", 201, 10*time.Millisecond)
+	r.ObserveRequest("DeleteApp", 429, 10*time.Millisecond)
+	r.ObserveQueued("DeleteApp", 2*time.Second)
+
+	if got := testutil.ToFloat64(flyAPIRequests.WithLabelValues("CreateMachine", "2xx")) - before; got != 2 {
+		t.Errorf("expected 2 CreateMachine requests counted, got %v", got)
+	}
+
+	var msg string
+	var kv []any
+	r.logSummary(func(m string, keysAndValues ...any) {
+		msg, kv = m, keysAndValues
+	})
+	if msg == "" {
+		t.Fatal("expected a summary to be logged")
+	}
+
+	fields := make(map[string]any)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields[kv[i].(string)] = kv[i+1]
+	}
+	if fields["total"] != 3 || fields["CreateMachine"] != 2 || fields["DeleteApp"] != 1 {
+		t.Errorf("unexpected per-operation counts: %v", fields)
+	}
+	if fields["rateLimited"] != 1 || fields["queued"] != "2s" {
+		t.Errorf("unexpected rate-limit fields: %v", fields)
+	}
+
+	// The summary resets after being logged.
+	r.logSummary(func(_ string, keysAndValues ...any) { kv = keysAndValues })
+	if kv[3] != 0 {
+		t.Errorf("expected counts to reset, got total %v", kv[3])
+	}
+}
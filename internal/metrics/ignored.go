@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var ignoredServices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "fly_tunnel_operator_ignored_services",
+	Help: "LoadBalancer Services observed but not managed by the operator, by reason.",
+}, []string{"reason"})
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(ignoredServices)
+}
+
+// SetIgnoredServices records the number of ignored LoadBalancer Services per
+// reason, replacing the previous counts.
+func SetIgnoredServices(counts map[string]int) {
+	ignoredServices.Reset()
+	for reason, n := range counts {
+		ignoredServices.WithLabelValues(reason).Set(float64(n))
+	}
+}
@@ -0,0 +1,19 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSetIgnoredServices(t *testing.T) {
+	SetIgnoredServices(map[string]int{"a": 2, "b": 1})
+	SetIgnoredServices(map[string]int{"a": 3})
+
+	if got := testutil.ToFloat64(ignoredServices.WithLabelValues("a")); got != 3 {
+		t.Errorf("expected a=3, got %v", got)
+	}
+	if got := testutil.CollectAndCount(ignoredServices); got != 1 {
+		t.Errorf("expected the stale reason to be dropped, got %d series", got)
+	}
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var tunnelImages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "fly_tunnel_operator_tunnel_images",
+	Help: "Tunnels per frp image used at their last successful provision or update, by component (frpc or frps).",
+}, []string{"component", "image"})
+
+var (
+	imagesMu sync.Mutex
+	// imagesByTunnel maps a tunnel to its frpc and frps images.
+	imagesByTunnel = make(map[string][2]string)
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(tunnelImages)
+}
+
+// SetTunnelImages records the frpc and frps images tunnel now runs.
+func SetTunnelImages(tunnel, frpcImage, frpsImage string) {
+	imagesMu.Lock()
+	defer imagesMu.Unlock()
+	imagesByTunnel[tunnel] = [2]string{frpcImage, frpsImage}
+	refreshTunnelImages()
+}
+
+// ForgetTunnelImages drops a torn down tunnel from the image counts.
+func ForgetTunnelImages(tunnel string) {
+	imagesMu.Lock()
+	defer imagesMu.Unlock()
+	delete(imagesByTunnel, tunnel)
+	refreshTunnelImages()
+}
+
+// refreshTunnelImages recomputes the gauge from imagesByTunnel, so images no
+// tunnel uses any more disappear. imagesMu must be held.
+func refreshTunnelImages() {
+	tunnelImages.Reset()
+	for _, images := range imagesByTunnel {
+		tunnelImages.WithLabelValues("frpc", images[0]).Inc()
+		tunnelImages.WithLabelValues("frps", images[1]).Inc()
+	}
+}
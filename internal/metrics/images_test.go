@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTunnelImages(t *testing.T) {
+	SetTunnelImages("default/a", "frpc:0.61.1", "frps:0.61.1")
+	SetTunnelImages("default/b", "frpc:0.61.1", "frps:0.61.1")
+	SetTunnelImages("default/b", "frpc:0.62.0", "frps:0.61.1")
+
+	if got := testutil.ToFloat64(tunnelImages.WithLabelValues("frps", "frps:0.61.1")); got != 2 {
+		t.Errorf("expected 2 tunnels on frps:0.61.1, got %v", got)
+	}
+	if got := testutil.ToFloat64(tunnelImages.WithLabelValues("frpc", "frpc:0.62.0")); got != 1 {
+		t.Errorf("expected 1 tunnel on frpc:0.62.0, got %v", got)
+	}
+
+	ForgetTunnelImages("default/a")
+	ForgetTunnelImages("default/b")
+	if got := testutil.CollectAndCount(tunnelImages); got != 0 {
+		t.Errorf("expected no series once every tunnel is gone, got %d", got)
+	}
+}
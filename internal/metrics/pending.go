@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var pendingTunnels = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "fly_tunnel_operator_pending_tunnels",
+	Help: "Services waiting for a tunnel because a provisioning limit is reached.",
+})
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(pendingTunnels)
+}
+
+// SetPendingTunnels records the number of Services held back by a
+// provisioning limit.
+func SetPendingTunnels(n int) {
+	pendingTunnels.Set(float64(n))
+}
@@ -0,0 +1,16 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSetPendingTunnels(t *testing.T) {
+	SetPendingTunnels(3)
+	SetPendingTunnels(2)
+
+	if got := testutil.ToFloat64(pendingTunnels); got != 2 {
+		t.Errorf("expected 2 pending tunnels, got %v", got)
+	}
+}
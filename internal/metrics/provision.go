@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	provisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fly_tunnel_operator_provision_total",
+		Help: "Tunnel provisioning attempts, by outcome (success or failure).",
+	}, []string{"outcome"})
+
+	provisionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fly_tunnel_operator_provision_duration_seconds",
+		Help:    "Duration of tunnel provisioning attempts.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+
+	activeTunnels = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fly_tunnel_operator_active_tunnels",
+		Help: "Managed Services with a provisioned tunnel.",
+	})
+)
+
+var (
+	activeMu sync.Mutex
+	// active holds the tunnels counted by activeTunnels.
+	active = make(map[string]bool)
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(provisions, provisionDuration, activeTunnels)
+}
+
+// ObserveProvision records a provisioning attempt that took d and returned
+// err.
+func ObserveProvision(d time.Duration, err error) {
+	provisions.WithLabelValues(outcome(err)).Inc()
+	provisionDuration.Observe(d.Seconds())
+}
+
+// SetTunnelActive records whether tunnel is provisioned.
+func SetTunnelActive(tunnel string, isActive bool) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if isActive {
+		active[tunnel] = true
+	} else {
+		delete(active, tunnel)
+	}
+	activeTunnels.Set(float64(len(active)))
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveProvision(t *testing.T) {
+	succeeded := testutil.ToFloat64(provisions.WithLabelValues("success"))
+	failed := testutil.ToFloat64(provisions.WithLabelValues("failure"))
+
+	ObserveProvision(time.Second, nil)
+	ObserveProvision(time.Second, nil)
+	ObserveProvision(time.Second, errors.New("quota exceeded"))
+
+	if got := testutil.ToFloat64(provisions.WithLabelValues("success")) - succeeded; got != 2 {
+		t.Errorf("expected 2 successful provisions, got %v", got)
+	}
+	if got := testutil.ToFloat64(provisions.WithLabelValues("failure")) - failed; got != 1 {
+		t.Errorf("expected 1 failed provision, got %v", got)
+	}
+}
+
+func TestSetTunnelActive(t *testing.T) {
+	SetTunnelActive("default/web", true)
+	SetTunnelActive("default/api", true)
+	SetTunnelActive("default/web", true)
+	SetTunnelActive("default/api", false)
+	SetTunnelActive("default/gone", false)
+
+	if got := testutil.ToFloat64(activeTunnels); got != 1 {
+		t.Errorf("expected 1 active tunnel, got %v", got)
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Teardown steps, as labelled on fly_tunnel_operator_teardown_steps_total.
+const (
+	TeardownStepFrpcResources = "frpc-resources"
+	TeardownStepReleaseIP     = "release-ip"
+	TeardownStepDeleteMachine = "delete-machine"
+	TeardownStepDeleteApp     = "delete-app"
+)
+
+var (
+	teardownDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fly_tunnel_operator_teardown_duration_seconds",
+		Help:    "Duration of tunnel teardowns, by outcome (success or failure).",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"outcome"})
+
+	teardownsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fly_tunnel_operator_teardown_total",
+		Help: "Tunnel teardowns, by outcome (success or failure).",
+	}, []string{"outcome"})
+
+	teardownSteps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fly_tunnel_operator_teardown_steps_total",
+		Help: "Tunnel teardown steps, by step and outcome (success or failure).",
+	}, []string{"step", "outcome"})
+)
+
+var (
+	teardownMu sync.Mutex
+	// teardowns and teardownsFailed count teardowns since the last summary;
+	// stepsFailed counts failed steps by step.
+	teardowns, teardownsFailed int
+	stepsFailed                = make(map[string]int)
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(teardownDuration, teardownsTotal, teardownSteps)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// ObserveTeardown records a teardown that took d and returned err.
+func ObserveTeardown(d time.Duration, err error) {
+	teardownDuration.WithLabelValues(outcome(err)).Observe(d.Seconds())
+	teardownsTotal.WithLabelValues(outcome(err)).Inc()
+
+	teardownMu.Lock()
+	defer teardownMu.Unlock()
+	teardowns++
+	if err != nil {
+		teardownsFailed++
+	}
+}
+
+// ObserveTeardownStep records a teardown step that returned err.
+func ObserveTeardownStep(step string, err error) {
+	teardownSteps.WithLabelValues(step, outcome(err)).Inc()
+	if err == nil {
+		return
+	}
+
+	teardownMu.Lock()
+	defer teardownMu.Unlock()
+	stepsFailed[step]++
+}
+
+// takeTeardownCounts returns the teardown counts gathered since the previous
+// call and resets them.
+func takeTeardownCounts() (total, failed int, steps map[string]int) {
+	teardownMu.Lock()
+	defer teardownMu.Unlock()
+	total, failed, steps = teardowns, teardownsFailed, maps.Clone(stepsFailed)
+	teardowns, teardownsFailed = 0, 0
+	clear(stepsFailed)
+	return total, failed, steps
+}
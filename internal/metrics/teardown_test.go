@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveTeardown(t *testing.T) {
+	takeTeardownCounts()
+	before := testutil.ToFloat64(teardownSteps.WithLabelValues(TeardownStepDeleteApp, "failure"))
+	succeeded := testutil.ToFloat64(teardownsTotal.WithLabelValues("success"))
+
+	ObserveTeardownStep(TeardownStepReleaseIP, nil)
+	ObserveTeardownStep(TeardownStepDeleteApp, errors.New("boom"))
+	ObserveTeardown(time.Second, nil)
+	ObserveTeardown(time.Second, errors.New("interrupted"))
+
+	if got := testutil.ToFloat64(teardownSteps.WithLabelValues(TeardownStepDeleteApp, "failure")) - before; got != 1 {
+		t.Errorf("expected 1 failed delete-app step, got %v", got)
+	}
+	if got := testutil.ToFloat64(teardownsTotal.WithLabelValues("success")) - succeeded; got != 1 {
+		t.Errorf("expected 1 successful teardown, got %v", got)
+	}
+	total, failed, steps := takeTeardownCounts()
+	if total != 2 || failed != 1 || len(steps) != 1 || steps[TeardownStepDeleteApp] != 1 {
+		t.Errorf("unexpected counts: total %d, failed %d, steps %v", total, failed, steps)
+	}
+	if total, _, _ := takeTeardownCounts(); total != 0 {
+		t.Errorf("expected counts to reset, got total %d", total)
+	}
+}
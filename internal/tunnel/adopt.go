@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+// A Provision that dies after creating the Machine or IP but before anything
+// is recorded on the Service leaves them in its App. The next Provision
+// finds the App by its deterministic name and adopts them, rather than
+// creating duplicates and leaking the originals.
+
+// adoptMachine returns the Machine named name in the App flyAppName, or nil
+// if there is none.
+func (m *Manager) adoptMachine(ctx context.Context, flyAppName, name string) (*flyio.Machine, error) {
+	machines, err := m.flyClient.ListMachines(ctx, flyAppName)
+	if err != nil {
+		return nil, fmt.Errorf("listing machines: %w", err)
+	}
+	for i := range machines {
+		if machines[i].Name == name {
+			log.FromContext(ctx).Info("Adopting existing fly.io Machine", "machineID", machines[i].ID, "app", flyAppName)
+			return &machines[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// adoptIP returns a dedicated IPv4 of the App flyAppName, or nil if it has
+// none.
+func (m *Manager) adoptIP(ctx context.Context, flyAppName string) (*flyio.IPAddress, error) {
+	ips, err := m.flyClient.ListIPAddresses(ctx, flyAppName)
+	if err != nil {
+		return nil, fmt.Errorf("listing IPs: %w", err)
+	}
+	for i := range ips {
+		if ips[i].Type == "v4" {
+			log.FromContext(ctx).Info("Adopting existing dedicated IPv4", "address", ips[i].Address, "id", ips[i].ID, "app", flyAppName)
+			return &ips[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+// appDeletionBackoff is how long ensureApp first waits for Fly.io to finish
+// deleting a previous App with the tunnel's name, doubling on each of
+// appDeletionAttempts attempts.
+var (
+	appDeletionBackoff  = 2 * time.Second
+	appDeletionAttempts = 4
+)
+
+// ensureApp ensures a Fly App named name exists for svc and returns the name
+// it ended up with, and whether the App already existed. A Service deleted and recreated under the same name
+// races Fly.io's asynchronous App deletion; ensureApp waits a bounded time
+// for the old App to go and then falls back to a name suffixed with the
+// Service's UID, which the caller records like any other App name.
+//
+// An App that already exists, e.g. left by an attempt that died before
+// recording or rolling back anything, is reused as is; Provision then adopts
+// the Machine and IP it finds in it.
+func (m *Manager) ensureApp(ctx context.Context, svc *corev1.Service, name string) (string, bool, error) {
+	logger := log.FromContext(ctx)
+
+	app, err := m.flyClient.GetApp(ctx, name)
+	switch {
+	case err == nil:
+		if app.Organization.Slug != "" && app.Organization.Slug != m.config.FlyOrg {
+			return name, true, permanent(fmt.Errorf("fly.io App %s already exists in organization %s, not %s", name, app.Organization.Slug, m.config.FlyOrg))
+		}
+		logger.Info("Reusing existing fly.io App", "app", name, "status", app.Status)
+		return name, true, nil
+	case !errors.Is(err, flyio.ErrNotFound):
+		return name, false, err
+	}
+
+	backoff := appDeletionBackoff
+	for attempt := 1; ; attempt++ {
+		err := m.flyClient.EnsureApp(ctx, name, m.config.FlyOrg)
+		if !errors.Is(err, flyio.ErrAppPendingDeletion) {
+			return name, false, err
+		}
+		if attempt == appDeletionAttempts {
+			break
+		}
+		logger.Info("fly.io App name is pending deletion; waiting", "app", name, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return name, false, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	if svc.UID == "" {
+		return name, false, fmt.Errorf("fly.io App %s is still being deleted", name)
+	}
+	fallback := sanitizeName(fmt.Sprintf("%s-%s", name, svc.UID))
+	logger.Info("fly.io App name still pending deletion; using a new name", "app", name, "fallback", fallback)
+	m.event(svc, corev1.EventTypeNormal, "AppNamePendingDeletion",
+		"fly.io App %s is still being deleted; provisioning App %s instead", name, fallback)
+	return fallback, false, m.flyClient.EnsureApp(ctx, fallback, m.config.FlyOrg)
+}
@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+func TestProvision_AppNamePendingDeletion(t *testing.T) {
+	defer func(backoff time.Duration) { appDeletionBackoff = backoff }(appDeletionBackoff)
+	appDeletionBackoff = time.Millisecond
+
+	tests := []struct {
+		name        string
+		drain       int
+		wantRenamed bool
+	}{
+		{name: "deletion completes while waiting", drain: appDeletionAttempts - 1},
+		{name: "deletion outlasts the wait", drain: appDeletionAttempts + 1, wantRenamed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+			server.AppDeletionDrain = tt.drain
+
+			scheme := runtime.NewScheme()
+			_ = clientgoscheme.AddToScheme(scheme)
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fly-tunnel-operator-system"}}
+			kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(ns).Build()
+			flyClient := flyio.NewClient("test-token").
+				WithBaseURL(server.URL).
+				WithGraphQLURL(server.URL + "/graphql")
+			m := NewManager(flyClient, kubeClient, Config{
+				FlyOrg:            "personal",
+				FlyRegion:         "syd",
+				OperatorNamespace: ns.Name,
+			})
+
+			// A previous Service of the same name was just torn down.
+			svc := desiredTestService(0)
+			conventional := flyAppNameForService(svc, "personal")
+			if err := flyClient.EnsureApp(context.Background(), conventional, "personal"); err != nil {
+				t.Fatalf("creating previous app: %v", err)
+			}
+			if err := flyClient.DeleteApp(context.Background(), conventional); err != nil {
+				t.Fatalf("deleting previous app: %v", err)
+			}
+
+			result, err := m.Provision(context.Background(), svc)
+			if err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+			if renamed := result.FlyApp != conventional; renamed != tt.wantRenamed {
+				t.Errorf("expected renamed=%v, got app %q", tt.wantRenamed, result.FlyApp)
+			}
+			if !server.HasApp(result.FlyApp) || server.AppCount() != 1 {
+				t.Errorf("expected exactly the reported app %q to exist, got %d apps", result.FlyApp, server.AppCount())
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+// auditConfigMapKey holds the audit records as newline-delimited JSON,
+// oldest first.
+const auditConfigMapKey = "records.jsonl"
+
+// ConfigMapAuditSink keeps the most recent fly.io audit records in a
+// ConfigMap, dropping the oldest once the ring buffer is full.
+type ConfigMapAuditSink struct {
+	kubeClient client.Client
+	namespace  string
+	name       string
+	size       int
+
+	mu sync.Mutex
+}
+
+// NewConfigMapAuditSink creates a sink that keeps the last size records in the
+// named ConfigMap, creating it on first use.
+func NewConfigMapAuditSink(kubeClient client.Client, namespace, name string, size int) *ConfigMapAuditSink {
+	return &ConfigMapAuditSink{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		name:       name,
+		size:       size,
+	}
+}
+
+// Record appends record to the ring buffer. Failures are logged rather than
+// returned so that auditing never fails the fly.io call being audited.
+func (s *ConfigMapAuditSink) Record(ctx context.Context, record flyio.AuditRecord) {
+	if err := s.append(ctx, record); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to write audit record to ConfigMap",
+			"configMap", s.namespace+"/"+s.name, "op", record.Op)
+	}
+}
+
+func (s *ConfigMapAuditSink) append(ctx context.Context, record flyio.AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshaling audit record: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var cm corev1.ConfigMap
+		err := s.kubeClient.Get(ctx, types.NamespacedName{Name: s.name, Namespace: s.namespace}, &cm)
+		if apierrors.IsNotFound(err) {
+			cm = corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+					Labels: map[string]string{
+						"app.kubernetes.io/managed-by": "fly-tunnel-operator",
+					},
+				},
+				Data: map[string]string{auditConfigMapKey: string(line) + "\n"},
+			}
+			return s.kubeClient.Create(ctx, &cm)
+		}
+		if err != nil {
+			return fmt.Errorf("getting audit ConfigMap: %w", err)
+		}
+
+		lines := strings.Split(strings.TrimRight(cm.Data[auditConfigMapKey], "\n"), "\n")
+		if len(lines) == 1 && lines[0] == "" {
+			lines = nil
+		}
+		lines = append(lines, string(line))
+		if len(lines) > s.size {
+			lines = lines[len(lines)-s.size:]
+		}
+
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[auditConfigMapKey] = strings.Join(lines, "\n") + "\n"
+		return s.kubeClient.Update(ctx, &cm)
+	})
+}
@@ -0,0 +1,50 @@
+package tunnel_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestConfigMapAuditSink_RingBuffer(t *testing.T) {
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).Build()
+	sink := tunnel.NewConfigMapAuditSink(kubeClient, testNamespace, "fly-audit", 3)
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		sink.Record(ctx, flyio.AuditRecord{
+			Op:       "CreateMachine",
+			App:      "audit-app",
+			Resource: fmt.Sprintf("m-%d", i),
+			Result:   flyio.AuditResultSuccess,
+		})
+	}
+
+	var cm corev1.ConfigMap
+	if err := kubeClient.Get(ctx, types.NamespacedName{Name: "fly-audit", Namespace: testNamespace}, &cm); err != nil {
+		t.Fatalf("getting audit ConfigMap: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(cm.Data["records.jsonl"]), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 records retained, got %d", len(lines))
+	}
+	for i, line := range lines {
+		var rec flyio.AuditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("record %d is not valid JSON: %v", i, err)
+		}
+		if want := fmt.Sprintf("m-%d", i+2); rec.Resource != want {
+			t.Errorf("record %d: expected resource %q, got %q", i, want, rec.Resource)
+		}
+	}
+}
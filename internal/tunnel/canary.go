@@ -0,0 +1,254 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+const (
+	// AnnotationFrpcCanary set to "true" rolls frpc config changes out to
+	// a canary first. The primary frpc keeps its config, and a one-replica
+	// Deployment named <frpc>-canary runs the new one next to it; frps
+	// balances connections across both. The canary goes away once the
+	// config matches the primary again: after a promotion, or when the
+	// change is reverted on the Service.
+	AnnotationFrpcCanary = "fly-tunnel-operator.dev/frpc-canary"
+
+	// AnnotationFrpcCanaryPromote promotes the canary config to the
+	// primary frpc whenever its value changes.
+	AnnotationFrpcCanaryPromote = "fly-tunnel-operator.dev/frpc-canary-promote"
+
+	// AnnotationFrpcCanaryPromoteObserved records the last
+	// AnnotationFrpcCanaryPromote value acted upon.
+	AnnotationFrpcCanaryPromoteObserved = "fly-tunnel-operator.dev/frpc-canary-promote-observed"
+
+	// AnnotationFrpcConfigHash and AnnotationFrpcCanaryConfigHash record the
+	// SHA-256 of the primary and canary frpc configs in canary mode.
+	AnnotationFrpcConfigHash       = "fly-tunnel-operator.dev/frpc-config-hash"
+	AnnotationFrpcCanaryConfigHash = "fly-tunnel-operator.dev/frpc-canary-config-hash"
+)
+
+// canaryMode reports whether svc rolls frpc config changes out to a canary.
+func canaryMode(svc *corev1.Service) bool {
+	return svc.Annotations[AnnotationFrpcCanary] == "true"
+}
+
+// promotionRequested reports whether svc asks for a canary promotion it has
+// not been given yet.
+func promotionRequested(svc *corev1.Service) bool {
+	requested := svc.Annotations[AnnotationFrpcCanaryPromote]
+	return requested != "" && requested != svc.Annotations[AnnotationFrpcCanaryPromoteObserved]
+}
+
+// validateCanary returns an error if svc combines canary mode with
+// options it cannot work with.
+func validateCanary(svc *corev1.Service) error {
+	if canaryMode(svc) && frp.RandomRemotePorts(svc) {
+		// The canary would be handed its own ports.
+		return fmt.Errorf("%s cannot be combined with %s", AnnotationFrpcCanary, frp.AnnotationRandomRemotePorts)
+	}
+	return nil
+}
+
+// canaryDeploymentName returns the name of the canary frpc Deployment of
+// the frpc Deployment deployName.
+func canaryDeploymentName(deployName string) string {
+	return sanitizeName(deployName + "-canary")
+}
+
+// deployFrpcCanary applies desired to the frpc of svc in canary mode. The
+// primary frpc keeps the config it has, moved to the current frps address
+// and token, unless a promotion is requested; desired goes to the canary if
+// it differs. It reports whether it wrote any frpc Secret or Deployment.
+func (m *Manager) deployFrpcCanary(ctx context.Context, svc *corev1.Service, namespace string, desired *desiredState, secrets tunnelSecrets) (bool, error) {
+	logger := log.FromContext(ctx)
+	annotations := map[string]string{annotationOwner: svc.Namespace + "/" + svc.Name}
+	extraData := frpcSecretData(secrets)
+
+	primary, canary := desired, (*desiredState)(nil)
+	promote := promotionRequested(svc)
+	if !promote {
+		current, err := m.primaryFrpcConfig(ctx, namespace, desired)
+		if err != nil {
+			return false, err
+		}
+		if current != "" && current != desired.frpcConfig {
+			primary = m.withFrpcConfig(desired, current)
+			canary = m.canaryState(desired)
+		}
+	}
+
+	changed, err := m.applyFrpc(ctx, namespace, primary, serviceLabelValue(svc), annotations, extraData)
+	if err != nil {
+		return false, err
+	}
+	canaryName := canaryDeploymentName(desired.frpcDeploymentName)
+	if canary != nil {
+		logger.Info("Running frpc config change on canary", "name", canaryName)
+		canaryChanged, err := m.applyFrpc(ctx, namespace, canary, serviceLabelValue(svc), annotations, extraData)
+		if err != nil {
+			return false, fmt.Errorf("deploying frpc canary: %w", err)
+		}
+		changed = changed || canaryChanged
+		if err := m.stampCanary(ctx, svc, namespace, canaryName); err != nil {
+			return false, err
+		}
+	} else if err := m.removeCanary(ctx, namespace, canaryName); err != nil {
+		return false, err
+	}
+	if promote {
+		logger.Info("Promoted frpc canary config", "name", desired.frpcDeploymentName)
+		m.event(svc, corev1.EventTypeNormal, "FrpcCanaryPromoted", "Promoted the canary frpc config to %s", desired.frpcDeploymentName)
+	}
+
+	record := map[string]string{AnnotationFrpcConfigHash: primary.frpcConfigHash}
+	if canary != nil {
+		record[AnnotationFrpcCanaryConfigHash] = canary.frpcConfigHash
+	}
+	if promote {
+		record[AnnotationFrpcCanaryPromoteObserved] = svc.Annotations[AnnotationFrpcCanaryPromote]
+	} else if observed, ok := svc.Annotations[AnnotationFrpcCanaryPromoteObserved]; ok {
+		record[AnnotationFrpcCanaryPromoteObserved] = observed
+	}
+	return changed, m.recordCanary(ctx, svc, record)
+}
+
+// leaveCanaryMode removes the canary of a Service no longer in canary mode,
+// and its records.
+func (m *Manager) leaveCanaryMode(ctx context.Context, svc *corev1.Service, namespace, deployName string) error {
+	if err := m.removeCanary(ctx, namespace, canaryDeploymentName(deployName)); err != nil {
+		return err
+	}
+	return m.recordCanary(ctx, svc, nil)
+}
+
+// canaryRecords are the annotations recordCanary maintains.
+var canaryRecords = []string{
+	AnnotationFrpcConfigHash,
+	AnnotationFrpcCanaryConfigHash,
+	AnnotationFrpcCanaryPromoteObserved,
+}
+
+// recordCanary sets the canary records of svc to record, removing those it
+// does not name, if they differ.
+func (m *Manager) recordCanary(ctx context.Context, svc *corev1.Service, record map[string]string) error {
+	changed := false
+	for _, key := range canaryRecords {
+		if value, ok := svc.Annotations[key]; value != record[key] || ok != (record[key] != "") {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	patch := client.MergeFrom(svc.DeepCopy())
+	if svc.Annotations == nil {
+		svc.Annotations = make(map[string]string)
+	}
+	for _, key := range canaryRecords {
+		if value := record[key]; value != "" {
+			svc.Annotations[key] = value
+		} else {
+			delete(svc.Annotations, key)
+		}
+	}
+	if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("recording frpc canary state: %w", err)
+	}
+	return nil
+}
+
+// primaryFrpcConfig returns the config the primary frpc of desired runs,
+// rendered for the frps address, token and load balancing of desired, or ""
+// if it has none yet.
+func (m *Manager) primaryFrpcConfig(ctx context.Context, namespace string, desired *desiredState) (string, error) {
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: desired.frpcConfigName, Namespace: namespace}
+	if err := m.kubeClient.Get(ctx, key, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("getting frpc config secret: %w", err)
+	}
+	current, err := frp.ParseClientConfig(string(secret.Data["frpc.toml"]))
+	if err != nil {
+		// Nothing to keep: the primary gets the desired config.
+		return "", nil
+	}
+	want, err := frp.ParseClientConfig(desired.frpcConfig)
+	if err != nil {
+		return "", fmt.Errorf("parsing desired frpc config: %w", err)
+	}
+	current.ServerAddr, current.ServerPort = want.ServerAddr, want.ServerPort
+	current.Auth, current.User = want.Auth, want.User
+	// Reconnect settings come with the operator, not the Service.
+	current.LoginFailExit = want.LoginFailExit
+	if current.Transport == nil {
+		current.Transport = &frp.ClientTransport{}
+	}
+	current.Transport.DialServerTimeout = want.Transport.DialServerTimeout
+	current.Transport.HeartbeatInterval = want.Transport.HeartbeatInterval
+	current.Transport.HeartbeatTimeout = want.Transport.HeartbeatTimeout
+	if groupKey := loadBalancerGroupKeyOf(want); groupKey != "" {
+		current.EnableLoadBalancing(groupKey)
+	}
+	return current.TOML(), nil
+}
+
+// loadBalancerGroupKeyOf returns the key the proxies of c join their load
+// balancing groups with, or "".
+func loadBalancerGroupKeyOf(c *frp.ClientConfig) string {
+	for _, proxy := range c.Proxies {
+		if proxy.LoadBalancer != nil {
+			return proxy.LoadBalancer.GroupKey
+		}
+	}
+	return ""
+}
+
+// withFrpcConfig returns a copy of desired running config.
+func (m *Manager) withFrpcConfig(desired *desiredState, config string) *desiredState {
+	state := *desired
+	state.frpcConfig = config
+	state.frpcConfigHash = fmt.Sprintf("%x", sha256.Sum256([]byte(config)))
+	state.frpcDeployment = m.frpcDeploymentSpec(&state)
+	return &state
+}
+
+// canaryState returns the state of the one-replica canary of desired.
+func (m *Manager) canaryState(desired *desiredState) *desiredState {
+	state := *desired
+	state.frpcDeploymentName = canaryDeploymentName(desired.frpcDeploymentName)
+	state.frpcConfigName = frpcConfigName(state.frpcDeploymentName)
+	state.frpcReplicas = 1
+	state.frpcDeployment = m.frpcDeploymentSpec(&state)
+	return &state
+}
+
+// removeCanary deletes the canary frpc Deployment canaryName and its config
+// from namespace, if there is one.
+func (m *Manager) removeCanary(ctx context.Context, namespace, canaryName string) error {
+	var deploy appsv1.Deployment
+	err := m.kubeClient.Get(ctx, types.NamespacedName{Name: canaryName, Namespace: namespace}, &deploy)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting frpc canary deployment: %w", err)
+	}
+	log.FromContext(ctx).Info("Removing frpc canary", "name", canaryName)
+	if err := m.deleteFrpcResources(ctx, namespace, canaryName); err != nil {
+		return fmt.Errorf("removing frpc canary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package tunnel_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestUpdate_FrpcCanary(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	svc.Annotations[tunnel.AnnotationFrpcCanary] = "true"
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), svc).Build()
+	recorder := record.NewFakeRecorder(100)
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig()).WithEventRecorder(recorder)
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), svc); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	annotateTunnelState(svc, result)
+
+	primary := result.FrpcDeployment
+	canary := primary + "-canary"
+	update := func() {
+		t.Helper()
+		if err := kubeClient.Update(context.Background(), svc); err != nil {
+			t.Fatalf("updating service: %v", err)
+		}
+		if _, err := mgr.Update(context.Background(), svc); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), svc); err != nil {
+			t.Fatalf("getting service: %v", err)
+		}
+	}
+	poolCount := func(deployName string) int {
+		t.Helper()
+		c, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, deployName))
+		if err != nil {
+			t.Fatalf("parsing frpc config: %v", err)
+		}
+		if c.Proxies[0].LoadBalancer == nil {
+			t.Errorf("expected %s to share its proxies in a load balancing group", deployName)
+		}
+		if c.Transport == nil {
+			return 0
+		}
+		return c.Transport.PoolCount
+	}
+	canaryExists := func() bool {
+		t.Helper()
+		var deploy appsv1.Deployment
+		err := kubeClient.Get(context.Background(), types.NamespacedName{Name: canary, Namespace: testNamespace}, &deploy)
+		if err != nil && !apierrors.IsNotFound(err) {
+			t.Fatalf("getting canary: %v", err)
+		}
+		if err == nil && *deploy.Spec.Replicas != 1 {
+			t.Errorf("expected a one-replica canary, got %d", *deploy.Spec.Replicas)
+		}
+		return err == nil
+	}
+
+	// Without a config change there is no canary.
+	update()
+	if canaryExists() {
+		t.Fatal("expected no canary without a config change")
+	}
+	if svc.Annotations[tunnel.AnnotationFrpcConfigHash] == "" {
+		t.Error("expected the primary config hash to be recorded")
+	}
+
+	// A config change goes to the canary only.
+	svc.Annotations[frp.AnnotationPoolCount] = "3"
+	update()
+	if !canaryExists() {
+		t.Fatal("expected a canary for the config change")
+	}
+	if got := poolCount(canary); got != 3 {
+		t.Errorf("expected the canary to run the new config, got pool count %d", got)
+	}
+	if got := poolCount(primary); got != 0 {
+		t.Errorf("expected the primary to keep its config, got pool count %d", got)
+	}
+	primaryHash, canaryHash := svc.Annotations[tunnel.AnnotationFrpcConfigHash], svc.Annotations[tunnel.AnnotationFrpcCanaryConfigHash]
+	if primaryHash == "" || canaryHash == "" || primaryHash == canaryHash {
+		t.Errorf("expected distinct primary and canary hashes, got %q and %q", primaryHash, canaryHash)
+	}
+
+	// Aborting: reverting the change removes the canary.
+	delete(svc.Annotations, frp.AnnotationPoolCount)
+	update()
+	if canaryExists() {
+		t.Error("expected the canary to be removed once the change is reverted")
+	}
+	if _, ok := svc.Annotations[tunnel.AnnotationFrpcCanaryConfigHash]; ok {
+		t.Error("expected the canary hash to be cleared")
+	}
+
+	// Promoting moves the canary config to the primary.
+	svc.Annotations[frp.AnnotationPoolCount] = "3"
+	update()
+	if !canaryExists() {
+		t.Fatal("expected a canary for the config change")
+	}
+	svc.Annotations[tunnel.AnnotationFrpcCanaryPromote] = "1"
+	update()
+	if canaryExists() {
+		t.Error("expected the canary to be removed once promoted")
+	}
+	if got := poolCount(primary); got != 3 {
+		t.Errorf("expected the primary to run the promoted config, got pool count %d", got)
+	}
+	if got := svc.Annotations[tunnel.AnnotationFrpcCanaryPromoteObserved]; got != "1" {
+		t.Errorf("expected the promotion to be recorded, got %q", got)
+	}
+	var promoted bool
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, "FrpcCanaryPromoted") {
+			promoted = true
+		}
+	}
+	if !promoted {
+		t.Error("expected a FrpcCanaryPromoted event")
+	}
+
+	// The next change gets a canary again, which teardown removes.
+	svc.Annotations[frp.AnnotationPoolCount] = "4"
+	update()
+	if !canaryExists() {
+		t.Fatal("expected a canary for the next config change")
+	}
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if canaryExists() {
+		t.Error("expected teardown to remove the canary")
+	}
+}
+
+func TestUpdate_LeavingFrpcCanaryMode(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	svc.Annotations[tunnel.AnnotationFrpcCanary] = "true"
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), svc).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), svc); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	svc.Annotations[frp.AnnotationPoolCount] = "3"
+	if err := kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	// Leaving canary mode applies the change to the primary directly.
+	delete(svc.Annotations, tunnel.AnnotationFrpcCanary)
+	if err := kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment + "-canary", Namespace: testNamespace}, &deploy); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the canary to be removed, got %v", err)
+	}
+	c, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+	if err != nil {
+		t.Fatalf("parsing frpc config: %v", err)
+	}
+	if c.Transport == nil || c.Transport.PoolCount != 3 || c.Proxies[0].LoadBalancer != nil {
+		t.Errorf("expected the primary to run the change without load balancing, got %+v", c)
+	}
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), svc); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	if _, ok := svc.Annotations[tunnel.AnnotationFrpcConfigHash]; ok {
+		t.Error("expected the canary records to be cleared")
+	}
+}
@@ -0,0 +1,40 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AnnotationOperatorIdentity records which operator manages the tunnel of a
+// Service, as its Fly.io org, cluster name and the Service's
+// loadBalancerClass. Operators with another identity leave the Service alone.
+const AnnotationOperatorIdentity = "fly-tunnel-operator.dev/operator-identity"
+
+// ErrClaimedByOtherOperator is returned for a Service whose tunnel is
+// managed by an operator with another identity.
+var ErrClaimedByOtherOperator = errors.New("service is claimed by another operator")
+
+// Identity returns the AnnotationOperatorIdentity value m claims svc with.
+func (m *Manager) Identity(svc *corev1.Service) string {
+	class := ""
+	if svc.Spec.LoadBalancerClass != nil {
+		class = *svc.Spec.LoadBalancerClass
+	}
+	return fmt.Sprintf("org=%s,cluster=%s,class=%s", m.config.FlyOrg, m.config.ClusterName, class)
+}
+
+// CheckClaim returns an error wrapping ErrClaimedByOtherOperator, and
+// records a Warning event, if svc is claimed by an operator with another
+// identity. Unclaimed Services may be claimed by any operator.
+func (m *Manager) CheckClaim(svc *corev1.Service) error {
+	claimed := svc.Annotations[AnnotationOperatorIdentity]
+	if claimed == "" || claimed == m.Identity(svc) {
+		return nil
+	}
+	m.event(svc, corev1.EventTypeWarning, "ClaimedByOtherOperator",
+		"Tunnel is managed by the operator with identity %q, not this one (%q); leaving the Service alone. Remove %s to hand it over",
+		claimed, m.Identity(svc), AnnotationOperatorIdentity)
+	return fmt.Errorf("%w: %s, not %s", ErrClaimedByOtherOperator, claimed, m.Identity(svc))
+}
@@ -0,0 +1,75 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestClaim_OtherOperatorLeavesClaimedService(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	config := newTestConfig()
+	config.ClusterName = "prod"
+	owner := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	result, err := owner.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if result.OperatorIdentity != owner.Identity(svc) {
+		t.Fatalf("expected Provision to claim the Service as %q, got %q", owner.Identity(svc), result.OperatorIdentity)
+	}
+	annotateTunnelState(svc, result)
+	svc.Annotations[tunnel.AnnotationOperatorIdentity] = result.OperatorIdentity
+	if err := owner.CheckClaim(svc); err != nil {
+		t.Fatalf("expected the owner to pass its own claim, got %v", err)
+	}
+
+	// A second operator for another org, watching the same class.
+	otherConfig := newTestConfig()
+	otherConfig.FlyOrg = "other-org"
+	otherConfig.ClusterName = "prod"
+	recorder := record.NewFakeRecorder(10)
+	other := tunnel.NewManager(newTestFlyClient(server), kubeClient, otherConfig).WithEventRecorder(recorder)
+
+	updates := 0
+	server.OnUpdateMachine = func(appName, machineID string, input flyio.CreateMachineInput) error {
+		updates++
+		return nil
+	}
+	svc.Spec.Ports[0].Port = 8080
+	if _, err := other.Update(context.Background(), svc); !errors.Is(err, tunnel.ErrClaimedByOtherOperator) {
+		t.Fatalf("expected ErrClaimedByOtherOperator, got %v", err)
+	}
+	if updates != 0 {
+		t.Errorf("expected no Machine updates by the other operator, got %d", updates)
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, "Warning ClaimedByOtherOperator") || !strings.Contains(e, "org=personal,cluster=prod") {
+			t.Errorf("unexpected event %q", e)
+		}
+	default:
+		t.Error("expected a ClaimedByOtherOperator event")
+	}
+
+	if err := other.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if server.MachineCount() != 1 || server.AppCount() != 1 {
+		t.Errorf("expected the other operator to leave the tunnel, got %d machines and %d apps", server.MachineCount(), server.AppCount())
+	}
+}
@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ClassDefaults replace Config.FlyRegion and Config.FlyMachineSize for the
+// Services of one loadBalancerClass. Empty fields keep the operator-wide
+// value, and the Service annotations still take precedence.
+type ClassDefaults struct {
+	FlyRegion      string `json:"region,omitempty"`
+	FlyMachineSize string `json:"machineSize,omitempty"`
+}
+
+// ParseClassDefaults parses a JSON object of ClassDefaults keyed by
+// loadBalancerClass, e.g.
+// {"example.com/premium": {"region": "ord", "machineSize": "performance-1x"}}.
+func ParseClassDefaults(s string) (map[string]ClassDefaults, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var defaults map[string]ClassDefaults
+	if err := json.Unmarshal([]byte(s), &defaults); err != nil {
+		return nil, fmt.Errorf("class defaults must be a JSON object keyed by loadBalancerClass: %w", err)
+	}
+	return defaults, nil
+}
+
+// classDefaults returns the ClassDefaults of the loadBalancerClass of svc.
+func (m *Manager) classDefaults(svc *corev1.Service) ClassDefaults {
+	if svc == nil || svc.Spec.LoadBalancerClass == nil {
+		return ClassDefaults{}
+	}
+	return m.config.ClassDefaults[*svc.Spec.LoadBalancerClass]
+}
+
+// defaultRegion returns the region of svc absent AnnotationFlyRegion.
+func (m *Manager) defaultRegion(svc *corev1.Service) string {
+	if region := m.classDefaults(svc).FlyRegion; region != "" {
+		return region
+	}
+	return m.config.FlyRegion
+}
+
+// defaultMachineSize returns the Machine size of svc absent
+// AnnotationFlyMachineSize.
+func (m *Manager) defaultMachineSize(svc *corev1.Service) string {
+	if size := m.classDefaults(svc).FlyMachineSize; size != "" {
+		return size
+	}
+	return m.config.FlyMachineSize
+}
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// ProxyStatusReader reads the status frpc reports for a tunnel's proxies.
+type ProxyStatusReader interface {
+	ProxyStatuses(ctx context.Context, namespace, deploymentName string) ([]frp.ProxyStatus, error)
+}
+
+// WithProxyStatusReader overrides how frpc's proxy status is read.
+func (m *Manager) WithProxyStatusReader(r ProxyStatusReader) *Manager {
+	m.proxyStatus = r
+	return m
+}
+
+// ControlChannelStatus reports whether the frpc of svc holds a control
+// connection to frps. Where frpc's admin API is enabled, the channel is up
+// once any proxy is running, and message otherwise carries the error frpc
+// reports; elsewhere it falls back to the frpc pod's readiness. An error is
+// returned only when the status could not be determined.
+func (m *Manager) ControlChannelStatus(ctx context.Context, svc *corev1.Service) (connected bool, message string, err error) {
+	if !frp.RandomRemotePorts(svc) {
+		ready, _, err := m.FrpcReady(ctx, svc)
+		if err != nil {
+			return false, "", err
+		}
+		if !ready {
+			return false, "frpc has no ready pod", nil
+		}
+		return true, "", nil
+	}
+
+	statuses, err := m.proxyStatus.ProxyStatuses(ctx, m.frpcNamespace(svc), frpcDeploymentName(svc))
+	if err != nil {
+		// An unreachable admin API means frpc isn't running, which is as
+		// disconnected as it gets.
+		return false, err.Error(), nil
+	}
+	connected, message = controlChannelFromStatus(statuses)
+	return connected, message, nil
+}
+
+// controlChannelFromStatus derives the control channel state from frpc's
+// proxy status: proxies only run once frpc has logged in to frps.
+func controlChannelFromStatus(statuses []frp.ProxyStatus) (bool, string) {
+	var firstErr string
+	for _, st := range statuses {
+		if st.Status == "running" {
+			return true, ""
+		}
+		if st.Err != "" && firstErr == "" {
+			firstErr = fmt.Sprintf("proxy %s: %s", st.Name, st.Err)
+		}
+	}
+	if firstErr == "" {
+		return false, "no proxy is running"
+	}
+	return false, firstErr
+}
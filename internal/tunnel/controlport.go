@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+const (
+	// AnnotationFrpControlPort overrides, for one Service, the port frpc
+	// connects to frps on.
+	AnnotationFrpControlPort = "fly-tunnel-operator.dev/frp-control-port"
+
+	// AnnotationControlPort records the frps control port chosen at
+	// Provision, so later updates keep frpc and frps on it.
+	AnnotationControlPort = "fly-tunnel-operator.dev/control-port"
+)
+
+// controlPort returns the frps control port recorded on svc. Tunnels
+// provisioned before the port was recorded use frp.DefaultServerPort.
+func controlPort(svc *corev1.Service) int {
+	if port, err := strconv.Atoi(svc.Annotations[AnnotationControlPort]); err == nil && port > 0 {
+		return port
+	}
+	return frp.DefaultServerPort
+}
+
+// parseControlPort returns the port requested by AnnotationFrpControlPort, or
+// 0 if the annotation is absent.
+func parseControlPort(svc *corev1.Service) (int, error) {
+	value := svc.Annotations[AnnotationFrpControlPort]
+	if value == "" {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid %s %q: must be a port number between 1 and 65535", AnnotationFrpControlPort, value)
+	}
+	return port, nil
+}
+
+// publicControlPorts returns the ports svc publishes on its Machine that the
+// control port must not take: TCP ports, and UDP ports too when frpc reaches
+// frps over UDP. frps assigns random remote ports itself and never hands out
+// the port it listens on, so those are left out; vhost ports always count.
+func publicControlPorts(svc *corev1.Service) map[int]bool {
+	udp := frp.TransportUsesUDP(frp.TransportProtocol(svc))
+	ports := make(map[int]bool)
+	for _, port := range frp.PublishedPorts(svc) {
+		if port.RemotePort != 0 && (port.Protocol == "tcp" || (udp && port.Protocol == "udp")) {
+			ports[port.RemotePort] = true
+		}
+	}
+	if frp.DashboardEnabled(svc) {
+		ports[frp.DefaultDashboardPort] = true
+	}
+	return ports
+}
+
+// chooseControlPort picks the frps control port for a new tunnel. A port
+// requested through AnnotationFrpControlPort must not clash with a port the
+// Service publishes; the operator default moves up to the next free port
+// instead.
+func (m *Manager) chooseControlPort(svc *corev1.Service) (int, error) {
+	taken := publicControlPorts(svc)
+
+	requested, err := parseControlPort(svc)
+	if err != nil {
+		return 0, err
+	}
+	if requested > 0 {
+		if taken[requested] {
+			return 0, fmt.Errorf("%s %d conflicts with a port the Service publishes", AnnotationFrpControlPort, requested)
+		}
+		return requested, nil
+	}
+
+	start := m.config.ControlPort
+	if start == 0 {
+		start = frp.DefaultServerPort
+	}
+	port := start
+	for taken[port] {
+		port++
+		if port > 65535 {
+			return 0, fmt.Errorf("no free frps control port at or above %d", start)
+		}
+	}
+	return port, nil
+}
+
+// checkControlPort returns an error if svc now publishes its tunnel's
+// recorded control port, which would shadow frps on the Machine.
+func checkControlPort(svc *corev1.Service) error {
+	if port := controlPort(svc); publicControlPorts(svc)[port] {
+		return fmt.Errorf("port %d is the tunnel's frps control port (%s) and cannot also be published; recreate the Service to move the control port", port, AnnotationControlPort)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestProvision_ServicePublishingControlPort(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("frp", "default",
+		corev1.ServicePort{Name: "frp", Port: 7000, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "frp-next", Port: 7001, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if result.ControlPort != 7002 {
+		t.Fatalf("expected the control port to move to the next free port 7002, got %d", result.ControlPort)
+	}
+
+	machine := server.GetMachines()[result.MachineID]
+	for _, port := range []int{7000, 7001, 7002} {
+		if !exposesPort(machine, port) {
+			t.Errorf("expected port %d on the Machine", port)
+		}
+	}
+	if config := server.AppSecrets(result.FlyApp)["FRP_SERVER_CONFIG"]; !strings.Contains(config, "bindPort = 7002") {
+		t.Errorf("expected frps to listen on 7002:\n%s", config)
+	}
+	if config := frpcConfig(t, kubeClient, result.FrpcDeployment); !strings.Contains(config, "serverPort = 7002") {
+		t.Errorf("expected frpc to connect on 7002:\n%s", config)
+	}
+
+	// Update keeps the recorded port.
+	annotateTunnelState(svc, result)
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if config := frpcConfig(t, kubeClient, result.FrpcDeployment); !strings.Contains(config, "serverPort = 7002") {
+		t.Errorf("expected frpc to stay on 7002 after Update:\n%s", config)
+	}
+}
+
+func TestProvision_ControlPortAnnotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		wantPort int
+		wantErr  string
+	}{
+		{name: "free port", value: "9000", wantPort: 9000},
+		{name: "published port", value: "80", wantErr: "conflicts with a port the Service publishes"},
+		{name: "invalid", value: "70000", wantErr: "invalid " + tunnel.AnnotationFrpControlPort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+			mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+			svc := testService("web", "default",
+				corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			)
+			svc.Annotations[tunnel.AnnotationFrpControlPort] = tt.value
+			result, err := mgr.Provision(context.Background(), svc)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.Is(err, tunnel.ErrPermanent) {
+					t.Fatalf("expected a permanent error containing %q, got %v", tt.wantErr, err)
+				}
+				if server.AppCount() != 0 {
+					t.Errorf("expected nothing to be created, got %d apps", server.AppCount())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+			if result.ControlPort != tt.wantPort {
+				t.Errorf("expected control port %d, got %d", tt.wantPort, result.ControlPort)
+			}
+		})
+	}
+}
+
+func TestUpdate_RejectsPublishingControlPort(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+
+	svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: "frp", Port: 7000, Protocol: corev1.ProtocolTCP})
+	if _, err := mgr.Update(context.Background(), svc); err == nil || !strings.Contains(err.Error(), "control port") {
+		t.Fatalf("expected Update to reject publishing the control port, got %v", err)
+	}
+}
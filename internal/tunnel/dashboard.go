@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// AnnotationFrpsDashboardSecret names the Secret in the operator namespace
+// holding the frps dashboard credentials of a tunnel with the dashboard
+// enabled.
+const AnnotationFrpsDashboardSecret = "fly-tunnel-operator.dev/frps-dashboard-secret"
+
+// dashboardUser is the frps dashboard login; only the password is secret.
+const dashboardUser = "admin"
+
+// dashboardSecretName returns the name of the dashboard credentials Secret
+// for svc.
+func dashboardSecretName(svc *corev1.Service) string {
+	return tunnelNameForService(svc) + "-dashboard"
+}
+
+// ensureDashboard returns the frps dashboard credentials for svc, generating
+// them into a Secret in the operator namespace on first use. It returns nil
+// if svc does not enable the dashboard.
+func (m *Manager) ensureDashboard(ctx context.Context, svc *corev1.Service) (*frp.Dashboard, error) {
+	if !frp.DashboardEnabled(svc) {
+		return nil, nil
+	}
+
+	name := dashboardSecretName(svc)
+	var existing corev1.Secret
+	err := m.kubeClient.Get(ctx, types.NamespacedName{Name: name, Namespace: m.config.OperatorNamespace}, &existing)
+	if err == nil {
+		return &frp.Dashboard{
+			User:     string(existing.Data[corev1.BasicAuthUsernameKey]),
+			Password: string(existing.Data[corev1.BasicAuthPasswordKey]),
+		}, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("getting frps dashboard secret: %w", err)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("generating frps dashboard password: %w", err)
+	}
+	dashboard := &frp.Dashboard{User: dashboardUser, Password: hex.EncodeToString(b)}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: m.config.OperatorNamespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       "frps-dashboard",
+				"app.kubernetes.io/managed-by": "fly-tunnel-operator",
+				labelService:                   serviceLabelValue(svc),
+			},
+		},
+		Type: corev1.SecretTypeBasicAuth,
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte(dashboard.User),
+			corev1.BasicAuthPasswordKey: []byte(dashboard.Password),
+		},
+	}
+	if err := m.kubeClient.Create(ctx, secret); err != nil {
+		return nil, fmt.Errorf("creating frps dashboard secret: %w", err)
+	}
+	return dashboard, nil
+}
+
+// reconcileDashboard brings the dashboard credentials Secret of an existing
+// tunnel in line with svc: created and recorded when the dashboard is
+// enabled, deleted and forgotten when it no longer is. It returns the
+// credentials to render frps with, or nil.
+func (m *Manager) reconcileDashboard(ctx context.Context, svc *corev1.Service) (*frp.Dashboard, error) {
+	dashboard, err := m.ensureDashboard(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+	recorded := svc.Annotations[AnnotationFrpsDashboardSecret]
+
+	switch {
+	case dashboard != nil && recorded == "":
+		patch := client.MergeFrom(svc.DeepCopy())
+		svc.Annotations[AnnotationFrpsDashboardSecret] = dashboardSecretName(svc)
+		if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+			return nil, fmt.Errorf("recording frps dashboard secret: %w", err)
+		}
+	case dashboard == nil && recorded != "":
+		if err := m.deleteDashboardSecret(ctx, recorded); err != nil {
+			return nil, err
+		}
+		patch := client.MergeFrom(svc.DeepCopy())
+		delete(svc.Annotations, AnnotationFrpsDashboardSecret)
+		if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+			return nil, fmt.Errorf("forgetting frps dashboard secret: %w", err)
+		}
+	}
+	return dashboard, nil
+}
+
+// deleteDashboardSecret deletes the named dashboard credentials Secret from
+// the operator namespace, if it exists.
+func (m *Manager) deleteDashboardSecret(ctx context.Context, name string) error {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: m.config.OperatorNamespace}}
+	if err := m.kubeClient.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("deleting frps dashboard secret: %w", err)
+	}
+	return nil
+}
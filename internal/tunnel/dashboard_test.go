@@ -0,0 +1,118 @@
+package tunnel_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// exposesPort reports whether machine publishes port.
+func exposesPort(machine *flyio.Machine, port int) bool {
+	for _, svc := range machine.Config.Services {
+		if svc.InternalPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDashboard_ProvisionAndTeardown(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[frp.AnnotationFrpsDashboard] = "true"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if result.DashboardSecret == "" {
+		t.Fatal("expected the dashboard credentials Secret to be reported")
+	}
+
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: result.DashboardSecret, Namespace: testNamespace}
+	if err := kubeClient.Get(context.Background(), key, &secret); err != nil {
+		t.Fatalf("getting dashboard secret: %v", err)
+	}
+	password := string(secret.Data[corev1.BasicAuthPasswordKey])
+	if password == "" || string(secret.Data[corev1.BasicAuthUsernameKey]) == "" {
+		t.Fatalf("expected generated credentials, got %v", secret.Data)
+	}
+	config, err := frp.ParseServerConfig(server.AppSecrets(result.FlyApp)["FRP_SERVER_CONFIG"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.WebServer == nil || config.WebServer.Port != frp.DefaultDashboardPort || config.WebServer.Password != password {
+		t.Errorf("expected the frps config to enable the dashboard with the stored password, got %+v", config.WebServer)
+	}
+	if !exposesPort(server.GetMachines()[result.MachineID], frp.DefaultDashboardPort) {
+		t.Error("expected the dashboard port on the Machine")
+	}
+
+	annotateTunnelState(svc, result)
+	svc.Annotations[tunnel.AnnotationFrpsDashboardSecret] = result.DashboardSecret
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), key, &secret); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the dashboard secret to be deleted, got %v", err)
+	}
+}
+
+func TestDashboard_DisabledOnUpdate(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[frp.AnnotationFrpsDashboard] = "true"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	svc.Annotations[tunnel.AnnotationFrpsDashboardSecret] = result.DashboardSecret
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating service: %v", err)
+	}
+
+	delete(svc.Annotations, frp.AnnotationFrpsDashboard)
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: result.DashboardSecret, Namespace: testNamespace}
+	if err := kubeClient.Get(context.Background(), key, &secret); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the dashboard secret to be deleted, got %v", err)
+	}
+	if _, ok := svc.Annotations[tunnel.AnnotationFrpsDashboardSecret]; ok {
+		t.Error("expected the dashboard secret annotation to be removed")
+	}
+	if strings.Contains(server.AppSecrets(result.FlyApp)["FRP_SERVER_CONFIG"], "webServer") {
+		t.Error("expected the dashboard to be disabled in the frps config")
+	}
+	if exposesPort(server.GetMachines()[result.MachineID], frp.DefaultDashboardPort) {
+		t.Error("expected the dashboard port to be removed from the Machine")
+	}
+}
@@ -0,0 +1,204 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/metrics"
+)
+
+// OperationTimeouts bound how long a single Provision, Update or Teardown may
+// run. A zero value leaves the operation bounded only by the caller's context.
+type OperationTimeouts struct {
+	Provision time.Duration
+	Update    time.Duration
+	Teardown  time.Duration
+}
+
+// DefaultOperationTimeouts leave room for a Machine start (up to a minute)
+// plus the surrounding API calls.
+var DefaultOperationTimeouts = OperationTimeouts{
+	Provision: 5 * time.Minute,
+	Update:    3 * time.Minute,
+	Teardown:  3 * time.Minute,
+}
+
+// partialStateWriteTimeout bounds recording partial state after the
+// operation's own context is already done.
+const partialStateWriteTimeout = 10 * time.Second
+
+// WithOperationTimeouts sets the per-operation deadlines.
+func (m *Manager) WithOperationTimeouts(timeouts OperationTimeouts) *Manager {
+	m.timeouts = timeouts
+	return m
+}
+
+// withBudget derives the context for one operation from ctx.
+func withBudget(ctx context.Context, budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, budget)
+}
+
+// teardownResult is the outcome of a Teardown whose steps all succeeded.
+// Running out of time still means cleanup was cut short, so the caller must
+// keep the finalizer and try again.
+func teardownResult(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("teardown interrupted: %w", err)
+	}
+	return nil
+}
+
+// teardownErrors returns the failed steps of a teardown as one error, or
+// teardownResult if none failed.
+func teardownErrors(ctx context.Context, errs []error) error {
+	if len(errs) > 0 {
+		return fmt.Errorf("tearing down tunnel: %w", errors.Join(errs...))
+	}
+	return teardownResult(ctx)
+}
+
+// partialTunnel is what an interrupted Provision had created so far.
+type partialTunnel struct {
+	FlyApp    string
+	MachineID string
+	IPID      string
+	PublicIP  string
+}
+
+// Provisioned reports whether svc records a complete tunnel. A Service with
+// only some tunnel annotations holds the partial state of an interrupted
+// Provision, which the next Provision resumes from.
+func Provisioned(svc *corev1.Service) bool {
+	return svc.Annotations[AnnotationFlyApp] != "" &&
+		svc.Annotations[AnnotationPublicIP] != "" &&
+		svc.Annotations[AnnotationFrpcDeployment] != ""
+}
+
+// interrupted records on svc the resources an interrupted Provision left
+// behind, so the next attempt resumes from them rather than creating
+// duplicates and Teardown can find them. The returned error wraps the
+// context error and is retryable.
+func (m *Manager) interrupted(ctx context.Context, svc *corev1.Service, partial partialTunnel, step string) error {
+	cause := ctx.Err()
+	if partial != (partialTunnel{}) {
+		// The operation's context is done; give the write its own deadline.
+		writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), partialStateWriteTimeout)
+		defer cancel()
+
+		patch := client.MergeFrom(svc.DeepCopy())
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+		set := func(key, value string) {
+			if value != "" {
+				svc.Annotations[key] = value
+			}
+		}
+		set(AnnotationFlyApp, partial.FlyApp)
+		set(AnnotationMachineID, partial.MachineID)
+		set(AnnotationIPID, partial.IPID)
+		set(AnnotationPublicIP, partial.PublicIP)
+		if partial.IPID != "" {
+			svc.Annotations[AnnotationIPOwnership] = IPOwnershipOperator
+		}
+		if partial.FlyApp != "" {
+			svc.Annotations[AnnotationAppOwnership] = m.appOwnership()
+		}
+		if err := m.kubeClient.Patch(writeCtx, svc, patch); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to record partial tunnel state", "app", partial.FlyApp, "machineID", partial.MachineID, "ipID", partial.IPID)
+		}
+	}
+	return fmt.Errorf("provisioning interrupted while %s: %w", step, cause)
+}
+
+// resumeMachine returns the Machine recorded by an interrupted Provision, or
+// nil if none was recorded or it no longer exists.
+func (m *Manager) resumeMachine(ctx context.Context, svc *corev1.Service, flyAppName string) (*flyio.Machine, error) {
+	id := svc.Annotations[AnnotationMachineID]
+	if id == "" {
+		return nil, nil
+	}
+	machine, err := m.flyClient.GetMachine(ctx, flyAppName, id)
+	if errors.Is(err, flyio.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting recorded machine: %w", err)
+	}
+	return machine, nil
+}
+
+// resumeIP returns the IP recorded by an interrupted Provision, or nil if
+// none was recorded or it is no longer allocated to the App.
+func (m *Manager) resumeIP(ctx context.Context, svc *corev1.Service, flyAppName string) (*flyio.IPAddress, error) {
+	id, address := svc.Annotations[AnnotationIPID], svc.Annotations[AnnotationPublicIP]
+	if id == "" || address == "" {
+		return nil, nil
+	}
+	ips, err := m.flyClient.ListIPAddresses(ctx, flyAppName)
+	if err != nil {
+		return nil, fmt.Errorf("listing recorded IP: %w", err)
+	}
+	for _, ip := range ips {
+		if ip.ID == id {
+			return &flyio.IPAddress{ID: id, Address: address}, nil
+		}
+	}
+	return nil, nil
+}
+
+// neverAllocatedIP reports whether svc records the partial state of a
+// Provision interrupted before it had an IP. frpc is only deployed after
+// that, and a stable identity may have brought a retained App along, so
+// neither is looked for.
+func neverAllocatedIP(svc *corev1.Service) bool {
+	return svc.Annotations[AnnotationPublicIP] == "" &&
+		svc.Annotations[AnnotationFrpcDeployment] == "" &&
+		stableIdentity(svc) == ""
+}
+
+// teardownPartial tears down what a Provision that never allocated an IP
+// left behind: the App and Machine its partial state records, if any, and
+// the frps dashboard Secret, which is created before anything on fly.io.
+// Nothing else was created, so nothing else is looked for, and a Service
+// whose provisioning never got anywhere costs no fly.io calls at all.
+func (m *Manager) teardownPartial(ctx context.Context, svc *corev1.Service) error {
+	logger := log.FromContext(ctx)
+	m.desired.forget(svc.UID)
+	var errs []error
+	step := func(name string, err error, msg string, keysAndValues ...interface{}) {
+		if err := teardownStep(name, err); err != nil {
+			logger.Error(err, msg, keysAndValues...)
+			errs = append(errs, err)
+		}
+	}
+
+	if frp.DashboardEnabled(svc) {
+		step(metrics.TeardownStepFrpcResources, m.deleteDashboardSecret(ctx, dashboardSecretName(svc)),
+			"Failed to delete frps dashboard secret", "name", dashboardSecretName(svc))
+	}
+
+	flyAppName := svc.Annotations[AnnotationFlyApp]
+	switch {
+	case flyAppName == "":
+	case !ownsApp(svc) || m.config.ExternalApps:
+		errs = append(errs, m.teardownInApp(ctx, svc, flyAppName)...)
+	default:
+		// The App takes a recorded Machine with it.
+		logger.Info("Deleting fly.io App of partially provisioned tunnel", "app", flyAppName, "machineID", svc.Annotations[AnnotationMachineID])
+		step(metrics.TeardownStepDeleteApp, m.flyClient.DeleteApp(ctx, flyAppName),
+			"Failed to delete fly app", "app", flyAppName)
+	}
+	return teardownErrors(ctx, errs)
+}
@@ -0,0 +1,348 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// TestProvision_InterruptedAtEachStep cancels Provision at each step
+// boundary and checks that the recorded annotations match what exists in
+// fakefly, and that a second Provision resumes without duplicating anything.
+func TestProvision_InterruptedAtEachStep(t *testing.T) {
+	tests := []struct {
+		name string
+		// interrupt arms a hook that cancels the context at the boundary.
+		interrupt   func(server *fakefly.Server, cancel context.CancelFunc, frpc *func())
+		wantApp     bool
+		wantMachine bool
+		wantIP      bool
+	}{
+		{
+			name: "before the app exists",
+			interrupt: func(server *fakefly.Server, cancel context.CancelFunc, _ *func()) {
+				server.OnCreateApp = func(string, string) error { cancel(); return errInterrupted }
+			},
+		},
+		{
+			name: "before the machine exists",
+			interrupt: func(server *fakefly.Server, cancel context.CancelFunc, _ *func()) {
+				server.OnCreateMachine = func(string, flyio.CreateMachineInput) error { cancel(); return errInterrupted }
+			},
+			wantApp: true,
+		},
+		{
+			name: "before the IP is allocated",
+			interrupt: func(server *fakefly.Server, cancel context.CancelFunc, _ *func()) {
+				server.OnAllocateIP = func(string) error { cancel(); return errInterrupted }
+			},
+			wantApp:     true,
+			wantMachine: true,
+		},
+		{
+			name: "before frpc is deployed",
+			interrupt: func(_ *fakefly.Server, cancel context.CancelFunc, frpc *func()) {
+				*frpc = cancel
+			},
+			wantApp:     true,
+			wantMachine: true,
+			wantIP:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			svc := testService("web", "default",
+				corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			)
+			var onFrpc func()
+			kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).
+				WithObjects(testOperatorNamespace(), svc).
+				WithInterceptorFuncs(interceptor.Funcs{
+					Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+						if _, ok := obj.(*corev1.Secret); ok && onFrpc != nil {
+							onFrpc()
+							return ctx.Err()
+						}
+						return c.Create(ctx, obj, opts...)
+					},
+				}).Build()
+			mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tt.interrupt(server, cancel, &onFrpc)
+
+			if _, err := mgr.Provision(ctx, svc); !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected an interrupted Provision, got %v", err)
+			}
+
+			var recorded corev1.Service
+			if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), &recorded); err != nil {
+				t.Fatalf("getting service: %v", err)
+			}
+			app := recorded.Annotations[tunnel.AnnotationFlyApp]
+			machineID := recorded.Annotations[tunnel.AnnotationMachineID]
+			ipID := recorded.Annotations[tunnel.AnnotationIPID]
+
+			if (app != "") != tt.wantApp || server.AppCount() != boolToInt(tt.wantApp) {
+				t.Errorf("app: recorded %q, %d in fakefly, want present=%v", app, server.AppCount(), tt.wantApp)
+			}
+			if (machineID != "") != tt.wantMachine || server.MachineCount() != boolToInt(tt.wantMachine) {
+				t.Errorf("machine: recorded %q, %d in fakefly, want present=%v", machineID, server.MachineCount(), tt.wantMachine)
+			}
+			if machineID != "" {
+				if _, ok := server.GetMachines()[machineID]; !ok {
+					t.Errorf("recorded machine %s does not exist in fakefly", machineID)
+				}
+			}
+			if (ipID != "") != tt.wantIP || server.IPCount() != boolToInt(tt.wantIP) {
+				t.Errorf("IP: recorded %q, %d in fakefly, want present=%v", ipID, server.IPCount(), tt.wantIP)
+			}
+			if ipID != "" {
+				if ip, ok := server.GetIPs()[ipID]; !ok || ip.Address != recorded.Annotations[tunnel.AnnotationPublicIP] {
+					t.Errorf("recorded IP %s/%s does not match fakefly", ipID, recorded.Annotations[tunnel.AnnotationPublicIP])
+				}
+			}
+			if tunnel.Provisioned(&recorded) {
+				t.Error("partial state must not count as a provisioned tunnel")
+			}
+
+			// The next attempt resumes from the recorded state.
+			server.OnCreateApp, server.OnCreateMachine, server.OnAllocateIP = nil, nil, nil
+			onFrpc = nil
+			result, err := mgr.Provision(context.Background(), &recorded)
+			if err != nil {
+				t.Fatalf("resumed Provision failed: %v", err)
+			}
+			if server.AppCount() != 1 || server.MachineCount() != 1 || server.IPCount() != 1 {
+				t.Errorf("expected exactly 1 app, machine and IP after resuming, got %d, %d, %d",
+					server.AppCount(), server.MachineCount(), server.IPCount())
+			}
+			if machineID != "" && result.MachineID != machineID {
+				t.Errorf("expected the recorded machine %s to be reused, got %s", machineID, result.MachineID)
+			}
+			if ipID != "" && result.IPID != ipID {
+				t.Errorf("expected the recorded IP %s to be reused, got %s", ipID, result.IPID)
+			}
+		})
+	}
+}
+
+func TestProvision_DeadlineExceeded(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), svc).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig()).
+		WithOperationTimeouts(tunnel.OperationTimeouts{Provision: 200 * time.Millisecond})
+
+	server.OnAllocateIP = func(string) error {
+		time.Sleep(400 * time.Millisecond)
+		return errInterrupted
+	}
+
+	if _, err := mgr.Provision(context.Background(), svc); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Provision to hit its deadline, got %v", err)
+	}
+
+	var recorded corev1.Service
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), &recorded); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	if recorded.Annotations[tunnel.AnnotationMachineID] == "" {
+		t.Error("expected the machine created before the deadline to be recorded")
+	}
+	if server.MachineCount() != 1 {
+		t.Errorf("expected the machine to be kept for the next attempt, got %d", server.MachineCount())
+	}
+}
+
+func TestTeardown_InterruptedKeepsFinalizer(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server.OnDeleteApp = func(string) error { cancel(); return errInterrupted }
+
+	if err := mgr.Teardown(ctx, svc); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected an interrupted Teardown to return an error, got %v", err)
+	}
+
+	// The retry completes the teardown.
+	server.OnDeleteApp = nil
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("retried Teardown failed: %v", err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected 0 apps after the retried teardown, got %d", server.AppCount())
+	}
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), client.ObjectKey{Name: result.FrpcDeployment, Namespace: testNamespace}, &deploy); err == nil {
+		t.Error("expected frpc Deployment to be deleted")
+	}
+}
+
+// flyCalls records the Fly.io API requests of a Client.
+type flyCalls struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (c *flyCalls) ObserveRequest(op string, statusCode int, _ time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, fmt.Sprintf("%s:%d", op, statusCode))
+}
+
+func (c *flyCalls) ObserveQueued(string, time.Duration) {}
+
+// take returns the requests recorded so far and forgets them.
+func (c *flyCalls) take() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	calls := c.calls
+	c.calls = nil
+	return calls
+}
+
+// TestTeardown_PartiallyProvisioned deletes a Service whose Provision was
+// interrupted at each step boundary and checks that exactly what was created
+// goes, without requests for anything that was not.
+func TestTeardown_PartiallyProvisioned(t *testing.T) {
+	tests := []struct {
+		name      string
+		interrupt func(server *fakefly.Server, cancel context.CancelFunc, frpc *func())
+		wantCalls []string
+	}{
+		{
+			name: "before the app exists",
+			interrupt: func(server *fakefly.Server, cancel context.CancelFunc, _ *func()) {
+				server.OnCreateApp = func(string, string) error { cancel(); return errInterrupted }
+			},
+			wantCalls: nil,
+		},
+		{
+			name: "before the machine exists",
+			interrupt: func(server *fakefly.Server, cancel context.CancelFunc, _ *func()) {
+				server.OnCreateMachine = func(string, flyio.CreateMachineInput) error { cancel(); return errInterrupted }
+			},
+			wantCalls: []string{"DeleteApp:202"},
+		},
+		{
+			name: "before the IP is allocated",
+			interrupt: func(server *fakefly.Server, cancel context.CancelFunc, _ *func()) {
+				server.OnAllocateIP = func(string) error { cancel(); return errInterrupted }
+			},
+			wantCalls: []string{"DeleteApp:202"},
+		},
+		{
+			name: "before frpc is deployed",
+			interrupt: func(_ *fakefly.Server, cancel context.CancelFunc, frpc *func()) {
+				*frpc = cancel
+			},
+			wantCalls: []string{"DeleteApp:202"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			svc := testService("web", "default",
+				corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			)
+			svc.Annotations[frp.AnnotationFrpsDashboard] = "true"
+			var onFrpc func()
+			kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).
+				WithObjects(testOperatorNamespace(), svc).
+				WithInterceptorFuncs(interceptor.Funcs{
+					Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+						if secret, ok := obj.(*corev1.Secret); ok && onFrpc != nil && !strings.HasSuffix(secret.Name, "-dashboard") {
+							onFrpc()
+							return ctx.Err()
+						}
+						return c.Create(ctx, obj, opts...)
+					},
+				}).Build()
+			calls := &flyCalls{}
+			flyClient := newTestFlyClient(server).WithObserver(calls)
+			mgr := tunnel.NewManager(flyClient, kubeClient, newTestConfig())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tt.interrupt(server, cancel, &onFrpc)
+			if _, err := mgr.Provision(ctx, svc); !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected an interrupted Provision, got %v", err)
+			}
+
+			var recorded corev1.Service
+			if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), &recorded); err != nil {
+				t.Fatalf("getting service: %v", err)
+			}
+			calls.take()
+			if err := mgr.Teardown(context.Background(), &recorded); err != nil {
+				t.Fatalf("Teardown failed: %v", err)
+			}
+			if got := calls.take(); !slices.Equal(got, tt.wantCalls) {
+				t.Errorf("expected fly.io requests %v, got %v", tt.wantCalls, got)
+			}
+			if server.AppCount() != 0 || server.MachineCount() != 0 || server.IPCount() != 0 {
+				t.Errorf("expected nothing left, got %d apps, %d machines, %d IPs",
+					server.AppCount(), server.MachineCount(), server.IPCount())
+			}
+			var secrets corev1.SecretList
+			if err := kubeClient.List(context.Background(), &secrets, client.InNamespace(testNamespace)); err != nil {
+				t.Fatalf("listing secrets: %v", err)
+			}
+			if len(secrets.Items) != 0 {
+				t.Errorf("expected the dashboard secret to be deleted, got %d secrets", len(secrets.Items))
+			}
+		})
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,262 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// podAnnotationConfigHash is the frpc pod template annotation carrying the
+// hash of the frpc config, so a config change rolls the Deployment.
+const podAnnotationConfigHash = "fly-tunnel-operator.dev/config-hash"
+
+// desiredState is everything derived from a Service and the operator config
+// that the frpc Deployment and fly.io Machine are reconciled towards. It is
+// the single source for Provision and Update alike, and is shared between
+// reconciles, so it must not be modified.
+type desiredState struct {
+	// frpcDeploymentName and frpcConfigName name the in-cluster frpc
+	// Deployment and its config Secret.
+	frpcDeploymentName string
+	frpcConfigName     string
+
+	frpcConfig     string
+	frpcConfigHash string
+	frpcResources  corev1.ResourceRequirements
+	frpcReplicas   int32
+	frpcScheduling frpcScheduling
+	frpcDeployment appsv1.DeploymentSpec
+	// loadBalanced is set when frpc shares its proxies with other frpc
+	// pods, each registering as its own user.
+	loadBalanced bool
+	// propagatedLabels and propagatedAnnotations are copied from the
+	// Service onto the frpc Deployment, its pods and its config Secret.
+	propagatedLabels      map[string]string
+	propagatedAnnotations map[string]string
+
+	// frpsConfig is the frps.toml delivered to the Machine as an App secret.
+	frpsConfig   string
+	machineInput flyio.CreateMachineInput
+}
+
+// desiredStateCache memoizes desiredState per Service UID. An entry is valid
+// while the Service generation, annotations, frps address and operator
+// config are unchanged; generation alone does not cover annotation edits.
+type desiredStateCache struct {
+	mu      sync.Mutex
+	entries map[types.UID]desiredStateEntry
+}
+
+type desiredStateEntry struct {
+	key   string
+	state *desiredState
+}
+
+func newDesiredStateCache() *desiredStateCache {
+	return &desiredStateCache{entries: make(map[types.UID]desiredStateEntry)}
+}
+
+func (c *desiredStateCache) get(uid types.UID, key string) *desiredState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[uid]; ok && e.key == key {
+		return e.state
+	}
+	return nil
+}
+
+func (c *desiredStateCache) put(uid types.UID, key string, state *desiredState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[uid] = desiredStateEntry{key: key, state: state}
+}
+
+func (c *desiredStateCache) forget(uid types.UID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, uid)
+}
+
+// desiredStateKey identifies the inputs of desiredState besides the UID.
+func (m *Manager) desiredStateKey(svc *corev1.Service, serverAddr string, secrets tunnelSecrets) string {
+	h := fnv.New64a()
+	keys := make([]string, 0, len(svc.Annotations))
+	for k := range svc.Annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\x00", k, svc.Annotations[k])
+	}
+	// Labels only matter when propagated, but don't bump the generation.
+	keys = keys[:0]
+	for k := range svc.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "label:%s=%s\x00", k, svc.Labels[k])
+	}
+	fmt.Fprintf(h, "%+v\x00%s\x00%s", m.config, m.frpsConfig(svc, secrets), secrets.adminPassword)
+	return fmt.Sprintf("%d/%s/%x", svc.Generation, serverAddr, h.Sum64())
+}
+
+// desiredStateFor returns the desired state for svc with frpc pointed at
+// serverAddr and rendered with secrets, from the cache when its inputs are
+// unchanged. Services without a UID (not yet persisted) are never cached.
+// Only the Machine side is meaningful while serverAddr is still unknown.
+func (m *Manager) desiredStateFor(svc *corev1.Service, serverAddr string, secrets tunnelSecrets) (*desiredState, error) {
+	if m.desired == nil || svc.UID == "" {
+		return m.buildDesiredState(svc, serverAddr, secrets)
+	}
+
+	key := m.desiredStateKey(svc, serverAddr, secrets)
+	if state := m.desired.get(svc.UID, key); state != nil {
+		return state, nil
+	}
+	state, err := m.buildDesiredState(svc, serverAddr, secrets)
+	if err != nil {
+		return nil, err
+	}
+	m.desired.put(svc.UID, key, state)
+	return state, nil
+}
+
+// buildDesiredState derives the desired state of the tunnel for svc from the
+// Service and the operator config.
+func (m *Manager) buildDesiredState(svc *corev1.Service, serverAddr string, secrets tunnelSecrets) (*desiredState, error) {
+	resources, err := frpcResources(svc)
+	if err != nil {
+		return nil, fmt.Errorf("building frpc resources: %w", err)
+	}
+	replicas, err := frpcReplicas(svc)
+	if err != nil {
+		return nil, err
+	}
+	scheduling, err := frpcSchedulingFor(svc, m.config.FrpcNodeSelector)
+	if err != nil {
+		return nil, err
+	}
+	opts := frp.ClientOptions{
+		ServerAddr:    serverAddr,
+		ServerPort:    controlPort(svc),
+		ClusterDomain: m.config.ClusterDomain,
+		AuthToken:     secrets.token,
+		Heartbeat:     m.config.FrpcHeartbeat,
+		LogLevel:      frp.FrpcLogLevelFor(svc, m.config.FrpcLogLevel),
+		AdminPassword: secrets.adminPassword,
+	}
+	if frp.RandomRemotePorts(svc) {
+		opts.AssignedRemotePorts = parseAssignedRemotePorts(svc.Annotations[AnnotationAssignedRemotePorts])
+	}
+	m.endpointsClientOptions(svc, &opts)
+	// A canary serves alongside the primary frpc.
+	loadBalanced := replicas > 1 || canaryMode(svc)
+	if loadBalanced {
+		opts.User = frpcReplicaUser
+		opts.LoadBalancerGroupKey = loadBalancerGroupKey(secrets.token)
+	}
+	config := frp.GenerateClientConfigWithOptions(svc, opts)
+	state := &desiredState{
+		frpcDeploymentName: frpcDeploymentName(svc),
+		frpcConfig:         config,
+		frpcConfigHash:     fmt.Sprintf("%x", sha256.Sum256([]byte(config))),
+		frpcResources:      resources,
+		frpcReplicas:       replicas,
+		frpcScheduling:     scheduling,
+		loadBalanced:       loadBalanced,
+		frpsConfig:         m.frpsConfig(svc, secrets),
+		machineInput:       m.buildMachineInput(svc, secrets),
+	}
+	state.propagatedLabels, state.propagatedAnnotations = propagatedMetadata(svc, m.config.PropagatePrefixes)
+	state.frpcConfigName = frpcConfigName(state.frpcDeploymentName)
+	state.frpcDeployment = m.frpcDeploymentSpec(state)
+	return state, nil
+}
+
+// frpcDeploymentSpec returns the spec of the frpc Deployment in state.
+func (m *Manager) frpcDeploymentSpec(state *desiredState) appsv1.DeploymentSpec {
+	labels := map[string]string{
+		"app.kubernetes.io/name":       "frpc",
+		"app.kubernetes.io/instance":   state.frpcDeploymentName,
+		"app.kubernetes.io/managed-by": "fly-tunnel-operator",
+	}
+
+	var env []corev1.EnvVar
+	if state.loadBalanced {
+		env = []corev1.EnvVar{{
+			Name: frpcPodNameEnv,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+			},
+		}}
+	}
+
+	return appsv1.DeploymentSpec{
+		Replicas: ptr.To(state.frpcReplicas),
+		Selector: &metav1.LabelSelector{
+			MatchLabels: labels,
+		},
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: withPropagated(state.propagatedLabels, labels),
+				Annotations: withPropagated(state.propagatedAnnotations, map[string]string{
+					// Hash of the config content; triggers a rollout when config changes.
+					podAnnotationConfigHash: state.frpcConfigHash,
+				}),
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:      "frpc",
+						Image:     m.config.FrpcImage,
+						Command:   []string{"frpc"},
+						Args:      []string{"-c", "/etc/frp/frpc.toml"},
+						Env:       env,
+						Resources: state.frpcResources,
+						VolumeMounts: []corev1.VolumeMount{
+							{
+								Name:      "config",
+								MountPath: "/etc/frp",
+								ReadOnly:  true,
+							},
+						},
+					},
+				},
+				ImagePullSecrets: m.frpcImagePullSecrets(),
+				NodeSelector:     state.frpcScheduling.nodeSelector,
+				Tolerations:      state.frpcScheduling.tolerations,
+				Affinity:         state.frpcScheduling.affinity,
+				Volumes: []corev1.Volume{
+					{
+						Name: "config",
+						VolumeSource: corev1.VolumeSource{
+							Secret: &corev1.SecretVolumeSource{
+								SecretName: state.frpcConfigName,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// frpcImagePullSecrets returns the pull secrets of frpc pods, if any.
+func (m *Manager) frpcImagePullSecrets() []corev1.LocalObjectReference {
+	if m.config.FrpcImagePullSecret == "" {
+		return nil
+	}
+	return []corev1.LocalObjectReference{{Name: m.config.FrpcImagePullSecret}}
+}
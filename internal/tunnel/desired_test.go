@@ -0,0 +1,258 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+func desiredTestService(i int) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("svc-%d", i),
+			Namespace:   "default",
+			UID:         types.UID(fmt.Sprintf("uid-%d", i)),
+			Generation:  1,
+			Annotations: map[string]string{AnnotationFrpcMemoryLimit: "256Mi"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+}
+
+func desiredTestManager(cfg Config) *Manager {
+	return NewManager(flyio.NewClient("test-token"), nil, cfg)
+}
+
+func TestDesiredStateFor_CachesUntilInputsChange(t *testing.T) {
+	m := desiredTestManager(Config{FlyRegion: "syd", FrpsImage: "frps:1"})
+	svc := desiredTestService(0)
+
+	first, err := m.desiredStateFor(svc, "1.2.3.4", tunnelSecrets{token: "token"})
+	if err != nil {
+		t.Fatalf("desiredStateFor: %v", err)
+	}
+	if again, _ := m.desiredStateFor(svc, "1.2.3.4", tunnelSecrets{token: "token"}); again != first {
+		t.Error("expected unchanged Service to hit the cache")
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(svc *corev1.Service, m *Manager) string
+	}{
+		{name: "generation", mutate: func(svc *corev1.Service, _ *Manager) string {
+			svc.Generation++
+			return "1.2.3.4"
+		}},
+		{name: "annotation", mutate: func(svc *corev1.Service, _ *Manager) string {
+			svc.Annotations[AnnotationFrpcMemoryLimit] = "512Mi"
+			return "1.2.3.4"
+		}},
+		{name: "server address", mutate: func(*corev1.Service, *Manager) string {
+			return "5.6.7.8"
+		}},
+		{name: "operator config", mutate: func(_ *corev1.Service, m *Manager) string {
+			m.config.FrpsImage = "frps:2"
+			return "1.2.3.4"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := m.desiredStateFor(svc, "1.2.3.4", tunnelSecrets{token: "token"})
+			if err != nil {
+				t.Fatalf("desiredStateFor: %v", err)
+			}
+			addr := tt.mutate(svc, m)
+			after, err := m.desiredStateFor(svc, addr, tunnelSecrets{token: "token"})
+			if err != nil {
+				t.Fatalf("desiredStateFor: %v", err)
+			}
+			if after == before {
+				t.Errorf("expected a %s change to invalidate the cache", tt.name)
+			}
+		})
+	}
+
+	// The rebuilt state reflects the changes.
+	state, _ := m.desiredStateFor(svc, "1.2.3.4", tunnelSecrets{token: "token"})
+	if state.machineInput.Config.Image != "frps:2" {
+		t.Errorf("expected rebuilt machine input to use the new image, got %q", state.machineInput.Config.Image)
+	}
+	if got := state.frpcResources.Limits.Memory().String(); got != "512Mi" {
+		t.Errorf("expected rebuilt frpc resources to use the new limit, got %s", got)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// TestBuildDesiredState_Golden pins the full desired state of a tunnel, so
+// refactors of how it is derived cannot change what is deployed. Run with
+// -update to accept an intended change.
+func TestBuildDesiredState_Golden(t *testing.T) {
+	m := desiredTestManager(Config{
+		FlyRegion:      "syd",
+		FlyMachineSize: "shared-cpu-1x",
+		FrpsImage:      "frps:1",
+		FrpcImage:      "frpc:1",
+	})
+	svc := desiredTestService(0)
+	svc.Annotations[AnnotationFrpcDeployment] = "frpc-default-svc-0"
+
+	state, err := m.buildDesiredState(svc, "1.2.3.4", tunnelSecrets{token: "token"})
+	if err != nil {
+		t.Fatalf("buildDesiredState: %v", err)
+	}
+	got, err := json.MarshalIndent(map[string]any{
+		"frpcDeploymentName": state.frpcDeploymentName,
+		"frpcConfigName":     state.frpcConfigName,
+		"frpcConfig":         state.frpcConfig,
+		"frpcDeployment":     state.frpcDeployment,
+		"frpsConfig":         state.frpsConfig,
+		"machineInput":       state.machineInput,
+	}, "", "  ")
+	if err != nil {
+		t.Fatalf("marshaling desired state: %v", err)
+	}
+
+	path := filepath.Join("testdata", "desired_state.golden")
+	if *updateGolden {
+		if err := os.WriteFile(path, append(got, '\n'), 0o644); err != nil {
+			t.Fatalf("writing golden file: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file: %v", err)
+	}
+	if string(want) != string(got)+"\n" {
+		t.Errorf("desired state differs from %s (run with -update to accept):\n%s", path, got)
+	}
+}
+
+func TestDesiredStateFor_NoUIDIsNotCached(t *testing.T) {
+	m := desiredTestManager(Config{})
+	svc := desiredTestService(0)
+	svc.UID = ""
+
+	first, _ := m.desiredStateFor(svc, "1.2.3.4", tunnelSecrets{token: "token"})
+	second, _ := m.desiredStateFor(svc, "1.2.3.4", tunnelSecrets{token: "token"})
+	if first == second {
+		t.Error("expected Services without a UID to bypass the cache")
+	}
+}
+
+func TestDesiredStateFor_ErrorsAreNotCached(t *testing.T) {
+	m := desiredTestManager(Config{})
+	svc := desiredTestService(0)
+	svc.Annotations[AnnotationFrpcMemoryLimit] = "lots"
+
+	if _, err := m.desiredStateFor(svc, "1.2.3.4", tunnelSecrets{token: "token"}); err == nil {
+		t.Fatal("expected an invalid resource annotation to fail")
+	}
+	if len(m.desired.entries) != 0 {
+		t.Errorf("expected failed builds not to be cached, got %d entries", len(m.desired.entries))
+	}
+}
+
+func benchmarkDesiredState(b *testing.B, cached bool) {
+	m := desiredTestManager(Config{FlyRegion: "syd", FrpsImage: "frps:1", FrpcImage: "frpc:1"})
+	if !cached {
+		m.desired = nil
+	}
+	services := make([]*corev1.Service, 200)
+	for i := range services {
+		services[i] = desiredTestService(i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, svc := range services {
+			if _, err := m.desiredStateFor(svc, "1.2.3.4", tunnelSecrets{token: "token"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkDesiredState measures a resync of 200 unchanged Services.
+func BenchmarkDesiredState(b *testing.B) {
+	b.Run("uncached", func(b *testing.B) { benchmarkDesiredState(b, false) })
+	b.Run("cached", func(b *testing.B) { benchmarkDesiredState(b, true) })
+}
+
+func benchmarkUpdate(b *testing.B, cached bool) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fly-tunnel-operator-system"}}
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(ns).Build()
+
+	flyClient := flyio.NewClient("test-token").
+		WithBaseURL(server.URL).
+		WithGraphQLURL(server.URL + "/graphql")
+	m := NewManager(flyClient, kubeClient, Config{
+		FlyOrg:            "personal",
+		FlyRegion:         "syd",
+		FrpsImage:         "frps:1",
+		FrpcImage:         "frpc:1",
+		OperatorNamespace: ns.Name,
+	})
+	if !cached {
+		m.desired = nil
+	}
+
+	ctx := context.Background()
+	services := make([]*corev1.Service, 200)
+	for i := range services {
+		svc := desiredTestService(i)
+		result, err := m.Provision(ctx, svc)
+		if err != nil {
+			b.Fatalf("Provision: %v", err)
+		}
+		svc.Annotations[AnnotationFlyApp] = result.FlyApp
+		svc.Annotations[AnnotationMachineID] = result.MachineID
+		svc.Annotations[AnnotationFrpcDeployment] = result.FrpcDeployment
+		svc.Annotations[AnnotationPublicIP] = result.PublicIP
+		services[i] = svc
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, svc := range services {
+			if _, err := m.Update(ctx, svc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkUpdate measures reconcile throughput for 200 unchanged Services
+// against the fake Kubernetes and fly.io APIs.
+func BenchmarkUpdate(b *testing.B) {
+	b.Run("uncached", func(b *testing.B) { benchmarkUpdate(b, false) })
+	b.Run("cached", func(b *testing.B) { benchmarkUpdate(b, true) })
+}
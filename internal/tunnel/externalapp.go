@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/metrics"
+)
+
+// AnnotationAppOwnership records whether the tunnel's Fly App was created by
+// the operator ("operator") or supplied by the user ("external"), with the
+// values of AnnotationIPOwnership. Teardown only deletes operator-owned Apps.
+// Tunnels provisioned before it was introduced are operator-owned.
+const AnnotationAppOwnership = "fly-tunnel-operator.dev/app-ownership"
+
+// MachineMetadataService is the Machine metadata key naming the Service, as
+// <namespace>/<name>, a tunnel Machine serves. In an external App, Teardown
+// only deletes a Machine carrying it for the Service being torn down.
+const MachineMetadataService = "fly_tunnel_operator_service"
+
+// ownsApp reports whether the operator created the Fly App of svc and may
+// therefore delete it. Unrecognised values are treated as external.
+func ownsApp(svc *corev1.Service) bool {
+	switch svc.Annotations[AnnotationAppOwnership] {
+	case "", IPOwnershipOperator:
+		return true
+	default:
+		return false
+	}
+}
+
+// appOwnership returns the AnnotationAppOwnership value of the tunnels m
+// provisions.
+func (m *Manager) appOwnership() string {
+	if m.config.ExternalApps {
+		return IPOwnershipExternal
+	}
+	return IPOwnershipOperator
+}
+
+// checkExternalApp verifies, before anything is created, that svc can be
+// tunneled through the existing App it names in AnnotationFlyApp: the App
+// must exist in the operator's organization and run no other Service's
+// tunnel, since the frps config is an App-wide secret.
+func (m *Manager) checkExternalApp(ctx context.Context, svc *corev1.Service) error {
+	if tunnelGroup(svc) != "" {
+		return permanent(fmt.Errorf("tunnel groups need the operator to manage fly.io Apps; remove %s", AnnotationTunnelGroup))
+	}
+	if stableIdentity(svc) != "" {
+		return permanent(fmt.Errorf("stable identities need the operator to manage fly.io Apps; remove %s", AnnotationStableIdentity))
+	}
+	name := svc.Annotations[AnnotationFlyApp]
+	if name == "" {
+		return permanent(fmt.Errorf("the operator does not manage fly.io Apps; set %s to an existing App", AnnotationFlyApp))
+	}
+
+	app, err := m.flyClient.GetApp(ctx, name)
+	if errors.Is(err, flyio.ErrNotFound) {
+		return permanent(fmt.Errorf("fly.io App %s does not exist", name))
+	}
+	if err != nil {
+		return fmt.Errorf("getting fly app: %w", err)
+	}
+	if app.Organization.Slug != "" && app.Organization.Slug != m.config.FlyOrg {
+		return permanent(fmt.Errorf("fly.io App %s is in organization %s, not %s", name, app.Organization.Slug, m.config.FlyOrg))
+	}
+
+	machines, err := m.flyClient.ListMachines(ctx, name)
+	if err != nil {
+		return fmt.Errorf("listing machines: %w", err)
+	}
+	for _, machine := range machines {
+		if owner := machine.Config.Metadata[MachineMetadataService]; owner != "" && owner != machineOwner(svc) {
+			return permanent(fmt.Errorf("fly.io App %s already runs the tunnel of Service %s", name, owner))
+		}
+	}
+	return nil
+}
+
+// machineOwner returns the MachineMetadataService value of the Machine
+// tunneling svc.
+func machineOwner(svc *corev1.Service) string {
+	return svc.Namespace + "/" + svc.Name
+}
+
+// teardownInApp removes what the tunnel of svc created in a Fly App the
+// operator must not delete: its operator-owned addresses, a Machine it
+// replaced, and its Machine, the latter only once its metadata shows it
+// serves svc.
+func (m *Manager) teardownInApp(ctx context.Context, svc *corev1.Service, flyAppName string) []error {
+	logger := log.FromContext(ctx)
+	var errs []error
+	step := func(name string, err error, msg string, keysAndValues ...interface{}) {
+		if err := teardownStep(name, err); err != nil {
+			logger.Error(err, msg, keysAndValues...)
+			errs = append(errs, err)
+		}
+	}
+
+	if ipID := svc.Annotations[AnnotationIPID]; ipID != "" && ownsIP(svc) {
+		logger.Info("Releasing dedicated IPv4", "id", ipID)
+		step(metrics.TeardownStepReleaseIP, m.flyClient.ReleaseIPAddress(ctx, flyAppName, ipID),
+			"Failed to release IP", "id", ipID)
+	}
+	if ipID := svc.Annotations[AnnotationIPv6ID]; ipID != "" {
+		logger.Info("Releasing dedicated IPv6", "id", ipID)
+		step(metrics.TeardownStepReleaseIP, m.flyClient.ReleaseIPAddress(ctx, flyAppName, ipID),
+			"Failed to release IPv6", "id", ipID)
+	}
+
+	if oldID := svc.Annotations[AnnotationReplacedMachineID]; oldID != "" {
+		logger.Info("Deleting replaced fly.io Machine", "id", oldID)
+		step(metrics.TeardownStepDeleteMachine, m.flyClient.DeleteMachine(ctx, flyAppName, oldID),
+			"Failed to delete replaced machine", "id", oldID)
+	}
+
+	machineID := svc.Annotations[AnnotationMachineID]
+	if machineID == "" {
+		return errs
+	}
+	machine, err := m.flyClient.GetMachine(ctx, flyAppName, machineID)
+	if err != nil {
+		step(metrics.TeardownStepDeleteMachine, err, "Failed to get machine", "id", machineID)
+		return errs
+	}
+	if owner := machine.Config.Metadata[MachineMetadataService]; owner != machineOwner(svc) {
+		logger.Info("Leaving fly.io Machine that does not belong to the Service", "id", machineID, "owner", owner)
+		return errs
+	}
+	logger.Info("Deleting fly.io Machine", "id", machineID)
+	step(metrics.TeardownStepDeleteMachine, m.flyClient.DeleteMachine(ctx, flyAppName, machineID),
+		"Failed to delete machine", "id", machineID)
+	return errs
+}
@@ -0,0 +1,38 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// frpcConfigName is the name of the Secret holding frpc.toml for the frpc
+// Deployment deploymentName. Operator versions that kept the config in a
+// ConfigMap used the same name.
+func frpcConfigName(deploymentName string) string {
+	return deploymentName + "-config"
+}
+
+// removeLegacyFrpcConfigMap deletes the frpc config ConfigMap written by
+// older operator versions. deployFrpc calls it once the Deployment mounts the
+// Secret instead, which completes the migration of an existing tunnel.
+func (m *Manager) removeLegacyFrpcConfigMap(ctx context.Context, namespace, deploymentName string) error {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      frpcConfigName(deploymentName),
+			Namespace: namespace,
+		},
+	}
+	if err := m.kubeClient.Delete(ctx, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("deleting legacy frpc configmap: %w", err)
+	}
+	log.FromContext(ctx).Info("Removed legacy frpc ConfigMap after moving config to a Secret", "name", cm.Name, "namespace", namespace)
+	return nil
+}
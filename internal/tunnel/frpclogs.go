@@ -0,0 +1,98 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AnnotationLastFrpcError holds a redacted excerpt of the log of the most
+// recent crash-looping frpc container, so users without access to the
+// operator namespace can see why their tunnel is down.
+const AnnotationLastFrpcError = "fly-tunnel-operator.dev/last-frpc-error"
+
+const (
+	// frpcLogTailLines is how many lines of the crashed container's log are
+	// fetched.
+	frpcLogTailLines = 20
+
+	// maxFrpcErrorExcerpt bounds the annotation value. The end of the log is
+	// kept since that is where the fatal error is.
+	maxFrpcErrorExcerpt = 1024
+)
+
+// secretPattern matches "key = value" style settings whose value must not be
+// copied into an annotation readable by Service owners.
+var secretPattern = regexp.MustCompile(`(?i)((?:token|password|secret|authorization)[\w.]*"?\s*[=:]\s*)("[^"]*"|\S+)`)
+
+// WithPodLogs enables fetching frpc container logs for crash diagnostics.
+func (m *Manager) WithPodLogs(pods typedcorev1.PodsGetter) *Manager {
+	m.podLogs = pods
+	return m
+}
+
+// FrpcCrashExcerpt returns a redacted, size-limited excerpt of the previous
+// log of a crash-looping frpc container for svc, formatted for
+// AnnotationLastFrpcError. current is the annotation's existing value; if it
+// already describes the same crash the log is not fetched again and current
+// is returned. An empty string means no frpc container is crash-looping or
+// log access is not configured.
+func (m *Manager) FrpcCrashExcerpt(ctx context.Context, svc *corev1.Service, current string) (string, error) {
+	if m.podLogs == nil {
+		return "", nil
+	}
+
+	deployName := frpcDeploymentName(svc)
+
+	var pods corev1.PodList
+	if err := m.kubeClient.List(ctx, &pods,
+		client.InNamespace(m.frpcNamespace(svc)),
+		client.MatchingLabels{"app.kubernetes.io/instance": deployName},
+	); err != nil {
+		return "", fmt.Errorf("listing frpc pods: %w", err)
+	}
+
+	for _, pod := range pods.Items {
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.Name != "frpc" || cs.State.Waiting == nil || cs.State.Waiting.Reason != "CrashLoopBackOff" {
+				continue
+			}
+
+			header := fmt.Sprintf("pod %s restart %d:\n", pod.Name, cs.RestartCount)
+			if strings.HasPrefix(current, header) {
+				return current, nil
+			}
+
+			raw, err := m.podLogs.Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+				Container: "frpc",
+				Previous:  true,
+				TailLines: ptr.To(int64(frpcLogTailLines)),
+			}).DoRaw(ctx)
+			if err != nil {
+				return "", fmt.Errorf("fetching frpc logs: %w", err)
+			}
+			return header + redactFrpcLog(string(raw), maxFrpcErrorExcerpt-len(header)), nil
+		}
+	}
+	return "", nil
+}
+
+// redactFrpcLog masks secret values and keeps at most limit bytes from the
+// end of the log, starting at a line boundary where possible.
+func redactFrpcLog(log string, limit int) string {
+	log = secretPattern.ReplaceAllString(strings.TrimSpace(log), "${1}<redacted>")
+	if len(log) <= limit {
+		return log
+	}
+	log = log[len(log)-limit:]
+	if i := strings.IndexByte(log, '\n'); i >= 0 && i < len(log)-1 {
+		log = log[i+1:]
+	}
+	return log
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRedactFrpcLog(t *testing.T) {
+	log := strings.Join([]string{
+		`2024/01/01 [I] start frpc service`,
+		`2024/01/01 [W] login to server failed: auth.token = "s3cr3t" mismatch`,
+		`password: hunter2`,
+	}, "\n")
+
+	got := redactFrpcLog(log, 1024)
+	for _, secret := range []string{"s3cr3t", "hunter2"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("expected %q to be redacted:\n%s", secret, got)
+		}
+	}
+	if !strings.Contains(got, "login to server failed") {
+		t.Errorf("expected the error context to be kept:\n%s", got)
+	}
+}
+
+func TestRedactFrpcLog_KeepsTailWithinLimit(t *testing.T) {
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, "2024/01/01 [I] some noisy startup line")
+	}
+	lines = append(lines, "2024/01/01 [E] connect to server error: i/o timeout")
+
+	got := redactFrpcLog(strings.Join(lines, "\n"), 256)
+	if len(got) > 256 {
+		t.Errorf("expected at most 256 bytes, got %d", len(got))
+	}
+	if !strings.HasSuffix(got, "connect to server error: i/o timeout") {
+		t.Errorf("expected the last line to be kept:\n%s", got)
+	}
+	if !strings.HasPrefix(got, "2024/01/01") {
+		t.Errorf("expected the excerpt to start at a line boundary:\n%s", got)
+	}
+}
+
+func TestFrpcCrashExcerpt(t *testing.T) {
+	s := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(s)
+
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:        "web",
+		Namespace:   "default",
+		Annotations: map[string]string{AnnotationFrpcDeployment: "frpc-default-web"},
+	}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "frpc-default-web-abc",
+			Namespace: "operator",
+			Labels:    map[string]string{"app.kubernetes.io/instance": "frpc-default-web"},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:         "frpc",
+				RestartCount: 4,
+				State: corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+				},
+			}},
+		},
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(s).WithObjects(pod).Build()
+	m := NewManager(nil, kubeClient, Config{OperatorNamespace: "operator"})
+
+	// Without log access nothing is reported.
+	excerpt, err := m.FrpcCrashExcerpt(context.Background(), svc, "")
+	if err != nil || excerpt != "" {
+		t.Fatalf("expected no excerpt without pod log access, got %q, %v", excerpt, err)
+	}
+
+	// The fake clientset returns canned "fake logs" for every container.
+	m.WithPodLogs(k8sfake.NewSimpleClientset().CoreV1())
+	excerpt, err = m.FrpcCrashExcerpt(context.Background(), svc, "")
+	if err != nil {
+		t.Fatalf("FrpcCrashExcerpt failed: %v", err)
+	}
+	want := "pod frpc-default-web-abc restart 4:\nfake logs"
+	if excerpt != want {
+		t.Errorf("expected %q, got %q", want, excerpt)
+	}
+
+	// The same crash is not fetched again.
+	again, err := m.FrpcCrashExcerpt(context.Background(), svc, want+" (cached)")
+	if err != nil || again != want+" (cached)" {
+		t.Errorf("expected the existing excerpt to be kept, got %q, %v", again, err)
+	}
+}
+
+func TestFrpcCrashExcerpt_HealthyPod(t *testing.T) {
+	s := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(s)
+
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "frpc-default-web-abc",
+			Namespace: "operator",
+			Labels:    map[string]string{"app.kubernetes.io/instance": "frpc-default-web"},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "frpc",
+				State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			}},
+		},
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(s).WithObjects(pod).Build()
+	m := NewManager(nil, kubeClient, Config{OperatorNamespace: "operator"}).
+		WithPodLogs(k8sfake.NewSimpleClientset().CoreV1())
+
+	excerpt, err := m.FrpcCrashExcerpt(context.Background(), svc, "")
+	if err != nil || excerpt != "" {
+		t.Errorf("expected no excerpt for a running frpc, got %q, %v", excerpt, err)
+	}
+}
@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+const (
+	// frpsConfigSecret is the Fly App secret holding frps.toml. Secrets are
+	// injected into the Machine's environment at boot and, unlike Machine
+	// env, cannot be read back through the API or dashboard, so the config
+	// (and any auth token in it) stays private.
+	frpsConfigSecret = "FRP_SERVER_CONFIG"
+
+	// frpsConfigHashEnv carries a hash of frps.toml in the Machine env. A
+	// config change thereby changes the Machine config, and the resulting
+	// update restarts the Machine onto the new secret.
+	frpsConfigHashEnv = "FRP_SERVER_CONFIG_HASH"
+)
+
+// tunnelSecrets are the generated credentials a tunnel's frp configs are
+// rendered with.
+type tunnelSecrets struct {
+	// token authenticates frpc to frps.
+	token string
+	// dashboard guards the frps dashboard; nil unless it is enabled.
+	dashboard *frp.Dashboard
+	// adminPassword guards the frpc admin API; empty unless it is enabled.
+	adminPassword string
+}
+
+// frpsConfig returns the frps config for the tunnel of svc with secrets.
+func (m *Manager) frpsConfig(svc *corev1.Service, secrets tunnelSecrets) string {
+	limits := m.config.FrpsLimits
+	limits.MaxPortsPerClient = frp.MaxPortsPerClientFor(svc, limits.MaxPortsPerClient)
+	httpPort, httpsPort := frp.VhostPorts(svc)
+	return frp.GenerateServerConfigWithOptions(frp.ServerOptions{
+		BindPort:       controlPort(svc),
+		Protocol:       frp.TransportProtocol(svc),
+		Dashboard:      secrets.dashboard,
+		Limits:         limits,
+		VhostHTTPPort:  httpPort,
+		VhostHTTPSPort: httpsPort,
+		LogLevel:       frp.FrpsLogLevelFor(svc, m.config.FrpsLogLevel),
+		AuthToken:      secrets.token,
+	})
+}
+
+// checkMaxPortsPerClient returns an error if the frps of svc would refuse
+// some of its proxies for exceeding the remote port limit, defaultLimit
+// unless overridden. Vhost proxies take no remote port.
+func checkMaxPortsPerClient(svc *corev1.Service, defaultLimit int) error {
+	limit := frp.MaxPortsPerClientFor(svc, defaultLimit)
+	n := 0
+	for _, proxy := range frp.ProxyPorts(svc) {
+		if frp.VhostPort(svc, proxy) == 0 {
+			n++
+		}
+	}
+	if limit > 0 && n > limit {
+		return fmt.Errorf("the Service publishes %d ports but frps allows %d per client; raise it with the %s annotation", n, limit, frp.AnnotationMaxPortsPerClient)
+	}
+	return nil
+}
+
+// frpsConfigHash returns the hash of config recorded in frpsConfigHashEnv.
+func frpsConfigHash(config string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(config)))
+}
+
+// pushFrpsConfig stores the frps config of desired as a secret on the Fly
+// App. It must run before the Machine is created or updated so the Machine
+// boots with it.
+func (m *Manager) pushFrpsConfig(ctx context.Context, flyAppName string, desired *desiredState) error {
+	if err := m.flyClient.SetAppSecrets(ctx, flyAppName, map[string]string{frpsConfigSecret: desired.frpsConfig}); err != nil {
+		return fmt.Errorf("setting frps config secret: %w", err)
+	}
+	return nil
+}
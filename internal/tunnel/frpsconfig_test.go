@@ -0,0 +1,84 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestFrpsLimits_KeptAcrossUpdate(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	config := newTestConfig()
+	config.FrpsLimits = frp.ServerLimits{MaxPoolCount: 2, MaxPortsPerClient: 4, HeartbeatTimeout: time.Minute}
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[frp.AnnotationMaxPortsPerClient] = "8"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	want := &frp.ServerTransport{MaxPoolCount: 2, HeartbeatTimeout: 60}
+	assertLimits := func(stage string) {
+		t.Helper()
+		frps, err := frp.ParseServerConfig(server.AppSecrets(result.FlyApp)["FRP_SERVER_CONFIG"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frps.MaxPortsPerClient != 8 || !reflect.DeepEqual(frps.Transport, want) {
+			t.Errorf("%s: expected maxPortsPerClient 8 and transport %+v, got %d and %+v", stage, want, frps.MaxPortsPerClient, frps.Transport)
+		}
+	}
+	assertLimits("after Provision")
+
+	annotateTunnelState(svc, result)
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating service: %v", err)
+	}
+	svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP})
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	assertLimits("after a port change")
+}
+
+func TestFrpsLimits_TooManyPorts(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	config := newTestConfig()
+	config.FrpsLimits.MaxPortsPerClient = 1
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+	)
+	if _, err := mgr.Provision(context.Background(), svc); !errors.Is(err, tunnel.ErrPermanent) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected nothing to be created, got %d apps", server.AppCount())
+	}
+
+	// The annotation raises the limit for this Service.
+	svc.Annotations[frp.AnnotationMaxPortsPerClient] = "2"
+	if _, err := mgr.Provision(context.Background(), svc); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+}
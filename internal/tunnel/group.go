@@ -0,0 +1,521 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+const (
+	// groupRecordKey is the key of a tunnel group's frpc config Secret
+	// holding its groupRecord.
+	groupRecordKey = "group.json"
+
+	// groupDeploymentPrefix starts the frpc Deployment name of every tunnel
+	// group. Per-Service Deployments start with "frpc-", so the two never
+	// collide.
+	groupDeploymentPrefix = "tunnel-group-"
+)
+
+// groupRecord is the state of a tunnel group, kept on its frpc config
+// Secret. It is written before member annotations are, so it is the
+// authority on which Services share the group's App, Machine and IP.
+type groupRecord struct {
+	FlyApp      string `json:"flyApp"`
+	MachineID   string `json:"machineID"`
+	IPID        string `json:"ipID"`
+	PublicIP    string `json:"publicIP"`
+	ControlPort int    `json:"controlPort"`
+	// Members maps each member Service ("namespace/name") to the public
+	// port of each of its proxies, keyed by frp.ProxyPort.Key.
+	Members map[string]map[string]int `json:"members"`
+}
+
+// tunnelGroup returns the tunnel group svc asks to join, if any.
+func tunnelGroup(svc *corev1.Service) string {
+	return svc.Annotations[AnnotationTunnelGroup]
+}
+
+func groupDeploymentName(group string) string {
+	return sanitizeName(groupDeploymentPrefix + group)
+}
+
+func groupAppName(group, flyOrg string) string {
+	return sanitizeName(fmt.Sprintf("fly-tunnel-group-%s-%s", group, flyOrg))
+}
+
+func memberKey(svc *corev1.Service) string {
+	return svc.Namespace + "/" + svc.Name
+}
+
+// validateGroupMember rejects the annotations that shape a tunnel's App,
+// Machine or frps and so cannot differ between members of a group.
+func validateGroupMember(svc *corev1.Service) error {
+	for _, key := range []string{
+		frp.AnnotationRandomRemotePorts,
+		frp.AnnotationFrpsDashboard,
+		frp.AnnotationTransport,
+		frp.AnnotationPoolCount,
+		AnnotationStableIdentity,
+		AnnotationFlyRegion,
+		AnnotationFlyMachineSize,
+		AnnotationFrpControlPort,
+		AnnotationSuspend,
+		AnnotationFrpcReplicas,
+		AnnotationLocalTarget,
+		AnnotationFrpcCanary,
+		AnnotationFrpcNodeSelector,
+		AnnotationFrpcTolerations,
+		AnnotationFrpcAffinity,
+		AnnotationIPv6,
+		frp.AnnotationMaxPortsPerClient,
+	} {
+		if _, ok := svc.Annotations[key]; ok {
+			return fmt.Errorf("annotation %s cannot be combined with %s", key, AnnotationTunnelGroup)
+		}
+	}
+	if httpPort, httpsPort := frp.VhostPorts(svc); httpPort != 0 || httpsPort != 0 {
+		return fmt.Errorf("%s vhost proxies cannot be combined with %s", frp.AnnotationProxyType, AnnotationTunnelGroup)
+	}
+	return nil
+}
+
+// lockGroup serializes changes to a tunnel group within this operator and
+// returns the unlock function.
+func (m *Manager) lockGroup(group string) func() {
+	mu, _ := m.groupLocks.LoadOrStore(group, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// recordedGroup returns the tunnel group whose frpc serves svc, or "" for a
+// Service with a tunnel of its own or none at all.
+func (m *Manager) recordedGroup(ctx context.Context, svc *corev1.Service) (string, error) {
+	deployName := svc.Annotations[AnnotationFrpcDeployment]
+	if deployName == "" || !strings.HasPrefix(deployName, groupDeploymentPrefix) {
+		return "", nil
+	}
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: frpcConfigName(deployName), Namespace: m.frpcNamespace(svc)}
+	if err := m.kubeClient.Get(ctx, key, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return tunnelGroup(svc), nil
+		}
+		return "", fmt.Errorf("getting tunnel group config: %w", err)
+	}
+	return secret.Annotations[AnnotationTunnelGroup], nil
+}
+
+// loadGroup returns the record and frps auth token of group, or a nil
+// record if the group has no tunnel yet.
+func (m *Manager) loadGroup(ctx context.Context, group string) (*groupRecord, string, error) {
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: frpcConfigName(groupDeploymentName(group)), Namespace: m.config.OperatorNamespace}
+	if err := m.kubeClient.Get(ctx, key, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("getting tunnel group config: %w", err)
+	}
+	var rec groupRecord
+	if err := json.Unmarshal(secret.Data[groupRecordKey], &rec); err != nil {
+		return nil, "", fmt.Errorf("decoding tunnel group record: %w", err)
+	}
+	if rec.Members == nil {
+		rec.Members = make(map[string]map[string]int)
+	}
+	return &rec, string(secret.Data[frpcTokenKey]), nil
+}
+
+// takenPorts returns the public ports ("port/protocol") of the group, other
+// than those of svc, mapped to the member serving them. The control port
+// is served by frps itself.
+func (rec *groupRecord) takenPorts(svc *corev1.Service) map[string]string {
+	taken := map[string]string{fmt.Sprintf("%d/tcp", rec.ControlPort): "frps"}
+	for key, ports := range rec.Members {
+		if key == memberKey(svc) {
+			continue
+		}
+		for proxyKey, port := range ports {
+			taken[fmt.Sprintf("%d/%s", port, proxyProtocol(proxyKey))] = key
+		}
+	}
+	return taken
+}
+
+// assignPorts records the public port of every proxy of svc in rec, keeping
+// the ports it was already assigned. A proxy gets its Service port (or its
+// frp.AnnotationRemotePort override) unless the control port or another
+// member has it, in which case the next free port up is used.
+func (rec *groupRecord) assignPorts(svc *corev1.Service) error {
+	taken := rec.takenPorts(svc)
+	previous := rec.Members[memberKey(svc)]
+	assigned := make(map[string]int)
+	for _, proxy := range frp.ProxyPorts(svc) {
+		port, ok := previous[proxy.Key()]
+		if _, clash := taken[fmt.Sprintf("%d/%s", port, proxy.Protocol)]; !ok || clash {
+			port = frp.RemotePortFor(svc, proxy)
+			for taken[fmt.Sprintf("%d/%s", port, proxy.Protocol)] != "" {
+				port++
+			}
+			if port > 65535 {
+				return fmt.Errorf("no free public port for %s in tunnel group %s", proxy.Key(), tunnelGroup(svc))
+			}
+		}
+		taken[fmt.Sprintf("%d/%s", port, proxy.Protocol)] = memberKey(svc)
+		assigned[proxy.Key()] = port
+	}
+	rec.Members[memberKey(svc)] = assigned
+	return nil
+}
+
+// claimPorts records ports, the public ports svc is already served on, as
+// its ports in rec. It fails with ErrGroupPortConflict, leaving rec alone,
+// if the group serves any of them for someone else.
+func (rec *groupRecord) claimPorts(svc *corev1.Service, ports map[string]int) error {
+	taken := rec.takenPorts(svc)
+	for key, port := range ports {
+		entry := fmt.Sprintf("%d/%s", port, proxyProtocol(key))
+		if owner, ok := taken[entry]; ok {
+			return fmt.Errorf("%w: public port %s of %s is already served for %s", ErrGroupPortConflict, entry, key, owner)
+		}
+	}
+	rec.Members[memberKey(svc)] = ports
+	return nil
+}
+
+// proxyProtocol returns the protocol of a frp.ProxyPort.Key.
+func proxyProtocol(key string) string {
+	_, protocol, _ := strings.Cut(key, "/")
+	return protocol
+}
+
+// formatRemotePorts formats the ports of a member as an
+// AnnotationAssignedRemotePorts value.
+func formatRemotePorts(ports map[string]int) string {
+	pairs := make([]string, 0, len(ports))
+	for key, port := range ports {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", key, port))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// groupFrpsConfig returns the frps config shared by the members of a group.
+// The group frpc serves every member's ports, so the remote port limit does
+// not apply, nor do the members' log level annotations.
+func (m *Manager) groupFrpsConfig(rec *groupRecord, token string) string {
+	limits := m.config.FrpsLimits
+	limits.MaxPortsPerClient = 0
+	return frp.GenerateServerConfigWithOptions(frp.ServerOptions{
+		BindPort:  rec.ControlPort,
+		Limits:    limits,
+		LogLevel:  m.config.FrpsLogLevel,
+		AuthToken: token,
+	})
+}
+
+// groupMachineInput returns the Machine running the frps of group, exposing
+// the control port and every member's public ports.
+func (m *Manager) groupMachineInput(group string, rec *groupRecord, token string) flyio.CreateMachineInput {
+	services := []flyio.MachineService{{
+		Protocol:     "tcp",
+		InternalPort: rec.ControlPort,
+		Ports:        []flyio.Port{{Port: rec.ControlPort}},
+	}}
+	var exposed []string
+	seen := make(map[string]bool)
+	for _, ports := range rec.Members {
+		for key, port := range ports {
+			entry := fmt.Sprintf("%d/%s", port, proxyProtocol(key))
+			if !seen[entry] {
+				seen[entry] = true
+				exposed = append(exposed, entry)
+			}
+		}
+	}
+	// Map iteration order must not reorder the Machine's services.
+	sort.Strings(exposed)
+	for _, entry := range exposed {
+		portStr, protocol, _ := strings.Cut(entry, "/")
+		port, _ := strconv.Atoi(portStr)
+		services = append(services, flyio.MachineService{
+			Protocol:     protocol,
+			InternalPort: port,
+			Ports:        []flyio.Port{{Port: port}},
+		})
+	}
+	return m.frpsMachineInput(sanitizeName("frp-group-"+group), m.config.FlyRegion,
+		m.guest(nil), services, m.groupFrpsConfig(rec, token))
+}
+
+// deployGroupFrpc renders the shared frpc config of every member of group
+// and applies it along with rec. current stands in for its own member
+// Service, whose annotations may be newer than the stored object's. It
+// reports whether it wrote the frpc Secret or Deployment.
+func (m *Manager) deployGroupFrpc(ctx context.Context, group string, rec *groupRecord, token string, current *corev1.Service) (bool, error) {
+	keys := make([]string, 0, len(rec.Members))
+	for key := range rec.Members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var members []frp.GroupMember
+	for _, key := range keys {
+		svc := current
+		if current == nil || key != memberKey(current) {
+			namespace, name, _ := strings.Cut(key, "/")
+			svc = &corev1.Service{}
+			if err := m.kubeClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, svc); err != nil {
+				if apierrors.IsNotFound(err) {
+					// Its own teardown removes it from the record.
+					continue
+				}
+				return false, fmt.Errorf("getting tunnel group member %s: %w", key, err)
+			}
+		}
+		members = append(members, frp.GroupMember{Service: svc, RemotePorts: rec.Members[key]})
+	}
+
+	config := frp.GenerateGroupClientConfig(members, rec.PublicIP, rec.ControlPort, token, m.config.ClusterDomain, m.config.FrpcHeartbeat, m.config.FrpcLogLevel)
+	state := &desiredState{
+		frpcDeploymentName: groupDeploymentName(group),
+		frpcConfig:         config,
+		frpcConfigHash:     fmt.Sprintf("%x", sha256.Sum256([]byte(config))),
+		frpcResources:      *defaultFrpcResources.DeepCopy(),
+		frpcReplicas:       1,
+		frpcScheduling:     frpcScheduling{nodeSelector: m.config.FrpcNodeSelector},
+	}
+	state.frpcConfigName = frpcConfigName(state.frpcDeploymentName)
+	state.frpcDeployment = m.frpcDeploymentSpec(state)
+
+	recData, err := json.Marshal(rec)
+	if err != nil {
+		return false, fmt.Errorf("encoding tunnel group record: %w", err)
+	}
+	return m.applyFrpc(ctx, m.config.OperatorNamespace, state, sanitizeName("group-"+group),
+		map[string]string{AnnotationTunnelGroup: group},
+		map[string][]byte{frpcTokenKey: []byte(token), groupRecordKey: recData})
+}
+
+// updateGroupMachine pushes the group's frps config and updates its Machine
+// to expose the ports in rec.
+func (m *Manager) updateGroupMachine(ctx context.Context, group string, rec *groupRecord, token string) error {
+	if err := m.flyClient.SetAppSecrets(ctx, rec.FlyApp, map[string]string{frpsConfigSecret: m.groupFrpsConfig(rec, token)}); err != nil {
+		return fmt.Errorf("setting frps config secret: %w", err)
+	}
+	if _, err := m.flyClient.UpdateMachine(ctx, rec.FlyApp, rec.MachineID, m.groupMachineInput(group, rec, token)); err != nil {
+		return fmt.Errorf("updating fly machine: %w", err)
+	}
+	return nil
+}
+
+// provisionGroupMember adds svc to its tunnel group, creating the group's
+// App, Machine and IP if it is the first member.
+func (m *Manager) provisionGroupMember(ctx context.Context, svc *corev1.Service) (*TunnelResult, error) {
+	if err := validateGroupMember(svc); err != nil {
+		return nil, permanent(err)
+	}
+	return m.joinGroup(ctx, svc, tunnelGroup(svc), nil)
+}
+
+// joinGroup adds svc to group, creating the group's App, Machine and IP if
+// it is the first member. A non-nil keep holds the public ports svc must
+// keep; see claimPorts.
+func (m *Manager) joinGroup(ctx context.Context, svc *corev1.Service, group string, keep map[string]int) (*TunnelResult, error) {
+	logger := log.FromContext(ctx)
+
+	unlock := m.lockGroup(group)
+	defer unlock()
+
+	rec, token, err := m.loadGroup(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	created := rec == nil
+	if created {
+		if token, err = newToken(); err != nil {
+			return nil, err
+		}
+		controlPort := m.config.ControlPort
+		if controlPort == 0 {
+			controlPort = frp.DefaultServerPort
+		}
+		rec = &groupRecord{ControlPort: controlPort, Members: make(map[string]map[string]int)}
+	}
+	if keep != nil {
+		if err := rec.claimPorts(svc, keep); err != nil {
+			return nil, err
+		}
+	}
+	if err := rec.assignPorts(svc); err != nil {
+		return nil, permanent(err)
+	}
+
+	if created {
+		logger.Info("Creating tunnel group", "group", group)
+		if err := m.createGroupTunnel(ctx, svc, group, rec, token); err != nil {
+			return nil, err
+		}
+	} else {
+		logger.Info("Joining tunnel group", "group", group, "app", rec.FlyApp)
+		if err := m.updateGroupMachine(ctx, group, rec, token); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := m.deployGroupFrpc(ctx, group, rec, token, svc); err != nil {
+		return nil, fmt.Errorf("deploying frpc: %w", err)
+	}
+
+	return &TunnelResult{
+		FlyApp:              rec.FlyApp,
+		MachineID:           rec.MachineID,
+		PublicIP:            rec.PublicIP,
+		IPID:                rec.IPID,
+		FrpcDeployment:      groupDeploymentName(group),
+		FrpcNamespace:       m.config.OperatorNamespace,
+		IPOwnership:         IPOwnershipOperator,
+		OperatorIdentity:    m.Identity(svc),
+		Versions:            m.versionAnnotations(),
+		ControlPort:         rec.ControlPort,
+		AssignedRemotePorts: formatRemotePorts(rec.Members[memberKey(svc)]),
+	}, nil
+}
+
+// createGroupTunnel creates the App, Machine and IP of a new tunnel group
+// and records them in rec. On failure the App is deleted again.
+func (m *Manager) createGroupTunnel(ctx context.Context, svc *corev1.Service, group string, rec *groupRecord, token string) error {
+	flyAppName, _, err := m.ensureApp(ctx, svc, groupAppName(group, m.config.FlyOrg))
+	if err != nil {
+		return permanentIfQuota(fmt.Errorf("ensuring fly app: %w", err))
+	}
+	fail := func(err error) error {
+		_ = m.flyClient.DeleteApp(ctx, flyAppName)
+		return err
+	}
+	rec.FlyApp = flyAppName
+
+	if err := m.flyClient.SetAppSecrets(ctx, flyAppName, map[string]string{frpsConfigSecret: m.groupFrpsConfig(rec, token)}); err != nil {
+		return fail(fmt.Errorf("setting frps config secret: %w", err))
+	}
+	machine, err := m.flyClient.CreateMachine(ctx, flyAppName, m.groupMachineInput(group, rec, token))
+	if err != nil {
+		return fail(permanentIfQuota(fmt.Errorf("creating fly machine: %w", err)))
+	}
+	rec.MachineID = machine.ID
+	if err := m.flyClient.WaitForMachine(ctx, flyAppName, machine.ID, machine.InstanceID, "started", m.machineStartTimeout(svc)); err != nil {
+		return fail(fmt.Errorf("waiting for machine to start: %w", err))
+	}
+	ip, err := m.flyClient.AllocateDedicatedIPv4(ctx, flyAppName)
+	if err != nil {
+		return fail(permanentIfQuota(fmt.Errorf("allocating dedicated IPv4: %w", err)))
+	}
+	rec.IPID, rec.PublicIP = ip.ID, ip.Address
+	return nil
+}
+
+// updateGroupMember brings the group tunnel in line with the ports of svc
+// and records its public ports on it. It reports whether it changed the
+// group's frpc or Machine.
+func (m *Manager) updateGroupMember(ctx context.Context, svc *corev1.Service, group string) (bool, error) {
+	if err := validateGroupMember(svc); err != nil {
+		return false, err
+	}
+
+	unlock := m.lockGroup(group)
+	defer unlock()
+
+	rec, token, err := m.loadGroup(ctx, group)
+	if err != nil {
+		return false, err
+	}
+	if rec == nil {
+		return false, fmt.Errorf("tunnel group %s has no recorded tunnel", group)
+	}
+	before := rec.Members[memberKey(svc)]
+	if err := rec.assignPorts(svc); err != nil {
+		return false, err
+	}
+	ports := rec.Members[memberKey(svc)]
+	machineChanged := !reflect.DeepEqual(before, ports)
+	if machineChanged {
+		if err := m.updateGroupMachine(ctx, group, rec, token); err != nil {
+			return false, err
+		}
+	}
+	frpcChanged, err := m.deployGroupFrpc(ctx, group, rec, token, svc)
+	if err != nil {
+		return false, fmt.Errorf("updating frpc deployment: %w", err)
+	}
+
+	if assigned := formatRemotePorts(ports); svc.Annotations[AnnotationAssignedRemotePorts] != assigned {
+		patch := client.MergeFrom(svc.DeepCopy())
+		svc.Annotations[AnnotationAssignedRemotePorts] = assigned
+		if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+			return false, fmt.Errorf("recording assigned remote ports: %w", err)
+		}
+	}
+	return machineChanged || frpcChanged, m.recordVersions(ctx, svc)
+}
+
+// teardownGroupMember removes svc from its tunnel group. The group's App,
+// Machine, IP and frpc go with its last member; until then only the
+// proxies of svc are removed.
+func (m *Manager) teardownGroupMember(ctx context.Context, svc *corev1.Service, group string) error {
+	logger := log.FromContext(ctx)
+
+	unlock := m.lockGroup(group)
+	defer unlock()
+
+	rec, token, err := m.loadGroup(ctx, group)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		logger.Info("Tunnel group has no recorded tunnel; nothing to tear down", "group", group)
+		return nil
+	}
+	if _, ok := rec.Members[memberKey(svc)]; !ok {
+		logger.Info("Service is not a recorded member of its tunnel group", "group", group)
+		return nil
+	}
+	delete(rec.Members, memberKey(svc))
+
+	if len(rec.Members) > 0 {
+		logger.Info("Leaving tunnel group", "group", group, "remaining", len(rec.Members))
+		if err := m.updateGroupMachine(ctx, group, rec, token); err != nil {
+			return err
+		}
+		if _, err := m.deployGroupFrpc(ctx, group, rec, token, nil); err != nil {
+			return fmt.Errorf("updating frpc deployment: %w", err)
+		}
+		return teardownResult(ctx)
+	}
+
+	logger.Info("Last member left tunnel group; deleting it", "group", group, "app", rec.FlyApp)
+	// Deleting the App takes its Machine and IP with it. The group record
+	// lives in the frpc config Secret, so frpc goes last: a failed App
+	// deletion is retried from the record.
+	if err := ignoreFlyNotFound(m.flyClient.DeleteApp(ctx, rec.FlyApp)); err != nil {
+		return fmt.Errorf("deleting fly app of tunnel group %s: %w", group, err)
+	}
+	if err := m.deleteFrpcResources(ctx, m.config.OperatorNamespace, groupDeploymentName(group)); err != nil {
+		return fmt.Errorf("deleting frpc resources of tunnel group %s: %w", group, err)
+	}
+	return teardownResult(ctx)
+}
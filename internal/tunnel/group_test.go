@@ -0,0 +1,137 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestTunnelGroup_JoinAndLeave(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	web := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	web.Annotations[tunnel.AnnotationTunnelGroup] = "shared"
+	api := testService("web", "staging",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	)
+	api.Annotations[tunnel.AnnotationTunnelGroup] = "shared"
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).
+		WithObjects(testOperatorNamespace(), web, api).
+		Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	webResult, err := mgr.Provision(context.Background(), web)
+	if err != nil {
+		t.Fatalf("Provision web failed: %v", err)
+	}
+	apiResult, err := mgr.Provision(context.Background(), api)
+	if err != nil {
+		t.Fatalf("Provision api failed: %v", err)
+	}
+
+	// Both Services share one App, Machine and IP.
+	if server.AppCount() != 1 || server.MachineCount() != 1 || server.IPCount() != 1 {
+		t.Fatalf("expected 1 app, machine and IP, got %d, %d and %d", server.AppCount(), server.MachineCount(), server.IPCount())
+	}
+	if webResult.PublicIP != apiResult.PublicIP || webResult.MachineID != apiResult.MachineID {
+		t.Errorf("expected members to share the tunnel, got %+v and %+v", webResult, apiResult)
+	}
+	if webResult.FrpcDeployment != apiResult.FrpcDeployment {
+		t.Errorf("expected members to share frpc, got %q and %q", webResult.FrpcDeployment, apiResult.FrpcDeployment)
+	}
+
+	// The second member's clashing port is remapped.
+	if webResult.AssignedRemotePorts != "80/tcp=80" {
+		t.Errorf("unexpected web ports %q", webResult.AssignedRemotePorts)
+	}
+	if apiResult.AssignedRemotePorts != "53/udp=53,80/tcp=81" {
+		t.Errorf("unexpected api ports %q", apiResult.AssignedRemotePorts)
+	}
+	machine := server.GetMachines()[webResult.MachineID]
+	for _, port := range []int{frp.DefaultServerPort, 80, 81} {
+		if !exposesPort(machine, port) {
+			t.Errorf("expected port %d to be exposed, got %+v", port, machine.Config.Services)
+		}
+	}
+	if !exposesUDPPort(machine, 53) {
+		t.Errorf("expected UDP port 53 to be exposed, got %+v", machine.Config.Services)
+	}
+
+	config := frpcConfig(t, kubeClient, webResult.FrpcDeployment)
+	for _, want := range []string{
+		`name = "default-web-http"`,
+		`localIP = "web.default.svc.cluster.local"`,
+		`name = "staging-web-http"`,
+		`localIP = "web.staging.svc.cluster.local"`,
+		"remotePort = 81",
+		"remotePort = 53",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("expected shared frpc config to contain %q, got:\n%s", want, config)
+		}
+	}
+
+	// The first member leaving only removes its own proxies.
+	annotateTunnelState(web, webResult)
+	if err := mgr.Teardown(context.Background(), web); err != nil {
+		t.Fatalf("Teardown web failed: %v", err)
+	}
+	if server.AppCount() != 1 || server.MachineCount() != 1 || server.IPCount() != 1 {
+		t.Fatalf("expected the group tunnel to remain, got %d apps, %d machines and %d IPs", server.AppCount(), server.MachineCount(), server.IPCount())
+	}
+	machine = server.GetMachines()[webResult.MachineID]
+	if exposesPort(machine, 80) || !exposesPort(machine, 81) {
+		t.Errorf("expected only the remaining member's ports, got %+v", machine.Config.Services)
+	}
+	config = frpcConfig(t, kubeClient, webResult.FrpcDeployment)
+	if strings.Contains(config, "web.default.svc") || !strings.Contains(config, "web.staging.svc") {
+		t.Errorf("expected only the remaining member's proxies, got:\n%s", config)
+	}
+
+	// The last member leaving deletes the group tunnel.
+	annotateTunnelState(api, apiResult)
+	if err := mgr.Teardown(context.Background(), api); err != nil {
+		t.Fatalf("Teardown api failed: %v", err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected the group app to be deleted, got %d apps", server.AppCount())
+	}
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: webResult.FrpcDeployment + "-config", Namespace: testNamespace}
+	if err := kubeClient.Get(context.Background(), key, &secret); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the shared frpc config to be deleted, got %v", err)
+	}
+}
+
+func TestTunnelGroup_RejectsPerTunnelAnnotations(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	svc.Annotations[tunnel.AnnotationTunnelGroup] = "shared"
+	svc.Annotations[tunnel.AnnotationFlyRegion] = "ams"
+
+	_, err := mgr.Provision(context.Background(), svc)
+	if !errors.Is(err, tunnel.ErrPermanent) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected no app, got %d", server.AppCount())
+	}
+}
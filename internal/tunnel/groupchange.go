@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// ErrGroupPortConflict is returned by ChangeTunnelGroup when the target
+// tunnel group already serves one of the public ports of the Service. The
+// Service stays on its current tunnel; the move can succeed once the port is
+// free.
+var ErrGroupPortConflict = errors.New("tunnel group port conflict")
+
+// TunnelGroupChange returns the tunnel group the tunnel of svc is recorded
+// in and the one AnnotationTunnelGroup asks for, "" standing for a tunnel of
+// its own. They differ while the Service is moving into, out of or between
+// groups, which ChangeTunnelGroup carries out.
+func (m *Manager) TunnelGroupChange(ctx context.Context, svc *corev1.Service) (from, to string, err error) {
+	from, err = m.recordedGroup(ctx, svc)
+	if err != nil {
+		return "", "", err
+	}
+	return from, tunnelGroup(svc), nil
+}
+
+// ChangeTunnelGroup moves a provisioned Service to the tunnel group that
+// AnnotationTunnelGroup names, or to a tunnel of its own when it names none.
+// The new tunnel is brought up before the old one is drained, so a refused
+// or failed move leaves the Service served as before. Moving into a group
+// keeps the Service's public ports, and is refused with ErrGroupPortConflict
+// if the group already serves one of them.
+//
+// The returned result describes the new tunnel and must be recorded on the
+// Service even when an error is also returned: the error then reports that
+// draining the old tunnel failed.
+func (m *Manager) ChangeTunnelGroup(ctx context.Context, svc *corev1.Service) (*TunnelResult, error) {
+	ctx = flyio.ContextWithAuditSubject(ctx, svc.Namespace+"/"+svc.Name)
+	logger := log.FromContext(ctx)
+
+	from, to, err := m.TunnelGroupChange(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+	if from == to {
+		return nil, fmt.Errorf("service is not changing tunnel group")
+	}
+
+	var result *TunnelResult
+	if to != "" {
+		result, err = m.enterGroup(ctx, svc, from, to)
+	} else {
+		// Provision a tunnel of its own from scratch: the recorded state
+		// is the group's.
+		fresh := svc.DeepCopy()
+		for _, key := range tunnelAnnotations {
+			delete(fresh.Annotations, key)
+		}
+		delete(fresh.Annotations, AnnotationAssignedRemotePorts)
+		result, err = m.Provision(ctx, fresh)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Draining previous tunnel", "from", from, "to", to)
+	if from != "" {
+		err = m.teardownGroupMember(ctx, svc, from)
+	} else {
+		err = m.Teardown(ctx, svc)
+	}
+	if err != nil {
+		return result, fmt.Errorf("draining previous tunnel: %w", err)
+	}
+	return result, nil
+}
+
+// enterGroup adds svc, served by the tunnel group from or by a tunnel of
+// its own, to group on the public ports it has now.
+func (m *Manager) enterGroup(ctx context.Context, svc *corev1.Service, from, group string) (*TunnelResult, error) {
+	ctx, cancel := withBudget(ctx, m.timeouts.Provision)
+	defer cancel()
+
+	svc, err := m.withFrpOptions(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateAnnotations(svc); err != nil {
+		return nil, permanent(err)
+	}
+	if err := validateGroupMember(svc); err != nil {
+		return nil, permanent(err)
+	}
+
+	keep := make(map[string]int)
+	if from != "" {
+		rec, _, err := m.loadGroup(ctx, from)
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil {
+			maps.Copy(keep, rec.Members[memberKey(svc)])
+		}
+	}
+	// Proxies the Service gained since, and the ports of a tunnel of its
+	// own, are the public ports they are served on alone.
+	for _, proxy := range frp.ProxyPorts(svc) {
+		if _, ok := keep[proxy.Key()]; !ok {
+			keep[proxy.Key()] = frp.RemotePortFor(svc, proxy)
+		}
+	}
+	return m.joinGroup(ctx, svc, group, keep)
+}
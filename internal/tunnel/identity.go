@@ -0,0 +1,123 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// AnnotationStableIdentity gives a Service a tunnel identity that outlives the
+// Service object. The Fly App and dedicated IP are named after and retained
+// for the identity, so a Service recreated with the same key (e.g. by a
+// Gateway API implementation) in the same namespace adopts them instead of
+// getting a new IP.
+const AnnotationStableIdentity = "fly-tunnel-operator.dev/stable-identity"
+
+// Keys of the identity record ConfigMap.
+const (
+	identityKeyNamespace = "namespace"
+	identityKeyIdentity  = "identity"
+	identityKeyFlyApp    = "fly-app"
+	identityKeyIPID      = "ip-id"
+	identityKeyPublicIP  = "public-ip"
+)
+
+// identityRecord is the retained tunnel state for a stable identity.
+type identityRecord struct {
+	FlyApp   string
+	IPID     string
+	PublicIP string
+}
+
+func stableIdentity(svc *corev1.Service) string {
+	return svc.Annotations[AnnotationStableIdentity]
+}
+
+func identityRecordName(svc *corev1.Service) string {
+	return sanitizeName(fmt.Sprintf("fly-tunnel-identity-%s-%s", svc.Namespace, stableIdentity(svc)))
+}
+
+// loadIdentity returns the retained state for the Service's stable identity,
+// or nil if none has been recorded. The record lives in the operator
+// namespace and is only trusted if it was written by this operator for the
+// same namespace and key.
+func (m *Manager) loadIdentity(ctx context.Context, svc *corev1.Service) (*identityRecord, error) {
+	var cm corev1.ConfigMap
+	key := types.NamespacedName{Name: identityRecordName(svc), Namespace: m.config.OperatorNamespace}
+	if err := m.kubeClient.Get(ctx, key, &cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("getting identity record: %w", err)
+	}
+
+	if cm.Labels["app.kubernetes.io/managed-by"] != "fly-tunnel-operator" ||
+		cm.Data[identityKeyNamespace] != svc.Namespace ||
+		cm.Data[identityKeyIdentity] != stableIdentity(svc) {
+		return nil, fmt.Errorf("identity record %s does not belong to stable identity %q in namespace %s",
+			key.Name, stableIdentity(svc), svc.Namespace)
+	}
+	if cm.Data[identityKeyFlyApp] == "" || cm.Data[identityKeyIPID] == "" {
+		return nil, nil
+	}
+
+	return &identityRecord{
+		FlyApp:   cm.Data[identityKeyFlyApp],
+		IPID:     cm.Data[identityKeyIPID],
+		PublicIP: cm.Data[identityKeyPublicIP],
+	}, nil
+}
+
+// saveIdentity records the tunnel state to retain for the Service's stable
+// identity. A record retained by a teardown expires after the identity TTL;
+// one written for a live Service does not.
+func (m *Manager) saveIdentity(ctx context.Context, svc *corev1.Service, rec identityRecord, retained bool) error {
+	var annotations map[string]string
+	if retained {
+		annotations = expiry(artifactIdentity, m.config.ArtifactTTLs.Identity)
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      identityRecordName(svc),
+			Namespace: m.config.OperatorNamespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "fly-tunnel-operator",
+			},
+			Annotations: annotations,
+		},
+		Data: map[string]string{
+			identityKeyNamespace: svc.Namespace,
+			identityKeyIdentity:  stableIdentity(svc),
+			identityKeyFlyApp:    rec.FlyApp,
+			identityKeyIPID:      rec.IPID,
+			identityKeyPublicIP:  rec.PublicIP,
+		},
+	}
+
+	if err := m.kubeClient.Create(ctx, cm); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("creating identity record: %w", err)
+		}
+		var existing corev1.ConfigMap
+		if err := m.kubeClient.Get(ctx, types.NamespacedName{Name: cm.Name, Namespace: cm.Namespace}, &existing); err != nil {
+			return fmt.Errorf("getting identity record: %w", err)
+		}
+		existing.Data = cm.Data
+		delete(existing.Annotations, annotationArtifact)
+		delete(existing.Annotations, AnnotationExpiresAt)
+		for k, v := range annotations {
+			if existing.Annotations == nil {
+				existing.Annotations = make(map[string]string)
+			}
+			existing.Annotations[k] = v
+		}
+		if err := m.kubeClient.Update(ctx, &existing); err != nil {
+			return fmt.Errorf("updating identity record: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package tunnel
+
+import (
+	"errors"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ErrProvisionInProgress is returned by Update when a Provision of the same
+// Service is still running in this operator. The annotations Update works
+// from may be half-written until it returns, so callers should retry later.
+var ErrProvisionInProgress = errors.New("tunnel is still being provisioned")
+
+// provisionsInFlight counts the running Provision calls of each Service.
+type provisionsInFlight struct {
+	mu       sync.Mutex
+	services map[types.NamespacedName]int
+}
+
+// begin records a Provision of svc and returns the function ending it.
+func (p *provisionsInFlight) begin(svc *corev1.Service) func() {
+	key := client.ObjectKeyFromObject(svc)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.services == nil {
+		p.services = make(map[types.NamespacedName]int)
+	}
+	p.services[key]++
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.services[key]--; p.services[key] == 0 {
+			delete(p.services, key)
+		}
+	}
+}
+
+// active reports whether a Provision of svc is running.
+func (p *provisionsInFlight) active(svc *corev1.Service) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.services[client.ObjectKeyFromObject(svc)] > 0
+}
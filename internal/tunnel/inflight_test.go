@@ -0,0 +1,90 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestUpdate_WaitsForProvisionInFlight(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	// CreateMachine stalls until released, holding Provision open.
+	creating := make(chan struct{})
+	release := make(chan struct{})
+	var provisioning atomic.Bool
+	var interleaved atomic.Int32
+	server.OnCreateMachine = func(string, flyio.CreateMachineInput) error {
+		close(creating)
+		<-release
+		return nil
+	}
+	server.OnUpdateMachine = func(string, string, flyio.CreateMachineInput) error {
+		if provisioning.Load() {
+			interleaved.Add(1)
+		}
+		return nil
+	}
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	provisioning.Store(true)
+	var wg sync.WaitGroup
+	var result *tunnel.TunnelResult
+	var provisionErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		result, provisionErr = mgr.Provision(context.Background(), svc.DeepCopy())
+	}()
+	<-creating
+
+	// A second worker reconciles the Service from half-written annotations.
+	stale := svc.DeepCopy()
+	stale.Annotations[tunnel.AnnotationFlyApp] = "fly-tunnel-default-web-personal"
+	stale.Annotations[tunnel.AnnotationPublicIP] = "137.66.0.1"
+	stale.Annotations[tunnel.AnnotationFrpcDeployment] = "frpc-default-web"
+	var updates sync.WaitGroup
+	for range 2 {
+		updates.Add(1)
+		go func() {
+			defer updates.Done()
+			if _, err := mgr.Update(context.Background(), stale.DeepCopy()); !errors.Is(err, tunnel.ErrProvisionInProgress) {
+				t.Errorf("expected Update to wait for the Provision, got %v", err)
+			}
+		}()
+	}
+	updates.Wait()
+	close(release)
+	wg.Wait()
+	provisioning.Store(false)
+	if provisionErr != nil {
+		t.Fatalf("Provision failed: %v", provisionErr)
+	}
+	if n := interleaved.Load(); n != 0 {
+		t.Errorf("expected no Machine updates during the Provision, got %d", n)
+	}
+
+	// Once provisioned, Update goes ahead.
+	annotateTunnelState(svc, result)
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating service: %v", err)
+	}
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// AnnotationIPOwnership records whether the tunnel's public IP was allocated
+// by the operator ("operator") or supplied by the user ("external"). Teardown
+// only releases operator-owned addresses. Tunnels provisioned before it was
+// introduced allocated their own IP and are treated as operator-owned.
+const AnnotationIPOwnership = "fly-tunnel-operator.dev/ip-ownership"
+
+// IP ownership modes recorded in AnnotationIPOwnership.
+const (
+	IPOwnershipOperator = "operator"
+	IPOwnershipExternal = "external"
+)
+
+// ownsIP reports whether the operator allocated the public IP of svc and may
+// therefore release it. Unrecognised values are treated as external, so an
+// address is never released unless the operator is known to own it.
+func ownsIP(svc *corev1.Service) bool {
+	switch svc.Annotations[AnnotationIPOwnership] {
+	case "", IPOwnershipOperator:
+		return true
+	default:
+		return false
+	}
+}
+
+// verifyIP checks that the IP recorded on svc is still allocated to its App
+// and returns the address frpc should connect to. An operator-owned IP that
+// was released out-of-band is replaced with a newly allocated one, recorded
+// on svc so the next reconcile publishes it. An external IP cannot be
+// replaced by the operator, so its loss is an error.
+func (m *Manager) verifyIP(ctx context.Context, svc *corev1.Service, flyAppName string) (string, error) {
+	logger := log.FromContext(ctx)
+	id, address := svc.Annotations[AnnotationIPID], svc.Annotations[AnnotationPublicIP]
+
+	ips, err := m.flyClient.ListIPAddresses(ctx, flyAppName)
+	if err != nil {
+		return "", fmt.Errorf("listing IPs: %w", err)
+	}
+	for _, ip := range ips {
+		if ip.ID == id && ip.Address == address {
+			return address, nil
+		}
+	}
+
+	if !ownsIP(svc) {
+		return "", fmt.Errorf("externally owned IP %s is no longer allocated to app %s", address, flyAppName)
+	}
+
+	logger.Info("Recorded IP is no longer allocated; allocating a new one", "app", flyAppName, "id", id, "address", address)
+	ip, err := m.flyClient.AllocateDedicatedIPv4(ctx, flyAppName)
+	if err != nil {
+		return "", permanentIfQuota(fmt.Errorf("re-allocating dedicated IPv4: %w", err))
+	}
+
+	patch := client.MergeFrom(svc.DeepCopy())
+	svc.Annotations[AnnotationIPID] = ip.ID
+	svc.Annotations[AnnotationPublicIP] = ip.Address
+	if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+		// Unrecorded, the new IP would leak; the next Update tries again.
+		_ = m.flyClient.ReleaseIPAddress(ctx, flyAppName, ip.ID)
+		return "", fmt.Errorf("recording re-allocated IP: %w", err)
+	}
+	m.event(svc, corev1.EventTypeWarning, "IPReallocated",
+		"Public IP %s was no longer allocated on Fly.io; allocated %s", address, ip.Address)
+
+	if stableIdentity(svc) != "" {
+		rec := identityRecord{FlyApp: flyAppName, IPID: ip.ID, PublicIP: ip.Address}
+		if err := m.saveIdentity(ctx, svc, rec, false); err != nil {
+			logger.Error(err, "Failed to record re-allocated IP for stable identity", "identity", stableIdentity(svc))
+		}
+	}
+	return ip.Address, nil
+}
@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+const (
+	// AnnotationIPv6 set to "true" publishes the tunnel dual-stack: a
+	// dedicated IPv6 is allocated next to the IPv4.
+	//
+	// The IPv4 is required: frpc reaches frps through it, so failing to
+	// allocate it fails provisioning as before. The IPv6 is not: if it
+	// fails, the IPv4 is published alone, an IPAllocationPartial event says
+	// why, and only the IPv6 is retried on later reconciles.
+	AnnotationIPv6 = "fly-tunnel-operator.dev/ipv6"
+
+	// AnnotationPublicIPv6 and AnnotationIPv6ID record the allocated IPv6.
+	AnnotationPublicIPv6 = "fly-tunnel-operator.dev/public-ipv6"
+	AnnotationIPv6ID     = "fly-tunnel-operator.dev/ipv6-id"
+)
+
+// wantsIPv6 reports whether svc asks for a dual-stack tunnel.
+func wantsIPv6(svc *corev1.Service) bool {
+	return svc.Annotations[AnnotationIPv6] == "true"
+}
+
+// validateIPv6 returns an error if AnnotationIPv6 is not "true" or "false".
+func validateIPv6(svc *corev1.Service) error {
+	switch value, ok := svc.Annotations[AnnotationIPv6]; {
+	case !ok, value == "true", value == "false":
+		return nil
+	default:
+		return fmt.Errorf("invalid %s %q: must be \"true\" or \"false\"", AnnotationIPv6, value)
+	}
+}
+
+// PublicIPs returns the public addresses recorded for svc, IPv4 first.
+func PublicIPs(svc *corev1.Service) []string {
+	var ips []string
+	for _, key := range []string{AnnotationPublicIP, AnnotationPublicIPv6} {
+		if ip := svc.Annotations[key]; ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// MissingIPv6 reports whether svc asks for an IPv6 that has not been
+// allocated yet, so its reconcile should be retried.
+func MissingIPv6(svc *corev1.Service) bool {
+	return wantsIPv6(svc) && svc.Annotations[AnnotationPublicIP] != "" && svc.Annotations[AnnotationPublicIPv6] == ""
+}
+
+// allocateIPv6 allocates the IPv6 of a dual-stack tunnel. A failure is
+// reported as an IPAllocationPartial event rather than returned; it returns
+// nil then.
+func (m *Manager) allocateIPv6(ctx context.Context, svc *corev1.Service, flyAppName, publicIP string) *flyio.IPAddress {
+	logger := log.FromContext(ctx)
+	logger.Info("Allocating dedicated IPv6", "app", flyAppName)
+	ip, err := m.flyClient.AllocateIPv6(ctx, flyAppName)
+	if err != nil {
+		m.ipv6Failed(ctx, svc, flyAppName, publicIP, err)
+		return nil
+	}
+	logger.Info("IPv6 allocated", "address", ip.Address, "id", ip.ID)
+	return ip
+}
+
+// allocateDualStack allocates the IPv4 and IPv6 of a new dual-stack tunnel
+// in a single request. Only the IPv4 is required: its failure is returned,
+// releasing the IPv6 if that was allocated. An IPv6 failure is reported as
+// by allocateIPv6 and leaves ipv6 nil.
+func (m *Manager) allocateDualStack(ctx context.Context, svc *corev1.Service, flyAppName string) (ipv4, ipv6 *flyio.IPAddress, err error) {
+	logger := log.FromContext(ctx)
+	logger.Info("Allocating dedicated IPv4 and IPv6", "app", flyAppName)
+	results, err := m.flyClient.AllocateIPs(ctx, flyAppName, []string{"v4", "v6"})
+	if err != nil {
+		return nil, nil, err
+	}
+	v4, v6 := results[0], results[1]
+	if v4.Err != nil {
+		if v6.IP != nil {
+			_ = m.flyClient.ReleaseIPAddress(ctx, flyAppName, v6.IP.ID)
+		}
+		return nil, nil, v4.Err
+	}
+	if v6.Err != nil {
+		m.ipv6Failed(ctx, svc, flyAppName, v4.IP.Address, v6.Err)
+		return v4.IP, nil, nil
+	}
+	logger.Info("IPv6 allocated", "address", v6.IP.Address, "id", v6.IP.ID)
+	return v4.IP, v6.IP, nil
+}
+
+// ipv6Failed reports that allocating the IPv6 of svc failed, so publicIP is
+// published alone until a later reconcile allocates it.
+func (m *Manager) ipv6Failed(ctx context.Context, svc *corev1.Service, flyAppName, publicIP string, err error) {
+	log.FromContext(ctx).Error(err, "Failed to allocate IPv6; publishing IPv4 only", "app", flyAppName)
+	m.event(svc, corev1.EventTypeWarning, "IPAllocationPartial",
+		"Published IPv4 %s only; allocating IPv6 failed and will be retried: %v", publicIP, err)
+}
+
+// reconcileIPv6 allocates the missing IPv6 of a dual-stack tunnel, or
+// releases the IPv6 of a tunnel no longer dual-stack, and records the
+// outcome on svc.
+func (m *Manager) reconcileIPv6(ctx context.Context, svc *corev1.Service, flyAppName, publicIP string) error {
+	switch {
+	case MissingIPv6(svc):
+		ip := m.allocateIPv6(ctx, svc, flyAppName, publicIP)
+		if ip == nil {
+			return nil
+		}
+		if err := m.recordIPv6(ctx, svc, ip); err != nil {
+			// Unrecorded, the IPv6 would leak; the next Update tries again.
+			_ = m.flyClient.ReleaseIPAddress(ctx, flyAppName, ip.ID)
+			return err
+		}
+		m.event(svc, corev1.EventTypeNormal, "IPv6Allocated", "Allocated IPv6 %s", ip.Address)
+	case !wantsIPv6(svc) && svc.Annotations[AnnotationIPv6ID] != "":
+		log.FromContext(ctx).Info("Releasing dedicated IPv6", "id", svc.Annotations[AnnotationIPv6ID])
+		if err := m.flyClient.ReleaseIPAddress(ctx, flyAppName, svc.Annotations[AnnotationIPv6ID]); err != nil {
+			return fmt.Errorf("releasing IPv6: %w", err)
+		}
+		if err := m.recordIPv6(ctx, svc, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordIPv6 records ip as the IPv6 of svc, nil removing it.
+func (m *Manager) recordIPv6(ctx context.Context, svc *corev1.Service, ip *flyio.IPAddress) error {
+	patch := client.MergeFrom(svc.DeepCopy())
+	if ip != nil {
+		svc.Annotations[AnnotationIPv6ID] = ip.ID
+		svc.Annotations[AnnotationPublicIPv6] = ip.Address
+	} else {
+		delete(svc.Annotations, AnnotationIPv6ID)
+		delete(svc.Annotations, AnnotationPublicIPv6)
+	}
+	if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("recording IPv6: %w", err)
+	}
+	return nil
+}
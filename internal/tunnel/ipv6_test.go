@@ -0,0 +1,110 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestProvision_DualStack(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	svc.Annotations[tunnel.AnnotationIPv6] = "true"
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), svc).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if result.PublicIPv6 == "" || result.IPv6ID == "" || server.IPCount() != 2 {
+		t.Fatalf("expected an IPv4 and an IPv6, got %+v and %d IPs", result, server.IPCount())
+	}
+	annotateTunnelState(svc, result)
+	if got := tunnel.PublicIPs(svc); !slices.Equal(got, []string{result.PublicIP, result.PublicIPv6}) {
+		t.Errorf("expected the IPv4 then the IPv6, got %v", got)
+	}
+
+	// Dropping dual-stack releases the IPv6 only.
+	delete(svc.Annotations, tunnel.AnnotationIPv6)
+	if err := kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), svc); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	if server.IPCount() != 1 {
+		t.Errorf("expected the IPv6 to be released, got %d IPs", server.IPCount())
+	}
+	if got := tunnel.PublicIPs(svc); !slices.Equal(got, []string{result.PublicIP}) {
+		t.Errorf("expected the IPv4 only, got %v", got)
+	}
+}
+
+func TestProvision_DualStackPartialFailure(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	svc.Annotations[tunnel.AnnotationIPv6] = "true"
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), svc).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	// The IPv6 is optional: the IPv4 is published alone.
+	server.OnAllocateIPv6 = func(string) error { return errors.New("no IPv6 capacity") }
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if result.PublicIP == "" || result.PublicIPv6 != "" || server.IPCount() != 1 {
+		t.Errorf("expected the IPv4 only, got %+v and %d IPs", result, server.IPCount())
+	}
+	annotateTunnelState(svc, result)
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if server.IPCount() != 0 {
+		t.Fatalf("expected Teardown to release the IPv4, got %d IPs", server.IPCount())
+	}
+
+	// The IPv4 is required: its failure fails Provision without leaking the
+	// IPv6 allocated alongside it.
+	server.OnAllocateIPv6 = nil
+	server.OnAllocateIP = func(string) error { return errors.New("no IPv4 capacity") }
+	if _, err := mgr.Provision(context.Background(), svc); err == nil {
+		t.Fatal("expected Provision to fail without an IPv4")
+	}
+	if server.IPCount() != 0 {
+		t.Errorf("expected no IPs left, got %d", server.IPCount())
+	}
+}
+
+func TestProvision_InvalidIPv6(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	svc.Annotations[tunnel.AnnotationIPv6] = "yes"
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), svc).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	if _, err := mgr.Provision(context.Background(), svc); !errors.Is(err, tunnel.ErrPermanent) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected nothing provisioned, got %d apps", server.AppCount())
+	}
+}
@@ -0,0 +1,201 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// AnnotationExpiresAt records, as an RFC 3339 time, when an auxiliary
+	// object the operator created may be deleted by CollectExpired if
+	// nothing uses it by then.
+	AnnotationExpiresAt = "fly-tunnel-operator.dev/expires-at"
+
+	// annotationArtifact names the artifact type of an object carrying
+	// AnnotationExpiresAt: artifactCanary or artifactIdentity.
+	annotationArtifact = "fly-tunnel-operator.dev/artifact"
+
+	artifactCanary   = "canary"
+	artifactIdentity = "identity"
+)
+
+// ArtifactTTLs are how long the auxiliary objects the operator creates
+// outlive their last use before CollectExpired deletes them. Zero keeps an
+// artifact type forever.
+type ArtifactTTLs struct {
+	// Canary applies to canary frpc Deployments and their config, counted
+	// from the last time the canary was deployed. A canary the Service
+	// still runs is never deleted.
+	Canary time.Duration
+	// Identity applies to the records of stable identities no Service
+	// holds, counted from the teardown that retained them. An expired
+	// identity's Fly App, and with it its IP, is deleted too.
+	Identity time.Duration
+}
+
+// expiry returns the annotations marking an artifact of type artifact as
+// expiring ttl from now, or nil if ttl is zero.
+func expiry(artifact string, ttl time.Duration) map[string]string {
+	if ttl <= 0 {
+		return nil
+	}
+	return map[string]string{
+		annotationArtifact:  artifact,
+		AnnotationExpiresAt: time.Now().Add(ttl).UTC().Format(time.RFC3339),
+	}
+}
+
+// expired reports whether the object with annotations has an
+// AnnotationExpiresAt in the past. Unparsable times never expire.
+func expired(annotations map[string]string, now time.Time) bool {
+	at, err := time.Parse(time.RFC3339, annotations[AnnotationExpiresAt])
+	return err == nil && now.After(at)
+}
+
+// stampCanary marks the canary frpc Deployment canaryName of svc as expiring
+// after the canary TTL.
+func (m *Manager) stampCanary(ctx context.Context, svc *corev1.Service, namespace, canaryName string) error {
+	annotations := expiry(artifactCanary, m.config.ArtifactTTLs.Canary)
+	if annotations == nil {
+		return nil
+	}
+	annotations[annotationOwner] = svc.Namespace + "/" + svc.Name
+	var deploy appsv1.Deployment
+	if err := m.kubeClient.Get(ctx, types.NamespacedName{Name: canaryName, Namespace: namespace}, &deploy); err != nil {
+		return fmt.Errorf("getting frpc canary deployment: %w", err)
+	}
+	patch := client.MergeFrom(deploy.DeepCopy())
+	if deploy.Annotations == nil {
+		deploy.Annotations = make(map[string]string)
+	}
+	for k, v := range annotations {
+		deploy.Annotations[k] = v
+	}
+	if err := m.kubeClient.Patch(ctx, &deploy, patch); err != nil {
+		return fmt.Errorf("recording frpc canary expiry: %w", err)
+	}
+	return nil
+}
+
+// CollectExpired deletes the auxiliary objects whose AnnotationExpiresAt
+// has passed and that are no longer in use: canaries of Services that left
+// canary mode or are gone, and stable identities no Service holds. It
+// returns the number of artifacts deleted.
+func (m *Manager) CollectExpired(ctx context.Context) (int, error) {
+	now := time.Now()
+	canaries, err := m.collectExpiredCanaries(ctx, now)
+	if err != nil {
+		return canaries, err
+	}
+	identities, err := m.collectExpiredIdentities(ctx, now)
+	return canaries + identities, err
+}
+
+func (m *Manager) collectExpiredCanaries(ctx context.Context, now time.Time) (int, error) {
+	var deployments appsv1.DeploymentList
+	if err := m.kubeClient.List(ctx, &deployments,
+		client.MatchingLabels{"app.kubernetes.io/managed-by": "fly-tunnel-operator"},
+	); err != nil {
+		return 0, fmt.Errorf("listing frpc deployments: %w", err)
+	}
+
+	collected := 0
+	for i := range deployments.Items {
+		deploy := &deployments.Items[i]
+		if deploy.Annotations[annotationArtifact] != artifactCanary || !expired(deploy.Annotations, now) {
+			continue
+		}
+		inUse, err := m.canaryInUse(ctx, deploy.Annotations[annotationOwner])
+		if err != nil {
+			return collected, err
+		}
+		if inUse {
+			continue
+		}
+		log.FromContext(ctx).Info("Deleting expired frpc canary", "name", deploy.Name, "namespace", deploy.Namespace)
+		if err := m.deleteFrpcResources(ctx, deploy.Namespace, deploy.Name); err != nil {
+			return collected, fmt.Errorf("deleting expired frpc canary %s: %w", deploy.Name, err)
+		}
+		collected++
+	}
+	return collected, nil
+}
+
+// canaryInUse reports whether the Service owner, as namespace/name, still
+// runs a canary.
+func (m *Manager) canaryInUse(ctx context.Context, owner string) (bool, error) {
+	namespace, name, ok := strings.Cut(owner, "/")
+	if !ok {
+		return false, nil
+	}
+	var svc corev1.Service
+	if err := m.kubeClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &svc); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("getting service %s: %w", owner, err)
+	}
+	return canaryMode(&svc) && svc.Annotations[AnnotationFrpcCanaryConfigHash] != "", nil
+}
+
+func (m *Manager) collectExpiredIdentities(ctx context.Context, now time.Time) (int, error) {
+	var records corev1.ConfigMapList
+	if err := m.kubeClient.List(ctx, &records,
+		client.InNamespace(m.config.OperatorNamespace),
+		client.MatchingLabels{"app.kubernetes.io/managed-by": "fly-tunnel-operator"},
+	); err != nil {
+		return 0, fmt.Errorf("listing identity records: %w", err)
+	}
+
+	collected := 0
+	for i := range records.Items {
+		record := &records.Items[i]
+		if record.Annotations[annotationArtifact] != artifactIdentity || !expired(record.Annotations, now) {
+			continue
+		}
+		inUse, err := m.identityInUse(ctx, record.Data[identityKeyNamespace], record.Data[identityKeyIdentity])
+		if err != nil {
+			return collected, err
+		}
+		if inUse {
+			continue
+		}
+		flyApp := record.Data[identityKeyFlyApp]
+		log.FromContext(ctx).Info("Deleting expired stable identity", "identity", record.Data[identityKeyIdentity],
+			"namespace", record.Data[identityKeyNamespace], "app", flyApp)
+		if flyApp != "" {
+			if err := ignoreFlyNotFound(m.flyClient.DeleteApp(ctx, flyApp)); err != nil {
+				return collected, fmt.Errorf("deleting fly app of expired identity record %s: %w", record.Name, err)
+			}
+		}
+		if err := m.kubeClient.Delete(ctx, record); err != nil && !apierrors.IsNotFound(err) {
+			return collected, fmt.Errorf("deleting expired identity record %s: %w", record.Name, err)
+		}
+		collected++
+	}
+	return collected, nil
+}
+
+// identityInUse reports whether a Service in namespace holds the stable
+// identity.
+func (m *Manager) identityInUse(ctx context.Context, namespace, identity string) (bool, error) {
+	var services corev1.ServiceList
+	if err := m.kubeClient.List(ctx, &services, client.InNamespace(namespace)); err != nil {
+		return false, fmt.Errorf("listing services in %s: %w", namespace, err)
+	}
+	for i := range services.Items {
+		if stableIdentity(&services.Items[i]) == identity {
+			return true, nil
+		}
+	}
+	return false, nil
+}
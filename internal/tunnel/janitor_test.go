@@ -0,0 +1,173 @@
+package tunnel_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// expire moves the expiry of obj into the past, as if its TTL had elapsed.
+func expire(t *testing.T, kubeClient client.Client, obj client.Object) {
+	t.Helper()
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(obj), obj); err != nil {
+		t.Fatalf("getting %s: %v", obj.GetName(), err)
+	}
+	annotations := obj.GetAnnotations()
+	if annotations[tunnel.AnnotationExpiresAt] == "" {
+		t.Fatalf("expected %s to carry an expiry", obj.GetName())
+	}
+	annotations[tunnel.AnnotationExpiresAt] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	obj.SetAnnotations(annotations)
+	if err := kubeClient.Update(context.Background(), obj); err != nil {
+		t.Fatalf("updating %s: %v", obj.GetName(), err)
+	}
+}
+
+func TestCollectExpired_Canary(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	svc.Annotations[tunnel.AnnotationFrpcCanary] = "true"
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), svc).Build()
+	config := newTestConfig()
+	config.ArtifactTTLs.Canary = time.Hour
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), svc); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	svc.Annotations[frp.AnnotationPoolCount] = "3"
+	if err := kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	canary := &appsv1.Deployment{}
+	canary.Name, canary.Namespace = result.FrpcDeployment+"-canary", testNamespace
+	canaryExists := func() bool {
+		t.Helper()
+		err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(canary), &appsv1.Deployment{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			t.Fatalf("getting canary: %v", err)
+		}
+		return err == nil
+	}
+	if !canaryExists() {
+		t.Fatal("expected a canary for the config change")
+	}
+
+	// An unexpired canary is left alone.
+	if n, err := mgr.CollectExpired(context.Background()); err != nil || n != 0 {
+		t.Fatalf("expected nothing to collect before the TTL, got %d, %v", n, err)
+	}
+
+	// An expired canary the Service still runs is left alone.
+	expire(t, kubeClient, canary)
+	if n, err := mgr.CollectExpired(context.Background()); err != nil || n != 0 {
+		t.Fatalf("expected a canary in use to survive, got %d, %v", n, err)
+	}
+	if !canaryExists() {
+		t.Fatal("expected the canary in use to survive")
+	}
+
+	// The Service leaves canary mode without the operator noticing.
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), svc); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	delete(svc.Annotations, tunnel.AnnotationFrpcCanary)
+	if err := kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("updating service: %v", err)
+	}
+	if n, err := mgr.CollectExpired(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected the abandoned canary to be collected, got %d, %v", n, err)
+	}
+	if canaryExists() {
+		t.Error("expected the abandoned canary to be deleted")
+	}
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: canary.Name + "-config", Namespace: testNamespace}
+	if err := kubeClient.Get(context.Background(), key, &secret); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the canary config Secret to be deleted, got %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment, Namespace: testNamespace}, &appsv1.Deployment{}); err != nil {
+		t.Errorf("expected the primary frpc to survive, got %v", err)
+	}
+}
+
+func TestCollectExpired_Identity(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	config := newTestConfig()
+	config.ArtifactTTLs.Identity = time.Hour
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	svc := testService("envoy-gw-abc123", "envoy-gateway-system",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[tunnel.AnnotationStableIdentity] = "public-gateway"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	record := &corev1.ConfigMap{}
+	record.Name, record.Namespace = "fly-tunnel-identity-envoy-gateway-system-public-gateway", testNamespace
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(record), record); err != nil {
+		t.Fatalf("getting identity record: %v", err)
+	}
+	if _, ok := record.Annotations[tunnel.AnnotationExpiresAt]; ok {
+		t.Error("expected the record of a live identity not to expire")
+	}
+
+	annotateTunnelState(svc, result)
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if n, err := mgr.CollectExpired(context.Background()); err != nil || n != 0 {
+		t.Fatalf("expected nothing to collect before the TTL, got %d, %v", n, err)
+	}
+
+	// A Service holding the identity keeps it, even past its TTL.
+	expire(t, kubeClient, record)
+	holder := testService("envoy-gw-def456", "envoy-gateway-system")
+	holder.Annotations[tunnel.AnnotationStableIdentity] = "public-gateway"
+	if err := kubeClient.Create(context.Background(), holder); err != nil {
+		t.Fatalf("creating service: %v", err)
+	}
+	if n, err := mgr.CollectExpired(context.Background()); err != nil || n != 0 {
+		t.Fatalf("expected a held identity to survive, got %d, %v", n, err)
+	}
+
+	if err := kubeClient.Delete(context.Background(), holder); err != nil {
+		t.Fatalf("deleting service: %v", err)
+	}
+	if n, err := mgr.CollectExpired(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected the expired identity to be collected, got %d, %v", n, err)
+	}
+	if server.HasApp(result.FlyApp) || server.IPCount() != 0 {
+		t.Errorf("expected the retained app and IP to be deleted, got app %v and %d IPs", server.HasApp(result.FlyApp), server.IPCount())
+	}
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(record), record); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the identity record to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+const (
+	// AnnotationLocalTarget selects what frpc dials: "service" (the
+	// default) dials the Service's cluster IP on the Service port, going
+	// through kube-proxy; "endpoints" dials the ready pods directly on their
+	// target port, through a headless Service the operator keeps next to
+	// the Service.
+	AnnotationLocalTarget = "fly-tunnel-operator.dev/local-target"
+
+	localTargetService   = "service"
+	localTargetEndpoints = "endpoints"
+)
+
+// localTargets are the accepted AnnotationLocalTarget values.
+var localTargets = []string{localTargetService, localTargetEndpoints}
+
+// validateLocalTarget returns an error if AnnotationLocalTarget is not a
+// supported value.
+func validateLocalTarget(svc *corev1.Service) error {
+	if value, ok := svc.Annotations[AnnotationLocalTarget]; ok && !slices.Contains(localTargets, value) {
+		return fmt.Errorf("invalid %s %q: must be %q or %q", AnnotationLocalTarget, value, localTargetService, localTargetEndpoints)
+	}
+	return nil
+}
+
+// endpointsServiceName returns the name of the headless Service frpc
+// dials the pods of svc through in endpoints mode.
+func endpointsServiceName(svc *corev1.Service) string {
+	return sanitizeName(svc.Name + "-frpc-endpoints")
+}
+
+// endpointsTarget returns the local port of each proxy of svc, keyed by
+// proxy name, when frpc dials its pods directly. It returns why not
+// instead if svc does not ask for endpoints mode or cannot use it, in
+// which case frpc dials the Service's cluster IP.
+func endpointsTarget(svc *corev1.Service) (map[string]int, string) {
+	if svc.Annotations[AnnotationLocalTarget] != localTargetEndpoints {
+		return nil, "not requested"
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return nil, "the Service has no selector, so its pods are not known"
+	}
+	ports := make(map[string]int)
+	for _, proxy := range frp.ProxyPorts(svc) {
+		target := proxy.Port.TargetPort
+		switch {
+		case target.Type == intstr.String:
+			// A named port may have a different number on every pod.
+			return nil, fmt.Sprintf("port %d has the named targetPort %q", proxy.Port.Port, target.StrVal)
+		case target.IntVal == 0:
+			ports[proxy.Name] = int(proxy.Port.Port)
+		default:
+			ports[proxy.Name] = int(target.IntVal)
+		}
+	}
+	return ports, ""
+}
+
+// endpointsService returns the headless Service frpc dials the pods of svc
+// through, selecting the same pods on their target ports.
+func endpointsService(svc *corev1.Service, localPorts map[string]int) *corev1.Service {
+	var ports []corev1.ServicePort
+	seen := make(map[string]bool)
+	for _, proxy := range frp.ProxyPorts(svc) {
+		port := int32(localPorts[proxy.Name])
+		key := fmt.Sprintf("%d/%s", port, proxy.Protocol)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		ports = append(ports, corev1.ServicePort{
+			Name:       fmt.Sprintf("%s-%d", proxy.Protocol, port),
+			Protocol:   proxy.Port.Protocol,
+			Port:       port,
+			TargetPort: intstr.FromInt32(port),
+		})
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      endpointsServiceName(svc),
+			Namespace: svc.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "fly-tunnel-operator",
+				labelService:                   serviceLabelValue(svc),
+			},
+			// Garbage collected with the Service should teardown miss it.
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Service",
+				Name:       svc.Name,
+				UID:        svc.UID,
+			}},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:      corev1.ServiceTypeClusterIP,
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  svc.Spec.Selector,
+			Ports:     ports,
+		},
+	}
+}
+
+// reconcileEndpointsService creates or updates the headless Service of svc
+// in endpoints mode, and deletes it otherwise. A Service asking for
+// endpoints mode that cannot use it gets a LocalTargetFallback event.
+func (m *Manager) reconcileEndpointsService(ctx context.Context, svc *corev1.Service) error {
+	localPorts, reason := endpointsTarget(svc)
+	if localPorts == nil {
+		if svc.Annotations[AnnotationLocalTarget] == localTargetEndpoints {
+			m.event(svc, corev1.EventTypeWarning, "LocalTargetFallback",
+				"frpc dials the Service's cluster IP instead of its endpoints: %s", reason)
+		}
+		return m.deleteEndpointsService(ctx, svc)
+	}
+
+	desired := endpointsService(svc, localPorts)
+	if svc.UID == "" {
+		desired.OwnerReferences = nil
+	}
+	if err := m.kubeClient.Create(ctx, desired); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("creating endpoints service: %w", err)
+		}
+		var existing corev1.Service
+		if err := m.kubeClient.Get(ctx, client.ObjectKeyFromObject(desired), &existing); err != nil {
+			return fmt.Errorf("getting endpoints service: %w", err)
+		}
+		if existing.Labels[labelService] != serviceLabelValue(svc) {
+			return permanent(fmt.Errorf("service %s/%s already exists and is not managed by the operator", existing.Namespace, existing.Name))
+		}
+		existing.Spec.Selector = desired.Spec.Selector
+		existing.Spec.Ports = desired.Spec.Ports
+		if err := m.kubeClient.Update(ctx, &existing); err != nil {
+			return fmt.Errorf("updating endpoints service: %w", err)
+		}
+	}
+	return nil
+}
+
+// deleteEndpointsService deletes the headless Service of svc, if any.
+func (m *Manager) deleteEndpointsService(ctx context.Context, svc *corev1.Service) error {
+	var existing corev1.Service
+	err := m.kubeClient.Get(ctx, types.NamespacedName{Namespace: svc.Namespace, Name: endpointsServiceName(svc)}, &existing)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting endpoints service: %w", err)
+	}
+	if existing.Labels[labelService] != serviceLabelValue(svc) {
+		// Not ours.
+		return nil
+	}
+	if err := m.kubeClient.Delete(ctx, &existing); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("deleting endpoints service: %w", err)
+	}
+	return nil
+}
+
+// endpointsClientOptions points opts at the pods of svc when it uses
+// endpoints mode.
+func (m *Manager) endpointsClientOptions(svc *corev1.Service, opts *frp.ClientOptions) {
+	localPorts, _ := endpointsTarget(svc)
+	if localPorts == nil {
+		return
+	}
+	target := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: endpointsServiceName(svc), Namespace: svc.Namespace}}
+	opts.LocalIPOverride = frp.LocalAddress(target, m.config.ClusterDomain)
+	opts.LocalPortOverrides = localPorts
+}
@@ -0,0 +1,147 @@
+package tunnel_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestLocalTargetEndpoints(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080), Protocol: corev1.ProtocolTCP})
+	svc.UID = "web-uid"
+	svc.Spec.Selector = map[string]string{"app": "web"}
+	svc.Annotations[tunnel.AnnotationLocalTarget] = "endpoints"
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), svc).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+
+	endpointsKey := types.NamespacedName{Namespace: "default", Name: "web-frpc-endpoints"}
+	localTarget := func() (string, int) {
+		t.Helper()
+		c, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+		if err != nil {
+			t.Fatalf("parsing frpc config: %v", err)
+		}
+		return c.Proxies[0].LocalIP, c.Proxies[0].LocalPort
+	}
+	update := func() {
+		t.Helper()
+		// The API server bumps the generation on spec changes.
+		svc.Generation++
+		if err := kubeClient.Update(context.Background(), svc); err != nil {
+			t.Fatalf("updating service: %v", err)
+		}
+		if _, err := mgr.Update(context.Background(), svc); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), svc); err != nil {
+			t.Fatalf("getting service: %v", err)
+		}
+	}
+
+	// frpc dials the pods on the target port through a headless Service.
+	var headless corev1.Service
+	if err := kubeClient.Get(context.Background(), endpointsKey, &headless); err != nil {
+		t.Fatalf("expected an endpoints Service: %v", err)
+	}
+	if headless.Spec.ClusterIP != corev1.ClusterIPNone || headless.Spec.Selector["app"] != "web" ||
+		len(headless.Spec.Ports) != 1 || headless.Spec.Ports[0].Port != 8080 {
+		t.Errorf("unexpected endpoints Service spec: %+v", headless.Spec)
+	}
+	if len(headless.OwnerReferences) != 1 || headless.OwnerReferences[0].UID != svc.UID {
+		t.Errorf("expected the endpoints Service to be owned by the Service, got %+v", headless.OwnerReferences)
+	}
+	if ip, port := localTarget(); ip != "web-frpc-endpoints.default.svc.cluster.local" || port != 8080 {
+		t.Errorf("expected frpc to dial the endpoints on 8080, got %s:%d", ip, port)
+	}
+
+	// A new targetPort re-renders the config.
+	svc.Spec.Ports[0].TargetPort = intstr.FromInt32(9090)
+	update()
+	if _, port := localTarget(); port != 9090 {
+		t.Errorf("expected frpc to follow the targetPort to 9090, got %d", port)
+	}
+	if err := kubeClient.Get(context.Background(), endpointsKey, &headless); err != nil || headless.Spec.Ports[0].Port != 9090 {
+		t.Errorf("expected the endpoints Service to follow the targetPort, got %+v (%v)", headless.Spec.Ports, err)
+	}
+
+	// Back to the cluster IP: the endpoints Service goes.
+	delete(svc.Annotations, tunnel.AnnotationLocalTarget)
+	update()
+	if ip, port := localTarget(); ip != "web.default.svc.cluster.local" || port != 80 {
+		t.Errorf("expected frpc to dial the cluster IP, got %s:%d", ip, port)
+	}
+	if err := kubeClient.Get(context.Background(), endpointsKey, &headless); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the endpoints Service to be deleted, got %v", err)
+	}
+
+	// Teardown removes it too.
+	svc.Annotations[tunnel.AnnotationLocalTarget] = "endpoints"
+	update()
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), endpointsKey, &headless); !apierrors.IsNotFound(err) {
+		t.Errorf("expected teardown to delete the endpoints Service, got %v", err)
+	}
+}
+
+func TestLocalTargetEndpoints_NamedTargetPortFallsBack(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	recorder := record.NewFakeRecorder(10)
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig()).WithEventRecorder(recorder)
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromString("http"), Protocol: corev1.ProtocolTCP})
+	svc.Spec.Selector = map[string]string{"app": "web"}
+	svc.Annotations[tunnel.AnnotationLocalTarget] = "endpoints"
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	c, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+	if err != nil {
+		t.Fatalf("parsing frpc config: %v", err)
+	}
+	if got := c.Proxies[0]; got.LocalIP != "web.default.svc.cluster.local" || got.LocalPort != 80 {
+		t.Errorf("expected frpc to dial the cluster IP, got %s:%d", got.LocalIP, got.LocalPort)
+	}
+	var headless corev1.Service
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "web-frpc-endpoints"}, &headless); !apierrors.IsNotFound(err) {
+		t.Errorf("expected no endpoints Service, got %v", err)
+	}
+
+	var fellBack bool
+	for len(recorder.Events) > 0 {
+		if e := <-recorder.Events; strings.Contains(e, "LocalTargetFallback") && strings.Contains(e, `named targetPort "http"`) {
+			fellBack = true
+		}
+	}
+	if !fellBack {
+		t.Error("expected a LocalTargetFallback event naming the targetPort")
+	}
+}
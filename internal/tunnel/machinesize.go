@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+// DefaultMachineSize is the Machine size of a tunnel unless the operator or
+// the Service picks another.
+const DefaultMachineSize = "shared-cpu-1x"
+
+// machinePreset is a Fly.io Machine size preset.
+type machinePreset struct {
+	cpuKind string
+	cpus    int
+	// memoryMB is the preset's memory, and memory a multiple of 256 MB
+	// from minMemoryMB to maxMemoryMB can replace it.
+	memoryMB, minMemoryMB, maxMemoryMB int
+}
+
+// machinePresets are the CPU presets Fly.io offers, keyed by name. Shared
+// CPUs take 256 MB to 2 GB of memory each, performance CPUs 2 GB to 8 GB.
+var machinePresets = map[string]machinePreset{
+	"shared-cpu-1x":   {cpuKind: "shared", cpus: 1, memoryMB: 256, minMemoryMB: 256, maxMemoryMB: 2048},
+	"shared-cpu-2x":   {cpuKind: "shared", cpus: 2, memoryMB: 512, minMemoryMB: 512, maxMemoryMB: 4096},
+	"shared-cpu-4x":   {cpuKind: "shared", cpus: 4, memoryMB: 1024, minMemoryMB: 1024, maxMemoryMB: 8192},
+	"shared-cpu-8x":   {cpuKind: "shared", cpus: 8, memoryMB: 2048, minMemoryMB: 2048, maxMemoryMB: 16384},
+	"performance-1x":  {cpuKind: "performance", cpus: 1, memoryMB: 2048, minMemoryMB: 2048, maxMemoryMB: 8192},
+	"performance-2x":  {cpuKind: "performance", cpus: 2, memoryMB: 4096, minMemoryMB: 4096, maxMemoryMB: 16384},
+	"performance-4x":  {cpuKind: "performance", cpus: 4, memoryMB: 8192, minMemoryMB: 8192, maxMemoryMB: 32768},
+	"performance-8x":  {cpuKind: "performance", cpus: 8, memoryMB: 16384, minMemoryMB: 16384, maxMemoryMB: 65536},
+	"performance-16x": {cpuKind: "performance", cpus: 16, memoryMB: 32768, minMemoryMB: 32768, maxMemoryMB: 131072},
+}
+
+// ParseMachineSize returns the guest of a Machine size: a preset such as
+// "performance-2x", optionally followed by a memory size in MB replacing
+// the preset's, as in "shared-cpu-2x:1024".
+func ParseMachineSize(size string) (*flyio.GuestConfig, error) {
+	name, memory, hasMemory := strings.Cut(size, ":")
+	preset, ok := machinePresets[name]
+	if !ok {
+		names := make([]string, 0, len(machinePresets))
+		for name := range machinePresets {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return nil, fmt.Errorf("unknown Machine size %q: must be one of %s, optionally followed by \":<memoryMB>\"", name, strings.Join(names, ", "))
+	}
+	guest := &flyio.GuestConfig{CPUKind: preset.cpuKind, CPUs: preset.cpus, MemoryMB: preset.memoryMB}
+	if hasMemory {
+		mb, err := strconv.Atoi(memory)
+		if err != nil || mb%256 != 0 || mb < preset.minMemoryMB || mb > preset.maxMemoryMB {
+			return nil, fmt.Errorf("invalid memory %q for Machine size %s: must be a multiple of 256 MB from %d to %d", memory, name, preset.minMemoryMB, preset.maxMemoryMB)
+		}
+		guest.MemoryMB = mb
+	}
+	return guest, nil
+}
+
+// validateMachineSize returns an error if AnnotationFlyMachineSize is not a
+// valid Machine size.
+func validateMachineSize(svc *corev1.Service) error {
+	if size := svc.Annotations[AnnotationFlyMachineSize]; size != "" {
+		if _, err := ParseMachineSize(size); err != nil {
+			return fmt.Errorf("invalid %s: %w", AnnotationFlyMachineSize, err)
+		}
+	}
+	return nil
+}
+
+// guest returns the guest of the Machine of svc. An invalid annotation is
+// rejected by validateAnnotations, and an invalid Config.FlyMachineSize or
+// class default at startup, before any Machine is touched, so all fall back
+// here.
+func (m *Manager) guest(svc *corev1.Service) *flyio.GuestConfig {
+	if svc != nil {
+		if guest, err := ParseMachineSize(svc.Annotations[AnnotationFlyMachineSize]); err == nil {
+			return guest
+		}
+	}
+	if guest, err := ParseMachineSize(m.defaultMachineSize(svc)); err == nil {
+		return guest
+	}
+	guest, _ := ParseMachineSize(DefaultMachineSize)
+	return guest
+}
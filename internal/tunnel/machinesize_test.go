@@ -0,0 +1,108 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestParseMachineSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    *flyio.GuestConfig
+		wantErr string
+	}{
+		{size: "shared-cpu-1x", want: &flyio.GuestConfig{CPUKind: "shared", CPUs: 1, MemoryMB: 256}},
+		{size: "shared-cpu-2x", want: &flyio.GuestConfig{CPUKind: "shared", CPUs: 2, MemoryMB: 512}},
+		{size: "shared-cpu-4x", want: &flyio.GuestConfig{CPUKind: "shared", CPUs: 4, MemoryMB: 1024}},
+		{size: "shared-cpu-8x", want: &flyio.GuestConfig{CPUKind: "shared", CPUs: 8, MemoryMB: 2048}},
+		{size: "performance-1x", want: &flyio.GuestConfig{CPUKind: "performance", CPUs: 1, MemoryMB: 2048}},
+		{size: "performance-2x", want: &flyio.GuestConfig{CPUKind: "performance", CPUs: 2, MemoryMB: 4096}},
+		{size: "performance-4x", want: &flyio.GuestConfig{CPUKind: "performance", CPUs: 4, MemoryMB: 8192}},
+		{size: "performance-8x", want: &flyio.GuestConfig{CPUKind: "performance", CPUs: 8, MemoryMB: 16384}},
+		{size: "performance-16x", want: &flyio.GuestConfig{CPUKind: "performance", CPUs: 16, MemoryMB: 32768}},
+		{size: "shared-cpu-2x:1024", want: &flyio.GuestConfig{CPUKind: "shared", CPUs: 2, MemoryMB: 1024}},
+		{size: "performance-1x:8192", want: &flyio.GuestConfig{CPUKind: "performance", CPUs: 1, MemoryMB: 8192}},
+		{size: "", wantErr: `unknown Machine size ""`},
+		{size: "performance-3x", wantErr: `unknown Machine size "performance-3x"`},
+		{size: "huge:1024", wantErr: `unknown Machine size "huge"`},
+		{size: "shared-cpu-1x:1000", wantErr: "multiple of 256 MB"},
+		{size: "shared-cpu-1x:4096", wantErr: "from 256 to 2048"},
+		{size: "performance-1x:1024", wantErr: "from 2048 to 8192"},
+		{size: "shared-cpu-1x:", wantErr: `invalid memory ""`},
+		{size: "shared-cpu-1x:1GB", wantErr: `invalid memory "1GB"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			got, err := tunnel.ParseMachineSize(tt.size)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error mentioning %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProvision_MachineSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    string
+		want    *flyio.GuestConfig
+		wantErr bool
+	}{
+		{name: "preset", size: "performance-4x", want: &flyio.GuestConfig{CPUKind: "performance", CPUs: 4, MemoryMB: 8192}},
+		{name: "custom memory", size: "shared-cpu-2x:2048", want: &flyio.GuestConfig{CPUKind: "shared", CPUs: 2, MemoryMB: 2048}},
+		{name: "unknown preset", size: "performance-4", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			var guest *flyio.GuestConfig
+			server.OnCreateMachine = func(appName string, input flyio.CreateMachineInput) error {
+				guest = input.Config.Guest
+				return nil
+			}
+			kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+			mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+			svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+			svc.Annotations[tunnel.AnnotationFlyMachineSize] = tt.size
+			_, err := mgr.Provision(context.Background(), svc)
+			if tt.wantErr {
+				if !errors.Is(err, tunnel.ErrPermanent) || !strings.Contains(err.Error(), tunnel.AnnotationFlyMachineSize) {
+					t.Fatalf("expected a permanent error naming %s, got %v", tunnel.AnnotationFlyMachineSize, err)
+				}
+				if server.AppCount() != 0 {
+					t.Errorf("expected nothing provisioned, got %d apps", server.AppCount())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+			if !reflect.DeepEqual(guest, tt.want) {
+				t.Errorf("expected guest %+v, got %+v", tt.want, guest)
+			}
+		})
+	}
+}
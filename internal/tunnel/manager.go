@@ -3,21 +3,26 @@ package tunnel
 
 import (
 	"context"
-	"crypto/sha256"
 	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/utils/ptr"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
 	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/metrics"
 )
 
 const (
@@ -40,6 +45,57 @@ type Config struct {
 	FrpsImage         string
 	FrpcImage         string
 	OperatorNamespace string
+	// OperatorVersion is recorded on every tunnel this operator reconciles.
+	OperatorVersion string
+	// MachineStartTimeout bounds the wait for a Machine to start; zero
+	// means DefaultMachineStartTimeout.
+	MachineStartTimeout time.Duration
+	// ControlPort is the preferred frps control port for new tunnels; zero
+	// means frp.DefaultServerPort.
+	ControlPort int
+	// ClusterDomain is the cluster DNS domain frpc resolves Services
+	// under; empty means frp.DefaultClusterDomain.
+	ClusterDomain string
+	// FrpcNodeSelector constrains frpc pods to nodes with these labels,
+	// unless a Service sets AnnotationFrpcNodeSelector.
+	FrpcNodeSelector map[string]string
+	// FrpcImagePullSecret names a Secret in the frpc namespace that frpc
+	// pods pull FrpcImage with; empty for a public image.
+	FrpcImagePullSecret string
+	// FrpcHeartbeat is how frpc detects a dead connection to frps; zero
+	// fields mean the frp package defaults.
+	FrpcHeartbeat frp.Heartbeat
+	// FrpsLimits bound what frpc may ask of frps; zero fields leave the
+	// frps defaults. A Service may override MaxPortsPerClient with
+	// frp.AnnotationMaxPortsPerClient.
+	FrpsLimits frp.ServerLimits
+	// FrpsLogLevel and FrpcLogLevel are the levels frps and frpc log at;
+	// empty means frp.DefaultLogLevel. A Service may override them with
+	// frp.AnnotationFrpsLogLevel and frp.AnnotationFrpcLogLevel.
+	FrpsLogLevel string
+	FrpcLogLevel string
+	// ArtifactTTLs bound how long auxiliary objects outlive their last use
+	// before CollectExpired deletes them.
+	ArtifactTTLs ArtifactTTLs
+	// ClusterLocation is where the cluster runs, for Services with
+	// AnnotationFlyRegion RegionAuto; zero disables RegionAuto.
+	ClusterLocation ClusterLocation
+	// ClassDefaults override FlyRegion and FlyMachineSize by the
+	// loadBalancerClass of the Service. Tunnel groups use the operator-wide
+	// values.
+	ClassDefaults map[string]ClassDefaults
+	// ExternalApps makes every tunnel run in an existing Fly App named by
+	// AnnotationFlyApp, which the operator neither creates nor deletes.
+	ExternalApps bool
+	// ClusterName names the cluster in the operator identity Services are
+	// claimed with; see AnnotationOperatorIdentity.
+	ClusterName string
+	// PropagatePrefixes select, by key prefix, the Service labels and
+	// annotations copied onto its frpc Deployment, pods and config Secret.
+	PropagatePrefixes []string
+	// FrpsRegistryAuth holds the credentials Fly.io pulls FrpsImage with;
+	// nil for a public image.
+	FrpsRegistryAuth *flyio.RegistryAuth
 }
 
 // Manager handles creating and destroying tunnel infrastructure.
@@ -47,349 +103,1086 @@ type Manager struct {
 	flyClient  *flyio.Client
 	kubeClient client.Client
 	config     Config
+
+	// remotePorts reads back frps-assigned ports for random-remote-port tunnels.
+	remotePorts RemotePortReader
+
+	// proxyStatus reads frpc's proxy status for the control channel check.
+	proxyStatus ProxyStatusReader
+
+	// recorder emits Events on Services; nil disables them.
+	recorder record.EventRecorder
+
+	// podLogs fetches frpc container logs; nil disables crash excerpts.
+	podLogs typedcorev1.PodsGetter
+
+	// desired caches the computed desired state of each Service.
+	desired *desiredStateCache
+
+	// suspiciousPorts are port names and numbers warned about when tunneled.
+	suspiciousPorts []string
+
+	// migrationTimeout bounds how long Update waits for frpc moved to a new
+	// operator namespace to become available. Zero disables migration.
+	migrationTimeout time.Duration
+
+	// timeouts bound each Provision, Update and Teardown call.
+	timeouts OperationTimeouts
+
+	// groupLocks holds a *sync.Mutex per tunnel group.
+	groupLocks sync.Map
+
+	// provisioning tracks the Services being provisioned, which Update
+	// leaves alone.
+	provisioning provisionsInFlight
 }
 
 // NewManager creates a new tunnel Manager.
 func NewManager(flyClient *flyio.Client, kubeClient client.Client, config Config) *Manager {
-	return &Manager{
-		flyClient:  flyClient,
+	admin := &frpcAdminReader{
 		kubeClient: kubeClient,
-		config:     config,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
 	}
+	return &Manager{
+		flyClient:       flyClient,
+		kubeClient:      kubeClient,
+		config:          config,
+		remotePorts:     admin,
+		proxyStatus:     admin,
+		desired:         newDesiredStateCache(),
+		suspiciousPorts: DefaultSuspiciousPorts,
+		timeouts:        DefaultOperationTimeouts,
+	}
+}
+
+// Config returns the operator-level configuration of m.
+func (m *Manager) Config() Config {
+	return m.config
+}
+
+// WithEventRecorder makes the Manager emit Kubernetes Events on Services for
+// notable tunnel operations.
+func (m *Manager) WithEventRecorder(recorder record.EventRecorder) *Manager {
+	m.recorder = recorder
+	return m
+}
+
+// event records an Event on svc if a recorder is configured.
+func (m *Manager) event(svc *corev1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if m.recorder == nil {
+		return
+	}
+	m.recorder.Eventf(svc, eventType, reason, messageFmt, args...)
 }
 
 // TunnelResult contains the result of provisioning a tunnel.
 type TunnelResult struct {
-	FlyApp         string
-	MachineID      string
-	PublicIP       string
-	IPID           string
+	FlyApp    string
+	MachineID string
+	PublicIP  string
+	IPID      string
+	// PublicIPv6 and IPv6ID are the IPv6 of a dual-stack tunnel, empty if
+	// its allocation failed.
+	PublicIPv6     string
+	IPv6ID         string
 	FrpcDeployment string
+	FrpcNamespace  string
+	IPOwnership    string
+	AppOwnership   string
+	// OperatorIdentity is the AnnotationOperatorIdentity claiming the
+	// Service.
+	OperatorIdentity string
+	// DashboardSecret names the frps dashboard credentials Secret, if the
+	// dashboard is enabled.
+	DashboardSecret string
+	// Versions are the image and operator version annotations to record.
+	Versions map[string]string
+	// ControlPort is the frps control port frpc connects to.
+	ControlPort int
+	// AssignedRemotePorts is the AnnotationAssignedRemotePorts value of a
+	// tunnel group member, whose public ports may be remapped.
+	AssignedRemotePorts string
 }
 
 // Provision creates a dedicated fly.io App with a Machine running frps,
 // deploys frpc in-cluster, and returns the public IP for the Service.
 func (m *Manager) Provision(ctx context.Context, svc *corev1.Service) (*TunnelResult, error) {
+	defer m.provisioning.begin(svc)()
+	start := time.Now()
+	result, err := m.provision(ctx, svc)
+	metrics.ObserveProvision(time.Since(start), err)
+	return result, err
+}
+
+// provision does the work of Provision.
+func (m *Manager) provision(ctx context.Context, svc *corev1.Service) (*TunnelResult, error) {
+	ctx = flyio.ContextWithAuditSubject(ctx, svc.Namespace+"/"+svc.Name)
+	ctx, cancel := withBudget(ctx, m.timeouts.Provision)
+	defer cancel()
 	logger := log.FromContext(ctx)
 	flyAppName := flyAppNameForService(svc, m.config.FlyOrg)
+	if err := m.CheckClaim(svc); err != nil {
+		return nil, err
+	}
+
+	// Bail out before touching fly.io if frpc resources can't be created yet.
+	if err := m.ensureOperatorNamespace(ctx); err != nil {
+		return nil, err
+	}
+	svc, err := m.withFrpOptions(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateService(svc, m.config); err != nil {
+		return nil, permanent(err)
+	}
+	m.warnSuspiciousPorts(svc)
+	if m.config.ExternalApps {
+		if err := m.checkExternalApp(ctx, svc); err != nil {
+			return nil, err
+		}
+	}
+	if tunnelGroup(svc) != "" {
+		return m.provisionGroupMember(ctx, svc)
+	}
+	if svc, err = m.resolveRegion(ctx, svc); err != nil {
+		return nil, err
+	}
+
+	// Keep the frps control port clear of the ports the Service publishes.
+	// The choice is recorded on (a copy of) svc for the desired state below.
+	if svc.Annotations[AnnotationControlPort] == "" {
+		port, err := m.chooseControlPort(svc)
+		if err != nil {
+			m.event(svc, corev1.EventTypeWarning, "ControlPortConflict", "%v", err)
+			return nil, permanent(err)
+		}
+		svc = svc.DeepCopy()
+		if svc.Annotations == nil {
+			svc.Annotations = map[string]string{}
+		}
+		svc.Annotations[AnnotationControlPort] = strconv.Itoa(port)
+	}
 
-	// Ensure a dedicated Fly App exists for this tunnel.
-	logger.Info("Ensuring fly.io App", "app", flyAppName, "org", m.config.FlyOrg)
-	if err := m.flyClient.EnsureApp(ctx, flyAppName, m.config.FlyOrg); err != nil {
-		return nil, fmt.Errorf("ensuring fly app: %w", err)
+	// An attempt interrupted by its deadline recorded what it had created;
+	// pick up from there. Resumed resources, like retained ones, are never
+	// rolled back on failure.
+	if app := svc.Annotations[AnnotationFlyApp]; app != "" {
+		flyAppName = app
 	}
+	var partial partialTunnel
 
-	// Create the fly.io Machine running frps.
-	machineInput := m.buildMachineInput(svc)
-	logger.Info("Creating fly.io Machine", "name", machineInput.Name, "app", flyAppName, "region", machineInput.Region)
-	machine, err := m.flyClient.CreateMachine(ctx, flyAppName, machineInput)
+	// A Service with a stable identity adopts the App and IP retained from a
+	// previous Service with the same identity.
+	var retained *identityRecord
+	if stableIdentity(svc) != "" {
+		rec, err := m.loadIdentity(ctx, svc)
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil {
+			logger.Info("Adopting retained tunnel for stable identity", "identity", stableIdentity(svc), "app", rec.FlyApp, "address", rec.PublicIP)
+			retained = rec
+			flyAppName = rec.FlyApp
+		}
+	}
+	resumedApp := svc.Annotations[AnnotationFlyApp] == flyAppName
+	// An App found without being recorded was left by an attempt that
+	// died; what it created in the App is adopted, and never rolled back.
+	var adopting bool
+	deleteApp := func() {
+		if retained == nil && !resumedApp && !adopting && !m.config.ExternalApps {
+			_ = m.flyClient.DeleteApp(ctx, flyAppName)
+		}
+	}
+
+	// Ensure a dedicated Fly App exists for this tunnel. An external App
+	// was checked above.
+	if !m.config.ExternalApps {
+		logger.Info("Ensuring fly.io App", "app", flyAppName, "org", m.config.FlyOrg)
+		flyAppName, adopting, err = m.ensureApp(ctx, svc, flyAppName)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, m.interrupted(ctx, svc, partial, "ensuring fly app")
+			}
+			return nil, permanentIfQuota(fmt.Errorf("ensuring fly app: %w", err))
+		}
+	}
+	partial.FlyApp = flyAppName
+
+	// Store the frps config as an App secret for the Machine to boot with.
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	dashboard, err := m.ensureDashboard(ctx, svc)
+	if err != nil {
+		deleteApp()
+		return nil, err
+	}
+	adminPassword, err := m.adminPasswordFor(ctx, svc, m.frpcNamespace(svc), frpcDeploymentName(svc))
+	if err != nil {
+		deleteApp()
+		return nil, err
+	}
+	secrets := tunnelSecrets{token: token, dashboard: dashboard, adminPassword: adminPassword}
+	// The IP, and with it the frpc side, is not known yet.
+	desired, err := m.desiredStateFor(svc, "", secrets)
 	if err != nil {
-		_ = m.flyClient.DeleteApp(ctx, flyAppName)
-		return nil, fmt.Errorf("creating fly machine: %w", err)
+		deleteApp()
+		return nil, err
+	}
+	if err := m.pushFrpsConfig(ctx, flyAppName, desired); err != nil {
+		if ctx.Err() != nil {
+			return nil, m.interrupted(ctx, svc, partial, "setting frps config secret")
+		}
+		deleteApp()
+		return nil, err
+	}
+
+	// Create the fly.io Machine running frps, unless one was recorded or
+	// is adopted.
+	machineInput := desired.machineInput
+	machine, err := m.resumeMachine(ctx, svc, flyAppName)
+	if err == nil && machine == nil && adopting {
+		machine, err = m.adoptMachine(ctx, flyAppName, machineInput.Name)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, m.interrupted(ctx, svc, partial, "getting recorded machine")
+		}
+		return nil, err
+	}
+	resumedMachine := machine != nil
+	if resumedMachine {
+		// The recorded or adopted Machine booted with an earlier attempt's
+		// token; restart it onto this one.
+		logger.Info("Resuming with recorded fly.io Machine", "machineID", machine.ID, "app", flyAppName)
+		machine, err = m.flyClient.UpdateMachine(ctx, flyAppName, machine.ID, machineInput)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, m.interrupted(ctx, svc, partial, "updating recorded machine")
+			}
+			return nil, fmt.Errorf("updating recorded machine: %w", err)
+		}
+	} else {
+		logger.Info("Creating fly.io Machine", "name", machineInput.Name, "app", flyAppName, "region", machineInput.Region)
+		machine, err = m.flyClient.CreateMachine(ctx, flyAppName, machineInput)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, m.interrupted(ctx, svc, partial, "creating fly machine")
+			}
+			if !flyio.IsRateLimited(err) {
+				// When throttled, deleting the App would be throttled
+				// too; the next attempt adopts it instead.
+				deleteApp()
+			}
+			return nil, permanentIfQuota(fmt.Errorf("creating fly machine: %w", err))
+		}
+		logger.Info("Machine created", "machineID", machine.ID, "instanceID", machine.InstanceID)
+	}
+	partial.MachineID = machine.ID
+	deleteMachine := func() {
+		if !resumedMachine {
+			_ = m.flyClient.DeleteMachine(ctx, flyAppName, machine.ID)
+		}
 	}
-	logger.Info("Machine created", "machineID", machine.ID, "instanceID", machine.InstanceID)
 
 	// Wait for the Machine to start.
-	if err := m.flyClient.WaitForMachine(ctx, flyAppName, machine.ID, machine.InstanceID, "started", 60*time.Second); err != nil {
-		_ = m.flyClient.DeleteMachine(ctx, flyAppName, machine.ID)
-		_ = m.flyClient.DeleteApp(ctx, flyAppName)
+	if err := m.flyClient.WaitForMachine(ctx, flyAppName, machine.ID, machine.InstanceID, "started", m.machineStartTimeout(svc)); err != nil {
+		if ctx.Err() != nil {
+			return nil, m.interrupted(ctx, svc, partial, "waiting for machine to start")
+		}
+		deleteMachine()
+		deleteApp()
 		return nil, fmt.Errorf("waiting for machine to start: %w", err)
 	}
 
-	// Allocate a dedicated IPv4.
-	logger.Info("Allocating dedicated IPv4", "app", flyAppName)
-	ip, err := m.flyClient.AllocateDedicatedIPv4(ctx, flyAppName)
-	if err != nil {
-		_ = m.flyClient.DeleteMachine(ctx, flyAppName, machine.ID)
-		_ = m.flyClient.DeleteApp(ctx, flyAppName)
-		return nil, fmt.Errorf("allocating dedicated IPv4: %w", err)
+	// Allocate a dedicated IPv4, unless one is retained for this identity,
+	// was recorded by an interrupted attempt or is adopted.
+	var ip *flyio.IPAddress
+	if retained != nil {
+		ip = &flyio.IPAddress{ID: retained.IPID, Address: retained.PublicIP}
+	} else {
+		ip, err = m.resumeIP(ctx, svc, flyAppName)
+		if err == nil && ip == nil && adopting {
+			ip, err = m.adoptIP(ctx, flyAppName)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, m.interrupted(ctx, svc, partial, "listing recorded IP")
+			}
+			return nil, err
+		}
+	}
+	// A dual-stack tunnel allocates both addresses in one request.
+	allocated := ip == nil
+	var ipv6 *flyio.IPAddress
+	if allocated {
+		if wantsIPv6(svc) {
+			ip, ipv6, err = m.allocateDualStack(ctx, svc, flyAppName)
+		} else {
+			logger.Info("Allocating dedicated IPv4", "app", flyAppName)
+			ip, err = m.flyClient.AllocateDedicatedIPv4(ctx, flyAppName)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, m.interrupted(ctx, svc, partial, "allocating dedicated IPv4")
+			}
+			deleteMachine()
+			deleteApp()
+			return nil, permanentIfQuota(fmt.Errorf("allocating dedicated IPv4: %w", err))
+		}
+		logger.Info("IPv4 allocated", "address", ip.Address, "id", ip.ID)
 	}
-	logger.Info("IPv4 allocated", "address", ip.Address, "id", ip.ID)
+	partial.IPID, partial.PublicIP = ip.ID, ip.Address
 
 	// Deploy frpc in-cluster.
-	frpcDeploymentName := frpcDeploymentNameForService(svc)
-	if err := m.deployFrpc(ctx, svc, ip.Address, frpcDeploymentName); err != nil {
-		_ = m.flyClient.ReleaseIPAddress(ctx, flyAppName, ip.ID)
-		_ = m.flyClient.DeleteMachine(ctx, flyAppName, machine.ID)
-		_ = m.flyClient.DeleteApp(ctx, flyAppName)
+	frpcDeploymentName := frpcDeploymentName(svc)
+	if _, err := m.deployFrpc(ctx, svc, ip.Address, m.config.OperatorNamespace, secrets); err != nil {
+		if ctx.Err() != nil {
+			return nil, m.interrupted(ctx, svc, partial, "deploying frpc")
+		}
+		if allocated {
+			_ = m.flyClient.ReleaseIPAddress(ctx, flyAppName, ip.ID)
+		}
+		if ipv6 != nil {
+			_ = m.flyClient.ReleaseIPAddress(ctx, flyAppName, ipv6.ID)
+		}
+		deleteMachine()
+		deleteApp()
 		return nil, fmt.Errorf("deploying frpc: %w", err)
 	}
 
-	return &TunnelResult{
-		FlyApp:         flyAppName,
-		MachineID:      machine.ID,
-		PublicIP:       ip.Address,
-		IPID:           ip.ID,
-		FrpcDeployment: frpcDeploymentName,
-	}, nil
+	if stableIdentity(svc) != "" {
+		rec := identityRecord{FlyApp: flyAppName, IPID: ip.ID, PublicIP: ip.Address}
+		if err := m.saveIdentity(ctx, svc, rec, false); err != nil {
+			// The tunnel works; it just won't be adoptable after deletion.
+			logger.Error(err, "Failed to record stable identity", "identity", stableIdentity(svc))
+		}
+	}
+
+	result := &TunnelResult{
+		FlyApp:           flyAppName,
+		MachineID:        machine.ID,
+		PublicIP:         ip.Address,
+		IPID:             ip.ID,
+		FrpcDeployment:   frpcDeploymentName,
+		FrpcNamespace:    m.config.OperatorNamespace,
+		IPOwnership:      IPOwnershipOperator,
+		AppOwnership:     m.appOwnership(),
+		OperatorIdentity: m.Identity(svc),
+		Versions:         m.versionAnnotations(),
+		ControlPort:      controlPort(svc),
+	}
+	if dashboard != nil {
+		result.DashboardSecret = dashboardSecretName(svc)
+	}
+	if wantsIPv6(svc) && !allocated {
+		ipv6 = m.allocateIPv6(ctx, svc, flyAppName, ip.Address)
+	}
+	if ipv6 != nil {
+		result.PublicIPv6, result.IPv6ID = ipv6.Address, ipv6.ID
+	}
+	metrics.SetTunnelImages(svc.Namespace+"/"+svc.Name, m.config.FrpcImage, m.config.FrpsImage)
+	return result, nil
 }
 
-// Teardown destroys the tunnel infrastructure for a Service.
-func (m *Manager) Teardown(ctx context.Context, svc *corev1.Service) error {
+// Teardown destroys the tunnel infrastructure for a Service. Its duration
+// and the outcome of each step are exported as metrics.
+func (m *Manager) Teardown(ctx context.Context, svc *corev1.Service) (err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveTeardown(time.Since(start), err) }()
+	ctx = flyio.ContextWithAuditSubject(ctx, svc.Namespace+"/"+svc.Name)
+	ctx, cancel := withBudget(ctx, m.timeouts.Teardown)
+	defer cancel()
 	logger := log.FromContext(ctx)
 
+	// The tunnel of a Service claimed by another operator is not ours to
+	// remove; its owner tears it down.
+	if err := m.CheckClaim(svc); err != nil {
+		logger.Info("Leaving tunnel of Service claimed by another operator", "reason", err.Error())
+		return nil
+	}
+
+	group, err := m.recordedGroup(ctx, svc)
+	if err != nil {
+		return err
+	}
+	if group == "" && !HasTunnelState(svc) {
+		// Provisioning may have joined the group before recording it.
+		group = tunnelGroup(svc)
+	}
+	if group != "" {
+		m.desired.forget(svc.UID)
+		metrics.ForgetTunnelImages(svc.Namespace + "/" + svc.Name)
+		return m.teardownGroupMember(ctx, svc, group)
+	}
+
+	// Without any recorded tunnel state, only clean up by conventional names
+	// if this cluster provably created the tunnel. Another cluster sharing the
+	// Fly org may own an app with the same conventional name.
+	if !HasTunnelState(svc) {
+		owned, err := m.ownsConventionalTunnel(ctx, svc)
+		if err != nil {
+			return fmt.Errorf("checking for unannotated tunnel: %w", err)
+		}
+		if !owned {
+			logger.Info("No tunnel state recorded for Service; nothing on fly.io to tear down")
+			return m.teardownPartial(ctx, svc)
+		}
+		logger.Info("Found tunnel resources without annotations; cleaning up by conventional names")
+	} else if neverAllocatedIP(svc) {
+		return m.teardownPartial(ctx, svc)
+	}
+
+	// Every step is attempted; the failed ones are returned together so the
+	// teardown is retried.
+	var errs []error
+	step := func(name string, err error, msg string, keysAndValues ...interface{}) {
+		if err := teardownStep(name, err); err != nil {
+			logger.Error(err, msg, keysAndValues...)
+			errs = append(errs, err)
+		}
+	}
+
 	// Delete frpc Deployment and ConfigMap.
 	// Use the deterministic name as fallback if the annotation was cleared.
-	deployName := svc.Annotations[AnnotationFrpcDeployment]
-	if deployName == "" {
-		deployName = frpcDeploymentNameForService(svc)
-	}
-	logger.Info("Deleting frpc resources", "name", deployName)
-	if err := m.deleteFrpcResources(ctx, deployName); err != nil {
-		logger.Error(err, "Failed to delete frpc resources", "name", deployName)
+	deployName := frpcDeploymentName(svc)
+	m.desired.forget(svc.UID)
+	metrics.ForgetTunnelImages(svc.Namespace + "/" + svc.Name)
+	logger.Info("Deleting frpc resources", "name", deployName, "namespace", m.frpcNamespace(svc))
+	step(metrics.TeardownStepFrpcResources, m.deleteFrpcResources(ctx, m.frpcNamespace(svc), deployName),
+		"Failed to delete frpc resources", "name", deployName)
+	step(metrics.TeardownStepFrpcResources, m.removeCanary(ctx, m.frpcNamespace(svc), canaryDeploymentName(deployName)),
+		"Failed to delete frpc canary", "name", canaryDeploymentName(deployName))
+	dashboardSecret := svc.Annotations[AnnotationFrpsDashboardSecret]
+	if dashboardSecret == "" {
+		dashboardSecret = dashboardSecretName(svc)
 	}
+	step(metrics.TeardownStepFrpcResources, m.deleteDashboardSecret(ctx, dashboardSecret),
+		"Failed to delete frps dashboard secret", "name", dashboardSecret)
+	step(metrics.TeardownStepFrpcResources, m.deleteEndpointsService(ctx, svc),
+		"Failed to delete endpoints service", "name", endpointsServiceName(svc))
 
 	// Use the deterministic app name as fallback if the annotation was cleared.
 	// Deleting the Fly app cascades to its machines and IP allocations, so we
 	// always attempt this even if individual resource annotations are missing.
+	recordedApp := svc.Annotations[AnnotationFlyApp] != ""
 	flyAppName := svc.Annotations[AnnotationFlyApp]
 	if flyAppName == "" {
 		flyAppName = flyAppNameForService(svc, m.config.FlyOrg)
 	}
+	deleteMachine := func() {
+		if machineID := svc.Annotations[AnnotationMachineID]; machineID != "" {
+			logger.Info("Deleting fly.io Machine", "id", machineID)
+			step(metrics.TeardownStepDeleteMachine, m.flyClient.DeleteMachine(ctx, flyAppName, machineID),
+				"Failed to delete machine", "id", machineID)
+		}
+	}
+	releaseIPv6 := func() {
+		if ipID := svc.Annotations[AnnotationIPv6ID]; ipID != "" {
+			logger.Info("Releasing dedicated IPv6", "id", ipID)
+			step(metrics.TeardownStepReleaseIP, m.flyClient.ReleaseIPAddress(ctx, flyAppName, ipID),
+				"Failed to release IPv6", "id", ipID)
+		}
+	}
+
+	// An App the operator did not create outlives the tunnel; only what the
+	// tunnel created in it goes.
+	if !ownsApp(svc) || m.config.ExternalApps {
+		errs = append(errs, m.teardownInApp(ctx, svc, flyAppName)...)
+		logger.Info("Leaving fly.io App in place", "app", flyAppName)
+		return teardownErrors(ctx, errs)
+	}
 
-	// Best-effort cleanup of individual resources before deleting the app.
-	if ipID, ok := svc.Annotations[AnnotationIPID]; ok && ipID != "" {
-		logger.Info("Releasing dedicated IPv4", "id", ipID)
-		if err := m.flyClient.ReleaseIPAddress(ctx, flyAppName, ipID); err != nil {
-			logger.Error(err, "Failed to release IP", "id", ipID)
+	// A stable identity retains the App and IP for a future Service with the
+	// same identity; only the Machine is removed.
+	if stableIdentity(svc) != "" && svc.Annotations[AnnotationIPID] != "" {
+		rec := identityRecord{
+			FlyApp:   flyAppName,
+			IPID:     svc.Annotations[AnnotationIPID],
+			PublicIP: svc.Annotations[AnnotationPublicIP],
+		}
+		if err := m.saveIdentity(ctx, svc, rec, true); err != nil {
+			return fmt.Errorf("retaining tunnel for stable identity: %w", err)
 		}
+		deleteMachine()
+		releaseIPv6()
+		logger.Info("Retaining fly.io App and IP for stable identity", "identity", stableIdentity(svc), "app", flyAppName)
+		return teardownErrors(ctx, errs)
+	}
+
+	// An external IP must outlive the tunnel. Deleting the App would release
+	// it along with the App's other addresses, so only the Machine goes.
+	if !ownsIP(svc) {
+		deleteMachine()
+		releaseIPv6()
+		logger.Info("Leaving externally owned IP and its fly.io App in place", "app", flyAppName, "address", svc.Annotations[AnnotationPublicIP])
+		return teardownErrors(ctx, errs)
 	}
-	if machineID, ok := svc.Annotations[AnnotationMachineID]; ok && machineID != "" {
-		logger.Info("Deleting fly.io Machine", "id", machineID)
-		if err := m.flyClient.DeleteMachine(ctx, flyAppName, machineID); err != nil {
-			logger.Error(err, "Failed to delete machine", "id", machineID)
+
+	// Deleting a recorded App takes its Machine and IPs with it; releasing
+	// them first would only race that. Under the conventional name, the
+	// App may not be the tunnel's, so what was recorded of it goes first.
+	if !recordedApp {
+		if ipID := svc.Annotations[AnnotationIPID]; ipID != "" {
+			logger.Info("Releasing dedicated IPv4", "id", ipID)
+			step(metrics.TeardownStepReleaseIP, m.flyClient.ReleaseIPAddress(ctx, flyAppName, ipID),
+				"Failed to release IP", "id", ipID)
 		}
+		releaseIPv6()
+		deleteMachine()
 	}
 
 	// Delete the Fly App (cascades to any remaining machines and IPs).
 	logger.Info("Deleting fly.io App", "app", flyAppName)
-	if err := m.flyClient.DeleteApp(ctx, flyAppName); err != nil {
-		logger.Error(err, "Failed to delete fly app", "app", flyAppName)
-	}
+	step(metrics.TeardownStepDeleteApp, m.flyClient.DeleteApp(ctx, flyAppName),
+		"Failed to delete fly app", "app", flyAppName)
+
+	return teardownErrors(ctx, errs)
+}
+
+// teardownStep records the outcome of a Teardown step and returns its error.
+// A Fly.io resource that is already gone counts as removed.
+func teardownStep(step string, err error) error {
+	err = ignoreFlyNotFound(err)
+	metrics.ObserveTeardownStep(step, err)
+	return err
+}
 
-	return nil
+// ignoreFlyNotFound returns nil if err only means the Fly.io resource it is
+// about does not exist, and err otherwise.
+func ignoreFlyNotFound(err error) error {
+	if flyio.IsNotFound(err) {
+		return nil
+	}
+	return err
 }
 
 // Update reconciles the full frpc Deployment/ConfigMap and fly.io Machine to
-// match the current Service spec and annotations.
-func (m *Manager) Update(ctx context.Context, svc *corev1.Service) error {
+// match the current Service spec and annotations. frpc resources that
+// already match, compared with frp.ConfigEqual for the config, are left
+// untouched. It reports whether it changed the frpc Secret, Deployment or
+// the Machine, and returns ErrProvisionInProgress, doing nothing, while a
+// Provision of the Service is running.
+func (m *Manager) Update(ctx context.Context, svc *corev1.Service) (bool, error) {
+	if m.provisioning.active(svc) {
+		return false, ErrProvisionInProgress
+	}
+	if err := m.CheckClaim(svc); err != nil {
+		return false, err
+	}
+	ctx = flyio.ContextWithAuditSubject(ctx, svc.Namespace+"/"+svc.Name)
+	ctx, cancel := withBudget(ctx, m.timeouts.Update)
+	defer cancel()
 	logger := log.FromContext(ctx)
+	requested := svc
 	publicIP := svc.Annotations[AnnotationPublicIP]
 	deployName := svc.Annotations[AnnotationFrpcDeployment]
 	machineID := svc.Annotations[AnnotationMachineID]
 	flyAppName := svc.Annotations[AnnotationFlyApp]
 
 	if publicIP == "" || deployName == "" || flyAppName == "" {
-		return fmt.Errorf("service missing tunnel annotations, cannot update")
+		return false, fmt.Errorf("service missing tunnel annotations, cannot update")
+	}
+
+	group, err := m.recordedGroup(ctx, svc)
+	if err != nil {
+		return false, err
+	}
+	if group != tunnelGroup(svc) {
+		return false, fmt.Errorf("service is moving from tunnel group %q to %q; ChangeTunnelGroup must run first", group, tunnelGroup(svc))
+	}
+	if group != "" {
+		svc, err = m.withFrpOptions(ctx, svc)
+		if err != nil {
+			return false, err
+		}
+		if err := validateAnnotations(svc); err != nil {
+			return false, err
+		}
+		return m.updateGroupMember(ctx, svc, group)
+	}
+
+	// The IP may have been released out-of-band since it was recorded.
+	publicIP, err = m.verifyIP(ctx, svc, flyAppName)
+	if err != nil {
+		return false, fmt.Errorf("verifying public IP: %w", err)
+	}
+	// A Machine left over from an earlier replacement still serves the
+	// previous frps config on the shared IP.
+	if err := m.deleteReplacedMachine(ctx, svc, flyAppName); err != nil {
+		return false, err
+	}
+
+	svc, err = m.withFrpOptions(ctx, svc)
+	if err != nil {
+		return false, err
+	}
+	if err := validateAnnotations(svc); err != nil {
+		return false, err
+	}
+	if err := checkControlPort(svc); err != nil {
+		m.event(svc, corev1.EventTypeWarning, "ControlPortConflict", "%v", err)
+		return false, err
+	}
+	if err := checkMaxPortsPerClient(svc, m.config.FrpsLimits.MaxPortsPerClient); err != nil {
+		return false, err
+	}
+	m.warnSuspiciousPorts(svc)
+
+	// Tunnels from before auth tokens were introduced get their first one
+	// like a rotation. A rotation moves frps first; frpc follows below.
+	namespace := m.frpcNamespace(svc)
+	var secrets tunnelSecrets
+	secrets.token, err = m.currentToken(ctx, namespace, deployName)
+	if err != nil {
+		return false, err
+	}
+	secrets.dashboard, err = m.reconcileDashboard(ctx, svc)
+	if err != nil {
+		return false, err
+	}
+	secrets.adminPassword, err = m.adminPasswordFor(ctx, svc, namespace, deployName)
+	if err != nil {
+		return false, err
+	}
+	// A suspended tunnel rotates once resumed: the rotation restarts frps.
+	rotated := (secrets.token == "" || rotationRequested(svc)) && !Suspended(svc)
+	// Starting or stopping the Machine, a rotation and a migration all
+	// change the tunnel.
+	changed := rotated || (machineID != "" && MachineStopped(svc) != Suspended(svc))
+	if !Suspended(svc) {
+		if err := m.resume(ctx, svc, flyAppName, machineID); err != nil {
+			return false, err
+		}
+	}
+	if rotated {
+		secrets, err = m.rotateToken(ctx, svc, flyAppName, machineID, publicIP, secrets)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Move frpc resources left behind in a previous operator namespace.
+	if namespace != m.config.OperatorNamespace && m.migrationTimeout > 0 {
+		if err := m.migrateFrpc(ctx, svc, publicIP, deployName, secrets); err != nil {
+			return false, fmt.Errorf("migrating frpc resources from namespace %s: %w", namespace, err)
+		}
+		namespace = m.config.OperatorNamespace
+		changed = true
+	}
+
+	// frps must serve a new port before frpc registers its proxy, or frps
+	// rejects the first registration. A change adding ports therefore
+	// updates the Machine first and waits for it; otherwise frpc goes first,
+	// so traffic drains from removed ports before frps stops serving them.
+	frpsFirst := false
+	if !Suspended(svc) && !rotated && machineID != "" {
+		frpsFirst, err = m.addsProxies(ctx, svc, namespace, publicIP, secrets)
+		if err != nil {
+			return false, err
+		}
+	}
+	if frpsFirst {
+		logger.Info("Ports added; updating frps before frpc")
+		machineChanged, err := m.updateFrps(ctx, svc, flyAppName, machineID, publicIP, secrets, true)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || machineChanged
 	}
 
 	// Reconcile the full frpc ConfigMap and Deployment spec (image, resources, config, etc.).
-	if err := m.deployFrpc(ctx, svc, publicIP, deployName); err != nil {
-		return fmt.Errorf("updating frpc deployment: %w", err)
+	frpcChanged, err := m.deployFrpc(ctx, svc, publicIP, namespace, secrets)
+	if err != nil {
+		return false, fmt.Errorf("updating frpc deployment: %w", err)
 	}
+	changed = changed || frpcChanged
 	logger.Info("Reconciled frpc Deployment", "name", deployName)
 
-	// Update fly.io Machine config (services, region, guest, etc.).
-	if machineID != "" {
-		machineInput := m.buildMachineInput(svc)
-		if _, err := m.flyClient.UpdateMachine(ctx, flyAppName, machineID, machineInput); err != nil {
-			return fmt.Errorf("updating fly machine: %w", err)
+	if Suspended(svc) {
+		// Updating a stopped Machine would start it again. It gets the
+		// current config once resumed.
+		if err := m.suspend(ctx, svc, flyAppName, machineID); err != nil {
+			return false, err
 		}
-		logger.Info("Updated fly.io Machine", "machineID", machineID)
+	} else if rotated {
+		// frps already runs the current config.
+		if err := m.recordTokenRotation(ctx, svc); err != nil {
+			return false, err
+		}
+	} else if machineID != "" && !frpsFirst {
+		// Update fly.io Machine config (services, region, guest, etc.).
+		machineChanged, err := m.updateFrps(ctx, svc, flyAppName, machineID, publicIP, secrets, false)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || machineChanged
+	}
+
+	// Recorded on the Service itself, so the caller can publish the IPv6.
+	if err := m.reconcileIPv6(ctx, requested, flyAppName, publicIP); err != nil {
+		return false, err
 	}
 
-	return nil
+	if err := m.recordVersions(ctx, svc); err != nil {
+		// The tunnel is up to date; only the audit trail lags.
+		logger.Error(err, "Failed to record tunnel versions")
+	}
+	return changed, nil
 }
 
-// deployFrpc creates the frpc ConfigMap and Deployment in-cluster.
-func (m *Manager) deployFrpc(ctx context.Context, svc *corev1.Service, serverAddr, deploymentName string) error {
-	configMapName := deploymentName + "-config"
-	configData := frp.GenerateClientConfig(svc, serverAddr, frp.DefaultServerPort)
+// updateFrps sets the frps config secret for secrets and updates the fly.io
+// Machine to match svc, replacing the Machine if it rejects the update in
+// place. With wait set it returns only once the updated Machine has started.
+// It reports whether the Machine was out of date.
+func (m *Manager) updateFrps(ctx context.Context, svc *corev1.Service, flyAppName, machineID, publicIP string, secrets tunnelSecrets, wait bool) (bool, error) {
+	logger := log.FromContext(ctx)
 
-	// Create ConfigMap with frpc config.
-	cm := &corev1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      configMapName,
-			Namespace: m.config.OperatorNamespace,
-			Labels: map[string]string{
-				"app.kubernetes.io/name":          "frpc",
-				"app.kubernetes.io/managed-by":    "fly-tunnel-operator",
-				"fly-tunnel-operator.dev/service": serviceLabelValue(svc),
-			},
-		},
-		Data: map[string]string{
-			"frpc.toml": configData,
-		},
+	desired, err := m.desiredStateFor(svc, publicIP, secrets)
+	if err != nil {
+		return false, err
 	}
-
-	if err := m.kubeClient.Create(ctx, cm); err != nil {
-		if !errors.IsAlreadyExists(err) {
-			return fmt.Errorf("creating frpc configmap: %w", err)
+	machineInput := desired.machineInput
+	// An update restarts the Machine, dropping every tunneled connection,
+	// so it is skipped when there is nothing to change. The frps config is
+	// covered by its hash in the Machine env, which only changes once the
+	// secret has been set.
+	current, err := m.flyClient.GetMachine(ctx, flyAppName, machineID)
+	if err != nil {
+		return false, fmt.Errorf("getting fly machine: %w", err)
+	}
+	if machineUpToDate(current, machineInput) {
+		logger.Info("fly.io Machine already up to date", "machineID", machineID)
+		return false, nil
+	}
+	// Setting the secret is idempotent; the update below restarts the
+	// Machine, which then boots with the current config.
+	if err := m.pushFrpsConfig(ctx, flyAppName, desired); err != nil {
+		return false, err
+	}
+	machine, err := m.flyClient.UpdateMachine(ctx, flyAppName, machineID, machineInput)
+	if flyio.IsUpdateRejected(err) {
+		// The replacement is only recorded once it has started.
+		logger.Info("In-place Machine update rejected; replacing Machine", "machineID", machineID, "reason", err.Error())
+		return true, m.replaceMachine(ctx, svc, flyAppName, machineID, machineInput)
+	}
+	if err != nil {
+		return false, fmt.Errorf("updating fly machine: %w", err)
+	}
+	if wait {
+		if err := m.flyClient.WaitForMachine(ctx, flyAppName, machine.ID, machine.InstanceID, "started", m.machineStartTimeout(svc)); err != nil {
+			return false, fmt.Errorf("waiting for updated machine to start: %w", err)
 		}
-		// Update existing ConfigMap.
-		var existing corev1.ConfigMap
-		if err := m.kubeClient.Get(ctx, types.NamespacedName{Name: configMapName, Namespace: m.config.OperatorNamespace}, &existing); err != nil {
-			return fmt.Errorf("getting existing frpc configmap: %w", err)
+	}
+	logger.Info("Updated fly.io Machine", "machineID", machineID)
+	return true, nil
+}
+
+// machineUpToDate reports whether machine already runs the config of input.
+// Fly.io does not return registry credentials, so they are not compared, and
+// the region of an existing Machine never changes.
+func machineUpToDate(machine *flyio.Machine, input flyio.CreateMachineInput) bool {
+	current, desired := machine.Config, input.Config
+	current.ImageRegistryAuth, desired.ImageRegistryAuth = nil, nil
+	return equality.Semantic.DeepEqual(current, desired)
+}
+
+// addsProxies reports whether the desired frpc config of svc has proxies
+// the deployed one lacks, matching them by name, type and remote port. A
+// missing or unreadable deployed config counts as adding none.
+func (m *Manager) addsProxies(ctx context.Context, svc *corev1.Service, namespace, publicIP string, secrets tunnelSecrets) (bool, error) {
+	desired, err := m.desiredStateFor(svc, publicIP, secrets)
+	if err != nil {
+		return false, err
+	}
+	var secret corev1.Secret
+	if err := m.kubeClient.Get(ctx, types.NamespacedName{Name: desired.frpcConfigName, Namespace: namespace}, &secret); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
 		}
-		existing.Data = cm.Data
-		if err := m.kubeClient.Update(ctx, &existing); err != nil {
-			return fmt.Errorf("updating existing frpc configmap: %w", err)
+		return false, fmt.Errorf("getting frpc config secret: %w", err)
+	}
+	current, err := frp.ParseClientConfig(string(secret.Data["frpc.toml"]))
+	if err != nil {
+		return false, nil
+	}
+	want, err := frp.ParseClientConfig(desired.frpcConfig)
+	if err != nil {
+		return false, fmt.Errorf("parsing desired frpc config: %w", err)
+	}
+	deployed := make(map[string]bool)
+	for _, proxy := range current.Proxies {
+		deployed[fmt.Sprintf("%s/%s/%d", proxy.Name, proxy.Type, proxy.RemotePort)] = true
+	}
+	for _, proxy := range want.Proxies {
+		if !deployed[fmt.Sprintf("%s/%s/%d", proxy.Name, proxy.Type, proxy.RemotePort)] {
+			return true, nil
 		}
 	}
+	return false, nil
+}
 
-	// Create frpc Deployment.
-	resources, err := frpcResources(svc)
+// FrpcReady reports whether the frpc Deployment for a Service has at least one
+// available replica. It also returns when the Deployment was created so callers
+// can bound how long they wait for it.
+func (m *Manager) FrpcReady(ctx context.Context, svc *corev1.Service) (bool, time.Time, error) {
+	deployName := frpcDeploymentName(svc)
+
+	var deploy appsv1.Deployment
+	if err := m.kubeClient.Get(ctx, types.NamespacedName{Name: deployName, Namespace: m.frpcNamespace(svc)}, &deploy); err != nil {
+		return false, time.Time{}, fmt.Errorf("getting frpc deployment: %w", err)
+	}
+
+	return deploy.Status.AvailableReplicas > 0, deploy.CreationTimestamp.Time, nil
+}
+
+// deployFrpc creates the frpc config Secret and Deployment in-cluster, in
+// namespace. The config is a Secret because it carries the frps auth token
+// and the cluster's internal service topology. It reports whether it wrote
+// any frpc Secret or Deployment.
+func (m *Manager) deployFrpc(ctx context.Context, svc *corev1.Service, serverAddr, namespace string, secrets tunnelSecrets) (bool, error) {
+	desired, err := m.desiredStateFor(svc, serverAddr, secrets)
+	if err != nil {
+		return false, err
+	}
+	if err := m.reconcileEndpointsService(ctx, svc); err != nil {
+		return false, err
+	}
+	if canaryMode(svc) {
+		return m.deployFrpcCanary(ctx, svc, namespace, desired, secrets)
+	}
+	changed, err := m.applyFrpc(ctx, namespace, desired, serviceLabelValue(svc),
+		map[string]string{annotationOwner: svc.Namespace + "/" + svc.Name},
+		frpcSecretData(secrets))
 	if err != nil {
-		return fmt.Errorf("building frpc resources: %w", err)
+		return false, err
 	}
+	return changed, m.leaveCanaryMode(ctx, svc, namespace, desired.frpcDeploymentName)
+}
 
-	labels := map[string]string{
-		"app.kubernetes.io/name":       "frpc",
-		"app.kubernetes.io/instance":   deploymentName,
-		"app.kubernetes.io/managed-by": "fly-tunnel-operator",
+// applyFrpc creates or updates the frpc config Secret and Deployment of
+// desired in namespace. The Secret is labelled with serviceLabel and carries
+// annotations and extraData besides the frpc config. Both get the labels and
+// annotations desired propagates from the Service. It reports whether it
+// wrote either of them.
+func (m *Manager) applyFrpc(ctx context.Context, namespace string, desired *desiredState, serviceLabel string, annotations map[string]string, extraData map[string][]byte) (bool, error) {
+	deploymentName, configName := desired.frpcDeploymentName, desired.frpcConfigName
+
+	// Create Secret with frpc config.
+	data := map[string][]byte{"frpc.toml": []byte(desired.frpcConfig)}
+	for k, v := range extraData {
+		data[k] = v
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configName,
+			Namespace: namespace,
+			Labels: withPropagated(desired.propagatedLabels, map[string]string{
+				"app.kubernetes.io/name":       "frpc",
+				"app.kubernetes.io/managed-by": "fly-tunnel-operator",
+				labelService:                   serviceLabel,
+			}),
+			Annotations: withPropagated(desired.propagatedAnnotations, annotations),
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
 	}
 
+	// configUnchanged is set when the deployed config only differs from the
+	// desired one in ordering or whitespace, e.g. because an older operator
+	// version rendered it. It is then left as is, so frpc is not restarted.
+	configUnchanged := false
+	changed := true
+	if err := m.kubeClient.Create(ctx, secret); err != nil {
+		if !errors.IsAlreadyExists(err) {
+			return false, fmt.Errorf("creating frpc config secret: %w", err)
+		}
+		// Update existing Secret.
+		var existing corev1.Secret
+		if err := m.kubeClient.Get(ctx, types.NamespacedName{Name: configName, Namespace: namespace}, &existing); err != nil {
+			return false, fmt.Errorf("getting existing frpc config secret: %w", err)
+		}
+		deployed := existing.Data["frpc.toml"]
+		configUnchanged = deployed != nil && frp.ConfigEqual(string(deployed), desired.frpcConfig)
+		if configUnchanged {
+			secret.Data["frpc.toml"] = deployed
+		}
+		updated := existing.DeepCopy()
+		updated.Data = secret.Data
+		mergeMetadata(&updated.ObjectMeta, secret.ObjectMeta)
+		changed = !equality.Semantic.DeepEqual(&existing, updated)
+		if changed {
+			if err := m.kubeClient.Update(ctx, updated); err != nil {
+				return false, fmt.Errorf("updating existing frpc config secret: %w", err)
+			}
+		}
+	}
+
+	// Create frpc Deployment.
 	deploy := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      deploymentName,
-			Namespace: m.config.OperatorNamespace,
-			Labels:    labels,
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: ptr.To(int32(1)),
-			Selector: &metav1.LabelSelector{
-				MatchLabels: labels,
-			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: labels,
-					Annotations: map[string]string{
-						// Hash of the ConfigMap content; triggers a rollout when config changes.
-						"fly-tunnel-operator.dev/config-hash": fmt.Sprintf("%x", sha256.Sum256([]byte(configData))),
-					},
-				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:      "frpc",
-							Image:     m.config.FrpcImage,
-							Command:   []string{"frpc"},
-							Args:      []string{"-c", "/etc/frp/frpc.toml"},
-							Resources: resources,
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "config",
-									MountPath: "/etc/frp",
-									ReadOnly:  true,
-								},
-							},
-						},
-					},
-					Volumes: []corev1.Volume{
-						{
-							Name: "config",
-							VolumeSource: corev1.VolumeSource{
-								ConfigMap: &corev1.ConfigMapVolumeSource{
-									LocalObjectReference: corev1.LocalObjectReference{
-										Name: configMapName,
-									},
-								},
-							},
-						},
-					},
-				},
-			},
+			Name:        deploymentName,
+			Namespace:   namespace,
+			Labels:      desired.frpcDeployment.Template.Labels,
+			Annotations: desired.propagatedAnnotations,
 		},
+		Spec: *desired.frpcDeployment.DeepCopy(),
 	}
 
 	if err := m.kubeClient.Create(ctx, deploy); err != nil {
 		if !errors.IsAlreadyExists(err) {
-			return fmt.Errorf("creating frpc deployment: %w", err)
+			return false, fmt.Errorf("creating frpc deployment: %w", err)
 		}
 		// Update existing Deployment.
 		var existing appsv1.Deployment
-		if err := m.kubeClient.Get(ctx, types.NamespacedName{Name: deploymentName, Namespace: m.config.OperatorNamespace}, &existing); err != nil {
-			return fmt.Errorf("getting existing frpc deployment: %w", err)
+		if err := m.kubeClient.Get(ctx, types.NamespacedName{Name: deploymentName, Namespace: namespace}, &existing); err != nil {
+			return false, fmt.Errorf("getting existing frpc deployment: %w", err)
+		}
+		// The pods already run the config the Secret keeps.
+		if hash, ok := existing.Spec.Template.Annotations[podAnnotationConfigHash]; ok && configUnchanged {
+			deploy.Spec.Template.Annotations[podAnnotationConfigHash] = hash
 		}
-		existing.Spec = deploy.Spec
-		if err := m.kubeClient.Update(ctx, &existing); err != nil {
-			return fmt.Errorf("updating existing frpc deployment: %w", err)
+		// Replacing the whole spec also drops pod-template annotations from
+		// older operator versions, such as the legacy restart-at timestamp,
+		// in the same write that sets config-hash, so migrating costs at
+		// most one rollout.
+		updated := existing.DeepCopy()
+		updated.Spec = deploy.Spec
+		mergeMetadata(&updated.ObjectMeta, deploy.ObjectMeta)
+		if !deploymentUpToDate(&existing, updated) {
+			if err := m.kubeClient.Update(ctx, updated); err != nil {
+				return false, fmt.Errorf("updating existing frpc deployment: %w", err)
+			}
+			changed = true
 		}
+	} else {
+		changed = true
 	}
 
-	return nil
+	// The Deployment now mounts the Secret, so a ConfigMap left by an older
+	// operator version can go.
+	return changed, m.removeLegacyFrpcConfigMap(ctx, namespace, deploymentName)
 }
 
-// deleteFrpcResources removes the frpc Deployment and ConfigMap.
-func (m *Manager) deleteFrpcResources(ctx context.Context, deploymentName string) error {
-	configMapName := deploymentName + "-config"
+// deploymentUpToDate reports whether writing desired over existing would
+// change nothing. Fields desired leaves unset may have been defaulted by the
+// API server, but the pod template metadata must match exactly, so stale
+// annotations are still removed.
+func deploymentUpToDate(existing, desired *appsv1.Deployment) bool {
+	return equality.Semantic.DeepEqual(existing.ObjectMeta, desired.ObjectMeta) &&
+		equality.Semantic.DeepEqual(existing.Spec.Template.ObjectMeta, desired.Spec.Template.ObjectMeta) &&
+		equality.Semantic.DeepDerivative(desired.Spec, existing.Spec)
+}
 
+// deleteFrpcResources removes the frpc Deployment and config Secret from
+// namespace, along with any legacy config ConfigMap.
+func (m *Manager) deleteFrpcResources(ctx context.Context, namespace, deploymentName string) error {
 	// Delete Deployment.
 	deploy := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      deploymentName,
-			Namespace: m.config.OperatorNamespace,
+			Namespace: namespace,
 		},
 	}
 	if err := m.kubeClient.Delete(ctx, deploy); err != nil && !errors.IsNotFound(err) {
 		return fmt.Errorf("deleting frpc deployment: %w", err)
 	}
 
-	// Delete ConfigMap.
-	cm := &corev1.ConfigMap{
+	// Delete Secret.
+	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      configMapName,
-			Namespace: m.config.OperatorNamespace,
+			Name:      frpcConfigName(deploymentName),
+			Namespace: namespace,
 		},
 	}
-	if err := m.kubeClient.Delete(ctx, cm); err != nil && !errors.IsNotFound(err) {
-		return fmt.Errorf("deleting frpc configmap: %w", err)
+	if err := m.kubeClient.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("deleting frpc config secret: %w", err)
 	}
 
-	return nil
+	return m.removeLegacyFrpcConfigMap(ctx, namespace, deploymentName)
 }
 
 // buildMachineInput constructs the CreateMachineInput for a fly.io Machine
-// running frps, derived from the Service spec and operator config.
-func (m *Manager) buildMachineInput(svc *corev1.Service) flyio.CreateMachineInput {
+// running frps with secrets, derived from the Service spec and operator config.
+func (m *Manager) buildMachineInput(svc *corev1.Service, secrets tunnelSecrets) flyio.CreateMachineInput {
 	tunnelName := tunnelNameForService(svc)
 
-	region := m.config.FlyRegion
-	if r, ok := svc.Annotations[AnnotationFlyRegion]; ok && r != "" {
+	region := m.defaultRegion(svc)
+	// Provision resolves RegionAuto; set on an existing tunnel, it is
+	// ignored like any other region change.
+	if r, ok := svc.Annotations[AnnotationFlyRegion]; ok && r != "" && r != RegionAuto {
 		region = r
 	}
 
-	guest := guestForSize(m.config.FlyMachineSize)
-	if size, ok := svc.Annotations[AnnotationFlyMachineSize]; ok && size != "" {
-		guest = guestForSize(size)
-	}
+	guest := m.guest(svc)
 
 	machineServices := []flyio.MachineService{
 		{
 			Protocol:     "tcp",
-			InternalPort: frp.DefaultServerPort,
-			Ports:        []flyio.Port{{Port: frp.DefaultServerPort}},
+			InternalPort: controlPort(svc),
+			Ports:        []flyio.Port{{Port: controlPort(svc)}},
 		},
 	}
-	for _, port := range svc.Spec.Ports {
+	if frp.TransportUsesUDP(frp.TransportProtocol(svc)) {
+		// quic and kcp reach frps over UDP on the control port number.
+		machineServices = append(machineServices, flyio.MachineService{
+			Protocol:     "udp",
+			InternalPort: controlPort(svc),
+			Ports:        []flyio.Port{{Port: controlPort(svc)}},
+		})
+	}
+	// A random remote port is exposed once the controller has read the
+	// port frps picked back into the annotation.
+	seen := make(map[string]bool)
+	for _, port := range publicPorts(svc) {
+		// Vhost proxies share the frps vhost port, and dual-stack ports add
+		// a second protocol for the same number, so dedupe on protocol and
+		// port rather than port alone.
+		key := fmt.Sprintf("%d/%s", port.RemotePort, port.Protocol)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		// No handlers: the Fly.io proxy passes the raw stream to frps. In
+		// particular its proxy_proto handler would add a PROXY header on
+		// top of the one frpc sends for frp.AnnotationProxyProtocol.
+		machineServices = append(machineServices, flyio.MachineService{
+			Protocol:     port.Protocol,
+			InternalPort: port.RemotePort,
+			Ports:        []flyio.Port{{Port: port.RemotePort}},
+		})
+	}
+
+	if secrets.dashboard != nil {
 		machineServices = append(machineServices, flyio.MachineService{
 			Protocol:     "tcp",
-			InternalPort: int(port.Port),
-			Ports:        []flyio.Port{{Port: int(port.Port)}},
+			InternalPort: frp.DefaultDashboardPort,
+			Ports:        []flyio.Port{{Port: frp.DefaultDashboardPort}},
 		})
 	}
 
-	frpsConfig := frp.GenerateServerConfig(frp.DefaultServerPort)
+	input := m.frpsMachineInput(tunnelName, region, guest, machineServices, m.frpsConfig(svc, secrets))
+	input.Config.Metadata = map[string]string{MachineMetadataService: machineOwner(svc)}
+	return input
+}
 
+// frpsMachineInput returns the CreateMachineInput for a Machine running frps
+// with config, exposing services.
+func (m *Manager) frpsMachineInput(name, region string, guest *flyio.GuestConfig, services []flyio.MachineService, config string) flyio.CreateMachineInput {
+	// The config itself is delivered as an App secret (see pushFrpsConfig).
 	return flyio.CreateMachineInput{
-		Name:   tunnelName,
+		Name:   name,
 		Region: region,
 		Config: flyio.MachineConfig{
-			Image:    m.config.FrpsImage,
-			Guest:    guest,
-			Services: machineServices,
+			Image:             m.config.FrpsImage,
+			ImageRegistryAuth: m.config.FrpsRegistryAuth,
+			Guest:             guest,
+			Services:          services,
 			Env: map[string]string{
-				"FRP_SERVER_CONFIG": frpsConfig,
+				frpsConfigHashEnv: frpsConfigHash(config),
 			},
 			Init: &flyio.InitConfig{
 				Entrypoint: []string{"sh"},
@@ -400,18 +1193,3 @@ func (m *Manager) buildMachineInput(svc *corev1.Service) flyio.CreateMachineInpu
 		},
 	}
 }
-
-func guestForSize(size string) *flyio.GuestConfig {
-	switch size {
-	case "shared-cpu-2x":
-		return &flyio.GuestConfig{CPUKind: "shared", CPUs: 2, MemoryMB: 512}
-	case "shared-cpu-4x":
-		return &flyio.GuestConfig{CPUKind: "shared", CPUs: 4, MemoryMB: 1024}
-	case "performance-1x":
-		return &flyio.GuestConfig{CPUKind: "performance", CPUs: 1, MemoryMB: 2048}
-	case "performance-2x":
-		return &flyio.GuestConfig{CPUKind: "performance", CPUs: 2, MemoryMB: 4096}
-	default: // shared-cpu-1x
-		return &flyio.GuestConfig{CPUKind: "shared", CPUs: 1, MemoryMB: 256}
-	}
-}
@@ -2,19 +2,31 @@ package tunnel_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 
 	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
 	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
 	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
 )
 
@@ -37,6 +49,12 @@ func newTestConfig() tunnel.Config {
 	}
 }
 
+func testOperatorNamespace() *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: testNamespace},
+	}
+}
+
 func newTestFlyClient(server *fakefly.Server) *flyio.Client {
 	return flyio.NewClient("test-token").
 		WithBaseURL(server.URL).
@@ -64,7 +82,7 @@ func TestProvision(t *testing.T) {
 	defer server.Close()
 
 	scheme := newTestScheme()
-	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
 
 	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
 
@@ -113,21 +131,21 @@ func TestProvision(t *testing.T) {
 		t.Errorf("expected 1 IP, got %d", server.IPCount())
 	}
 
-	// Verify frpc ConfigMap was created.
-	var cm corev1.ConfigMap
+	// Verify frpc config Secret was created.
+	var secret corev1.Secret
 	err = kubeClient.Get(context.Background(), types.NamespacedName{
 		Name:      result.FrpcDeployment + "-config",
 		Namespace: testNamespace,
-	}, &cm)
+	}, &secret)
 	if err != nil {
-		t.Fatalf("expected frpc ConfigMap to exist: %v", err)
+		t.Fatalf("expected frpc config Secret to exist: %v", err)
 	}
 
-	config, ok := cm.Data["frpc.toml"]
+	config, ok := secret.Data["frpc.toml"]
 	if !ok {
-		t.Fatal("expected frpc.toml in ConfigMap data")
+		t.Fatal("expected frpc.toml in Secret data")
 	}
-	if config == "" {
+	if len(config) == 0 {
 		t.Error("expected non-empty frpc.toml config")
 	}
 
@@ -151,12 +169,99 @@ func TestProvision(t *testing.T) {
 	}
 }
 
+func TestProvision_ReusesAppLeftByCrash(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	var creates int
+	server.OnCreateApp = func(appName, orgSlug string) error {
+		creates++
+		return nil
+	}
+	// The first attempt dies after creating the App: its Machine is never
+	// created and nothing is rolled back.
+	crashed := true
+	server.OnCreateMachine = func(string, flyio.CreateMachineInput) error {
+		if crashed {
+			return errors.New("operator crashed")
+		}
+		return nil
+	}
+	server.OnDeleteApp = func(string) error {
+		if crashed {
+			return errors.New("operator crashed")
+		}
+		return nil
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+
+	if _, err := mgr.Provision(context.Background(), svc); err == nil {
+		t.Fatal("expected the first Provision to fail")
+	}
+	if server.AppCount() != 1 {
+		t.Fatalf("expected the App to be left behind, got %d apps", server.AppCount())
+	}
+
+	crashed = false
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("expected Provision to resume with the existing App, got %v", err)
+	}
+	if !server.HasApp(result.FlyApp) || server.AppCount() != 1 || server.MachineCount() != 1 {
+		t.Errorf("expected one App with one Machine, got %d apps and %d machines", server.AppCount(), server.MachineCount())
+	}
+	if creates != 1 {
+		t.Errorf("expected the existing App to be reused rather than created again, got %d creates", creates)
+	}
+}
+
+func TestProvision_AdoptsResourcesLeftByCrash(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	// A previous attempt created the App, Machine and IP, then died before
+	// recording any of them on the Service.
+	flyClient := newTestFlyClient(server)
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	ctx := context.Background()
+	if err := flyClient.EnsureApp(ctx, "fly-tunnel-default-web-personal", "personal"); err != nil {
+		t.Fatal(err)
+	}
+	leftMachine, err := flyClient.CreateMachine(ctx, "fly-tunnel-default-web-personal", flyio.CreateMachineInput{Name: "frp-default-web", Region: "syd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leftIP, err := flyClient.AllocateDedicatedIPv4(ctx, "fly-tunnel-default-web-personal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(flyClient, kubeClient, newTestConfig())
+	result, err := mgr.Provision(ctx, svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if server.AppCount() != 1 || server.MachineCount() != 1 || server.IPCount() != 1 {
+		t.Errorf("expected no duplicates, got %d apps, %d machines and %d IPs", server.AppCount(), server.MachineCount(), server.IPCount())
+	}
+	if result.FlyApp != "fly-tunnel-default-web-personal" || result.MachineID != leftMachine.ID || result.IPID != leftIP.ID || result.PublicIP != leftIP.Address {
+		t.Errorf("expected the existing resources to be adopted, got %+v", result)
+	}
+	if got := server.GetMachines()[leftMachine.ID].Config.Image; got != newTestConfig().FrpsImage {
+		t.Errorf("expected the adopted Machine to be updated to run frps, got image %q", got)
+	}
+}
+
 func TestProvision_MultipleServices(t *testing.T) {
 	server := fakefly.NewServer()
 	defer server.Close()
 
 	scheme := newTestScheme()
-	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
 
 	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
 
@@ -210,7 +315,7 @@ func TestTeardown(t *testing.T) {
 	defer server.Close()
 
 	scheme := newTestScheme()
-	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
 
 	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
 
@@ -271,14 +376,14 @@ func TestTeardown(t *testing.T) {
 		t.Error("expected frpc Deployment to be deleted")
 	}
 
-	// Verify frpc ConfigMap was deleted.
-	var cm corev1.ConfigMap
+	// Verify frpc config Secret was deleted.
+	var secret corev1.Secret
 	err = kubeClient.Get(context.Background(), types.NamespacedName{
 		Name:      result.FrpcDeployment + "-config",
 		Namespace: testNamespace,
-	}, &cm)
+	}, &secret)
 	if err == nil {
-		t.Error("expected frpc ConfigMap to be deleted")
+		t.Error("expected frpc config Secret to be deleted")
 	}
 }
 
@@ -287,7 +392,7 @@ func TestUpdate(t *testing.T) {
 	defer server.Close()
 
 	scheme := newTestScheme()
-	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
 
 	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
 
@@ -313,22 +418,22 @@ func TestUpdate(t *testing.T) {
 	)
 	svc.Annotations[tunnel.AnnotationFrpcMemoryLimit] = "256Mi"
 
-	err = mgr.Update(context.Background(), svc)
+	_, err = mgr.Update(context.Background(), svc)
 	if err != nil {
 		t.Fatalf("Update failed: %v", err)
 	}
 
-	// Verify ConfigMap was updated.
-	var cm corev1.ConfigMap
+	// Verify the config Secret was updated.
+	var secret corev1.Secret
 	err = kubeClient.Get(context.Background(), types.NamespacedName{
 		Name:      result.FrpcDeployment + "-config",
 		Namespace: testNamespace,
-	}, &cm)
+	}, &secret)
 	if err != nil {
-		t.Fatalf("expected ConfigMap to exist: %v", err)
+		t.Fatalf("expected config Secret to exist: %v", err)
 	}
 
-	config := cm.Data["frpc.toml"]
+	config := string(secret.Data["frpc.toml"])
 	if !containsString(config, "remotePort = 443") {
 		t.Error("expected updated config to contain port 443")
 	}
@@ -360,7 +465,7 @@ func TestTeardown_MissingAnnotations(t *testing.T) {
 	defer server.Close()
 
 	scheme := newTestScheme()
-	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
 
 	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
 
@@ -401,14 +506,14 @@ func TestTeardown_MissingAnnotations(t *testing.T) {
 		t.Error("expected frpc Deployment to be deleted")
 	}
 
-	// frpc ConfigMap should still be deleted via the deterministic name fallback.
-	var cm corev1.ConfigMap
+	// frpc config Secret should still be deleted via the deterministic name fallback.
+	var secret corev1.Secret
 	err = kubeClient.Get(context.Background(), types.NamespacedName{
 		Name:      result.FrpcDeployment + "-config",
 		Namespace: testNamespace,
-	}, &cm)
+	}, &secret)
 	if err == nil {
-		t.Error("expected frpc ConfigMap to be deleted")
+		t.Error("expected frpc config Secret to be deleted")
 	}
 }
 
@@ -423,7 +528,7 @@ func TestProvision_RegionOverride(t *testing.T) {
 	}
 
 	scheme := newTestScheme()
-	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
 
 	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
 
@@ -442,12 +547,198 @@ func TestProvision_RegionOverride(t *testing.T) {
 	}
 }
 
+func TestProvision_RegionAuto(t *testing.T) {
+	tests := []struct {
+		name     string
+		location tunnel.ClusterLocation
+		want     string
+	}{
+		{name: "cluster coordinates", location: tunnel.ClusterLocation{Coordinates: &tunnel.Coordinates{Latitude: 41.88, Longitude: -87.63}}, want: "ord"},
+		{name: "cluster region", location: tunnel.ClusterLocation{Region: "syd"}, want: "syd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			var capturedRegion string
+			server.OnCreateMachine = func(appName string, input flyio.CreateMachineInput) error {
+				capturedRegion = input.Region
+				return nil
+			}
+
+			svc := testService("test", "default",
+				corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			)
+			svc.Annotations[tunnel.AnnotationFlyRegion] = tunnel.RegionAuto
+
+			scheme := newTestScheme()
+			kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace(), svc.DeepCopy()).Build()
+
+			config := newTestConfig()
+			config.ClusterLocation = tt.location
+			mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+			if _, err := mgr.Provision(context.Background(), svc); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+			if capturedRegion != tt.want {
+				t.Errorf("expected region %q, got %q", tt.want, capturedRegion)
+			}
+
+			var stored corev1.Service
+			if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), &stored); err != nil {
+				t.Fatal(err)
+			}
+			if got := stored.Annotations[tunnel.AnnotationFlyRegion]; got != tt.want {
+				t.Errorf("expected the resolved region %q recorded on the Service, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProvision_RegionAutoWithoutClusterLocation(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	svc := testService("test", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[tunnel.AnnotationFlyRegion] = tunnel.RegionAuto
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace(), svc.DeepCopy()).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	_, err := mgr.Provision(context.Background(), svc)
+	if !errors.Is(err, tunnel.ErrPermanent) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected no Fly app to be created, got %d", server.AppCount())
+	}
+}
+
+func TestProvision_ClassDefaults(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	var captured []flyio.CreateMachineInput
+	server.OnCreateMachine = func(appName string, input flyio.CreateMachineInput) error {
+		captured = append(captured, input)
+		return nil
+	}
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+
+	config := newTestConfig()
+	config.ClassDefaults = map[string]tunnel.ClassDefaults{
+		"example.com/premium": {FlyRegion: "ord", FlyMachineSize: "performance-1x"},
+	}
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	premiumClass := "example.com/premium"
+	premium := testService("premium", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	premium.Spec.LoadBalancerClass = &premiumClass
+	overridden := testService("overridden", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	overridden.Spec.LoadBalancerClass = &premiumClass
+	overridden.Annotations[tunnel.AnnotationFlyRegion] = "iad"
+	plain := testService("plain", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+
+	for _, svc := range []*corev1.Service{premium, overridden, plain} {
+		if _, err := mgr.Provision(context.Background(), svc); err != nil {
+			t.Fatalf("Provision of %s failed: %v", svc.Name, err)
+		}
+	}
+	if len(captured) != 3 {
+		t.Fatalf("expected 3 Machines, got %d", len(captured))
+	}
+	for i, want := range []struct {
+		region  string
+		cpuKind string
+	}{
+		{"ord", "performance"},
+		{"iad", "performance"},
+		{"syd", "shared"},
+	} {
+		if got := captured[i]; got.Region != want.region || got.Config.Guest.CPUKind != want.cpuKind {
+			t.Errorf("Machine %d: expected %s on %s CPUs, got %s on %s", i, want.region, want.cpuKind, got.Region, got.Config.Guest.CPUKind)
+		}
+	}
+}
+
+func TestProvision_SkipsUnsupportedProtocols(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("test", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+		corev1.ServicePort{Name: "sip", Port: 5060, Protocol: corev1.ProtocolSCTP},
+	)
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	exposed := make(map[string]bool)
+	for _, s := range server.GetMachines()[result.MachineID].Config.Services {
+		exposed[fmt.Sprintf("%d/%s", s.InternalPort, s.Protocol)] = true
+	}
+	if !exposed["80/tcp"] || !exposed["53/udp"] {
+		t.Errorf("expected the TCP and UDP ports on the Machine, got %v", exposed)
+	}
+	for key := range exposed {
+		if strings.HasPrefix(key, "5060/") {
+			t.Errorf("expected no Machine service for the SCTP port, got %s", key)
+		}
+	}
+
+	c, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+	if err != nil {
+		t.Fatalf("parsing frpc config: %v", err)
+	}
+	if len(c.Proxies) != 2 {
+		t.Errorf("expected 2 proxies, got %+v", c.Proxies)
+	}
+}
+
+func TestProvision_OnlyUnsupportedProtocols(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("test", "default",
+		corev1.ServicePort{Name: "sip", Port: 5060, Protocol: corev1.ProtocolSCTP},
+	)
+
+	_, err := mgr.Provision(context.Background(), svc)
+	if !errors.Is(err, tunnel.ErrPermanent) || !strings.Contains(err.Error(), "publish nothing") {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected no Fly app to be created, got %d", server.AppCount())
+	}
+}
+
 func TestProvision_DefaultFrpcResources(t *testing.T) {
 	server := fakefly.NewServer()
 	defer server.Close()
 
 	scheme := newTestScheme()
-	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
 
 	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
 
@@ -493,7 +784,7 @@ func TestProvision_FrpcResourceAnnotationOverrides(t *testing.T) {
 	defer server.Close()
 
 	scheme := newTestScheme()
-	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
 
 	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
 
@@ -539,34 +830,1790 @@ func TestProvision_FrpcResourceAnnotationOverrides(t *testing.T) {
 	}
 }
 
-func TestProvision_InvalidResourceAnnotation(t *testing.T) {
+func TestProvision_PropagatesServiceMetadata(t *testing.T) {
 	server := fakefly.NewServer()
 	defer server.Close()
 
 	scheme := newTestScheme()
-	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+	config := newTestConfig()
+	config.PropagatePrefixes = []string{"team", "example.com/", "app.kubernetes.io/"}
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	svc := testService("test", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Labels = map[string]string{"team": "payments", "app": "web", "app.kubernetes.io/name": "web"}
+	svc.Annotations["example.com/cost-center"] = "42"
+	svc.Annotations[tunnel.AnnotationFrpcCPURequest] = "50m"
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{
+		Name:      result.FrpcDeployment,
+		Namespace: testNamespace,
+	}, &deploy); err != nil {
+		t.Fatalf("expected frpc Deployment to exist: %v", err)
+	}
+	var secret corev1.Secret
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{
+		Name:      deploy.Spec.Template.Spec.Volumes[0].Secret.SecretName,
+		Namespace: testNamespace,
+	}, &secret); err != nil {
+		t.Fatalf("expected frpc config Secret to exist: %v", err)
+	}
+
+	for name, meta := range map[string]metav1.ObjectMeta{
+		"deployment": deploy.ObjectMeta,
+		"pod":        deploy.Spec.Template.ObjectMeta,
+		"secret":     secret.ObjectMeta,
+	} {
+		if got := meta.Labels["team"]; got != "payments" {
+			t.Errorf("%s: expected label team=payments, got %q", name, got)
+		}
+		if _, ok := meta.Labels["app"]; ok {
+			t.Errorf("%s: expected label app not to be propagated", name)
+		}
+		if got := meta.Labels["app.kubernetes.io/name"]; got != "frpc" {
+			t.Errorf("%s: expected the operator's app.kubernetes.io/name label to win, got %q", name, got)
+		}
+		if got := meta.Annotations["example.com/cost-center"]; got != "42" {
+			t.Errorf("%s: expected annotation example.com/cost-center=42, got %q", name, got)
+		}
+		if _, ok := meta.Annotations[tunnel.AnnotationFrpcCPURequest]; ok {
+			t.Errorf("%s: expected operator annotations not to be propagated", name)
+		}
+	}
+}
+
+func TestUpdate_OrdersFrpsAndFrpcByPortChange(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	// provisionForRotation records frps and frpc writes after Provision.
+	mgr, _, svc, calls := provisionForRotation(t, server)
+	update := func() []string {
+		t.Helper()
+		*calls = nil
+		if _, err := mgr.Update(context.Background(), svc); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		return *calls
+	}
+
+	// frps serves the new port before frpc registers it.
+	svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP})
+	want := []string{"frps-secret", "update-machine", "wait-started", "frpc-secret"}
+	if got := update(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("adding a port: expected %v, got %v", want, got)
+	}
+
+	// frpc stops using the removed port before frps does.
+	svc.Spec.Ports = svc.Spec.Ports[:1]
+	want = []string{"frpc-secret", "frps-secret", "update-machine"}
+	if got := update(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("removing a port: expected %v, got %v", want, got)
+	}
+
+	// Changes to frpc alone leave the Machine alone.
+	svc.Annotations[frp.AnnotationCompression] = "true"
+	want = []string{"frpc-secret"}
+	if got := update(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("changing a proxy option: expected %v, got %v", want, got)
+	}
+}
+
+func TestUpdate_SkipsUpToDateMachine(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	updates := 0
+	server.OnUpdateMachine = func(string, string, flyio.CreateMachineInput) error {
+		updates++
+		return nil
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+
+	// Neither an unchanged Service nor an frpc-only change touch the Machine.
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	svc.Annotations[tunnel.AnnotationFrpcMemoryLimit] = "512Mi"
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if updates != 0 {
+		t.Errorf("expected no Machine updates while the ports are unchanged, got %d", updates)
+	}
+
+	svc.Spec.Ports[0].Port = 8080
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if updates != 1 {
+		t.Errorf("expected a port change to update the Machine once, got %d", updates)
+	}
+}
+
+func TestUpdate_ReappliesFrpcResources(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
 
 	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
 
 	svc := testService("test", "default",
 		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
 	)
-	svc.Annotations[tunnel.AnnotationFrpcMemoryLimit] = "not-a-quantity"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
 
-	_, err := mgr.Provision(context.Background(), svc)
-	if err == nil {
-		t.Fatal("expected Provision to fail with invalid resource annotation")
+	svc.Annotations[tunnel.AnnotationFrpcMemoryLimit] = "512Mi"
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
 	}
-	if !containsString(err.Error(), tunnel.AnnotationFrpcMemoryLimit) {
-		t.Errorf("expected error to mention annotation %q, got: %v", tunnel.AnnotationFrpcMemoryLimit, err)
+
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{
+		Name:      result.FrpcDeployment,
+		Namespace: testNamespace,
+	}, &deploy); err != nil {
+		t.Fatalf("expected frpc Deployment to exist: %v", err)
+	}
+	want := resource.MustParse("512Mi")
+	if got := deploy.Spec.Template.Spec.Containers[0].Resources.Limits.Memory(); !got.Equal(want) {
+		t.Errorf("memory limit after Update: want %v, got %v", &want, got)
+	}
+
+	svc.Annotations[tunnel.AnnotationFrpcMemoryLimit] = "lots"
+	if _, err := mgr.Update(context.Background(), svc); err == nil || !strings.Contains(err.Error(), tunnel.AnnotationFrpcMemoryLimit) {
+		t.Errorf("expected Update to reject the invalid annotation, got %v", err)
 	}
 }
 
-func containsString(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
-		}
+func TestUpdate_ReportsChanges(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("test", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating Service: %v", err)
+	}
+
+	changed, err := mgr.Update(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if changed {
+		t.Error("expected Update of a freshly provisioned tunnel to change nothing")
+	}
+
+	svc.Spec.Ports[0].Port = 8080
+	changed, err = mgr.Update(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if !changed {
+		t.Error("expected Update to report the port change")
+	}
+
+	changed, err = mgr.Update(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if changed {
+		t.Error("expected a repeated Update to change nothing")
+	}
+}
+
+func TestProvision_InvalidResourceAnnotation(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("test", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[tunnel.AnnotationFrpcMemoryLimit] = "not-a-quantity"
+
+	_, err := mgr.Provision(context.Background(), svc)
+	if err == nil {
+		t.Fatal("expected Provision to fail with invalid resource annotation")
+	}
+	if !containsString(err.Error(), tunnel.AnnotationFrpcMemoryLimit) {
+		t.Errorf("expected error to mention annotation %q, got: %v", tunnel.AnnotationFrpcMemoryLimit, err)
+	}
+}
+
+func TestProvision_InvalidProxyTransportAnnotation(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("test", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	annotation := frp.PortAnnotation("http", frp.AnnotationCompression)
+	svc.Annotations[annotation] = "on"
+
+	_, err := mgr.Provision(context.Background(), svc)
+	if err == nil {
+		t.Fatal("expected Provision to fail with invalid compression annotation")
+	}
+	if !containsString(err.Error(), annotation) {
+		t.Errorf("expected error to mention annotation %q, got: %v", annotation, err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected no fly.io resources to be created, got %d apps", server.AppCount())
+	}
+}
+
+func TestProvision_InvalidMachineStartTimeoutAnnotation(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	for _, value := range []string{"120", "soon", "-1m"} {
+		svc := testService("test", "default",
+			corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		)
+		svc.Annotations[tunnel.AnnotationMachineStartTimeout] = value
+
+		_, err := mgr.Provision(context.Background(), svc)
+		if err == nil {
+			t.Fatalf("expected Provision to fail with machine start timeout %q", value)
+		}
+		if !containsString(err.Error(), tunnel.AnnotationMachineStartTimeout) || !containsString(err.Error(), "duration") {
+			t.Errorf("expected error to name the annotation and expected format, got: %v", err)
+		}
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected no fly.io resources to be created, got %d apps", server.AppCount())
+	}
+}
+
+func TestProvision_OperatorNamespaceNotReady(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	// Fresh install: the operator namespace doesn't exist yet.
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("test", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+
+	_, err := mgr.Provision(context.Background(), svc)
+	if !errors.Is(err, tunnel.ErrOperatorNamespaceNotReady) {
+		t.Fatalf("expected ErrOperatorNamespaceNotReady, got: %v", err)
+	}
+
+	// Nothing should have been created on fly.io.
+	if server.AppCount() != 0 {
+		t.Errorf("expected 0 apps while namespace is missing, got %d", server.AppCount())
+	}
+	if server.MachineCount() != 0 {
+		t.Errorf("expected 0 machines while namespace is missing, got %d", server.MachineCount())
+	}
+
+	// Once the namespace is created, provisioning succeeds.
+	if err := kubeClient.Create(context.Background(), testOperatorNamespace()); err != nil {
+		t.Fatalf("creating namespace: %v", err)
+	}
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed after namespace was created: %v", err)
+	}
+	if result.PublicIP == "" {
+		t.Error("expected public IP")
+	}
+	if server.AppCount() != 1 {
+		t.Errorf("expected 1 app, got %d", server.AppCount())
+	}
+
+	// Deleting the namespace again is noticed rather than cached away.
+	if err := kubeClient.Delete(context.Background(), testOperatorNamespace()); err != nil {
+		t.Fatalf("deleting namespace: %v", err)
+	}
+	other := testService("other", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	if _, err := mgr.Provision(context.Background(), other); !errors.Is(err, tunnel.ErrOperatorNamespaceNotReady) {
+		t.Fatalf("expected ErrOperatorNamespaceNotReady after the namespace was deleted, got: %v", err)
+	}
+}
+
+// stubRemotePortReader returns canned frps-assigned ports.
+type stubRemotePortReader map[string]int
+
+func (s stubRemotePortReader) RemotePorts(context.Context, string, string) (map[string]int, error) {
+	return s, nil
+}
+
+func TestRandomRemotePorts_ReadbackExposesAssignedPorts(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig()).
+		WithRemotePortReader(stubRemotePortReader{"game-game": 31234, "game-voice": 31235})
+
+	svc := testService("game", "default",
+		corev1.ServicePort{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "voice", Port: 9987, Protocol: corev1.ProtocolUDP},
+	)
+	svc.Annotations[frp.AnnotationRandomRemotePorts] = "true"
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	// Before readback only the frps control port is exposed.
+	machine := server.GetMachines()[result.MachineID]
+	if len(machine.Config.Services) != 1 {
+		t.Errorf("expected only the control port before readback, got %+v", machine.Config.Services)
+	}
+
+	svc.Annotations[tunnel.AnnotationFlyApp] = result.FlyApp
+	svc.Annotations[tunnel.AnnotationMachineID] = result.MachineID
+	svc.Annotations[tunnel.AnnotationFrpcDeployment] = result.FrpcDeployment
+	svc.Annotations[tunnel.AnnotationIPID] = result.IPID
+	svc.Annotations[tunnel.AnnotationPublicIP] = result.PublicIP
+
+	assigned, err := mgr.ReadRemotePorts(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("ReadRemotePorts failed: %v", err)
+	}
+	if assigned != "25565/tcp=31234,9987/udp=31235" {
+		t.Errorf("unexpected assigned ports annotation: %q", assigned)
+	}
+
+	svc.Annotations[tunnel.AnnotationAssignedRemotePorts] = assigned
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	machine = server.GetMachines()[result.MachineID]
+	exposed := make(map[int]bool)
+	for _, ms := range machine.Config.Services {
+		exposed[ms.InternalPort] = true
+	}
+	for _, port := range []int{frp.DefaultServerPort, 31234, 31235} {
+		if !exposed[port] {
+			t.Errorf("expected port %d to be exposed on the machine, got %+v", port, machine.Config.Services)
+		}
+	}
+	if exposed[25565] {
+		t.Error("expected the Service port itself not to be exposed when remote ports are random")
+	}
+}
+
+func TestRandomRemotePorts_AdminAPIRequiresPassword(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("game", "default",
+		corev1.ServicePort{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[frp.AnnotationRandomRemotePorts] = "true"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+
+	adminAPI := func() (frp.WebServer, string) {
+		t.Helper()
+		var secret corev1.Secret
+		if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment + "-config", Namespace: testNamespace}, &secret); err != nil {
+			t.Fatalf("getting frpc config Secret: %v", err)
+		}
+		config, err := frp.ParseClientConfig(string(secret.Data["frpc.toml"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.WebServer == nil {
+			t.Fatal("expected the frpc admin API to be enabled")
+		}
+		return *config.WebServer, string(secret.Data["admin-password"])
+	}
+
+	webServer, password := adminAPI()
+	if password == "" {
+		t.Fatal("expected an admin password in the frpc config Secret")
+	}
+	if webServer.User != frp.AdminUser || webServer.Password != password {
+		t.Errorf("expected the admin API to require the stored password, got %+v", webServer)
+	}
+
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, again := adminAPI(); again != password {
+		t.Error("expected Update to keep the admin password")
+	}
+}
+
+func containsString(s, substr string) bool {
+	for i := 0; i <= len(s)-len(substr); i++ {
+		if s[i:i+len(substr)] == substr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTeardown_NoStateLeavesUnownedApp(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	flyClient := newTestFlyClient(server)
+	mgr := tunnel.NewManager(flyClient, kubeClient, newTestConfig())
+
+	// An app with the conventional name exists, but nothing in this cluster
+	// says we created it (e.g. another cluster sharing the Fly org).
+	if err := flyClient.EnsureApp(context.Background(), "fly-tunnel-default-web-personal", "personal"); err != nil {
+		t.Fatalf("EnsureApp failed: %v", err)
+	}
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+
+	if !server.HasApp("fly-tunnel-default-web-personal") {
+		t.Error("expected an app without ownership evidence to be left alone")
+	}
+}
+
+func TestProvision_UDPPortMachineService(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	var captured []flyio.MachineService
+	server.OnCreateMachine = func(appName string, input flyio.CreateMachineInput) error {
+		captured = input.Config.Services
+		return nil
+	}
+	server.OnUpdateMachine = func(appName, machineID string, input flyio.CreateMachineInput) error {
+		captured = input.Config.Services
+		return nil
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("coredns", "kube-system",
+		corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	// frps control port (always tcp) + udp/53.
+	if len(captured) != 2 {
+		t.Fatalf("expected 2 machine services, got %+v", captured)
+	}
+	if captured[0].Protocol != "tcp" || captured[0].InternalPort != frp.DefaultServerPort {
+		t.Errorf("expected the frps control port over tcp, got %+v", captured[0])
+	}
+	if captured[1].Protocol != "udp" || captured[1].InternalPort != 53 {
+		t.Errorf("expected udp/53, got %+v", captured[1])
+	}
+
+	// Update keeps the mapping when a TCP port is added next to it.
+	annotateTunnelState(svc, result)
+	svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: "dns-tcp", Port: 53, Protocol: corev1.ProtocolTCP})
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if len(captured) != 3 || captured[1].Protocol != "udp" || captured[2].Protocol != "tcp" {
+		t.Errorf("expected udp/53 and tcp/53 after Update, got %+v", captured)
+	}
+}
+
+func TestProvision_ProxyProtocolAddsNoFlyHandlers(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	var captured []flyio.MachineService
+	server.OnCreateMachine = func(appName string, input flyio.CreateMachineInput) error {
+		captured = input.Config.Services
+		return nil
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	svc.Annotations[frp.AnnotationProxyProtocol] = frp.ProxyProtocolV2
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	// frpc sends the header; the Fly.io proxy must not add a second one.
+	if config := frpcConfig(t, kubeClient, result.FrpcDeployment); !strings.Contains(config, `proxyProtocolVersion = "v2"`) {
+		t.Errorf("expected frpc to send a v2 PROXY header, got:\n%s", config)
+	}
+	for _, service := range captured {
+		for _, port := range service.Ports {
+			if len(port.Handlers) != 0 {
+				t.Errorf("expected no Fly.io handlers, got %v on port %d", port.Handlers, port.Port)
+			}
+		}
+	}
+}
+
+func TestProvision_DualStackPorts(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	var captured []flyio.MachineService
+	server.OnCreateMachine = func(appName string, input flyio.CreateMachineInput) error {
+		captured = input.Config.Services
+		return nil
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("minecraft", "games",
+		corev1.ServicePort{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[frp.AnnotationDualStackPorts] = "25565"
+
+	if _, err := mgr.Provision(context.Background(), svc); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	// frps control port + tcp and udp for 25565.
+	if len(captured) != 3 {
+		t.Fatalf("expected 3 machine services, got %+v", captured)
+	}
+	if captured[1].Protocol != "tcp" || captured[1].InternalPort != 25565 {
+		t.Errorf("expected tcp/25565, got %+v", captured[1])
+	}
+	if captured[2].Protocol != "udp" || captured[2].InternalPort != 25565 {
+		t.Errorf("expected udp/25565, got %+v", captured[2])
+	}
+}
+
+func TestProvision_DualStackPortsRejectsUnknownPort(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("minecraft", "games",
+		corev1.ServicePort{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[frp.AnnotationDualStackPorts] = "19132"
+
+	if _, err := mgr.Provision(context.Background(), svc); err == nil {
+		t.Fatal("expected Provision to reject a dual-stack port missing from the Service")
+	}
+	if server.AppCount() != 0 || server.MachineCount() != 0 {
+		t.Errorf("expected no fly.io resources, got %d apps and %d machines", server.AppCount(), server.MachineCount())
+	}
+}
+
+func TestUpdate_ReplacesMachineWhenUpdateRejected(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	recorder := record.NewFakeRecorder(10)
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig()).
+		WithEventRecorder(recorder)
+
+	svc := testService("game", "default",
+		corev1.ServicePort{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	svc.Annotations[tunnel.AnnotationFlyApp] = result.FlyApp
+	svc.Annotations[tunnel.AnnotationMachineID] = result.MachineID
+	svc.Annotations[tunnel.AnnotationFrpcDeployment] = result.FrpcDeployment
+	svc.Annotations[tunnel.AnnotationIPID] = result.IPID
+	svc.Annotations[tunnel.AnnotationPublicIP] = result.PublicIP
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating Service: %v", err)
+	}
+
+	server.OnUpdateMachine = func(appName, machineID string, input flyio.CreateMachineInput) error {
+		return &fakefly.StatusError{Code: http.StatusUnprocessableEntity, Message: "cannot change cpu kind in place"}
+	}
+
+	svc.Annotations[tunnel.AnnotationFlyMachineSize] = "performance-1x"
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	machines := server.GetMachines()
+	if len(machines) != 1 {
+		t.Fatalf("expected exactly 1 machine after replacement, got %d", len(machines))
+	}
+	if _, ok := machines[result.MachineID]; ok {
+		t.Error("expected the old machine to be deleted")
+	}
+
+	var updated corev1.Service
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: "game", Namespace: "default"}, &updated); err != nil {
+		t.Fatalf("getting Service: %v", err)
+	}
+	newID := updated.Annotations[tunnel.AnnotationMachineID]
+	replacement, ok := machines[newID]
+	if !ok {
+		t.Fatalf("machine-id annotation %q does not point at the replacement machine", newID)
+	}
+	if replacement.Config.Guest.CPUKind != "performance" {
+		t.Errorf("expected replacement to use the new guest, got %+v", replacement.Config.Guest)
+	}
+	if replacement.Region != "syd" {
+		t.Errorf("expected replacement to keep region 'syd', got %q", replacement.Region)
+	}
+	if server.IPCount() != 1 {
+		t.Errorf("expected the dedicated IP to be kept, got %d IPs", server.IPCount())
+	}
+
+	close(recorder.Events)
+	var events []string
+	for e := range recorder.Events {
+		events = append(events, e)
+	}
+	if len(events) != 2 || !strings.Contains(events[0], "ReplacingMachine") || !strings.Contains(events[1], "MachineReplaced") {
+		t.Errorf("expected ReplacingMachine and MachineReplaced events, got %v", events)
+	}
+}
+
+func TestUpdate_RetriesDeletingReplacedMachine(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("game", "default",
+		corev1.ServicePort{Name: "game", Port: 25565, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating Service: %v", err)
+	}
+
+	server.OnUpdateMachine = func(appName, machineID string, input flyio.CreateMachineInput) error {
+		return &fakefly.StatusError{Code: http.StatusUnprocessableEntity, Message: "cannot change cpu kind in place"}
+	}
+	server.OnDeleteMachine = func(appName, machineID string) error {
+		return &fakefly.StatusError{Code: http.StatusInternalServerError, Message: "boom"}
+	}
+
+	svc.Annotations[tunnel.AnnotationFlyMachineSize] = "performance-1x"
+	if _, err := mgr.Update(context.Background(), svc); err == nil {
+		t.Fatal("expected Update to fail while the replaced machine cannot be deleted")
+	}
+	if _, ok := server.GetMachines()[result.MachineID]; !ok {
+		t.Fatal("expected the old machine to survive the failed delete")
+	}
+
+	var updated corev1.Service
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: "game", Namespace: "default"}, &updated); err != nil {
+		t.Fatalf("getting Service: %v", err)
+	}
+	if got := updated.Annotations[tunnel.AnnotationReplacedMachineID]; got != result.MachineID {
+		t.Fatalf("expected the old machine to be recorded for deletion, got %q", got)
+	}
+
+	server.OnDeleteMachine = nil
+	if _, err := mgr.Update(context.Background(), &updated); err != nil {
+		t.Fatalf("second Update failed: %v", err)
+	}
+	machines := server.GetMachines()
+	if _, ok := machines[result.MachineID]; ok {
+		t.Error("expected the second Update to delete the old machine")
+	}
+	if len(machines) != 1 {
+		t.Errorf("expected only the replacement machine to remain, got %d", len(machines))
+	}
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: "game", Namespace: "default"}, &updated); err != nil {
+		t.Fatalf("getting Service: %v", err)
+	}
+	if got, ok := updated.Annotations[tunnel.AnnotationReplacedMachineID]; ok {
+		t.Errorf("expected the replaced machine annotation to be cleared, got %q", got)
+	}
+}
+
+func annotateTunnelState(svc *corev1.Service, result *tunnel.TunnelResult) {
+	svc.Annotations[tunnel.AnnotationFlyApp] = result.FlyApp
+	svc.Annotations[tunnel.AnnotationMachineID] = result.MachineID
+	svc.Annotations[tunnel.AnnotationFrpcDeployment] = result.FrpcDeployment
+	svc.Annotations[tunnel.AnnotationIPID] = result.IPID
+	svc.Annotations[tunnel.AnnotationPublicIP] = result.PublicIP
+	svc.Annotations[tunnel.AnnotationIPOwnership] = result.IPOwnership
+	svc.Annotations[tunnel.AnnotationControlPort] = strconv.Itoa(result.ControlPort)
+	if result.AppOwnership != "" {
+		svc.Annotations[tunnel.AnnotationAppOwnership] = result.AppOwnership
+	}
+	if result.IPv6ID != "" {
+		svc.Annotations[tunnel.AnnotationIPv6ID] = result.IPv6ID
+		svc.Annotations[tunnel.AnnotationPublicIPv6] = result.PublicIPv6
+	}
+}
+
+func TestTeardown_IPOwnership(t *testing.T) {
+	tests := []struct {
+		name        string
+		ownership   string // "" removes the annotation, as on a legacy tunnel
+		wantIPs     int
+		wantApps    int
+		wantRelease bool
+	}{
+		// Deleting the recorded App releases an operator-owned IP with it.
+		{name: "operator", ownership: tunnel.IPOwnershipOperator, wantIPs: 0, wantApps: 0, wantRelease: false},
+		{name: "legacy defaults to operator", ownership: "", wantIPs: 0, wantApps: 0, wantRelease: false},
+		{name: "external", ownership: tunnel.IPOwnershipExternal, wantIPs: 1, wantApps: 1, wantRelease: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			scheme := newTestScheme()
+			kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+			mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+			svc := testService("web", "default",
+				corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			)
+			result, err := mgr.Provision(context.Background(), svc)
+			if err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+			if result.IPOwnership != tunnel.IPOwnershipOperator {
+				t.Fatalf("expected Provision to record operator ownership, got %q", result.IPOwnership)
+			}
+			if result.AppOwnership != tunnel.IPOwnershipOperator {
+				t.Fatalf("expected Provision to record operator app ownership, got %q", result.AppOwnership)
+			}
+			annotateTunnelState(svc, result)
+			if tt.ownership == "" {
+				delete(svc.Annotations, tunnel.AnnotationIPOwnership)
+			} else {
+				svc.Annotations[tunnel.AnnotationIPOwnership] = tt.ownership
+			}
+
+			released := false
+			server.OnReleaseIP = func(appName, ipID string) error {
+				released = true
+				return nil
+			}
+
+			if err := mgr.Teardown(context.Background(), svc); err != nil {
+				t.Fatalf("Teardown failed: %v", err)
+			}
+			if released != tt.wantRelease {
+				t.Errorf("IP released = %v, want %v", released, tt.wantRelease)
+			}
+			if server.IPCount() != tt.wantIPs {
+				t.Errorf("expected %d IPs after teardown, got %d", tt.wantIPs, server.IPCount())
+			}
+			if server.AppCount() != tt.wantApps {
+				t.Errorf("expected %d apps after teardown, got %d", tt.wantApps, server.AppCount())
+			}
+			if server.MachineCount() != 0 {
+				t.Errorf("expected the machine to be deleted, got %d machines", server.MachineCount())
+			}
+		})
+	}
+}
+
+func TestExternalApp_Lifecycle(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	flyClient := newTestFlyClient(server)
+	config := newTestConfig()
+	config.ExternalApps = true
+	if err := flyClient.EnsureApp(context.Background(), "byo-tunnel", config.FlyOrg); err != nil {
+		t.Fatalf("creating app: %v", err)
+	}
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(flyClient, kubeClient, config)
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations = map[string]string{tunnel.AnnotationFlyApp: "byo-tunnel"}
+	server.OnCreateApp = func(appName, orgSlug string) error {
+		t.Errorf("unexpected CreateApp(%q)", appName)
+		return nil
+	}
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if result.FlyApp != "byo-tunnel" {
+		t.Errorf("expected the tunnel in byo-tunnel, got %q", result.FlyApp)
+	}
+	if result.AppOwnership != tunnel.IPOwnershipExternal {
+		t.Errorf("expected external app ownership, got %q", result.AppOwnership)
+	}
+	machine := server.GetMachines()[result.MachineID]
+	if machine == nil {
+		t.Fatalf("machine %s not found", result.MachineID)
+	}
+	if got := machine.Config.Metadata[tunnel.MachineMetadataService]; got != "default/web" {
+		t.Errorf("expected machine metadata to name default/web, got %q", got)
+	}
+	annotateTunnelState(svc, result)
+
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if !server.HasApp("byo-tunnel") {
+		t.Error("expected the external app to survive teardown")
+	}
+	if server.MachineCount() != 0 {
+		t.Errorf("expected the machine to be deleted, got %d machines", server.MachineCount())
+	}
+	if server.IPCount() != 0 {
+		t.Errorf("expected the IP to be released, got %d IPs", server.IPCount())
+	}
+}
+
+func TestExternalApp_MissingAppIsPermanent(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	config := newTestConfig()
+	config.ExternalApps = true
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	for name, annotations := range map[string]map[string]string{
+		"missing app":     {tunnel.AnnotationFlyApp: "byo-tunnel"},
+		"no app named":    nil,
+		"tunnel group":    {tunnel.AnnotationFlyApp: "byo-tunnel", tunnel.AnnotationTunnelGroup: "shared"},
+		"stable identity": {tunnel.AnnotationFlyApp: "byo-tunnel", tunnel.AnnotationStableIdentity: "web"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			svc := testService("web", "default",
+				corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			)
+			svc.Annotations = annotations
+			_, err := mgr.Provision(context.Background(), svc)
+			if !errors.Is(err, tunnel.ErrPermanent) {
+				t.Fatalf("expected a permanent error, got %v", err)
+			}
+			if server.AppCount() != 0 || server.MachineCount() != 0 {
+				t.Errorf("expected nothing created, got %d apps and %d machines", server.AppCount(), server.MachineCount())
+			}
+		})
+	}
+}
+
+func TestExternalApp_TeardownLeavesForeignMachine(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	flyClient := newTestFlyClient(server)
+	config := newTestConfig()
+	config.ExternalApps = true
+	ctx := context.Background()
+	if err := flyClient.EnsureApp(ctx, "byo-tunnel", config.FlyOrg); err != nil {
+		t.Fatalf("creating app: %v", err)
+	}
+	foreign, err := flyClient.CreateMachine(ctx, "byo-tunnel", flyio.CreateMachineInput{
+		Name:   "other",
+		Region: "syd",
+		Config: flyio.MachineConfig{Image: "nginx"},
+	})
+	if err != nil {
+		t.Fatalf("creating machine: %v", err)
+	}
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(flyClient, kubeClient, config)
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations = map[string]string{
+		tunnel.AnnotationFlyApp:       "byo-tunnel",
+		tunnel.AnnotationMachineID:    foreign.ID,
+		tunnel.AnnotationAppOwnership: tunnel.IPOwnershipExternal,
+	}
+	if err := mgr.Teardown(ctx, svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if server.MachineCount() != 1 {
+		t.Errorf("expected the unlabelled machine to be left alone, got %d machines", server.MachineCount())
+	}
+	if !server.HasApp("byo-tunnel") {
+		t.Error("expected the external app to survive teardown")
+	}
+}
+
+func TestStableIdentity_RecreatedServiceAdoptsAppAndIP(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("envoy-gw-abc123", "envoy-gateway-system",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[tunnel.AnnotationStableIdentity] = "public-gateway"
+
+	first, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, first)
+
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+
+	// The App and IP are retained; the Machine is not.
+	if !server.HasApp(first.FlyApp) {
+		t.Errorf("expected app %q to be retained", first.FlyApp)
+	}
+	if server.IPCount() != 1 {
+		t.Errorf("expected IP to be retained, got %d IPs", server.IPCount())
+	}
+	if server.MachineCount() != 0 {
+		t.Errorf("expected 0 machines after teardown, got %d", server.MachineCount())
+	}
+
+	// Recreate the Service under a different name with the same identity.
+	recreated := testService("envoy-gw-def456", "envoy-gateway-system",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	recreated.Annotations[tunnel.AnnotationStableIdentity] = "public-gateway"
+
+	second, err := mgr.Provision(context.Background(), recreated)
+	if err != nil {
+		t.Fatalf("Provision of recreated Service failed: %v", err)
+	}
+
+	if second.FlyApp != first.FlyApp {
+		t.Errorf("expected app %q to be adopted, got %q", first.FlyApp, second.FlyApp)
+	}
+	if second.PublicIP != first.PublicIP || second.IPID != first.IPID {
+		t.Errorf("expected IP %s (%s) to be adopted, got %s (%s)", first.PublicIP, first.IPID, second.PublicIP, second.IPID)
+	}
+	if server.AppCount() != 1 || server.IPCount() != 1 {
+		t.Errorf("expected 1 app and 1 IP, got %d apps and %d IPs", server.AppCount(), server.IPCount())
+	}
+	if server.MachineCount() != 1 {
+		t.Errorf("expected a new machine, got %d", server.MachineCount())
+	}
+}
+
+func TestStableIdentity_DifferentNamespaceDoesNotAdopt(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("gateway", "team-a",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[tunnel.AnnotationStableIdentity] = "shared"
+
+	first, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, first)
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+
+	other := testService("gateway", "team-b",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	other.Annotations[tunnel.AnnotationStableIdentity] = "shared"
+
+	second, err := mgr.Provision(context.Background(), other)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if second.FlyApp == first.FlyApp || second.PublicIP == first.PublicIP {
+		t.Errorf("expected a fresh tunnel for another namespace, got app %q and IP %s", second.FlyApp, second.PublicIP)
+	}
+}
+
+func TestStableIdentity_RejectsForeignRecord(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	// A ConfigMap at the identity record's name that this operator did not
+	// write for this namespace and identity.
+	foreign := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fly-tunnel-identity-default-shared",
+			Namespace: testNamespace,
+		},
+		Data: map[string]string{
+			"namespace": "default",
+			"identity":  "shared",
+			"fly-app":   "someone-elses-app",
+			"ip-id":     "ip-foreign",
+		},
+	}
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace(), foreign).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("gateway", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[tunnel.AnnotationStableIdentity] = "shared"
+
+	if _, err := mgr.Provision(context.Background(), svc); err == nil {
+		t.Fatal("expected Provision to refuse an identity record it does not own")
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected no fly.io resources, got %d apps", server.AppCount())
+	}
+}
+
+func TestUpdate_RemovesLegacyRestartAtAnnotation(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	var deployUpdates int
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+				if _, ok := obj.(*appsv1.Deployment); ok {
+					deployUpdates++
+				}
+				return c.Update(ctx, obj, opts...)
+			},
+		}).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("envoy-gateway", "envoy-gateway-system",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+
+	// Rewind the Deployment to what an older operator version left behind:
+	// a restart-at timestamp and no config-hash.
+	key := types.NamespacedName{Name: result.FrpcDeployment, Namespace: testNamespace}
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), key, &deploy); err != nil {
+		t.Fatalf("getting Deployment: %v", err)
+	}
+	deploy.Spec.Template.Annotations = map[string]string{
+		"fly-tunnel-operator.dev/restart-at": "2024-01-01T00:00:00Z",
+	}
+	if err := kubeClient.Update(context.Background(), &deploy); err != nil {
+		t.Fatalf("seeding legacy Deployment: %v", err)
+	}
+	deployUpdates = 0
+
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	if err := kubeClient.Get(context.Background(), key, &deploy); err != nil {
+		t.Fatalf("getting Deployment: %v", err)
+	}
+	annotations := deploy.Spec.Template.Annotations
+	if _, ok := annotations["fly-tunnel-operator.dev/restart-at"]; ok {
+		t.Error("expected legacy restart-at annotation to be removed")
+	}
+	if annotations["fly-tunnel-operator.dev/config-hash"] == "" {
+		t.Error("expected config-hash annotation to be set")
+	}
+	if deployUpdates != 1 {
+		t.Errorf("expected the migration in a single Deployment write, got %d", deployUpdates)
+	}
+}
+
+func TestUpdate_KeepsEquivalentFrpcConfig(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	var secretUpdates, deployUpdates int
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+				switch obj.(type) {
+				case *corev1.Secret:
+					secretUpdates++
+				case *appsv1.Deployment:
+					deployUpdates++
+				}
+				return c.Update(ctx, obj, opts...)
+			},
+		}).Build()
+
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if secretUpdates != 0 || deployUpdates != 0 {
+		t.Errorf("expected an unchanged Service to write nothing, got %d Secret and %d Deployment updates", secretUpdates, deployUpdates)
+	}
+
+	// Reorder the deployed proxies, as an older operator version might
+	// have rendered them.
+	secretKey := types.NamespacedName{Name: result.FrpcDeployment + "-config", Namespace: testNamespace}
+	var secret corev1.Secret
+	if err := kubeClient.Get(context.Background(), secretKey, &secret); err != nil {
+		t.Fatalf("getting frpc config Secret: %v", err)
+	}
+	deployed, err := frp.ParseClientConfig(string(secret.Data["frpc.toml"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployed.Proxies[0], deployed.Proxies[1] = deployed.Proxies[1], deployed.Proxies[0]
+	reordered := deployed.TOML()
+	secret.Data["frpc.toml"] = []byte(reordered)
+	if err := kubeClient.Update(context.Background(), &secret); err != nil {
+		t.Fatalf("seeding reordered config: %v", err)
+	}
+	deployKey := types.NamespacedName{Name: result.FrpcDeployment, Namespace: testNamespace}
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), deployKey, &deploy); err != nil {
+		t.Fatalf("getting Deployment: %v", err)
+	}
+	hash := deploy.Spec.Template.Annotations["fly-tunnel-operator.dev/config-hash"]
+	secretUpdates, deployUpdates = 0, 0
+
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if secretUpdates != 0 || deployUpdates != 0 {
+		t.Errorf("expected a reordered config to be kept, got %d Secret and %d Deployment updates", secretUpdates, deployUpdates)
+	}
+
+	// A genuine port change rewrites the config and rolls frpc.
+	svc.Spec.Ports[1].Port = 8443
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), secretKey, &secret); err != nil {
+		t.Fatalf("getting frpc config Secret: %v", err)
+	}
+	if string(secret.Data["frpc.toml"]) == reordered {
+		t.Error("expected the port change to rewrite the frpc config")
+	}
+	if err := kubeClient.Get(context.Background(), deployKey, &deploy); err != nil {
+		t.Fatalf("getting Deployment: %v", err)
+	}
+	if deploy.Spec.Template.Annotations["fly-tunnel-operator.dev/config-hash"] == hash {
+		t.Error("expected the port change to roll the frpc Deployment")
+	}
+}
+
+func TestOperatorNamespaceChange_UpdateAndTeardownUseRecordedNamespace(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	nsB := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tunnels-b"}}
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace(), nsB).Build()
+
+	mgrA := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("envoy-gateway", "envoy-gateway-system",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgrA.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if result.FrpcNamespace != testNamespace {
+		t.Errorf("expected frpc namespace %q, got %q", testNamespace, result.FrpcNamespace)
+	}
+	annotateTunnelState(svc, result)
+	svc.Annotations[tunnel.AnnotationFrpcNamespace] = result.FrpcNamespace
+
+	// Restart the operator with a different --namespace.
+	configB := newTestConfig()
+	configB.OperatorNamespace = nsB.Name
+	mgrB := tunnel.NewManager(newTestFlyClient(server), kubeClient, configB)
+
+	svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP})
+	if _, err := mgrB.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: result.FrpcDeployment + "-config", Namespace: testNamespace}
+	if err := kubeClient.Get(context.Background(), key, &secret); err != nil {
+		t.Fatalf("expected config Secret in the original namespace: %v", err)
+	}
+	if !strings.Contains(string(secret.Data["frpc.toml"]), "remotePort = 443") {
+		t.Error("expected the config Secret in the original namespace to be updated")
+	}
+	var deploys appsv1.DeploymentList
+	if err := kubeClient.List(context.Background(), &deploys); err != nil {
+		t.Fatalf("listing Deployments: %v", err)
+	}
+	if len(deploys.Items) != 1 || deploys.Items[0].Namespace != testNamespace {
+		t.Errorf("expected only the original frpc Deployment, got %d", len(deploys.Items))
+	}
+
+	if err := mgrB.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), key, &secret); err == nil {
+		t.Error("expected frpc config Secret in the original namespace to be deleted")
+	}
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment, Namespace: testNamespace}, &deploy); err == nil {
+		t.Error("expected frpc Deployment in the original namespace to be deleted")
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected 0 apps after teardown, got %d", server.AppCount())
+	}
+}
+
+func TestOperatorNamespaceChange_MigratesFrpc(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	nsB := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tunnels-b"}}
+	scheme := newTestScheme()
+	// frpc becomes available as soon as it is created.
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace(), nsB).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+				if err := c.Create(ctx, obj, opts...); err != nil {
+					return err
+				}
+				if deploy, ok := obj.(*appsv1.Deployment); ok {
+					deploy.Status.AvailableReplicas = 1
+					return c.Status().Update(ctx, deploy)
+				}
+				return nil
+			},
+		}).Build()
+
+	mgrA := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("envoy-gateway", "envoy-gateway-system",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating Service: %v", err)
+	}
+	result, err := mgrA.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	svc.Annotations[tunnel.AnnotationFrpcNamespace] = result.FrpcNamespace
+	if err := kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("recording tunnel state: %v", err)
+	}
+
+	configB := newTestConfig()
+	configB.OperatorNamespace = nsB.Name
+	recorder := record.NewFakeRecorder(10)
+	mgrB := tunnel.NewManager(newTestFlyClient(server), kubeClient, configB).
+		WithNamespaceMigration(time.Minute).
+		WithEventRecorder(recorder)
+
+	if _, err := mgrB.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment, Namespace: nsB.Name}, &deploy); err != nil {
+		t.Fatalf("expected frpc Deployment in the new namespace: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment, Namespace: testNamespace}, &deploy); err == nil {
+		t.Error("expected frpc Deployment in the old namespace to be deleted")
+	}
+
+	var stored corev1.Service
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), &stored); err != nil {
+		t.Fatalf("getting Service: %v", err)
+	}
+	if got := stored.Annotations[tunnel.AnnotationFrpcNamespace]; got != nsB.Name {
+		t.Errorf("expected recorded frpc namespace %q, got %q", nsB.Name, got)
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, "FrpcMigrated") {
+			t.Errorf("expected FrpcMigrated event, got %q", e)
+		}
+	default:
+		t.Error("expected a FrpcMigrated event")
+	}
+
+	// Teardown now cleans up the new namespace.
+	if err := mgrB.Teardown(context.Background(), &stored); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment, Namespace: nsB.Name}, &deploy); err == nil {
+		t.Error("expected frpc Deployment in the new namespace to be deleted")
+	}
+}
+
+func TestProvision_PermanentFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(server *fakefly.Server, svc *corev1.Service)
+		permanent bool
+	}{
+		{
+			name: "invalid annotation",
+			setup: func(_ *fakefly.Server, svc *corev1.Service) {
+				svc.Annotations[tunnel.AnnotationFrpcMemoryLimit] = "not-a-quantity"
+			},
+			permanent: true,
+		},
+		{
+			name: "machine quota",
+			setup: func(server *fakefly.Server, _ *corev1.Service) {
+				server.OnCreateMachine = func(string, flyio.CreateMachineInput) error {
+					return &fakefly.StatusError{Code: http.StatusPaymentRequired, Message: "payment required"}
+				}
+			},
+			permanent: true,
+		},
+		{
+			name: "IP quota",
+			setup: func(server *fakefly.Server, _ *corev1.Service) {
+				server.OnAllocateIP = func(string) error {
+					return errors.New("You have reached the dedicated IPv4 quota for this organization")
+				}
+			},
+			permanent: true,
+		},
+		{
+			name: "transient API error",
+			setup: func(server *fakefly.Server, _ *corev1.Service) {
+				server.OnCreateMachine = func(string, flyio.CreateMachineInput) error {
+					return errors.New("internal error")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			scheme := newTestScheme()
+			kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+			mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+			svc := testService("test", "default",
+				corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			)
+			tt.setup(server, svc)
+
+			_, err := mgr.Provision(context.Background(), svc)
+			if err == nil {
+				t.Fatal("expected Provision to fail")
+			}
+			if got := errors.Is(err, tunnel.ErrPermanent); got != tt.permanent {
+				t.Errorf("errors.Is(err, ErrPermanent) = %v, want %v (err: %v)", got, tt.permanent, err)
+			}
+		})
+	}
+}
+
+// legacyConfigMapTunnel rewrites the frpc resources of a provisioned tunnel
+// the way operator versions before the config Secret left them: config in a
+// ConfigMap, mounted by the Deployment.
+func legacyConfigMapTunnel(t *testing.T, kubeClient client.Client, svc *corev1.Service, deployName string) {
+	t.Helper()
+	ctx := context.Background()
+	key := types.NamespacedName{Name: deployName + "-config", Namespace: testNamespace}
+
+	var secret corev1.Secret
+	if err := kubeClient.Get(ctx, key, &secret); err != nil {
+		t.Fatalf("getting config Secret: %v", err)
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace, Labels: secret.Labels},
+		Data:       map[string]string{"frpc.toml": string(secret.Data["frpc.toml"])},
+	}
+	if err := kubeClient.Create(ctx, cm); err != nil {
+		t.Fatalf("creating legacy ConfigMap: %v", err)
+	}
+	if err := kubeClient.Delete(ctx, &secret); err != nil {
+		t.Fatalf("deleting config Secret: %v", err)
+	}
+
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(ctx, types.NamespacedName{Name: deployName, Namespace: testNamespace}, &deploy); err != nil {
+		t.Fatalf("getting frpc Deployment: %v", err)
+	}
+	deploy.Spec.Template.Spec.Volumes[0].VolumeSource = corev1.VolumeSource{
+		ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: key.Name}},
+	}
+	if err := kubeClient.Update(ctx, &deploy); err != nil {
+		t.Fatalf("repointing frpc Deployment at the ConfigMap: %v", err)
+	}
+}
+
+func TestUpdate_MigratesLegacyConfigMapToSecret(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	legacyConfigMapTunnel(t, kubeClient, svc, result.FrpcDeployment)
+
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	key := types.NamespacedName{Name: result.FrpcDeployment + "-config", Namespace: testNamespace}
+	var secret corev1.Secret
+	if err := kubeClient.Get(context.Background(), key, &secret); err != nil {
+		t.Fatalf("expected the config Secret to be created: %v", err)
+	}
+	if !strings.Contains(string(secret.Data["frpc.toml"]), "remotePort = 80") {
+		t.Errorf("expected the Secret to hold the frpc config, got %q", secret.Data["frpc.toml"])
+	}
+
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment, Namespace: testNamespace}, &deploy); err != nil {
+		t.Fatalf("getting frpc Deployment: %v", err)
+	}
+	volume := deploy.Spec.Template.Spec.Volumes[0]
+	if volume.Secret == nil || volume.Secret.SecretName != key.Name || volume.ConfigMap != nil {
+		t.Errorf("expected the frpc Deployment to mount Secret %s, got %+v", key.Name, volume.VolumeSource)
+	}
+
+	if err := kubeClient.Get(context.Background(), key, &corev1.ConfigMap{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the legacy ConfigMap to be removed, got %v", err)
+	}
+}
+
+func TestTeardown_DeletesLegacyConfigMap(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	legacyConfigMapTunnel(t, kubeClient, svc, result.FrpcDeployment)
+
+	// Without annotations, the labelled legacy ConfigMap still proves
+	// ownership.
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected the owned app to be deleted, got %d apps", server.AppCount())
+	}
+	key := types.NamespacedName{Name: result.FrpcDeployment + "-config", Namespace: testNamespace}
+	if err := kubeClient.Get(context.Background(), key, &corev1.ConfigMap{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the legacy ConfigMap to be deleted, got %v", err)
+	}
+}
+
+func TestProvision_FrpsConfigDeliveredAsAppSecret(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	// Record the order of secret writes and Machine writes.
+	var calls []string
+	server.OnSetSecrets = func(string, map[string]string) error {
+		calls = append(calls, "secrets")
+		return nil
+	}
+	server.OnCreateMachine = func(string, flyio.CreateMachineInput) error {
+		calls = append(calls, "create")
+		return nil
+	}
+	server.OnUpdateMachine = func(string, string, flyio.CreateMachineInput) error {
+		calls = append(calls, "update")
+		return nil
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	secret := server.AppSecrets(result.FlyApp)["FRP_SERVER_CONFIG"]
+	if frps, err := frp.ParseServerConfig(secret); err != nil || frps.BindPort != frp.DefaultServerPort || frps.Auth == nil || frps.Auth.Token == "" {
+		t.Errorf("expected the authenticated frps config as an app secret, got %q", secret)
+	}
+	machine := server.GetMachines()[result.MachineID]
+	for key, value := range machine.Config.Env {
+		if key == "FRP_SERVER_CONFIG" || strings.Contains(value, "bindPort") {
+			t.Errorf("expected no frps config in the Machine env, got %s=%q", key, value)
+		}
+	}
+	if machine.Config.Env["FRP_SERVER_CONFIG_HASH"] == "" {
+		t.Error("expected the frps config hash in the Machine env")
+	}
+
+	annotateTunnelState(svc, result)
+	svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP})
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	want := []string{"secrets", "create", "secrets", "update"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Errorf("expected the secret to be set before each Machine write, got %v", calls)
+	}
+}
+
+func TestUpdate_ReallocatesReleasedIP(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	flyClient := newTestFlyClient(server)
+	mgr := tunnel.NewManager(flyClient, kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating service: %v", err)
+	}
+
+	// The IP is released behind the operator's back.
+	if err := flyClient.ReleaseIPAddress(context.Background(), result.FlyApp, result.IPID); err != nil {
+		t.Fatalf("releasing IP: %v", err)
+	}
+
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	if server.IPCount() != 1 {
+		t.Fatalf("expected a new IP to be allocated, got %d IPs", server.IPCount())
+	}
+	var recorded corev1.Service
+	if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), &recorded); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	newID, newIP := recorded.Annotations[tunnel.AnnotationIPID], recorded.Annotations[tunnel.AnnotationPublicIP]
+	if newID == result.IPID || newIP == result.PublicIP {
+		t.Fatalf("expected new IP annotations, still %s/%s", newID, newIP)
+	}
+	if ip, ok := server.GetIPs()[newID]; !ok || ip.Address != newIP {
+		t.Errorf("recorded IP %s/%s does not match fakefly", newID, newIP)
+	}
+	if config := frpcConfig(t, kubeClient, result.FrpcDeployment); !strings.Contains(config, newIP) {
+		t.Errorf("expected frpc to connect to the new IP %s, got config:\n%s", newIP, config)
+	}
+
+	// An externally owned IP is not replaced.
+	recorded.Annotations[tunnel.AnnotationIPOwnership] = tunnel.IPOwnershipExternal
+	if err := flyClient.ReleaseIPAddress(context.Background(), result.FlyApp, newID); err != nil {
+		t.Fatalf("releasing IP: %v", err)
+	}
+	if _, err := mgr.Update(context.Background(), &recorded); err == nil {
+		t.Error("expected Update to fail when an external IP is gone")
+	}
+	if server.IPCount() != 0 {
+		t.Errorf("expected no IP to be allocated in place of an external one, got %d", server.IPCount())
+	}
+}
+
+func TestProvisionAndUpdate_SameDesiredMachineConfig(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	var created flyio.MachineConfig
+	updates := 0
+	server.OnCreateMachine = func(_ string, input flyio.CreateMachineInput) error {
+		created = input.Config
+		return nil
+	}
+	server.OnUpdateMachine = func(_, _ string, input flyio.CreateMachineInput) error {
+		updates++
+		return nil
+	}
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	config := newTestConfig()
+	config.FlyMachineSize = "shared-cpu-2x"
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	)
+	svc.Annotations[tunnel.AnnotationFlyMachineSize] = "performance-1x"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	// Update only skips the Machine when its desired config is the one
+	// Provision created it with.
+	if created.Guest == nil {
+		t.Fatal("expected a guest on the created Machine config")
+	}
+	if updates != 0 {
+		t.Errorf("expected Update to find the Machine Provision created up to date, got %d updates", updates)
+	}
+}
+
+func TestProvision_PrivateImages(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	config := newTestConfig()
+	config.FrpcImagePullSecret = "registry-creds"
+	config.FrpsRegistryAuth = &flyio.RegistryAuth{Server: "registry.example.com", Username: "bot", Password: "secret"}
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment, Namespace: testNamespace}, &deploy); err != nil {
+		t.Fatalf("getting frpc deployment: %v", err)
+	}
+	want := []corev1.LocalObjectReference{{Name: "registry-creds"}}
+	if got := deploy.Spec.Template.Spec.ImagePullSecrets; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected image pull secrets %v, got %v", want, got)
+	}
+
+	machine := server.GetMachines()[result.MachineID]
+	if machine == nil {
+		t.Fatalf("machine %s not found", result.MachineID)
+	}
+	if got := machine.Config.ImageRegistryAuth; got == nil || *got != *config.FrpsRegistryAuth {
+		t.Errorf("expected the Machine to pull frps with %+v, got %+v", config.FrpsRegistryAuth, got)
 	}
-	return false
 }
@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// migrationPollInterval is how often migrateFrpc checks the new frpc
+// Deployment for an available replica.
+var migrationPollInterval = 2 * time.Second
+
+// WithNamespaceMigration makes Update move frpc resources that live outside
+// the current operator namespace into it, waiting up to timeout for the new
+// frpc Deployment to become available before deleting the old one. Without
+// it, such tunnels keep being managed in their recorded namespace.
+func (m *Manager) WithNamespaceMigration(timeout time.Duration) *Manager {
+	m.migrationTimeout = timeout
+	return m
+}
+
+// migrateFrpc recreates the frpc resources of svc in the operator namespace
+// and removes them from the namespace recorded in AnnotationFrpcNamespace.
+// The old frpc keeps serving until the new one is available; if it never
+// becomes available both are left in place and the migration is retried on
+// the next Update.
+func (m *Manager) migrateFrpc(ctx context.Context, svc *corev1.Service, serverAddr, deployName string, secrets tunnelSecrets) error {
+	logger := log.FromContext(ctx)
+	oldNamespace := m.frpcNamespace(svc)
+	newNamespace := m.config.OperatorNamespace
+
+	if err := m.ensureOperatorNamespace(ctx); err != nil {
+		return err
+	}
+
+	logger.Info("Migrating frpc resources", "name", deployName, "from", oldNamespace, "to", newNamespace)
+	if _, err := m.deployFrpc(ctx, svc, serverAddr, newNamespace, secrets); err != nil {
+		return fmt.Errorf("creating frpc in namespace %s: %w", newNamespace, err)
+	}
+
+	key := types.NamespacedName{Name: deployName, Namespace: newNamespace}
+	err := wait.PollUntilContextTimeout(ctx, migrationPollInterval, m.migrationTimeout, true, func(ctx context.Context) (bool, error) {
+		var deploy appsv1.Deployment
+		if err := m.kubeClient.Get(ctx, key, &deploy); err != nil {
+			return false, err
+		}
+		return deploy.Status.AvailableReplicas > 0, nil
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for frpc in namespace %s to become available: %w", newNamespace, err)
+	}
+
+	patch := client.MergeFrom(svc.DeepCopy())
+	svc.Annotations[AnnotationFrpcNamespace] = newNamespace
+	if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+		svc.Annotations[AnnotationFrpcNamespace] = oldNamespace
+		return fmt.Errorf("recording frpc namespace: %w", err)
+	}
+
+	if err := m.deleteFrpcResources(ctx, oldNamespace, deployName); err != nil {
+		// Both frpc Deployments now point at the same frps; the old one
+		// is only a leak.
+		logger.Error(err, "Failed to delete migrated frpc resources", "name", deployName, "namespace", oldNamespace)
+	}
+
+	m.event(svc, corev1.EventTypeNormal, "FrpcMigrated", "Moved frpc from namespace %s to %s", oldNamespace, newNamespace)
+	return nil
+}
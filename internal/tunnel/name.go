@@ -18,6 +18,9 @@ func tunnelNameForService(svc *corev1.Service) string {
 }
 
 func flyAppNameForService(svc *corev1.Service, flyOrg string) string {
+	if key := stableIdentity(svc); key != "" {
+		return sanitizeName(fmt.Sprintf("fly-tunnel-%s-id-%s-%s", svc.Namespace, key, flyOrg))
+	}
 	return sanitizeName(fmt.Sprintf("fly-tunnel-%s-%s-%s", svc.Namespace, svc.Name, flyOrg))
 }
 
@@ -25,6 +28,15 @@ func frpcDeploymentNameForService(svc *corev1.Service) string {
 	return sanitizeName(fmt.Sprintf("frpc-%s-%s", svc.Namespace, svc.Name))
 }
 
+// frpcDeploymentName returns the frpc Deployment name recorded on svc, or
+// the conventional one if none was recorded.
+func frpcDeploymentName(svc *corev1.Service) string {
+	if name := svc.Annotations[AnnotationFrpcDeployment]; name != "" {
+		return name
+	}
+	return frpcDeploymentNameForService(svc)
+}
+
 func serviceLabelValue(svc *corev1.Service) string {
 	return sanitizeName(fmt.Sprintf("%s-%s", svc.Namespace, svc.Name))
 }
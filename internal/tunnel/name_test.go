@@ -6,6 +6,8 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
 )
 
 func TestSanitizeName(t *testing.T) {
@@ -170,3 +172,78 @@ func TestFlyAppNameForService(t *testing.T) {
 		})
 	}
 }
+
+func TestFrpcUserMatchesServiceLabelValue(t *testing.T) {
+	for _, tt := range []struct{ namespace, name string }{
+		{"default", "nginx"},
+		{"envoy-gateway-system", "envoy-gateway"},
+		{"my.namespace", "my.service"},
+		{strings.Repeat("n", 63), strings.Repeat("s", 63)},
+		{"this-is-a-really-long-namespace-name", "and-this-is-a-really-long-service-name-too"},
+	} {
+		svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: tt.name, Namespace: tt.namespace}}
+		if got, want := frp.ClientUser(svc), serviceLabelValue(svc); got != want {
+			t.Errorf("frp.ClientUser(%s/%s) = %q, want serviceLabelValue %q", tt.namespace, tt.name, got, want)
+		}
+	}
+}
+
+func TestDerivedLabelValuesWithinLimit(t *testing.T) {
+	// Pathological but valid: 63-char namespace and Service name.
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      strings.Repeat("s", 63),
+			Namespace: strings.Repeat("n", 63),
+		},
+	}
+
+	for name, got := range map[string]string{
+		"frpcDeploymentNameForService": frpcDeploymentNameForService(svc),
+		"serviceLabelValue":            serviceLabelValue(svc),
+		"tunnelNameForService":         tunnelNameForService(svc),
+	} {
+		if len(got) > maxLabelLen {
+			t.Errorf("%s() length = %d, exceeds label limit %d", name, len(got), maxLabelLen)
+		}
+	}
+}
+
+func FuzzSanitizeName(f *testing.F) {
+	for _, seed := range []string{
+		"fly-tunnel-default-nginx",
+		"Fly-Tunnel-Default-Nginx",
+		"fly_tunnel_default_nginx",
+		"fly--tunnel---default-nginx",
+		"-fly-tunnel-default-nginx-",
+		"fly-tunnel-very-long-namespace-name-that-exceeds-the-sixty-three-character-limit-for-fly-io-apps",
+		"fly-tunnel-my.namespace-my.service",
+		"...",
+		"---",
+		"frp-" + strings.Repeat("n", 63) + "-" + strings.Repeat("s", 63),
+		strings.Repeat("a", 50) + "-" + strings.Repeat("b", 20),
+		"fly-tunnel-défaut-ñginx",
+		"K-İ-ß",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		got := sanitizeName(name)
+		if len(got) > maxLabelLen {
+			t.Fatalf("sanitizeName(%q) = %q, longer than %d", name, got, maxLabelLen)
+		}
+		for _, c := range got {
+			if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-') {
+				t.Fatalf("sanitizeName(%q) = %q contains invalid char %q", name, got, string(c))
+			}
+		}
+		if strings.HasPrefix(got, "-") || strings.HasSuffix(got, "-") || strings.Contains(got, "--") {
+			t.Fatalf("sanitizeName(%q) = %q has a leading, trailing or doubled dash", name, got)
+		}
+		if again := sanitizeName(name); again != got {
+			t.Fatalf("sanitizeName(%q) is not deterministic: %q, then %q", name, got, again)
+		}
+		if again := sanitizeName(got); again != got {
+			t.Fatalf("sanitizeName(%q) = %q, which sanitizes again to %q", name, got, again)
+		}
+	})
+}
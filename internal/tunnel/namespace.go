@@ -0,0 +1,49 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// AnnotationFrpcNamespace records the namespace a tunnel's frpc resources
+// were created in, so they can still be found after the operator namespace
+// changes. Tunnels provisioned before it was introduced are assumed to live
+// in the current operator namespace.
+const AnnotationFrpcNamespace = "fly-tunnel-operator.dev/frpc-namespace"
+
+// ErrOperatorNamespaceNotReady is returned by Provision when the operator
+// namespace (where frpc resources live) does not exist yet, e.g. on a fresh
+// install before the namespace has been created. Callers should requeue
+// rather than treat it as a provisioning failure.
+var ErrOperatorNamespaceNotReady = errors.New("operator namespace not ready")
+
+// ensureOperatorNamespace verifies the operator namespace exists and is not
+// terminating. The namespace can be deleted and recreated while the operator
+// runs, so it is checked every time; the manager's client serves the Get
+// from its informer cache.
+func (m *Manager) ensureOperatorNamespace(ctx context.Context) error {
+	var ns corev1.Namespace
+	if err := m.kubeClient.Get(ctx, types.NamespacedName{Name: m.config.OperatorNamespace}, &ns); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("%w: namespace %q not found", ErrOperatorNamespaceNotReady, m.config.OperatorNamespace)
+		}
+		return fmt.Errorf("getting operator namespace: %w", err)
+	}
+	if ns.Status.Phase == corev1.NamespaceTerminating {
+		return fmt.Errorf("%w: namespace %q is terminating", ErrOperatorNamespaceNotReady, m.config.OperatorNamespace)
+	}
+	return nil
+}
+
+// frpcNamespace returns the namespace holding the frpc resources of svc.
+func (m *Manager) frpcNamespace(svc *corev1.Service) string {
+	if ns := svc.Annotations[AnnotationFrpcNamespace]; ns != "" {
+		return ns
+	}
+	return m.config.OperatorNamespace
+}
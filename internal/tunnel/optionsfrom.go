@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// AnnotationFrpOptionsFrom names a ConfigMap in the Service's namespace
+// holding per-Service options. Each key is an annotation name without the
+// fly-tunnel-operator.dev/ prefix (e.g. "bandwidth-limit"), since ConfigMap
+// keys cannot contain a slash. Annotations on the Service win on conflict.
+const AnnotationFrpOptionsFrom = "fly-tunnel-operator.dev/frp-options-from"
+
+// LabelFrpOptions marks a ConfigMap, with the value "true", as holding frp
+// options. The operator only watches ConfigMaps carrying it, so edits to an
+// unlabelled one are only picked up by the next resync.
+const LabelFrpOptions = "fly-tunnel-operator.dev/frp-options"
+
+// annotationPrefix is the prefix of every operator annotation.
+const annotationPrefix = "fly-tunnel-operator.dev/"
+
+// ErrFrpOptionsNotFound is returned when the ConfigMap named by
+// AnnotationFrpOptionsFrom does not exist.
+var ErrFrpOptionsNotFound = errors.New("frp options ConfigMap not found")
+
+// notOptions are annotations that record operator state or tunnel identity
+// rather than configure the tunnel, so the options ConfigMap cannot set them.
+// The tunnel state annotations are excluded too.
+var notOptions = []string{
+	AnnotationFrpOptionsFrom,
+	AnnotationStableIdentity,
+	AnnotationIPv6,
+	AnnotationAssignedRemotePorts,
+	AnnotationLastFrpcError,
+	AnnotationRotateToken,
+	AnnotationRotateTokenObserved,
+	AnnotationFrpcImage,
+	AnnotationFrpsImage,
+	AnnotationOperatorVersion,
+	AnnotationOperatorIdentity,
+}
+
+// withFrpOptions returns svc with the options from its frp options ConfigMap
+// merged into a copy of its annotations. A Service without the reference is
+// returned as is.
+func (m *Manager) withFrpOptions(ctx context.Context, svc *corev1.Service) (*corev1.Service, error) {
+	name := svc.Annotations[AnnotationFrpOptionsFrom]
+	if name == "" {
+		return svc, nil
+	}
+
+	var cm corev1.ConfigMap
+	if err := m.kubeClient.Get(ctx, types.NamespacedName{Name: name, Namespace: svc.Namespace}, &cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			m.event(svc, corev1.EventTypeWarning, "FrpOptionsNotFound",
+				"ConfigMap %s referenced by %s does not exist", name, AnnotationFrpOptionsFrom)
+			return nil, fmt.Errorf("%w: %s/%s", ErrFrpOptionsNotFound, svc.Namespace, name)
+		}
+		return nil, fmt.Errorf("getting frp options configmap: %w", err)
+	}
+	if cm.Labels[LabelFrpOptions] != "true" {
+		m.event(svc, corev1.EventTypeWarning, "FrpOptionsUnlabeled",
+			"ConfigMap %s lacks the %s=true label; edits to it are not watched", name, LabelFrpOptions)
+	}
+
+	merged := svc.DeepCopy()
+	for key, value := range cm.Data {
+		annotation := annotationPrefix + key
+		if slices.Contains(notOptions, annotation) || slices.Contains(tunnelAnnotations, annotation) {
+			continue
+		}
+		if _, set := merged.Annotations[annotation]; set {
+			continue
+		}
+		merged.Annotations[annotation] = value
+	}
+	return merged, nil
+}
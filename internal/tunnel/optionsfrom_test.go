@@ -0,0 +1,218 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func frpOptions(name, namespace string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{tunnel.LabelFrpOptions: "true"},
+		},
+		Data: data,
+	}
+}
+
+func frpcConfig(t *testing.T, kubeClient client.Client, deployName string) string {
+	t.Helper()
+	var secret corev1.Secret
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: deployName + "-config", Namespace: testNamespace}, &secret); err != nil {
+		t.Fatalf("getting frpc config Secret: %v", err)
+	}
+	return string(secret.Data["frpc.toml"])
+}
+
+func TestFrpOptionsFrom_Precedence(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	options := frpOptions("web-frp", "default", map[string]string{
+		"pool-count":           "3",
+		"bandwidth-limit":      "1MB",
+		"bandwidth-limit-mode": "server",
+		// State annotations cannot be injected through the ConfigMap.
+		"public-ip": "203.0.113.9",
+	})
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), options).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[tunnel.AnnotationFrpOptionsFrom] = "web-frp"
+	// The Service's own annotation wins over the ConfigMap.
+	svc.Annotations[frp.AnnotationBandwidthLimit] = "2MB"
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if result.PublicIP == "203.0.113.9" {
+		t.Error("expected public-ip from the options ConfigMap to be ignored")
+	}
+	if _, ok := svc.Annotations[frp.AnnotationPoolCount]; ok {
+		t.Error("expected options to be merged into a copy, not the caller's Service")
+	}
+
+	config, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Transport == nil || config.Transport.PoolCount != 3 {
+		t.Errorf("expected poolCount 3, got %+v", config.Transport)
+	}
+	for _, proxy := range config.Proxies {
+		if proxy.Transport == nil || proxy.Transport.BandwidthLimit != "2MB" || proxy.Transport.BandwidthLimitMode != "server" {
+			t.Errorf("expected proxy %s to be limited to 2MB in server mode, got %+v", proxy.Name, proxy.Transport)
+		}
+	}
+}
+
+func TestFrpOptionsFrom_Changes(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	options := frpOptions("web-frp", "default", map[string]string{"pool-count": "2"})
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), options).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[tunnel.AnnotationFrpOptionsFrom] = "web-frp"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+
+	options.Data["pool-count"] = "4"
+	if err := kubeClient.Update(context.Background(), options); err != nil {
+		t.Fatalf("updating options ConfigMap: %v", err)
+	}
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	config, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Transport == nil || config.Transport.PoolCount != 4 {
+		t.Errorf("expected Update to apply the changed ConfigMap, got %+v", config.Transport)
+	}
+}
+
+func TestFrpOptionsFrom_MissingConfigMap(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	recorder := record.NewFakeRecorder(10)
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig()).WithEventRecorder(recorder)
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[tunnel.AnnotationFrpOptionsFrom] = "missing"
+
+	_, err := mgr.Provision(context.Background(), svc)
+	if !errors.Is(err, tunnel.ErrFrpOptionsNotFound) {
+		t.Fatalf("expected ErrFrpOptionsNotFound, got %v", err)
+	}
+	if errors.Is(err, tunnel.ErrPermanent) {
+		t.Error("a missing ConfigMap may still be created; it must not be a permanent failure")
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected nothing to be created on fly.io, got %d apps", server.AppCount())
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, "FrpOptionsNotFound") {
+			t.Errorf("expected a FrpOptionsNotFound event, got %q", e)
+		}
+	default:
+		t.Error("expected a FrpOptionsNotFound event")
+	}
+}
+
+func TestFrpOptionsFrom_UnlabeledConfigMap(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	options := frpOptions("web-frp", "default", map[string]string{"pool-count": "2"})
+	options.Labels = nil
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), options).Build()
+	recorder := record.NewFakeRecorder(10)
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig()).WithEventRecorder(recorder)
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[tunnel.AnnotationFrpOptionsFrom] = "web-frp"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	config, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Transport == nil || config.Transport.PoolCount != 2 {
+		t.Errorf("expected the unlabelled ConfigMap to still be applied, got %+v", config.Transport)
+	}
+
+	found := false
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, "FrpOptionsUnlabeled") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected a FrpOptionsUnlabeled event")
+	}
+}
+
+func TestProvision_ClusterDomain(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	config := newTestConfig()
+	config.ClusterDomain = "corp.example"
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	c, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+	if err != nil {
+		t.Fatalf("parsing frpc config: %v", err)
+	}
+	if got := c.Proxies[0].LocalIP; got != "web.default.svc.corp.example" {
+		t.Errorf("expected the configured cluster domain in localIP, got %q", got)
+	}
+}
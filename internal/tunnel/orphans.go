@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// annotationOwner records on the frpc config Secret the namespace/name of
+// the Service the tunnel belongs to, so CollectOrphans can tell when it is
+// gone. The Service label is sanitized and cannot be mapped back.
+const annotationOwner = "fly-tunnel-operator.dev/owner"
+
+// CollectOrphans tears down tunnels whose Service no longer exists, as left
+// behind when a Service without the operator's finalizer is deleted while
+// the operator is not watching. It returns the number of tunnels torn down.
+//
+// Orphans are found through the frpc config Secrets in the operator
+// namespace and cleaned up by conventional names, like a Service whose
+// annotations were lost: a Fly App renamed around a pending deletion, or
+// frpc moved from another namespace, is not found.
+func (m *Manager) CollectOrphans(ctx context.Context) (int, error) {
+	logger := log.FromContext(ctx)
+
+	var secrets corev1.SecretList
+	if err := m.kubeClient.List(ctx, &secrets,
+		client.InNamespace(m.config.OperatorNamespace),
+		client.MatchingLabels{"app.kubernetes.io/managed-by": "fly-tunnel-operator"},
+	); err != nil {
+		return 0, fmt.Errorf("listing frpc config secrets: %w", err)
+	}
+
+	collected := 0
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		namespace, name, ok := strings.Cut(secret.Annotations[annotationOwner], "/")
+		if !ok {
+			continue
+		}
+
+		var svc corev1.Service
+		err := m.kubeClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &svc)
+		if err == nil {
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			return collected, fmt.Errorf("getting service %s/%s: %w", namespace, name, err)
+		}
+
+		orphan := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+		if secret.Name != frpcConfigName(frpcDeploymentNameForService(orphan)) {
+			continue
+		}
+		logger.Info("Tearing down tunnel of deleted Service", "service", namespace+"/"+name)
+		if err := m.Teardown(ctx, orphan); err != nil {
+			return collected, fmt.Errorf("tearing down orphaned tunnel of %s/%s: %w", namespace, name, err)
+		}
+		collected++
+	}
+	return collected, nil
+}
@@ -0,0 +1,62 @@
+package tunnel_test
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestCollectOrphans(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating service: %v", err)
+	}
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	// A live Service's tunnel is left alone.
+	if n, err := mgr.CollectOrphans(context.Background()); err != nil || n != 0 {
+		t.Fatalf("expected nothing to collect while the Service exists, got %d, %v", n, err)
+	}
+	if !server.HasApp(result.FlyApp) {
+		t.Fatal("expected the app to survive")
+	}
+
+	// The Service goes without the operator noticing.
+	if err := kubeClient.Delete(context.Background(), svc); err != nil {
+		t.Fatalf("deleting service: %v", err)
+	}
+	if n, err := mgr.CollectOrphans(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected the orphaned tunnel to be collected, got %d, %v", n, err)
+	}
+	if server.HasApp(result.FlyApp) {
+		t.Error("expected the orphaned app to be deleted")
+	}
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: result.FrpcDeployment + "-config", Namespace: testNamespace}
+	if err := kubeClient.Get(context.Background(), key, &secret); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the frpc config Secret to be deleted, got %v", err)
+	}
+
+	// Nothing is left to collect.
+	if n, err := mgr.CollectOrphans(context.Background()); err != nil || n != 0 {
+		t.Errorf("expected a second pass to find nothing, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// labelService marks in-cluster frpc resources with the Service they belong to.
+const labelService = "fly-tunnel-operator.dev/service"
+
+// tunnelAnnotations are the annotations recording provisioned tunnel state.
+var tunnelAnnotations = []string{
+	AnnotationFlyApp,
+	AnnotationMachineID,
+	AnnotationReplacedMachineID,
+	AnnotationIPID,
+	AnnotationPublicIP,
+	AnnotationIPv6ID,
+	AnnotationPublicIPv6,
+	AnnotationFrpcDeployment,
+	AnnotationFrpcNamespace,
+	AnnotationIPOwnership,
+	AnnotationAppOwnership,
+	AnnotationFrpsDashboardSecret,
+	AnnotationControlPort,
+}
+
+// HasTunnelState reports whether any tunnel state was recorded on the Service.
+func HasTunnelState(svc *corev1.Service) bool {
+	for _, key := range tunnelAnnotations {
+		if svc.Annotations[key] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsConventionalTunnel reports whether this operator provisioned a tunnel
+// for svc even though its annotations were never written, e.g. when the
+// annotation update after Provision failed. The frpc config Secret (or, for
+// tunnels from older operator versions, ConfigMap), created in this cluster
+// and labelled with the Service, is the ownership marker.
+func (m *Manager) ownsConventionalTunnel(ctx context.Context, svc *corev1.Service) (bool, error) {
+	key := types.NamespacedName{
+		Name:      frpcConfigName(frpcDeploymentNameForService(svc)),
+		Namespace: m.config.OperatorNamespace,
+	}
+	for _, obj := range []client.Object{&corev1.Secret{}, &corev1.ConfigMap{}} {
+		if err := m.kubeClient.Get(ctx, key, obj); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return false, fmt.Errorf("getting frpc config: %w", err)
+		}
+		if obj.GetLabels()[labelService] == serviceLabelValue(svc) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// ErrPermanent marks provisioning failures that retrying cannot fix without
+// the user changing something first: invalid Service annotations or a Fly.io
+// quota. Callers should stop retrying until asked to.
+var ErrPermanent = errors.New("permanent failure")
+
+// permanent marks err as an ErrPermanent.
+func permanent(err error) error {
+	return fmt.Errorf("%w: %w", ErrPermanent, err)
+}
+
+// permanentIfQuota marks Fly.io quota refusals as permanent and returns other
+// errors unchanged.
+func permanentIfQuota(err error) error {
+	if flyio.IsQuotaExceeded(err) {
+		return permanent(err)
+	}
+	return err
+}
+
+// annotationChecks validate the user-set annotations that shape the tunnel,
+// each returning an error naming the annotation at fault.
+var annotationChecks = []func(*corev1.Service) error{
+	frp.ValidateDualStackPorts,
+	frp.ValidateBandwidthLimit,
+	frp.ValidatePoolCount,
+	frp.ValidateProxyTransport,
+	frp.ValidateHealthCheck,
+	frp.ValidateProxyProtocol,
+	frp.ValidateVhost,
+	frp.ValidateRemotePorts,
+	frp.ValidateMaxPortsPerClient,
+	frp.ValidateTransportProtocol,
+	frp.ValidateClusterDomainAnnotation,
+	frp.ValidateLogLevels,
+	func(svc *corev1.Service) error { _, err := frpcResources(svc); return err },
+	func(svc *corev1.Service) error { _, err := frpcReplicas(svc); return err },
+	func(svc *corev1.Service) error { _, err := frpcSchedulingFor(svc, nil); return err },
+	validateLocalTarget,
+	validateCanary,
+	validateIPv6,
+	validateRegion,
+	validateMachineSize,
+	func(svc *corev1.Service) error { _, err := parseMachineStartTimeout(svc); return err },
+	func(svc *corev1.Service) error { _, err := parseControlPort(svc); return err },
+}
+
+// validateAnnotations checks the user-set annotations that shape the tunnel,
+// returning the first problem.
+func validateAnnotations(svc *corev1.Service) error {
+	for _, check := range annotationChecks {
+		if err := check(svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
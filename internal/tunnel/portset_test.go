@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// randomPortService returns a Service with a few random ports and a random
+// combination of the annotations that shape its port set.
+func randomPortService(rng *rand.Rand) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{}},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}
+	numbers := []int32{53, 80, 443, 8080, 9000, 25565}
+	declared := make(map[string]bool)
+	for i := range 1 + rng.IntN(4) {
+		port := corev1.ServicePort{Name: fmt.Sprintf("p%d", i), Port: numbers[rng.IntN(len(numbers))], Protocol: corev1.ProtocolTCP}
+		if rng.IntN(3) == 0 {
+			port.Protocol = corev1.ProtocolUDP
+		}
+		key := fmt.Sprintf("%d/%s", port.Port, port.Protocol)
+		if declared[key] {
+			continue
+		}
+		declared[key] = true
+		svc.Spec.Ports = append(svc.Spec.Ports, port)
+	}
+
+	var dualStack, clusterOnly []string
+	for _, port := range svc.Spec.Ports {
+		switch rng.IntN(6) {
+		case 0:
+			dualStack = append(dualStack, strconv.Itoa(int(port.Port)))
+		case 1:
+			clusterOnly = append(clusterOnly, port.Name)
+		case 2:
+			svc.Annotations[frp.PortAnnotation(port.Name, frp.AnnotationRemotePort)] = strconv.Itoa(10000 + rng.IntN(4))
+		case 3:
+			svc.Annotations[frp.PortAnnotation(port.Name, frp.AnnotationProxyType)] = []string{frp.ProxyTypeHTTP, frp.ProxyTypeHTTPS}[rng.IntN(2)]
+			svc.Annotations[frp.AnnotationCustomDomains] = "example.com"
+		}
+	}
+	if len(dualStack) > 0 {
+		svc.Annotations[frp.AnnotationDualStackPorts] = strings.Join(dualStack, ",")
+	}
+	if len(clusterOnly) > 0 {
+		svc.Annotations[frp.AnnotationClusterOnlyPorts] = strings.Join(clusterOnly, ",")
+	}
+	if rng.IntN(4) == 0 {
+		svc.Annotations[frp.AnnotationRandomRemotePorts] = "true"
+	}
+	return svc
+}
+
+// TestPortSet_FrpcMatchesMachineServices checks that the frpc config and the
+// frps Machine's services always describe the same public ports, whatever
+// combination of port annotations a Service sets.
+func TestPortSet_FrpcMatchesMachineServices(t *testing.T) {
+	m := desiredTestManager(Config{FlyRegion: "syd", FrpsImage: "frps:1"})
+	rng := rand.New(rand.NewPCG(1, 2))
+	checked := 0
+	for range 2000 {
+		svc := randomPortService(rng)
+		if validateAnnotations(svc) != nil {
+			continue
+		}
+		checked++
+
+		// Simulate frps having assigned every random remote port.
+		assigned := make(map[string]int)
+		if frp.RandomRemotePorts(svc) {
+			for i, proxy := range frp.ProxyPorts(svc) {
+				assigned[proxy.Key()] = 30000 + i
+			}
+			svc.Annotations[AnnotationAssignedRemotePorts] = formatRemotePorts(assigned)
+		}
+
+		keys := make(map[string]string)
+		for _, proxy := range frp.ProxyPorts(svc) {
+			keys[proxy.Name] = proxy.Key()
+		}
+		var frpc []string
+		config := frp.ClientConfigFor(svc, frp.ClientOptions{ServerAddr: "1.2.3.4", ServerPort: controlPort(svc)})
+		for _, proxy := range config.Proxies {
+			switch {
+			case proxy.Type == frp.ProxyTypeHTTP:
+				frpc = append(frpc, fmt.Sprintf("%d/tcp", frp.VhostHTTPPort))
+			case proxy.Type == frp.ProxyTypeHTTPS:
+				frpc = append(frpc, fmt.Sprintf("%d/tcp", frp.VhostHTTPSPort))
+			case proxy.RemotePort == 0:
+				frpc = append(frpc, fmt.Sprintf("%d/%s", assigned[keys[proxy.Name]], proxy.Type))
+			default:
+				frpc = append(frpc, fmt.Sprintf("%d/%s", proxy.RemotePort, proxy.Type))
+			}
+		}
+
+		var machine []string
+		for _, service := range m.buildMachineInput(svc, tunnelSecrets{}).Config.Services {
+			if service.InternalPort == controlPort(svc) {
+				continue
+			}
+			machine = append(machine, fmt.Sprintf("%d/%s", service.InternalPort, service.Protocol))
+		}
+
+		if got, want := portSet(machine), portSet(frpc); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Machine services %v differ from frpc proxies %v for ports %+v and annotations %v",
+				got, want, svc.Spec.Ports, svc.Annotations)
+		}
+	}
+	if checked < 200 {
+		t.Fatalf("expected at least 200 valid Services to check, got %d", checked)
+	}
+}
+
+// portSet returns the distinct entries of ports, sorted.
+func portSet(ports []string) []string {
+	seen := make(map[string]bool)
+	var set []string
+	for _, port := range ports {
+		if !seen[port] {
+			seen[port] = true
+			set = append(set, port)
+		}
+	}
+	sort.Strings(set)
+	return set
+}
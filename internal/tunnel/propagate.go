@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// operatorPrefix is the prefix of the operator's own annotations, which are
+// never propagated.
+const operatorPrefix = "fly-tunnel-operator.dev/"
+
+// propagatedMetadata returns the labels and annotations of svc whose keys
+// start with one of prefixes, for the metadata of its frpc resources.
+func propagatedMetadata(svc *corev1.Service, prefixes []string) (labels, annotations map[string]string) {
+	return matchingPrefixes(svc.Labels, prefixes), matchingPrefixes(svc.Annotations, prefixes)
+}
+
+// matchingPrefixes returns the entries of m whose keys start with one of
+// prefixes and not with operatorPrefix, or nil if there are none.
+func matchingPrefixes(m map[string]string, prefixes []string) map[string]string {
+	var matched map[string]string
+	for key, value := range m {
+		if strings.HasPrefix(key, operatorPrefix) {
+			continue
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				if matched == nil {
+					matched = make(map[string]string)
+				}
+				matched[key] = value
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// withPropagated returns own overlaid on propagated, so the operator's
+// entries win over the Service's, or own itself if nothing is propagated.
+func withPropagated(propagated, own map[string]string) map[string]string {
+	if len(propagated) == 0 {
+		return own
+	}
+	merged := make(map[string]string, len(propagated)+len(own))
+	for k, v := range propagated {
+		merged[k] = v
+	}
+	for k, v := range own {
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergeMetadata sets the labels and annotations of desired on existing,
+// keeping any others, e.g. those added by other controllers.
+func mergeMetadata(existing *metav1.ObjectMeta, desired metav1.ObjectMeta) {
+	if len(desired.Labels) > 0 && existing.Labels == nil {
+		existing.Labels = make(map[string]string)
+	}
+	for k, v := range desired.Labels {
+		existing.Labels[k] = v
+	}
+	if len(desired.Annotations) > 0 && existing.Annotations == nil {
+		existing.Annotations = make(map[string]string)
+	}
+	for k, v := range desired.Annotations {
+		existing.Annotations[k] = v
+	}
+}
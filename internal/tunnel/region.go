@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+// RegionAuto, as AnnotationFlyRegion, runs the tunnel in the Fly.io region
+// nearest the cluster (see Config.ClusterLocation). Provision replaces it
+// with the region picked.
+const RegionAuto = "auto"
+
+// earthRadiusKm is the mean radius of the Earth.
+const earthRadiusKm = 6371.0
+
+// Coordinates locate a point on Earth, in degrees.
+type Coordinates struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// ParseCoordinates parses "<latitude>,<longitude>" in degrees, e.g.
+// "-33.87,151.21".
+func ParseCoordinates(s string) (Coordinates, error) {
+	lat, lon, ok := strings.Cut(s, ",")
+	if !ok {
+		return Coordinates{}, fmt.Errorf("coordinates %q must be <latitude>,<longitude>", s)
+	}
+	var c Coordinates
+	var errLat, errLon error
+	c.Latitude, errLat = strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	c.Longitude, errLon = strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if errLat != nil || errLon != nil || math.Abs(c.Latitude) > 90 || math.Abs(c.Longitude) > 180 {
+		return Coordinates{}, fmt.Errorf("coordinates %q must be a latitude from -90 to 90 and a longitude from -180 to 180", s)
+	}
+	return c, nil
+}
+
+// ClusterLocation is where the cluster runs, for RegionAuto: either the
+// Coordinates of the cluster or a Fly.io Region code standing in for them.
+type ClusterLocation struct {
+	Region      string
+	Coordinates *Coordinates
+}
+
+// distanceKm returns the great-circle distance between a and b.
+func distanceKm(a, b Coordinates) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(b.Latitude - a.Latitude)
+	dLon := rad(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(a.Latitude))*math.Cos(rad(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(min(h, 1)))
+}
+
+// nearestRegion returns the region of regions nearest at, or false if
+// regions is empty.
+func nearestRegion(regions []flyio.Region, at Coordinates) (flyio.Region, bool) {
+	var nearest flyio.Region
+	best := math.Inf(1)
+	for _, r := range regions {
+		if d := distanceKm(at, Coordinates{Latitude: r.Latitude, Longitude: r.Longitude}); d < best {
+			nearest, best = r, d
+		}
+	}
+	return nearest, !math.IsInf(best, 1)
+}
+
+// errNoClusterLocation is returned for RegionAuto when the operator was not
+// told where the cluster is.
+var errNoClusterLocation = errors.New("fly-region auto needs the operator's --cluster-region or --cluster-coords")
+
+// autoRegion returns the Fly.io region nearest the cluster.
+func (m *Manager) autoRegion(ctx context.Context) (flyio.Region, error) {
+	location := m.config.ClusterLocation
+	if location.Region == "" && location.Coordinates == nil {
+		return flyio.Region{}, permanent(errNoClusterLocation)
+	}
+	regions, err := m.flyClient.ListRegions(ctx)
+	if err != nil {
+		return flyio.Region{}, fmt.Errorf("resolving fly-region auto: %w", err)
+	}
+	at := location.Coordinates
+	if at == nil {
+		for _, r := range regions {
+			if r.Code == location.Region {
+				at = &Coordinates{Latitude: r.Latitude, Longitude: r.Longitude}
+				break
+			}
+		}
+		if at == nil {
+			return flyio.Region{}, permanent(fmt.Errorf("resolving fly-region auto: Fly.io has no cluster region %q", location.Region))
+		}
+	}
+	nearest, ok := nearestRegion(regions, *at)
+	if !ok {
+		return flyio.Region{}, fmt.Errorf("resolving fly-region auto: Fly.io lists no regions")
+	}
+	return nearest, nil
+}
+
+// resolveRegion returns svc with AnnotationFlyRegion RegionAuto replaced by
+// the region nearest the cluster, recorded on the Service so the tunnel
+// stays there. Other Services are returned as is.
+func (m *Manager) resolveRegion(ctx context.Context, svc *corev1.Service) (*corev1.Service, error) {
+	if svc.Annotations[AnnotationFlyRegion] != RegionAuto {
+		return svc, nil
+	}
+	region, err := m.autoRegion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// svc may carry options merged from a ConfigMap; only the region is
+	// written back.
+	record := svc.DeepCopy()
+	patch := client.MergeFrom(record.DeepCopy())
+	record.Annotations[AnnotationFlyRegion] = region.Code
+	if err := m.kubeClient.Patch(ctx, record, patch); err != nil {
+		return nil, fmt.Errorf("recording resolved fly-region: %w", err)
+	}
+	resolved := svc.DeepCopy()
+	resolved.Annotations[AnnotationFlyRegion] = region.Code
+	log.FromContext(ctx).Info("Resolved fly-region auto", "region", region.Code)
+	m.event(svc, corev1.EventTypeNormal, "RegionResolved", "Resolved %s %s to %s (%s)",
+		AnnotationFlyRegion, RegionAuto, region.Code, region.Name)
+	return resolved, nil
+}
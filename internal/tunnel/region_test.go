@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+func TestParseCoordinates(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Coordinates
+		wantErr bool
+	}{
+		{in: "-37.81,144.96", want: Coordinates{Latitude: -37.81, Longitude: 144.96}},
+		{in: " 41.88 , -87.63 ", want: Coordinates{Latitude: 41.88, Longitude: -87.63}},
+		{in: "0,180", want: Coordinates{Latitude: 0, Longitude: 180}},
+		{in: "41.88", wantErr: true},
+		{in: "north,west", wantErr: true},
+		{in: "91,0", wantErr: true},
+		{in: "0,-181", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCoordinates(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCoordinates(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseCoordinates(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNearestRegion(t *testing.T) {
+	regions := []flyio.Region{
+		{Code: "ams", Latitude: 52.374342, Longitude: 4.895439},
+		{Code: "ord", Latitude: 41.891544, Longitude: -87.630386},
+		{Code: "syd", Latitude: -33.866667, Longitude: 151.2},
+		{Code: "nrt", Latitude: 35.621582, Longitude: 139.741698},
+	}
+	tests := []struct {
+		name string
+		at   Coordinates
+		want string
+	}{
+		{name: "Melbourne", at: Coordinates{Latitude: -37.81, Longitude: 144.96}, want: "syd"},
+		{name: "Chicago", at: Coordinates{Latitude: 41.88, Longitude: -87.63}, want: "ord"},
+		{name: "Berlin", at: Coordinates{Latitude: 52.52, Longitude: 13.40}, want: "ams"},
+		// Across the antimeridian: Auckland to Sydney, not the long way round.
+		{name: "Auckland", at: Coordinates{Latitude: -36.85, Longitude: 174.76}, want: "syd"},
+	}
+	for _, tt := range tests {
+		got, ok := nearestRegion(regions, tt.at)
+		if !ok || got.Code != tt.want {
+			t.Errorf("nearestRegion(%s) = %q, %v, want %q", tt.name, got.Code, ok, tt.want)
+		}
+	}
+	if _, ok := nearestRegion(nil, Coordinates{}); ok {
+		t.Error("expected no region from an empty list")
+	}
+}
+
+func TestDistanceKm(t *testing.T) {
+	sydney := Coordinates{Latitude: -33.87, Longitude: 151.21}
+	melbourne := Coordinates{Latitude: -37.81, Longitude: 144.96}
+	// Sydney to Melbourne is about 714 km.
+	if d := distanceKm(sydney, melbourne); d < 700 || d > 730 {
+		t.Errorf("distanceKm(Sydney, Melbourne) = %.0f, want about 714", d)
+	}
+	if d := distanceKm(sydney, sydney); d != 0 {
+		t.Errorf("distanceKm to itself = %v, want 0", d)
+	}
+}
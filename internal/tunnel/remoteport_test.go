@@ -0,0 +1,66 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestProvision_RemotePortOverride(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[frp.PortAnnotation("http", frp.AnnotationRemotePort)] = "80"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	machine := server.GetMachines()[result.MachineID]
+	if !exposesPort(machine, 80) || !exposesPort(machine, 22) {
+		t.Errorf("expected the remapped port and the plain port to be exposed, got %+v", machine.Config.Services)
+	}
+	if exposesPort(machine, 8080) {
+		t.Errorf("expected the Service port of the remapped port not to be exposed, got %+v", machine.Config.Services)
+	}
+
+	want := []corev1.PortStatus{{Port: 80, Protocol: corev1.ProtocolTCP}}
+	if got := tunnel.RemappedPorts(svc); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected remapped ports %+v, got %+v", want, got)
+	}
+}
+
+func TestProvision_RemotePortConflict(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "web", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[frp.PortAnnotation("http", frp.AnnotationRemotePort)] = "80"
+	if _, err := mgr.Provision(context.Background(), svc); !errors.Is(err, tunnel.ErrPermanent) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected nothing to be created, got %d apps", server.AppCount())
+	}
+}
@@ -0,0 +1,188 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// AnnotationAssignedRemotePorts records the public ports frps assigned when
+// random remote ports are enabled, as comma-separated
+// "<servicePort>/<protocol>=<remotePort>" pairs.
+const AnnotationAssignedRemotePorts = "fly-tunnel-operator.dev/assigned-remote-ports"
+
+// RemotePortReader reads back the remote ports frps assigned to a tunnel's
+// proxies, keyed by proxy name.
+type RemotePortReader interface {
+	RemotePorts(ctx context.Context, namespace, deploymentName string) (map[string]int, error)
+}
+
+// frpcAdminReader queries the admin API of a running frpc pod.
+type frpcAdminReader struct {
+	kubeClient client.Client
+	httpClient *http.Client
+}
+
+func (r *frpcAdminReader) RemotePorts(ctx context.Context, namespace, deploymentName string) (map[string]int, error) {
+	statuses, err := r.ProxyStatuses(ctx, namespace, deploymentName)
+	if err != nil {
+		return nil, err
+	}
+	return frp.AssignedRemotePorts(statuses), nil
+}
+
+func (r *frpcAdminReader) ProxyStatuses(ctx context.Context, namespace, deploymentName string) ([]frp.ProxyStatus, error) {
+	var pods corev1.PodList
+	if err := r.kubeClient.List(ctx, &pods,
+		client.InNamespace(namespace),
+		client.MatchingLabels{"app.kubernetes.io/instance": deploymentName},
+	); err != nil {
+		return nil, fmt.Errorf("listing frpc pods: %w", err)
+	}
+
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: frpcConfigName(deploymentName), Namespace: namespace}
+	if err := r.kubeClient.Get(ctx, key, &secret); err != nil {
+		return nil, fmt.Errorf("getting frpc admin password: %w", err)
+	}
+	password := string(secret.Data[frpcAdminPasswordKey])
+
+	lastErr := fmt.Errorf("no running frpc pod for %s", deploymentName)
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		addr := net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(frp.DefaultAdminPort))
+		statuses, err := frp.FetchProxyStatus(ctx, r.httpClient, addr, password)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return statuses, nil
+	}
+	return nil, lastErr
+}
+
+// WithRemotePortReader overrides how assigned remote ports are read back.
+func (m *Manager) WithRemotePortReader(r RemotePortReader) *Manager {
+	m.remotePorts = r
+	return m
+}
+
+// ReadRemotePorts reads back the ports frps assigned to a Service's proxies and
+// returns them formatted for AnnotationAssignedRemotePorts. Ports already
+// recorded are kept: they are pinned in the frpc config, while a restarted
+// frps or an frpc pod on its way out may report others. Ports whose proxy
+// hasn't registered yet are omitted; an error is returned if none have.
+func (m *Manager) ReadRemotePorts(ctx context.Context, svc *corev1.Service) (string, error) {
+	recorded := parseAssignedRemotePorts(svc.Annotations[AnnotationAssignedRemotePorts])
+	var proxies []frp.ProxyPort
+	missing := false
+	for _, proxy := range frp.ProxyPorts(svc) {
+		if frp.VhostPort(svc, proxy) != 0 {
+			continue
+		}
+		proxies = append(proxies, proxy)
+		if _, ok := recorded[proxy.Key()]; !ok {
+			missing = true
+		}
+	}
+
+	var byProxy map[string]int
+	if missing {
+		var err error
+		byProxy, err = m.remotePorts.RemotePorts(ctx, m.frpcNamespace(svc), frpcDeploymentName(svc))
+		if err != nil {
+			return "", fmt.Errorf("reading assigned remote ports: %w", err)
+		}
+	}
+
+	var pairs []string
+	for _, proxy := range proxies {
+		remotePort, ok := recorded[proxy.Key()]
+		if !ok {
+			remotePort, ok = byProxy[proxy.Name]
+		}
+		if !ok {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%d", proxy.Key(), remotePort))
+	}
+	if len(pairs) == 0 {
+		return "", fmt.Errorf("no proxies registered with frps yet")
+	}
+	return strings.Join(pairs, ","), nil
+}
+
+// publicPorts returns frp.PublishedPorts of svc with the remote ports frps
+// assigned filled in from AnnotationAssignedRemotePorts. Ports frps has not
+// assigned yet are left out.
+func publicPorts(svc *corev1.Service) []frp.PublishedPort {
+	assigned := parseAssignedRemotePorts(svc.Annotations[AnnotationAssignedRemotePorts])
+	var ports []frp.PublishedPort
+	for _, port := range frp.PublishedPorts(svc) {
+		if port.RemotePort == 0 {
+			p, ok := assigned[port.Key()]
+			if !ok {
+				continue
+			}
+			port.RemotePort = p
+		}
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// parseAssignedRemotePorts parses an AnnotationAssignedRemotePorts value into
+// a map keyed by frp.ProxyPort.Key. Malformed entries are skipped.
+func parseAssignedRemotePorts(value string) map[string]int {
+	ports := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		key, portStr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		ports[key] = port
+	}
+	return ports
+}
+
+// RemappedPorts returns the public ports of the proxies of svc served on a
+// port other than their Service port through an frp.AnnotationRemotePort
+// override, for the Service's LoadBalancerIngress. It returns nil if there
+// are none.
+func RemappedPorts(svc *corev1.Service) []corev1.PortStatus {
+	if frp.RandomRemotePorts(svc) || !frp.HasRemotePortOverrides(svc) {
+		return nil
+	}
+	// A group member may have been moved off the port it asked for.
+	assigned := parseAssignedRemotePorts(svc.Annotations[AnnotationAssignedRemotePorts])
+	var ports []corev1.PortStatus
+	for _, proxy := range frp.ProxyPorts(svc) {
+		if frp.VhostPort(svc, proxy) != 0 {
+			continue
+		}
+		port, ok := assigned[proxy.Key()]
+		if !ok {
+			port = frp.RemotePortFor(svc, proxy)
+		}
+		if port == int(proxy.Port.Port) {
+			continue
+		}
+		ports = append(ports, corev1.PortStatus{Port: int32(port), Protocol: corev1.Protocol(strings.ToUpper(proxy.Protocol))})
+	}
+	return ports
+}
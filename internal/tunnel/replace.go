@@ -0,0 +1,83 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+)
+
+// AnnotationReplacedMachineID records the ID of a Machine that
+// replaceMachine superseded but has not deleted yet. Until it is gone the
+// old frps keeps serving on the shared IP, so Update deletes it first.
+const AnnotationReplacedMachineID = "fly-tunnel-operator.dev/replaced-machine-id"
+
+// replaceMachine applies input by creating a new Machine and destroying the
+// old one, for config changes the Machines API refuses to apply in place. The
+// dedicated IP belongs to the Fly App, so it carries over to the new Machine;
+// the old Machine's region is kept as well. The machine-id annotation is
+// switched to the new Machine, and the old one recorded in
+// AnnotationReplacedMachineID, before the old one is deleted, so a failed
+// delete is retried by the next Update.
+func (m *Manager) replaceMachine(ctx context.Context, svc *corev1.Service, flyAppName, oldID string, input flyio.CreateMachineInput) error {
+	logger := log.FromContext(ctx)
+
+	if old, err := m.flyClient.GetMachine(ctx, flyAppName, oldID); err == nil && old.Region != "" {
+		input.Region = old.Region
+	}
+
+	m.event(svc, corev1.EventTypeNormal, "ReplacingMachine",
+		"Machine %s rejected an in-place update; replacing it", oldID)
+
+	machine, err := m.flyClient.CreateMachine(ctx, flyAppName, input)
+	if err != nil {
+		m.event(svc, corev1.EventTypeWarning, "MachineReplaceFailed", "Creating replacement Machine: %v", err)
+		return fmt.Errorf("creating replacement machine: %w", err)
+	}
+	if err := m.flyClient.WaitForMachine(ctx, flyAppName, machine.ID, machine.InstanceID, "started", m.machineStartTimeout(svc)); err != nil {
+		_ = m.flyClient.DeleteMachine(ctx, flyAppName, machine.ID)
+		m.event(svc, corev1.EventTypeWarning, "MachineReplaceFailed", "Replacement Machine %s did not start: %v", machine.ID, err)
+		return fmt.Errorf("waiting for replacement machine to start: %w", err)
+	}
+
+	patch := client.MergeFrom(svc.DeepCopy())
+	svc.Annotations[AnnotationMachineID] = machine.ID
+	svc.Annotations[AnnotationReplacedMachineID] = oldID
+	if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+		_ = m.flyClient.DeleteMachine(ctx, flyAppName, machine.ID)
+		svc.Annotations[AnnotationMachineID] = oldID
+		delete(svc.Annotations, AnnotationReplacedMachineID)
+		return fmt.Errorf("recording replacement machine ID: %w", err)
+	}
+
+	if err := m.deleteReplacedMachine(ctx, svc, flyAppName); err != nil {
+		return err
+	}
+
+	logger.Info("Replaced fly.io Machine", "oldMachineID", oldID, "machineID", machine.ID)
+	m.event(svc, corev1.EventTypeNormal, "MachineReplaced", "Replaced Machine %s with %s", oldID, machine.ID)
+	return nil
+}
+
+// deleteReplacedMachine deletes the Machine recorded in
+// AnnotationReplacedMachineID, if any, and clears the annotation.
+func (m *Manager) deleteReplacedMachine(ctx context.Context, svc *corev1.Service, flyAppName string) error {
+	oldID := svc.Annotations[AnnotationReplacedMachineID]
+	if oldID == "" {
+		return nil
+	}
+	if err := ignoreFlyNotFound(m.flyClient.DeleteMachine(ctx, flyAppName, oldID)); err != nil {
+		m.event(svc, corev1.EventTypeWarning, "MachineReplaceFailed", "Deleting replaced Machine %s: %v", oldID, err)
+		return fmt.Errorf("deleting replaced machine %s: %w", oldID, err)
+	}
+	patch := client.MergeFrom(svc.DeepCopy())
+	delete(svc.Annotations, AnnotationReplacedMachineID)
+	if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("clearing replaced machine ID: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// AnnotationFrpcReplicas sets how many frpc pods serve the Service. With
+// more than one, every TCP proxy joins an frp load balancing group, so frps
+// spreads connections across the replicas and keeps serving while one is
+// down.
+const AnnotationFrpcReplicas = "fly-tunnel-operator.dev/frpc-replicas"
+
+const (
+	// frpcPodNameEnv carries the frpc pod name into its config.
+	frpcPodNameEnv = "FRPC_POD_NAME"
+
+	// frpcReplicaUser makes the frpc user the pod name. frps prefixes proxy
+	// names with the user, so replicas registering the same proxies do not
+	// clash.
+	frpcReplicaUser = "{{ .Envs." + frpcPodNameEnv + " }}"
+)
+
+// frpcReplicas returns the number of frpc pods requested for svc.
+func frpcReplicas(svc *corev1.Service) (int32, error) {
+	value := svc.Annotations[AnnotationFrpcReplicas]
+	if value == "" {
+		return 1, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive integer", AnnotationFrpcReplicas, value)
+	}
+	if n > 1 && frp.RandomRemotePorts(svc) {
+		// Each replica would be handed its own ports.
+		return 0, fmt.Errorf("%s greater than 1 cannot be combined with %s", AnnotationFrpcReplicas, frp.AnnotationRandomRemotePorts)
+	}
+	return int32(n), nil
+}
+
+// loadBalancerGroupKey derives the key frpc replicas join their proxies'
+// load balancing groups with from the tunnel's auth token, so only clients
+// of this tunnel can join them.
+func loadBalancerGroupKey(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte("load-balancer-group:"+token)))[:32]
+}
@@ -0,0 +1,129 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestProvision_FrpcReplicas(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("dns", "default",
+		corev1.ServicePort{Name: "tcp", Port: 53, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "udp", Port: 53, Protocol: corev1.ProtocolUDP},
+	)
+	svc.Annotations[tunnel.AnnotationFrpcReplicas] = "3"
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment, Namespace: testNamespace}, &deploy); err != nil {
+		t.Fatalf("getting frpc deployment: %v", err)
+	}
+	if got := *deploy.Spec.Replicas; got != 3 {
+		t.Errorf("expected 3 frpc replicas, got %d", got)
+	}
+	env := deploy.Spec.Template.Spec.Containers[0].Env
+	if len(env) != 1 || env[0].ValueFrom == nil || env[0].ValueFrom.FieldRef.FieldPath != "metadata.name" {
+		t.Errorf("expected the pod name in the frpc environment, got %+v", env)
+	}
+
+	c, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+	if err != nil {
+		t.Fatalf("parsing frpc config: %v", err)
+	}
+	if !strings.Contains(c.User, ".Envs.") {
+		t.Errorf("expected a per-pod frpc user, got %q", c.User)
+	}
+	tcp := c.ProxyByName("dns-tcp")
+	if tcp == nil || tcp.LoadBalancer == nil || tcp.LoadBalancer.Group != "dns-tcp" || tcp.LoadBalancer.GroupKey == "" {
+		t.Fatalf("expected the TCP proxy in a load balancing group, got %+v", tcp)
+	}
+	if tcp.LoadBalancer.GroupKey == c.Auth.Token {
+		t.Error("expected the group key not to be the auth token")
+	}
+	if udp := c.ProxyByName("dns-udp"); udp == nil || udp.LoadBalancer != nil {
+		t.Errorf("expected the UDP proxy outside any group, got %+v", udp)
+	}
+}
+
+func TestProvision_FrpcReplicasDefault(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	var deploy appsv1.Deployment
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment, Namespace: testNamespace}, &deploy); err != nil {
+		t.Fatalf("getting frpc deployment: %v", err)
+	}
+	if got := *deploy.Spec.Replicas; got != 1 {
+		t.Errorf("expected 1 frpc replica, got %d", got)
+	}
+	c, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+	if err != nil {
+		t.Fatalf("parsing frpc config: %v", err)
+	}
+	if c.User != "default-web" || c.Proxies[0].LoadBalancer != nil {
+		t.Errorf("expected the Service's own user and no load balancing with a single replica, got user %q and %+v", c.User, c.Proxies[0].LoadBalancer)
+	}
+}
+
+func TestProvision_InvalidFrpcReplicas(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		random  bool
+		wantErr string
+	}{
+		{value: "0", wantErr: "must be a positive integer"},
+		{value: "-1", wantErr: "must be a positive integer"},
+		{value: "two", wantErr: "must be a positive integer"},
+		{value: "2", random: true, wantErr: "cannot be combined"},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+			mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+			svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+			svc.Annotations[tunnel.AnnotationFrpcReplicas] = tt.value
+			if tt.random {
+				svc.Annotations[frp.AnnotationRandomRemotePorts] = "true"
+			}
+			_, err := mgr.Provision(context.Background(), svc)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.Is(err, tunnel.ErrPermanent) {
+				t.Fatalf("expected a permanent error containing %q, got %v", tt.wantErr, err)
+			}
+			if server.AppCount() != 0 {
+				t.Errorf("expected nothing to be provisioned, got %d apps", server.AppCount())
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// AnnotationFrpcNodeSelector constrains the frpc pods to nodes with
+	// these labels, as comma-separated key=value pairs. It replaces the
+	// operator-wide default.
+	AnnotationFrpcNodeSelector = "fly-tunnel-operator.dev/frpc-node-selector"
+
+	// AnnotationFrpcTolerations lets the frpc pods onto tainted nodes, as a
+	// JSON array of Pod tolerations.
+	AnnotationFrpcTolerations = "fly-tunnel-operator.dev/frpc-tolerations"
+
+	// AnnotationFrpcAffinity sets the affinity of the frpc pods, as a JSON
+	// Pod affinity object.
+	AnnotationFrpcAffinity = "fly-tunnel-operator.dev/frpc-affinity"
+)
+
+// frpcScheduling is where the frpc pods of a tunnel may run.
+type frpcScheduling struct {
+	nodeSelector map[string]string
+	tolerations  []corev1.Toleration
+	affinity     *corev1.Affinity
+}
+
+// ParseNodeSelector parses comma-separated key=value pairs, e.g.
+// "kubernetes.io/os=linux,egress=fly", into a node selector.
+func ParseNodeSelector(value string) (map[string]string, error) {
+	selector := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(pair, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a key=value pair", pair)
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label key %q: %s", key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(val); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label value %q: %s", val, strings.Join(errs, "; "))
+		}
+		selector[key] = val
+	}
+	if len(selector) == 0 {
+		return nil, nil
+	}
+	return selector, nil
+}
+
+// frpcSchedulingFor returns where the frpc pods of svc may run, from its
+// annotations and the operator-wide default node selector.
+func frpcSchedulingFor(svc *corev1.Service, defaultNodeSelector map[string]string) (frpcScheduling, error) {
+	s := frpcScheduling{nodeSelector: defaultNodeSelector}
+	if value, ok := svc.Annotations[AnnotationFrpcNodeSelector]; ok {
+		selector, err := ParseNodeSelector(value)
+		if err != nil {
+			return s, fmt.Errorf("invalid %s: %w", AnnotationFrpcNodeSelector, err)
+		}
+		s.nodeSelector = selector
+	}
+	if value := svc.Annotations[AnnotationFrpcTolerations]; value != "" {
+		if err := json.Unmarshal([]byte(value), &s.tolerations); err != nil {
+			return s, fmt.Errorf("invalid %s: must be a JSON array of tolerations: %w", AnnotationFrpcTolerations, err)
+		}
+		for _, t := range s.tolerations {
+			if t.Key == "" && t.Operator != corev1.TolerationOpExists {
+				return s, fmt.Errorf("invalid %s: a toleration without a key must use operator Exists", AnnotationFrpcTolerations)
+			}
+		}
+	}
+	if value := svc.Annotations[AnnotationFrpcAffinity]; value != "" {
+		s.affinity = &corev1.Affinity{}
+		if err := json.Unmarshal([]byte(value), s.affinity); err != nil {
+			return s, fmt.Errorf("invalid %s: must be a JSON affinity object: %w", AnnotationFrpcAffinity, err)
+		}
+	}
+	return s, nil
+}
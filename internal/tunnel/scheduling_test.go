@@ -0,0 +1,102 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestProvision_FrpcScheduling(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{
+			name: "operator default",
+			want: map[string]string{"egress": "fly"},
+		},
+		{
+			name:        "annotation replaces the default",
+			annotations: map[string]string{tunnel.AnnotationFrpcNodeSelector: "kubernetes.io/os=linux, pool=edge"},
+			want:        map[string]string{"kubernetes.io/os": "linux", "pool": "edge"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+			config := newTestConfig()
+			config.FrpcNodeSelector = map[string]string{"egress": "fly"}
+			mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+			svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+			for k, v := range tt.annotations {
+				svc.Annotations[k] = v
+			}
+			svc.Annotations[tunnel.AnnotationFrpcTolerations] = `[{"key":"dedicated","operator":"Equal","value":"edge","effect":"NoSchedule"}]`
+
+			result, err := mgr.Provision(context.Background(), svc)
+			if err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+			var deploy appsv1.Deployment
+			if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: result.FrpcDeployment, Namespace: testNamespace}, &deploy); err != nil {
+				t.Fatalf("getting frpc deployment: %v", err)
+			}
+			pod := deploy.Spec.Template.Spec
+			if len(pod.NodeSelector) != len(tt.want) {
+				t.Errorf("expected node selector %v, got %v", tt.want, pod.NodeSelector)
+			}
+			for k, v := range tt.want {
+				if pod.NodeSelector[k] != v {
+					t.Errorf("expected node selector %v, got %v", tt.want, pod.NodeSelector)
+				}
+			}
+			if len(pod.Tolerations) != 1 || pod.Tolerations[0].Key != "dedicated" || pod.Tolerations[0].Effect != corev1.TaintEffectNoSchedule {
+				t.Errorf("expected the dedicated=edge toleration, got %+v", pod.Tolerations)
+			}
+		})
+	}
+}
+
+func TestProvision_InvalidFrpcScheduling(t *testing.T) {
+	tests := map[string]struct {
+		annotation, value, wantErr string
+	}{
+		"selector without value": {tunnel.AnnotationFrpcNodeSelector, "egress", "not a key=value pair"},
+		"bad selector key":       {tunnel.AnnotationFrpcNodeSelector, "bad key=fly", "invalid label key"},
+		"tolerations not JSON":   {tunnel.AnnotationFrpcTolerations, "dedicated=edge:NoSchedule", "JSON array of tolerations"},
+		"affinity not JSON":      {tunnel.AnnotationFrpcAffinity, "zone=a", "JSON affinity object"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+			mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+			svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+			svc.Annotations[tt.annotation] = tt.value
+			_, err := mgr.Provision(context.Background(), svc)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.Is(err, tunnel.ErrPermanent) {
+				t.Fatalf("expected a permanent error containing %q, got %v", tt.wantErr, err)
+			}
+			if server.AppCount() != 0 {
+				t.Errorf("expected nothing to be provisioned, got %d apps", server.AppCount())
+			}
+		})
+	}
+}
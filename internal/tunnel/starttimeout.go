@@ -0,0 +1,42 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AnnotationMachineStartTimeout overrides, for one Service, how long to wait
+// for its Machine to start. The value is a Go duration such as "5m".
+const AnnotationMachineStartTimeout = "fly-tunnel-operator.dev/machine-start-timeout"
+
+// DefaultMachineStartTimeout is used when Config.MachineStartTimeout is unset.
+const DefaultMachineStartTimeout = 120 * time.Second
+
+// parseMachineStartTimeout returns the timeout set by
+// AnnotationMachineStartTimeout, or 0 if the annotation is absent.
+func parseMachineStartTimeout(svc *corev1.Service) (time.Duration, error) {
+	value := svc.Annotations[AnnotationMachineStartTimeout]
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration such as \"90s\" or \"5m\"", AnnotationMachineStartTimeout, value)
+	}
+	return d, nil
+}
+
+// machineStartTimeout returns how long to wait for the Machine of svc to
+// start. An invalid annotation is rejected by validateAnnotations before any
+// Machine is touched, so it falls back to the operator default here.
+func (m *Manager) machineStartTimeout(svc *corev1.Service) time.Duration {
+	if d, err := parseMachineStartTimeout(svc); err == nil && d > 0 {
+		return d
+	}
+	if m.config.MachineStartTimeout > 0 {
+		return m.config.MachineStartTimeout
+	}
+	return DefaultMachineStartTimeout
+}
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// AnnotationSuspend set to "true" stops the tunnel's fly.io Machine to
+	// stop compute billing. The App, IP and frps config are kept, so
+	// removing the annotation starts the Machine and the tunnel resumes.
+	AnnotationSuspend = "fly-tunnel-operator.dev/suspend"
+
+	// AnnotationMachineStopped records that the operator stopped the
+	// Machine for AnnotationSuspend.
+	AnnotationMachineStopped = "fly-tunnel-operator.dev/machine-stopped"
+)
+
+// Suspended reports whether svc asks for its tunnel to be suspended.
+func Suspended(svc *corev1.Service) bool {
+	return svc.Annotations[AnnotationSuspend] == "true"
+}
+
+// MachineStopped reports whether the Machine of svc was stopped by a
+// suspend and has not been started again.
+func MachineStopped(svc *corev1.Service) bool {
+	return svc.Annotations[AnnotationMachineStopped] == "true"
+}
+
+// suspend stops the Machine of svc, unless it already did.
+func (m *Manager) suspend(ctx context.Context, svc *corev1.Service, flyAppName, machineID string) error {
+	if MachineStopped(svc) || machineID == "" {
+		return nil
+	}
+	log.FromContext(ctx).Info("Suspending tunnel; stopping fly.io Machine", "machineID", machineID)
+	machine, err := m.flyClient.GetMachine(ctx, flyAppName, machineID)
+	if err != nil {
+		return fmt.Errorf("getting fly machine: %w", err)
+	}
+	if err := m.flyClient.StopMachine(ctx, flyAppName, machineID); err != nil {
+		return fmt.Errorf("stopping fly machine: %w", err)
+	}
+	if err := m.flyClient.WaitForMachine(ctx, flyAppName, machineID, machine.InstanceID, "stopped", m.machineStartTimeout(svc)); err != nil {
+		return fmt.Errorf("waiting for machine to stop: %w", err)
+	}
+	if err := m.setMachineStopped(ctx, svc, true); err != nil {
+		return err
+	}
+	m.event(svc, corev1.EventTypeNormal, "TunnelSuspended", "Stopped fly.io Machine %s", machineID)
+	return nil
+}
+
+// resume starts the Machine of svc again after a suspend.
+func (m *Manager) resume(ctx context.Context, svc *corev1.Service, flyAppName, machineID string) error {
+	if !MachineStopped(svc) {
+		return nil
+	}
+	log.FromContext(ctx).Info("Resuming tunnel; starting fly.io Machine", "machineID", machineID)
+	if err := m.flyClient.StartMachine(ctx, flyAppName, machineID); err != nil {
+		return fmt.Errorf("starting fly machine: %w", err)
+	}
+	machine, err := m.flyClient.GetMachine(ctx, flyAppName, machineID)
+	if err != nil {
+		return fmt.Errorf("getting fly machine: %w", err)
+	}
+	if err := m.flyClient.WaitForMachine(ctx, flyAppName, machineID, machine.InstanceID, "started", m.machineStartTimeout(svc)); err != nil {
+		return fmt.Errorf("waiting for machine to start: %w", err)
+	}
+	if err := m.setMachineStopped(ctx, svc, false); err != nil {
+		return err
+	}
+	m.event(svc, corev1.EventTypeNormal, "TunnelResumed", "Started fly.io Machine %s", machineID)
+	return nil
+}
+
+// setMachineStopped records on svc whether its Machine is stopped.
+func (m *Manager) setMachineStopped(ctx context.Context, svc *corev1.Service, stopped bool) error {
+	patch := client.MergeFrom(svc.DeepCopy())
+	if stopped {
+		svc.Annotations[AnnotationMachineStopped] = "true"
+	} else {
+		delete(svc.Annotations, AnnotationMachineStopped)
+	}
+	if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("recording machine state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package tunnel_test
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestUpdate_SuspendAndResume(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace(), svc).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	if err := kubeClient.Update(context.Background(), svc); err != nil {
+		t.Fatalf("recording tunnel state: %v", err)
+	}
+
+	var updates int
+	server.OnUpdateMachine = func(string, string, flyio.CreateMachineInput) error {
+		updates++
+		return nil
+	}
+	update := func() {
+		t.Helper()
+		if err := kubeClient.Update(context.Background(), svc); err != nil {
+			t.Fatalf("updating service: %v", err)
+		}
+		if _, err := mgr.Update(context.Background(), svc); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		if err := kubeClient.Get(context.Background(), client.ObjectKeyFromObject(svc), svc); err != nil {
+			t.Fatalf("getting service: %v", err)
+		}
+	}
+
+	// Suspending stops the Machine and keeps the App and IP.
+	svc.Annotations[tunnel.AnnotationSuspend] = "true"
+	update()
+	if state := server.GetMachines()[result.MachineID].State; state != "stopped" {
+		t.Fatalf("expected the Machine to be stopped, got %q", state)
+	}
+	if !tunnel.MachineStopped(svc) {
+		t.Error("expected the stopped Machine to be recorded")
+	}
+	if server.AppCount() != 1 || server.IPCount() != 1 {
+		t.Errorf("expected the App and IP to be kept, got %d apps and %d IPs", server.AppCount(), server.IPCount())
+	}
+
+	// Updates while suspended leave the Machine stopped.
+	update()
+	if updates != 0 {
+		t.Errorf("expected no Machine updates while suspended, got %d", updates)
+	}
+	if state := server.GetMachines()[result.MachineID].State; state != "stopped" {
+		t.Errorf("expected the Machine to stay stopped, got %q", state)
+	}
+
+	// Resuming starts it again.
+	delete(svc.Annotations, tunnel.AnnotationSuspend)
+	update()
+	if state := server.GetMachines()[result.MachineID].State; state != "started" {
+		t.Errorf("expected the Machine to be started, got %q", state)
+	}
+	if tunnel.MachineStopped(svc) {
+		t.Error("expected the stopped Machine record to be cleared")
+	}
+	if server.MachineCount() != 1 {
+		t.Errorf("expected the same Machine to be resumed, got %d machines", server.MachineCount())
+	}
+}
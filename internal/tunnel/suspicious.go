@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// AnnotationAllowPublicPorts silences the warning about tunneling ports that
+// look cluster-internal. Set it to "true" once the exposure is intended.
+const AnnotationAllowPublicPorts = "fly-tunnel-operator.dev/allow-public-ports"
+
+// DefaultSuspiciousPorts are port names and numbers that usually serve
+// cluster-internal traffic (metrics, health, debugging).
+var DefaultSuspiciousPorts = []string{
+	"metrics", "health", "healthz", "admin", "debug", "pprof",
+	"8081", "9090", "9100", "6060",
+}
+
+// WithSuspiciousPorts replaces the port names and numbers that trigger a
+// warning when tunneled publicly. An empty list disables the warning.
+func (m *Manager) WithSuspiciousPorts(patterns []string) *Manager {
+	m.suspiciousPorts = patterns
+	return m
+}
+
+// suspiciousPorts returns the tunneled ports of svc that match patterns, as
+// "name (port)" or "port". A number matches the port number; a name matches
+// the port name or any dash-separated part of it, so "metrics" also matches
+// "http-metrics".
+func suspiciousPorts(svc *corev1.Service, patterns []string) []string {
+	var found []string
+	for _, port := range svc.Spec.Ports {
+		if frp.ClusterOnly(svc, port) || !frp.Supported(port) || !matchesSuspicious(port, patterns) {
+			continue
+		}
+		if port.Name != "" {
+			found = append(found, fmt.Sprintf("%s (%d)", port.Name, port.Port))
+		} else {
+			found = append(found, strconv.Itoa(int(port.Port)))
+		}
+	}
+	return found
+}
+
+func matchesSuspicious(port corev1.ServicePort, patterns []string) bool {
+	number := strconv.Itoa(int(port.Port))
+	parts := strings.Split(strings.ToLower(port.Name), "-")
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if pattern == number {
+			return true
+		}
+		for _, part := range parts {
+			if part == pattern {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// warnSuspiciousPorts emits a Warning event listing tunneled ports that look
+// cluster-internal, unless the Service explicitly allows them. It never
+// blocks provisioning.
+func (m *Manager) warnSuspiciousPorts(svc *corev1.Service) {
+	if svc.Annotations[AnnotationAllowPublicPorts] == "true" {
+		return
+	}
+	found := suspiciousPorts(svc, m.suspiciousPorts)
+	if len(found) == 0 {
+		return
+	}
+	m.event(svc, corev1.EventTypeWarning, "SuspiciousPublicPorts",
+		"Ports %s look cluster-internal but will be exposed publicly; list them in %s to keep them off the tunnel, or set %s=true if intended",
+		strings.Join(found, ", "), frp.AnnotationClusterOnlyPorts, AnnotationAllowPublicPorts)
+}
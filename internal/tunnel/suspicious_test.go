@@ -0,0 +1,114 @@
+package tunnel_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// suspiciousPortsWarning provisions svc with patterns as the suspicious
+// ports and returns the SuspiciousPublicPorts event it drew, or "".
+func suspiciousPortsWarning(t *testing.T, svc *corev1.Service, patterns []string) string {
+	t.Helper()
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	recorder := record.NewFakeRecorder(10)
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig()).
+		WithEventRecorder(recorder).
+		WithSuspiciousPorts(patterns)
+
+	if _, err := mgr.Provision(context.Background(), svc); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	for len(recorder.Events) > 0 {
+		if e := <-recorder.Events; strings.Contains(e, "SuspiciousPublicPorts") {
+			return e
+		}
+	}
+	return ""
+}
+
+func TestSuspiciousPorts(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ports       []corev1.ServicePort
+		want        string // listed ports; "" for no warning
+	}{
+		{
+			name:  "public ports only",
+			ports: []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "https", Port: 443}},
+		},
+		{
+			name:  "matches by name",
+			ports: []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "metrics", Port: 8000}},
+			want:  "metrics (8000)",
+		},
+		{
+			name:  "matches a dash-separated part of the name",
+			ports: []corev1.ServicePort{{Name: "http-metrics", Port: 8000}},
+			want:  "http-metrics (8000)",
+		},
+		{
+			name:  "does not match substrings",
+			ports: []corev1.ServicePort{{Name: "healthcare", Port: 8000}},
+		},
+		{
+			name:  "matches by number",
+			ports: []corev1.ServicePort{{Name: "web", Port: 9090}, {Name: "alt", Port: 8081}},
+			want:  "web (9090), alt (8081)",
+		},
+		{
+			name:        "cluster-only ports are not exposed",
+			annotations: map[string]string{frp.AnnotationClusterOnlyPorts: "metrics"},
+			ports:       []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "metrics", Port: 9090}},
+		},
+		{
+			name:        "allowed explicitly",
+			annotations: map[string]string{tunnel.AnnotationAllowPublicPorts: "true"},
+			ports:       []corev1.ServicePort{{Name: "metrics", Port: 9090}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := testService("app", "default", tt.ports...)
+			for k, v := range tt.annotations {
+				svc.Annotations[k] = v
+			}
+			got := suspiciousPortsWarning(t, svc, tunnel.DefaultSuspiciousPorts)
+			if tt.want == "" {
+				if got != "" {
+					t.Errorf("expected no warning, got %q", got)
+				}
+			} else if !strings.Contains(got, "Ports "+tt.want+" look") {
+				t.Errorf("expected a warning listing %s, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSuspiciousPorts_CustomList(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Name: "metrics", Port: 9090},
+		{Name: "grpc-internal", Port: 5000},
+	}
+
+	got := suspiciousPortsWarning(t, testService("app", "default", ports...), []string{"internal", "9090"})
+	if want := "Ports metrics (9090), grpc-internal (5000) look"; !strings.Contains(got, want) {
+		t.Errorf("expected a warning containing %q, got %q", want, got)
+	}
+	if got := suspiciousPortsWarning(t, testService("app", "default", ports...), nil); got != "" {
+		t.Errorf("expected an empty list to disable detection, got %q", got)
+	}
+}
@@ -0,0 +1,139 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// teardownSteps returns fly_tunnel_operator_teardown_steps_total by step and
+// outcome, e.g. "delete-app/failure".
+func teardownSteps(t *testing.T) map[string]float64 {
+	t.Helper()
+	families, err := ctrlmetrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	counts := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "fly_tunnel_operator_teardown_steps_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			counts[labels["step"]+"/"+labels["outcome"]] = metric.GetCounter().GetValue()
+		}
+	}
+	return counts
+}
+
+func TestTeardown_StepMetrics(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+
+	server.OnDeleteApp = func(string) error { return errors.New("delete failed") }
+
+	before := teardownSteps(t)
+	if err := mgr.Teardown(context.Background(), svc); err == nil {
+		t.Fatal("expected Teardown to return the App deletion failure")
+	}
+	after := teardownSteps(t)
+
+	want := map[string]float64{
+		// The frpc Deployment and config, its canary, the dashboard Secret
+		// and the endpoints Service.
+		"frpc-resources/success": 4,
+		"delete-app/failure":     1,
+	}
+	for key, n := range want {
+		if got := after[key] - before[key]; got != n {
+			t.Errorf("%s: expected %v more, got %v", key, n, got)
+		}
+	}
+	// The App is recorded, so deleting it takes the IP and Machine with it.
+	for _, key := range []string{"release-ip/success", "release-ip/failure", "delete-machine/success", "delete-machine/failure", "delete-app/success"} {
+		if after[key] != before[key] {
+			t.Errorf("%s: expected no change, got %v more", key, after[key]-before[key])
+		}
+	}
+
+	server.OnDeleteApp = nil
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("retried Teardown failed: %v", err)
+	}
+	if server.HasApp(result.FlyApp) || server.IPCount() != 0 || server.MachineCount() != 0 {
+		t.Errorf("expected the retried Teardown to remove the App, IP and Machine")
+	}
+}
+
+func TestTeardown_ResourcesAlreadyGone(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	scheme := newTestScheme()
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(testOperatorNamespace()).Build()
+	flyClient := newTestFlyClient(server)
+	mgr := tunnel.NewManager(flyClient, kubeClient, newTestConfig())
+
+	svc := testService("gone", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	// Without a recorded App, Teardown releases the IP and deletes the
+	// Machine itself before deleting the App by its conventional name.
+	delete(svc.Annotations, tunnel.AnnotationFlyApp)
+
+	// The IP and Machine were removed out of band, e.g. from the Fly.io
+	// dashboard.
+	if err := flyClient.ReleaseIPAddress(context.Background(), result.FlyApp, result.IPID); err != nil {
+		t.Fatalf("ReleaseIPAddress failed: %v", err)
+	}
+	if err := flyClient.DeleteMachine(context.Background(), result.FlyApp, result.MachineID); err != nil {
+		t.Fatalf("DeleteMachine failed: %v", err)
+	}
+
+	before := teardownSteps(t)
+	if err := mgr.Teardown(context.Background(), svc); err != nil {
+		t.Fatalf("Teardown failed: %v", err)
+	}
+	after := teardownSteps(t)
+
+	for _, step := range []string{"release-ip", "delete-machine"} {
+		if got := after[step+"/success"] - before[step+"/success"]; got != 1 {
+			t.Errorf("%s: expected the missing resource to count as removed, got %v more successes", step, got)
+		}
+		if after[step+"/failure"] != before[step+"/failure"] {
+			t.Errorf("%s: expected no failure for a missing resource", step)
+		}
+	}
+	if server.HasApp(result.FlyApp) {
+		t.Errorf("expected the App to be deleted after the missing IP and Machine")
+	}
+}
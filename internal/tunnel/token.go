@@ -0,0 +1,137 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+const (
+	// AnnotationRotateToken requests a new frp auth token for the tunnel
+	// whenever its value changes; a timestamp is the natural choice.
+	AnnotationRotateToken = "fly-tunnel-operator.dev/rotate-token"
+
+	// AnnotationRotateTokenObserved records the AnnotationRotateToken value
+	// the current token was issued for.
+	AnnotationRotateTokenObserved = "fly-tunnel-operator.dev/rotate-token-observed"
+)
+
+// frpcTokenKey is the key of the frpc config Secret holding the tunnel's
+// auth token. The Secret is the token's source of truth; frps only ever
+// receives it through the App secret.
+const frpcTokenKey = "token"
+
+// frpcAdminPasswordKey is the key of the frpc config Secret holding the
+// password of the frpc admin API, for tunnels with random remote ports.
+const frpcAdminPasswordKey = "admin-password"
+
+// frpcSecretData returns the entries of the frpc config Secret besides the
+// config itself.
+func frpcSecretData(secrets tunnelSecrets) map[string][]byte {
+	data := map[string][]byte{frpcTokenKey: []byte(secrets.token)}
+	if secrets.adminPassword != "" {
+		data[frpcAdminPasswordKey] = []byte(secrets.adminPassword)
+	}
+	return data
+}
+
+// newToken returns a random frp auth token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating frp auth token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// currentToken returns the auth token recorded in the frpc config Secret of
+// deployName in namespace, or "" if there is none. Tunnels created before
+// authentication was introduced have none.
+func (m *Manager) currentToken(ctx context.Context, namespace, deployName string) (string, error) {
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: frpcConfigName(deployName), Namespace: namespace}
+	if err := m.kubeClient.Get(ctx, key, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("getting frpc config secret: %w", err)
+	}
+	return string(secret.Data[frpcTokenKey]), nil
+}
+
+// adminPasswordFor returns the frpc admin API password of svc: the one
+// recorded in the frpc config Secret of deployName in namespace, a new one if
+// there is none yet, or "" if svc does not need the admin API.
+func (m *Manager) adminPasswordFor(ctx context.Context, svc *corev1.Service, namespace, deployName string) (string, error) {
+	if !frp.RandomRemotePorts(svc) {
+		return "", nil
+	}
+	var secret corev1.Secret
+	key := types.NamespacedName{Name: frpcConfigName(deployName), Namespace: namespace}
+	if err := m.kubeClient.Get(ctx, key, &secret); err != nil && !apierrors.IsNotFound(err) {
+		return "", fmt.Errorf("getting frpc config secret: %w", err)
+	}
+	if password := string(secret.Data[frpcAdminPasswordKey]); password != "" {
+		return password, nil
+	}
+	return newToken()
+}
+
+// rotationRequested reports whether svc asks for a token it has not been
+// issued yet.
+func rotationRequested(svc *corev1.Service) bool {
+	requested := svc.Annotations[AnnotationRotateToken]
+	return requested != "" && requested != svc.Annotations[AnnotationRotateTokenObserved]
+}
+
+// rotateToken moves frps to a new token ahead of frpc. frps is updated and
+// confirmed started on the new token before Update rewrites the frpc Secret:
+// an frpc restarted onto a token frps does not accept yet would never
+// reconnect. It returns secrets with the new token for Update to hand to
+// frpc.
+func (m *Manager) rotateToken(ctx context.Context, svc *corev1.Service, flyAppName, machineID, publicIP string, secrets tunnelSecrets) (tunnelSecrets, error) {
+	logger := log.FromContext(ctx)
+
+	token, err := newToken()
+	if err != nil {
+		return secrets, err
+	}
+	secrets.token = token
+	if machineID == "" {
+		// No frps to move; frpc alone picks up the token.
+		return secrets, nil
+	}
+
+	logger.Info("Rotating frp auth token", "app", flyAppName, "machineID", machineID)
+	if _, err := m.updateFrps(ctx, svc, flyAppName, machineID, publicIP, secrets, true); err != nil {
+		return secrets, fmt.Errorf("moving frps to the new token: %w", err)
+	}
+	return secrets, nil
+}
+
+// recordTokenRotation marks the rotation requested by svc as done, once
+// frpc has been given the new token.
+func (m *Manager) recordTokenRotation(ctx context.Context, svc *corev1.Service) error {
+	requested := svc.Annotations[AnnotationRotateToken]
+	if requested == "" || requested == svc.Annotations[AnnotationRotateTokenObserved] {
+		m.event(svc, corev1.EventTypeNormal, "TokenIssued", "Issued an frp auth token to the tunnel")
+		return nil
+	}
+
+	patch := client.MergeFrom(svc.DeepCopy())
+	svc.Annotations[AnnotationRotateTokenObserved] = requested
+	if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("recording token rotation: %w", err)
+	}
+	m.event(svc, corev1.EventTypeNormal, "TokenRotated", "Rotated the frp auth token (%s=%s)", AnnotationRotateToken, requested)
+	return nil
+}
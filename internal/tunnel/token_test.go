@@ -0,0 +1,157 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// frpcToken returns the auth token recorded in the frpc config Secret.
+func frpcToken(t *testing.T, kubeClient client.Client, deployName string) string {
+	t.Helper()
+	var secret corev1.Secret
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: deployName + "-config", Namespace: testNamespace}, &secret); err != nil {
+		t.Fatalf("getting frpc config Secret: %v", err)
+	}
+	return string(secret.Data["token"])
+}
+
+// provisionForRotation provisions a tunnel for a stored Service and returns
+// it along with a log of frps and frpc writes made from then on.
+func provisionForRotation(t *testing.T, server *fakefly.Server) (*tunnel.Manager, client.Client, *corev1.Service, *[]string) {
+	t.Helper()
+	var calls []string
+	recording := false
+	record := func(call string) {
+		if recording {
+			calls = append(calls, call)
+		}
+	}
+	server.OnSetSecrets = func(string, map[string]string) error {
+		record("frps-secret")
+		return nil
+	}
+	server.OnUpdateMachine = func(string, string, flyio.CreateMachineInput) error {
+		record("update-machine")
+		return nil
+	}
+	server.OnWaitMachine = func(_, _, state string) error {
+		record("wait-" + state)
+		return nil
+	}
+
+	kubeClient := fake.NewClientBuilder().
+		WithScheme(newTestScheme()).
+		WithObjects(testOperatorNamespace()).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+				if _, ok := obj.(*corev1.Secret); ok {
+					record("frpc-secret")
+				}
+				return c.Update(ctx, obj, opts...)
+			},
+		}).
+		Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	annotateTunnelState(svc, result)
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating service: %v", err)
+	}
+	recording = true
+	return mgr, kubeClient, svc, &calls
+}
+
+func TestRotateToken_UpdatesFrpsBeforeFrpc(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	mgr, kubeClient, svc, calls := provisionForRotation(t, server)
+	deployName := svc.Annotations[tunnel.AnnotationFrpcDeployment]
+	flyApp := svc.Annotations[tunnel.AnnotationFlyApp]
+	oldToken := frpcToken(t, kubeClient, deployName)
+	if oldToken == "" || !strings.Contains(server.AppSecrets(flyApp)["FRP_SERVER_CONFIG"], oldToken) {
+		t.Fatalf("expected frpc and frps to share a token after Provision, got %q", oldToken)
+	}
+
+	svc.Annotations[tunnel.AnnotationRotateToken] = "2026-01-01T00:00:00Z"
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	want := []string{"frps-secret", "update-machine", "wait-started", "frpc-secret"}
+	if strings.Join(*calls, ",") != strings.Join(want, ",") {
+		t.Errorf("expected frps to start on the new token before frpc is touched, got %v", *calls)
+	}
+	newToken := frpcToken(t, kubeClient, deployName)
+	if newToken == "" || newToken == oldToken {
+		t.Errorf("expected a new frpc token, got %q", newToken)
+	}
+	if !strings.Contains(server.AppSecrets(flyApp)["FRP_SERVER_CONFIG"], newToken) {
+		t.Error("expected frps to be configured with the new token")
+	}
+	if !strings.Contains(frpcConfig(t, kubeClient, deployName), newToken) {
+		t.Error("expected frpc.toml to carry the new token")
+	}
+
+	var stored corev1.Service
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}, &stored); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	if got := stored.Annotations[tunnel.AnnotationRotateTokenObserved]; got != "2026-01-01T00:00:00Z" {
+		t.Errorf("expected the rotation to be recorded, got %q", got)
+	}
+
+	// The same request does not rotate again.
+	*calls = nil
+	if _, err := mgr.Update(context.Background(), svc); err != nil {
+		t.Fatalf("second Update failed: %v", err)
+	}
+	if got := frpcToken(t, kubeClient, deployName); got != newToken {
+		t.Errorf("expected the token to be kept, got %q", got)
+	}
+}
+
+func TestRotateToken_LeavesFrpcWhenFrpsDoesNotStart(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	mgr, kubeClient, svc, calls := provisionForRotation(t, server)
+	deployName := svc.Annotations[tunnel.AnnotationFrpcDeployment]
+	oldToken := frpcToken(t, kubeClient, deployName)
+
+	server.OnWaitMachine = func(string, string, string) error {
+		return errors.New("machine failed to start")
+	}
+	svc.Annotations[tunnel.AnnotationRotateToken] = "2026-01-01T00:00:00Z"
+	if _, err := mgr.Update(context.Background(), svc); err == nil {
+		t.Fatal("expected Update to fail")
+	}
+
+	for _, call := range *calls {
+		if call == "frpc-secret" {
+			t.Errorf("expected frpc to be left alone, got %v", *calls)
+		}
+	}
+	if got := frpcToken(t, kubeClient, deployName); got != oldToken {
+		t.Errorf("expected frpc to keep its token, got %q", got)
+	}
+}
@@ -0,0 +1,112 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+// exposesUDPPort reports whether machine publishes port over UDP.
+func exposesUDPPort(machine *flyio.Machine, port int) bool {
+	for _, svc := range machine.Config.Services {
+		if svc.Protocol == "udp" && svc.InternalPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProvision_FrpTransport(t *testing.T) {
+	tests := []struct {
+		protocol   string
+		wantUDP    bool
+		wantServer string
+	}{
+		{protocol: "websocket"},
+		{protocol: "quic", wantUDP: true, wantServer: "quicBindPort = 7000"},
+		{protocol: "kcp", wantUDP: true, wantServer: "kcpBindPort = 7000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			server := fakefly.NewServer()
+			defer server.Close()
+
+			kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+			mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+			svc := testService("web", "default",
+				corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			)
+			svc.Annotations[frp.AnnotationTransport] = tt.protocol
+			result, err := mgr.Provision(context.Background(), svc)
+			if err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			machine := server.GetMachines()[result.MachineID]
+			if got := exposesUDPPort(machine, 7000); got != tt.wantUDP {
+				t.Errorf("expected UDP control port on the Machine = %v, got %v", tt.wantUDP, got)
+			}
+			if config := server.AppSecrets(result.FlyApp)["FRP_SERVER_CONFIG"]; !strings.Contains(config, tt.wantServer) {
+				t.Errorf("expected %q in the frps config:\n%s", tt.wantServer, config)
+			}
+			config, err := frp.ParseClientConfig(frpcConfig(t, kubeClient, result.FrpcDeployment))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Transport == nil || config.Transport.Protocol != tt.protocol {
+				t.Errorf("expected transport protocol %q in the frpc config, got %+v", tt.protocol, config.Transport)
+			}
+		})
+	}
+}
+
+func TestProvision_InvalidFrpTransport(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[frp.AnnotationTransport] = "http2"
+	_, err := mgr.Provision(context.Background(), svc)
+	if !errors.Is(err, tunnel.ErrPermanent) || !strings.Contains(err.Error(), frp.AnnotationTransport) {
+		t.Fatalf("expected a permanent error naming %s, got %v", frp.AnnotationTransport, err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected nothing to be created, got %d apps", server.AppCount())
+	}
+}
+
+func TestProvision_UDPTransportAvoidsUDPServicePorts(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("game", "default",
+		corev1.ServicePort{Name: "game", Port: 7000, Protocol: corev1.ProtocolUDP},
+	)
+	svc.Annotations[frp.AnnotationTransport] = "quic"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if result.ControlPort == 7000 {
+		t.Error("expected the quic control port to move off the Service's UDP port")
+	}
+}
@@ -0,0 +1,247 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// MaxPublishedPorts caps the public ports of one tunnel, so a Service with
+// hundreds of ports is refused up front rather than by Fly.io halfway
+// through provisioning. Vhost proxies share one port per proxy type.
+const MaxPublishedPorts = 64
+
+// regionPattern matches a Fly.io region code, e.g. "ord" or "syd".
+var regionPattern = regexp.MustCompile(`^[a-z]{3}$`)
+
+// ValidationError lists every problem ValidateService found with a Service.
+type ValidationError struct {
+	Problems []error
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].Error()
+	}
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		problems[i] = problem.Error()
+	}
+	return fmt.Sprintf("%d problems: %s", len(e.Problems), strings.Join(problems, "; "))
+}
+
+func (e *ValidationError) Unwrap() []error {
+	return e.Problems
+}
+
+// ValidateService checks, without calling Fly.io, that a tunnel can be
+// provisioned for svc under config: that it has ports to publish, not more
+// than MaxPublishedPorts, and valid annotations. It returns a
+// *ValidationError listing every problem, or nil.
+func ValidateService(svc *corev1.Service, config Config) error {
+	var problems []error
+	if len(svc.Spec.Ports) == 0 {
+		problems = append(problems, errors.New("the Service has no ports"))
+	} else if n := len(publishedPortKeys(svc)); n == 0 {
+		problems = append(problems, fmt.Errorf("every port is listed in %s or has a protocol frp cannot tunnel; the tunnel would publish nothing", frp.AnnotationClusterOnlyPorts))
+	} else if n > MaxPublishedPorts {
+		problems = append(problems, fmt.Errorf("the Service publishes %d ports; a tunnel supports at most %d", n, MaxPublishedPorts))
+	}
+	for _, check := range annotationChecks {
+		if err := check(svc); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if tunnelGroup(svc) == "" {
+		if err := checkMaxPortsPerClient(svc, config.FrpsLimits.MaxPortsPerClient); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: problems}
+}
+
+// publishedPortKeys returns the distinct public ports of svc, vhost proxies
+// sharing one per type.
+func publishedPortKeys(svc *corev1.Service) map[string]bool {
+	keys := make(map[string]bool)
+	for _, p := range frp.PublishedPorts(svc) {
+		if p.Vhost() {
+			keys[p.Type] = true
+		} else {
+			keys[p.Key()] = true
+		}
+	}
+	return keys
+}
+
+// ValidateRegion returns an error if region is not a region code. Whether
+// Fly.io has the region is up to CheckRegion.
+func ValidateRegion(region string) error {
+	if !regionPattern.MatchString(region) {
+		return fmt.Errorf("region %q is not a Fly.io region code such as \"ord\"", region)
+	}
+	return nil
+}
+
+// validateRegion returns an error if AnnotationFlyRegion is not a region
+// code or RegionAuto.
+func validateRegion(svc *corev1.Service) error {
+	if region, ok := svc.Annotations[AnnotationFlyRegion]; ok && region != RegionAuto {
+		if err := ValidateRegion(region); err != nil {
+			return fmt.Errorf("invalid %s: %w", AnnotationFlyRegion, err)
+		}
+	}
+	return nil
+}
+
+// ValidateConfig checks the parts of config that would otherwise only fail
+// once the first Machine is created: FlyRegion and FlyMachineSize, and
+// those of ClassDefaults.
+func ValidateConfig(config Config) error {
+	var errs []error
+	if err := ValidateRegion(config.FlyRegion); err != nil {
+		errs = append(errs, fmt.Errorf("invalid Fly.io region: %w", err))
+	}
+	if config.FlyMachineSize != "" {
+		if _, err := ParseMachineSize(config.FlyMachineSize); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Fly.io Machine size: %w", err))
+		}
+	}
+	classes := make([]string, 0, len(config.ClassDefaults))
+	for class := range config.ClassDefaults {
+		classes = append(classes, class)
+	}
+	slices.Sort(classes)
+	for _, class := range classes {
+		defaults := config.ClassDefaults[class]
+		if defaults.FlyRegion != "" {
+			if err := ValidateRegion(defaults.FlyRegion); err != nil {
+				errs = append(errs, fmt.Errorf("invalid Fly.io region for class %q: %w", class, err))
+			}
+		}
+		if defaults.FlyMachineSize != "" {
+			if _, err := ParseMachineSize(defaults.FlyMachineSize); err != nil {
+				errs = append(errs, fmt.Errorf("invalid Fly.io Machine size for class %q: %w", class, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CheckRegion returns an error if Fly.io does not list region.
+func CheckRegion(ctx context.Context, flyClient *flyio.Client, region string) error {
+	regions, err := flyClient.ListRegions(ctx)
+	if err != nil {
+		return err
+	}
+	codes := make([]string, len(regions))
+	for i, r := range regions {
+		if r.Code == region {
+			return nil
+		}
+		codes[i] = r.Code
+	}
+	slices.Sort(codes)
+	return fmt.Errorf("region %q is not offered by Fly.io, which has %s", region, strings.Join(codes, ", "))
+}
+
+// knownAnnotations are the annotations in the operator's prefix that the
+// tunnel and frp packages read or write on Services. Per-port annotations
+// are recognized by frp.IsPortAnnotation.
+var knownAnnotations = []string{
+	AnnotationFlyApp,
+	AnnotationMachineID,
+	AnnotationReplacedMachineID,
+	AnnotationIPID,
+	AnnotationPublicIP,
+	AnnotationIPv6,
+	AnnotationIPv6ID,
+	AnnotationPublicIPv6,
+	AnnotationIPOwnership,
+	AnnotationAppOwnership,
+	AnnotationOperatorIdentity,
+	AnnotationFrpcDeployment,
+	AnnotationFrpcNamespace,
+	AnnotationTunnelGroup,
+	AnnotationFlyRegion,
+	AnnotationFlyMachineSize,
+	AnnotationMachineStartTimeout,
+	AnnotationFrpControlPort,
+	AnnotationControlPort,
+	AnnotationFrpsDashboardSecret,
+	AnnotationAssignedRemotePorts,
+	AnnotationStableIdentity,
+	AnnotationFrpOptionsFrom,
+	AnnotationLastFrpcError,
+	AnnotationRotateToken,
+	AnnotationRotateTokenObserved,
+	AnnotationFrpcImage,
+	AnnotationFrpsImage,
+	AnnotationOperatorVersion,
+	AnnotationLocalTarget,
+	AnnotationSuspend,
+	AnnotationMachineStopped,
+	AnnotationAllowPublicPorts,
+	AnnotationFrpcReplicas,
+	AnnotationFrpcCanary,
+	AnnotationFrpcCanaryPromote,
+	AnnotationFrpcCanaryPromoteObserved,
+	AnnotationFrpcConfigHash,
+	AnnotationFrpcCanaryConfigHash,
+	AnnotationFrpcCPURequest,
+	AnnotationFrpcCPULimit,
+	AnnotationFrpcMemoryRequest,
+	AnnotationFrpcMemoryLimit,
+	AnnotationFrpcNodeSelector,
+	AnnotationFrpcTolerations,
+	AnnotationFrpcAffinity,
+	frp.AnnotationPoolCount,
+	frp.AnnotationBandwidthLimit,
+	frp.AnnotationBandwidthLimitMode,
+	frp.AnnotationDualStackPorts,
+	frp.AnnotationClusterOnlyPorts,
+	frp.AnnotationFrpsDashboard,
+	frp.AnnotationMaxPortsPerClient,
+	frp.AnnotationHealthCheck,
+	frp.AnnotationHealthCheckPath,
+	frp.AnnotationHealthCheckInterval,
+	frp.AnnotationEncryption,
+	frp.AnnotationCompression,
+	frp.AnnotationTransport,
+	frp.AnnotationFrpsLogLevel,
+	frp.AnnotationFrpcLogLevel,
+	frp.AnnotationProxyProtocol,
+	frp.AnnotationClusterDomain,
+	frp.AnnotationRemotePort,
+	frp.AnnotationProxyType,
+	frp.AnnotationCustomDomains,
+	frp.AnnotationRandomRemotePorts,
+}
+
+// UnknownAnnotations returns, sorted, the annotations of svc in the
+// operator's prefix that neither the operator nor known names, such as
+// misspelled options.
+func UnknownAnnotations(svc *corev1.Service, known ...string) []string {
+	var unknown []string
+	for key := range svc.Annotations {
+		if !strings.HasPrefix(key, annotationPrefix) || frp.IsPortAnnotation(key) ||
+			slices.Contains(knownAnnotations, key) || slices.Contains(known, key) {
+			continue
+		}
+		unknown = append(unknown, key)
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,212 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestValidateService(t *testing.T) {
+	http := corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}
+	manyPorts := func(n int) []corev1.ServicePort {
+		ports := make([]corev1.ServicePort, n)
+		for i := range ports {
+			ports[i] = corev1.ServicePort{Name: fmt.Sprintf("p%d", i), Port: int32(1000 + i), Protocol: corev1.ProtocolTCP}
+		}
+		return ports
+	}
+	tests := []struct {
+		name        string
+		ports       []corev1.ServicePort
+		annotations map[string]string
+		config      tunnel.Config
+		want        []string // substrings, one per expected problem
+	}{
+		{name: "valid", ports: []corev1.ServicePort{http}},
+		{name: "no ports", want: []string{"no ports"}},
+		{
+			name:        "only cluster-only ports",
+			ports:       []corev1.ServicePort{http},
+			annotations: map[string]string{frp.AnnotationClusterOnlyPorts: "http"},
+			want:        []string{"publish nothing"},
+		},
+		{
+			name:  "too many ports",
+			ports: manyPorts(tunnel.MaxPublishedPorts + 1),
+			want:  []string{fmt.Sprintf("at most %d", tunnel.MaxPublishedPorts)},
+		},
+		{name: "as many ports as allowed", ports: manyPorts(tunnel.MaxPublishedPorts)},
+		{
+			name:        "invalid machine size",
+			ports:       []corev1.ServicePort{http},
+			annotations: map[string]string{tunnel.AnnotationFlyMachineSize: "huge"},
+			want:        []string{tunnel.AnnotationFlyMachineSize},
+		},
+		{
+			name:        "malformed region",
+			ports:       []corev1.ServicePort{http},
+			annotations: map[string]string{tunnel.AnnotationFlyRegion: "us-east-1"},
+			want:        []string{tunnel.AnnotationFlyRegion},
+		},
+		{
+			name:        "invalid frp annotation",
+			ports:       []corev1.ServicePort{http},
+			annotations: map[string]string{frp.AnnotationPoolCount: "many"},
+			want:        []string{frp.AnnotationPoolCount},
+		},
+		{
+			name:   "over the operator's ports per client",
+			ports:  manyPorts(3),
+			config: tunnel.Config{FrpsLimits: frp.ServerLimits{MaxPortsPerClient: 2}},
+			want:   []string{frp.AnnotationMaxPortsPerClient},
+		},
+		{
+			name:  "every problem at once",
+			ports: nil,
+			annotations: map[string]string{
+				tunnel.AnnotationFlyMachineSize: "huge",
+				tunnel.AnnotationFlyRegion:      "SYD",
+			},
+			want: []string{"no ports", tunnel.AnnotationFlyRegion, tunnel.AnnotationFlyMachineSize},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := testService("web", "default", tt.ports...)
+			for k, v := range tt.annotations {
+				svc.Annotations[k] = v
+			}
+			err := tunnel.ValidateService(svc, tt.config)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("expected a valid Service, got %v", err)
+				}
+				return
+			}
+			var verr *tunnel.ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected a *ValidationError, got %v", err)
+			}
+			if len(verr.Problems) != len(tt.want) {
+				t.Fatalf("expected %d problems, got %v", len(tt.want), verr.Problems)
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(verr.Problems[i].Error(), want) {
+					t.Errorf("expected problem %d to mention %q, got %q", i, want, verr.Problems[i])
+				}
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected the error to list %q, got %q", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownAnnotations(t *testing.T) {
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	svc.Annotations = map[string]string{
+		frp.AnnotationPoolCount:                                 "2",
+		tunnel.AnnotationPublicIP:                               "1.2.3.4",
+		frp.PortAnnotation("http", frp.AnnotationCompression):   "true",
+		"fly-tunnel-operator.dev/bandwith-limit":                "1MB",
+		frp.PortAnnotation("http", "fly-tunnel-operator.dev/x"): "1",
+		"fly-tunnel-operator.dev/retry":                         "1",
+		"example.com/unrelated":                                 "1",
+	}
+	got := tunnel.UnknownAnnotations(svc, "fly-tunnel-operator.dev/retry")
+	want := []string{"fly-tunnel-operator.dev/bandwith-limit", "fly-tunnel-operator.dev/port.http.x"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UnknownAnnotations = %v, want %v", got, want)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config tunnel.Config
+		want   []string
+	}{
+		{name: "valid", config: tunnel.Config{FlyRegion: "syd", FlyMachineSize: "shared-cpu-2x:1024"}},
+		{name: "default size", config: tunnel.Config{FlyRegion: "syd"}},
+		{name: "unknown size", config: tunnel.Config{FlyRegion: "syd", FlyMachineSize: "shared-cpu-3x"}, want: []string{"Machine size", "shared-cpu-3x"}},
+		{name: "invalid memory", config: tunnel.Config{FlyRegion: "syd", FlyMachineSize: "shared-cpu-1x:300"}, want: []string{"Machine size", "300"}},
+		{name: "typo in region", config: tunnel.Config{FlyRegion: "sydd"}, want: []string{"region", "sydd"}},
+		{name: "both", config: tunnel.Config{FlyRegion: "", FlyMachineSize: "huge"}, want: []string{"region", "Machine size"}},
+		{
+			name: "class defaults",
+			config: tunnel.Config{FlyRegion: "syd", ClassDefaults: map[string]tunnel.ClassDefaults{
+				"example.com/a": {FlyRegion: "ord"},
+				"example.com/b": {FlyMachineSize: "performance-2x"},
+			}},
+		},
+		{
+			name: "invalid class defaults",
+			config: tunnel.Config{FlyRegion: "syd", ClassDefaults: map[string]tunnel.ClassDefaults{
+				"example.com/a": {FlyRegion: "Chicago", FlyMachineSize: "huge"},
+			}},
+			want: []string{`class "example.com/a"`, "Chicago", "huge"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tunnel.ValidateConfig(tt.config)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("expected a valid config, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected the error to mention %q, got %q", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseClassDefaults(t *testing.T) {
+	got, err := tunnel.ParseClassDefaults(`{"example.com/premium": {"region": "ord", "machineSize": "performance-1x"}, "example.com/cheap": {}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]tunnel.ClassDefaults{
+		"example.com/premium": {FlyRegion: "ord", FlyMachineSize: "performance-1x"},
+		"example.com/cheap":   {},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseClassDefaults = %+v, want %+v", got, want)
+	}
+	if got, err := tunnel.ParseClassDefaults(""); err != nil || got != nil {
+		t.Errorf("expected no defaults from an empty value, got %v, %v", got, err)
+	}
+	if _, err := tunnel.ParseClassDefaults(`["ord"]`); err == nil {
+		t.Error("expected an error for a JSON array")
+	}
+}
+
+func TestCheckRegion(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+	client := newTestFlyClient(server)
+
+	if err := tunnel.CheckRegion(context.Background(), client, "syd"); err != nil {
+		t.Errorf("expected syd to be offered, got %v", err)
+	}
+	err := tunnel.CheckRegion(context.Background(), client, "xyz")
+	if err == nil || !strings.Contains(err.Error(), "xyz") || !strings.Contains(err.Error(), "syd") {
+		t.Errorf("expected an error naming xyz and the offered regions, got %v", err)
+	}
+}
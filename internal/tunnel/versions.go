@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/metrics"
+)
+
+const (
+	// AnnotationFrpcImage records the frpc image of the last successful
+	// Provision or Update.
+	AnnotationFrpcImage = "fly-tunnel-operator.dev/frpc-image"
+
+	// AnnotationFrpsImage records the frps image of the last successful
+	// Provision or Update.
+	AnnotationFrpsImage = "fly-tunnel-operator.dev/frps-image"
+
+	// AnnotationOperatorVersion records the operator version that performed
+	// the last successful Provision or Update.
+	AnnotationOperatorVersion = "fly-tunnel-operator.dev/operator-version"
+)
+
+// versionAnnotations returns the image and version annotations describing a
+// tunnel reconciled by this operator.
+func (m *Manager) versionAnnotations() map[string]string {
+	return map[string]string{
+		AnnotationFrpcImage:       m.config.FrpcImage,
+		AnnotationFrpsImage:       m.config.FrpsImage,
+		AnnotationOperatorVersion: m.config.OperatorVersion,
+	}
+}
+
+// recordVersions notes on svc, and in the image metrics, that its tunnel now
+// runs the configured images. The Service is only patched when they changed.
+func (m *Manager) recordVersions(ctx context.Context, svc *corev1.Service) error {
+	metrics.SetTunnelImages(svc.Namespace+"/"+svc.Name, m.config.FrpcImage, m.config.FrpsImage)
+
+	patch := client.MergeFrom(svc.DeepCopy())
+	changed := false
+	for key, value := range m.versionAnnotations() {
+		if svc.Annotations[key] != value {
+			svc.Annotations[key] = value
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := m.kubeClient.Patch(ctx, svc, patch); err != nil {
+		return fmt.Errorf("recording tunnel versions: %w", err)
+	}
+	return nil
+}
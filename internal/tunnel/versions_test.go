@@ -0,0 +1,70 @@
+package tunnel_test
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestVersions_TrackConfiguredImages(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	config := newTestConfig()
+	config.OperatorVersion = "v1.0.0"
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+	)
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	want := map[string]string{
+		tunnel.AnnotationFrpcImage:       config.FrpcImage,
+		tunnel.AnnotationFrpsImage:       config.FrpsImage,
+		tunnel.AnnotationOperatorVersion: "v1.0.0",
+	}
+	for key, value := range want {
+		if result.Versions[key] != value {
+			t.Errorf("expected Provision to report %s=%q, got %q", key, value, result.Versions[key])
+		}
+		svc.Annotations[key] = result.Versions[key]
+	}
+	annotateTunnelState(svc, result)
+	if err := kubeClient.Create(context.Background(), svc); err != nil {
+		t.Fatalf("creating service: %v", err)
+	}
+
+	// An operator upgrade changes both images.
+	config.FrpcImage = "snowdreamtech/frpc:0.62.0"
+	config.FrpsImage = "snowdreamtech/frps:0.62.0"
+	config.OperatorVersion = "v1.1.0"
+	upgraded := tunnel.NewManager(newTestFlyClient(server), kubeClient, config)
+	if _, err := upgraded.Update(context.Background(), svc); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	var stored corev1.Service
+	if err := kubeClient.Get(context.Background(), types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}, &stored); err != nil {
+		t.Fatalf("getting service: %v", err)
+	}
+	want = map[string]string{
+		tunnel.AnnotationFrpcImage:       "snowdreamtech/frpc:0.62.0",
+		tunnel.AnnotationFrpsImage:       "snowdreamtech/frps:0.62.0",
+		tunnel.AnnotationOperatorVersion: "v1.1.0",
+	}
+	for key, value := range want {
+		if got := stored.Annotations[key]; got != value {
+			t.Errorf("expected Update to record %s=%q, got %q", key, value, got)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/fakefly"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
+)
+
+func TestProvision_VhostProxies(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default",
+		corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP},
+	)
+	svc.Annotations[frp.PortAnnotation("http", frp.AnnotationProxyType)] = "http"
+	svc.Annotations[frp.AnnotationCustomDomains] = "app.example.com"
+	result, err := mgr.Provision(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	machine := server.GetMachines()[result.MachineID]
+	if !exposesPort(machine, frp.VhostHTTPPort) || !exposesPort(machine, 22) {
+		t.Errorf("expected the vhost port and the TCP port to be exposed, got %+v", machine.Config.Services)
+	}
+	if exposesPort(machine, 8080) {
+		t.Errorf("expected the http Service port not to be exposed, got %+v", machine.Config.Services)
+	}
+	config, err := frp.ParseServerConfig(server.AppSecrets(result.FlyApp)["FRP_SERVER_CONFIG"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.VhostHTTPPort != frp.VhostHTTPPort || config.VhostHTTPSPort != 0 {
+		t.Errorf("expected frps to serve http vhosts only, got %+v", config)
+	}
+}
+
+func TestProvision_VhostProxiesRejectedInGroup(t *testing.T) {
+	server := fakefly.NewServer()
+	defer server.Close()
+
+	kubeClient := fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(testOperatorNamespace()).Build()
+	mgr := tunnel.NewManager(newTestFlyClient(server), kubeClient, newTestConfig())
+
+	svc := testService("web", "default", corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP})
+	svc.Annotations[tunnel.AnnotationTunnelGroup] = "shared"
+	svc.Annotations[frp.AnnotationProxyType] = "http"
+	svc.Annotations[frp.AnnotationCustomDomains] = "app.example.com"
+	if _, err := mgr.Provision(context.Background(), svc); !errors.Is(err, tunnel.ErrPermanent) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+	if server.AppCount() != 0 {
+		t.Errorf("expected nothing to be created, got %d apps", server.AppCount())
+	}
+}
@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// warmUpDialTimeout bounds each warm-up probe connection.
+const warmUpDialTimeout = 5 * time.Second
+
+// NeedsWarmUp reports whether the Service asked for a pooled, pre-warmed
+// tunnel via frp.AnnotationPoolCount.
+func NeedsWarmUp(svc *corev1.Service) bool {
+	return frp.PoolCount(svc) > 0
+}
+
+// WarmUp opens and closes one connection to every public TCP port of the
+// tunnel, so the Fly proxy, frps and frpc have all established their side of
+// the path before the IP is published. UDP ports are skipped, as are random
+// remote ports not yet read back from frpc. Vhost proxies are warmed up on
+// their vhost port.
+func (m *Manager) WarmUp(ctx context.Context, svc *corev1.Service) error {
+	publicIP := svc.Annotations[AnnotationPublicIP]
+	if publicIP == "" {
+		return fmt.Errorf("service has no public IP annotation")
+	}
+
+	dialer := &net.Dialer{Timeout: warmUpDialTimeout}
+	for _, port := range publicPorts(svc) {
+		if port.Protocol != "tcp" {
+			continue
+		}
+
+		addr := net.JoinHostPort(publicIP, strconv.Itoa(port.RemotePort))
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("warm-up connection to %s: %w", addr, err)
+		}
+		_ = conn.Close()
+		log.FromContext(ctx).V(1).Info("Warmed up tunnel port", "address", addr)
+	}
+	return nil
+}
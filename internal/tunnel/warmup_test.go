@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+)
+
+// acceptCounter listens on a loopback port and counts accepted connections.
+func acceptCounter(t *testing.T) (port int32, accepted <-chan struct{}) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	ch := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			ch <- struct{}{}
+		}
+	}()
+	return int32(l.Addr().(*net.TCPAddr).Port), ch
+}
+
+func TestWarmUp_ProbesEveryTCPPort(t *testing.T) {
+	httpPort, httpAccepted := acceptCounter(t)
+	grpcPort, grpcAccepted := acceptCounter(t)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "api",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationPublicIP:      "127.0.0.1",
+				frp.AnnotationPoolCount: "2",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: httpPort, Protocol: corev1.ProtocolTCP},
+				{Name: "grpc", Port: grpcPort, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+	if !NeedsWarmUp(svc) {
+		t.Fatal("expected a pooled Service to need warm-up")
+	}
+
+	if err := (&Manager{}).WarmUp(context.Background(), svc); err != nil {
+		t.Fatalf("WarmUp failed: %v", err)
+	}
+	for name, ch := range map[string]<-chan struct{}{"http": httpAccepted, "grpc": grpcAccepted} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Errorf("expected a warm-up connection on %s", name)
+		}
+	}
+}
+
+func TestWarmUp_FailsWhenPortUnreachable(t *testing.T) {
+	// Grab a free port and close it so nothing is listening.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "api",
+			Namespace:   "default",
+			Annotations: map[string]string{AnnotationPublicIP: "127.0.0.1"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: int32(port), Protocol: corev1.ProtocolTCP}},
+		},
+	}
+
+	err = (&Manager{}).WarmUp(context.Background(), svc)
+	if err == nil {
+		t.Fatal("expected warm-up to fail")
+	}
+	if want := net.JoinHostPort("127.0.0.1", strconv.Itoa(port)); !strings.Contains(err.Error(), want) {
+		t.Errorf("expected error to name %s, got %v", want, err)
+	}
+}
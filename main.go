@@ -1,51 +1,169 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
 	"github.com/zhming0/fly-tunnel-operator/internal/controller"
+	"github.com/zhming0/fly-tunnel-operator/internal/events"
+	"github.com/zhming0/fly-tunnel-operator/internal/fingerprint"
 	"github.com/zhming0/fly-tunnel-operator/internal/flyio"
+	"github.com/zhming0/fly-tunnel-operator/internal/frp"
+	"github.com/zhming0/fly-tunnel-operator/internal/health"
+	"github.com/zhming0/fly-tunnel-operator/internal/metrics"
 	"github.com/zhming0/fly-tunnel-operator/internal/tunnel"
 )
 
 var scheme = runtime.NewScheme()
 
+// version is the operator version, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 }
 
 func main() {
 	var (
-		metricsAddr       string
-		healthProbeAddr   string
-		flyAPIToken       string
-		flyOrg            string
-		flyRegion         string
-		flyMachineSize    string
-		loadBalancerClass string
-		frpsImage         string
-		frpcImage         string
-		operatorNamespace string
+		metricsAddr         string
+		healthProbeAddr     string
+		flyAPIToken         string
+		flyOrg              string
+		flyRegion           string
+		flyMachineSize      string
+		loadBalancerClass   string
+		frpsImage           string
+		frpcImage           string
+		operatorNamespace   string
+		waitForFrpc         bool
+		waitForFrpcTimeout  time.Duration
+		auditConfigMap      string
+		auditConfigMapSize  int
+		flyAPIQPS           float64
+		flyAPIBurst         int
+		eventRateWindow     time.Duration
+		reconcileStall      time.Duration
+		migrationTimeout    time.Duration
+		suspiciousPorts     string
+		propagatePrefixes   string
+		clusterName         string
+		provisionTimeout    time.Duration
+		machineStartTimeout time.Duration
+		controlPort         int
+		manageFinalizer     bool
+		manageApps          bool
+		orphanGCInterval    time.Duration
+		updateTimeout       time.Duration
+		teardownTimeout     time.Duration
+		frpVerifyBinDir     string
+		explainIgnored      bool
+		publishDNSHints     bool
+		flyAPIMaxAttempts   int
+		flyAPIConcurrency   int
+		resyncInterval      time.Duration
+		resyncJitter        float64
+		maxTunnels          int
+		maxProvisionsHourly int
+		maxProvisionBackoff time.Duration
+		clusterDomain       string
+		frpcNodeSelector    string
+		frpcPullSecret      string
+		flyRegistryAuth     string
+		flyAPIBaseURL       string
+		flyGraphQLURL       string
+		frpcHeartbeat       frp.Heartbeat
+		frpsLimits          frp.ServerLimits
+		frpsLogLevel        string
+		frpcLogLevel        string
+		artifactTTLs        tunnel.ArtifactTTLs
+		verifyFlyRegion     bool
+		clusterRegion       string
+		clusterCoords       string
+		janitorInterval     time.Duration
+		classDefaultsJSON   string
 	)
 
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&healthProbeAddr, "health-probe-bind-address", ":8081", "The address the health probe endpoint binds to.")
 	flag.StringVar(&flyAPIToken, "fly-api-token", "", "Fly.io API token. Can also be set via FLY_API_TOKEN env var.")
 	flag.StringVar(&flyOrg, "fly-org", "", "Fly.io organization slug. Can also be set via FLY_ORG env var.")
+	flag.StringVar(&flyAPIBaseURL, "fly-api-base-url", "", "Base URL of the Fly.io Machines API, e.g. of a local fakefly. Defaults to the real API. Can also be set via FLY_API_BASE_URL env var.")
+	flag.StringVar(&flyGraphQLURL, "fly-graphql-url", "", "URL of the Fly.io GraphQL API, e.g. of a local fakefly. Defaults to the real API. Can also be set via FLY_GRAPHQL_URL env var.")
 	flag.StringVar(&flyRegion, "fly-region", "", "Fly.io region. Can also be set via FLY_REGION env var.")
-	flag.StringVar(&flyMachineSize, "fly-machine-size", "shared-cpu-1x", "Fly.io Machine size preset.")
-	flag.StringVar(&loadBalancerClass, "load-balancer-class", controller.DefaultLoadBalancerClass, "LoadBalancer class string to watch.")
+	flag.StringVar(&clusterRegion, "cluster-region", "", "Fly.io region nearest the cluster, for Services with fly-tunnel-operator.dev/fly-region: auto. Alternative to --cluster-coords.")
+	flag.StringVar(&clusterCoords, "cluster-coords", "", "Location of the cluster as <latitude>,<longitude> in degrees, for Services with fly-tunnel-operator.dev/fly-region: auto, which run in the Fly.io region nearest it.")
+	flag.BoolVar(&verifyFlyRegion, "verify-fly-region", false, "At startup, check with the Fly.io API that --fly-region exists, and exit if it does not.")
+	flag.StringVar(&flyMachineSize, "fly-machine-size", tunnel.DefaultMachineSize, "Fly.io Machine size preset, optionally with a memory size in MB (e.g. shared-cpu-2x:1024).")
+	flag.StringVar(&loadBalancerClass, "load-balancer-class", controller.DefaultLoadBalancerClass, "Comma-separated LoadBalancer classes to watch.")
+	flag.StringVar(&classDefaultsJSON, "class-defaults", "", `Fly.io region and Machine size per LoadBalancer class, as a JSON object, e.g. {"example.com/premium":{"region":"ord","machineSize":"performance-1x"}}. Classes not listed use --fly-region and --fly-machine-size.`)
 	flag.StringVar(&frpsImage, "frps-image", "snowdreamtech/frps:0.61.1@sha256:f18a0fd489b14d1fdfc68069239722f2ce3ab76b644aeb75219bf1df1b4bcea9", "Container image for frps.")
 	flag.StringVar(&frpcImage, "frpc-image", "snowdreamtech/frpc:0.61.1@sha256:55de10291630ca31e98a07120ad73e25977354a2307731cb28b0dc42f6987c59", "Container image for frpc.")
 	flag.StringVar(&operatorNamespace, "namespace", "", "Namespace for frpc deployments. Can also be set via OPERATOR_NAMESPACE env var.")
+	flag.BoolVar(&waitForFrpc, "wait-for-frpc", true, "Withhold the Service's external IP until the frpc Deployment has an available replica.")
+	flag.DurationVar(&waitForFrpcTimeout, "wait-for-frpc-timeout", 2*time.Minute, "How long to wait for frpc before publishing the IP anyway and marking the Service Degraded.")
+	flag.StringVar(&auditConfigMap, "audit-configmap", "", "If set, also keep recent fly.io API mutation audit records in this ConfigMap in the operator namespace.")
+	flag.IntVar(&auditConfigMapSize, "audit-configmap-size", 200, "Number of audit records kept in the audit ConfigMap.")
+	flag.Float64Var(&flyAPIQPS, "fly-api-qps", 0, "Client-side limit on Fly.io API requests per second. 0 disables the limit.")
+	flag.IntVar(&flyAPIBurst, "fly-api-burst", 10, "Burst size for --fly-api-qps.")
+	flag.IntVar(&flyAPIMaxAttempts, "fly-api-max-attempts", 4, "Attempts per Fly.io API call; reads are retried on 429 and 5xx, mutations only on 429 and 503, with jittered exponential backoff. 1 disables retries.")
+	flag.IntVar(&flyAPIConcurrency, "fly-api-max-concurrency", 0, "Maximum Fly.io API requests in flight at once, shared by drift checks and mutations. 0 disables the cap.")
+	flag.DurationVar(&resyncInterval, "resync-interval", 0, "If set, re-check every provisioned tunnel for drift this often. 0 disables periodic resync.")
+	flag.Float64Var(&resyncJitter, "resync-jitter", controller.DefaultResyncJitter, "Randomize each periodic resync by up to this fraction of --resync-interval, so tunnels are not checked in synchronized bursts.")
+	flag.DurationVar(&eventRateWindow, "event-rate-limit-window", events.DefaultWindow, "Emit at most one Warning event per Service and reason within this window. 0 disables rate limiting.")
+	flag.DurationVar(&migrationTimeout, "frpc-namespace-migration-timeout", 0, "If set, move frpc resources of existing tunnels into --namespace when it has changed, waiting this long for the moved frpc to become available. 0 leaves them where they are.")
+	flag.StringVar(&clusterName, "cluster-name", "", "Name of the cluster, part of the operator identity (with --fly-org and the loadBalancerClass) each Service is claimed with. Operators with another identity leave claimed Services alone.")
+	flag.StringVar(&propagatePrefixes, "propagate-label-prefixes", "", "Comma-separated key prefixes of the Service labels and annotations to copy onto its frpc Deployment, pods and config Secret, e.g. team,example.com/. The operator's own fly-tunnel-operator.dev/ annotations are never copied.")
+	flag.StringVar(&suspiciousPorts, "suspicious-ports", strings.Join(tunnel.DefaultSuspiciousPorts, ","), "Comma-separated port names and numbers that trigger a warning event when tunneled publicly. Empty disables the warning.")
+	flag.DurationVar(&machineStartTimeout, "machine-start-timeout", tunnel.DefaultMachineStartTimeout, "How long to wait for a fly.io Machine to start before rolling it back. Overridable per Service with the fly-tunnel-operator.dev/machine-start-timeout annotation.")
+	flag.IntVar(&controlPort, "frp-control-port", frp.DefaultServerPort, "Port frpc connects to frps on for new tunnels. If a Service publishes it, the next free port is used instead. Overridable per Service with the fly-tunnel-operator.dev/frp-control-port annotation.")
+	flag.StringVar(&clusterDomain, "cluster-domain", frp.DefaultClusterDomain, "Cluster DNS domain frpc resolves Services under, as <service>.<namespace>.svc.<domain>. Overridable per Service with the fly-tunnel-operator.dev/cluster-domain annotation.")
+	flag.StringVar(&frpcNodeSelector, "frpc-node-selector", "", "Comma-separated key=value node labels frpc pods are constrained to, e.g. egress=fly. Overridable per Service with the fly-tunnel-operator.dev/frpc-node-selector annotation.")
+	flag.StringVar(&frpcPullSecret, "frpc-image-pull-secret", "", "Name of a Secret in --namespace that frpc pods pull --frpc-image with, for a private registry.")
+	flag.DurationVar(&frpcHeartbeat.Interval, "frpc-heartbeat-interval", frp.DefaultHeartbeatInterval, "How often frpc sends frps a heartbeat, in whole seconds.")
+	flag.DurationVar(&frpcHeartbeat.Timeout, "frpc-heartbeat-timeout", frp.DefaultHeartbeatTimeout, "How long frpc goes without a heartbeat answer before reconnecting to frps; at least twice --frpc-heartbeat-interval.")
+	flag.IntVar(&frpsLimits.MaxPoolCount, "frps-max-pool-count", 0, "Cap on the work connections frps lets each proxy pool ahead of time, up to 5. 0 keeps the frps default of 5.")
+	flag.IntVar(&frpsLimits.MaxPortsPerClient, "frps-max-ports-per-client", 0, "Cap on the public ports one frpc may open on frps. 0 disables the cap. Overridable per Service with the fly-tunnel-operator.dev/frps-max-ports-per-client annotation.")
+	flag.StringVar(&frpsLogLevel, "frps-log-level", frp.DefaultLogLevel, "Level frps logs to stdout at, shown by fly logs: trace, debug, info, warn or error. Overridable per Service with the fly-tunnel-operator.dev/frps-log-level annotation.")
+	flag.StringVar(&frpcLogLevel, "frpc-log-level", frp.DefaultLogLevel, "Level frpc logs to stdout at: trace, debug, info, warn or error. Overridable per Service with the fly-tunnel-operator.dev/frpc-log-level annotation.")
+	flag.DurationVar(&frpsLimits.HeartbeatTimeout, "frps-heartbeat-timeout", 0, "How long frps keeps an frpc that stopped sending heartbeats, in whole seconds; at least twice --frpc-heartbeat-interval. 0 keeps the frps default of 90s.")
+	flag.StringVar(&flyRegistryAuth, "fly-registry-auth", "", "Credentials Fly.io pulls --frps-image with, as <username>:<password>@<server>, for a private registry. Can also be set via FLY_REGISTRY_AUTH env var.")
+	flag.BoolVar(&manageFinalizer, "manage-finalizer", true, "Add a finalizer to managed Services so their tunnel is always torn down before they go. If false, Services delete instantly and tunnels are torn down from observed delete events only; deletes missed while the operator is down leak Fly.io resources unless --orphan-gc-interval is set or they are cleaned up externally.")
+	flag.BoolVar(&manageApps, "manage-apps", true, "Create a dedicated Fly.io App for each tunnel and delete it on teardown. If false, each Service names an existing App in its fly-tunnel-operator.dev/fly-app annotation, which the operator only runs the tunnel's Machine and IPs in.")
+	flag.DurationVar(&orphanGCInterval, "orphan-gc-interval", 0, "If set, tear down tunnels whose Service no longer exists this often. 0 disables the orphan GC.")
+	flag.DurationVar(&artifactTTLs.Canary, "canary-ttl", 24*time.Hour, "How long a canary frpc Deployment outlives its last deploy before the janitor deletes it, once its Service has left canary mode or is gone. 0 keeps canaries until their Service removes them.")
+	flag.DurationVar(&artifactTTLs.Identity, "identity-ttl", 0, "How long a stable identity retained by a teardown waits for a Service to adopt it before the janitor deletes its Fly.io App, IP and record. 0 retains identities forever.")
+	flag.DurationVar(&janitorInterval, "janitor-interval", controller.DefaultJanitorInterval, "How often the janitor deletes artifacts whose --canary-ttl or --identity-ttl has expired.")
+	flag.DurationVar(&provisionTimeout, "provision-timeout", tunnel.DefaultOperationTimeouts.Provision, "Deadline for provisioning one tunnel. Resources created before it expires are recorded on the Service and reused by the next attempt. 0 disables the deadline.")
+	flag.DurationVar(&updateTimeout, "update-timeout", tunnel.DefaultOperationTimeouts.Update, "Deadline for updating one tunnel. 0 disables the deadline.")
+	flag.DurationVar(&teardownTimeout, "teardown-timeout", tunnel.DefaultOperationTimeouts.Teardown, "Deadline for tearing down one tunnel; the finalizer is kept and teardown retried if it expires. 0 disables the deadline.")
+	flag.StringVar(&frpVerifyBinDir, "frp-verify-bin-dir", "", "If set, run frpc and frps from this directory with 'verify' against sample generated configs at startup, and fail the readiness probe if they reject them.")
+	flag.BoolVar(&publishDNSHints, "publish-external-dns-hints", false, "Publish each tunnel's IPs in the external-dns.alpha.kubernetes.io/target annotation and its fly.dev hostname in fly-tunnel-operator.dev/fly-hostname, for external-dns or manual DNS. A target set by the user is left alone.")
+	flag.BoolVar(&explainIgnored, "explain-ignored", false, "Record a one-time event on each LoadBalancer Service the operator ignores, saying why (e.g. a different loadBalancerClass).")
+	flag.IntVar(&maxTunnels, "max-tunnels", 0, "Maximum number of provisioned tunnels. Further Services are left pending, with an event, until tunnels are removed or the limit is raised. 0 disables the limit.")
+	flag.IntVar(&maxProvisionsHourly, "max-provisions-per-hour", 0, "Maximum tunnel provisioning attempts in any hour. Further Services are left pending until the hour has passed. 0 disables the limit.")
+	flag.DurationVar(&maxProvisionBackoff, "max-provision-backoff", controller.DefaultMaxProvisionBackoff, "Longest wait between retries of a Service whose provisioning keeps failing. The wait starts at 5s and doubles with each failure. 0 leaves retries to the controller's rate limiter.")
+	flag.DurationVar(&reconcileStall, "reconcile-stall-timeout", 10*time.Minute, "Fail the liveness probe when a single reconcile runs longer than this.")
 
 	opts := zap.Options{Development: true}
 	opts.BindFlags(flag.CommandLine)
@@ -67,6 +185,15 @@ func main() {
 	if operatorNamespace == "" {
 		operatorNamespace = os.Getenv("OPERATOR_NAMESPACE")
 	}
+	if flyRegistryAuth == "" {
+		flyRegistryAuth = os.Getenv("FLY_REGISTRY_AUTH")
+	}
+	if flyAPIBaseURL == "" {
+		flyAPIBaseURL = os.Getenv("FLY_API_BASE_URL")
+	}
+	if flyGraphQLURL == "" {
+		flyGraphQLURL = os.Getenv("FLY_GRAPHQL_URL")
+	}
 	if operatorNamespace == "" {
 		operatorNamespace = "fly-tunnel-operator-system"
 	}
@@ -84,13 +211,126 @@ func main() {
 		setupLog.Error(nil, "fly-region or FLY_REGION is required")
 		os.Exit(1)
 	}
+	if err := frp.ValidateClusterDomain(clusterDomain); err != nil {
+		setupLog.Error(err, "invalid --cluster-domain")
+		os.Exit(1)
+	}
+	if err := frp.ValidateHeartbeat(frpcHeartbeat); err != nil {
+		setupLog.Error(err, "invalid --frpc-heartbeat-interval or --frpc-heartbeat-timeout")
+		os.Exit(1)
+	}
+	if err := frp.ValidateServerLimits(frpsLimits, frpcHeartbeat); err != nil {
+		setupLog.Error(err, "invalid frps limits")
+		os.Exit(1)
+	}
+	if err := frp.ValidateLogLevel(frpsLogLevel); err != nil {
+		setupLog.Error(err, "invalid --frps-log-level")
+		os.Exit(1)
+	}
+	if err := frp.ValidateLogLevel(frpcLogLevel); err != nil {
+		setupLog.Error(err, "invalid --frpc-log-level")
+		os.Exit(1)
+	}
+	var loadBalancerClasses []string
+	for _, class := range strings.Split(loadBalancerClass, ",") {
+		if class = strings.TrimSpace(class); class != "" {
+			loadBalancerClasses = append(loadBalancerClasses, class)
+		}
+	}
+	if len(loadBalancerClasses) == 0 {
+		setupLog.Error(nil, "--load-balancer-class must name at least one class")
+		os.Exit(1)
+	}
+	classDefaults, err := tunnel.ParseClassDefaults(classDefaultsJSON)
+	if err != nil {
+		setupLog.Error(err, "invalid --class-defaults")
+		os.Exit(1)
+	}
+	for class := range classDefaults {
+		if !slices.Contains(loadBalancerClasses, class) {
+			setupLog.Error(nil, "--class-defaults names a class not in --load-balancer-class", "class", class)
+			os.Exit(1)
+		}
+	}
+	if err := tunnel.ValidateConfig(tunnel.Config{FlyRegion: flyRegion, FlyMachineSize: flyMachineSize, ClassDefaults: classDefaults}); err != nil {
+		setupLog.Error(err, "invalid --fly-region, --fly-machine-size or --class-defaults")
+		os.Exit(1)
+	}
+	clusterLocation := tunnel.ClusterLocation{Region: clusterRegion}
+	if clusterRegion != "" && clusterCoords != "" {
+		setupLog.Error(nil, "--cluster-region and --cluster-coords are mutually exclusive")
+		os.Exit(1)
+	}
+	if clusterRegion != "" {
+		if err := tunnel.ValidateRegion(clusterRegion); err != nil {
+			setupLog.Error(err, "invalid --cluster-region")
+			os.Exit(1)
+		}
+	}
+	if clusterCoords != "" {
+		coords, err := tunnel.ParseCoordinates(clusterCoords)
+		if err != nil {
+			setupLog.Error(err, "invalid --cluster-coords")
+			os.Exit(1)
+		}
+		clusterLocation.Coordinates = &coords
+	}
+	nodeSelector, err := tunnel.ParseNodeSelector(frpcNodeSelector)
+	if err != nil {
+		setupLog.Error(err, "invalid --frpc-node-selector")
+		os.Exit(1)
+	}
+	var frpsRegistryAuth *flyio.RegistryAuth
+	if flyRegistryAuth != "" {
+		if frpsRegistryAuth, err = flyio.ParseRegistryAuth(flyRegistryAuth); err != nil {
+			setupLog.Error(err, "invalid --fly-registry-auth")
+			os.Exit(1)
+		}
+	}
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                  scheme,
-		HealthProbeBindAddress:  healthProbeAddr,
+	// Warn about frp images known not to understand the generated configs.
+	for _, image := range []string{frpsImage, frpcImage} {
+		if err := frp.CheckImageVersion(image); err != nil {
+			setupLog.Error(err, "incompatible frp image; tunnels using it will likely fail")
+		} else if _, ok := frp.ImageVersion(image); !ok {
+			setupLog.Info("cannot determine the frp version of image; compatibility not checked", "image", image)
+		}
+	}
+
+	// How this operator is configured, for support; credentials are redacted.
+	operatorFingerprint := fingerprint.New(version, flag.CommandLine)
+
+	// Per-component liveness, enumerated for humans on /healthz/detailed.
+	healthRegistry := health.NewRegistry()
+
+	restConfig := ctrl.GetConfigOrDie()
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
+		Scheme:                 scheme,
+		HealthProbeBindAddress: healthProbeAddr,
+		Metrics: metricsserver.Options{
+			BindAddress: metricsAddr,
+			ExtraHandlers: map[string]http.Handler{
+				"/healthz/detailed": healthRegistry.DetailedHandler(),
+				"/debug/config":     operatorFingerprint.Handler(),
+			},
+		},
 		LeaderElection:          true,
 		LeaderElectionID:        "fly-tunnel-operator",
 		LeaderElectionNamespace: operatorNamespace,
+		Client: client.Options{
+			// frpc config Secrets are read directly rather than caching
+			// every Secret in the cluster. So are ConfigMaps, whose cache
+			// below only holds the labelled frp options ConfigMaps.
+			Cache: &client.CacheOptions{DisableFor: []client.Object{&corev1.Secret{}, &corev1.ConfigMap{}}},
+		},
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				// frpc pods only ever live in the operator namespace.
+				&corev1.Pod{}: {Namespaces: map[string]cache.Config{operatorNamespace: {}}},
+				// Only frp options ConfigMaps are watched.
+				&corev1.ConfigMap{}: {Label: labels.SelectorFromSet(labels.Set{tunnel.LabelFrpOptions: "true"})},
+			},
+		},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to create manager")
@@ -98,40 +338,174 @@ func main() {
 	}
 
 	// Create the Fly.io API client.
-	flyClient := flyio.NewClient(flyAPIToken)
+	flyAPIRecorder := metrics.NewFlyAPIRecorder()
+	flyClient := flyio.NewClient(flyAPIToken).WithObserver(flyAPIRecorder).
+		WithRetry(flyAPIMaxAttempts, 500*time.Millisecond).
+		WithMaxConcurrentRequests(flyAPIConcurrency)
+	if flyAPIQPS > 0 {
+		flyClient.WithRateLimit(flyAPIQPS, flyAPIBurst)
+	}
+	if flyAPIBaseURL != "" {
+		flyClient.WithBaseURL(flyAPIBaseURL)
+	}
+	if flyGraphQLURL != "" {
+		flyClient.WithGraphQLURL(flyGraphQLURL)
+	}
+	if verifyFlyRegion {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := tunnel.CheckRegion(ctx, flyClient, flyRegion)
+		for class, defaults := range classDefaults {
+			if err == nil && defaults.FlyRegion != "" {
+				if err = tunnel.CheckRegion(ctx, flyClient, defaults.FlyRegion); err != nil {
+					err = fmt.Errorf("class %q: %w", class, err)
+				}
+			}
+		}
+		cancel()
+		if err != nil {
+			setupLog.Error(err, "invalid --fly-region or --class-defaults")
+			os.Exit(1)
+		}
+	}
+	if err := mgr.Add(healthRegistry.Runnable("fly-api-usage", flyAPIRecorder)); err != nil {
+		setupLog.Error(err, "unable to add Fly.io API usage summary")
+		os.Exit(1)
+	}
+	// The fingerprint ConfigMap is written at startup and again by each new
+	// leader, so it describes the replica doing the work.
+	for _, leader := range []bool{false, true} {
+		if err := mgr.Add(fingerprint.NewPublisher(mgr.GetClient(), operatorFingerprint, operatorNamespace, fingerprint.DefaultConfigMapName, leader)); err != nil {
+			setupLog.Error(err, "unable to add operator fingerprint")
+			os.Exit(1)
+		}
+	}
+	if auditConfigMap != "" {
+		flyClient.WithAuditSink(tunnel.NewConfigMapAuditSink(mgr.GetClient(), operatorNamespace, auditConfigMap, auditConfigMapSize))
+	}
+
+	// The typed clientset is only needed for the pods/log subresource.
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to create clientset")
+		os.Exit(1)
+	}
+
+	// Events for a persistently failing Service are rate-limited per reason.
+	recorder := events.NewRateLimitedRecorder(mgr.GetEventRecorderFor("fly-tunnel-operator"), eventRateWindow)
 
 	// Create the tunnel manager.
 	tunnelMgr := tunnel.NewManager(flyClient, mgr.GetClient(), tunnel.Config{
-		FlyOrg:            flyOrg,
-		FlyRegion:         flyRegion,
-		FlyMachineSize:    flyMachineSize,
-		FrpsImage:         frpsImage,
-		FrpcImage:         frpcImage,
-		OperatorNamespace: operatorNamespace,
-	})
+		FlyOrg:              flyOrg,
+		FlyRegion:           flyRegion,
+		FlyMachineSize:      flyMachineSize,
+		FrpsImage:           frpsImage,
+		FrpcImage:           frpcImage,
+		OperatorNamespace:   operatorNamespace,
+		OperatorVersion:     version,
+		MachineStartTimeout: machineStartTimeout,
+		ControlPort:         controlPort,
+		ClusterDomain:       clusterDomain,
+		FrpcNodeSelector:    nodeSelector,
+		FrpcImagePullSecret: frpcPullSecret,
+		FrpsRegistryAuth:    frpsRegistryAuth,
+		FrpcHeartbeat:       frpcHeartbeat,
+		FrpsLimits:          frpsLimits,
+		FrpsLogLevel:        frpsLogLevel,
+		FrpcLogLevel:        frpcLogLevel,
+		ArtifactTTLs:        artifactTTLs,
+		ClusterLocation:     clusterLocation,
+		ClassDefaults:       classDefaults,
+		ExternalApps:        !manageApps,
+		PropagatePrefixes:   splitList(propagatePrefixes),
+		ClusterName:         clusterName,
+	}).WithEventRecorder(recorder).WithPodLogs(clientset.CoreV1()).WithNamespaceMigration(migrationTimeout).
+		WithSuspiciousPorts(splitList(suspiciousPorts)).
+		WithOperationTimeouts(tunnel.OperationTimeouts{
+			Provision: provisionTimeout,
+			Update:    updateTimeout,
+			Teardown:  teardownTimeout,
+		})
 
 	// Set up the Service reconciler.
-	reconciler := controller.NewServiceReconciler(mgr.GetClient(), tunnelMgr, loadBalancerClass)
+	reconciler := controller.NewServiceReconciler(mgr.GetClient(), tunnelMgr, loadBalancerClasses...).
+		WithEventRecorder(recorder).
+		WithHeartbeat(healthRegistry.Heartbeat("controller", reconcileStall)).
+		WithResync(resyncInterval, resyncJitter).
+		WithProvisionLimits(maxTunnels, maxProvisionsHourly).
+		WithProvisionBackoff(maxProvisionBackoff)
+	if waitForFrpc {
+		reconciler.WithFrpcReadyGate(waitForFrpcTimeout)
+	}
+	if explainIgnored {
+		reconciler.WithExplainIgnored()
+	}
+	if publishDNSHints {
+		reconciler.WithExternalDNSHints()
+	}
+	if !manageFinalizer {
+		reconciler.WithoutFinalizer()
+		if orphanGCInterval == 0 {
+			setupLog.Info("Finalizer disabled without --orphan-gc-interval; tunnels of Services deleted while the operator is down will leak")
+		}
+	}
 	if err := reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Service")
 		os.Exit(1)
 	}
+	if err := mgr.Add(healthRegistry.Runnable("ignored-services", reconciler.IgnoredServicesSummary(controller.DefaultIgnoredSummaryInterval))); err != nil {
+		setupLog.Error(err, "unable to add ignored Services summary")
+		os.Exit(1)
+	}
+
+	if orphanGCInterval > 0 {
+		if err := mgr.Add(healthRegistry.Runnable("orphan-gc", reconciler.OrphanCollector(orphanGCInterval))); err != nil {
+			setupLog.Error(err, "unable to add orphan GC")
+			os.Exit(1)
+		}
+	}
+	if (artifactTTLs.Canary > 0 || artifactTTLs.Identity > 0) && janitorInterval > 0 {
+		if err := mgr.Add(healthRegistry.Runnable("janitor", reconciler.ArtifactJanitor(janitorInterval))); err != nil {
+			setupLog.Error(err, "unable to add artifact janitor")
+			os.Exit(1)
+		}
+	}
 
 	// Add health and readiness checks.
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
+	for _, s := range healthRegistry.Statuses() {
+		if err := mgr.AddHealthzCheck(s.Name, healthRegistry.Checker(s.Name)); err != nil {
+			setupLog.Error(err, "unable to set up health check", "component", s.Name)
+			os.Exit(1)
+		}
+	}
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if frpVerifyBinDir != "" {
+		verifyCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		verifyErr := frp.VerifyBinaries(verifyCtx,
+			filepath.Join(frpVerifyBinDir, "frpc"), filepath.Join(frpVerifyBinDir, "frps"))
+		cancel()
+		if verifyErr != nil {
+			setupLog.Error(verifyErr, "frp rejected the generated configs; refusing to become ready", "binDir", frpVerifyBinDir)
+		}
+		if err := mgr.AddReadyzCheck("frp-config", func(*http.Request) error { return verifyErr }); err != nil {
+			setupLog.Error(err, "unable to set up ready check")
+			os.Exit(1)
+		}
+	}
 
 	setupLog.Info("starting manager",
+		"version", version,
 		"flyOrg", flyOrg,
 		"flyRegion", flyRegion,
-		"loadBalancerClass", loadBalancerClass,
+		"loadBalancerClasses", loadBalancerClasses,
 		"namespace", operatorNamespace,
+		"configHash", operatorFingerprint.ConfigHash,
 	)
 
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
@@ -139,3 +513,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}